@@ -29,6 +29,7 @@ require (
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/johannesboyne/gofakes3 v0.0.0-20200716060623-6b2b4cb092cc
 	github.com/julienschmidt/httprouter v1.2.0
+	github.com/klauspost/compress v1.15.15
 	github.com/lib/pq v1.10.2
 	github.com/msteinert/pam v0.0.0-20190215180659-f29b9f28d6f9
 	github.com/prometheus/client_golang v1.7.1
@@ -75,6 +75,10 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		err = fmt.Errorf("unsupported cloud driver %q", cluster.Containers.CloudVMs.Driver)
 		return 1
 	}
+	params, err := dispatchcloud.DriverParameters(cluster)
+	if err != nil {
+		return 1
+	}
 	if *imageID == "" {
 		*imageID = cluster.Containers.CloudVMs.ImageID
 	}
@@ -95,7 +99,7 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		SyncInterval:     cluster.Containers.CloudVMs.SyncInterval.Duration(),
 		TimeoutBooting:   cluster.Containers.CloudVMs.TimeoutBooting.Duration(),
 		Driver:           driver,
-		DriverParameters: cluster.Containers.CloudVMs.DriverParameters,
+		DriverParameters: params,
 		ImageID:          cloud.ImageID(*imageID),
 		InstanceType:     it,
 		SSHKey:           key,
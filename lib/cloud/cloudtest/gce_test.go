@@ -0,0 +1,84 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package cloudtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/cloud/gce"
+	"git.arvados.org/arvados.git/lib/cloud/gce/gcetest"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&GCETesterSuite{})
+
+// GCETesterSuite runs the tester against the gce driver, using a
+// stand-in for the GCE API.
+type GCETesterSuite struct {
+	server *gcetest.Server
+	tester *tester
+	log    bytes.Buffer
+}
+
+func (s *GCETesterSuite) SetUpTest(c *check.C) {
+	_, privkey := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	_, privhostkey := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_vm")
+	s.server = &gcetest.Server{HostKey: privhostkey, PageSize: 2}
+	s.server.Start()
+	params, err := json.Marshal(map[string]string{
+		"Project":       "test-project",
+		"Zone":          "test-zone",
+		"AdminUsername": "crunch",
+		"APIEndpoint":   s.server.Endpoint(),
+	})
+	c.Assert(err, check.IsNil)
+	s.log.Reset()
+	s.tester = &tester{
+		Logger:           ctxlog.New(&s.log, "text", "info"),
+		Tags:             cloud.SharedResourceTags{"testtagkey": "testtagvalue"},
+		TagKeyPrefix:     "tagprefix:",
+		SetID:            cloud.InstanceSetID("test-instance-set-id"),
+		ProbeInterval:    5 * time.Millisecond,
+		SyncInterval:     10 * time.Millisecond,
+		TimeoutBooting:   10 * time.Second,
+		Driver:           gce.Driver,
+		DriverParameters: params,
+		InstanceType:     test.InstanceType(2),
+		ImageID:          "test-image-id",
+		SSHKey:           privkey,
+		BootProbeCommand: "crunch-run --list",
+		ShellCommand:     "true",
+	}
+}
+
+func (s *GCETesterSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *GCETesterSuite) TestSuccess(c *check.C) {
+	s.tester.Logger = ctxlog.TestLogger(c)
+	ok := s.tester.Run()
+	c.Check(ok, check.Equals, true)
+}
+
+func (s *GCETesterSuite) TestBootFail(c *check.C) {
+	s.tester.BootProbeCommand = "falsey"
+	s.tester.TimeoutBooting = 150 * time.Millisecond
+	ok := s.tester.Run()
+	c.Check(ok, check.Equals, false)
+	c.Check(s.log.String(), check.Matches, `(?ms).*\\"falsey\\": command not found.*`)
+}
+
+func (s *GCETesterSuite) TestShellCommandFail(c *check.C) {
+	s.tester.ShellCommand = "falsey"
+	ok := s.tester.Run()
+	c.Check(ok, check.Equals, false)
+	c.Check(s.log.String(), check.Matches, `(?ms).*\\"falsey\\": command not found.*`)
+}
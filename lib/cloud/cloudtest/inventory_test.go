@@ -0,0 +1,101 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package cloudtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/cloud/inventory"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"golang.org/x/crypto/ssh"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&InventoryTesterSuite{})
+
+// InventoryTesterSuite runs the tester against the inventory driver,
+// using a local SSH server as the only host in the inventory.
+type InventoryTesterSuite struct {
+	sshd   *test.SSHService
+	tester *tester
+	log    bytes.Buffer
+}
+
+func (s *InventoryTesterSuite) SetUpTest(c *check.C) {
+	pubkey, privkey := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	_, privhostkey := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_vm")
+	s.sshd = &test.SSHService{
+		Exec: func(env map[string]string, command string, stdin io.Reader, stdout, stderr io.Writer) uint32 {
+			if command == "true" || command == "crunch-run --list" {
+				return 0
+			}
+			fmt.Fprintf(stderr, "%q: command not found\n", command)
+			return 1
+		},
+		HostKey:        privhostkey,
+		AuthorizedUser: "root",
+		AuthorizedKeys: []ssh.PublicKey{pubkey},
+	}
+	c.Assert(s.sshd.Start(), check.IsNil)
+	params, err := json.Marshal(map[string]interface{}{
+		"StateFile":      c.MkDir() + "/state.json",
+		"PrivateKeyFile": "../../dispatchcloud/test/sshkey_dispatch",
+		"Hosts": map[string]interface{}{
+			"host1": map[string]string{
+				"Address":      s.sshd.Address(),
+				"ProviderType": test.InstanceType(2).ProviderType,
+				"HostKey":      string(ssh.MarshalAuthorizedKey(privhostkey.PublicKey())),
+			},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	s.log.Reset()
+	s.tester = &tester{
+		Logger:           ctxlog.New(&s.log, "text", "info"),
+		Tags:             cloud.SharedResourceTags{"testtagkey": "testtagvalue"},
+		TagKeyPrefix:     "tagprefix:",
+		SetID:            cloud.InstanceSetID("test-instance-set-id"),
+		ProbeInterval:    5 * time.Millisecond,
+		SyncInterval:     10 * time.Millisecond,
+		TimeoutBooting:   150 * time.Millisecond,
+		Driver:           inventory.Driver,
+		DriverParameters: params,
+		InstanceType:     test.InstanceType(2),
+		ImageID:          "test-image-id",
+		SSHKey:           privkey,
+		BootProbeCommand: "crunch-run --list",
+		ShellCommand:     "true",
+	}
+}
+
+func (s *InventoryTesterSuite) TearDownTest(c *check.C) {
+	s.sshd.Close()
+}
+
+func (s *InventoryTesterSuite) TestSuccess(c *check.C) {
+	s.tester.Logger = ctxlog.TestLogger(c)
+	ok := s.tester.Run()
+	c.Check(ok, check.Equals, true)
+}
+
+func (s *InventoryTesterSuite) TestBootFail(c *check.C) {
+	s.tester.BootProbeCommand = "falsey"
+	ok := s.tester.Run()
+	c.Check(ok, check.Equals, false)
+	c.Check(s.log.String(), check.Matches, `(?ms).*\\"falsey\\": command not found.*`)
+}
+
+func (s *InventoryTesterSuite) TestShellCommandFail(c *check.C) {
+	s.tester.ShellCommand = "falsey"
+	ok := s.tester.Run()
+	c.Check(ok, check.Equals, false)
+	c.Check(s.log.String(), check.Matches, `(?ms).*\\"falsey\\": command not found.*`)
+}
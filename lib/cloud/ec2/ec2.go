@@ -337,6 +337,15 @@ func (inst *ec2Instance) RemoteUser() string {
 	return inst.provider.ec2config.AdminUsername
 }
 
+// Preempted implements cloud.PreemptibleInstance. It returns true if
+// EC2 has stopped (or is stopping) the instance to reclaim spot
+// capacity. Spot instances that are terminated on interruption are
+// not listed by Instances() at all.
+func (inst *ec2Instance) Preempted() bool {
+	return inst.instance.StateReason != nil &&
+		aws.StringValue(inst.instance.StateReason.Code) == "Server.SpotInstanceTermination"
+}
+
 func (inst *ec2Instance) VerifyHostKey(ssh.PublicKey, *ssh.Client) error {
 	return cloud.ErrNotImplemented
 }
@@ -350,23 +359,33 @@ func (err rateLimitError) EarliestRetry() time.Time {
 	return err.earliestRetry
 }
 
-var isCodeCapacity = map[string]bool{
-	"InsufficientInstanceCapacity": true,
+var isCodeQuota = map[string]bool{
 	"VcpuLimitExceeded":            true,
 	"MaxSpotInstanceCountExceeded": true,
 }
 
-// isErrorCapacity returns whether the error is to be throttled based on its code.
-// Returns false if error is nil.
-func isErrorCapacity(err error) bool {
+// isErrorQuota returns whether the error indicates the account
+// cannot create more instances, based on its code. Returns false if
+// error is nil.
+func isErrorQuota(err error) bool {
 	if aerr, ok := err.(awserr.Error); ok && aerr != nil {
-		if _, ok := isCodeCapacity[aerr.Code()]; ok {
+		if _, ok := isCodeQuota[aerr.Code()]; ok {
 			return true
 		}
 	}
 	return false
 }
 
+// isErrorCapacity returns whether the error indicates AWS does not
+// have enough capacity for the requested instance type, based on its
+// code. Returns false if error is nil.
+func isErrorCapacity(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok && aerr != nil {
+		return aerr.Code() == "InsufficientInstanceCapacity"
+	}
+	return false
+}
+
 type ec2QuotaError struct {
 	error
 }
@@ -375,6 +394,14 @@ func (er *ec2QuotaError) IsQuotaError() bool {
 	return true
 }
 
+type ec2CapacityError struct {
+	error
+}
+
+func (er *ec2CapacityError) IsCapacityError() bool {
+	return true
+}
+
 func wrapError(err error, throttleValue *atomic.Value) error {
 	if request.IsErrorThrottle(err) {
 		// Back off exponentially until an upstream call
@@ -388,8 +415,10 @@ func wrapError(err error, throttleValue *atomic.Value) error {
 		}
 		throttleValue.Store(d)
 		return rateLimitError{error: err, earliestRetry: time.Now().Add(d)}
-	} else if isErrorCapacity(err) {
+	} else if isErrorQuota(err) {
 		return &ec2QuotaError{err}
+	} else if isErrorCapacity(err) {
+		return &ec2CapacityError{err}
 	} else if err != nil {
 		throttleValue.Store(time.Duration(0))
 		return err
@@ -254,8 +254,33 @@ func (*EC2InstanceSetSuite) TestWrapError(c *check.C) {
 	_, ok := wrapped.(cloud.RateLimitError)
 	c.Check(ok, check.Equals, true)
 
-	quotaError := awserr.New("InsufficientInstanceCapacity", "", nil)
+	quotaError := awserr.New("VcpuLimitExceeded", "", nil)
 	wrapped = wrapError(quotaError, nil)
 	_, ok = wrapped.(cloud.QuotaError)
 	c.Check(ok, check.Equals, true)
+
+	capacityError := awserr.New("InsufficientInstanceCapacity", "", nil)
+	wrapped = wrapError(capacityError, nil)
+	_, ok = wrapped.(cloud.CapacityError)
+	c.Check(ok, check.Equals, true)
+	_, ok = wrapped.(cloud.QuotaError)
+	c.Check(ok, check.Equals, false)
+}
+
+func (*EC2InstanceSetSuite) TestPreempted(c *check.C) {
+	var inst cloud.Instance = &ec2Instance{instance: &ec2.Instance{
+		State: &ec2.InstanceState{Name: aws.String("running")},
+	}}
+	pi, ok := inst.(cloud.PreemptibleInstance)
+	c.Assert(ok, check.Equals, true)
+	c.Check(pi.Preempted(), check.Equals, false)
+
+	inst = &ec2Instance{instance: &ec2.Instance{
+		State: &ec2.InstanceState{Name: aws.String("stopped")},
+		StateReason: &ec2.StateReason{
+			Code:    aws.String("Server.SpotInstanceTermination"),
+			Message: aws.String("Server.SpotInstanceTermination: Spot instance termination"),
+		},
+	}}
+	c.Check(inst.(cloud.PreemptibleInstance).Preempted(), check.Equals, true)
 }
@@ -0,0 +1,566 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package gce
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Driver is the gce implementation of the cloud.Driver interface.
+var Driver = cloud.DriverFunc(newGCEInstanceSet)
+
+const (
+	throttleDelayMin = time.Second
+	throttleDelayMax = time.Minute
+
+	// Size of each local SSD partition attached to provide
+	// AddedScratch.
+	localSSDSize = 375 << 30
+
+	// Instance metadata key used to store the exact tags given
+	// to Create and SetTags. GCE labels can only hold a
+	// lowercase subset of the tag keys and values, so they are
+	// used for filtering but not as the source of truth.
+	tagsMetadataKey = "arvados-tags"
+
+	// Maximum time to wait for a setLabels/setMetadata operation
+	// to finish, or for an instance to appear after an insert
+	// operation starts.
+	operationTimeout = 5 * time.Minute
+
+	// Interval between checks for a new instance while an
+	// insert operation is in progress.
+	createPollInterval = 2 * time.Second
+)
+
+type gceInstanceSetConfig struct {
+	Project         string
+	Zone            string
+	CredentialsFile string
+	Network         string
+	Subnet          string
+	ServiceAccount  string
+	AdminUsername   string
+
+	// Alternate API endpoint, e.g., for Private Google Access.
+	// If it uses http:// rather than https://, requests are
+	// sent without credentials.
+	APIEndpoint string
+}
+
+type gceInstanceSet struct {
+	gceconfig              gceInstanceSetConfig
+	instanceSetID          cloud.InstanceSetID
+	logger                 logrus.FieldLogger
+	service                *compute.Service
+	ctx                    context.Context
+	stopFunc               context.CancelFunc
+	throttleDelayCreate    atomic.Value
+	throttleDelayInstances atomic.Value
+}
+
+func newGCEInstanceSet(config json.RawMessage, instanceSetID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger) (prv cloud.InstanceSet, err error) {
+	instanceSet := &gceInstanceSet{
+		instanceSetID: instanceSetID,
+		logger:        logger,
+	}
+	err = json.Unmarshal(config, &instanceSet.gceconfig)
+	if err != nil {
+		return nil, err
+	}
+	if instanceSet.gceconfig.Project == "" {
+		return nil, errors.New("Project is not configured")
+	}
+	if instanceSet.gceconfig.Zone == "" {
+		return nil, errors.New("Zone is not configured")
+	}
+	if instanceSet.gceconfig.Network == "" && instanceSet.gceconfig.Subnet == "" {
+		instanceSet.gceconfig.Network = "global/networks/default"
+	}
+
+	var opts []option.ClientOption
+	if ep := instanceSet.gceconfig.APIEndpoint; ep != "" {
+		opts = append(opts, option.WithEndpoint(ep))
+		if strings.HasPrefix(ep, "http://") {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+	}
+	if fnm := instanceSet.gceconfig.CredentialsFile; fnm != "" {
+		opts = append(opts, option.WithCredentialsFile(fnm))
+	}
+	instanceSet.ctx, instanceSet.stopFunc = context.WithCancel(context.Background())
+	instanceSet.service, err = compute.NewService(instanceSet.ctx, opts...)
+	if err != nil {
+		instanceSet.stopFunc()
+		return nil, err
+	}
+	return instanceSet, nil
+}
+
+func (instanceSet *gceInstanceSet) Create(
+	instanceType arvados.InstanceType,
+	imageID cloud.ImageID,
+	newTags cloud.InstanceTags,
+	initCommand cloud.InitCommand,
+	publicKey ssh.PublicKey) (cloud.Instance, error) {
+
+	tagsJSON, err := json.Marshal(newTags)
+	if err != nil {
+		return nil, err
+	}
+	zone := "zones/" + instanceSet.gceconfig.Zone
+	inst := &compute.Instance{
+		Name:        "arvados-" + randomHex(20),
+		MachineType: zone + "/machineTypes/" + instanceType.ProviderType,
+		Labels:      labels(newTags),
+		Metadata: &compute.Metadata{
+			Items: []*compute.MetadataItems{
+				{Key: "startup-script", Value: googleapi.String("#!/bin/sh\n" + string(initCommand) + "\n")},
+				{Key: "ssh-keys", Value: googleapi.String(instanceSet.gceconfig.AdminUsername + ":" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))))},
+				{Key: tagsMetadataKey, Value: googleapi.String(string(tagsJSON))},
+			},
+		},
+		Disks: []*compute.AttachedDisk{{
+			Boot:       true,
+			AutoDelete: true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				SourceImage: imageURL(imageID),
+			},
+		}},
+		NetworkInterfaces: []*compute.NetworkInterface{{
+			Network:    instanceSet.gceconfig.Network,
+			Subnetwork: instanceSet.gceconfig.Subnet,
+		}},
+	}
+
+	if sa := instanceSet.gceconfig.ServiceAccount; sa != "" {
+		inst.ServiceAccounts = []*compute.ServiceAccount{{
+			Email:  sa,
+			Scopes: []string{compute.CloudPlatformScope},
+		}}
+	}
+
+	// Local SSDs come in fixed-size partitions, so round up.
+	for n := (int64(instanceType.AddedScratch) + localSSDSize - 1) / localSSDSize; n > 0; n-- {
+		inst.Disks = append(inst.Disks, &compute.AttachedDisk{
+			Type:       "SCRATCH",
+			Interface:  "NVME",
+			AutoDelete: true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				DiskType: zone + "/diskTypes/local-ssd",
+			},
+		})
+	}
+
+	if instanceType.Preemptible {
+		inst.Scheduling = &compute.Scheduling{
+			Preemptible:       true,
+			AutomaticRestart:  googleapi.Bool(false),
+			OnHostMaintenance: "TERMINATE",
+		}
+	}
+
+	op, err := instanceSet.service.Instances.Insert(instanceSet.gceconfig.Project, instanceSet.gceconfig.Zone, inst).Context(instanceSet.ctx).Do()
+	if err == nil {
+		inst, err = instanceSet.waitCreated(op, inst.Name)
+	}
+	err = wrapError(err, &instanceSet.throttleDelayCreate)
+	if err != nil {
+		return nil, err
+	}
+	return &gceInstance{
+		provider: instanceSet,
+		instance: inst,
+	}, nil
+}
+
+// waitCreated waits until the instance being created by the given
+// insert operation exists, and returns it. It returns an error if
+// the operation fails first, e.g., because the zone does not have
+// enough capacity.
+//
+// It does not wait for the operation to finish, which can take
+// minutes while the instance boots. The worker pool's probes
+// detect when the instance is ready.
+func (instanceSet *gceInstanceSet) waitCreated(op *compute.Operation, name string) (*compute.Instance, error) {
+	ctx, cancel := context.WithTimeout(instanceSet.ctx, operationTimeout)
+	defer cancel()
+	project, zone := instanceSet.gceconfig.Project, instanceSet.gceconfig.Zone
+	for {
+		if op.Status == "DONE" && op.Error != nil && len(op.Error.Errors) > 0 {
+			return nil, &operationError{op.Error.Errors}
+		}
+		inst, err := instanceSet.service.Instances.Get(project, zone, name).Context(ctx).Do()
+		if err == nil {
+			return inst, nil
+		} else if err, ok := err.(*googleapi.Error); !ok || err.Code != http.StatusNotFound {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(createPollInterval):
+		}
+		op, err = instanceSet.service.ZoneOperations.Get(project, zone, op.Name).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (instanceSet *gceInstanceSet) Instances(tags cloud.InstanceTags) (instances []cloud.Instance, err error) {
+	// Filter by labels on the server side, then check the exact
+	// tag values, which might have been lost in translation to
+	// labels.
+	var filters []string
+	for k, v := range labels(tags) {
+		if v != "" {
+			filters = append(filters, fmt.Sprintf("(labels.%s = %q)", k, v))
+		}
+	}
+	sort.Strings(filters)
+	call := instanceSet.service.Instances.List(instanceSet.gceconfig.Project, instanceSet.gceconfig.Zone)
+	if len(filters) > 0 {
+		call = call.Filter(strings.Join(filters, " "))
+	}
+	err = call.Pages(instanceSet.ctx, func(page *compute.InstanceList) error {
+		for _, inst := range page.Items {
+			gi := &gceInstance{provider: instanceSet, instance: inst}
+			if hasTags(gi.Tags(), tags) {
+				instances = append(instances, gi)
+			}
+		}
+		return nil
+	})
+	err = wrapError(err, &instanceSet.throttleDelayInstances)
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+func (instanceSet *gceInstanceSet) Stop() {
+	instanceSet.stopFunc()
+}
+
+// waitOperation waits for a zone operation to finish, and returns
+// an error if the operation failed.
+func (instanceSet *gceInstanceSet) waitOperation(op *compute.Operation) error {
+	ctx, cancel := context.WithTimeout(instanceSet.ctx, operationTimeout)
+	defer cancel()
+	for op.Status != "DONE" {
+		var err error
+		op, err = instanceSet.service.ZoneOperations.Wait(instanceSet.gceconfig.Project, instanceSet.gceconfig.Zone, op.Name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return &operationError{op.Error.Errors}
+	}
+	return nil
+}
+
+type gceInstance struct {
+	provider *gceInstanceSet
+	instance *compute.Instance
+}
+
+func (inst *gceInstance) ID() cloud.InstanceID {
+	return cloud.InstanceID(inst.instance.Name)
+}
+
+func (inst *gceInstance) String() string {
+	return inst.instance.Name
+}
+
+func (inst *gceInstance) ProviderType() string {
+	return path.Base(inst.instance.MachineType)
+}
+
+func (inst *gceInstance) SetTags(newTags cloud.InstanceTags) error {
+	tagsJSON, err := json.Marshal(newTags)
+	if err != nil {
+		return err
+	}
+	project, zone := inst.provider.gceconfig.Project, inst.provider.gceconfig.Zone
+	ctx := inst.provider.ctx
+
+	// Get the current fingerprints, which are required to
+	// update metadata and labels.
+	cur, err := inst.provider.service.Instances.Get(project, zone, inst.instance.Name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	md := &compute.Metadata{}
+	if cur.Metadata != nil {
+		md.Fingerprint = cur.Metadata.Fingerprint
+		for _, item := range cur.Metadata.Items {
+			if item.Key != tagsMetadataKey {
+				md.Items = append(md.Items, item)
+			}
+		}
+	}
+	md.Items = append(md.Items, &compute.MetadataItems{Key: tagsMetadataKey, Value: googleapi.String(string(tagsJSON))})
+	op, err := inst.provider.service.Instances.SetMetadata(project, zone, inst.instance.Name, md).Context(ctx).Do()
+	if err == nil {
+		err = inst.provider.waitOperation(op)
+	}
+	if err != nil {
+		return err
+	}
+	op, err = inst.provider.service.Instances.SetLabels(project, zone, inst.instance.Name, &compute.InstancesSetLabelsRequest{
+		Labels:           labels(newTags),
+		LabelFingerprint: cur.LabelFingerprint,
+	}).Context(ctx).Do()
+	if err == nil {
+		err = inst.provider.waitOperation(op)
+	}
+	return err
+}
+
+func (inst *gceInstance) Tags() cloud.InstanceTags {
+	if inst.instance.Metadata != nil {
+		for _, item := range inst.instance.Metadata.Items {
+			if item.Key != tagsMetadataKey || item.Value == nil {
+				continue
+			}
+			var tags cloud.InstanceTags
+			if err := json.Unmarshal([]byte(*item.Value), &tags); err == nil {
+				return tags
+			}
+		}
+	}
+	// Instance was created or modified by something other than
+	// this driver. Labels are the best we can do.
+	tags := cloud.InstanceTags{}
+	for k, v := range inst.instance.Labels {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (inst *gceInstance) Destroy() error {
+	_, err := inst.provider.service.Instances.Delete(inst.provider.gceconfig.Project, inst.provider.gceconfig.Zone, inst.instance.Name).Context(inst.provider.ctx).Do()
+	return err
+}
+
+func (inst *gceInstance) Address() string {
+	if len(inst.instance.NetworkInterfaces) > 0 {
+		return inst.instance.NetworkInterfaces[0].NetworkIP
+	}
+	return ""
+}
+
+func (inst *gceInstance) RemoteUser() string {
+	return inst.provider.gceconfig.AdminUsername
+}
+
+// Preempted implements cloud.PreemptibleInstance. GCE stops a
+// preempted instance rather than deleting it, so it remains listed
+// with status TERMINATED until the dispatcher destroys it.
+func (inst *gceInstance) Preempted() bool {
+	return inst.instance.Scheduling != nil &&
+		inst.instance.Scheduling.Preemptible &&
+		inst.instance.Status == "TERMINATED"
+}
+
+func (inst *gceInstance) VerifyHostKey(ssh.PublicKey, *ssh.Client) error {
+	return cloud.ErrNotImplemented
+}
+
+// imageURL returns a source image URL for the given ImageID, which
+// can be a full or partial URL, or the name of an image in the
+// configured project.
+func imageURL(imageID cloud.ImageID) string {
+	if strings.Contains(string(imageID), "/") {
+		return string(imageID)
+	}
+	return "global/images/" + string(imageID)
+}
+
+// labels converts tags to GCE labels. Keys and values are converted
+// to lowercase, other unsupported characters are replaced with "_",
+// and both are truncated to 63 characters.
+func labels(tags cloud.InstanceTags) map[string]string {
+	labels := map[string]string{}
+	for k, v := range tags {
+		k = labelString(k)
+		if k == "" || k[0] < 'a' || k[0] > 'z' {
+			k = labelString("x" + k)
+		}
+		labels[k] = labelString(v)
+	}
+	return labels
+}
+
+func labelString(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, s)
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// hasTags returns true if have includes all of the keys and values in
+// want.
+func hasTags(have, want cloud.InstanceTags) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type rateLimitError struct {
+	error
+	earliestRetry time.Time
+}
+
+func (err rateLimitError) EarliestRetry() time.Time {
+	return err.earliestRetry
+}
+
+type gceQuotaError struct {
+	error
+}
+
+func (er *gceQuotaError) IsQuotaError() bool {
+	return true
+}
+
+type gceCapacityError struct {
+	error
+}
+
+func (er *gceCapacityError) IsCapacityError() bool {
+	return true
+}
+
+// operationError is returned when an asynchronous operation (like
+// creating an instance) fails after the API call itself succeeded.
+type operationError struct {
+	errors []*compute.OperationErrorErrors
+}
+
+func (err *operationError) Error() string {
+	var msgs []string
+	for _, e := range err.errors {
+		msgs = append(msgs, e.Code+": "+e.Message)
+	}
+	return "operation failed: " + strings.Join(msgs, "; ")
+}
+
+var isCodeThrottle = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+var isCodeQuota = map[string]bool{
+	"quotaExceeded":  true,
+	"QUOTA_EXCEEDED": true,
+}
+
+var isCodeCapacity = map[string]bool{
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+}
+
+// errorCodes returns the error reasons from an API error, or the
+// error codes from a failed operation.
+func errorCodes(err error) []string {
+	var codes []string
+	switch err := err.(type) {
+	case *googleapi.Error:
+		for _, e := range err.Errors {
+			codes = append(codes, e.Reason)
+		}
+	case *operationError:
+		for _, e := range err.errors {
+			codes = append(codes, e.Code)
+		}
+	}
+	return codes
+}
+
+func hasCode(err error, codes map[string]bool) bool {
+	for _, code := range errorCodes(err) {
+		if codes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+func isErrorThrottle(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == 429 {
+		return true
+	}
+	return hasCode(err, isCodeThrottle)
+}
+
+func wrapError(err error, throttleValue *atomic.Value) error {
+	if isErrorThrottle(err) {
+		// Back off exponentially until an upstream call
+		// either succeeds or returns a non-throttle error.
+		d, _ := throttleValue.Load().(time.Duration)
+		d = d*3/2 + time.Second
+		if d < throttleDelayMin {
+			d = throttleDelayMin
+		} else if d > throttleDelayMax {
+			d = throttleDelayMax
+		}
+		throttleValue.Store(d)
+		return rateLimitError{error: err, earliestRetry: time.Now().Add(d)}
+	} else if hasCode(err, isCodeQuota) {
+		return &gceQuotaError{err}
+	} else if hasCode(err, isCodeCapacity) {
+		return &gceCapacityError{err}
+	} else if err != nil {
+		throttleValue.Store(time.Duration(0))
+		return err
+	}
+	throttleValue.Store(time.Duration(0))
+	return nil
+}
+
+// Return a random string of n hexadecimal digits (n*4 random bits). n
+// must be even.
+func randomHex(n int) string {
+	buf := make([]byte, n/2)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", buf)
+}
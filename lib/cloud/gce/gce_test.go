@@ -0,0 +1,252 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package gce
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/cloud/gce/gcetest"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"golang.org/x/crypto/ssh"
+	check "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type GCEInstanceSetSuite struct {
+	server *gcetest.Server
+	is     cloud.InstanceSet
+	pubkey ssh.PublicKey
+}
+
+var _ = check.Suite(&GCEInstanceSetSuite{})
+
+func (s *GCEInstanceSetSuite) SetUpTest(c *check.C) {
+	s.pubkey, _ = test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	_, hostkey := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_vm")
+	s.server = &gcetest.Server{HostKey: hostkey, PageSize: 1}
+	s.server.Start()
+	params, err := json.Marshal(map[string]string{
+		"Project":       "test-project",
+		"Zone":          "test-zone",
+		"AdminUsername": "crunch",
+		"APIEndpoint":   s.server.Endpoint(),
+	})
+	c.Assert(err, check.IsNil)
+	s.is, err = Driver.InstanceSet(params, "test-instance-set-id", nil, ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *GCEInstanceSetSuite) TearDownTest(c *check.C) {
+	s.is.Stop()
+	s.server.Close()
+}
+
+func (s *GCEInstanceSetSuite) create(c *check.C, it arvados.InstanceType, tags cloud.InstanceTags) cloud.Instance {
+	inst, err := s.is.Create(it, "test-image", tags, "echo hello", s.pubkey)
+	c.Assert(err, check.IsNil)
+	return inst
+}
+
+func (s *GCEInstanceSetSuite) TestCreate(c *check.C) {
+	inst := s.create(c, test.InstanceType(1), cloud.InstanceTags{"TestTagName": "Test Tag Value"})
+	c.Check(inst.ProviderType(), check.Equals, test.InstanceType(1).ProviderType)
+	c.Check(inst.RemoteUser(), check.Equals, "crunch")
+	c.Check(inst.Tags(), check.DeepEquals, cloud.InstanceTags{"TestTagName": "Test Tag Value"})
+
+	gi := s.server.Instance(string(inst.ID()))
+	c.Assert(gi, check.NotNil)
+	c.Check(gi.MachineType, check.Equals, "zones/test-zone/machineTypes/"+test.InstanceType(1).ProviderType)
+	c.Check(gi.Labels, check.DeepEquals, map[string]string{"testtagname": "test_tag_value"})
+	c.Check(gi.Scheduling, check.IsNil)
+	c.Assert(gi.Disks, check.HasLen, 1)
+	c.Check(gi.Disks[0].Boot, check.Equals, true)
+	c.Check(gi.Disks[0].InitializeParams.SourceImage, check.Equals, "global/images/test-image")
+	c.Assert(gi.NetworkInterfaces, check.HasLen, 1)
+	c.Check(gi.NetworkInterfaces[0].Network, check.Equals, "global/networks/default")
+	metadata := map[string]string{}
+	for _, item := range gi.Metadata.Items {
+		metadata[item.Key] = *item.Value
+	}
+	c.Check(metadata["startup-script"], check.Equals, "#!/bin/sh\necho hello\n")
+	c.Check(metadata["ssh-keys"], check.Equals, "crunch:"+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.pubkey))))
+}
+
+// Create returns as soon as the instance exists, without waiting
+// for the insert operation to finish.
+func (s *GCEInstanceSetSuite) TestCreateSlowInsert(c *check.C) {
+	s.server.SlowInserts = true
+	t0 := time.Now()
+	inst := s.create(c, test.InstanceType(1), cloud.InstanceTags{"TestTagName": "Test Tag Value"})
+	c.Check(time.Since(t0) < createPollInterval, check.Equals, true)
+	c.Check(s.server.Instance(string(inst.ID())), check.NotNil)
+	c.Check(inst.Tags(), check.DeepEquals, cloud.InstanceTags{"TestTagName": "Test Tag Value"})
+}
+
+func (s *GCEInstanceSetSuite) TestCreateWithExtraScratch(c *check.C) {
+	it := test.InstanceType(1)
+	it.AddedScratch = 500 << 30
+	inst := s.create(c, it, nil)
+
+	gi := s.server.Instance(string(inst.ID()))
+	c.Assert(gi, check.NotNil)
+	c.Assert(gi.Disks, check.HasLen, 3)
+	for _, disk := range gi.Disks[1:] {
+		c.Check(disk.Type, check.Equals, "SCRATCH")
+		c.Check(disk.Interface, check.Equals, "NVME")
+		c.Check(disk.AutoDelete, check.Equals, true)
+		c.Check(disk.InitializeParams.DiskType, check.Equals, "zones/test-zone/diskTypes/local-ssd")
+	}
+}
+
+func (s *GCEInstanceSetSuite) TestCreatePreemptible(c *check.C) {
+	it := test.InstanceType(1)
+	it.Preemptible = true
+	inst := s.create(c, it, nil)
+
+	gi := s.server.Instance(string(inst.ID()))
+	c.Assert(gi, check.NotNil)
+	c.Assert(gi.Scheduling, check.NotNil)
+	c.Check(gi.Scheduling.Preemptible, check.Equals, true)
+	c.Check(*gi.Scheduling.AutomaticRestart, check.Equals, false)
+	c.Check(gi.Scheduling.OnHostMaintenance, check.Equals, "TERMINATE")
+}
+
+func (s *GCEInstanceSetSuite) TestListInstances(c *check.C) {
+	for _, tags := range []cloud.InstanceTags{
+		{"InstanceSetID": "test-instance-set-id", "Name": "a"},
+		{"InstanceSetID": "test-instance-set-id", "Name": "A"},
+		{"InstanceSetID": "other-instance-set-id", "Name": "a"},
+	} {
+		s.create(c, test.InstanceType(1), tags)
+	}
+
+	// Default PageSize is 1 for this suite, so this also
+	// exercises paging.
+	insts, err := s.is.Instances(nil)
+	c.Check(err, check.IsNil)
+	c.Check(insts, check.HasLen, 3)
+
+	insts, err = s.is.Instances(cloud.InstanceTags{"InstanceSetID": "test-instance-set-id"})
+	c.Check(err, check.IsNil)
+	c.Check(insts, check.HasLen, 2)
+	for _, inst := range insts {
+		c.Check(inst.Address(), check.Matches, `127\.0\.0\.1:\d+`)
+	}
+
+	// Labels are lowercase, so "a" and "A" are only
+	// distinguished by the driver's own filtering.
+	insts, err = s.is.Instances(cloud.InstanceTags{"InstanceSetID": "test-instance-set-id", "Name": "A"})
+	c.Check(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Check(insts[0].Tags()["Name"], check.Equals, "A")
+}
+
+func (s *GCEInstanceSetSuite) TestSetTags(c *check.C) {
+	inst := s.create(c, test.InstanceType(1), cloud.InstanceTags{"InstanceSetID": "test-instance-set-id", "Name": "a"})
+	err := inst.SetTags(cloud.InstanceTags{"InstanceSetID": "test-instance-set-id", "Name": "B"})
+	c.Check(err, check.IsNil)
+
+	insts, err := s.is.Instances(cloud.InstanceTags{"Name": "B"})
+	c.Check(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Check(insts[0].ID(), check.Equals, inst.ID())
+	c.Check(insts[0].Tags(), check.DeepEquals, cloud.InstanceTags{"InstanceSetID": "test-instance-set-id", "Name": "B"})
+
+	gi := s.server.Instance(string(inst.ID()))
+	c.Assert(gi, check.NotNil)
+	c.Check(gi.Labels, check.DeepEquals, map[string]string{"instancesetid": "test-instance-set-id", "name": "b"})
+	keys := map[string]bool{}
+	for _, item := range gi.Metadata.Items {
+		keys[item.Key] = true
+	}
+	c.Check(keys, check.DeepEquals, map[string]bool{"startup-script": true, "ssh-keys": true, tagsMetadataKey: true})
+
+	// Second SetTags call needs the updated fingerprints.
+	err = inst.SetTags(cloud.InstanceTags{"InstanceSetID": "test-instance-set-id", "Name": "C"})
+	c.Check(err, check.IsNil)
+}
+
+func (s *GCEInstanceSetSuite) TestDestroyInstances(c *check.C) {
+	inst := s.create(c, test.InstanceType(1), nil)
+	c.Check(inst.Destroy(), check.IsNil)
+	c.Check(s.server.Instance(string(inst.ID())), check.IsNil)
+	insts, err := s.is.Instances(nil)
+	c.Check(err, check.IsNil)
+	c.Check(insts, check.HasLen, 0)
+}
+
+func (s *GCEInstanceSetSuite) TestPreempted(c *check.C) {
+	it := test.InstanceType(1)
+	it.Preemptible = true
+	inst := s.create(c, it, nil)
+	insts, err := s.is.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Check(insts[0].(cloud.PreemptibleInstance).Preempted(), check.Equals, false)
+
+	s.server.Preempt(string(inst.ID()))
+	insts, err = s.is.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Check(insts[0].(cloud.PreemptibleInstance).Preempted(), check.Equals, true)
+}
+
+func (s *GCEInstanceSetSuite) TestCapacityError(c *check.C) {
+	s.server.AtCapacity = map[string]bool{test.InstanceType(1).ProviderType: true}
+	_, err := s.is.Create(test.InstanceType(1), "test-image", nil, "", s.pubkey)
+	c.Assert(err, check.NotNil)
+	cerr, ok := err.(cloud.CapacityError)
+	c.Assert(ok, check.Equals, true, check.Commentf("%#v", err))
+	c.Check(cerr.IsCapacityError(), check.Equals, true)
+	_, ok = err.(cloud.QuotaError)
+	c.Check(ok, check.Equals, false)
+
+	s.create(c, test.InstanceType(2), nil)
+}
+
+func (s *GCEInstanceSetSuite) TestQuotaError(c *check.C) {
+	s.server.QuotaExceeded = true
+	_, err := s.is.Create(test.InstanceType(1), "test-image", nil, "", s.pubkey)
+	c.Assert(err, check.NotNil)
+	qerr, ok := err.(cloud.QuotaError)
+	c.Assert(ok, check.Equals, true, check.Commentf("%#v", err))
+	c.Check(qerr.IsQuotaError(), check.Equals, true)
+}
+
+func (s *GCEInstanceSetSuite) TestRateLimitError(c *check.C) {
+	s.server.RateLimited = true
+	var prev time.Time
+	for i := 0; i < 3; i++ {
+		_, err := s.is.Instances(nil)
+		rlerr, ok := err.(cloud.RateLimitError)
+		c.Assert(ok, check.Equals, true, check.Commentf("%#v", err))
+		c.Check(rlerr.EarliestRetry().After(prev), check.Equals, true)
+		prev = rlerr.EarliestRetry()
+	}
+}
+
+func (*GCEInstanceSetSuite) TestLabels(c *check.C) {
+	c.Check(labels(cloud.InstanceTags{
+		"ArvadosInstanceSetID": "zzzzz-zzzzz-zzzzzzzzzzzzzzz",
+		"Name":                 "Example Name",
+		"0key":                 "value.with/punctuation",
+		"long":                 "0123456789012345678901234567890123456789012345678901234567890123456789",
+	}), check.DeepEquals, map[string]string{
+		"arvadosinstancesetid": "zzzzz-zzzzz-zzzzzzzzzzzzzzz",
+		"name":                 "example_name",
+		"x0key":                "value_with_punctuation",
+		"long":                 "012345678901234567890123456789012345678901234567890123456789012",
+	})
+}
@@ -0,0 +1,402 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package gcetest provides an HTTP stand-in for the subset of the
+// Google Compute Engine API used by the gce cloud driver.
+package gcetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/api/compute/v1"
+)
+
+var (
+	filterRe = regexp.MustCompile(`\(labels\.([a-z0-9_-]+) = "([^"]*)"\)`)
+	secretRe = regexp.MustCompile(`echo -n "([0-9a-f]+)" >(\S+)`)
+)
+
+// Server is a fake GCE API server. Each instance it creates runs an
+// SSH server on localhost that accepts the key given in the
+// instance's "ssh-keys" metadata, responds to the commands used by
+// the dispatcher's boot probe and instance secret check, and reports
+// its host:port as the instance's networkIP.
+//
+// Exported fields should not be modified after calling Start.
+type Server struct {
+	// Host key used by instances' SSH servers.
+	HostKey ssh.Signer
+
+	// Maximum number of instances returned per page when
+	// listing instances. Zero means 500.
+	PageSize int
+
+	// Machine types (e.g., "n1-standard-1") that fail with
+	// ZONE_RESOURCE_POOL_EXHAUSTED when creating instances.
+	AtCapacity map[string]bool
+
+	// If true, creating an instance fails with QUOTA_EXCEEDED.
+	QuotaExceeded bool
+
+	// If true, all API calls fail with 429 rateLimitExceeded.
+	RateLimited bool
+
+	// If true, insert operations never finish, as if the new
+	// instances were taking a long time to boot. The instances
+	// exist right away.
+	SlowInserts bool
+
+	srv       *httptest.Server
+	mtx       sync.Mutex
+	instances map[string]*stubInstance
+	ops       map[string]*compute.Operation
+	serial    int
+}
+
+type stubInstance struct {
+	instance *compute.Instance
+	sshd     *test.SSHService
+	secret   string
+}
+
+// Start starts the server.
+func (s *Server) Start() {
+	s.instances = map[string]*stubInstance{}
+	s.ops = map[string]*compute.Operation{}
+	s.srv = httptest.NewServer(s)
+}
+
+// Close shuts down the server and all instances' SSH servers.
+func (s *Server) Close() {
+	s.srv.Close()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, si := range s.instances {
+		si.sshd.Close()
+	}
+}
+
+// Endpoint returns a URL suitable for the gce driver's APIEndpoint
+// parameter.
+func (s *Server) Endpoint() string {
+	return s.srv.URL + "/compute/v1/projects/"
+}
+
+// Instance returns a copy of the named instance as last stored by
+// the server, or nil if there is no such instance.
+func (s *Server) Instance(name string) *compute.Instance {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	si, ok := s.instances[name]
+	if !ok {
+		return nil
+	}
+	return copyInstance(si.instance)
+}
+
+// Preempt simulates preemption of the named instance by changing its
+// status to TERMINATED and shutting down its SSH server.
+func (s *Server) Preempt(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if si, ok := s.instances[name]; ok {
+		si.instance.Status = "TERMINATED"
+		si.sshd.Close()
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.RateLimited {
+		writeError(w, http.StatusTooManyRequests, "rateLimitExceeded", "Rate Limit Exceeded")
+		return
+	}
+	// /compute/v1/projects/{project}/zones/{zone}/{collection}[/{name}[/{method}]]
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if len(parts) < 7 || parts[0] != "compute" || parts[1] != "v1" || parts[2] != "projects" || parts[4] != "zones" {
+		writeError(w, http.StatusNotFound, "notFound", "unsupported path "+req.URL.Path)
+		return
+	}
+	parts = parts[6:]
+	switch {
+	case parts[0] == "instances" && len(parts) == 1 && req.Method == "GET":
+		s.list(w, req)
+	case parts[0] == "instances" && len(parts) == 1 && req.Method == "POST":
+		s.insert(w, req)
+	case parts[0] == "instances" && len(parts) == 2 && req.Method == "GET":
+		if si := s.instances[parts[1]]; si != nil {
+			writeJSON(w, si.instance)
+		} else {
+			writeError(w, http.StatusNotFound, "notFound", "instance not found")
+		}
+	case parts[0] == "instances" && len(parts) == 2 && req.Method == "DELETE":
+		s.delete(w, parts[1])
+	case parts[0] == "instances" && len(parts) == 3 && req.Method == "POST" && parts[2] == "setLabels":
+		s.setLabels(w, req, parts[1])
+	case parts[0] == "instances" && len(parts) == 3 && req.Method == "POST" && parts[2] == "setMetadata":
+		s.setMetadata(w, req, parts[1])
+	case parts[0] == "operations" && (len(parts) == 2 && req.Method == "GET" || len(parts) == 3 && req.Method == "POST" && parts[2] == "wait"):
+		if op := s.ops[parts[1]]; op != nil {
+			writeJSON(w, op)
+		} else {
+			writeError(w, http.StatusNotFound, "notFound", "operation not found")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "unsupported request "+req.Method+" "+req.URL.Path)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, req *http.Request) {
+	want := map[string]string{}
+	for _, m := range filterRe.FindAllStringSubmatch(req.FormValue("filter"), -1) {
+		want[m[1]] = m[2]
+	}
+	var names []string
+	for name, si := range s.instances {
+		match := true
+		for k, v := range want {
+			if si.instance.Labels[k] != v {
+				match = false
+			}
+		}
+		if match {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	pageSize := s.PageSize
+	if pageSize == 0 {
+		pageSize = 500
+	}
+	start, _ := strconv.Atoi(req.FormValue("pageToken"))
+	resp := &compute.InstanceList{Kind: "compute#instanceList"}
+	for i := start; i < len(names) && i < start+pageSize; i++ {
+		resp.Items = append(resp.Items, s.instances[names[i]].instance)
+	}
+	if start+pageSize < len(names) {
+		resp.NextPageToken = strconv.Itoa(start + pageSize)
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) insert(w http.ResponseWriter, req *http.Request) {
+	var inst compute.Instance
+	err := json.NewDecoder(req.Body).Decode(&inst)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if _, exists := s.instances[inst.Name]; exists {
+		writeError(w, http.StatusConflict, "alreadyExists", "instance already exists")
+		return
+	}
+	if s.AtCapacity[path.Base(inst.MachineType)] {
+		writeJSON(w, s.operation(inst.Name, "ZONE_RESOURCE_POOL_EXHAUSTED", "The zone does not have enough resources available to fulfill the request."))
+		return
+	}
+	if s.QuotaExceeded {
+		writeJSON(w, s.operation(inst.Name, "QUOTA_EXCEEDED", "Quota 'CPUS' exceeded."))
+		return
+	}
+
+	si := &stubInstance{instance: &inst}
+	var authorizedKeys []ssh.PublicKey
+	var user string
+	if inst.Metadata != nil {
+		for _, item := range inst.Metadata.Items {
+			if item.Value == nil {
+				continue
+			}
+			switch item.Key {
+			case "ssh-keys":
+				for _, line := range strings.Split(*item.Value, "\n") {
+					kv := strings.SplitN(line, ":", 2)
+					if len(kv) != 2 {
+						continue
+					}
+					key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(kv[1]))
+					if err != nil {
+						writeError(w, http.StatusBadRequest, "invalid", "ssh-keys: "+err.Error())
+						return
+					}
+					user = kv[0]
+					authorizedKeys = append(authorizedKeys, key)
+				}
+			case "startup-script":
+				if m := secretRe.FindStringSubmatch(*item.Value); m != nil {
+					si.secret = m[1]
+				}
+			}
+		}
+		inst.Metadata.Fingerprint = s.fingerprint()
+	}
+	si.sshd = &test.SSHService{
+		Exec:           si.exec,
+		HostKey:        s.HostKey,
+		AuthorizedUser: user,
+		AuthorizedKeys: authorizedKeys,
+	}
+	if err := si.sshd.Start(); err != nil {
+		writeError(w, http.StatusInternalServerError, "internalError", err.Error())
+		return
+	}
+	inst.Status = "RUNNING"
+	inst.CreationTimestamp = time.Now().Format(time.RFC3339)
+	inst.LabelFingerprint = s.fingerprint()
+	if len(inst.NetworkInterfaces) > 0 {
+		inst.NetworkInterfaces[0].NetworkIP = si.sshd.Address()
+	}
+	s.instances[inst.Name] = si
+	op := s.operation(inst.Name, "", "")
+	if s.SlowInserts {
+		op.Status = "RUNNING"
+	}
+	writeJSON(w, op)
+}
+
+func (s *Server) delete(w http.ResponseWriter, name string) {
+	si, ok := s.instances[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "instance not found")
+		return
+	}
+	si.sshd.Close()
+	delete(s.instances, name)
+	writeJSON(w, s.operation(name, "", ""))
+}
+
+func (s *Server) setLabels(w http.ResponseWriter, req *http.Request, name string) {
+	si, ok := s.instances[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "instance not found")
+		return
+	}
+	var sl compute.InstancesSetLabelsRequest
+	err := json.NewDecoder(req.Body).Decode(&sl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if sl.LabelFingerprint != si.instance.LabelFingerprint {
+		writeError(w, http.StatusPreconditionFailed, "conditionNotMet", "label fingerprint does not match")
+		return
+	}
+	si.instance.Labels = sl.Labels
+	si.instance.LabelFingerprint = s.fingerprint()
+	writeJSON(w, s.operation(name, "", ""))
+}
+
+func (s *Server) setMetadata(w http.ResponseWriter, req *http.Request, name string) {
+	si, ok := s.instances[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "instance not found")
+		return
+	}
+	var md compute.Metadata
+	err := json.NewDecoder(req.Body).Decode(&md)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if si.instance.Metadata == nil {
+		si.instance.Metadata = &compute.Metadata{}
+	}
+	if md.Fingerprint != si.instance.Metadata.Fingerprint {
+		writeError(w, http.StatusPreconditionFailed, "conditionNotMet", "metadata fingerprint does not match")
+		return
+	}
+	md.Fingerprint = s.fingerprint()
+	si.instance.Metadata = &md
+	writeJSON(w, s.operation(name, "", ""))
+}
+
+// operation records and returns a completed operation. If code is
+// not empty, the operation failed with the given error.
+func (s *Server) operation(target, code, message string) *compute.Operation {
+	s.serial++
+	op := &compute.Operation{
+		Kind:       "compute#operation",
+		Name:       fmt.Sprintf("operation-%d", s.serial),
+		Status:     "DONE",
+		TargetLink: target,
+	}
+	if code != "" {
+		op.Error = &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{{Code: code, Message: message}},
+		}
+	}
+	s.ops[op.Name] = op
+	return op
+}
+
+func (s *Server) fingerprint() string {
+	s.serial++
+	return fmt.Sprintf("fingerprint-%d", s.serial)
+}
+
+func (si *stubInstance) exec(env map[string]string, command string, stdin io.Reader, stdout, stderr io.Writer) uint32 {
+	switch command {
+	case "true", "crunch-run --list":
+		return 0
+	case "cat /var/run/arvados-instance-secret", "sudo cat /var/run/arvados-instance-secret":
+		if si.secret == "" {
+			fmt.Fprint(stderr, "cat: /var/run/arvados-instance-secret: No such file or directory\n")
+			return 1
+		}
+		fmt.Fprint(stdout, si.secret)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "%q: command not found\n", command)
+		return 1
+	}
+}
+
+func copyInstance(inst *compute.Instance) *compute.Instance {
+	buf, err := json.Marshal(inst)
+	if err != nil {
+		panic(err)
+	}
+	var cp compute.Instance
+	err = json.Unmarshal(buf, &cp)
+	if err != nil {
+		panic(err)
+	}
+	return &cp
+}
+
+func writeJSON(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeError(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors": []map[string]string{{
+				"reason":  reason,
+				"message": message,
+			}},
+		},
+	})
+}
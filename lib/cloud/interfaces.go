@@ -36,6 +36,19 @@ type QuotaError interface {
 	error
 }
 
+// A CapacityError should be returned by an InstanceSet's Create
+// method when the cloud service indicates it does not currently have
+// enough capacity to create an instance of the requested type. Unlike
+// a QuotaError, it does not prevent creating instances of other
+// types.
+type CapacityError interface {
+	// If true, don't try to create more instances of the
+	// requested type for a while. If false, don't handle the
+	// error as a capacity error.
+	IsCapacityError() bool
+	error
+}
+
 type SharedResourceTags map[string]string
 type InstanceSetID string
 type InstanceTags map[string]string
@@ -106,6 +119,18 @@ type Instance interface {
 	Destroy() error
 }
 
+// A PreemptibleInstance is an Instance that can report whether the
+// cloud provider has reclaimed it, or has announced that it will
+// reclaim it soon (e.g., a spot instance interruption). Drivers are
+// not required to implement this interface.
+type PreemptibleInstance interface {
+	Instance
+
+	// Preempted returns true if the instance has been, or is
+	// about to be, reclaimed by the cloud provider.
+	Preempted() bool
+}
+
 // An InstanceSet manages a set of VM instances created by an elastic
 // cloud provider like AWS, GCE, or Azure.
 //
@@ -121,8 +146,8 @@ type InstanceSet interface {
 	// instances' VerifyHostKey() method never returns
 	// ErrNotImplemented. InitCommand will be under 1 KiB.
 	//
-	// The returned error should implement RateLimitError and
-	// QuotaError where applicable.
+	// The returned error should implement RateLimitError,
+	// QuotaError, and CapacityError where applicable.
 	Create(arvados.InstanceType, ImageID, InstanceTags, InitCommand, ssh.PublicKey) (Instance, error)
 
 	// Return all instances, including ones that are booting or
@@ -0,0 +1,479 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package inventory implements a cloud driver that leases
+// pre-registered hosts (bare metal machines or long-lived VMs) from a
+// static inventory, instead of creating and destroying VMs.
+package inventory
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/sshexecutor"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Driver is the inventory implementation of the cloud.Driver
+// interface.
+var Driver = cloud.DriverFunc(newInventoryInstanceSet)
+
+var errHostKeyMismatch = errors.New("host key does not match inventory")
+
+// defaultCleanupCommand stops everything a previous lease might have
+// left running on a host, and removes its scratch data. Docker
+// containers started by crunch-run are named after the Arvados
+// container UUID.
+const defaultCleanupCommand = `crunch-run --list | grep -o '^[0-9a-z]*-dz642-[0-9a-z]*' | xargs -r -n1 crunch-run --kill 9; ` +
+	`pkill -KILL -f 'bin/arv-mount'; ` +
+	`docker ps -aq --filter name=-dz642- | xargs -r docker rm -f; ` +
+	`grep -o ' /tmp/crunch-run[^ ]*' /proc/mounts | xargs -r -n1 fusermount -u -z; ` +
+	`rm -rf /tmp/crunch-run.*`
+
+// Time to wait before retrying a cleanup command that failed.
+const cleanupRetryInterval = time.Minute
+
+type inventoryHost struct {
+	// Hostname or IP address, with optional ":port". Defaults
+	// to the host's key in the Hosts map.
+	Address string
+
+	// Matches the ProviderType of the cluster's InstanceTypes
+	// that this host can serve.
+	ProviderType string
+
+	// SSH host public key, in authorized_keys format.
+	HostKey string
+
+	hostKey ssh.PublicKey
+}
+
+type inventoryInstanceSetConfig struct {
+	Hosts          map[string]*inventoryHost
+	StateFile      string
+	AdminUsername  string
+	PrivateKeyFile string
+	PrivateKey     string
+	CleanupCommand string
+}
+
+// lease records that a host is in use by a dispatcher, like a
+// running VM in a real cloud. ID is unique to each lease, so a host
+// that is released and leased again looks like a new instance.
+//
+// A lease is Releasing after Destroy, until the host has been
+// cleaned up. The host can't be leased again until then.
+type lease struct {
+	ID        cloud.InstanceID
+	Host      string
+	Tags      cloud.InstanceTags
+	Releasing bool `json:",omitempty"`
+}
+
+type inventoryState struct {
+	Leases []lease
+}
+
+type inventoryInstanceSet struct {
+	config        inventoryInstanceSetConfig
+	instanceSetID cloud.InstanceSetID
+	logger        logrus.FieldLogger
+	signer        ssh.Signer
+	retryInterval time.Duration
+	stop          chan struct{}
+	stopOnce      sync.Once
+
+	mtx      sync.Mutex
+	leases   map[cloud.InstanceID]lease
+	cleaning map[cloud.InstanceID]bool
+}
+
+func newInventoryInstanceSet(config json.RawMessage, instanceSetID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger) (cloud.InstanceSet, error) {
+	instanceSet := &inventoryInstanceSet{
+		instanceSetID: instanceSetID,
+		logger:        logger,
+		retryInterval: cleanupRetryInterval,
+		stop:          make(chan struct{}),
+		leases:        map[cloud.InstanceID]lease{},
+		cleaning:      map[cloud.InstanceID]bool{},
+	}
+	err := json.Unmarshal(config, &instanceSet.config)
+	if err != nil {
+		return nil, err
+	}
+	if instanceSet.config.StateFile == "" {
+		return nil, errors.New("StateFile is not configured")
+	}
+	if instanceSet.config.AdminUsername == "" {
+		instanceSet.config.AdminUsername = "root"
+	}
+	if instanceSet.config.CleanupCommand == "" {
+		instanceSet.config.CleanupCommand = defaultCleanupCommand
+	}
+	// PrivateKey is normally filled in from
+	// Containers.DispatchPrivateKey by the dispatcher (see
+	// dispatchcloud.DriverParameters), unless PrivateKeyFile is
+	// configured.
+	var buf []byte
+	if fnm := instanceSet.config.PrivateKeyFile; fnm != "" {
+		buf, err = ioutil.ReadFile(fnm)
+		if err != nil {
+			return nil, err
+		}
+		instanceSet.signer, err = ssh.ParsePrivateKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", fnm, err)
+		}
+	} else if instanceSet.config.PrivateKey != "" {
+		instanceSet.signer, err = ssh.ParsePrivateKey([]byte(instanceSet.config.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing PrivateKey: %s", err)
+		}
+	} else {
+		return nil, errors.New("PrivateKeyFile is not configured")
+	}
+	for name, host := range instanceSet.config.Hosts {
+		if host == nil {
+			host = &inventoryHost{}
+			instanceSet.config.Hosts[name] = host
+		}
+		if host.Address == "" {
+			host.Address = name
+		}
+		if host.ProviderType == "" {
+			return nil, fmt.Errorf("host %q: ProviderType is not configured", name)
+		}
+		host.hostKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(host.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("host %q: error parsing HostKey: %s", name, err)
+		}
+	}
+
+	var state inventoryState
+	buf, err = ioutil.ReadFile(instanceSet.config.StateFile)
+	if os.IsNotExist(err) {
+		// Nothing leased yet.
+	} else if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(buf, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", instanceSet.config.StateFile, err)
+	}
+	for _, l := range state.Leases {
+		if _, ok := instanceSet.config.Hosts[l.Host]; !ok {
+			logger.WithFields(logrus.Fields{
+				"Instance": l.ID,
+				"Host":     l.Host,
+			}).Warn("leased host is no longer in the inventory")
+		}
+		instanceSet.leases[l.ID] = l
+	}
+	for _, l := range instanceSet.leases {
+		if l.Releasing {
+			// A previous dispatcher process was
+			// cleaning up this host when it exited.
+			instanceSet.startCleanup(l)
+		}
+	}
+	return instanceSet, nil
+}
+
+// Create leases an unused host with the requested ProviderType. The
+// host must already accept the dispatcher's SSH key, so publicKey
+// and initCommand are not used.
+func (instanceSet *inventoryInstanceSet) Create(
+	instanceType arvados.InstanceType,
+	imageID cloud.ImageID,
+	newTags cloud.InstanceTags,
+	initCommand cloud.InitCommand,
+	publicKey ssh.PublicKey) (cloud.Instance, error) {
+
+	instanceSet.mtx.Lock()
+	defer instanceSet.mtx.Unlock()
+
+	leased := map[string]bool{}
+	for _, l := range instanceSet.leases {
+		leased[l.Host] = true
+	}
+	var names []string
+	for name, host := range instanceSet.config.Hosts {
+		if host.ProviderType == instanceType.ProviderType && !leased[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, capacityError{fmt.Errorf("no unused hosts with ProviderType %q", instanceType.ProviderType)}
+	}
+	sort.Strings(names)
+	l := lease{
+		ID:   cloud.InstanceID(names[0] + "-" + randomHex(8)),
+		Host: names[0],
+		Tags: copyTags(newTags),
+	}
+	instanceSet.leases[l.ID] = l
+	err := instanceSet.save()
+	if err != nil {
+		delete(instanceSet.leases, l.ID)
+		return nil, err
+	}
+	return instanceSet.instance(l), nil
+}
+
+func (instanceSet *inventoryInstanceSet) Instances(tags cloud.InstanceTags) ([]cloud.Instance, error) {
+	instanceSet.mtx.Lock()
+	defer instanceSet.mtx.Unlock()
+	var instances []cloud.Instance
+	for _, l := range instanceSet.leases {
+		if !l.Releasing && hasTags(l.Tags, tags) {
+			instances = append(instances, instanceSet.instance(l))
+		}
+	}
+	return instances, nil
+}
+
+// Stop abandons any cleanups in progress. The hosts being cleaned
+// up remain unavailable, and cleanup resumes the next time an
+// InstanceSet is created with the same StateFile.
+func (instanceSet *inventoryInstanceSet) Stop() {
+	instanceSet.stopOnce.Do(func() { close(instanceSet.stop) })
+}
+
+// startCleanup starts cleaning up the given lease's host in a new
+// goroutine, unless that is already in progress. Caller must have
+// lock.
+func (instanceSet *inventoryInstanceSet) startCleanup(l lease) {
+	if instanceSet.cleaning[l.ID] {
+		return
+	}
+	instanceSet.cleaning[l.ID] = true
+	go instanceSet.cleanup(l)
+}
+
+// cleanup runs CleanupCommand on the given lease's host, retrying
+// until it succeeds, and then ends the lease so the host can be
+// leased again.
+func (instanceSet *inventoryInstanceSet) cleanup(l lease) {
+	logger := instanceSet.logger.WithFields(logrus.Fields{
+		"Instance": l.ID,
+		"Host":     l.Host,
+	})
+	instanceSet.mtx.Lock()
+	inst := instanceSet.instance(l)
+	instanceSet.mtx.Unlock()
+	cmd := "sh -c " + shellQuote(instanceSet.config.CleanupCommand)
+	if inst.RemoteUser() != "root" {
+		cmd = "sudo " + cmd
+	}
+	for {
+		exr := sshexecutor.New(inst)
+		exr.SetSigners(instanceSet.signer)
+		_, stderr, err := exr.Execute(nil, cmd, nil)
+		exr.Close()
+		if err == nil {
+			instanceSet.mtx.Lock()
+			delete(instanceSet.leases, l.ID)
+			err = instanceSet.save()
+			if err != nil {
+				instanceSet.leases[l.ID] = l
+			} else {
+				delete(instanceSet.cleaning, l.ID)
+			}
+			instanceSet.mtx.Unlock()
+			if err == nil {
+				logger.Info("host cleaned up and returned to inventory")
+				return
+			}
+		}
+		logger.WithError(err).WithField("stderr", string(stderr)).Warn("host cleanup failed, will retry")
+		select {
+		case <-instanceSet.stop:
+			return
+		case <-time.After(instanceSet.retryInterval):
+		}
+	}
+}
+
+// instance returns an Instance with a snapshot of the given lease.
+// Caller must have lock.
+func (instanceSet *inventoryInstanceSet) instance(l lease) *inventoryInstance {
+	inst := &inventoryInstance{
+		provider: instanceSet,
+		lease:    l,
+	}
+	inst.lease.Tags = copyTags(l.Tags)
+	if host, ok := instanceSet.config.Hosts[l.Host]; ok {
+		inst.host = *host
+	}
+	return inst
+}
+
+// save writes the current leases to the state file. Caller must
+// have lock.
+func (instanceSet *inventoryInstanceSet) save() error {
+	var state inventoryState
+	for _, l := range instanceSet.leases {
+		state.Leases = append(state.Leases, l)
+	}
+	sort.Slice(state.Leases, func(i, j int) bool {
+		return state.Leases[i].ID < state.Leases[j].ID
+	})
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	fnm := instanceSet.config.StateFile
+	tmp, err := ioutil.TempFile(filepath.Dir(fnm), "."+filepath.Base(fnm)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fnm)
+}
+
+type inventoryInstance struct {
+	provider *inventoryInstanceSet
+	lease    lease
+	host     inventoryHost
+}
+
+func (inst *inventoryInstance) ID() cloud.InstanceID {
+	return inst.lease.ID
+}
+
+func (inst *inventoryInstance) String() string {
+	return string(inst.lease.ID)
+}
+
+func (inst *inventoryInstance) ProviderType() string {
+	return inst.host.ProviderType
+}
+
+func (inst *inventoryInstance) SetTags(newTags cloud.InstanceTags) error {
+	is := inst.provider
+	is.mtx.Lock()
+	defer is.mtx.Unlock()
+	l, ok := is.leases[inst.lease.ID]
+	if !ok || l.Releasing {
+		return os.ErrNotExist
+	}
+	oldTags := l.Tags
+	l.Tags = copyTags(newTags)
+	is.leases[l.ID] = l
+	err := is.save()
+	if err != nil {
+		l.Tags = oldTags
+		is.leases[l.ID] = l
+	}
+	return err
+}
+
+func (inst *inventoryInstance) Tags() cloud.InstanceTags {
+	return inst.lease.Tags
+}
+
+// Destroy ends the lease. The instance disappears right away, but
+// the host is not returned to the inventory until CleanupCommand has
+// stopped any processes left over from the lease and removed its
+// scratch data.
+func (inst *inventoryInstance) Destroy() error {
+	is := inst.provider
+	is.mtx.Lock()
+	defer is.mtx.Unlock()
+	l, ok := is.leases[inst.lease.ID]
+	if !ok || l.Releasing {
+		return nil
+	}
+	l.Releasing = true
+	is.leases[l.ID] = l
+	err := is.save()
+	if err != nil {
+		l.Releasing = false
+		is.leases[l.ID] = l
+		return err
+	}
+	is.startCleanup(l)
+	return nil
+}
+
+func (inst *inventoryInstance) Address() string {
+	return inst.host.Address
+}
+
+func (inst *inventoryInstance) RemoteUser() string {
+	return inst.provider.config.AdminUsername
+}
+
+// VerifyHostKey checks the host key against the one configured in
+// the inventory.
+func (inst *inventoryInstance) VerifyHostKey(key ssh.PublicKey, _ *ssh.Client) error {
+	if inst.host.hostKey == nil || !bytes.Equal(key.Marshal(), inst.host.hostKey.Marshal()) {
+		return errHostKeyMismatch
+	}
+	return nil
+}
+
+type capacityError struct {
+	error
+}
+
+func (capacityError) IsCapacityError() bool {
+	return true
+}
+
+// hasTags returns true if have includes all of the keys and values in
+// want.
+func hasTags(have, want cloud.InstanceTags) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func copyTags(tags cloud.InstanceTags) cloud.InstanceTags {
+	cp := cloud.InstanceTags{}
+	for k, v := range tags {
+		cp[k] = v
+	}
+	return cp
+}
+
+// shellQuote returns s quoted for use as a single word in a POSIX
+// shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Return a random string of n hexadecimal digits (n*4 random bits). n
+// must be even.
+func randomHex(n int) string {
+	buf := make([]byte, n/2)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", buf)
+}
@@ -0,0 +1,291 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package inventory
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"golang.org/x/crypto/ssh"
+	check "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type InventorySuite struct {
+	params       json.RawMessage
+	hostkey      ssh.PublicKey
+	sshd         *test.SSHService
+	instanceSets []cloud.InstanceSet
+
+	mtx         sync.Mutex
+	cleanupCmds []string
+	cleanupFail bool
+}
+
+var _ = check.Suite(&InventorySuite{})
+
+func (s *InventorySuite) SetUpTest(c *check.C) {
+	var hostsigner ssh.Signer
+	s.hostkey, hostsigner = test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_vm")
+	hostkey := string(ssh.MarshalAuthorizedKey(s.hostkey))
+	clientkey, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	s.instanceSets = nil
+	var sshd *test.SSHService
+	sshd = &test.SSHService{
+		HostKey:        hostsigner,
+		AuthorizedUser: "root",
+		AuthorizedKeys: []ssh.PublicKey{clientkey},
+		Exec: func(env map[string]string, command string, stdin io.Reader, stdout, stderr io.Writer) uint32 {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			if s.sshd != sshd {
+				// A cleanup started by a previous
+				// test is still running.
+				return 0
+			}
+			s.cleanupCmds = append(s.cleanupCmds, command)
+			if s.cleanupFail {
+				return 1
+			}
+			return 0
+		},
+	}
+	s.mtx.Lock()
+	s.sshd = sshd
+	s.cleanupCmds = nil
+	s.cleanupFail = false
+	s.mtx.Unlock()
+	s.sshd.Start()
+	var err error
+	s.params, err = json.Marshal(map[string]interface{}{
+		"StateFile":      c.MkDir() + "/state.json",
+		"PrivateKeyFile": "../../dispatchcloud/test/sshkey_dispatch",
+		"Hosts": map[string]interface{}{
+			"small1": map[string]string{"ProviderType": "small", "HostKey": hostkey, "Address": s.sshd.Address()},
+			"small2": map[string]string{"ProviderType": "small", "HostKey": hostkey},
+			"big1":   map[string]string{"ProviderType": "big", "HostKey": hostkey},
+		},
+	})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *InventorySuite) TearDownTest(c *check.C) {
+	for _, is := range s.instanceSets {
+		is.Stop()
+	}
+	s.sshd.Close()
+}
+
+func (s *InventorySuite) newInstanceSet(c *check.C) cloud.InstanceSet {
+	is, err := Driver.InstanceSet(s.params, "test-instance-set-id", nil, ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+	is.(*inventoryInstanceSet).retryInterval = time.Millisecond
+	s.instanceSets = append(s.instanceSets, is)
+	return is
+}
+
+// Wait for Create to succeed, i.e., for a destroyed instance's host
+// to be cleaned up and returned to the inventory.
+func (s *InventorySuite) waitCreate(c *check.C, is cloud.InstanceSet, it arvados.InstanceType) cloud.Instance {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inst, err := is.Create(it, "", nil, "", nil)
+		if err == nil {
+			return inst
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("timed out waiting for Create to succeed: %s", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *InventorySuite) TestCreate(c *check.C) {
+	is := s.newInstanceSet(c)
+	small := arvados.InstanceType{Name: "small", ProviderType: "small"}
+
+	inst1, err := is.Create(small, "", cloud.InstanceTags{"Name": "a"}, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst1.ProviderType(), check.Equals, "small")
+	c.Check(inst1.Address(), check.Equals, s.sshd.Address())
+	c.Check(inst1.RemoteUser(), check.Equals, "root")
+	c.Check(inst1.Tags(), check.DeepEquals, cloud.InstanceTags{"Name": "a"})
+
+	inst2, err := is.Create(small, "", cloud.InstanceTags{"Name": "b"}, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst2.Address(), check.Equals, "small2")
+
+	_, err = is.Create(small, "", nil, "", nil)
+	c.Assert(err, check.NotNil)
+	cerr, ok := err.(cloud.CapacityError)
+	c.Assert(ok, check.Equals, true)
+	c.Check(cerr.IsCapacityError(), check.Equals, true)
+
+	// Releasing a host makes it available again, with a new
+	// instance ID, once it has been cleaned up.
+	c.Check(inst1.Destroy(), check.IsNil)
+	inst3 := s.waitCreate(c, is, small)
+	c.Check(inst3.Address(), check.Equals, s.sshd.Address())
+	c.Check(inst3.ID(), check.Not(check.Equals), inst1.ID())
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c.Assert(s.cleanupCmds, check.HasLen, 1)
+	c.Check(s.cleanupCmds[0], check.Matches, `sh -c '.*crunch-run --kill.*rm -rf /tmp/crunch-run\.\*'`)
+}
+
+func (s *InventorySuite) TestCleanupFailure(c *check.C) {
+	s.cleanupFail = true
+	is := s.newInstanceSet(c)
+	small := arvados.InstanceType{Name: "small", ProviderType: "small"}
+	inst1, err := is.Create(small, "", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	_, err = is.Create(small, "", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst1.Destroy(), check.IsNil)
+
+	// The host is not leasable while cleanup keeps failing.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.mtx.Lock()
+		n := len(s.cleanupCmds)
+		s.mtx.Unlock()
+		if n >= 3 {
+			break
+		}
+		c.Assert(time.Now().Before(deadline), check.Equals, true, check.Commentf("timed out waiting for cleanup retries"))
+	}
+	_, err = is.Create(small, "", nil, "", nil)
+	c.Check(err, check.FitsTypeOf, capacityError{})
+	insts, err := is.Instances(nil)
+	c.Check(err, check.IsNil)
+	c.Check(insts, check.HasLen, 1)
+
+	// A new InstanceSet resumes the cleanup, and the host
+	// becomes available once it succeeds.
+	is.Stop()
+	s.mtx.Lock()
+	s.cleanupFail = false
+	s.mtx.Unlock()
+	is = s.newInstanceSet(c)
+	inst3 := s.waitCreate(c, is, small)
+	c.Check(inst3.Address(), check.Equals, s.sshd.Address())
+}
+
+func (s *InventorySuite) TestInstancesAndTags(c *check.C) {
+	is := s.newInstanceSet(c)
+	small := arvados.InstanceType{Name: "small", ProviderType: "small"}
+	big := arvados.InstanceType{Name: "big", ProviderType: "big"}
+	inst1, err := is.Create(small, "", cloud.InstanceTags{"InstanceSetID": "test-instance-set-id"}, "", nil)
+	c.Assert(err, check.IsNil)
+	_, err = is.Create(big, "", cloud.InstanceTags{"InstanceSetID": "other-instance-set-id"}, "", nil)
+	c.Assert(err, check.IsNil)
+
+	insts, err := is.Instances(nil)
+	c.Check(err, check.IsNil)
+	c.Check(insts, check.HasLen, 2)
+	insts, err = is.Instances(cloud.InstanceTags{"InstanceSetID": "test-instance-set-id"})
+	c.Check(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Check(insts[0].ID(), check.Equals, inst1.ID())
+
+	err = inst1.SetTags(cloud.InstanceTags{"InstanceSetID": "test-instance-set-id", "Name": "x"})
+	c.Check(err, check.IsNil)
+	insts, err = is.Instances(cloud.InstanceTags{"Name": "x"})
+	c.Check(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Check(insts[0].Tags(), check.DeepEquals, cloud.InstanceTags{"InstanceSetID": "test-instance-set-id", "Name": "x"})
+
+	c.Check(inst1.Destroy(), check.IsNil)
+	insts, err = is.Instances(cloud.InstanceTags{"InstanceSetID": "test-instance-set-id"})
+	c.Check(err, check.IsNil)
+	c.Check(insts, check.HasLen, 0)
+	c.Check(inst1.SetTags(nil), check.NotNil)
+}
+
+func (s *InventorySuite) TestStateFile(c *check.C) {
+	is := s.newInstanceSet(c)
+	big := arvados.InstanceType{Name: "big", ProviderType: "big"}
+	inst, err := is.Create(big, "", cloud.InstanceTags{"Name": "a"}, "", nil)
+	c.Assert(err, check.IsNil)
+	is.Stop()
+
+	// A new InstanceSet (e.g., after restarting the
+	// dispatcher) sees the existing lease.
+	is = s.newInstanceSet(c)
+	insts, err := is.Instances(nil)
+	c.Check(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Check(insts[0].ID(), check.Equals, inst.ID())
+	c.Check(insts[0].Tags(), check.DeepEquals, cloud.InstanceTags{"Name": "a"})
+	_, err = is.Create(big, "", nil, "", nil)
+	c.Check(err, check.FitsTypeOf, capacityError{})
+}
+
+// The private key can be given in the parameters instead of a file
+// (the dispatcher does this with DispatchPrivateKey).
+func (s *InventorySuite) TestPrivateKeyParameter(c *check.C) {
+	var params map[string]interface{}
+	c.Assert(json.Unmarshal(s.params, &params), check.IsNil)
+	buf, err := ioutil.ReadFile(params["PrivateKeyFile"].(string))
+	c.Assert(err, check.IsNil)
+	delete(params, "PrivateKeyFile")
+	params["PrivateKey"] = string(buf)
+	s.params, err = json.Marshal(params)
+	c.Assert(err, check.IsNil)
+
+	is := s.newInstanceSet(c)
+	small := arvados.InstanceType{Name: "small", ProviderType: "small"}
+	inst, err := is.Create(small, "", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	_, err = is.Create(small, "", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.Destroy(), check.IsNil)
+	c.Check(s.waitCreate(c, is, small).Address(), check.Equals, s.sshd.Address())
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c.Check(s.cleanupCmds, check.HasLen, 1)
+}
+
+func (s *InventorySuite) TestConfigErrors(c *check.C) {
+	hostkey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.hostkey)))
+	keyfile := `"PrivateKeyFile":"../../dispatchcloud/test/sshkey_dispatch"`
+	for params, errmatch := range map[string]string{
+		`{"Hosts":{"h1":{"ProviderType":"small","HostKey":"bogus"}},"StateFile":"/dev/null",` + keyfile + `}`:                `host "h1": error parsing HostKey.*`,
+		`{"Hosts":{"h1":{"HostKey":"` + hostkey + `"}},"StateFile":"/dev/null",` + keyfile + `}`:                             `host "h1": ProviderType is not configured`,
+		`{"Hosts":{"h1":{"ProviderType":"small","HostKey":"` + hostkey + `"}},` + keyfile + `}`:                              `StateFile is not configured`,
+		`{"Hosts":{"h1":{"ProviderType":"small","HostKey":"` + hostkey + `"}},"StateFile":"/dev/null"}`:                      `PrivateKeyFile is not configured`,
+		`{"Hosts":{"h1":{"ProviderType":"small","HostKey":"` + hostkey + `"}},"StateFile":"/dev/null","PrivateKey":"bogus"}`: `error parsing PrivateKey: .*`,
+	} {
+		_, err := Driver.InstanceSet(json.RawMessage(params), "test-instance-set-id", nil, ctxlog.TestLogger(c))
+		c.Check(err, check.ErrorMatches, errmatch, check.Commentf("%s", params))
+	}
+
+	fnm := c.MkDir() + "/state.json"
+	err := ioutil.WriteFile(fnm, []byte("{bogus"), 0600)
+	c.Assert(err, check.IsNil)
+	_, err = Driver.InstanceSet(json.RawMessage(`{"StateFile":"`+fnm+`","PrivateKeyFile":"../../dispatchcloud/test/sshkey_dispatch"}`), "test-instance-set-id", nil, ctxlog.TestLogger(c))
+	c.Check(err, check.ErrorMatches, `error parsing .*`)
+}
+
+func (s *InventorySuite) TestVerifyHostKey(c *check.C) {
+	is := s.newInstanceSet(c)
+	inst, err := is.Create(arvados.InstanceType{ProviderType: "big"}, "", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.VerifyHostKey(s.hostkey, nil), check.IsNil)
+	otherkey, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	c.Check(inst.VerifyHostKey(otherkey, nil), check.Equals, errHostKeyMismatch)
+}
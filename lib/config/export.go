@@ -74,6 +74,7 @@ var whitelist = map[string]bool{
 	"API.SendTimeout":                          true,
 	"API.VocabularyPath":                       false,
 	"API.WebsocketClientEventQueue":            false,
+	"API.WebsocketUpstreamFeed":                false,
 	"API.WebsocketServerEventQueue":            false,
 	"AuditLogs":                                false,
 	"AuditLogs.MaxAge":                         false,
@@ -86,9 +87,14 @@ var whitelist = map[string]bool{
 	"Collections.BalancePeriod":                false,
 	"Collections.BalanceTimeout":               false,
 	"Collections.BalanceUpdateLimit":           false,
+	"Collections.BalanceLifecycleRules":        false,
+	"Collections.BalanceStateFile":             false,
+	"Collections.BalanceFullRunInterval":       false,
 	"Collections.BlobDeleteConcurrency":        false,
 	"Collections.BlobMissingReport":            false,
 	"Collections.BlobReplicateConcurrency":     false,
+	"Collections.BlobScrubInterval":            false,
+	"Collections.BlobScrubMaxBytesPerSecond":   false,
 	"Collections.BlobSigning":                  true,
 	"Collections.BlobSigningKey":               false,
 	"Collections.BlobSigningTTL":               true,
@@ -100,15 +106,18 @@ var whitelist = map[string]bool{
 	"Collections.DefaultReplication":           true,
 	"Collections.DefaultTrashLifetime":         true,
 	"Collections.ForwardSlashNameSubstitution": true,
+	"Collections.KeepproxyBlockCache":          false,
 	"Collections.KeepproxyPermission":          false,
 	"Collections.ManagedProperties":            true,
 	"Collections.ManagedProperties.*":          true,
 	"Collections.ManagedProperties.*.*":        true,
 	"Collections.PreserveVersionIfIdle":        true,
 	"Collections.S3FolderObjects":              true,
+	"Collections.S3MultipartUploadTTL":         false,
 	"Collections.TrashSweepInterval":           false,
 	"Collections.TrustAllContent":              true,
 	"Collections.WebDAVCache":                  false,
+	"Collections.WebDAVLocks":                  false,
 	"Collections.WebDAVLogEvents":              false,
 	"Collections.WebDAVPermission":             false,
 	"Containers":                               true,
@@ -118,6 +127,7 @@ var whitelist = map[string]bool{
 	"Containers.CrunchRunCommand":              false,
 	"Containers.DefaultKeepCacheRAM":           true,
 	"Containers.DispatchPrivateKey":            false,
+	"Containers.FairShare":                     false,
 	"Containers.JobsAPI":                       true,
 	"Containers.JobsAPI.Enable":                true,
 	"Containers.JobsAPI.GitInternalDir":        false,
@@ -129,7 +139,11 @@ var whitelist = map[string]bool{
 	"Containers.MaxComputeVMs":                 false,
 	"Containers.MaxDispatchAttempts":           false,
 	"Containers.MaxRetryAttempts":              true,
+	"Containers.MaximumPriceFactor":            false,
 	"Containers.MinRetryPeriod":                true,
+	"Containers.OutputCheckpointInterval":      false,
+	"Containers.PartialOutputTTL":              false,
+	"Containers.Quotas":                        false,
 	"Containers.ReserveExtraRAM":               true,
 	"Containers.RuntimeEngine":                 true,
 	"Containers.ShellAccess":                   true,
@@ -212,6 +226,9 @@ var whitelist = map[string]bool{
 	"StorageClasses":                                      true,
 	"StorageClasses.*":                                    true,
 	"StorageClasses.*.Default":                            true,
+	"StorageClasses.*.ErasureCoding":                      true,
+	"StorageClasses.*.ErasureCoding.DataShards":           true,
+	"StorageClasses.*.ErasureCoding.ParityShards":         true,
 	"StorageClasses.*.Priority":                           true,
 	"SystemLogs":                                          false,
 	"SystemRootToken":                                     false,
@@ -242,6 +259,8 @@ var whitelist = map[string]bool{
 	"Volumes.*.AccessViaHosts":                            true,
 	"Volumes.*.AccessViaHosts.*":                          true,
 	"Volumes.*.AccessViaHosts.*.ReadOnly":                 true,
+	"Volumes.*.Compression":                               true,
+	"Volumes.*.Encryption":                                false,
 	"Volumes.*.ReadOnly":                                  true,
 	"Volumes.*.Replication":                               true,
 	"Volumes.*.StorageClasses":                            true,
@@ -305,10 +305,14 @@ func (ldr *Loader) Load() (*arvados.Config, error) {
 			ldr.checkToken(fmt.Sprintf("Clusters.%s.Collections.BlobSigningKey", id), cc.Collections.BlobSigningKey, true, false),
 			checkKeyConflict(fmt.Sprintf("Clusters.%s.PostgreSQL.Connection", id), cc.PostgreSQL.Connection),
 			ldr.checkEnum("Containers.LocalKeepLogsToContainerLog", cc.Containers.LocalKeepLogsToContainerLog, "none", "all", "errors"),
+			ldr.checkEnum("Containers.FairShare.GroupBy", cc.Containers.FairShare.GroupBy, "user", "project"),
 			ldr.checkEmptyKeepstores(cc),
 			ldr.checkUnlistedKeepstores(cc),
 			ldr.checkStorageClasses(cc),
+			ldr.checkVolumeCompression(cc),
+			ldr.checkVolumeEncryption(cc),
 			ldr.checkCUDAVersions(cc),
+			ldr.checkContainerPacking(cc),
 			// TODO: check non-empty Rendezvous on
 			// services other than Keepstore
 		} {
@@ -426,10 +430,54 @@ func (ldr *Loader) checkStorageClasses(cc arvados.Cluster) error {
 		if sc.Default {
 			haveDefault = true
 		}
+		if ec := sc.ErasureCoding; ec.DataShards < 0 || ec.ParityShards < 0 || (ec.DataShards == 0 && ec.ParityShards > 0) {
+			return fmt.Errorf("storage class %q: invalid ErasureCoding config: DataShards must be positive if ParityShards is non-zero, and neither can be negative", classid)
+		} else if ec.DataShards+ec.ParityShards > 256 {
+			return fmt.Errorf("storage class %q: invalid ErasureCoding config: DataShards+ParityShards must not exceed 256", classid)
+		}
 	}
 	if !haveDefault {
 		return fmt.Errorf("there is no default storage class (at least one entry in StorageClasses must have Default: true)")
 	}
+	for name, rule := range cc.Collections.BalanceLifecycleRules {
+		if rule.FromStorageClass == "" && rule.ToStorageClass == "" {
+			continue
+		}
+		for _, classid := range []string{rule.FromStorageClass, rule.ToStorageClass} {
+			if _, ok := cc.StorageClasses[classid]; !ok {
+				return fmt.Errorf("Collections.BalanceLifecycleRules.%s: refers to storage class %q that is not defined in StorageClasses", name, classid)
+			}
+		}
+		if rule.FromStorageClass == rule.ToStorageClass {
+			return fmt.Errorf("Collections.BalanceLifecycleRules.%s: FromStorageClass and ToStorageClass are the same", name)
+		}
+		if rule.MinAge < 0 {
+			return fmt.Errorf("Collections.BalanceLifecycleRules.%s: MinAge must not be negative", name)
+		}
+	}
+	return nil
+}
+
+func (ldr *Loader) checkVolumeCompression(cc arvados.Cluster) error {
+	for volid, vol := range cc.Volumes {
+		err := ldr.checkEnum(fmt.Sprintf("Volumes.%s.Compression", volid), vol.Compression, "", "zstd")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ldr *Loader) checkVolumeEncryption(cc arvados.Cluster) error {
+	for volid, vol := range cc.Volumes {
+		err := ldr.checkEnum(fmt.Sprintf("Volumes.%s.Encryption.KeyProvider", volid), vol.Encryption.KeyProvider, "", "file")
+		if err != nil {
+			return err
+		}
+		if vol.Encryption.KeyProvider == "file" && vol.Encryption.KeyFile == "" {
+			return fmt.Errorf("Volumes.%s.Encryption.KeyFile: must be provided when KeyProvider is \"file\"", volid)
+		}
+	}
 	return nil
 }
 
@@ -451,6 +499,15 @@ func (ldr *Loader) checkCUDAVersions(cc arvados.Cluster) error {
 	return nil
 }
 
+func (ldr *Loader) checkContainerPacking(cc arvados.Cluster) error {
+	if cc.Containers.CloudVMs.MaxContainersPerInstance > 1 && cc.Containers.RuntimeEngine != "docker" && cc.Containers.RuntimeEngine != "oci" {
+		// Packing works, but containers can use more than
+		// their share of VCPUs and RAM.
+		ldr.Logger.Warnf("Containers.CloudVMs.MaxContainersPerInstance is %d, but RuntimeEngine %q does not limit each container's VCPUs and RAM", cc.Containers.CloudVMs.MaxContainersPerInstance, cc.Containers.RuntimeEngine)
+	}
+	return nil
+}
+
 func checkKeyConflict(label string, m map[string]string) error {
 	saw := map[string]bool{}
 	for k := range m {
@@ -14,6 +14,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -695,3 +696,112 @@ Clusters:
 	_, err = ldr.Load()
 	c.Assert(err, check.ErrorMatches, `there is no default storage class.*`)
 }
+
+func (s *LoadSuite) TestErasureCodedStorageClasses(c *check.C) {
+	ldr := testLoader(c, `
+Clusters:
+ z1111:
+  StorageClasses:
+   archive:
+    Default: true
+    ErasureCoding:
+     DataShards: 6
+     ParityShards: 3
+  Volumes:
+   z:
+    StorageClasses:
+     archive: true`, nil)
+	cfg, err := ldr.Load()
+	c.Assert(err, check.IsNil)
+	cc, err := cfg.GetCluster("z1111")
+	c.Assert(err, check.IsNil)
+	c.Check(cc.StorageClasses["archive"].ErasureCoding.Enabled(), check.Equals, true)
+	c.Check(cc.StorageClasses["archive"].ErasureCoding.DataShards, check.Equals, 6)
+	c.Check(cc.StorageClasses["archive"].ErasureCoding.ParityShards, check.Equals, 3)
+
+	for _, trial := range []string{
+		`{DataShards: 0, ParityShards: 2}`,
+		`{DataShards: -1, ParityShards: 2}`,
+		`{DataShards: 4, ParityShards: -2}`,
+		`{DataShards: 200, ParityShards: 100}`,
+	} {
+		ldr := testLoader(c, `
+Clusters:
+ z1111:
+  StorageClasses:
+   archive:
+    Default: true
+    ErasureCoding: `+trial+`
+  Volumes:
+   z:
+    StorageClasses:
+     archive: true`, nil)
+		_, err = ldr.Load()
+		c.Check(err, check.ErrorMatches, `storage class "archive": invalid ErasureCoding config.*`, check.Commentf("%s", trial))
+	}
+}
+
+func (s *LoadSuite) TestLifecycleRules(c *check.C) {
+	for _, trial := range []struct {
+		rule   string
+		errMsg string
+	}{
+		{`{FromStorageClass: fast, ToStorageClass: archive, MinAge: 720h}`, ``},
+		{`{FromStorageClass: fast, ToStorageClass: archive, MinAge: 720h, ProjectUUID: z1111-j7d0g-012345678901234}`, ``},
+		{`{FromStorageClass: fast, ToStorageClass: nonexistent, MinAge: 720h}`, `.*refers to storage class "nonexistent".*`},
+		{`{FromStorageClass: "", ToStorageClass: archive, MinAge: 720h}`, `.*refers to storage class "".*`},
+		{`{FromStorageClass: fast, ToStorageClass: fast, MinAge: 720h}`, `.*FromStorageClass and ToStorageClass are the same`},
+		{`{FromStorageClass: fast, ToStorageClass: archive, MinAge: -1h}`, `.*MinAge must not be negative`},
+	} {
+		ldr := testLoader(c, `
+Clusters:
+ z1111:
+  StorageClasses:
+   fast:
+    Default: true
+   archive: {}
+  Collections:
+   BalanceLifecycleRules:
+    rule1: `+trial.rule+`
+  Volumes:
+   z:
+    StorageClasses:
+     fast: true
+     archive: true`, nil)
+		cfg, err := ldr.Load()
+		if trial.errMsg != "" {
+			c.Check(err, check.ErrorMatches, `Collections.BalanceLifecycleRules.rule1: `+trial.errMsg, check.Commentf("%s", trial.rule))
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("%s", trial.rule))
+		cc, err := cfg.GetCluster("z1111")
+		c.Assert(err, check.IsNil)
+		c.Check(cc.Collections.BalanceLifecycleRules, check.HasLen, 1)
+		c.Check(cc.Collections.BalanceLifecycleRules["rule1"].MinAge, check.Equals, arvados.Duration(720*time.Hour))
+	}
+}
+
+func (s *LoadSuite) TestVolumeEncryption(c *check.C) {
+	for _, trial := range []struct {
+		encryption string
+		errMsg     string
+	}{
+		{`{}`, ``},
+		{`{KeyProvider: file, KeyFile: /etc/arvados/keepstore.key}`, ``},
+		{`{KeyProvider: file}`, `Volumes.z1111-nyw5e-000000000000000.Encryption.KeyFile: must be provided when KeyProvider is "file"`},
+		{`{KeyProvider: kms, KeyFile: /etc/arvados/keepstore.key}`, `Volumes.z1111-nyw5e-000000000000000.Encryption.KeyProvider: unacceptable value "kms".*`},
+	} {
+		ldr := testLoader(c, `
+Clusters:
+ z1111:
+  Volumes:
+   z1111-nyw5e-000000000000000:
+    Encryption: `+trial.encryption, nil)
+		_, err := ldr.Load()
+		if trial.errMsg != "" {
+			c.Check(err, check.ErrorMatches, trial.errMsg, check.Commentf("%s", trial.encryption))
+		} else {
+			c.Check(err, check.IsNil, check.Commentf("%s", trial.encryption))
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
@@ -28,9 +29,18 @@ var errTooManySymlinks = errors.New("too many symlinks, or symlink cycle")
 const limitFollowSymlinks = 10
 
 type filetodo struct {
-	src  string
-	dst  string
-	size int64
+	src   string
+	dst   string
+	size  int64
+	mtime time.Time
+}
+
+// uploadedFile records the content of a host file that has already
+// been written to Keep by a previous copier run.
+type uploadedFile struct {
+	size     int64
+	mtime    time.Time
+	snapshot *arvados.Subtree
 }
 
 // copier copies data from a finished container's output path to a new
@@ -60,6 +70,17 @@ type copier struct {
 	secretMounts  map[string]arvados.Mount
 	logger        printfer
 
+	// If uploaded is not nil, host files that have not changed
+	// since they were recorded in uploaded are added to the
+	// output without reading them again, and files that do get
+	// copied are recorded in uploaded for next time.
+	uploaded map[string]uploadedFile
+
+	// If partial is true, the container is still running, so
+	// files that disappear while we are copying are skipped
+	// instead of causing an error.
+	partial bool
+
 	dirs     []string
 	files    []filetodo
 	manifest string
@@ -85,7 +106,15 @@ func (cp *copier) Copy() (string, error) {
 	}
 	var unflushed int64
 	var lastparentdir string
+	var copied []filetodo
 	for _, f := range cp.files {
+		if u, ok := cp.uploaded[f.src]; ok && u.size == f.size && u.mtime.Equal(f.mtime) {
+			err = arvados.Splice(fs, f.dst, u.snapshot)
+			if err != nil {
+				return "", fmt.Errorf("error adding previously copied file %q to output collection: %v", f.dst, err)
+			}
+			continue
+		}
 		// If a dir has just had its last file added, do a
 		// full Flush. Otherwise, do a partial Flush (write
 		// full-size blocks, but leave the last short block
@@ -100,12 +129,43 @@ func (cp *copier) Copy() (string, error) {
 		lastparentdir = dir
 
 		n, err := cp.copyFile(fs, f)
-		if err != nil {
-			return "", fmt.Errorf("error copying file %q into output collection: %v", f, err)
+		if cp.partial && os.IsNotExist(err) {
+			cp.logger.Printf("skipping %q: file was removed while copying", f.dst)
+			fs.Remove(f.dst)
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("error copying file %q into output collection: %v", f.dst, err)
 		}
 		unflushed += n
+		copied = append(copied, f)
+	}
+	mt, err := fs.MarshalManifest(".")
+	if err != nil {
+		return "", err
+	}
+	if cp.uploaded != nil {
+		cp.recordUploaded(mt, copied)
+	}
+	return mt, nil
+}
+
+// recordUploaded adds the given files, which have just been written
+// to Keep as part of manifest text mt, to cp.uploaded.
+func (cp *copier) recordUploaded(mt string, copied []filetodo) {
+	// Load the manifest into a new filesystem so the snapshots
+	// refer only to stored blocks, not our in-memory buffers.
+	fs, err := (&arvados.Collection{ManifestText: mt}).FileSystem(cp.client, cp.keepClient)
+	if err != nil {
+		cp.logger.Printf("error loading output manifest to record copied files: %v", err)
+		return
+	}
+	for _, f := range copied {
+		snap, err := arvados.Snapshot(fs, f.dst)
+		if err != nil {
+			continue
+		}
+		cp.uploaded[f.src] = uploadedFile{size: f.size, mtime: f.mtime, snapshot: snap}
 	}
-	return fs.MarshalManifest(".")
 }
 
 func (cp *copier) copyFile(fs arvados.CollectionFileSystem, f filetodo) (int64, error) {
@@ -167,7 +227,10 @@ func (cp *copier) walkMount(dest, src string, maxSymlinks int, walkMountsBelow b
 	case srcMount.Kind == "tmp":
 		// Handle by walking the host filesystem.
 		return cp.walkHostFS(dest, src, maxSymlinks, walkMountsBelow)
-	case srcMount.Kind != "collection":
+	case srcMount.Kind == "partial_output" && srcMount.PortableDataHash == "":
+		// No previous attempt saved any output, so the
+		// mount is an empty directory.
+	case srcMount.Kind != "collection" && srcMount.Kind != "partial_output":
 		return fmt.Errorf("%q: unsupported mount %q in output (kind is %q)", src, srcRoot, srcMount.Kind)
 	case !srcMount.Writable:
 		mft, err := cp.getManifest(srcMount.PortableDataHash)
@@ -255,7 +318,9 @@ func (cp *copier) walkHostFS(dest, src string, maxSymlinks int, includeMounts bo
 
 	// If src is a symlink, walk its target.
 	fi, err := os.Lstat(hostsrc)
-	if err != nil {
+	if cp.partial && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("lstat %q: %s", src, err)
 	}
 	if fi.Mode()&os.ModeSymlink != 0 {
@@ -280,7 +345,9 @@ func (cp *copier) walkHostFS(dest, src string, maxSymlinks int, includeMounts bo
 			cp.dirs = append(cp.dirs, dest)
 		}
 		dir, err := os.Open(hostsrc)
-		if err != nil {
+		if cp.partial && os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
 			return fmt.Errorf("open %q: %s", src, err)
 		}
 		names, err := dir.Readdirnames(-1)
@@ -325,9 +392,10 @@ func (cp *copier) walkHostFS(dest, src string, maxSymlinks int, includeMounts bo
 	// If src is a regular file, append it to cp.files.
 	if fi.Mode().IsRegular() {
 		cp.files = append(cp.files, filetodo{
-			src:  hostsrc,
-			dst:  dest,
-			size: fi.Size(),
+			src:   hostsrc,
+			dst:   dest,
+			size:  fi.Size(),
+			mtime: fi.ModTime(),
 		})
 		return nil
 	}
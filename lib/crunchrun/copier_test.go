@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"syscall"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
@@ -68,7 +69,7 @@ func (s *copierSuite) TestRegularFilesAndDirs(c *check.C) {
 	c.Check(s.cp.dirs, check.DeepEquals, []string{"/dir1", "/dir1/dir2", "/dir1/dir2/dir3"})
 	c.Check(s.cp.files, check.DeepEquals, []filetodo{
 		{src: os.DevNull, dst: "/dir1/dir2/dir3/.keep"},
-		{src: s.cp.hostOutputDir + "/dir1/foo", dst: "/dir1/foo", size: 3},
+		{src: s.cp.hostOutputDir + "/dir1/foo", dst: "/dir1/foo", size: 3, mtime: s.mtime(c, "dir1/foo")},
 	})
 	c.Check(s.log.String(), check.Matches, `.* msg="Skipping unsupported file type \(mode 200000644\) in output dir: \\"/ctr/outdir/dir1/fifo\\""\n`)
 }
@@ -165,6 +166,8 @@ func (s *copierSuite) TestSymlink(c *check.C) {
 		c.Assert(err, check.IsNil)
 	}
 
+	mtime := s.mtime(c, "dir1/file")
+
 	err = s.cp.walkMount("", s.cp.ctrOutputDir, 10, true)
 	c.Check(err, check.IsNil)
 	c.Check(s.cp.dirs, check.DeepEquals, []string{
@@ -175,16 +178,16 @@ func (s *copierSuite) TestSymlink(c *check.C) {
 	})
 	c.Check(s.cp.files, check.DeepEquals, []filetodo{
 		{dst: "/dir1/dir2/dir3/.keep", src: os.DevNull},
-		{dst: "/dir1/dir2/l_rel_file", src: hostfile, size: 4},
-		{dst: "/dir1/file", src: hostfile, size: 4},
+		{dst: "/dir1/dir2/l_rel_file", src: hostfile, size: 4, mtime: mtime},
+		{dst: "/dir1/file", src: hostfile, size: 4, mtime: mtime},
 		{dst: "/l_abs_dir2/dir3/.keep", src: os.DevNull},
-		{dst: "/l_abs_dir2/l_rel_file", src: hostfile, size: 4},
-		{dst: "/l_abs_file", src: hostfile, size: 4},
+		{dst: "/l_abs_dir2/l_rel_file", src: hostfile, size: 4, mtime: mtime},
+		{dst: "/l_abs_file", src: hostfile, size: 4, mtime: mtime},
 		{dst: "/l_rel_dir3/.keep", src: os.DevNull},
-		{dst: "/l_rel_file", src: hostfile, size: 4},
+		{dst: "/l_rel_file", src: hostfile, size: 4, mtime: mtime},
 		{dst: "/morelinks/l_rel_dir2/dir3/.keep", src: os.DevNull},
-		{dst: "/morelinks/l_rel_dir2/l_rel_file", src: hostfile, size: 4},
-		{dst: "/morelinks/l_rel_l_rel_file", src: hostfile, size: 4},
+		{dst: "/morelinks/l_rel_dir2/l_rel_file", src: hostfile, size: 4, mtime: mtime},
+		{dst: "/morelinks/l_rel_l_rel_file", src: hostfile, size: 4, mtime: mtime},
 	})
 }
 
@@ -214,11 +217,49 @@ func (s *copierSuite) TestWritableMountBelow(c *check.C) {
 	c.Check(err, check.IsNil)
 	c.Check(s.cp.dirs, check.DeepEquals, []string{"/mount"})
 	c.Check(s.cp.files, check.DeepEquals, []filetodo{
-		{src: s.cp.hostOutputDir + "/file", dst: "/file", size: 4},
-		{src: s.cp.hostOutputDir + "/mount/foo", dst: "/mount/foo", size: 3},
+		{src: s.cp.hostOutputDir + "/file", dst: "/file", size: 4, mtime: s.mtime(c, "file")},
+		{src: s.cp.hostOutputDir + "/mount/foo", dst: "/mount/foo", size: 3, mtime: s.mtime(c, "mount/foo")},
 	})
 }
 
+func (s *copierSuite) TestReuseUploadedFiles(c *check.C) {
+	s.cp.keepClient = &KeepTestClient{}
+	s.cp.uploaded = map[string]uploadedFile{}
+	s.writeFileInOutputDir(c, "foo", "foo")
+	s.writeFileInOutputDir(c, "bar", "bar")
+	_, err := s.cp.Copy()
+	c.Assert(err, check.IsNil)
+	c.Check(s.log.String(), check.Matches, `(?ms).*copying .*/bar.*`)
+	c.Check(s.log.String(), check.Matches, `(?ms).*copying .*/foo.*`)
+
+	// Change bar. Only bar should be copied again.
+	s.writeFileInOutputDir(c, "bar", "barbar")
+	s.cp.dirs, s.cp.files = nil, nil
+	s.log.Reset()
+	mt, err := s.cp.Copy()
+	c.Assert(err, check.IsNil)
+	c.Check(s.log.String(), check.Matches, `(?ms).*copying .*/bar.*`)
+	c.Check(s.log.String(), check.Not(check.Matches), `(?ms).*copying .*/foo.*`)
+	c.Check(mt, check.Matches, `\. \S+ \S+ 0:6:bar 9:3:foo\n`)
+}
+
+func (s *copierSuite) TestPartialMissingOutputDir(c *check.C) {
+	c.Assert(os.Remove(s.cp.hostOutputDir), check.IsNil)
+	err := s.cp.walkMount("", s.cp.ctrOutputDir, 10, true)
+	c.Check(err, check.ErrorMatches, `.*no such file or directory.*`)
+
+	s.cp.partial = true
+	err = s.cp.walkMount("", s.cp.ctrOutputDir, 10, true)
+	c.Check(err, check.IsNil)
+	c.Check(s.cp.files, check.HasLen, 0)
+}
+
+func (s *copierSuite) mtime(c *check.C, path string) time.Time {
+	fi, err := os.Stat(s.cp.hostOutputDir + "/" + path)
+	c.Assert(err, check.IsNil)
+	return fi.ModTime()
+}
+
 func (s *copierSuite) writeFileInOutputDir(c *check.C, path, data string) {
 	f, err := os.OpenFile(s.cp.hostOutputDir+"/"+path, os.O_CREATE|os.O_WRONLY, 0644)
 	c.Assert(err, check.IsNil)
@@ -146,6 +146,21 @@ type ContainerRunner struct {
 	hoststatReporter *crunchstat.Reporter
 	statInterval     time.Duration
 	cgroupRoot       string
+
+	// Output checkpoint state, see output_checkpoint.go.
+	outputCheckpointInterval time.Duration
+	partialOutputTTL         time.Duration
+	stopOutputCheckpoints    func()
+	uploadedOutput           map[string]uploadedFile
+	partialOutputUUID        string
+	partialOutputText        string
+	containerRequests        []arvados.ContainerRequest
+	localLocators            map[string]string
+
+	// If not nil, log messages are also copied to the structured
+	// log, see structured_log.go.
+	structuredLog *structuredLogger
+
 	// What we expect the container's cgroup parent to be.
 	expectCgroupParent string
 	// What we tell docker to use as the container's cgroup
@@ -303,7 +318,7 @@ func (runner *ContainerRunner) ArvMountCmd(cmdline []string, token string) (c *e
 	if err != nil {
 		return nil, err
 	}
-	runner.arvMountLog = NewThrottledLogger(w)
+	runner.arvMountLog = runner.newThrottledLogger("arv-mount", w)
 	scanner := logScanner{
 		Patterns: []string{
 			"Keep write error",
@@ -419,7 +434,9 @@ func (runner *ContainerRunner) SetupMounts() (map[string]bindmount, error) {
 		"--storage-classes", strings.Join(runner.Container.OutputStorageClasses, ","),
 		fmt.Sprintf("--crunchstat-interval=%v", runner.statInterval.Seconds())}
 
-	if runner.executor.Runtime() == "docker" {
+	if runner.executor.Runtime() == "docker" || (runner.executor.Runtime() == "oci" && os.Geteuid() == 0) {
+		// The container process runs as a different user,
+		// so it needs to be allowed to access the mount.
 		arvMountCmd = append(arvMountCmd, "--allow-other")
 	}
 
@@ -612,6 +629,29 @@ func (runner *ContainerRunner) SetupMounts() (map[string]bindmount, error) {
 				bindmounts[bind] = bindmount{HostPath: tmpfn, ReadOnly: true}
 			}
 
+		case mnt.Kind == "partial_output":
+			pdh, err := runner.findPartialOutput()
+			if err != nil {
+				return nil, err
+			}
+			if pdh == "" {
+				// No previous attempt saved any
+				// output, so provide an empty
+				// directory.
+				tmpdir, err := runner.MkTempDir(runner.parentTemp, "partial_output")
+				if err != nil {
+					return nil, fmt.Errorf("creating temp dir: %v", err)
+				}
+				bindmounts[bind] = bindmount{HostPath: tmpdir, ReadOnly: true}
+				break
+			}
+			mnt.PortableDataHash = pdh
+			mnt.Writable = false
+			runner.Container.Mounts[bind] = mnt
+			src := fmt.Sprintf("%s/by_id/%s", runner.ArvMountPoint, pdh)
+			bindmounts[bind] = bindmount{HostPath: src, ReadOnly: true}
+			collectionPaths = append(collectionPaths, src)
+
 		case mnt.Kind == "git_tree":
 			tmpdir, err := runner.MkTempDir(runner.parentTemp, "git_tree")
 			if err != nil {
@@ -722,7 +762,7 @@ func (runner *ContainerRunner) startHoststat() error {
 	if err != nil {
 		return err
 	}
-	runner.hoststatLogger = NewThrottledLogger(w)
+	runner.hoststatLogger = runner.newThrottledLogger("hoststat", w)
 	runner.hoststatReporter = &crunchstat.Reporter{
 		Logger:     log.New(runner.hoststatLogger, "", 0),
 		CgroupRoot: runner.cgroupRoot,
@@ -737,7 +777,7 @@ func (runner *ContainerRunner) startCrunchstat() error {
 	if err != nil {
 		return err
 	}
-	runner.statLogger = NewThrottledLogger(w)
+	runner.statLogger = runner.newThrottledLogger("crunchstat", w)
 	runner.statReporter = &crunchstat.Reporter{
 		CID:          runner.executor.CgroupID(),
 		Logger:       log.New(runner.statLogger, "", 0),
@@ -966,7 +1006,7 @@ func (runner *ContainerRunner) CreateContainer(imageID string, bindmounts map[st
 	} else if w, err := runner.NewLogWriter("stdout"); err != nil {
 		return err
 	} else {
-		stdout = NewThrottledLogger(w)
+		stdout = runner.newThrottledLogger("stdout", w)
 	}
 
 	if mnt, ok := runner.Container.Mounts["stderr"]; ok {
@@ -978,7 +1018,7 @@ func (runner *ContainerRunner) CreateContainer(imageID string, bindmounts map[st
 	} else if w, err := runner.NewLogWriter("stderr"); err != nil {
 		return err
 	} else {
-		stderr = NewThrottledLogger(w)
+		stderr = runner.newThrottledLogger("stderr", w)
 	}
 
 	env := runner.Container.Environment
@@ -1190,6 +1230,9 @@ func (runner *ContainerRunner) reportArvMountWarning(pattern, text string) {
 // CaptureOutput saves data from the container's output directory if
 // needed, and updates the container output accordingly.
 func (runner *ContainerRunner) CaptureOutput(bindmounts map[string]bindmount) error {
+	if runner.stopOutputCheckpoints != nil {
+		runner.stopOutputCheckpoints()
+	}
 	if runner.Container.RuntimeConstraints.API {
 		// Output may have been set directly by the container, so
 		// refresh the container record to check.
@@ -1205,6 +1248,31 @@ func (runner *ContainerRunner) CaptureOutput(bindmounts map[string]bindmount) er
 		}
 	}
 
+	txt, err := runner.copyOutput(bindmounts, false)
+	if err != nil {
+		return err
+	}
+	runner.finishPartialOutput(txt)
+	var resp arvados.Collection
+	err = runner.ContainerArvClient.Create("collections", arvadosclient.Dict{
+		"ensure_unique_name": true,
+		"collection": arvadosclient.Dict{
+			"is_trashed":    true,
+			"name":          "output for " + runner.Container.UUID,
+			"manifest_text": txt,
+		},
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("error creating output collection: %v", err)
+	}
+	runner.OutputPDH = &resp.PortableDataHash
+	return nil
+}
+
+// copyOutput copies the container's output to Keep and returns the
+// manifest text. If partial is true, the container is still
+// running.
+func (runner *ContainerRunner) copyOutput(bindmounts map[string]bindmount, partial bool) (string, error) {
 	txt, err := (&copier{
 		client:        runner.containerClient,
 		arvClient:     runner.ContainerArvClient,
@@ -1215,35 +1283,59 @@ func (runner *ContainerRunner) CaptureOutput(bindmounts map[string]bindmount) er
 		mounts:        runner.Container.Mounts,
 		secretMounts:  runner.SecretMounts,
 		logger:        runner.CrunchLog,
+		uploaded:      runner.uploadedOutput,
+		partial:       partial,
 	}).Copy()
 	if err != nil {
-		return err
+		return "", err
 	}
-	if n := len(regexp.MustCompile(` [0-9a-f]+\+\S*\+R`).FindAllStringIndex(txt, -1)); n > 0 {
-		runner.CrunchLog.Printf("Copying %d data blocks from remote input collections...", n)
-		fs, err := (&arvados.Collection{ManifestText: txt}).FileSystem(runner.containerClient, runner.ContainerKeepClient)
-		if err != nil {
-			return err
+	return runner.localizeRemoteBlocks(txt)
+}
+
+var remoteLocatorRegexp = regexp.MustCompile(` [0-9a-f]{32}\+[0-9]+\S*\+R\S*`)
+
+// localizeRemoteBlocks copies data blocks from remote input
+// collections (with +R hints) to the local cluster, and returns the
+// manifest text with local locators. Blocks that were already copied
+// (e.g., by a previous output checkpoint) are not copied again.
+func (runner *ContainerRunner) localizeRemoteBlocks(txt string) (string, error) {
+	if runner.localLocators == nil {
+		runner.localLocators = map[string]string{}
+	}
+	var todo []string
+	for _, loc := range remoteLocatorRegexp.FindAllString(txt, -1) {
+		loc = loc[1:]
+		if _, ok := runner.localLocators[blockHashSize(loc)]; !ok {
+			todo = append(todo, loc)
+		}
+	}
+	if len(todo) > 0 {
+		runner.CrunchLog.Printf("Copying %d data blocks from remote input collections...", len(todo))
+	}
+	for _, loc := range todo {
+		if _, ok := runner.localLocators[blockHashSize(loc)]; ok {
+			// Same block appeared more than once.
+			continue
 		}
-		txt, err = fs.MarshalManifest(".")
+		local, err := runner.ContainerKeepClient.LocalLocator(loc)
 		if err != nil {
-			return err
+			return "", err
 		}
+		runner.localLocators[blockHashSize(loc)] = local
 	}
-	var resp arvados.Collection
-	err = runner.ContainerArvClient.Create("collections", arvadosclient.Dict{
-		"ensure_unique_name": true,
-		"collection": arvadosclient.Dict{
-			"is_trashed":    true,
-			"name":          "output for " + runner.Container.UUID,
-			"manifest_text": txt,
-		},
-	}, &resp)
-	if err != nil {
-		return fmt.Errorf("error creating output collection: %v", err)
+	return remoteLocatorRegexp.ReplaceAllStringFunc(txt, func(loc string) string {
+		return " " + runner.localLocators[blockHashSize(loc[1:])]
+	}), nil
+}
+
+// blockHashSize returns the "hash+size" part of a block locator.
+func blockHashSize(loc string) string {
+	if i := strings.Index(loc, "+"); i >= 0 {
+		if j := strings.Index(loc[i+1:], "+"); j >= 0 {
+			return loc[:i+1+j]
+		}
 	}
-	runner.OutputPDH = &resp.PortableDataHash
-	return nil
+	return loc
 }
 
 func (runner *ContainerRunner) CleanupDirs() {
@@ -1311,11 +1403,13 @@ func (runner *ContainerRunner) CommitLogs() error {
 		defer runner.cStateLock.Unlock()
 
 		runner.CrunchLog.Print(runner.finalState)
+		runner.structuredLog.logState(runner.finalState)
 
 		if runner.arvMountLog != nil {
 			runner.arvMountLog.Close()
 		}
 		runner.CrunchLog.Close()
+		runner.structuredLog.Close()
 
 		// Closing CrunchLog above allows them to be committed to Keep at this
 		// point, but re-open crunch log with ArvClient in case there are any
@@ -1412,8 +1506,12 @@ func (runner *ContainerRunner) UpdateContainerRunning() error {
 	if runner.cCancelled {
 		return ErrCancelled
 	}
-	return runner.DispatcherArvClient.Update("containers", runner.Container.UUID,
+	err := runner.DispatcherArvClient.Update("containers", runner.Container.UUID,
 		arvadosclient.Dict{"container": arvadosclient.Dict{"state": "Running", "gateway_address": runner.gateway.Address}}, nil)
+	if err == nil {
+		runner.structuredLog.logState("Running")
+	}
+	return err
 }
 
 // ContainerToken returns the api_token the container (and any
@@ -1608,6 +1706,7 @@ func (runner *ContainerRunner) Run() (err error) {
 		runner.checkBrokenNode(err)
 		return
 	}
+	runner.startOutputCheckpoints(bindmounts)
 
 	err = runner.WaitFinish()
 	if err == nil && !runner.IsCancelled() {
@@ -1727,7 +1826,12 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	enableNetwork := flags.String("container-enable-networking", "default", "enable networking \"always\" (for all containers) or \"default\" (for containers that request it)")
 	networkMode := flags.String("container-network-mode", "default", `Docker network mode for container (use any argument valid for docker --net)`)
 	memprofile := flags.String("memprofile", "", "write memory profile to `file` after running container")
-	runtimeEngine := flags.String("runtime-engine", "docker", "container runtime: docker or singularity")
+	runtimeEngine := flags.String("runtime-engine", "docker", "container runtime: docker, singularity, or oci")
+	ociRuntime := flags.String("oci-runtime", "", "OCI runtime executable to use with -runtime-engine=oci (default: crun or runc, whichever is found first in PATH)")
+	outputCheckpointInterval := flags.Duration("output-checkpoint-interval", 0, "save partial output to Keep at this interval while the container is running (0 = never)")
+	partialOutputTTL := flags.Duration("partial-output-ttl", defaultPartialOutputTTL, "delete partial output this long after it was last updated, if the container does not complete")
+	structuredLogs := flags.Bool("structured-logs", false, "also write log messages and crunchstat samples as JSON records to the \"structured\" log")
+	structuredLogsStdio := flags.Bool("structured-logs-stdio", false, "with -structured-logs, also copy the container's stdout and stderr to the structured log")
 	flags.Duration("check-containerd", 0, "Ignored. Exists for compatibility with older versions.")
 
 	ignoreDetachFlag := false
@@ -1826,6 +1930,14 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		return 1
 	}
 
+	if *structuredLogs {
+		err = cr.startStructuredLog(*structuredLogsStdio)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+
 	if keepstore == nil {
 		// Log explanation (if any) for why we're not running
 		// a local keepstore.
@@ -1844,7 +1956,7 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 			log.Print(err)
 			return 1
 		}
-		cr.keepstoreLogger = NewThrottledLogger(logwriter)
+		cr.keepstoreLogger = cr.newThrottledLogger("keepstore", logwriter)
 
 		var writer io.WriteCloser = cr.keepstoreLogger
 		if logWhat == "errors" {
@@ -1868,6 +1980,8 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		cr.executor, err = newDockerExecutor(containerUUID, cr.CrunchLog.Printf, cr.containerWatchdogInterval)
 	case "singularity":
 		cr.executor, err = newSingularityExecutor(cr.CrunchLog.Printf)
+	case "oci":
+		cr.executor, err = newOCIExecutor(containerUUID, cr.CrunchLog.Printf, *ociRuntime)
 	default:
 		cr.CrunchLog.Printf("%s: unsupported RuntimeEngine %q", containerUUID, *runtimeEngine)
 		cr.CrunchLog.Close()
@@ -1917,6 +2031,8 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	cr.statInterval = *statInterval
 	cr.cgroupRoot = *cgroupRoot
 	cr.expectCgroupParent = *cgroupParent
+	cr.outputCheckpointInterval = *outputCheckpointInterval
+	cr.partialOutputTTL = *partialOutputTTL
 	cr.enableMemoryLimit = *enableMemoryLimit
 	cr.enableNetwork = *enableNetwork
 	cr.networkMode = *networkMode
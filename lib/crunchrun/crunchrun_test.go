@@ -98,6 +98,12 @@ type ArvTestClient struct {
 	sync.Mutex
 	WasSetRunning bool
 	callraw       bool
+
+	// Returned by collection list calls, i.e., when looking for
+	// partial output from a previous attempt.
+	partialOutputs []arvados.Collection
+	// Filters used in the last collection list call.
+	partialOutputFilters interface{}
 }
 
 type KeepTestClient struct {
@@ -157,6 +163,8 @@ var normalizedWithSubdirsPDH = "a0def87f80dd594d4675809e83bd4f15+367"
 var denormalizedManifestWithSubdirs = ". 3e426d509afffb85e06c4c96a7c15e91+27+Aa124ac75e5168396c73c0abcdefgh11234567890@569fa8c3 0:9:file1_in_main.txt 9:18:file2_in_main.txt 0:27:zzzzz-8i9sb-bcdefghijkdhvnk.log.txt 0:10:subdir1/file1_in_subdir1.txt 10:17:subdir1/file2_in_subdir1.txt\n"
 var denormalizedWithSubdirsPDH = "b0def87f80dd594d4675809e83bd4f15+367"
 
+var fakeContainerRequestUUID = "zzzzz-xvhdp-000000000000000"
+var fakeContainerRequestOwnerUUID = "zzzzz-j7d0g-000000000000000"
 var fakeAuthUUID = "zzzzz-gj3su-55pqoyepgi2glem"
 var fakeAuthToken = "a3ltuwzqcu2u4sc0q7yhpc2w7s00fdcqecg5d6e0u3pfohmbjt"
 
@@ -204,6 +212,12 @@ func (client *ArvTestClient) Call(method, resourceType, uuid, action string, par
 			return json.Unmarshal(client.secretMounts, output)
 		}
 		return json.Unmarshal([]byte(`{"secret_mounts":{}}`), output)
+	case method == "GET" && resourceType == "container_requests" && uuid == "":
+		return json.Unmarshal([]byte(`{"items":[{"uuid":"`+fakeContainerRequestUUID+`","owner_uuid":"`+fakeContainerRequestOwnerUUID+`"}]}`), output)
+	case method == "GET" && resourceType == "collections" && uuid == "":
+		client.partialOutputFilters = parameters["filters"]
+		output.(*arvados.CollectionList).Items = client.partialOutputs
+		return nil
 	default:
 		return fmt.Errorf("Not found")
 	}
@@ -271,8 +285,8 @@ func (client *ArvTestClient) Update(resourceType string, uuid string, parameters
 		if parameters["container"].(arvadosclient.Dict)["state"] == "Running" {
 			client.WasSetRunning = true
 		}
-	} else if resourceType == "collections" {
-		mt := parameters["collection"].(arvadosclient.Dict)["manifest_text"].(string)
+	} else if resourceType == "collections" && output != nil {
+		mt, _ := parameters["collection"].(arvadosclient.Dict)["manifest_text"].(string)
 		output.(*arvados.Collection).UUID = uuid
 		output.(*arvados.Collection).PortableDataHash = fmt.Sprintf("%x", md5.Sum([]byte(mt)))
 	}
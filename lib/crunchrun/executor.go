@@ -33,7 +33,7 @@ type containerSpec struct {
 }
 
 // containerExecutor is an interface to a container runtime
-// (docker/singularity).
+// (docker/singularity/oci).
 type containerExecutor interface {
 	// ImageLoad loads the image from the given tarball such that
 	// it can be used to create/start a container.
@@ -60,6 +60,6 @@ type containerExecutor interface {
 	// Release resources (temp dirs, stopped containers)
 	Close()
 
-	// Name of runtime engine ("docker", "singularity")
+	// Name of runtime engine ("docker", "singularity", "oci")
 	Runtime() string
 }
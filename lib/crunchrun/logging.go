@@ -46,6 +46,10 @@ type ThrottledLogger struct {
 	Timestamper
 	Immediate    *log.Logger
 	pendingFlush bool
+
+	// If not nil, tee is called with the time and text of each
+	// line, e.g., to copy it to the structured log.
+	tee func(t time.Time, line string)
 }
 
 // RFC3339NanoFixed is a fixed-width version of time.RFC3339Nano.
@@ -58,7 +62,8 @@ func RFC3339Timestamp(t time.Time) string {
 
 // Write prepends a timestamp to each line of the input data and
 // appends to the internal buffer. Each line is also logged to
-// tl.Immediate, if tl.Immediate is not nil.
+// tl.Immediate, if tl.Immediate is not nil. If tl.Timestamper is
+// nil, lines are buffered as is, without a timestamp.
 func (tl *ThrottledLogger) Write(p []byte) (n int, err error) {
 	tl.Mutex.Lock()
 	defer tl.Mutex.Unlock()
@@ -67,13 +72,20 @@ func (tl *ThrottledLogger) Write(p []byte) (n int, err error) {
 		tl.buf = &bytes.Buffer{}
 	}
 
-	now := tl.Timestamper(time.Now().UTC())
+	t := time.Now().UTC()
+	var now string
+	if tl.Timestamper != nil {
+		now = tl.Timestamper(t) + " "
+	}
 	sc := bufio.NewScanner(bytes.NewBuffer(p))
 	for err == nil && sc.Scan() {
-		out := fmt.Sprintf("%s %s\n", now, sc.Bytes())
+		out := fmt.Sprintf("%s%s\n", now, sc.Bytes())
 		if tl.Immediate != nil {
 			tl.Immediate.Print(out[:len(out)-1])
 		}
+		if tl.tee != nil {
+			tl.tee(t, sc.Text())
+		}
 		_, err = io.WriteString(tl.buf, out)
 	}
 	if err == nil {
@@ -222,6 +234,20 @@ type ArvLogWriter struct {
 	bufToFlush                   bytes.Buffer
 	bufFlushedAt                 time.Time
 	closing                      bool
+
+	// If not nil, formatNotice is used to format the messages
+	// (like "Exceeded rate ...") that are sent in place of
+	// throttled log lines. Otherwise they are plain text with a
+	// timestamp.
+	formatNotice func(t time.Time, msg string) string
+}
+
+// notice returns a throttling message to send in place of log lines.
+func (arvlog *ArvLogWriter) notice(now time.Time, msg string) string {
+	if arvlog.formatNotice != nil {
+		return arvlog.formatNotice(now.UTC(), msg)
+	}
+	return RFC3339Timestamp(now.UTC()) + " " + msg
 }
 
 func (arvlog *ArvLogWriter) Write(p []byte) (int, error) {
@@ -238,7 +264,7 @@ func (arvlog *ArvLogWriter) Write(p []byte) (int, error) {
 		// It has been more than throttle_period seconds since the last
 		// checkpoint; so reset the throttle
 		if arvlog.logThrottleBytesSkipped > 0 {
-			arvlog.bufToFlush.WriteString(fmt.Sprintf("%s Skipped %d bytes of log\n", RFC3339Timestamp(now.UTC()), arvlog.logThrottleBytesSkipped))
+			arvlog.bufToFlush.WriteString(arvlog.notice(now, fmt.Sprintf("Skipped %d bytes of log", arvlog.logThrottleBytesSkipped)) + "\n")
 		}
 
 		arvlog.logThrottleResetTime = now.Add(crunchLogThrottlePeriod)
@@ -318,8 +344,8 @@ func (arvlog *ArvLogWriter) rateLimit(line []byte, now time.Time) (bool, []byte)
 				arvlog.logThrottleFirstPartialLine = false
 				arvlog.logThrottlePartialLineNextAt = now.Add(crunchLogPartialLineThrottlePeriod)
 				arvlog.logThrottleBytesSkipped += lineSize
-				return true, []byte(fmt.Sprintf("%s Rate-limiting partial segments of long lines to one every %d seconds.",
-					RFC3339Timestamp(now.UTC()), crunchLogPartialLineThrottlePeriod/time.Second))
+				return true, []byte(arvlog.notice(now, fmt.Sprintf("Rate-limiting partial segments of long lines to one every %d seconds.",
+					crunchLogPartialLineThrottlePeriod/time.Second)))
 			} else if now.After(arvlog.logThrottlePartialLineNextAt) {
 				// The throttle period has passed.  Update timestamp and let it through.
 				arvlog.logThrottlePartialLineNextAt = now.Add(crunchLogPartialLineThrottlePeriod)
@@ -339,21 +365,21 @@ func (arvlog *ArvLogWriter) rateLimit(line []byte, now time.Time) (bool, []byte)
 		arvlog.logThrottleLinesSoFar++
 
 		if arvlog.bytesLogged > crunchLimitLogBytesPerJob {
-			message = fmt.Sprintf("%s Exceeded log limit %d bytes (crunch_limit_log_bytes_per_job). Log will be truncated.",
-				RFC3339Timestamp(now.UTC()), crunchLimitLogBytesPerJob)
+			message = fmt.Sprintf("Exceeded log limit %d bytes (crunch_limit_log_bytes_per_job). Log will be truncated.",
+				crunchLimitLogBytesPerJob)
 			arvlog.logThrottleResetTime = now.Add(time.Duration(365 * 24 * time.Hour))
 			arvlog.logThrottleIsOpen = false
 
 		} else if arvlog.logThrottleBytesSoFar > crunchLogThrottleBytes {
 			remainingTime := arvlog.logThrottleResetTime.Sub(now)
-			message = fmt.Sprintf("%s Exceeded rate %d bytes per %d seconds (crunch_log_throttle_bytes). Logging will be silenced for the next %d seconds.",
-				RFC3339Timestamp(now.UTC()), crunchLogThrottleBytes, crunchLogThrottlePeriod/time.Second, remainingTime/time.Second)
+			message = fmt.Sprintf("Exceeded rate %d bytes per %d seconds (crunch_log_throttle_bytes). Logging will be silenced for the next %d seconds.",
+				crunchLogThrottleBytes, crunchLogThrottlePeriod/time.Second, remainingTime/time.Second)
 			arvlog.logThrottleIsOpen = false
 
 		} else if arvlog.logThrottleLinesSoFar > crunchLogThrottleLines {
 			remainingTime := arvlog.logThrottleResetTime.Sub(now)
-			message = fmt.Sprintf("%s Exceeded rate %d lines per %d seconds (crunch_log_throttle_lines), logging will be silenced for the next %d seconds.",
-				RFC3339Timestamp(now.UTC()), crunchLogThrottleLines, crunchLogThrottlePeriod/time.Second, remainingTime/time.Second)
+			message = fmt.Sprintf("Exceeded rate %d lines per %d seconds (crunch_log_throttle_lines), logging will be silenced for the next %d seconds.",
+				crunchLogThrottleLines, crunchLogThrottlePeriod/time.Second, remainingTime/time.Second)
 			arvlog.logThrottleIsOpen = false
 
 		}
@@ -368,7 +394,7 @@ func (arvlog *ArvLogWriter) rateLimit(line []byte, now time.Time) (bool, []byte)
 		// Yes, write to logs, but use our "rate exceeded" message
 		// instead of the log message that exceeded the limit.
 		message += " A complete log is still being written to Keep, and will be available when the job finishes."
-		return true, []byte(message)
+		return true, []byte(arvlog.notice(now, message))
 	}
 	return arvlog.logThrottleIsOpen, line
 }
@@ -0,0 +1,600 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"golang.org/x/net/context"
+)
+
+// ociExecutor runs containers with an OCI runtime (crun or runc)
+// directly, without a container daemon. The image is unpacked from
+// the docker image tarball into an OCI bundle in a temp dir.
+type ociExecutor struct {
+	logf        func(string, ...interface{})
+	runtime     string // path to crun/runc executable
+	containerID string
+	tmpdir      string
+	rootless    bool
+	procDevices string // path to /proc/devices, for finding device major numbers
+	image       *ociImageConfig
+	spec        containerSpec
+	child       *exec.Cmd
+}
+
+func newOCIExecutor(containerUUID string, logf func(string, ...interface{}), runtime string) (*ociExecutor, error) {
+	var err error
+	if runtime != "" {
+		runtime, err = exec.LookPath(runtime)
+	} else {
+		for _, try := range []string{"crun", "runc"} {
+			runtime, err = exec.LookPath(try)
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot find OCI runtime: %w", err)
+	}
+	tmpdir, err := ioutil.TempDir("", "crunch-run-oci-")
+	if err != nil {
+		return nil, err
+	}
+	return &ociExecutor{
+		logf:        logf,
+		runtime:     runtime,
+		containerID: containerUUID,
+		tmpdir:      tmpdir,
+		rootless:    os.Geteuid() != 0,
+		procDevices: "/proc/devices",
+	}, nil
+}
+
+func (e *ociExecutor) Runtime() string { return "oci" }
+
+func (e *ociExecutor) bundleDir() string { return filepath.Join(e.tmpdir, "bundle") }
+func (e *ociExecutor) rootfs() string    { return filepath.Join(e.tmpdir, "bundle", "rootfs") }
+func (e *ociExecutor) stateDir() string  { return filepath.Join(e.tmpdir, "state") }
+
+// LoadImage unpacks the image layers from the docker image tarball
+// into the bundle's rootfs.
+func (e *ociExecutor) LoadImage(imageID string, imageTarballPath string, container arvados.Container, keepMount string, containerClient *arvados.Client) error {
+	err := os.MkdirAll(e.rootfs(), 0755)
+	if err != nil {
+		return err
+	}
+	e.logf("unpacking image %s into %s", imageID, e.rootfs())
+	e.image, err = unpackDockerArchive(imageTarballPath, e.rootfs(), e.rootless)
+	if err != nil {
+		return fmt.Errorf("error unpacking image: %w", err)
+	}
+	return nil
+}
+
+// Create writes the bundle's config.json.
+func (e *ociExecutor) Create(spec containerSpec) error {
+	e.spec = spec
+	if e.image == nil {
+		return errors.New("image has not been loaded")
+	}
+	if spec.EnableNetwork {
+		// Use the host's name resolution config, like docker
+		// does with the default network mode.
+		for _, fnm := range []string{"/etc/resolv.conf", "/etc/hosts"} {
+			err := copyHostFileToRoot(e.rootfs(), fnm)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	config, err := e.config()
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(e.bundleDir(), "config.json"), buf, 0600)
+}
+
+// config returns the OCI runtime config for the container spec.
+func (e *ociExecutor) config() (*ociSpec, error) {
+	spec := e.spec
+	env := map[string]string{}
+	for _, kv := range e.image.Config.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	for k, v := range spec.Env {
+		env[k] = v
+	}
+	if _, ok := env["PATH"]; !ok {
+		env["PATH"] = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+
+	var hooks *ociHooks
+	var visible string
+	if spec.CUDADeviceCount > 0 {
+		hook, err := lookPathAny("nvidia-container-runtime-hook", "nvidia-container-toolkit")
+		if err != nil {
+			return nil, fmt.Errorf("container requires CUDA, but cannot find nvidia container hook: %w", err)
+		}
+		// Like docker with the nvidia runtime, expose the
+		// devices selected by the resource manager (if any)
+		// or the requested number of devices.
+		visible = os.Getenv("CUDA_VISIBLE_DEVICES")
+		if visible == "" {
+			var devs []string
+			for i := 0; i < spec.CUDADeviceCount; i++ {
+				devs = append(devs, fmt.Sprintf("%d", i))
+			}
+			visible = strings.Join(devs, ",")
+		}
+		env["NVIDIA_VISIBLE_DEVICES"] = visible
+		env["NVIDIA_DRIVER_CAPABILITIES"] = "compute,utility"
+		hooks = &ociHooks{Prestart: []ociHook{{
+			Path: hook,
+			Args: []string{filepath.Base(hook), "prestart"},
+			Env:  []string{"PATH=" + os.Getenv("PATH")},
+		}}}
+	}
+
+	var envlist []string
+	for k, v := range env {
+		envlist = append(envlist, k+"="+v)
+	}
+	sort.Strings(envlist)
+
+	cwd := spec.WorkingDir
+	if cwd == "" {
+		cwd = e.image.Config.WorkingDir
+	}
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	uid, gid, err := lookupUser(e.rootfs(), e.image.Config.User)
+	if err != nil {
+		return nil, err
+	}
+	if e.rootless && (uid != 0 || gid != 0) {
+		// Only the invoking user is mapped into the user
+		// namespace (as root), so there is no other user to
+		// run as.
+		return nil, fmt.Errorf("image specifies user %q (uid %d, gid %d), but crunch-run is running without root privileges, so the container can only run as root", e.image.Config.User, uid, gid)
+	}
+
+	config := &ociSpec{
+		Version: "1.0.2",
+		Root:    ociRoot{Path: "rootfs"},
+		Process: ociProcess{
+			User: ociUser{UID: uid, GID: gid},
+			Args: spec.Command,
+			Env:  envlist,
+			Cwd:  cwd,
+			Capabilities: &ociCapabilities{
+				Bounding:  ociDefaultCapabilities,
+				Effective: ociDefaultCapabilities,
+				Permitted: ociDefaultCapabilities,
+			},
+		},
+		Hostname: "arvados",
+		Mounts:   e.mounts(),
+		Hooks:    hooks,
+		Linux: ociLinux{
+			Namespaces: []ociNamespace{
+				{Type: "pid"},
+				{Type: "ipc"},
+				{Type: "uts"},
+				{Type: "mount"},
+			},
+			MaskedPaths:   ociMaskedPaths,
+			ReadonlyPaths: ociReadonlyPaths,
+		},
+	}
+	if !spec.EnableNetwork {
+		config.Linux.Namespaces = append(config.Linux.Namespaces, ociNamespace{Type: "network"})
+	}
+	if e.rootless {
+		config.Linux.Namespaces = append(config.Linux.Namespaces, ociNamespace{Type: "user"})
+		config.Linux.UIDMappings = []ociIDMapping{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}}
+		config.Linux.GIDMappings = []ociIDMapping{{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}}
+		// Rootless runtimes generally can't use cgroups, so
+		// resource limits and the cgroup path (used by
+		// crunchstat) only apply when running as root.
+		e.logf("warning: running without root privileges, so cannot apply cgroup limits (VCPUs %d, RAM %d) or report container resource usage", spec.VCPUs, spec.RAM)
+	} else {
+		resources := &ociResources{
+			Devices: ociDefaultDevices,
+		}
+		if spec.CUDADeviceCount > 0 {
+			resources.Devices = append(append([]ociDeviceCgroup(nil), ociDefaultDevices...), e.nvidiaDevices(visible)...)
+		}
+		if spec.VCPUs > 0 {
+			period := uint64(100000)
+			quota := int64(spec.VCPUs) * 100000
+			resources.CPU = &ociCPU{Quota: &quota, Period: &period}
+		}
+		if spec.RAM > 0 {
+			resources.Memory = &ociMemory{Limit: &spec.RAM, Swap: &spec.RAM}
+		}
+		config.Linux.Resources = resources
+		parent := spec.CgroupParent
+		if parent == "" {
+			parent = "docker"
+		}
+		config.Linux.CgroupsPath = "/" + parent + "/" + e.containerID
+	}
+	return config, nil
+}
+
+func (e *ociExecutor) mounts() []ociMount {
+	mounts := []ociMount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+		{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+		{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+		{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+		{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+	}
+	if e.rootless {
+		// An unprivileged user can't mount sysfs or set the
+		// devpts gid in a new user namespace.
+		mounts[2].Options = []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}
+		mounts[5] = ociMount{Destination: "/sys", Type: "none", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev", "ro"}}
+	} else {
+		mounts = append(mounts, ociMount{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}})
+	}
+	var binds []string
+	for path := range e.spec.BindMounts {
+		binds = append(binds, path)
+	}
+	sort.Strings(binds)
+	for _, path := range binds {
+		mount := e.spec.BindMounts[path]
+		opts := []string{"rbind", "rw"}
+		if mount.ReadOnly {
+			opts[1] = "ro"
+		}
+		mounts = append(mounts, ociMount{Destination: path, Type: "none", Source: mount.HostPath, Options: opts})
+	}
+	return mounts
+}
+
+func (e *ociExecutor) Start() error {
+	child := &exec.Cmd{
+		Path:   e.runtime,
+		Args:   []string{e.runtime, "--root", e.stateDir(), "run", "--bundle", e.bundleDir(), e.containerID},
+		Stdin:  e.spec.Stdin,
+		Stdout: e.spec.Stdout,
+		Stderr: e.spec.Stderr,
+	}
+	err := child.Start()
+	if err != nil {
+		return err
+	}
+	e.child = child
+	return nil
+}
+
+func (e *ociExecutor) CgroupID() string {
+	if e.rootless {
+		return ""
+	}
+	return e.containerID
+}
+
+func (e *ociExecutor) Stop() error {
+	if err := e.child.Process.Signal(syscall.Signal(0)); err != nil {
+		// process already exited
+		return nil
+	}
+	err := exec.Command(e.runtime, "--root", e.stateDir(), "kill", e.containerID, "KILL").Run()
+	if err != nil {
+		e.logf("error killing container with %s: %s", e.runtime, err)
+		return e.child.Process.Signal(syscall.SIGKILL)
+	}
+	return nil
+}
+
+// Wait waits for the container to exit. If ctx is done first, Wait
+// kills the container and returns ctx.Err().
+func (e *ociExecutor) Wait(ctx context.Context) (int, error) {
+	waited := make(chan error, 1)
+	go func() { waited <- e.child.Wait() }()
+	var err error
+	select {
+	case err = <-waited:
+	case <-ctx.Done():
+		if err := e.Stop(); err != nil {
+			e.logf("error stopping container: %s", err)
+		}
+		return -1, ctx.Err()
+	}
+	if err, ok := err.(*exec.ExitError); ok {
+		return err.ProcessState.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return e.child.ProcessState.ExitCode(), nil
+}
+
+func (e *ociExecutor) Close() {
+	if e.child != nil {
+		out, err := exec.Command(e.runtime, "--root", e.stateDir(), "delete", "--force", e.containerID).CombinedOutput()
+		if err != nil {
+			e.logf("error deleting container: %s: %q", err, out)
+		}
+	}
+	err := os.RemoveAll(e.tmpdir)
+	if err != nil {
+		e.logf("error removing temp dir: %s", err)
+	}
+}
+
+// copyHostFileToRoot copies a file from the host into the same path
+// in rootfs, replacing whatever the image had there.
+func copyHostFileToRoot(rootfs, fnm string) error {
+	buf, err := ioutil.ReadFile(fnm)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	dst, err := resolveInRoot(rootfs, fnm)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	os.Remove(dst)
+	return ioutil.WriteFile(dst, buf, 0644)
+}
+
+func lookPathAny(names ...string) (path string, err error) {
+	for _, name := range names {
+		path, err = exec.LookPath(name)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// The default capabilities and masked/readonly paths are the same
+// as docker's defaults.
+var ociDefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// ociDefaultDevices denies access to all devices except the ones
+// every container needs (null, zero, full, tty, random, urandom,
+// console, ptmx, and pts), and allows mknod, like docker does.
+var ociDefaultDevices = []ociDeviceCgroup{
+	{Allow: false, Access: "rwm"},
+	{Allow: true, Type: "c", Access: "m"},
+	{Allow: true, Type: "b", Access: "m"},
+	{Allow: true, Type: "c", Major: ociDevNum(1), Minor: ociDevNum(3), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(1), Minor: ociDevNum(5), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(1), Minor: ociDevNum(7), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(5), Minor: ociDevNum(0), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(1), Minor: ociDevNum(8), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(1), Minor: ociDevNum(9), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(5), Minor: ociDevNum(1), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(5), Minor: ociDevNum(2), Access: "rwm"},
+	{Allow: true, Type: "c", Major: ociDevNum(136), Access: "rwm"},
+}
+
+func ociDevNum(n int64) *int64 { return &n }
+
+// Major device number of /dev/nvidia0, /dev/nvidia1, ...,
+// /dev/nvidia-modeset (minor 254), and /dev/nvidiactl (minor 255).
+const nvidiaMajor = 195
+
+// nvidiaDevices returns device cgroup rules that allow access to the
+// given GPUs (a comma-separated list of device indexes, as in
+// NVIDIA_VISIBLE_DEVICES) and the NVIDIA control and unified memory
+// devices. The nvidia hook creates the device nodes in the
+// container, but with cgroup v2 it cannot add them to the device
+// filter.
+func (e *ociExecutor) nvidiaDevices(visible string) []ociDeviceCgroup {
+	devs := []ociDeviceCgroup{
+		{Allow: true, Type: "c", Major: ociDevNum(nvidiaMajor), Minor: ociDevNum(255), Access: "rwm"},
+		{Allow: true, Type: "c", Major: ociDevNum(nvidiaMajor), Minor: ociDevNum(254), Access: "rwm"},
+	}
+	for _, idx := range strings.Split(visible, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(idx), 10, 64)
+		if err != nil || n < 0 || n >= 254 {
+			// A GPU UUID or "all": we can't tell which
+			// device node it refers to, so allow all of
+			// them.
+			devs = append(devs[:2], ociDeviceCgroup{Allow: true, Type: "c", Major: ociDevNum(nvidiaMajor), Access: "rwm"})
+			break
+		}
+		devs = append(devs, ociDeviceCgroup{Allow: true, Type: "c", Major: ociDevNum(nvidiaMajor), Minor: ociDevNum(n), Access: "rwm"})
+	}
+	// /dev/nvidia-uvm and /dev/nvidia-uvm-tools have a
+	// dynamically assigned major number.
+	if major, err := e.deviceMajor("nvidia-uvm"); err != nil {
+		e.logf("warning: cannot allow access to /dev/nvidia-uvm: %s", err)
+	} else {
+		devs = append(devs, ociDeviceCgroup{Allow: true, Type: "c", Major: ociDevNum(major), Access: "rwm"})
+	}
+	return devs
+}
+
+// deviceMajor returns the major number of the named character device
+// driver, according to /proc/devices.
+func (e *ociExecutor) deviceMajor(name string) (int64, error) {
+	buf, err := ioutil.ReadFile(e.procDevices)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "Block devices:" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == name {
+			return strconv.ParseInt(fields[0], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s not found in %s", name, e.procDevices)
+}
+
+var ociMaskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+}
+
+var ociReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// The following types are the subset of the OCI runtime spec
+// (https://github.com/opencontainers/runtime-spec/blob/master/config.md)
+// used by ociExecutor.
+
+type ociSpec struct {
+	Version  string     `json:"ociVersion"`
+	Root     ociRoot    `json:"root"`
+	Process  ociProcess `json:"process"`
+	Hostname string     `json:"hostname,omitempty"`
+	Mounts   []ociMount `json:"mounts,omitempty"`
+	Hooks    *ociHooks  `json:"hooks,omitempty"`
+	Linux    ociLinux   `json:"linux"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type ociProcess struct {
+	Terminal        bool             `json:"terminal,omitempty"`
+	User            ociUser          `json:"user"`
+	Args            []string         `json:"args"`
+	Env             []string         `json:"env,omitempty"`
+	Cwd             string           `json:"cwd"`
+	Capabilities    *ociCapabilities `json:"capabilities,omitempty"`
+	NoNewPrivileges bool             `json:"noNewPrivileges,omitempty"`
+}
+
+type ociUser struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+type ociCapabilities struct {
+	Bounding  []string `json:"bounding,omitempty"`
+	Effective []string `json:"effective,omitempty"`
+	Permitted []string `json:"permitted,omitempty"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type ociHooks struct {
+	Prestart []ociHook `json:"prestart,omitempty"`
+}
+
+type ociHook struct {
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+	Env  []string `json:"env,omitempty"`
+}
+
+type ociLinux struct {
+	Namespaces    []ociNamespace `json:"namespaces"`
+	UIDMappings   []ociIDMapping `json:"uidMappings,omitempty"`
+	GIDMappings   []ociIDMapping `json:"gidMappings,omitempty"`
+	Resources     *ociResources  `json:"resources,omitempty"`
+	CgroupsPath   string         `json:"cgroupsPath,omitempty"`
+	MaskedPaths   []string       `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string       `json:"readonlyPaths,omitempty"`
+}
+
+type ociNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type ociIDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+type ociResources struct {
+	Devices []ociDeviceCgroup `json:"devices,omitempty"`
+	Memory  *ociMemory        `json:"memory,omitempty"`
+	CPU     *ociCPU           `json:"cpu,omitempty"`
+}
+
+// A nil Major or Minor matches all device numbers.
+type ociDeviceCgroup struct {
+	Allow  bool   `json:"allow"`
+	Type   string `json:"type,omitempty"`
+	Major  *int64 `json:"major,omitempty"`
+	Minor  *int64 `json:"minor,omitempty"`
+	Access string `json:"access,omitempty"`
+}
+
+type ociMemory struct {
+	Limit *int64 `json:"limit,omitempty"`
+	Swap  *int64 `json:"swap,omitempty"`
+}
+
+type ociCPU struct {
+	Quota  *int64  `json:"quota,omitempty"`
+	Period *uint64 `json:"period,omitempty"`
+}
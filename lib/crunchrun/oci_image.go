@@ -0,0 +1,353 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ociImageConfig is the part of a docker image config that affects
+// how the oci executor runs a container.
+type ociImageConfig struct {
+	Config struct {
+		Env        []string
+		WorkingDir string
+		User       string
+	} `json:"config"`
+}
+
+// unpackDockerArchive unpacks the layers of the image in a "docker
+// save" tarball into rootfs, and returns the image config.
+func unpackDockerArchive(tarballPath, rootfs string, rootless bool) (*ociImageConfig, error) {
+	var manifest []struct {
+		Config string
+		Layers []string
+	}
+	err := readDockerArchiveFile(tarballPath, "manifest.json", func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest) != 1 {
+		return nil, fmt.Errorf("expected 1 image in manifest.json, found %d", len(manifest))
+	}
+	var config ociImageConfig
+	err = readDockerArchiveFile(tarballPath, manifest[0].Config, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&config)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range manifest[0].Layers {
+		err = readDockerArchiveFile(tarballPath, layer, func(r io.Reader) error {
+			br := bufio.NewReader(r)
+			if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+				zr, err := gzip.NewReader(br)
+				if err != nil {
+					return err
+				}
+				defer zr.Close()
+				return unpackLayer(rootfs, zr, rootless)
+			}
+			return unpackLayer(rootfs, br, rootless)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layer, err)
+		}
+	}
+	return &config, nil
+}
+
+// readDockerArchiveFile calls fn with the content of the named file
+// in the tarball. Unread file content is skipped by seeking, so
+// finding a file near the end of a large tarball is cheap.
+func readDockerArchiveFile(tarballPath, name string, fn func(io.Reader) error) error {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s not found in image tarball", name)
+		} else if err != nil {
+			return err
+		}
+		if path.Clean(hdr.Name) == path.Clean(name) {
+			return fn(tr)
+		}
+	}
+}
+
+// unpackLayer applies a layer tarball to rootfs, including whiteout
+// entries that delete files from lower layers.
+func unpackLayer(rootfs string, r io.Reader, rootless bool) error {
+	tr := tar.NewReader(r)
+	created := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := path.Split(name)
+		if base == ".wh..wh..opq" {
+			// Opaque directory: hide everything from lower
+			// layers.
+			hostdir, err := resolveInRoot(rootfs, dir)
+			if err != nil {
+				return err
+			}
+			ents, err := ioutil.ReadDir(hostdir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, ent := range ents {
+				if !created[path.Join(dir, ent.Name())] {
+					err = os.RemoveAll(filepath.Join(hostdir, ent.Name()))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			target, err := resolveInRoot(rootfs, path.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			if err != nil {
+				return err
+			}
+			err = os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		dst, err := resolveInRoot(rootfs, name)
+		if err != nil {
+			return err
+		}
+		created[name] = true
+		if fi, err := os.Lstat(dst); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			err = os.RemoveAll(dst)
+			if err != nil {
+				return err
+			}
+		}
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if rootless {
+				// Make sure we can add files from
+				// later entries/layers.
+				mode |= 0700
+			}
+			err = os.Mkdir(dst, 0700)
+			if os.IsExist(err) {
+				err = nil
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			var f *os.File
+			f, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				break
+			}
+			_, err = io.Copy(f, tr)
+			if err == nil {
+				err = f.Close()
+			} else {
+				f.Close()
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, dst)
+		case tar.TypeLink:
+			var src string
+			src, err = resolveInRoot(rootfs, hdr.Linkname)
+			if err == nil {
+				err = os.Link(src, dst)
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if rootless {
+				// Can't create device nodes
+				// without privileges. The runtime
+				// provides the usual /dev entries
+				// anyway.
+				continue
+			}
+			devtype := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+			err = unix.Mknod(dst, devtype|uint32(mode.Perm()), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if !rootless {
+			err = os.Lchown(dst, hdr.Uid, hdr.Gid)
+			if err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+		}
+		if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+			// Chmod after chown, because chown clears
+			// setuid/setgid bits.
+			err = os.Chmod(dst, mode)
+			if err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+		}
+	}
+}
+
+// resolveInRoot returns the path on the host for the given path
+// inside rootfs. Symlinks in all but the last path component are
+// followed as if rootfs were "/", so the result is always inside
+// rootfs even if the image has symlinks pointing elsewhere.
+func resolveInRoot(rootfs, name string) (string, error) {
+	resolved := "/"
+	todo := strings.Split(name, "/")
+	for links := 0; len(todo) > 0; {
+		elem := todo[0]
+		todo = todo[1:]
+		if elem == "" || elem == "." {
+			continue
+		} else if elem == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		} else if len(todo) == 0 {
+			resolved = path.Join(resolved, elem)
+			break
+		}
+		next := path.Join(resolved, elem)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// lookupUser returns the uid and gid for a docker-style user spec
+// ("name", "uid", "name:group", or "uid:gid"), using the /etc/passwd
+// and /etc/group files in rootfs.
+func lookupUser(rootfs, user string) (uid, gid uint32, err error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+	userPart, groupPart := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		userPart, groupPart = user[:i], user[i+1:]
+	}
+	found := false
+	if n, err := strconv.ParseUint(userPart, 10, 32); err == nil {
+		uid = uint32(n)
+	}
+	err = scanEtcFile(rootfs, "/etc/passwd", func(fields []string) bool {
+		if len(fields) < 4 || (fields[0] != userPart && fields[2] != userPart) {
+			return false
+		}
+		u, err1 := strconv.ParseUint(fields[2], 10, 32)
+		g, err2 := strconv.ParseUint(fields[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		uid, gid, found = uint32(u), uint32(g), true
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		if _, err := strconv.ParseUint(userPart, 10, 32); err != nil {
+			return 0, 0, fmt.Errorf("user %q not found in image's /etc/passwd", userPart)
+		}
+	}
+	if groupPart == "" {
+		return uid, gid, nil
+	}
+	if n, err := strconv.ParseUint(groupPart, 10, 32); err == nil {
+		return uid, uint32(n), nil
+	}
+	found = false
+	err = scanEtcFile(rootfs, "/etc/group", func(fields []string) bool {
+		if len(fields) < 3 || fields[0] != groupPart {
+			return false
+		}
+		g, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return false
+		}
+		gid, found = uint32(g), true
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("group %q not found in image's /etc/group", groupPart)
+	}
+	return uid, gid, nil
+}
+
+// scanEtcFile calls fn with the colon-separated fields of each line
+// of a passwd/group file in rootfs, until fn returns true. A missing
+// file is treated as empty.
+func scanEtcFile(rootfs, name string, fn func([]string) bool) error {
+	fnm, err := resolveInRoot(rootfs, name)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(fnm)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if fn(strings.Split(line, ":")) {
+			return nil
+		}
+	}
+	return nil
+}
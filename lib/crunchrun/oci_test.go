@@ -0,0 +1,380 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ociSuite{})
+
+type ociSuite struct {
+	executorSuite
+}
+
+func (s *ociSuite) SetUpSuite(c *C) {
+	if _, err := lookPathAny("crun", "runc"); err != nil {
+		c.Skip("looks like neither crun nor runc is installed")
+	}
+	s.newExecutor = func(c *C) {
+		var err error
+		s.executor, err = newOCIExecutor("zzzzz-zzzzz-zzzzzzzzzzzzzzz", c.Logf, "")
+		c.Assert(err, IsNil)
+	}
+}
+
+var _ = Suite(&ociStubSuite{})
+
+// ociStubSuite tests don't really invoke an OCI runtime, so we can
+// run them even if crun/runc is not installed.
+type ociStubSuite struct {
+	executor *ociExecutor
+	logbuf   bytes.Buffer
+}
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func writeTestTar(c *C, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, ent := range entries {
+		hdr := ent.hdr
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		hdr.Size = int64(len(ent.data))
+		c.Assert(tw.WriteHeader(&hdr), IsNil)
+		_, err := tw.Write([]byte(ent.data))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	return buf.Bytes()
+}
+
+// writeTestImage writes a docker-archive tarball with the given
+// config and layers, and returns its path.
+func writeTestImage(c *C, config string, layers ...[]tarEntry) string {
+	manifest := []map[string]interface{}{{"Config": "config.json"}}
+	var files []tarEntry
+	var layerNames []string
+	for i, layer := range layers {
+		name := string(rune('a'+i)) + "/layer.tar"
+		layerNames = append(layerNames, name)
+		files = append(files, tarEntry{tar.Header{Name: name}, string(writeTestTar(c, layer))})
+	}
+	manifest[0]["Layers"] = layerNames
+	mbuf, err := json.Marshal(manifest)
+	c.Assert(err, IsNil)
+	files = append(files,
+		tarEntry{tar.Header{Name: "config.json"}, config},
+		tarEntry{tar.Header{Name: "manifest.json"}, string(mbuf)})
+	fnm := c.MkDir() + "/image.tar"
+	c.Assert(ioutil.WriteFile(fnm, writeTestTar(c, files), 0644), IsNil)
+	return fnm
+}
+
+func (s *ociStubSuite) SetUpTest(c *C) {
+	var err error
+	s.logbuf.Reset()
+	s.executor, err = newOCIExecutor("zzzzz-zzzzz-zzzzzzzzzzzzzzz", func(f string, args ...interface{}) {
+		fmt.Fprintf(&s.logbuf, f+"\n", args...)
+	}, "true")
+	c.Assert(err, IsNil)
+	image := writeTestImage(c, `{"config":{"Env":["PATH=/imagebin","FOO=image","BAR=image"],"WorkingDir":"/imagewd","User":"alice"}}`,
+		[]tarEntry{
+			{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{hdr: tar.Header{Name: "etc/passwd"}, data: "root:x:0:0::/root:/bin/sh\nalice:x:1000:1001::/home/alice:/bin/sh\n"},
+			{hdr: tar.Header{Name: "etc/group"}, data: "root:x:0:\nstaff:x:50:\n"},
+		})
+	err = s.executor.LoadImage("", image, arvados.Container{}, "", nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *ociStubSuite) TearDownTest(c *C) {
+	s.executor.Close()
+}
+
+func (s *ociStubSuite) loadConfig(c *C) *ociSpec {
+	buf, err := ioutil.ReadFile(filepath.Join(s.executor.bundleDir(), "config.json"))
+	c.Assert(err, IsNil)
+	var config ociSpec
+	c.Assert(json.Unmarshal(buf, &config), IsNil)
+	return &config
+}
+
+func (s *ociStubSuite) namespaces(config *ociSpec) []string {
+	var types []string
+	for _, ns := range config.Linux.Namespaces {
+		types = append(types, ns.Type)
+	}
+	return types
+}
+
+func (s *ociStubSuite) TestConfig(c *C) {
+	s.executor.rootless = false
+	err := s.executor.Create(containerSpec{
+		VCPUs:        2,
+		RAM:          1 << 30,
+		Env:          map[string]string{"FOO": "bar"},
+		BindMounts:   map[string]bindmount{"/mnt": {HostPath: "/hostpath", ReadOnly: true}, "/tmp": {HostPath: "/hosttmp"}},
+		Command:      []string{"echo", "ok"},
+		CgroupParent: "arvados",
+	})
+	c.Assert(err, IsNil)
+	config := s.loadConfig(c)
+	c.Check(config.Process.Args, DeepEquals, []string{"echo", "ok"})
+	c.Check(config.Process.Env, DeepEquals, []string{"BAR=image", "FOO=bar", "PATH=/imagebin"})
+	c.Check(config.Process.Cwd, Equals, "/imagewd")
+	c.Check(config.Process.User, Equals, ociUser{UID: 1000, GID: 1001})
+	c.Check(s.namespaces(config), DeepEquals, []string{"pid", "ipc", "uts", "mount", "network"})
+	c.Check(config.Linux.CgroupsPath, Equals, "/arvados/zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Check(s.executor.CgroupID(), Equals, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(config.Linux.Resources, NotNil)
+	c.Check(*config.Linux.Resources.CPU.Quota, Equals, int64(200000))
+	c.Check(*config.Linux.Resources.Memory.Limit, Equals, int64(1<<30))
+	c.Check(config.Linux.Resources.Devices[0], DeepEquals, ociDeviceCgroup{Allow: false, Access: "rwm"})
+	allowed := map[string]bool{}
+	for _, dev := range config.Linux.Resources.Devices[1:] {
+		c.Check(dev.Allow, Equals, true)
+		if dev.Major != nil && dev.Minor != nil {
+			allowed[fmt.Sprintf("%s %d:%d %s", dev.Type, *dev.Major, *dev.Minor, dev.Access)] = true
+		} else if dev.Major != nil {
+			allowed[fmt.Sprintf("%s %d:* %s", dev.Type, *dev.Major, dev.Access)] = true
+		}
+	}
+	for _, dev := range []string{"1:3", "1:5", "1:7", "1:8", "1:9", "5:0", "5:1", "5:2", "136:*"} {
+		c.Check(allowed["c "+dev+" rwm"], Equals, true, Commentf("%s", dev))
+	}
+	c.Check(s.logbuf.String(), Not(Matches), `(?ms).*cannot apply cgroup limits.*`)
+	binds := map[string]ociMount{}
+	for _, m := range config.Mounts {
+		binds[m.Destination] = m
+	}
+	c.Check(binds["/mnt"], DeepEquals, ociMount{Destination: "/mnt", Type: "none", Source: "/hostpath", Options: []string{"rbind", "ro"}})
+	c.Check(binds["/tmp"], DeepEquals, ociMount{Destination: "/tmp", Type: "none", Source: "/hosttmp", Options: []string{"rbind", "rw"}})
+	c.Check(binds["/sys/fs/cgroup"].Type, Equals, "cgroup")
+	c.Check(config.Hooks, IsNil)
+	c.Check(config.Linux.Resources.Devices, HasLen, len(ociDefaultDevices))
+}
+
+func (s *ociStubSuite) TestConfigRootlessWithNetwork(c *C) {
+	s.executor.rootless = true
+	s.executor.image.Config.User = "root"
+	err := s.executor.Create(containerSpec{
+		WorkingDir:    "/wd",
+		EnableNetwork: true,
+		Command:       []string{"true"},
+	})
+	c.Assert(err, IsNil)
+	config := s.loadConfig(c)
+	c.Check(config.Process.Cwd, Equals, "/wd")
+	c.Check(config.Process.User, Equals, ociUser{})
+	c.Check(s.namespaces(config), DeepEquals, []string{"pid", "ipc", "uts", "mount", "user"})
+	c.Check(config.Linux.UIDMappings, DeepEquals, []ociIDMapping{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}})
+	c.Check(config.Linux.Resources, IsNil)
+	c.Check(s.logbuf.String(), Matches, `(?ms).*warning: running without root privileges, so cannot apply cgroup limits.*`)
+	c.Check(config.Linux.CgroupsPath, Equals, "")
+	c.Check(s.executor.CgroupID(), Equals, "")
+	for _, m := range config.Mounts {
+		c.Check(m.Type, Not(Equals), "sysfs")
+		c.Check(m.Type, Not(Equals), "cgroup")
+	}
+	// Host's name resolution config is copied into the image.
+	if resolvconf, err := ioutil.ReadFile("/etc/resolv.conf"); err == nil {
+		buf, err := ioutil.ReadFile(s.executor.rootfs() + "/etc/resolv.conf")
+		c.Check(err, IsNil)
+		c.Check(string(buf), Equals, string(resolvconf))
+	}
+}
+
+// In rootless mode, only root is mapped into the container's user
+// namespace, so an image that specifies a different user is
+// rejected instead of silently running as root.
+func (s *ociStubSuite) TestConfigRootlessNonRootUser(c *C) {
+	s.executor.rootless = true
+	for _, user := range []string{"alice", "1000", "root:staff"} {
+		s.executor.image.Config.User = user
+		err := s.executor.Create(containerSpec{Command: []string{"true"}})
+		c.Check(err, ErrorMatches, `image specifies user "`+user+`" .*, but crunch-run is running without root privileges, so the container can only run as root`)
+	}
+	for _, user := range []string{"", "root", "0:0"} {
+		s.executor.image.Config.User = user
+		err := s.executor.Create(containerSpec{Command: []string{"true"}})
+		c.Check(err, IsNil)
+	}
+}
+
+// cudaDevices returns the device cgroup rules added (after the
+// default ones) for a CUDA container, in "c major:minor" form.
+func (s *ociStubSuite) cudaDevices(c *C, config *ociSpec) []string {
+	c.Assert(config.Linux.Resources, NotNil)
+	var devs []string
+	for _, dev := range config.Linux.Resources.Devices[len(ociDefaultDevices):] {
+		c.Check(dev.Allow, Equals, true)
+		c.Check(dev.Access, Equals, "rwm")
+		minor := "*"
+		if dev.Minor != nil {
+			minor = fmt.Sprintf("%d", *dev.Minor)
+		}
+		devs = append(devs, fmt.Sprintf("%s %d:%s", dev.Type, *dev.Major, minor))
+	}
+	return devs
+}
+
+func (s *ociStubSuite) TestConfigCUDA(c *C) {
+	s.executor.rootless = false
+	s.executor.procDevices = c.MkDir() + "/devices"
+	c.Assert(ioutil.WriteFile(s.executor.procDevices, []byte("Character devices:\n  1 mem\n195 nvidia\n236 nvidia-uvm\n\nBlock devices:\n  7 loop\n"), 0644), IsNil)
+	bindir := c.MkDir()
+	c.Assert(ioutil.WriteFile(bindir+"/nvidia-container-runtime-hook", []byte("#!/bin/sh\n"), 0755), IsNil)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bindir)
+	defer os.Setenv("CUDA_VISIBLE_DEVICES", os.Getenv("CUDA_VISIBLE_DEVICES"))
+
+	os.Setenv("CUDA_VISIBLE_DEVICES", "")
+	err := s.executor.Create(containerSpec{CUDADeviceCount: 2, Command: []string{"nvidia-smi"}})
+	c.Assert(err, IsNil)
+	config := s.loadConfig(c)
+	c.Check(config.Process.Env, DeepEquals, []string{"BAR=image", "FOO=image", "NVIDIA_DRIVER_CAPABILITIES=compute,utility", "NVIDIA_VISIBLE_DEVICES=0,1", "PATH=/imagebin"})
+	c.Assert(config.Hooks, NotNil)
+	c.Check(config.Hooks.Prestart, DeepEquals, []ociHook{{
+		Path: bindir + "/nvidia-container-runtime-hook",
+		Args: []string{"nvidia-container-runtime-hook", "prestart"},
+		Env:  []string{"PATH=" + bindir},
+	}})
+	c.Check(s.cudaDevices(c, config), DeepEquals, []string{"c 195:255", "c 195:254", "c 195:0", "c 195:1", "c 236:*"})
+
+	os.Setenv("CUDA_VISIBLE_DEVICES", "3")
+	err = s.executor.Create(containerSpec{CUDADeviceCount: 1, Command: []string{"nvidia-smi"}})
+	c.Assert(err, IsNil)
+	config = s.loadConfig(c)
+	c.Check(config.Process.Env, DeepEquals, []string{"BAR=image", "FOO=image", "NVIDIA_DRIVER_CAPABILITIES=compute,utility", "NVIDIA_VISIBLE_DEVICES=3", "PATH=/imagebin"})
+	c.Check(s.cudaDevices(c, config), DeepEquals, []string{"c 195:255", "c 195:254", "c 195:3", "c 236:*"})
+
+	// Devices identified by UUID: allow all GPUs. If the
+	// nvidia-uvm driver isn't loaded, log a warning.
+	os.Setenv("CUDA_VISIBLE_DEVICES", "GPU-8c4a5d40-1b5e-4c2f-9a7e-000000000000")
+	c.Assert(ioutil.WriteFile(s.executor.procDevices, []byte("Character devices:\n195 nvidia\n"), 0644), IsNil)
+	err = s.executor.Create(containerSpec{CUDADeviceCount: 1, Command: []string{"nvidia-smi"}})
+	c.Assert(err, IsNil)
+	c.Check(s.cudaDevices(c, s.loadConfig(c)), DeepEquals, []string{"c 195:255", "c 195:254", "c 195:*"})
+	c.Check(s.logbuf.String(), Matches, `(?ms).*warning: cannot allow access to /dev/nvidia-uvm: nvidia-uvm not found in .*`)
+
+	os.Setenv("PATH", c.MkDir())
+	err = s.executor.Create(containerSpec{CUDADeviceCount: 1, Command: []string{"nvidia-smi"}})
+	c.Check(err, ErrorMatches, `container requires CUDA, but cannot find nvidia container hook: .*`)
+}
+
+func (s *ociStubSuite) TestWaitContext(c *C) {
+	// Stub runtime: "run" never exits, "kill" fails, so Stop
+	// has to kill the runtime process itself.
+	s.executor.runtime = c.MkDir() + "/runtime"
+	c.Assert(ioutil.WriteFile(s.executor.runtime, []byte("#!/bin/sh\ncase \"$3\" in run) exec sleep 60;; *) exit 1;; esac\n"), 0755), IsNil)
+	c.Assert(s.executor.Create(containerSpec{Command: []string{"true"}}), IsNil)
+	c.Assert(s.executor.Start(), IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	_, err := s.executor.Wait(ctx)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(time.Since(t0) < 10*time.Second, Equals, true)
+	for deadline := time.Now().Add(10 * time.Second); s.executor.child.Process.Signal(syscall.Signal(0)) == nil; time.Sleep(10 * time.Millisecond) {
+		c.Assert(time.Now().Before(deadline), Equals, true, Commentf("runtime process was not killed"))
+	}
+}
+
+func (s *ociStubSuite) TestUnpackLayers(c *C) {
+	image := writeTestImage(c, `{}`,
+		[]tarEntry{
+			{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{hdr: tar.Header{Name: "dir/deleted"}, data: "x"},
+			{hdr: tar.Header{Name: "dir/kept"}, data: "x"},
+			{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{hdr: tar.Header{Name: "opaque/hidden"}, data: "x"},
+			{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/dir"}},
+			{hdr: tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../../../.."}},
+			{hdr: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/kept"}},
+			{hdr: tar.Header{Name: "setuid", Mode: 04755}, data: "x"},
+		},
+		[]tarEntry{
+			{hdr: tar.Header{Name: "dir/.wh.deleted"}},
+			{hdr: tar.Header{Name: "opaque/new"}, data: "new"},
+			{hdr: tar.Header{Name: "opaque/.wh..wh..opq"}},
+			{hdr: tar.Header{Name: "link/viasymlink"}, data: "via"},
+			{hdr: tar.Header{Name: "escape/escaped"}, data: "escaped"},
+		})
+	rootfs := c.MkDir()
+	_, err := unpackDockerArchive(image, rootfs, os.Geteuid() != 0)
+	c.Assert(err, IsNil)
+
+	_, err = os.Stat(rootfs + "/dir/deleted")
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(rootfs + "/dir/kept")
+	c.Check(err, IsNil)
+	_, err = os.Stat(rootfs + "/opaque/hidden")
+	c.Check(os.IsNotExist(err), Equals, true)
+	buf, err := ioutil.ReadFile(rootfs + "/opaque/new")
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "new")
+	buf, err = ioutil.ReadFile(rootfs + "/dir/viasymlink")
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "via")
+	buf, err = ioutil.ReadFile(rootfs + "/escaped")
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "escaped")
+	fi, err := os.Stat(rootfs + "/setuid")
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode()&os.ModeSetuid, Not(Equals), os.FileMode(0))
+	fi1, err := os.Stat(rootfs + "/hardlink")
+	c.Assert(err, IsNil)
+	fi2, err := os.Stat(rootfs + "/dir/kept")
+	c.Assert(err, IsNil)
+	c.Check(os.SameFile(fi1, fi2), Equals, true)
+}
+
+func (s *ociStubSuite) TestLookupUser(c *C) {
+	rootfs := s.executor.rootfs()
+	for _, trial := range []struct {
+		user     string
+		uid, gid uint32
+		err      string
+	}{
+		{"", 0, 0, ""},
+		{"alice", 1000, 1001, ""},
+		{"1000", 1000, 1001, ""},
+		{"alice:staff", 1000, 50, ""},
+		{"alice:12", 1000, 12, ""},
+		{"2000:3000", 2000, 3000, ""},
+		{"bob", 0, 0, `user "bob" not found.*`},
+		{"alice:nogroup", 0, 0, `group "nogroup" not found.*`},
+	} {
+		uid, gid, err := lookupUser(rootfs, trial.user)
+		if trial.err != "" {
+			c.Check(err, ErrorMatches, trial.err)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(uid, Equals, trial.uid, Commentf("%q", trial.user))
+		c.Check(gid, Equals, trial.gid, Commentf("%q", trial.user))
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// Default for how long a partial output collection is kept after it
+// was last updated, if the container never finishes successfully.
+// See Containers.PartialOutputTTL in the cluster config.
+const defaultPartialOutputTTL = 14 * 24 * time.Hour
+
+// startOutputCheckpoints starts a goroutine that periodically copies
+// the container's output to Keep while the container is running,
+// and saves it as a partial output collection. Files that haven't
+// changed since the last checkpoint are not copied again, and the
+// final CaptureOutput reuses the data that has already been
+// uploaded.
+func (runner *ContainerRunner) startOutputCheckpoints(bindmounts map[string]bindmount) {
+	if runner.outputCheckpointInterval <= 0 {
+		return
+	}
+	runner.uploadedOutput = map[string]uploadedFile{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	runner.stopOutputCheckpoints = func() {
+		close(stop)
+		<-done
+		runner.stopOutputCheckpoints = nil
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(runner.outputCheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			txt, err := runner.copyOutput(bindmounts, true)
+			if err != nil {
+				runner.CrunchLog.Printf("error copying partial output: %s", err)
+				continue
+			}
+			err = runner.savePartialOutput(txt)
+			if err != nil {
+				runner.CrunchLog.Printf("error saving partial output: %s", err)
+			}
+		}
+	}()
+}
+
+// savePartialOutput creates or updates the partial output collection
+// with the given manifest text. It does nothing if the manifest text
+// hasn't changed since the last save.
+func (runner *ContainerRunner) savePartialOutput(txt string) error {
+	if runner.partialOutputUUID != "" && txt == runner.partialOutputText {
+		return nil
+	}
+	ttl := runner.partialOutputTTL
+	if ttl <= 0 {
+		ttl = defaultPartialOutputTTL
+	}
+	exp := time.Now().Add(ttl)
+	coll := arvadosclient.Dict{
+		"manifest_text": txt,
+		"trash_at":      exp,
+		"delete_at":     exp,
+	}
+	var resp arvados.Collection
+	var err error
+	if runner.partialOutputUUID == "" {
+		props := arvadosclient.Dict{
+			"type":           "partial_output",
+			"container_uuid": runner.Container.UUID,
+		}
+		var crs []arvados.ContainerRequest
+		crs, err = runner.containerRequestsUsingContainer()
+		if err != nil {
+			return err
+		}
+		if len(crs) > 0 {
+			// Save in the same project as the container
+			// request (where its output will go) rather
+			// than the user's home project.
+			props["container_request"] = crs[0].UUID
+			coll["owner_uuid"] = crs[0].OwnerUUID
+		}
+		coll["name"] = "partial output for " + runner.Container.UUID
+		coll["properties"] = props
+		err = runner.ContainerArvClient.Create("collections", arvadosclient.Dict{
+			"ensure_unique_name": true,
+			"collection":         coll,
+		}, &resp)
+	} else {
+		err = runner.ContainerArvClient.Update("collections", runner.partialOutputUUID, arvadosclient.Dict{
+			"collection": coll,
+		}, &resp)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving partial output collection: %v", err)
+	}
+	runner.partialOutputUUID = resp.UUID
+	runner.partialOutputText = txt
+	runner.CrunchLog.Printf("saved partial output %s (%s)", resp.UUID, resp.PortableDataHash)
+	return nil
+}
+
+// finishPartialOutput is called with the final output manifest. If
+// the container completed, the partial output collection is no
+// longer needed. Otherwise, it is updated with the final output so
+// a retried container can use it.
+func (runner *ContainerRunner) finishPartialOutput(txt string) {
+	if runner.uploadedOutput == nil {
+		// Checkpoints were not enabled.
+		return
+	}
+	if runner.finalState != "Complete" {
+		err := runner.savePartialOutput(txt)
+		if err != nil {
+			runner.CrunchLog.Printf("error saving partial output: %s", err)
+		}
+		return
+	}
+	if runner.partialOutputUUID == "" {
+		return
+	}
+	err := runner.ContainerArvClient.Update("collections", runner.partialOutputUUID, arvadosclient.Dict{
+		"collection": arvadosclient.Dict{"is_trashed": true},
+	}, nil)
+	if err != nil {
+		runner.CrunchLog.Printf("error trashing partial output collection %s: %s", runner.partialOutputUUID, err)
+	}
+}
+
+// findPartialOutput returns the portable data hash of the most
+// recent partial output saved by a previous attempt to run the
+// container requests that are using this container, or "" if there
+// is none.
+//
+// Only collections that the container's own token can read, and that
+// are in the same project as the corresponding container request
+// (see savePartialOutput), are considered.
+func (runner *ContainerRunner) findPartialOutput() (string, error) {
+	crs, err := runner.containerRequestsUsingContainer()
+	if err != nil {
+		return "", err
+	}
+	var found arvados.Collection
+	for _, cr := range crs {
+		var list arvados.CollectionList
+		err := runner.ContainerArvClient.Call("GET", "collections", "", "", arvadosclient.Dict{
+			"filters": [][]interface{}{
+				{"owner_uuid", "=", cr.OwnerUUID},
+				{"properties.type", "=", "partial_output"},
+				{"properties.container_request", "=", cr.UUID},
+				{"properties.container_uuid", "!=", runner.Container.UUID},
+			},
+			"order": []string{"modified_at desc"},
+			"limit": 1,
+		}, &list)
+		if err != nil {
+			return "", fmt.Errorf("error looking up partial output collections: %v", err)
+		}
+		for _, coll := range list.Items {
+			if found.UUID == "" || coll.ModifiedAt.After(found.ModifiedAt) {
+				found = coll
+			}
+		}
+	}
+	if found.UUID != "" {
+		runner.CrunchLog.Printf("using partial output %s (%s) from %v", found.UUID, found.PortableDataHash, found.Properties["container_uuid"])
+	}
+	return found.PortableDataHash, nil
+}
+
+// containerRequestsUsingContainer returns the UUIDs and owners of
+// the container requests that are using this container, sorted by
+// UUID.
+func (runner *ContainerRunner) containerRequestsUsingContainer() ([]arvados.ContainerRequest, error) {
+	if runner.containerRequests != nil {
+		return runner.containerRequests, nil
+	}
+	var list arvados.ContainerRequestList
+	err := runner.DispatcherArvClient.Call("GET", "container_requests", "", "", arvadosclient.Dict{
+		"filters": [][]interface{}{{"container_uuid", "=", runner.Container.UUID}},
+		"select":  []string{"uuid", "owner_uuid"},
+	}, &list)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up container requests: %v", err)
+	}
+	crs := []arvados.ContainerRequest{}
+	for _, cr := range list.Items {
+		crs = append(crs, arvados.ContainerRequest{UUID: cr.UUID, OwnerUUID: cr.OwnerUUID})
+	}
+	sort.Slice(crs, func(i, j int) bool { return crs[i].UUID < crs[j].UUID })
+	runner.containerRequests = crs
+	return crs, nil
+}
@@ -0,0 +1,187 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestOutputCheckpoints(c *C) {
+	s.runner.outputCheckpointInterval = 10 * time.Millisecond
+	s.fullRunHelper(c, `{
+    "command": ["true"],
+    "container_image": "`+arvadostest.DockerImage112PDH+`",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {},
+    "state": "Locked"
+}`, nil, 0, func() {
+		c.Check(ioutil.WriteFile(s.runner.HostOutputDir+"/foo", []byte("foo"), 0644), IsNil)
+		api := s.runner.ContainerArvClient.(*ArvTestClient)
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			api.Lock()
+			saved := api.CalledWith("collection.properties.type", "partial_output")
+			api.Unlock()
+			if saved != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.Error("timed out waiting for partial output")
+				break
+			}
+		}
+		c.Check(ioutil.WriteFile(s.runner.HostOutputDir+"/bar", []byte("bar"), 0644), IsNil)
+	})
+
+	c.Check(s.api.CalledWith("container.state", "Complete"), NotNil)
+	api := s.runner.ContainerArvClient.(*ArvTestClient)
+	saved := api.CalledWith("collection.properties.type", "partial_output")
+	c.Assert(saved, NotNil)
+	coll := saved["collection"].(arvadosclient.Dict)
+	c.Check(coll["manifest_text"], Matches, `\. \S+ 0:3:foo\n`)
+	c.Check(coll["owner_uuid"], Equals, fakeContainerRequestOwnerUUID)
+	c.Check(coll["properties"], DeepEquals, arvadosclient.Dict{
+		"type":              "partial_output",
+		"container_uuid":    s.runner.Container.UUID,
+		"container_request": fakeContainerRequestUUID,
+	})
+
+	// The final output includes the file that was uploaded
+	// during the checkpoint, and the file written after that.
+	final := api.CalledWith("collection.name", "output for "+s.runner.Container.UUID)
+	c.Assert(final, NotNil)
+	c.Check(final["collection"].(arvadosclient.Dict)["manifest_text"], Matches, `\. \S+ 0:3:bar 3:3:foo\n|\. \S+ \S+ 0:3:bar 3:3:foo\n`)
+
+	// The partial output is trashed after the container
+	// completes successfully.
+	c.Check(api.CalledWith("collection.is_trashed", true), NotNil)
+}
+
+func (s *TestSuite) TestPartialOutputSavedOnFailure(c *C) {
+	api := &ArvTestClient{}
+	s.runner.ContainerArvClient = api
+	s.runner.uploadedOutput = map[string]uploadedFile{}
+	s.runner.partialOutputTTL = time.Hour
+	s.runner.finalState = "Cancelled"
+	s.runner.finishPartialOutput(". d41d8cd98f00b204e9800998ecf8427e+0 0:0:foo\n")
+	saved := api.CalledWith("collection.properties.type", "partial_output")
+	c.Assert(saved, NotNil)
+	coll := saved["collection"].(arvadosclient.Dict)
+	c.Check(coll["manifest_text"], Equals, ". d41d8cd98f00b204e9800998ecf8427e+0 0:0:foo\n")
+	c.Check(coll["delete_at"].(time.Time).Sub(time.Now()) <= time.Hour, Equals, true)
+	c.Check(coll["delete_at"].(time.Time).Sub(time.Now()) > time.Hour-time.Minute, Equals, true)
+	c.Check(api.CalledWith("collection.is_trashed", true), IsNil)
+
+	// Without checkpoints enabled, nothing is saved.
+	api = &ArvTestClient{}
+	s.runner.ContainerArvClient = api
+	s.runner.uploadedOutput = nil
+	s.runner.finishPartialOutput(". d41d8cd98f00b204e9800998ecf8427e+0 0:0:foo\n")
+	c.Check(api.Content, HasLen, 0)
+}
+
+func (s *TestSuite) TestSetupMountsPartialOutput(c *C) {
+	cr := s.runner
+	api := &ArvTestClient{}
+	cr.ContainerArvClient = api
+	cr.ContainerKeepClient = &KeepTestClient{}
+	realTemp := c.MkDir()
+	cr.parentTemp = realTemp
+	i := 0
+	cr.MkTempDir = func(_ string, prefix string) (string, error) {
+		i++
+		d := realTemp + "/" + prefix + string(rune('0'+i))
+		return d, os.Mkdir(d, os.ModePerm)
+	}
+	cr.Container.OutputPath = "/tmp"
+
+	// No previous attempt => empty directory
+	cr.Container.Mounts = map[string]arvados.Mount{
+		"/tmp":  {Kind: "tmp"},
+		"/prev": {Kind: "partial_output"},
+	}
+	bindmounts, err := cr.SetupMounts()
+	c.Assert(err, IsNil)
+	c.Check(bindmounts["/prev"].ReadOnly, Equals, true)
+	c.Check(strings.HasPrefix(bindmounts["/prev"].HostPath, realTemp+"/partial_output"), Equals, true)
+	ents, err := ioutil.ReadDir(bindmounts["/prev"].HostPath)
+	c.Check(err, IsNil)
+	c.Check(ents, HasLen, 0)
+
+	// Previous attempt saved partial output => use the most
+	// recent one in the container request's project that the
+	// container's token can read. (The dispatcher's token is
+	// not used to look it up.)
+	pdh := "acbd18db4cc2f85cedef654fccc4a4d8+54"
+	c.Assert(os.Mkdir(cr.ArvMountPoint+"/by_id/"+pdh, 0755), IsNil)
+	s.api.partialOutputs = []arvados.Collection{{
+		UUID:             "zzzzz-4zz18-000000000000002",
+		PortableDataHash: "37b51d194a7513e45b56f6524f2d51f2+54",
+		ModifiedAt:       time.Now(),
+	}}
+	api.partialOutputs = []arvados.Collection{{
+		UUID:             "zzzzz-4zz18-000000000000001",
+		PortableDataHash: pdh,
+		ModifiedAt:       time.Now(),
+		Properties:       map[string]interface{}{"container_uuid": "zzzzz-dz642-000000000000001"},
+	}}
+	cr.Container.Mounts = map[string]arvados.Mount{
+		"/tmp":  {Kind: "tmp"},
+		"/prev": {Kind: "partial_output"},
+	}
+	bindmounts, err = cr.SetupMounts()
+	c.Assert(err, IsNil)
+	c.Check(bindmounts["/prev"], DeepEquals, bindmount{HostPath: cr.ArvMountPoint + "/by_id/" + pdh, ReadOnly: true})
+	c.Check(cr.Container.Mounts["/prev"].PortableDataHash, Equals, pdh)
+	c.Check(api.partialOutputFilters, DeepEquals, [][]interface{}{
+		{"owner_uuid", "=", fakeContainerRequestOwnerUUID},
+		{"properties.type", "=", "partial_output"},
+		{"properties.container_request", "=", fakeContainerRequestUUID},
+		{"properties.container_uuid", "!=", cr.Container.UUID},
+	})
+}
+
+type localLocatorCountingKeepClient struct {
+	KeepTestClient
+	localLocatorCalls []string
+}
+
+func (kc *localLocatorCountingKeepClient) LocalLocator(locator string) (string, error) {
+	kc.localLocatorCalls = append(kc.localLocatorCalls, locator)
+	return strings.Split(locator, "+R")[0] + "+Alocalsig@12345678", nil
+}
+
+func (s *TestSuite) TestLocalizeRemoteBlocks(c *C) {
+	kc := &localLocatorCountingKeepClient{}
+	s.runner.ContainerKeepClient = kc
+	txt1 := ". acbd18db4cc2f85cedef654fccc4a4d8+3+Rzzzzz-remotesig1 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo 3:3:bar\n"
+	out, err := s.runner.localizeRemoteBlocks(txt1)
+	c.Check(err, IsNil)
+	c.Check(out, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3+Alocalsig@12345678 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo 3:3:bar\n")
+	c.Check(kc.localLocatorCalls, HasLen, 1)
+
+	// The next checkpoint has the same remote block (with a
+	// different signature) plus a new one. Only the new one is
+	// copied.
+	txt2 := ". acbd18db4cc2f85cedef654fccc4a4d8+3+Rzzzzz-remotesig2 73feffa4b7f6bb68e44cf984c85f6e88+3+Rzzzzz-remotesig2 0:3:foo 3:3:baz\n"
+	out, err = s.runner.localizeRemoteBlocks(txt2)
+	c.Check(err, IsNil)
+	c.Check(out, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3+Alocalsig@12345678 73feffa4b7f6bb68e44cf984c85f6e88+3+Alocalsig@12345678 0:3:foo 3:3:baz\n")
+	c.Check(kc.localLocatorCalls, DeepEquals, []string{
+		"acbd18db4cc2f85cedef654fccc4a4d8+3+Rzzzzz-remotesig1",
+		"73feffa4b7f6bb68e44cf984c85f6e88+3+Rzzzzz-remotesig2",
+	})
+}
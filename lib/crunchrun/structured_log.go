@@ -0,0 +1,242 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structuredLogRecord is a single record in the structured log. Each
+// record is written as one line of JSON.
+type structuredLogRecord struct {
+	Time          string            `json:"time"`
+	Stream        string            `json:"stream"`
+	ContainerUUID string            `json:"container_uuid"`
+	Level         string            `json:"level"`
+	Event         string            `json:"event"`
+	Message       string            `json:"msg,omitempty"`
+	State         string            `json:"state,omitempty"`
+	Crunchstat    *crunchstatSample `json:"crunchstat,omitempty"`
+}
+
+// crunchstatSample is the machine-readable form of a crunchstat
+// report line like
+//
+//	cpu 1.2345 user 0.4321 sys 4 cpus -- interval 10.0000 seconds 0.1000 user 0.0100 sys
+type crunchstatSample struct {
+	Category string             `json:"category"`
+	Values   map[string]float64 `json:"values"`
+	Interval float64            `json:"interval,omitempty"`
+	Deltas   map[string]float64 `json:"deltas,omitempty"`
+}
+
+// structuredLogger writes log messages from other log streams,
+// crunchstat samples, and container state changes to the
+// "structured" log stream as JSON records, in addition to the usual
+// text logs.
+type structuredLogger struct {
+	containerUUID string
+	includeStdio  bool
+	writer        *ThrottledLogger
+	closed        bool
+	mtx           sync.Mutex
+}
+
+// startStructuredLog starts copying log messages to the structured
+// log. Logs that were started before this is called (other than
+// CrunchLog) are not copied. The container's stdout and stderr are
+// only copied if includeStdio is true, because they can be much
+// bigger than the other logs.
+func (runner *ContainerRunner) startStructuredLog(includeStdio bool) error {
+	w, err := runner.NewLogWriter("structured")
+	if err != nil {
+		return err
+	}
+	sl := &structuredLogger{
+		containerUUID: runner.Container.UUID,
+		includeStdio:  includeStdio,
+	}
+	if aw, ok := w.(*ArvLogWriter); ok {
+		// Send throttling messages as records, too, so
+		// every line of every event is a JSON record.
+		aw.formatNotice = sl.formatNotice
+	}
+	sl.writer = NewThrottledLogger(w)
+	// Records have their own timestamps.
+	sl.writer.Timestamper = nil
+	runner.structuredLog = sl
+	runner.CrunchLog.Lock()
+	runner.CrunchLog.tee = runner.structuredLog.tee("crunch-run")
+	runner.CrunchLog.Unlock()
+	return nil
+}
+
+// newThrottledLogger returns a ThrottledLogger for the named log
+// stream that also copies each line to the structured log, if
+// enabled.
+func (runner *ContainerRunner) newThrottledLogger(name string, w io.WriteCloser) *ThrottledLogger {
+	tl := NewThrottledLogger(w)
+	if sl := runner.structuredLog; sl != nil && (sl.includeStdio || (name != "stdout" && name != "stderr")) {
+		tl.tee = sl.tee(name)
+	}
+	return tl
+}
+
+// tee returns a func that copies lines from the given stream to the
+// structured log.
+func (sl *structuredLogger) tee(stream string) func(time.Time, string) {
+	return func(t time.Time, line string) {
+		rec := structuredLogRecord{
+			Stream:  stream,
+			Level:   logLevel(line),
+			Event:   "log",
+			Message: line,
+		}
+		if stream == "crunchstat" || stream == "hoststat" {
+			if sample := parseCrunchstat(line); sample != nil {
+				rec.Event = "crunchstat"
+				rec.Crunchstat = sample
+			}
+		}
+		sl.write(t, rec)
+	}
+}
+
+// logState adds a record of a container state change.
+func (sl *structuredLogger) logState(state string) {
+	if sl == nil {
+		return
+	}
+	sl.write(time.Now().UTC(), structuredLogRecord{
+		Stream: "crunch-run",
+		Level:  "info",
+		Event:  "state",
+		State:  state,
+	})
+}
+
+// formatNotice returns a record for a message from the structured
+// log's own rate limiter, like "Exceeded rate ...".
+func (sl *structuredLogger) formatNotice(t time.Time, msg string) string {
+	return string(sl.marshal(t, structuredLogRecord{
+		Stream:  "structured",
+		Level:   "warning",
+		Event:   "throttle",
+		Message: msg,
+	}))
+}
+
+func (sl *structuredLogger) marshal(t time.Time, rec structuredLogRecord) []byte {
+	rec.Time = RFC3339Timestamp(t)
+	rec.ContainerUUID = sl.containerUUID
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		// Can't happen: all fields are marshalable.
+		return nil
+	}
+	return buf
+}
+
+func (sl *structuredLogger) write(t time.Time, rec structuredLogRecord) {
+	buf := sl.marshal(t, rec)
+	if buf == nil {
+		return
+	}
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	if sl.closed {
+		return
+	}
+	sl.writer.Write(append(buf, '\n'))
+}
+
+// Close flushes the structured log. Records written after Close are
+// discarded.
+func (sl *structuredLogger) Close() error {
+	if sl == nil {
+		return nil
+	}
+	sl.mtx.Lock()
+	if sl.closed {
+		sl.mtx.Unlock()
+		return nil
+	}
+	sl.closed = true
+	sl.mtx.Unlock()
+	return sl.writer.Close()
+}
+
+// logLevel guesses the severity of a text log message from its
+// prefix, e.g., "warning: ..." or "error ...".
+func logLevel(msg string) string {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(msg, "error"), strings.HasPrefix(msg, "fatal"):
+		return "error"
+	case strings.HasPrefix(msg, "warning"):
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// parseCrunchstat parses a crunchstat report line. It returns nil if
+// the line is not a stats sample (e.g., "notice: ..." messages).
+func parseCrunchstat(line string) *crunchstatSample {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || strings.HasSuffix(fields[0], ":") {
+		return nil
+	}
+	sample := &crunchstatSample{
+		Category: fields[0],
+		Values:   map[string]float64{},
+	}
+	fields = fields[1:]
+	for i, f := range fields {
+		if f == "--" {
+			interval := fields[i+1:]
+			if len(interval) < 3 || interval[0] != "interval" || interval[2] != "seconds" {
+				return nil
+			}
+			var err error
+			sample.Interval, err = strconv.ParseFloat(interval[1], 64)
+			if err != nil {
+				return nil
+			}
+			sample.Deltas = map[string]float64{}
+			if !parseStatPairs(interval[3:], sample.Deltas) {
+				return nil
+			}
+			fields = fields[:i]
+			break
+		}
+	}
+	if !parseStatPairs(fields, sample.Values) {
+		return nil
+	}
+	return sample
+}
+
+// parseStatPairs parses a list of fields like "1234 user 5678 sys"
+// into dst. It returns false if the fields are not all value/label
+// pairs.
+func parseStatPairs(fields []string, dst map[string]float64) bool {
+	if len(fields)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(fields); i += 2 {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return false
+		}
+		dst[fields[i+1]] = v
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+func (s *LoggingTestSuite) TestStructuredLog(c *C) {
+	api := &ArvTestClient{}
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, api, kc, "zzzzz-dz642-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	c.Assert(cr.startStructuredLog(true), IsNil)
+
+	w, err := cr.NewLogWriter("stdout")
+	c.Assert(err, IsNil)
+	stdout := cr.newThrottledLogger("stdout", w)
+	w, err = cr.NewLogWriter("crunchstat")
+	c.Assert(err, IsNil)
+	stat := cr.newThrottledLogger("crunchstat", w)
+
+	cr.CrunchLog.Print("Hello world!")
+	stdout.Print("Doing stuff")
+	stat.Print("notice: reading stats from /sys/fs/cgroup/foo")
+	stat.Print("cpu 1.5000 user 0.2500 sys 2 cpus -- interval 10.0000 seconds 0.5000 user 0.1000 sys")
+	cr.CrunchLog.Print("error: something failed")
+	cr.structuredLog.logState("Running")
+	stdout.Close()
+	stat.Close()
+	cr.CrunchLog.Close()
+	c.Assert(cr.structuredLog.Close(), IsNil)
+
+	// Text logs are still written as usual.
+	f, err := cr.LogCollection.OpenFile("stdout.txt", os.O_RDONLY, 0)
+	c.Assert(err, IsNil)
+	buf, err := ioutil.ReadAll(f)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Matches, `\S+ Doing stuff\n`)
+
+	f, err = cr.LogCollection.OpenFile("structured.txt", os.O_RDONLY, 0)
+	c.Assert(err, IsNil)
+	var recs []structuredLogRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec structuredLogRecord
+		c.Assert(json.Unmarshal(scanner.Bytes(), &rec), IsNil, Commentf("%q", scanner.Text()))
+		_, err = time.Parse(time.RFC3339Nano, rec.Time)
+		c.Check(err, IsNil)
+		c.Check(rec.ContainerUUID, Equals, "zzzzz-dz642-zzzzzzzzzzzzzzz")
+		rec.Time = ""
+		rec.ContainerUUID = ""
+		recs = append(recs, rec)
+	}
+	c.Check(recs, DeepEquals, []structuredLogRecord{
+		{Stream: "crunch-run", Level: "info", Event: "log", Message: "Hello world!"},
+		{Stream: "stdout", Level: "info", Event: "log", Message: "Doing stuff"},
+		{Stream: "crunchstat", Level: "info", Event: "log", Message: "notice: reading stats from /sys/fs/cgroup/foo"},
+		{Stream: "crunchstat", Level: "info", Event: "crunchstat",
+			Message: "cpu 1.5000 user 0.2500 sys 2 cpus -- interval 10.0000 seconds 0.5000 user 0.1000 sys",
+			Crunchstat: &crunchstatSample{
+				Category: "cpu",
+				Values:   map[string]float64{"user": 1.5, "sys": 0.25, "cpus": 2},
+				Interval: 10,
+				Deltas:   map[string]float64{"user": 0.5, "sys": 0.1},
+			}},
+		{Stream: "crunch-run", Level: "error", Event: "log", Message: "error: something failed"},
+		{Stream: "crunch-run", Level: "info", Event: "state", State: "Running"},
+	})
+
+	// The records are also sent as "structured" log events.
+	var events string
+	for _, content := range api.Content {
+		if lr, ok := content["log"].(arvadosclient.Dict); ok && lr["event_type"] == "structured" {
+			events += lr["properties"].(map[string]string)["text"]
+		}
+	}
+	c.Check(strings.Count(events, "\n"), Equals, len(recs))
+	c.Check(events, Matches, `(?ms)^\{"time":.*"event":"state","state":"Running"\}\n$`)
+}
+
+func (s *LoggingTestSuite) TestStructuredLogThrottle(c *C) {
+	discoveryMap["crunchLogThrottleLines"] = float64(2)
+	defer func() {
+		discoveryMap["crunchLogThrottleLines"] = float64(1024)
+	}()
+
+	api := &ArvTestClient{}
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, api, kc, "zzzzz-dz642-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	c.Assert(cr.startStructuredLog(false), IsNil)
+
+	w, err := cr.NewLogWriter("stdout")
+	c.Assert(err, IsNil)
+	stdout := cr.newThrottledLogger("stdout", w)
+	stdout.Print("Doing stuff")
+	for i := 0; i < 5; i++ {
+		cr.CrunchLog.Printf("line %d", i)
+	}
+	stdout.Close()
+	cr.CrunchLog.Close()
+	c.Assert(cr.structuredLog.Close(), IsNil)
+
+	// The complete log in Keep has all of the crunch-run
+	// messages, but not stdout.
+	f, err := cr.LogCollection.OpenFile("structured.txt", os.O_RDONLY, 0)
+	c.Assert(err, IsNil)
+	buf, err := ioutil.ReadAll(f)
+	c.Assert(err, IsNil)
+	c.Check(strings.Count(string(buf), "\n"), Equals, 5)
+	c.Check(string(buf), Not(Matches), `(?ms).*Doing stuff.*`)
+
+	// The log events are throttled, and the throttling message
+	// is a JSON record like the others.
+	var events string
+	for _, content := range api.Content {
+		if lr, ok := content["log"].(arvadosclient.Dict); ok && lr["event_type"] == "structured" {
+			events += lr["properties"].(map[string]string)["text"]
+		}
+	}
+	var recs []structuredLogRecord
+	for _, line := range strings.Split(strings.TrimSuffix(events, "\n"), "\n") {
+		var rec structuredLogRecord
+		c.Check(json.Unmarshal([]byte(line), &rec), IsNil, Commentf("%q", line))
+		recs = append(recs, rec)
+	}
+	c.Assert(recs, HasLen, 3)
+	c.Check(recs[0].Message, Equals, "line 0")
+	c.Check(recs[1].Message, Equals, "line 1")
+	c.Check(recs[2].Stream, Equals, "structured")
+	c.Check(recs[2].Level, Equals, "warning")
+	c.Check(recs[2].Event, Equals, "throttle")
+	c.Check(recs[2].ContainerUUID, Equals, "zzzzz-dz642-zzzzzzzzzzzzzzz")
+	c.Check(recs[2].Message, Matches, `Exceeded rate 2 lines per 60 seconds .*`)
+}
+
+func (s *LoggingTestSuite) TestParseCrunchstat(c *C) {
+	for _, trial := range []struct {
+		line   string
+		expect *crunchstatSample
+	}{
+		{"mem 12345 cache 0 swap 17 pgmajfault 98765 rss", &crunchstatSample{
+			Category: "mem",
+			Values:   map[string]float64{"cache": 12345, "swap": 0, "pgmajfault": 17, "rss": 98765},
+		}},
+		{"net:eth0 100 tx 200 rx -- interval 10.0000 seconds 10 tx 20 rx", &crunchstatSample{
+			Category: "net:eth0",
+			Values:   map[string]float64{"tx": 100, "rx": 200},
+			Interval: 10,
+			Deltas:   map[string]float64{"tx": 10, "rx": 20},
+		}},
+		{"statfs 1000 available 24 used 1024 total", &crunchstatSample{
+			Category: "statfs",
+			Values:   map[string]float64{"available": 1000, "used": 24, "total": 1024},
+		}},
+		{"mem", nil},
+		{"notice: reading stats from /sys/fs/cgroup/foo", nil},
+		{"warning: cgroup stats files never appeared for abcdef", nil},
+		{"cpu 1.0 user 2.0", nil},
+		{"cpu 1.0 user -- interval ten seconds 1.0 user", nil},
+		{"cpu 1.0 user -- 10 seconds 1.0 user", nil},
+	} {
+		c.Check(parseCrunchstat(trial.line), DeepEquals, trial.expect, Commentf("%q", trial.line))
+	}
+}
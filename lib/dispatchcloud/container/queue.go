@@ -15,7 +15,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-type typeChooser func(*arvados.Container) (arvados.InstanceType, error)
+// A typeChooser returns the instance types that can run a container,
+// in order of preference.
+type typeChooser func(*arvados.Container) ([]arvados.InstanceType, error)
 
 // An APIClient performs Arvados API requests. It is typically an
 // *arvados.Client.
@@ -24,14 +26,34 @@ type APIClient interface {
 }
 
 // A QueueEnt is an entry in the queue, consisting of a container
-// record and the instance type that should be used to run it.
+// record and the instance types that can be used to run it.
 type QueueEnt struct {
 	// The container to run. Only the UUID, State, Priority,
-	// RuntimeConstraints, Mounts, and ContainerImage fields are
-	// populated.
-	Container    arvados.Container    `json:"container"`
-	InstanceType arvados.InstanceType `json:"instance_type"`
-	FirstSeenAt  time.Time            `json:"first_seen_at"`
+	// RuntimeConstraints, RuntimeUserUUID, Mounts, and
+	// ContainerImage fields are populated.
+	Container arvados.Container `json:"container"`
+
+	// InstanceTypes are the instance types that can run the
+	// container, in order of preference (cheapest first).
+	// InstanceType is the first of them, or the zero value if
+	// there are none.
+	InstanceType  arvados.InstanceType   `json:"instance_type"`
+	InstanceTypes []arvados.InstanceType `json:"instance_types"`
+
+	FirstSeenAt time.Time `json:"first_seen_at"`
+
+	// OwnerUUID and RequestUUID are the owner and UUID of the
+	// highest-priority container request for this container, at
+	// the time the container was first seen. They are populated
+	// only if the Queue was configured to look up owners (see
+	// LookupOwners).
+	OwnerUUID   string `json:"owner_uuid,omitempty"`
+	RequestUUID string `json:"request_uuid,omitempty"`
+
+	// Number of times this container, or an earlier container
+	// for the same container request, has been preempted. See
+	// RecordPreemption.
+	Preemptions int `json:"preemptions,omitempty"`
 }
 
 // String implements fmt.Stringer by returning the queued container's
@@ -58,6 +80,16 @@ type Queue struct {
 	chooseType typeChooser
 	client     APIClient
 
+	// If true, look up the owner of each new container's
+	// highest-priority container request. See LookupOwners.
+	lookupOwners bool
+
+	// Number of preemptions after which a container that asks
+	// for a preemptible instance type gets a non-preemptible one
+	// instead (0 = never). See SetPreemptionFallback.
+	preemptionFallback int
+	preemptions        map[string]preemptionCount // keyed by container request UUID, or container UUID if unknown
+
 	auth    *arvados.APIClientAuthorization
 	current map[string]QueueEnt
 	updated time.Time
@@ -85,6 +117,7 @@ func NewQueue(logger logrus.FieldLogger, reg *prometheus.Registry, chooseType ty
 		chooseType:  chooseType,
 		client:      client,
 		current:     map[string]QueueEnt{},
+		preemptions: map[string]preemptionCount{},
 		subscribers: map[<-chan struct{}]chan struct{}{},
 	}
 	if reg != nil {
@@ -93,6 +126,81 @@ func NewQueue(logger logrus.FieldLogger, reg *prometheus.Registry, chooseType ty
 	return cq
 }
 
+// LookupOwners enables populating the OwnerUUID and RequestUUID
+// fields of each new queue entry. This costs an additional API
+// request during Update when new containers appear. It should be
+// called before the first Update.
+func (cq *Queue) LookupOwners() {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	cq.lookupOwners = true
+}
+
+// SetPreemptionFallback enables choosing a non-preemptible instance
+// type for a container that asks for a preemptible one, once it has
+// been preempted n times (see RecordPreemption). Preemptions of
+// earlier containers for the same container request are counted
+// only if LookupOwners is also enabled.
+func (cq *Queue) SetPreemptionFallback(n int) {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	cq.preemptionFallback = n
+}
+
+// RecordPreemption records that the given container was running on
+// an instance that the cloud provider reclaimed. If the preemption
+// fallback threshold is reached, the entry's InstanceType is changed
+// to a non-preemptible type.
+func (cq *Queue) RecordPreemption(uuid string) {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	ent, ok := cq.current[uuid]
+	if !ok {
+		return
+	}
+	key := preemptionKey(ent)
+	pc := cq.preemptions[key]
+	pc.count++
+	pc.last = time.Now()
+	cq.preemptions[key] = pc
+	ent.Preemptions = pc.count
+	if types, err := cq.chooseTypeAfterPreemptions(ent.Container, ent.Preemptions); err == nil && len(types) > 0 && types[0].Name != ent.InstanceType.Name {
+		cq.logger.WithFields(logrus.Fields{
+			"ContainerUUID":        uuid,
+			"Preemptions":          ent.Preemptions,
+			"InstanceType":         types[0].Name,
+			"PreviousInstanceType": ent.InstanceType.Name,
+		}).Info("falling back to non-preemptible instance type")
+		ent.setInstanceTypes(types)
+	}
+	cq.current[uuid] = ent
+	cq.notify()
+}
+
+// Caller must have lock.
+func (cq *Queue) chooseTypeAfterPreemptions(ctr arvados.Container, preemptions int) ([]arvados.InstanceType, error) {
+	if ctr.SchedulingParameters.Preemptible && cq.preemptionFallback > 0 && preemptions >= cq.preemptionFallback {
+		ctr.SchedulingParameters.Preemptible = false
+	}
+	return cq.chooseType(&ctr)
+}
+
+type preemptionCount struct {
+	count int
+	last  time.Time
+}
+
+// Time to remember preemptions of a container request's containers
+// after the most recent one.
+const preemptionMemory = 24 * time.Hour
+
+func preemptionKey(ent QueueEnt) string {
+	if ent.RequestUUID != "" {
+		return ent.RequestUUID
+	}
+	return ent.Container.UUID
+}
+
 // Subscribe returns a channel that becomes ready to receive when an
 // entry in the Queue is updated.
 //
@@ -186,7 +294,22 @@ func (cq *Queue) Update() error {
 		return err
 	}
 
+	var requests map[string]arvados.ContainerRequest
 	cq.mtx.Lock()
+	if cq.lookupOwners {
+		var added []string
+		for uuid := range next {
+			if _, ok := cq.current[uuid]; !ok {
+				added = append(added, uuid)
+			}
+		}
+		cq.mtx.Unlock()
+		requests, err = cq.fetchRequests(added)
+		if err != nil {
+			return err
+		}
+		cq.mtx.Lock()
+	}
 	defer cq.mtx.Unlock()
 	for uuid, ctr := range next {
 		if _, dontupdate := cq.dontupdate[uuid]; dontupdate {
@@ -195,7 +318,7 @@ func (cq *Queue) Update() error {
 			continue
 		}
 		if cur, ok := cq.current[uuid]; !ok {
-			cq.addEnt(uuid, *ctr)
+			cq.addEnt(uuid, *ctr, requests[uuid])
 		} else {
 			cur.Container = *ctr
 			cq.current[uuid] = cur
@@ -215,6 +338,11 @@ func (cq *Queue) Update() error {
 			cq.delEnt(uuid, ent.Container.State)
 		}
 	}
+	for key, pc := range cq.preemptions {
+		if time.Since(pc.last) > preemptionMemory {
+			delete(cq.preemptions, key)
+		}
+	}
 	cq.dontupdate = nil
 	cq.updated = updateStarted
 	cq.notify()
@@ -231,8 +359,13 @@ func (cq *Queue) delEnt(uuid string, state arvados.ContainerState) {
 }
 
 // Caller must have lock.
-func (cq *Queue) addEnt(uuid string, ctr arvados.Container) {
-	it, err := cq.chooseType(&ctr)
+func (cq *Queue) addEnt(uuid string, ctr arvados.Container, req arvados.ContainerRequest) {
+	ent := QueueEnt{Container: ctr, FirstSeenAt: time.Now(), OwnerUUID: req.OwnerUUID, RequestUUID: req.UUID}
+	ent.Preemptions = cq.preemptions[preemptionKey(ent)].count
+	types, err := cq.chooseTypeAfterPreemptions(ctr, ent.Preemptions)
+	if err == nil && len(types) == 0 {
+		err = errors.New("no suitable instance type")
+	}
 	if err != nil && (ctr.State == arvados.ContainerStateQueued || ctr.State == arvados.ContainerStateLocked) {
 		// We assume here that any chooseType error is a hard
 		// error: it wouldn't help to try again, or to leave
@@ -284,9 +417,26 @@ func (cq *Queue) addEnt(uuid string, ctr arvados.Container) {
 		"ContainerUUID": ctr.UUID,
 		"State":         ctr.State,
 		"Priority":      ctr.Priority,
-		"InstanceType":  it.Name,
+		"InstanceTypes": instanceTypeNames(types),
 	}).Info("adding container to queue")
-	cq.current[uuid] = QueueEnt{Container: ctr, InstanceType: it, FirstSeenAt: time.Now()}
+	ent.setInstanceTypes(types)
+	cq.current[uuid] = ent
+}
+
+func (ent *QueueEnt) setInstanceTypes(types []arvados.InstanceType) {
+	ent.InstanceTypes = types
+	ent.InstanceType = arvados.InstanceType{}
+	if len(types) > 0 {
+		ent.InstanceType = types[0]
+	}
+}
+
+func instanceTypeNames(types []arvados.InstanceType) []string {
+	names := make([]string, len(types))
+	for i, it := range types {
+		names[i] = it.Name
+	}
+	return names
 }
 
 // Lock acquires the dispatch lock for the given container.
@@ -302,11 +452,37 @@ func (cq *Queue) Unlock(uuid string) error {
 // setRuntimeError sets runtime_status["error"] to the given value.
 // Container should already have state==Locked or Running.
 func (cq *Queue) setRuntimeError(uuid, errorString string) error {
-	return cq.client.RequestAndDecode(nil, "PUT", "arvados/v1/containers/"+uuid, nil, map[string]map[string]map[string]interface{}{
+	return cq.UpdateRuntimeStatus(uuid, map[string]string{"error": errorString})
+}
+
+// UpdateRuntimeStatus sets the given keys in the given container's
+// runtime_status, and deletes keys whose given value is "". Other
+// keys, like those set by crunch-run, are left alone.
+//
+// The API does not offer an atomic merge, so a concurrent update by
+// another client between our read and write can be lost.
+//
+// Container should already have state==Locked or Running.
+func (cq *Queue) UpdateRuntimeStatus(uuid string, update map[string]string) error {
+	var ctr arvados.Container
+	err := cq.client.RequestAndDecode(&ctr, "GET", "arvados/v1/containers/"+uuid, nil, map[string][]string{"select": {"uuid", "runtime_status"}})
+	if err != nil {
+		return err
+	}
+	rs := ctr.RuntimeStatus
+	if rs == nil {
+		rs = map[string]interface{}{}
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(rs, k)
+		} else {
+			rs[k] = v
+		}
+	}
+	return cq.client.RequestAndDecode(nil, "PUT", "arvados/v1/containers/"+uuid, nil, map[string]map[string]interface{}{
 		"container": {
-			"runtime_status": {
-				"error": errorString,
-			},
+			"runtime_status": rs,
 		},
 	})
 }
@@ -384,7 +560,7 @@ func (cq *Queue) poll() (map[string]*arvados.Container, error) {
 			*next[upd.UUID] = upd
 		}
 	}
-	selectParam := []string{"uuid", "state", "priority", "runtime_constraints", "container_image", "mounts", "scheduling_parameters", "created_at"}
+	selectParam := []string{"uuid", "state", "priority", "runtime_constraints", "container_image", "mounts", "scheduling_parameters", "created_at", "runtime_user_uuid"}
 	limitParam := 1000
 
 	mine, err := cq.fetchAll(arvados.ResourceListParams{
@@ -471,6 +647,104 @@ func (cq *Queue) poll() (map[string]*arvados.Container, error) {
 	return next, nil
 }
 
+// fetchRequests returns the uuid and owner_uuid of the
+// highest-priority container request for each of the given
+// containers, keyed by container UUID.
+func (cq *Queue) fetchRequests(uuids []string) (map[string]arvados.ContainerRequest, error) {
+	requests := map[string]arvados.ContainerRequest{}
+	priority := map[string]int{}
+	for len(uuids) > 0 {
+		batch := uuids
+		if len(batch) > 20 {
+			batch = batch[:20]
+		}
+		uuids = uuids[len(batch):]
+		params := arvados.ResourceListParams{
+			Select:  []string{"uuid", "container_uuid", "owner_uuid", "priority"},
+			Order:   "uuid",
+			Count:   "none",
+			Filters: []arvados.Filter{{"container_uuid", "in", batch}},
+		}
+		for {
+			var list arvados.ContainerRequestList
+			err := cq.client.RequestAndDecode(&list, "GET", "arvados/v1/container_requests", nil, params)
+			if err != nil {
+				return nil, err
+			}
+			if len(list.Items) == 0 {
+				break
+			}
+			for _, cr := range list.Items {
+				if prio, seen := priority[cr.ContainerUUID]; !seen || cr.Priority > prio {
+					requests[cr.ContainerUUID] = cr
+					priority[cr.ContainerUUID] = cr.Priority
+				}
+			}
+			params.Filters = []arvados.Filter{{"container_uuid", "in", batch}, {"uuid", ">", list.Items[len(list.Items)-1].UUID}}
+		}
+	}
+	return requests, nil
+}
+
+// FetchHistory returns entries for containers that are running, or
+// that finished after the given time, with StartedAt and FinishedAt
+// populated. OwnerUUID and RequestUUID are populated if LookupOwners
+// is enabled. The entries are not added to the queue.
+//
+// Containers that never started, or that cannot run on any of the
+// currently configured instance types, are omitted.
+func (cq *Queue) FetchHistory(since time.Time) ([]QueueEnt, error) {
+	selectParam := []string{"uuid", "state", "runtime_constraints", "scheduling_parameters", "runtime_user_uuid", "started_at", "finished_at"}
+	var ctrs []arvados.Container
+	for _, filters := range [][]arvados.Filter{
+		{{"state", "=", arvados.ContainerStateRunning}},
+		{{"finished_at", ">=", since}, {"started_at", "!=", nil}},
+	} {
+		found, err := cq.fetchAll(arvados.ResourceListParams{
+			Select:  selectParam,
+			Order:   "uuid",
+			Count:   "none",
+			Filters: filters,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ctrs = append(ctrs, found...)
+	}
+
+	cq.mtx.Lock()
+	lookupOwners := cq.lookupOwners
+	cq.mtx.Unlock()
+	var requests map[string]arvados.ContainerRequest
+	if lookupOwners {
+		uuids := make([]string, 0, len(ctrs))
+		for _, ctr := range ctrs {
+			uuids = append(uuids, ctr.UUID)
+		}
+		var err error
+		requests, err = cq.fetchRequests(uuids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ents := make([]QueueEnt, 0, len(ctrs))
+	for _, ctr := range ctrs {
+		if ctr.StartedAt == nil {
+			continue
+		}
+		types, err := cq.chooseType(&ctr)
+		if err != nil || len(types) == 0 {
+			continue
+		}
+		req := requests[ctr.UUID]
+		ent := QueueEnt{Container: ctr, OwnerUUID: req.OwnerUUID, RequestUUID: req.UUID}
+		ent.setInstanceTypes(types)
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
 func (cq *Queue) fetchAll(initialParams arvados.ResourceListParams) ([]arvados.Container, error) {
 	var results []arvados.Container
 	params := initialParams
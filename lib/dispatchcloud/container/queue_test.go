@@ -40,8 +40,8 @@ func (suite *IntegrationSuite) TearDownTest(c *check.C) {
 }
 
 func (suite *IntegrationSuite) TestGetLockUnlockCancel(c *check.C) {
-	typeChooser := func(ctr *arvados.Container) (arvados.InstanceType, error) {
-		return arvados.InstanceType{Name: "testType"}, nil
+	typeChooser := func(ctr *arvados.Container) ([]arvados.InstanceType, error) {
+		return []arvados.InstanceType{{Name: "testType"}}, nil
 	}
 
 	client := arvados.NewClientFromEnv()
@@ -104,8 +104,52 @@ func (suite *IntegrationSuite) TestGetLockUnlockCancel(c *check.C) {
 	wg.Wait()
 }
 
+func (suite *IntegrationSuite) TestLookupOwners(c *check.C) {
+	typeChooser := func(ctr *arvados.Container) ([]arvados.InstanceType, error) {
+		return []arvados.InstanceType{{Name: "testType"}}, nil
+	}
+	client := arvados.NewClientFromEnv()
+
+	cq := NewQueue(logger(), nil, typeChooser, client)
+	c.Check(cq.Update(), check.IsNil)
+	ents, _ := cq.Entries()
+	c.Check(ents[arvadostest.QueuedContainerUUID].OwnerUUID, check.Equals, "")
+
+	cq = NewQueue(logger(), nil, typeChooser, client)
+	cq.LookupOwners()
+	c.Check(cq.Update(), check.IsNil)
+	ents, _ = cq.Entries()
+	c.Check(ents[arvadostest.QueuedContainerUUID].OwnerUUID, check.Equals, arvadostest.ActiveUserUUID)
+}
+
+func (suite *IntegrationSuite) TestFetchHistory(c *check.C) {
+	typeChooser := func(ctr *arvados.Container) ([]arvados.InstanceType, error) {
+		return []arvados.InstanceType{{Name: "testType"}}, nil
+	}
+	cq := NewQueue(logger(), nil, typeChooser, arvados.NewClientFromEnv())
+	ents, err := cq.FetchHistory(time.Time{})
+	c.Assert(err, check.IsNil)
+	found := map[string]QueueEnt{}
+	for _, ent := range ents {
+		c.Check(ent.Container.StartedAt, check.NotNil)
+		c.Check(ent.InstanceType.Name, check.Equals, "testType")
+		found[ent.Container.UUID] = ent
+	}
+	c.Check(found[arvadostest.RunningContainerUUID].Container.State, check.Equals, arvados.ContainerStateRunning)
+	c.Check(found[arvadostest.CompletedContainerUUID].Container.FinishedAt, check.NotNil)
+	_, ok := found[arvadostest.QueuedContainerUUID]
+	c.Check(ok, check.Equals, false)
+
+	// Nothing has finished in the future.
+	ents, err = cq.FetchHistory(time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	for _, ent := range ents {
+		c.Check(ent.Container.State, check.Equals, arvados.ContainerStateRunning)
+	}
+}
+
 func (suite *IntegrationSuite) TestCancelIfNoInstanceType(c *check.C) {
-	errorTypeChooser := func(ctr *arvados.Container) (arvados.InstanceType, error) {
+	errorTypeChooser := func(ctr *arvados.Container) ([]arvados.InstanceType, error) {
 		// Make sure the relevant container fields are
 		// actually populated.
 		c.Check(ctr.ContainerImage, check.Equals, "test")
@@ -113,7 +157,7 @@ func (suite *IntegrationSuite) TestCancelIfNoInstanceType(c *check.C) {
 		c.Check(ctr.RuntimeConstraints.RAM, check.Equals, int64(12000000000))
 		c.Check(ctr.Mounts["/tmp"].Capacity, check.Equals, int64(24000000000))
 		c.Check(ctr.Mounts["/var/spool/cwl"].Capacity, check.Equals, int64(24000000000))
-		return arvados.InstanceType{}, errors.New("no suitable instance type")
+		return nil, errors.New("no suitable instance type")
 	}
 
 	client := arvados.NewClientFromEnv()
@@ -161,3 +205,54 @@ func (suite *IntegrationSuite) waitfor(c *check.C, timeout time.Duration, fn fun
 		time.Sleep(timeout / 1000)
 	}
 }
+
+var _ = check.Suite(&QueueSuite{})
+
+type QueueSuite struct{}
+
+func (*QueueSuite) TestPreemptionFallback(c *check.C) {
+	typeChooser := func(ctr *arvados.Container) ([]arvados.InstanceType, error) {
+		if ctr.SchedulingParameters.Preemptible {
+			return []arvados.InstanceType{{Name: "spot", Preemptible: true}}, nil
+		}
+		return []arvados.InstanceType{{Name: "ondemand"}}, nil
+	}
+	cq := NewQueue(logger(), nil, typeChooser, nil)
+	cq.SetPreemptionFallback(2)
+
+	ctr := arvados.Container{
+		UUID:                 "zzzzz-dz642-000000000000001",
+		State:                arvados.ContainerStateQueued,
+		Priority:             1,
+		SchedulingParameters: arvados.SchedulingParameters{Preemptible: true},
+	}
+	cq.mtx.Lock()
+	cq.addEnt(ctr.UUID, ctr, arvados.ContainerRequest{UUID: "zzzzz-xvhdp-000000000000001"})
+	cq.mtx.Unlock()
+
+	ent, ok := cq.Get(ctr.UUID)
+	c.Assert(ok, check.Equals, true)
+	ents, _ := cq.Entries()
+	c.Check(ents[ctr.UUID].InstanceType.Name, check.Equals, "spot")
+
+	cq.RecordPreemption(ctr.UUID)
+	ents, _ = cq.Entries()
+	c.Check(ents[ctr.UUID].Preemptions, check.Equals, 1)
+	c.Check(ents[ctr.UUID].InstanceType.Name, check.Equals, "spot")
+
+	cq.RecordPreemption(ctr.UUID)
+	ents, _ = cq.Entries()
+	c.Check(ents[ctr.UUID].Preemptions, check.Equals, 2)
+	c.Check(ents[ctr.UUID].InstanceType.Name, check.Equals, "ondemand")
+
+	// A retry container for the same container request starts
+	// out on the non-preemptible type.
+	retry := ent
+	retry.UUID = "zzzzz-dz642-000000000000002"
+	cq.mtx.Lock()
+	cq.addEnt(retry.UUID, retry, arvados.ContainerRequest{UUID: "zzzzz-xvhdp-000000000000001"})
+	cq.mtx.Unlock()
+	ents, _ = cq.Entries()
+	c.Check(ents[retry.UUID].Preemptions, check.Equals, 2)
+	c.Check(ents[retry.UUID].InstanceType.Name, check.Equals, "ondemand")
+}
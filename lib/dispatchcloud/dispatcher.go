@@ -57,9 +57,11 @@ type dispatcher struct {
 	instanceSet cloud.InstanceSet
 	pool        pool
 	queue       scheduler.ContainerQueue
+	sched       *scheduler.Scheduler // nil until run() starts
 	httpHandler http.Handler
 	sshKey      ssh.Signer
 
+	mtx       sync.Mutex // protects sched
 	setupOnce sync.Once
 	stop      chan struct{}
 	stopped   chan struct{}
@@ -107,10 +109,30 @@ func (disp *dispatcher) newExecutor(inst cloud.Instance) worker.Executor {
 	return exr
 }
 
-func (disp *dispatcher) typeChooser(ctr *arvados.Container) (arvados.InstanceType, error) {
+func (disp *dispatcher) typeChooser(ctr *arvados.Container) ([]arvados.InstanceType, error) {
 	return ChooseInstanceType(disp.Cluster, ctr)
 }
 
+// needOwners returns true if the scheduler needs to know the owner
+// (or UUID) of each container's container request, i.e., fair-share
+// scheduling is grouped by project, quotas are configured for any
+// projects, or preemptions are counted toward falling back to
+// non-preemptible instances.
+func (disp *dispatcher) needOwners() bool {
+	if fs := disp.Cluster.Containers.FairShare; fs.Enable && fs.GroupBy == "project" {
+		return true
+	}
+	if disp.Cluster.Containers.CloudVMs.PreemptionFallbackThreshold > 0 {
+		return true
+	}
+	for uuid := range disp.Cluster.Containers.Quotas.Limits {
+		if !strings.Contains(uuid, "-tpzed-") {
+			return true
+		}
+	}
+	return false
+}
+
 func (disp *dispatcher) setup() {
 	disp.initialize()
 	go disp.run()
@@ -144,8 +166,17 @@ func (disp *dispatcher) initialize() {
 		disp.logger.Fatalf("error initializing driver: %s", err)
 	}
 	disp.instanceSet = instanceSet
-	disp.pool = worker.NewPool(disp.logger, disp.ArvClient, disp.Registry, disp.InstanceSetID, disp.instanceSet, disp.newExecutor, disp.sshKey.PublicKey(), disp.Cluster)
-	disp.queue = container.NewQueue(disp.logger, disp.Registry, disp.typeChooser, disp.ArvClient)
+	pool := worker.NewPool(disp.logger, disp.ArvClient, disp.Registry, disp.InstanceSetID, disp.instanceSet, disp.newExecutor, disp.sshKey.PublicKey(), disp.Cluster)
+	pool.EnablePacking(func(ctr *arvados.Container) worker.Resources {
+		return containerResources(disp.Cluster, ctr)
+	})
+	disp.pool = pool
+	queue := container.NewQueue(disp.logger, disp.Registry, disp.typeChooser, disp.ArvClient)
+	if disp.needOwners() {
+		queue.LookupOwners()
+	}
+	queue.SetPreemptionFallback(disp.Cluster.Containers.CloudVMs.PreemptionFallbackThreshold)
+	disp.queue = queue
 
 	if disp.Cluster.ManagementToken == "" {
 		disp.httpHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -160,6 +191,7 @@ func (disp *dispatcher) initialize() {
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/drain", disp.apiInstanceDrain)
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/run", disp.apiInstanceRun)
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/kill", disp.apiInstanceKill)
+		mux.HandlerFunc("GET", "/arvados/v1/dispatch/quotas", disp.apiQuotas)
 		metricsH := promhttp.HandlerFor(disp.Registry, promhttp.HandlerOpts{
 			ErrorLog: disp.logger,
 		})
@@ -188,6 +220,19 @@ func (disp *dispatcher) run() {
 		pollInterval = defaultPollInterval
 	}
 	sched := scheduler.New(disp.Context, disp.queue, disp.pool, disp.Registry, staleLockTimeout, pollInterval)
+	var history func(time.Time) ([]container.QueueEnt, error)
+	if q, ok := disp.queue.(*container.Queue); ok {
+		history = q.FetchHistory
+	}
+	if disp.Cluster.Containers.FairShare.Enable {
+		sched.EnableFairShare(disp.Cluster.Containers.FairShare, history)
+	}
+	if len(disp.Cluster.Containers.Quotas.Limits) > 0 {
+		sched.EnableQuotas(disp.Cluster.Containers.Quotas, history)
+	}
+	disp.mtx.Lock()
+	disp.sched = sched
+	disp.mtx.Unlock()
 	sched.Start()
 	defer sched.Stop()
 
@@ -215,6 +260,20 @@ func (disp *dispatcher) apiInstances(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// Management API: current usage of per-user/project quotas.
+func (disp *dispatcher) apiQuotas(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		Items []scheduler.QuotaUsage `json:"items"`
+	}
+	disp.mtx.Lock()
+	sched := disp.sched
+	disp.mtx.Unlock()
+	if sched != nil {
+		resp.Items = sched.QuotaStatus()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
 // Management API: set idle behavior to "hold" for specified instance.
 func (disp *dispatcher) apiInstanceHold(w http.ResponseWriter, r *http.Request) {
 	disp.apiInstanceIdleBehavior(w, r, worker.IdleBehaviorHold)
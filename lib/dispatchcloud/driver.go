@@ -5,12 +5,15 @@
 package dispatchcloud
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/lib/cloud/azure"
 	"git.arvados.org/arvados.git/lib/cloud/ec2"
+	"git.arvados.org/arvados.git/lib/cloud/gce"
+	"git.arvados.org/arvados.git/lib/cloud/inventory"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -21,8 +24,10 @@ import (
 // Clusters.*.Containers.CloudVMs.Driver configuration values
 // correspond to keys in this map.
 var Drivers = map[string]cloud.Driver{
-	"azure": azure.Driver,
-	"ec2":   ec2.Driver,
+	"azure":     azure.Driver,
+	"ec2":       ec2.Driver,
+	"gce":       gce.Driver,
+	"inventory": inventory.Driver,
 }
 
 func newInstanceSet(cluster *arvados.Cluster, setID cloud.InstanceSetID, logger logrus.FieldLogger, reg *prometheus.Registry) (cloud.InstanceSet, error) {
@@ -30,8 +35,12 @@ func newInstanceSet(cluster *arvados.Cluster, setID cloud.InstanceSetID, logger
 	if !ok {
 		return nil, fmt.Errorf("unsupported cloud driver %q", cluster.Containers.CloudVMs.Driver)
 	}
+	params, err := DriverParameters(cluster)
+	if err != nil {
+		return nil, err
+	}
 	sharedResourceTags := cloud.SharedResourceTags(cluster.Containers.CloudVMs.ResourceTags)
-	is, err := driver.InstanceSet(cluster.Containers.CloudVMs.DriverParameters, setID, sharedResourceTags, logger)
+	is, err := driver.InstanceSet(params, setID, sharedResourceTags, logger)
 	is = newInstrumentedInstanceSet(is, reg)
 	if maxops := cluster.Containers.CloudVMs.MaxCloudOpsPerSecond; maxops > 0 {
 		is = rateLimitedInstanceSet{
@@ -50,6 +59,31 @@ func newInstanceSet(cluster *arvados.Cluster, setID cloud.InstanceSetID, logger
 	return is, err
 }
 
+// DriverParameters returns the configured DriverParameters, with
+// defaults that come from elsewhere in the cluster config filled
+// in. Currently, this means the inventory driver connects to hosts
+// with DispatchPrivateKey unless PrivateKeyFile is configured.
+func DriverParameters(cluster *arvados.Cluster) (json.RawMessage, error) {
+	params := cluster.Containers.CloudVMs.DriverParameters
+	if cluster.Containers.CloudVMs.Driver != "inventory" {
+		return params, nil
+	}
+	var m map[string]interface{}
+	if len(params) > 0 {
+		err := json.Unmarshal(params, &m)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing DriverParameters: %s", err)
+		}
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	if fnm, _ := m["PrivateKeyFile"].(string); fnm == "" {
+		m["PrivateKey"] = cluster.Containers.DispatchPrivateKey
+	}
+	return json.Marshal(m)
+}
+
 type rateLimitedInstanceSet struct {
 	cloud.InstanceSet
 	ticker *time.Ticker
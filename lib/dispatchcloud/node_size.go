@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
 
@@ -96,16 +97,10 @@ func versionLess(vs1 string, vs2 string) (bool, error) {
 	return v1 < v2, nil
 }
 
-// ChooseInstanceType returns the cheapest available
-// arvados.InstanceType big enough to run ctr.
-func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvados.InstanceType, err error) {
-	if len(cc.InstanceTypes) == 0 {
-		err = ErrInstanceTypesNotConfigured
-		return
-	}
-
-	needScratch := EstimateScratchSpace(ctr)
-
+// containerResources returns the amount of each resource a worker
+// needs to have available in order to run ctr, including RAM
+// overhead for crunch-run, arv-mount, and the Docker image.
+func containerResources(cc *arvados.Cluster, ctr *arvados.Container) worker.Resources {
 	needVCPUs := ctr.RuntimeConstraints.VCPUs
 
 	needRAM := ctr.RuntimeConstraints.RAM + ctr.RuntimeConstraints.KeepCacheRAM
@@ -113,31 +108,58 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvad
 	needRAM += int64(cc.Containers.LocalKeepBlobBuffersPerVCPU * needVCPUs * (1 << 26))
 	needRAM = (needRAM * 100) / int64(100-discountConfiguredRAMPercent)
 
-	ok := false
+	return worker.Resources{
+		VCPUs:   needVCPUs,
+		RAM:     needRAM,
+		Scratch: EstimateScratchSpace(ctr),
+		GPUs:    ctr.RuntimeConstraints.CUDA.DeviceCount,
+	}
+}
+
+// ChooseInstanceType returns the arvados.InstanceTypes that are big
+// enough to run ctr, cheapest first. If the cheapest type is
+// unavailable, the caller can fall back to the next one.
+//
+// Types are ranked by instance price even if
+// Containers.CloudVMs.MaxContainersPerInstance is greater than 1.
+// Ranking by price per container would assume the instance will be
+// filled with similar containers, and put a lone container on a
+// large instance. Larger types stay in the list, though, so the
+// scheduler can pack the container onto a running instance of any
+// suitable type.
+//
+// Types that cost more than Containers.MaximumPriceFactor times the
+// cheapest suitable type are not returned.
+func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) ([]arvados.InstanceType, error) {
+	if len(cc.InstanceTypes) == 0 {
+		return nil, ErrInstanceTypesNotConfigured
+	}
+
+	need := containerResources(cc, ctr)
+
+	var types []arvados.InstanceType
+	price := map[string]float64{}
 	for _, it := range cc.InstanceTypes {
 		driverInsuff, driverErr := versionLess(it.CUDA.DriverVersion, ctr.RuntimeConstraints.CUDA.DriverVersion)
 		capabilityInsuff, capabilityErr := versionLess(it.CUDA.HardwareCapability, ctr.RuntimeConstraints.CUDA.HardwareCapability)
 
 		switch {
 		// reasons to reject a node
-		case ok && it.Price > best.Price: // already selected a node, and this one is more expensive
-		case int64(it.Scratch) < needScratch: // insufficient scratch
-		case int64(it.RAM) < needRAM: // insufficient RAM
-		case it.VCPUs < needVCPUs: // insufficient VCPUs
+		case int64(it.Scratch) < need.Scratch: // insufficient scratch
+		case int64(it.RAM) < need.RAM: // insufficient RAM
+		case it.VCPUs < need.VCPUs: // insufficient VCPUs
 		case it.Preemptible != ctr.SchedulingParameters.Preemptible: // wrong preemptable setting
-		case it.Price == best.Price && (it.RAM < best.RAM || it.VCPUs < best.VCPUs): // same price, worse specs
 		case it.CUDA.DeviceCount < ctr.RuntimeConstraints.CUDA.DeviceCount: // insufficient CUDA devices
 		case ctr.RuntimeConstraints.CUDA.DeviceCount > 0 && (driverInsuff || driverErr != nil): // insufficient driver version
 		case ctr.RuntimeConstraints.CUDA.DeviceCount > 0 && (capabilityInsuff || capabilityErr != nil): // insufficient hardware capability
 			// Don't select this node
 		default:
 			// Didn't reject the node, so select it
-			// Lower price || (same price && better specs)
-			best = it
-			ok = true
+			types = append(types, it)
+			price[it.Name] = it.Price
 		}
 	}
-	if !ok {
+	if len(types) == 0 {
 		availableTypes := make([]arvados.InstanceType, 0, len(cc.InstanceTypes))
 		for _, t := range cc.InstanceTypes {
 			availableTypes = append(availableTypes, t)
@@ -145,11 +167,33 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvad
 		sort.Slice(availableTypes, func(a, b int) bool {
 			return availableTypes[a].Price < availableTypes[b].Price
 		})
-		err = ConstraintsNotSatisfiableError{
+		return nil, ConstraintsNotSatisfiableError{
 			errors.New("constraints not satisfiable by any configured instance type"),
 			availableTypes,
 		}
-		return
 	}
-	return
+	sort.Slice(types, func(a, b int) bool {
+		ta, tb := types[a], types[b]
+		switch {
+		case price[ta.Name] != price[tb.Name]:
+			return price[ta.Name] < price[tb.Name]
+		case ta.RAM != tb.RAM:
+			// same price, better specs first
+			return ta.RAM > tb.RAM
+		case ta.VCPUs != tb.VCPUs:
+			return ta.VCPUs > tb.VCPUs
+		default:
+			return ta.Name < tb.Name
+		}
+	})
+	if factor := cc.Containers.MaximumPriceFactor; factor > 0 {
+		maxPrice := price[types[0].Name] * factor
+		for i, it := range types {
+			if price[it.Name] > maxPrice {
+				types = types[:i]
+				break
+			}
+		}
+	}
+	return types, nil
 }
@@ -80,7 +80,7 @@ func (*NodeSizeSuite) TestChoose(c *check.C) {
 			"costly": {Price: 4.4, RAM: 4000000000, VCPUs: 8, Scratch: 2 * GiB, Name: "costly"},
 		},
 	} {
-		best, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu, Containers: arvados.ContainersConfig{ReserveExtraRAM: 268435456}}, &arvados.Container{
+		types, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu, Containers: arvados.ContainersConfig{ReserveExtraRAM: 268435456}}, &arvados.Container{
 			Mounts: map[string]arvados.Mount{
 				"/tmp": {Kind: "tmp", Capacity: 2 * int64(GiB)},
 			},
@@ -90,7 +90,8 @@ func (*NodeSizeSuite) TestChoose(c *check.C) {
 				KeepCacheRAM: 123456789,
 			},
 		})
-		c.Check(err, check.IsNil)
+		c.Assert(err, check.IsNil)
+		best := types[0]
 		c.Check(best.Name, check.Equals, "best")
 		c.Check(best.RAM >= 1234567890, check.Equals, true)
 		c.Check(best.VCPUs >= 2, check.Equals, true)
@@ -105,7 +106,7 @@ func (*NodeSizeSuite) TestChoosePreemptable(c *check.C) {
 		"best":        {Price: 2.2, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Preemptible: true, Name: "best"},
 		"small":       {Price: 1.1, RAM: 1000000000, VCPUs: 2, Scratch: 2 * GiB, Preemptible: true, Name: "small"},
 	}
-	best, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu}, &arvados.Container{
+	types, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu}, &arvados.Container{
 		Mounts: map[string]arvados.Mount{
 			"/tmp": {Kind: "tmp", Capacity: 2 * int64(GiB)},
 		},
@@ -118,7 +119,8 @@ func (*NodeSizeSuite) TestChoosePreemptable(c *check.C) {
 			Preemptible: true,
 		},
 	})
-	c.Check(err, check.IsNil)
+	c.Assert(err, check.IsNil)
+	best := types[0]
 	c.Check(best.Name, check.Equals, "best")
 	c.Check(best.RAM >= 1234567890, check.Equals, true)
 	c.Check(best.VCPUs >= 2, check.Equals, true)
@@ -126,6 +128,72 @@ func (*NodeSizeSuite) TestChoosePreemptable(c *check.C) {
 	c.Check(best.Preemptible, check.Equals, true)
 }
 
+func (*NodeSizeSuite) TestChoosePacking(c *check.C) {
+	menu := map[string]arvados.InstanceType{
+		"small":      {Price: 1.0, RAM: 2000000000, VCPUs: 2, Scratch: 10 * GiB, Name: "small"},
+		"ramlimited": {Price: 2.7, RAM: 4000000000, VCPUs: 16, Scratch: 100 * GiB, Name: "ramlimited"},
+		"big":        {Price: 6.0, RAM: 16000000000, VCPUs: 16, Scratch: 100 * GiB, Name: "big"},
+	}
+	ctr := &arvados.Container{
+		Mounts: map[string]arvados.Mount{
+			"/tmp": {Kind: "tmp", Capacity: int64(GiB)},
+		},
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			VCPUs: 2,
+			RAM:   1000000000,
+		},
+	}
+	// Packing doesn't make a lone container prefer a larger
+	// instance, but larger types are still acceptable so the
+	// container can be packed onto one that is already running.
+	for _, maxContainers := range []int{0, 1, 2, 8} {
+		cc := &arvados.Cluster{InstanceTypes: menu}
+		cc.Containers.CloudVMs.MaxContainersPerInstance = maxContainers
+		types, err := ChooseInstanceType(cc, ctr)
+		c.Assert(err, check.IsNil)
+		var names []string
+		for _, it := range types {
+			names = append(names, it.Name)
+		}
+		c.Check(names, check.DeepEquals, []string{"small", "ramlimited", "big"}, check.Commentf("maxContainers %d", maxContainers))
+	}
+}
+
+func (*NodeSizeSuite) TestChooseRanked(c *check.C) {
+	menu := map[string]arvados.InstanceType{
+		"small":      {Price: 1.1, RAM: 1000000000, VCPUs: 2, Scratch: 2 * GiB, Name: "small"},
+		"goodenough": {Price: 2.2, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "goodenough"},
+		"best":       {Price: 2.2, RAM: 4000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "best"},
+		"next":       {Price: 3.0, RAM: 4000000000, VCPUs: 8, Scratch: 2 * GiB, Name: "next"},
+		"costly":     {Price: 4.4, RAM: 4000000000, VCPUs: 8, Scratch: 2 * GiB, Name: "costly"},
+	}
+	ctr := &arvados.Container{
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			VCPUs: 2,
+			RAM:   1500000000,
+		},
+	}
+	for _, trial := range []struct {
+		maxPriceFactor float64
+		expect         []string
+	}{
+		{0, []string{"best", "goodenough", "next", "costly"}},
+		{1, []string{"best", "goodenough"}},
+		{1.5, []string{"best", "goodenough", "next"}},
+		{2, []string{"best", "goodenough", "next", "costly"}},
+	} {
+		cc := &arvados.Cluster{InstanceTypes: menu}
+		cc.Containers.MaximumPriceFactor = trial.maxPriceFactor
+		types, err := ChooseInstanceType(cc, ctr)
+		c.Assert(err, check.IsNil)
+		var names []string
+		for _, it := range types {
+			names = append(names, it.Name)
+		}
+		c.Check(names, check.DeepEquals, trial.expect, check.Commentf("MaximumPriceFactor %v", trial.maxPriceFactor))
+	}
+}
+
 func (*NodeSizeSuite) TestScratchForDockerImage(c *check.C) {
 	n := EstimateScratchSpace(&arvados.Container{
 		ContainerImage: "d5025c0f29f6eef304a7358afa82a822+342",
@@ -215,7 +283,7 @@ func (*NodeSizeSuite) TestChooseGPU(c *check.C) {
 	}
 
 	for _, tc := range cases {
-		best, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu}, &arvados.Container{
+		types, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu}, &arvados.Container{
 			Mounts: map[string]arvados.Mount{
 				"/tmp": {Kind: "tmp", Capacity: 2 * int64(GiB)},
 			},
@@ -226,9 +294,9 @@ func (*NodeSizeSuite) TestChooseGPU(c *check.C) {
 				CUDA:         tc.CUDA,
 			},
 		})
-		if best.Name != "" {
+		if len(types) > 0 {
 			c.Check(err, check.IsNil)
-			c.Check(best.Name, check.Equals, tc.SelectedInstance)
+			c.Check(types[0].Name, check.Equals, tc.SelectedInstance)
 		} else {
 			c.Check(err, check.Not(check.IsNil))
 		}
@@ -0,0 +1,400 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"math"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// When ordering the queue, each container that is running or about
+// to start is counted as this many hours of additional usage (at
+// its instance type's cost) by its group. This prevents a group with
+// a large backlog from taking all available capacity just because
+// its past usage was low.
+const fairShareStartHours = 1.0
+
+// Groups whose decayed usage falls below this much, and have nothing
+// in the queue, are forgotten.
+const fairShareForgetUsage = 0.001
+
+// When restoring usage at startup, containers that finished more
+// than this many half-lives ago are ignored: their usage would count
+// for less than 1/2^N of its original value.
+const fairShareHistoryHalfLives = 5
+
+// fairShare tracks recent usage by each user (or project) and orders
+// the queue so containers belonging to under-served users start
+// before containers belonging to users who have already used more
+// than their share.
+//
+// Usage is measured in instance-hours weighted by instance price
+// (see fairShareCost), so a container on a large or GPU instance
+// counts for more than one on a small instance.
+//
+// By default, fairShare only changes the order containers are
+// started in. It does not cap any group's usage: when there is spare
+// capacity, it is better to let one group use it than to leave it
+// idle, and when capacity is constrained, the scheduler starts
+// containers in this order and unlocks the ones that don't fit, so
+// an over-served group only gets instances that no under-served
+// group is waiting for. If MaxShareMultiplier is configured, a group
+// whose running containers exceed that multiple of its weighted
+// share is also held back while other groups are waiting (see
+// holdOverShare). Running containers are never stopped to make room.
+// Hard limits are provided by quotas (see arvados.QuotaConfig).
+//
+// A fairShare is not safe for concurrent use. It is only used by the
+// scheduler's runQueue.
+type fairShare struct {
+	groupBy       string
+	halfLife      time.Duration
+	defaultWeight float64
+	weights       map[string]float64
+	maxShare      float64
+
+	// held is the set of container UUIDs that should not be
+	// started during the current scheduling pass, because
+	// their group is over its maximum share.
+	held map[string]bool
+
+	usage     map[string]float64 // decayed cost-weighted hours, keyed by group
+	lastTally time.Time
+
+	// history delivers the containers loaded by loadHistory,
+	// whose usage up to historyT0 is restored by order.
+	history   chan []container.QueueEnt
+	historyT0 time.Time
+
+	mUsage       *prometheus.GaugeVec
+	mUsageShare  *prometheus.GaugeVec
+	mTargetShare *prometheus.GaugeVec
+	mHeld        *prometheus.GaugeVec
+}
+
+func newFairShare(cfg arvados.FairShareConfig, reg *prometheus.Registry) *fairShare {
+	fs := &fairShare{
+		groupBy:       cfg.GroupBy,
+		halfLife:      cfg.UsageHalfLife.Duration(),
+		defaultWeight: cfg.DefaultWeight,
+		weights:       cfg.Weights,
+		maxShare:      cfg.MaxShareMultiplier,
+		usage:         map[string]float64{},
+		held:          map[string]bool{},
+	}
+	if fs.defaultWeight <= 0 {
+		fs.defaultWeight = 1
+	}
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	fs.mUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "fair_share_usage",
+		Help:      "Recent usage (decayed instance-hours, weighted by instance price) by each user or project.",
+	}, []string{"group"})
+	reg.MustRegister(fs.mUsage)
+	fs.mUsageShare = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "fair_share_usage_fraction",
+		Help:      "Fraction of recent VM usage attributed to each user or project.",
+	}, []string{"group"})
+	reg.MustRegister(fs.mUsageShare)
+	fs.mTargetShare = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "fair_share_target_fraction",
+		Help:      "Fraction of VM usage each active user or project is entitled to, according to configured weights.",
+	}, []string{"group"})
+	reg.MustRegister(fs.mTargetShare)
+	fs.mHeld = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "fair_share_held_containers",
+		Help:      "Number of queued containers not being started because their user or project is over its maximum share.",
+	}, []string{"group"})
+	reg.MustRegister(fs.mHeld)
+	return fs
+}
+
+// group returns the user or project UUID that the given container's
+// usage is attributed to.
+func (fs *fairShare) group(ent container.QueueEnt) string {
+	if fs.groupBy == "project" {
+		return ent.OwnerUUID
+	}
+	return ent.Container.RuntimeUserUUID
+}
+
+// fairShareCost returns the hourly cost of running an instance of
+// the given type, for the purpose of tracking usage: its price, or
+// (if no price is configured) its number of VCPUs.
+func fairShareCost(it arvados.InstanceType) float64 {
+	if it.Price > 0 {
+		return it.Price
+	} else if it.VCPUs > 0 {
+		return float64(it.VCPUs)
+	}
+	return 1
+}
+
+func (fs *fairShare) weight(group string) float64 {
+	if w, ok := fs.weights[group]; ok && w > 0 {
+		return w
+	}
+	return fs.defaultWeight
+}
+
+// tally decays all past usage according to the time elapsed since
+// the last tally, and adds the usage of running containers, given as
+// the total hourly cost for each group, during that time.
+func (fs *fairShare) tally(now time.Time, running map[string]float64) {
+	if !fs.lastTally.IsZero() && now.After(fs.lastTally) {
+		elapsed := now.Sub(fs.lastTally)
+		decay := 1.0
+		if fs.halfLife > 0 {
+			decay = math.Exp2(-float64(elapsed) / float64(fs.halfLife))
+		}
+		for g := range fs.usage {
+			fs.usage[g] *= decay
+		}
+		for g, cost := range running {
+			fs.usage[g] += cost * elapsed.Hours()
+		}
+	}
+	fs.lastTally = now
+}
+
+// historySince returns the earliest finish time of containers whose
+// usage should be passed to restore.
+func (fs *fairShare) historySince(now time.Time) time.Time {
+	if fs.halfLife <= 0 {
+		// Usage never decays, but we have to stop somewhere.
+		return now.Add(-fairShareHistoryHalfLives * 24 * time.Hour)
+	}
+	return now.Add(-fairShareHistoryHalfLives * fs.halfLife)
+}
+
+// loadHistory calls fetch (in a separate goroutine) to get the
+// containers that are running or finished recently, so their usage
+// can be restored by the next call to order.
+func (fs *fairShare) loadHistory(logger logrus.FieldLogger, fetch func(since time.Time) ([]container.QueueEnt, error)) {
+	t0 := time.Now()
+	fs.historyT0 = t0
+	fs.history = make(chan []container.QueueEnt, 1)
+	go func() {
+		ents, err := fetch(fs.historySince(t0))
+		if err != nil {
+			logger.WithError(err).Warn("error loading container history, fair-share usage starts from zero")
+			return
+		}
+		logger.WithField("Containers", len(ents)).Info("loaded container history for fair-share usage")
+		fs.history <- ents
+	}()
+}
+
+// restore adds the usage of the given containers, which were running
+// (or had already finished) at time t0, up to t0, decayed as of now.
+// It is used at startup, so usage is not forgotten when the
+// dispatcher restarts. Usage after t0 is counted by tally.
+func (fs *fairShare) restore(t0, now time.Time, ents []container.QueueEnt) {
+	for _, ent := range ents {
+		ctr := ent.Container
+		if ctr.StartedAt == nil {
+			continue
+		}
+		start, finish := *ctr.StartedAt, t0
+		if ctr.FinishedAt != nil && ctr.FinishedAt.Before(t0) {
+			finish = *ctr.FinishedAt
+		}
+		if !start.Before(finish) {
+			continue
+		}
+		var hours float64
+		if fs.halfLife <= 0 {
+			hours = finish.Sub(start).Hours()
+		} else {
+			// Integral of 2^(-age/halfLife) over the
+			// time the container was running.
+			decay := func(t time.Time) float64 {
+				return math.Exp2(-float64(now.Sub(t)) / float64(fs.halfLife))
+			}
+			hours = fs.halfLife.Hours() / math.Ln2 * (decay(finish) - decay(start))
+		}
+		// The instance a finished container ran on is no
+		// longer known, so this uses the type the queue
+		// chose for it.
+		fs.usage[fs.group(ent)] += fairShareCost(ent.InstanceType) * hours
+	}
+}
+
+// order returns the given queue entries (already sorted by priority)
+// in the order they should be started.
+//
+// Entries that are already running come first. Entries that are
+// eligible to run are interleaved so that, at each step, the next
+// container is taken from the group with the lowest projected usage
+// relative to its weight, where projected usage includes
+// fairShareStartHours of usage for each of the group's containers
+// that are running or ordered ahead. Within a group, the original
+// order is preserved.
+//
+// A running container's cost is based on the instance it is
+// actually running on, according to instances, which can be a
+// fallback type rather than the first choice. When several
+// containers share an instance, they share its cost equally.
+// Containers missing from instances are assumed to have an instance
+// of their first-choice type to themselves.
+func (fs *fairShare) order(sorted []container.QueueEnt, running map[string]time.Time, instances map[string]worker.ContainerInstance, now time.Time) []container.QueueEnt {
+	ordered := make([]container.QueueEnt, 0, len(sorted))
+	active := map[string]float64{}
+	queues := map[string][]container.QueueEnt{}
+	var groups []string
+	var idle []container.QueueEnt
+	sharing := map[cloud.InstanceID]int{}
+	for _, inst := range instances {
+		sharing[inst.Instance]++
+	}
+	for _, ent := range sorted {
+		g := fs.group(ent)
+		if _, ok := running[ent.Container.UUID]; ok {
+			if inst, ok := instances[ent.Container.UUID]; ok {
+				active[g] += fairShareCost(inst.InstanceType) / float64(sharing[inst.Instance])
+			} else {
+				active[g] += fairShareCost(ent.InstanceType)
+			}
+			ordered = append(ordered, ent)
+		} else if ent.Container.Priority < 1 {
+			idle = append(idle, ent)
+		} else {
+			if _, ok := queues[g]; !ok {
+				groups = append(groups, g)
+			}
+			queues[g] = append(queues[g], ent)
+		}
+	}
+	fs.tally(now, active)
+	select {
+	case ents := <-fs.history:
+		fs.restore(fs.historyT0, now, ents)
+	default:
+	}
+
+	fs.holdOverShare(active, queues)
+	projected := map[string]float64{}
+	for _, g := range groups {
+		projected[g] = fs.usage[g] + active[g]*fairShareStartHours
+	}
+	for len(groups) > 0 {
+		best := 0
+		for i, g := range groups[1:] {
+			if projected[g]/fs.weight(g) < projected[groups[best]]/fs.weight(groups[best]) {
+				best = i + 1
+			}
+		}
+		g := groups[best]
+		ordered = append(ordered, queues[g][0])
+		projected[g] += fairShareCost(queues[g][0].InstanceType) * fairShareStartHours
+		queues[g] = queues[g][1:]
+		if len(queues[g]) == 0 {
+			groups = append(groups[:best], groups[best+1:]...)
+		}
+	}
+	ordered = append(ordered, idle...)
+
+	fs.updateMetrics(sorted)
+	return ordered
+}
+
+// holdOverShare updates held, given the hourly cost of each group's
+// running containers and each group's queued containers.
+//
+// A group is over its maximum share if its running containers
+// account for more than maxShare times its weighted share of the
+// total cost of running containers, where each group's weighted
+// share is its weight divided by the total weight of all groups with
+// running or queued containers. The queued containers of groups that
+// are over their maximum share are held, unless no other group has
+// containers waiting, in which case holding them would only leave
+// capacity idle.
+func (fs *fairShare) holdOverShare(active map[string]float64, queues map[string][]container.QueueEnt) {
+	fs.held = map[string]bool{}
+	fs.mHeld.Reset()
+	if fs.maxShare <= 0 {
+		return
+	}
+	var total, totalWeight float64
+	for g, cost := range active {
+		total += cost
+		totalWeight += fs.weight(g)
+	}
+	for g := range queues {
+		if _, ok := active[g]; !ok {
+			totalWeight += fs.weight(g)
+		}
+	}
+	if total <= 0 {
+		return
+	}
+	var over []string
+	waiting := false
+	for g := range queues {
+		if active[g]/total > fs.maxShare*fs.weight(g)/totalWeight {
+			over = append(over, g)
+		} else {
+			waiting = true
+		}
+	}
+	if !waiting {
+		return
+	}
+	for _, g := range over {
+		for _, ent := range queues[g] {
+			fs.held[ent.Container.UUID] = true
+		}
+		fs.mHeld.WithLabelValues(g).Set(float64(len(queues[g])))
+	}
+}
+
+func (fs *fairShare) updateMetrics(ents []container.QueueEnt) {
+	queued := map[string]bool{}
+	for _, ent := range ents {
+		g := fs.group(ent)
+		queued[g] = true
+		if _, ok := fs.usage[g]; !ok {
+			fs.usage[g] = 0
+		}
+	}
+	var totalUsage, totalWeight float64
+	for g, u := range fs.usage {
+		if u < fairShareForgetUsage && !queued[g] {
+			delete(fs.usage, g)
+			fs.mUsage.DeleteLabelValues(g)
+			fs.mUsageShare.DeleteLabelValues(g)
+			fs.mTargetShare.DeleteLabelValues(g)
+			continue
+		}
+		totalUsage += u
+		totalWeight += fs.weight(g)
+	}
+	for g, u := range fs.usage {
+		fs.mUsage.WithLabelValues(g).Set(u)
+		if totalUsage > 0 {
+			fs.mUsageShare.WithLabelValues(g).Set(u / totalUsage)
+		} else {
+			fs.mUsageShare.WithLabelValues(g).Set(0)
+		}
+		fs.mTargetShare.WithLabelValues(g).Set(fs.weight(g) / totalWeight)
+	}
+}
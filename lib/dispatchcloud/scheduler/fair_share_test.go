@@ -0,0 +1,414 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&FairShareSuite{})
+
+type FairShareSuite struct{}
+
+const (
+	userA = "zzzzz-tpzed-aaaaaaaaaaaaaaa"
+	userB = "zzzzz-tpzed-bbbbbbbbbbbbbbb"
+)
+
+func (*FairShareSuite) TestTally(c *check.C) {
+	fs := newFairShare(arvados.FairShareConfig{UsageHalfLife: arvados.Duration(time.Hour)}, nil)
+	t0 := time.Now()
+	fs.tally(t0, map[string]float64{userA: 100})
+	c.Check(fs.usage, check.HasLen, 0)
+
+	fs.tally(t0.Add(time.Hour), map[string]float64{userA: 2})
+	c.Check(fs.usage[userA], check.Equals, 2.0)
+
+	fs.tally(t0.Add(2*time.Hour), map[string]float64{userB: 1})
+	c.Check(fs.usage[userA], check.Equals, 1.0)
+	c.Check(fs.usage[userB], check.Equals, 1.0)
+}
+
+func (*FairShareSuite) TestCost(c *check.C) {
+	c.Check(fairShareCost(arvados.InstanceType{VCPUs: 4, Price: 0.5}), check.Equals, 0.5)
+	c.Check(fairShareCost(arvados.InstanceType{VCPUs: 4}), check.Equals, 4.0)
+	c.Check(fairShareCost(arvados.InstanceType{}), check.Equals, 1.0)
+}
+
+func (*FairShareSuite) TestRestore(c *check.C) {
+	fs := newFairShare(arvados.FairShareConfig{UsageHalfLife: arvados.Duration(time.Hour)}, nil)
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	ents := []container.QueueEnt{
+		// Ran from 2h ago to 1h ago on a $2/h instance:
+		// 2 * (1/ln2) * (1/2 - 1/4)
+		{
+			Container:    arvados.Container{RuntimeUserUUID: userA, StartedAt: ago(2 * time.Hour), FinishedAt: ago(time.Hour)},
+			InstanceType: arvados.InstanceType{Price: 2},
+		},
+		// Still running since 1h ago on a $1/h instance:
+		// 1 * (1/ln2) * (1 - 1/2)
+		{
+			Container:    arvados.Container{RuntimeUserUUID: userB, StartedAt: ago(time.Hour)},
+			InstanceType: arvados.InstanceType{Price: 1},
+		},
+		// Never started.
+		{
+			Container:    arvados.Container{RuntimeUserUUID: userB},
+			InstanceType: arvados.InstanceType{Price: 1},
+		},
+	}
+	fs.restore(now, now, ents)
+	c.Check(fs.usage[userA], check.Equals, 0.5/math.Ln2)
+	c.Check(fs.usage[userB], check.Equals, 0.5/math.Ln2)
+
+	// History is restored by order(), decayed as of the time
+	// order() is called, and only up to the time the history
+	// was requested.
+	fs = newFairShare(arvados.FairShareConfig{UsageHalfLife: arvados.Duration(time.Hour)}, nil)
+	fs.loadHistory(ctxlog.TestLogger(c), func(since time.Time) ([]container.QueueEnt, error) {
+		c.Check(since.Before(now.Add(-4*time.Hour)), check.Equals, true)
+		return ents[1:2], nil
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	for len(fs.history) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	fs.order(nil, nil, nil, fs.historyT0.Add(time.Hour))
+	c.Check(fs.usage[userB] > 0.5/math.Ln2*0.49, check.Equals, true)
+	c.Check(fs.usage[userB] < 0.5/math.Ln2*0.51, check.Equals, true)
+}
+
+// Usage is weighted by instance price, so a user running one
+// expensive container is behind a user running several cheap ones.
+func (*FairShareSuite) TestOrderByCost(c *check.C) {
+	ent := func(i int, user string, price float64) container.QueueEnt {
+		return container.QueueEnt{
+			Container: arvados.Container{
+				UUID:            test.ContainerUUID(i),
+				RuntimeUserUUID: user,
+				Priority:        1,
+				State:           arvados.ContainerStateQueued,
+			},
+			InstanceType: arvados.InstanceType{Price: price},
+		}
+	}
+	sorted := []container.QueueEnt{
+		ent(1, userA, 8),
+		ent(2, userA, 8),
+		ent(3, userB, 1),
+		ent(4, userB, 1),
+		ent(5, userB, 1),
+	}
+	fs := newFairShare(arvados.FairShareConfig{DefaultWeight: 1}, nil)
+	var uuids []string
+	for _, ent := range fs.order(sorted, nil, nil, time.Now()) {
+		uuids = append(uuids, ent.Container.UUID)
+	}
+	c.Check(uuids, check.DeepEquals, []string{
+		test.ContainerUUID(1),
+		test.ContainerUUID(3),
+		test.ContainerUUID(4),
+		test.ContainerUUID(5),
+		test.ContainerUUID(2),
+	})
+}
+
+// Running containers are charged for the instance they are actually
+// running on, shared with other containers on the same instance.
+func (*FairShareSuite) TestOrderByActualInstance(c *check.C) {
+	ent := func(i int, user string, price float64) container.QueueEnt {
+		return container.QueueEnt{
+			Container: arvados.Container{
+				UUID:            test.ContainerUUID(i),
+				RuntimeUserUUID: user,
+				Priority:        1,
+			},
+			InstanceType: arvados.InstanceType{Price: price},
+		}
+	}
+	sorted := []container.QueueEnt{
+		ent(1, userA, 1),
+		ent(2, userB, 2),
+		ent(3, userA, 1),
+		ent(4, userB, 1),
+	}
+	running := map[string]time.Time{
+		test.ContainerUUID(1): {},
+		test.ContainerUUID(2): {},
+	}
+	for _, trial := range []struct {
+		instances map[string]worker.ContainerInstance
+		expect    []int
+	}{
+		// userA's container is on its first-choice type.
+		{nil, []int{1, 2, 3, 4}},
+		// userA's container fell back to a more expensive
+		// type.
+		{map[string]worker.ContainerInstance{
+			test.ContainerUUID(1): {Instance: "i-1", InstanceType: arvados.InstanceType{Price: 8}},
+		}, []int{1, 2, 4, 3}},
+		// ...but shares that instance with three other
+		// containers.
+		{map[string]worker.ContainerInstance{
+			test.ContainerUUID(1): {Instance: "i-1", InstanceType: arvados.InstanceType{Price: 8}},
+			test.ContainerUUID(5): {Instance: "i-1", InstanceType: arvados.InstanceType{Price: 8}},
+			test.ContainerUUID(6): {Instance: "i-1", InstanceType: arvados.InstanceType{Price: 8}},
+			test.ContainerUUID(7): {Instance: "i-1", InstanceType: arvados.InstanceType{Price: 8}},
+		}, []int{1, 2, 3, 4}},
+	} {
+		fs := newFairShare(arvados.FairShareConfig{DefaultWeight: 1}, nil)
+		var expect []string
+		for _, i := range trial.expect {
+			expect = append(expect, test.ContainerUUID(i))
+		}
+		var uuids []string
+		for _, ent := range fs.order(sorted, running, trial.instances, time.Now()) {
+			uuids = append(uuids, ent.Container.UUID)
+		}
+		c.Check(uuids, check.DeepEquals, expect, check.Commentf("%+v", trial.instances))
+	}
+}
+
+func (*FairShareSuite) TestOrder(c *check.C) {
+	ent := func(i int, user string, priority int64, state arvados.ContainerState) container.QueueEnt {
+		return container.QueueEnt{
+			Container: arvados.Container{
+				UUID:            test.ContainerUUID(i),
+				RuntimeUserUUID: user,
+				Priority:        priority,
+				State:           state,
+			},
+		}
+	}
+	sorted := []container.QueueEnt{
+		ent(1, userA, 10, arvados.ContainerStateQueued),
+		ent(2, userA, 9, arvados.ContainerStateRunning),
+		ent(3, userA, 8, arvados.ContainerStateQueued),
+		ent(4, userB, 2, arvados.ContainerStateQueued),
+		ent(5, userB, 1, arvados.ContainerStateLocked),
+		ent(6, userB, 0, arvados.ContainerStateQueued),
+	}
+	running := map[string]time.Time{test.ContainerUUID(2): {}}
+	uuidsOf := func(ents []container.QueueEnt) (r []string) {
+		for _, ent := range ents {
+			r = append(r, ent.Container.UUID)
+		}
+		return
+	}
+
+	for _, trial := range []struct {
+		usageA  float64
+		weights map[string]float64
+		expect  []int
+	}{
+		// userA's running container counts against its
+		// share, so userB goes first.
+		{0, nil, []int{2, 4, 1, 5, 3, 6}},
+		// userA has used much more than userB.
+		{10, nil, []int{2, 4, 5, 1, 3, 6}},
+		// ...but userA is entitled to 20x as much.
+		{10, map[string]float64{userA: 20}, []int{2, 4, 1, 3, 5, 6}},
+	} {
+		fs := newFairShare(arvados.FairShareConfig{DefaultWeight: 1, Weights: trial.weights}, nil)
+		fs.usage[userA] = trial.usageA
+		var expect []string
+		for _, i := range trial.expect {
+			expect = append(expect, test.ContainerUUID(i))
+		}
+		c.Check(uuidsOf(fs.order(sorted, running, nil, time.Now())), check.DeepEquals, expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (*FairShareSuite) TestGroupByProject(c *check.C) {
+	fs := newFairShare(arvados.FairShareConfig{GroupBy: "project"}, nil)
+	ent := container.QueueEnt{
+		Container: arvados.Container{RuntimeUserUUID: userA},
+		OwnerUUID: "zzzzz-j7d0g-000000000000000",
+	}
+	c.Check(fs.group(ent), check.Equals, "zzzzz-j7d0g-000000000000000")
+	fs = newFairShare(arvados.FairShareConfig{GroupBy: "user"}, nil)
+	c.Check(fs.group(ent), check.Equals, userA)
+}
+
+// When the pool is at quota, the scheduler starts a container
+// belonging to a user with no running containers, even though
+// another user's queued container has higher priority.
+func (*FairShareSuite) TestSchedulerAtQuota(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	ctr := func(i int, user string, priority int64, state arvados.ContainerState) arvados.Container {
+		return arvados.Container{
+			UUID:            test.ContainerUUID(i),
+			RuntimeUserUUID: user,
+			Priority:        priority,
+			State:           state,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 1,
+				RAM:   1 << 30,
+			},
+		}
+	}
+	queue := test.Queue{
+		ChooseType: chooseType,
+		Containers: []arvados.Container{
+			ctr(1, userA, 5, arvados.ContainerStateRunning),
+			ctr(2, userA, 5, arvados.ContainerStateRunning),
+			ctr(3, userA, 5, arvados.ContainerStateLocked),
+			ctr(4, userB, 1, arvados.ContainerStateLocked),
+		},
+	}
+	queue.Update()
+	pool := stubPool{
+		quota: 3,
+		unalloc: map[arvados.InstanceType]int{
+			test.InstanceType(1): 1,
+		},
+		idle: map[arvados.InstanceType]int{
+			test.InstanceType(1): 1,
+		},
+		running: map[string]time.Time{
+			test.ContainerUUID(1): time.Now(),
+			test.ContainerUUID(2): time.Now(),
+		},
+	}
+	reg := prometheus.NewRegistry()
+	sch := New(ctx, &queue, &pool, reg, time.Millisecond, time.Millisecond)
+	sch.EnableFairShare(arvados.FairShareConfig{Enable: true, GroupBy: "user", UsageHalfLife: arvados.Duration(time.Hour), DefaultWeight: 1}, nil)
+	sch.runQueue()
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(4)})
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: arvados.ContainerStateLocked, To: arvados.ContainerStateQueued},
+	})
+
+	c.Check(testutil.ToFloat64(sch.fairShare.mTargetShare.WithLabelValues(userA)), check.Equals, 0.5)
+	c.Check(testutil.ToFloat64(sch.fairShare.mTargetShare.WithLabelValues(userB)), check.Equals, 0.5)
+	c.Check(testutil.ToFloat64(sch.fairShare.mUsage.WithLabelValues(userB)), check.Equals, 0.0)
+}
+
+func (*FairShareSuite) TestHoldOverShare(c *check.C) {
+	ent := func(i int, user string, state arvados.ContainerState) container.QueueEnt {
+		return container.QueueEnt{
+			Container: arvados.Container{
+				UUID:            test.ContainerUUID(i),
+				RuntimeUserUUID: user,
+				Priority:        1,
+				State:           state,
+			},
+			InstanceType: arvados.InstanceType{Price: 1},
+		}
+	}
+	running := map[string]time.Time{
+		test.ContainerUUID(1): {},
+		test.ContainerUUID(2): {},
+		test.ContainerUUID(3): {},
+		test.ContainerUUID(4): {},
+	}
+	withB := []container.QueueEnt{
+		ent(1, userA, arvados.ContainerStateRunning),
+		ent(2, userA, arvados.ContainerStateRunning),
+		ent(3, userA, arvados.ContainerStateRunning),
+		ent(4, userB, arvados.ContainerStateRunning),
+		ent(5, userA, arvados.ContainerStateQueued),
+		ent(6, userA, arvados.ContainerStateLocked),
+		ent(7, userB, arvados.ContainerStateQueued),
+	}
+	withoutB := withB[:6]
+	for _, trial := range []struct {
+		sorted   []container.QueueEnt
+		maxShare float64
+		weights  map[string]float64
+		expect   []int
+	}{
+		// No maximum.
+		{withB, 0, nil, nil},
+		// userA is using 75% of the instances, more than
+		// 1.4x its 50% share, while userB is waiting.
+		{withB, 1.4, nil, []int{5, 6}},
+		// 75% is within 1.6x userA's share.
+		{withB, 1.6, nil, nil},
+		// ...and within 1.4x userA's 67% weighted share.
+		{withB, 1.4, map[string]float64{userA: 2}, nil},
+		// Nobody else is waiting.
+		{withoutB, 1.4, nil, nil},
+	} {
+		fs := newFairShare(arvados.FairShareConfig{DefaultWeight: 1, Weights: trial.weights, MaxShareMultiplier: trial.maxShare}, nil)
+		fs.order(trial.sorted, running, nil, time.Now())
+		expect := map[string]bool{}
+		for _, i := range trial.expect {
+			expect[test.ContainerUUID(i)] = true
+		}
+		c.Check(fs.held, check.DeepEquals, expect, check.Commentf("%+v", trial))
+		c.Check(testutil.ToFloat64(fs.mHeld.WithLabelValues(userA)), check.Equals, float64(len(trial.expect)), check.Commentf("%+v", trial))
+	}
+}
+
+// A user over its maximum share doesn't get idle instances while
+// another user is waiting, and its locked containers are unlocked.
+func (*FairShareSuite) TestSchedulerHoldOverShare(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	ctr := func(i int, user string, priority int64, state arvados.ContainerState) arvados.Container {
+		return arvados.Container{
+			UUID:            test.ContainerUUID(i),
+			RuntimeUserUUID: user,
+			Priority:        priority,
+			State:           state,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 1,
+				RAM:   1 << 30,
+			},
+		}
+	}
+	queue := test.Queue{
+		ChooseType: chooseType,
+		Containers: []arvados.Container{
+			ctr(1, userA, 5, arvados.ContainerStateRunning),
+			ctr(2, userA, 5, arvados.ContainerStateRunning),
+			ctr(3, userA, 5, arvados.ContainerStateRunning),
+			ctr(4, userB, 1, arvados.ContainerStateRunning),
+			ctr(5, userA, 5, arvados.ContainerStateLocked),
+			ctr(6, userA, 5, arvados.ContainerStateQueued),
+			ctr(7, userB, 1, arvados.ContainerStateLocked),
+		},
+	}
+	queue.Update()
+	pool := stubPool{
+		quota: 10,
+		unalloc: map[arvados.InstanceType]int{
+			test.InstanceType(1): 3,
+		},
+		idle: map[arvados.InstanceType]int{
+			test.InstanceType(1): 3,
+		},
+		running: map[string]time.Time{
+			test.ContainerUUID(1): time.Now(),
+			test.ContainerUUID(2): time.Now(),
+			test.ContainerUUID(3): time.Now(),
+			test.ContainerUUID(4): time.Now(),
+		},
+	}
+	reg := prometheus.NewRegistry()
+	sch := New(ctx, &queue, &pool, reg, time.Millisecond, time.Millisecond)
+	sch.EnableFairShare(arvados.FairShareConfig{Enable: true, GroupBy: "user", UsageHalfLife: arvados.Duration(time.Hour), DefaultWeight: 1, MaxShareMultiplier: 1.4}, nil)
+	sch.runQueue()
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(7)})
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(5), From: arvados.ContainerStateLocked, To: arvados.ContainerStateQueued},
+	})
+	c.Check(testutil.ToFloat64(sch.fairShare.mHeld.WithLabelValues(userA)), check.Equals, 2.0)
+}
@@ -20,6 +20,8 @@ type ContainerQueue interface {
 	Lock(uuid string) error
 	Unlock(uuid string) error
 	Cancel(uuid string) error
+	UpdateRuntimeStatus(uuid string, update map[string]string) error
+	RecordPreemption(uuid string)
 	Forget(uuid string)
 	Get(uuid string) (arvados.Container, bool)
 	Subscribe() <-chan struct{}
@@ -32,14 +34,18 @@ type ContainerQueue interface {
 // stubs. See worker.Pool method documentation for details.
 type WorkerPool interface {
 	Running() map[string]time.Time
+	ContainerInstances() map[string]worker.ContainerInstance
 	Unallocated() map[arvados.InstanceType]int
 	CountWorkers() map[worker.State]int
 	AtQuota() bool
+	AtCapacity(arvados.InstanceType) bool
 	Create(arvados.InstanceType) bool
 	Shutdown(arvados.InstanceType) bool
 	StartContainer(arvados.InstanceType, arvados.Container) bool
+	Packable(arvados.InstanceType, arvados.Container) bool
 	KillContainer(uuid, reason string) bool
 	ForgetContainer(uuid string)
+	Preempted(uuid string) (string, bool)
 	Subscribe() <-chan struct{}
 	Unsubscribe(<-chan struct{})
 }
@@ -0,0 +1,403 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Number of buckets used to track spend during the configured
+// SpendPeriod.
+const quotaSpendBuckets = 96
+
+// QuotaUsage reports the current usage and limits of a user or
+// project that has a configured quota.
+type QuotaUsage struct {
+	UUID         string  `json:"uuid"`
+	Instances    int     `json:"instances"`
+	VCPUs        int     `json:"vcpus"`
+	Spend        float64 `json:"spend"`
+	MaxInstances int     `json:"max_instances"`
+	MaxVCPUs     int     `json:"max_vcpus"`
+	MaxSpend     float64 `json:"max_spend"`
+	// Number of containers waiting because this quota is
+	// exhausted.
+	Waiting int `json:"waiting"`
+	// Reason each waiting container cannot start, keyed by
+	// container UUID.
+	WaitingContainers map[string]string `json:"waiting_containers,omitempty"`
+}
+
+// quotaTracker enforces per-user and per-project limits on
+// concurrent instances, VCPUs, and recent spend (see
+// arvados.QuotaConfig).
+//
+// During each scheduling pass, the scheduler calls begin, then
+// exceeded and allocate for each container it considers starting,
+// then end. Containers that would exceed a quota are left in the
+// queue; the reason is reported by status and metrics.
+type quotaTracker struct {
+	limits      map[string]arvados.QuotaLimits
+	spendPeriod time.Duration
+
+	mtx       sync.Mutex
+	usage     map[string]*QuotaUsage
+	spend     map[string]*spendWindow
+	lastTally time.Time
+
+	// history delivers the containers loaded by loadHistory,
+	// whose spend up to historyT0 is restored by begin.
+	history   chan []container.QueueEnt
+	historyT0 time.Time
+
+	mUsage   *prometheus.GaugeVec
+	mLimit   *prometheus.GaugeVec
+	mWaiting *prometheus.GaugeVec
+}
+
+func newQuotaTracker(cfg arvados.QuotaConfig, reg *prometheus.Registry) *quotaTracker {
+	qt := &quotaTracker{
+		limits:      cfg.Limits,
+		spendPeriod: cfg.SpendPeriod.Duration(),
+		usage:       map[string]*QuotaUsage{},
+		spend:       map[string]*spendWindow{},
+	}
+	if qt.spendPeriod <= 0 {
+		qt.spendPeriod = 24 * time.Hour
+	}
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	qt.mUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "quota_usage",
+		Help:      "Current usage of each user/project quota (resource is instances, vcpus, or spend).",
+	}, []string{"quota", "resource"})
+	reg.MustRegister(qt.mUsage)
+	qt.mLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "quota_limit",
+		Help:      "Configured limit of each user/project quota (resource is instances, vcpus, or spend).",
+	}, []string{"quota", "resource"})
+	reg.MustRegister(qt.mLimit)
+	qt.mWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "quota_waiting_containers",
+		Help:      "Number of containers waiting because a user/project quota is exhausted.",
+	}, []string{"quota"})
+	reg.MustRegister(qt.mWaiting)
+	for uuid, lim := range qt.limits {
+		qt.mLimit.WithLabelValues(uuid, "instances").Set(float64(lim.MaxInstances))
+		qt.mLimit.WithLabelValues(uuid, "vcpus").Set(float64(lim.MaxVCPUs))
+		qt.mLimit.WithLabelValues(uuid, "spend").Set(lim.MaxSpend)
+	}
+	return qt
+}
+
+// keys returns the UUIDs of the quotas that apply to the given
+// container.
+func (qt *quotaTracker) keys(ent container.QueueEnt) []string {
+	var keys []string
+	for _, uuid := range []string{ent.Container.RuntimeUserUUID, ent.OwnerUUID} {
+		if _, ok := qt.limits[uuid]; ok && uuid != "" {
+			keys = append(keys, uuid)
+		}
+	}
+	if len(keys) == 2 && keys[0] == keys[1] {
+		keys = keys[:1]
+	}
+	return keys
+}
+
+// loadHistory calls fetch (in a separate goroutine) to get the
+// containers that are running or finished during the last
+// SpendPeriod, so their spend can be restored by the next call to
+// begin.
+func (qt *quotaTracker) loadHistory(logger logrus.FieldLogger, fetch func(since time.Time) ([]container.QueueEnt, error)) {
+	t0 := time.Now()
+	qt.historyT0 = t0
+	qt.history = make(chan []container.QueueEnt, 1)
+	go func() {
+		ents, err := fetch(t0.Add(-qt.spendPeriod))
+		if err != nil {
+			logger.WithError(err).Warn("error loading container history, quota spend starts from zero")
+			return
+		}
+		logger.WithField("Containers", len(ents)).Info("loaded container history for quota spend")
+		qt.history <- ents
+	}()
+}
+
+// restore adds the spend of the given containers, which were running
+// (or had already finished) at time t0, during the SpendPeriod before
+// t0. It is used at startup, so spend is not forgotten when the
+// dispatcher restarts. Spend after t0 is counted by begin.
+//
+// The instance a finished container ran on is no longer known, so
+// this uses the type the queue chose for it, and containers that
+// shared an instance are each charged for a whole one.
+//
+// Caller must have lock.
+func (qt *quotaTracker) restore(t0 time.Time, ents []container.QueueEnt) {
+	bucketSize := qt.spendPeriod / quotaSpendBuckets
+	windowStart := t0.Add(-qt.spendPeriod)
+	restored := map[string][]spendBucket{}
+	for _, ent := range ents {
+		ctr := ent.Container
+		keys := qt.keys(ent)
+		if ctr.StartedAt == nil || len(keys) == 0 {
+			continue
+		}
+		start, finish := *ctr.StartedAt, t0
+		if ctr.FinishedAt != nil && ctr.FinishedAt.Before(t0) {
+			finish = *ctr.FinishedAt
+		}
+		if start.Before(windowStart) {
+			start = windowStart
+		}
+		// Charge each bucket for the part of [start, finish)
+		// that falls in it.
+		for i := int(start.Sub(windowStart) / bucketSize); i < quotaSpendBuckets; i++ {
+			bstart := windowStart.Add(time.Duration(i) * bucketSize)
+			bend := bstart.Add(bucketSize)
+			from, to := start, finish
+			if from.Before(bstart) {
+				from = bstart
+			}
+			if to.After(bend) {
+				to = bend
+			}
+			if !from.Before(to) {
+				break
+			}
+			amount := ent.InstanceType.Price * to.Sub(from).Hours()
+			for _, uuid := range keys {
+				if restored[uuid] == nil {
+					restored[uuid] = make([]spendBucket, quotaSpendBuckets)
+				}
+				// Like the buckets filled by begin,
+				// label each with the end of the time
+				// it covers.
+				restored[uuid][i].start = bend
+				restored[uuid][i].amount += amount
+			}
+		}
+	}
+	for uuid, buckets := range restored {
+		var old []spendBucket
+		for _, b := range buckets {
+			if b.amount > 0 {
+				old = append(old, b)
+			}
+		}
+		sw := qt.spend[uuid]
+		if sw == nil {
+			sw = &spendWindow{}
+			qt.spend[uuid] = sw
+		}
+		// Spend recorded since t0 is newer than anything
+		// restored here.
+		sw.buckets = append(old, sw.buckets...)
+	}
+}
+
+// begin starts a scheduling pass. It accrues spend by running
+// instances since the previous pass, and counts the instances and
+// VCPUs currently used by each quota holder.
+//
+// An instance running several of a quota holder's containers (see
+// MaxContainersPerInstance) counts once toward that holder's
+// instance, VCPU, and spend totals. Containers missing from
+// instances are assumed to have an instance of their own.
+func (qt *quotaTracker) begin(now time.Time, ents []container.QueueEnt, running map[string]time.Time, instances map[string]worker.ContainerInstance) {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	var elapsed time.Duration
+	if !qt.lastTally.IsZero() && now.After(qt.lastTally) {
+		elapsed = now.Sub(qt.lastTally)
+	}
+	qt.lastTally = now
+
+	select {
+	case ents := <-qt.history:
+		qt.restore(qt.historyT0, ents)
+	default:
+	}
+
+	qt.usage = map[string]*QuotaUsage{}
+	for uuid, lim := range qt.limits {
+		qt.usage[uuid] = &QuotaUsage{
+			UUID:         uuid,
+			MaxInstances: lim.MaxInstances,
+			MaxVCPUs:     lim.MaxVCPUs,
+			MaxSpend:     lim.MaxSpend,
+		}
+	}
+	counted := map[string]map[cloud.InstanceID]bool{}
+	for _, ent := range ents {
+		if _, ok := running[ent.Container.UUID]; !ok {
+			continue
+		}
+		inst, ok := instances[ent.Container.UUID]
+		if !ok {
+			inst = worker.ContainerInstance{
+				Instance:     cloud.InstanceID(ent.Container.UUID),
+				InstanceType: ent.InstanceType,
+			}
+		}
+		for _, uuid := range qt.keys(ent) {
+			if counted[uuid] == nil {
+				counted[uuid] = map[cloud.InstanceID]bool{}
+			} else if counted[uuid][inst.Instance] {
+				continue
+			}
+			counted[uuid][inst.Instance] = true
+			u := qt.usage[uuid]
+			u.Instances++
+			u.VCPUs += inst.InstanceType.VCPUs
+			if elapsed > 0 {
+				sw := qt.spend[uuid]
+				if sw == nil {
+					sw = &spendWindow{}
+					qt.spend[uuid] = sw
+				}
+				sw.add(now, inst.InstanceType.Price*elapsed.Hours(), qt.spendPeriod/quotaSpendBuckets)
+			}
+		}
+	}
+	for uuid, sw := range qt.spend {
+		if u := qt.usage[uuid]; u != nil {
+			u.Spend = sw.total(now, qt.spendPeriod)
+		} else {
+			// quota was removed from config
+			delete(qt.spend, uuid)
+		}
+	}
+}
+
+// exceeded returns a message explaining why the given container
+// cannot start on an instance of the given type without exceeding a
+// quota, or "" if it can start.
+func (qt *quotaTracker) exceeded(ent container.QueueEnt, it arvados.InstanceType) string {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	for _, uuid := range qt.keys(ent) {
+		u := qt.usage[uuid]
+		var msg string
+		if u.MaxInstances > 0 && u.Instances+1 > u.MaxInstances {
+			msg = fmt.Sprintf("%s has reached its quota of %d concurrent instances", uuid, u.MaxInstances)
+		} else if u.MaxVCPUs > 0 && u.VCPUs+it.VCPUs > u.MaxVCPUs {
+			msg = fmt.Sprintf("starting this container (%d VCPUs) would exceed quota of %d concurrent VCPUs for %s (currently using %d)", it.VCPUs, u.MaxVCPUs, uuid, u.VCPUs)
+		} else if u.MaxSpend > 0 && u.Spend >= u.MaxSpend {
+			msg = fmt.Sprintf("%s has reached its spending quota of %g per %s", uuid, u.MaxSpend, qt.spendPeriod)
+		}
+		if msg != "" {
+			u.Waiting++
+			if u.WaitingContainers == nil {
+				u.WaitingContainers = map[string]string{}
+			}
+			u.WaitingContainers[ent.Container.UUID] = msg
+			return msg
+		}
+	}
+	return ""
+}
+
+// allocate counts an instance of the given type toward the given
+// container's quotas for the rest of the current scheduling pass.
+//
+// exceeded and allocate conservatively assume the container needs a
+// new instance even if it ends up packed onto a busy worker. The
+// next pass's begin corrects the totals.
+func (qt *quotaTracker) allocate(ent container.QueueEnt, it arvados.InstanceType) {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	for _, uuid := range qt.keys(ent) {
+		u := qt.usage[uuid]
+		u.Instances++
+		u.VCPUs += it.VCPUs
+	}
+}
+
+// end finishes a scheduling pass and updates metrics.
+func (qt *quotaTracker) end() {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	for uuid, u := range qt.usage {
+		qt.mUsage.WithLabelValues(uuid, "instances").Set(float64(u.Instances))
+		qt.mUsage.WithLabelValues(uuid, "vcpus").Set(float64(u.VCPUs))
+		qt.mUsage.WithLabelValues(uuid, "spend").Set(u.Spend)
+		qt.mWaiting.WithLabelValues(uuid).Set(float64(u.Waiting))
+	}
+}
+
+// status returns the current usage of each configured quota, sorted
+// by UUID.
+func (qt *quotaTracker) status() []QuotaUsage {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	var status []QuotaUsage
+	for _, u := range qt.usage {
+		u := *u
+		if u.WaitingContainers != nil {
+			waiting := make(map[string]string, len(u.WaitingContainers))
+			for uuid, reason := range u.WaitingContainers {
+				waiting[uuid] = reason
+			}
+			u.WaitingContainers = waiting
+		}
+		status = append(status, u)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].UUID < status[j].UUID
+	})
+	return status
+}
+
+// spendWindow tracks spend during a rolling time window, using a
+// fixed bucket size to limit memory use.
+type spendWindow struct {
+	buckets []spendBucket // oldest first
+}
+
+type spendBucket struct {
+	start  time.Time
+	amount float64
+}
+
+func (sw *spendWindow) add(now time.Time, amount float64, bucketSize time.Duration) {
+	if n := len(sw.buckets); n > 0 && now.Sub(sw.buckets[n-1].start) < bucketSize {
+		sw.buckets[n-1].amount += amount
+		return
+	}
+	sw.buckets = append(sw.buckets, spendBucket{start: now, amount: amount})
+}
+
+// total returns the total spend in buckets that started during the
+// given period, and discards older buckets.
+func (sw *spendWindow) total(now time.Time, period time.Duration) float64 {
+	cutoff := now.Add(-period)
+	for len(sw.buckets) > 0 && !sw.buckets[0].start.After(cutoff) {
+		sw.buckets = sw.buckets[1:]
+	}
+	total := 0.0
+	for _, b := range sw.buckets {
+		total += b.amount
+	}
+	return total
+}
@@ -0,0 +1,296 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&QuotaSuite{})
+
+type QuotaSuite struct{}
+
+const quotaProject = "zzzzz-j7d0g-quotaquotaquota"
+
+func (*QuotaSuite) queue(states ...arvados.ContainerState) *test.Queue {
+	queue := &test.Queue{
+		ChooseType: chooseType,
+		OwnerUUIDs: map[string]string{},
+	}
+	for i, state := range states {
+		uuid := test.ContainerUUID(i + 1)
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:            uuid,
+			RuntimeUserUUID: userA,
+			Priority:        int64(10 - i),
+			State:           state,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 2,
+				RAM:   1 << 30,
+			},
+		})
+		queue.OwnerUUIDs[uuid] = quotaProject
+	}
+	queue.Update()
+	return queue
+}
+
+func (*QuotaSuite) pool(running ...int) *stubPool {
+	pool := &stubPool{
+		quota: 1000,
+		unalloc: map[arvados.InstanceType]int{
+			test.InstanceType(2): 2,
+		},
+		idle: map[arvados.InstanceType]int{
+			test.InstanceType(2): 2,
+		},
+		running: map[string]time.Time{},
+	}
+	for _, i := range running {
+		pool.running[test.ContainerUUID(i)] = time.Now()
+	}
+	return pool
+}
+
+// Containers in a project that is at its instance quota stay in the
+// queue: queued containers are not locked, and locked containers are
+// unlocked. QuotaStatus explains why they are waiting.
+func (s *QuotaSuite) TestMaxInstances(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.queue(arvados.ContainerStateRunning, arvados.ContainerStateLocked, arvados.ContainerStateLocked, arvados.ContainerStateQueued)
+	pool := s.pool(1)
+	sch := New(ctx, queue, pool, nil, time.Millisecond, time.Millisecond)
+	sch.EnableQuotas(arvados.QuotaConfig{
+		Limits: map[string]arvados.QuotaLimits{
+			quotaProject: {MaxInstances: 2},
+		},
+	}, nil)
+	sch.runQueue()
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(2)})
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: "Locked", To: "Queued"},
+	})
+
+	reason := quotaProject + " has reached its quota of 2 concurrent instances"
+	status := sch.QuotaStatus()
+	c.Assert(status, check.HasLen, 1)
+	c.Check(status[0], check.DeepEquals, QuotaUsage{
+		UUID:         quotaProject,
+		Instances:    2,
+		VCPUs:        4,
+		MaxInstances: 2,
+		Waiting:      2,
+		WaitingContainers: map[string]string{
+			test.ContainerUUID(3): reason,
+			test.ContainerUUID(4): reason,
+		},
+	})
+
+	// Subsequent passes leave both containers queued.
+	for i := 0; i < 3; i++ {
+		sch.runQueue()
+	}
+	c.Check(queue.StateChanges(), check.HasLen, 1)
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(2)})
+	c.Check(sch.QuotaStatus()[0].Waiting, check.Equals, 2)
+}
+
+// When the scheduler falls back to a larger instance type than the
+// container's first choice, the larger type counts toward the quota.
+func (s *QuotaSuite) TestChargeStartedType(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.queue(arvados.ContainerStateLocked)
+	queue.ChooseType = func(*arvados.Container) ([]arvados.InstanceType, error) {
+		return []arvados.InstanceType{test.InstanceType(2), test.InstanceType(4)}, nil
+	}
+	queue.Update()
+	pool := s.pool()
+	pool.unalloc = map[arvados.InstanceType]int{test.InstanceType(4): 1}
+	pool.idle = map[arvados.InstanceType]int{test.InstanceType(4): 1}
+	pool.atCapacity = map[arvados.InstanceType]bool{test.InstanceType(2): true}
+	sch := New(ctx, queue, pool, nil, time.Millisecond, time.Millisecond)
+	sch.EnableQuotas(arvados.QuotaConfig{
+		Limits: map[string]arvados.QuotaLimits{
+			userA: {MaxVCPUs: 3},
+		},
+	}, nil)
+	sch.runQueue()
+	c.Check(pool.starts, check.HasLen, 0)
+	c.Check(sch.QuotaStatus()[0].WaitingContainers[test.ContainerUUID(1)], check.Matches, `starting this container \(4 VCPUs\) would exceed quota of 3 .*`)
+
+	// With a 4-VCPU quota, it starts on the fallback type and
+	// uses the whole quota.
+	sch.quota.limits[userA] = arvados.QuotaLimits{MaxVCPUs: 4}
+	queue.Containers[0].State = arvados.ContainerStateLocked
+	queue.Update()
+	sch.runQueue()
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1)})
+	c.Check(sch.QuotaStatus()[0].VCPUs, check.Equals, 4)
+}
+
+// Containers packed onto a single instance count as one instance.
+func (s *QuotaSuite) TestPackedInstances(c *check.C) {
+	qt := newQuotaTracker(arvados.QuotaConfig{
+		Limits: map[string]arvados.QuotaLimits{
+			userA: {MaxInstances: 2},
+		},
+	}, nil)
+	var ents []container.QueueEnt
+	running := map[string]time.Time{}
+	for i := 1; i <= 3; i++ {
+		ents = append(ents, container.QueueEnt{
+			Container:    arvados.Container{UUID: test.ContainerUUID(i), RuntimeUserUUID: userA},
+			InstanceType: test.InstanceType(1),
+		})
+		running[test.ContainerUUID(i)] = time.Time{}
+	}
+	ents = append(ents, container.QueueEnt{
+		Container:    arvados.Container{UUID: test.ContainerUUID(4), RuntimeUserUUID: userA},
+		InstanceType: test.InstanceType(1),
+	})
+	shared := worker.ContainerInstance{Instance: "i-shared", InstanceType: test.InstanceType(4)}
+	qt.begin(time.Now(), ents, running, map[string]worker.ContainerInstance{
+		test.ContainerUUID(1): shared,
+		test.ContainerUUID(2): shared,
+		test.ContainerUUID(3): shared,
+	})
+	c.Check(qt.status()[0].Instances, check.Equals, 1)
+	c.Check(qt.status()[0].VCPUs, check.Equals, 4)
+	c.Check(qt.exceeded(ents[3], test.InstanceType(1)), check.Equals, "")
+}
+
+func (s *QuotaSuite) TestMaxVCPUs(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.queue(arvados.ContainerStateLocked, arvados.ContainerStateLocked)
+	pool := s.pool()
+	reg := prometheus.NewRegistry()
+	sch := New(ctx, queue, pool, reg, time.Millisecond, time.Millisecond)
+	sch.EnableQuotas(arvados.QuotaConfig{
+		Limits: map[string]arvados.QuotaLimits{
+			userA: {MaxVCPUs: 3},
+		},
+	}, nil)
+	sch.runQueue()
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1)})
+	c.Check(testutil.ToFloat64(sch.quota.mUsage.WithLabelValues(userA, "vcpus")), check.Equals, 2.0)
+	c.Check(testutil.ToFloat64(sch.quota.mLimit.WithLabelValues(userA, "vcpus")), check.Equals, 3.0)
+	c.Check(testutil.ToFloat64(sch.quota.mWaiting.WithLabelValues(userA)), check.Equals, 1.0)
+}
+
+// Quotas for other users/projects don't affect scheduling.
+func (s *QuotaSuite) TestUnrelatedQuota(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.queue(arvados.ContainerStateLocked, arvados.ContainerStateLocked)
+	pool := s.pool()
+	sch := New(ctx, queue, pool, nil, time.Millisecond, time.Millisecond)
+	sch.EnableQuotas(arvados.QuotaConfig{
+		Limits: map[string]arvados.QuotaLimits{
+			userB: {MaxInstances: 1},
+		},
+	}, nil)
+	sch.runQueue()
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1), test.ContainerUUID(2)})
+}
+
+func (s *QuotaSuite) TestSpend(c *check.C) {
+	qt := newQuotaTracker(arvados.QuotaConfig{
+		SpendPeriod: arvados.Duration(4 * time.Hour),
+		Limits: map[string]arvados.QuotaLimits{
+			userA: {MaxSpend: 1.5},
+		},
+	}, nil)
+	ents := []container.QueueEnt{
+		{
+			Container:    arvados.Container{UUID: test.ContainerUUID(1), RuntimeUserUUID: userA},
+			InstanceType: arvados.InstanceType{Price: 0.5},
+		},
+		{
+			Container:    arvados.Container{UUID: test.ContainerUUID(2), RuntimeUserUUID: userA},
+			InstanceType: arvados.InstanceType{Price: 0.5},
+		},
+	}
+	running := map[string]time.Time{test.ContainerUUID(1): {}}
+	t0 := time.Now()
+	for i := 0; i <= 2; i++ {
+		qt.begin(t0.Add(time.Duration(i)*time.Hour), ents, running, nil)
+		c.Check(qt.exceeded(ents[1], ents[1].InstanceType), check.Equals, "")
+	}
+	qt.begin(t0.Add(3*time.Hour), ents, running, nil)
+	c.Check(qt.status()[0].Spend, check.Equals, 1.5)
+	c.Check(qt.exceeded(ents[1], ents[1].InstanceType), check.Matches, `.* has reached its spending quota of 1.5 per 4h0m0s`)
+
+	// Spend from more than SpendPeriod ago doesn't count.
+	qt.begin(t0.Add(8*time.Hour), ents, map[string]time.Time{}, nil)
+	c.Check(qt.status()[0].Spend, check.Equals, 0.0)
+	c.Check(qt.exceeded(ents[1], ents[1].InstanceType), check.Equals, "")
+}
+
+// Spend during the SpendPeriod before the dispatcher started is
+// restored from container history.
+func (s *QuotaSuite) TestRestoreSpend(c *check.C) {
+	qt := newQuotaTracker(arvados.QuotaConfig{
+		SpendPeriod: arvados.Duration(4 * time.Hour),
+		Limits: map[string]arvados.QuotaLimits{
+			userA: {MaxSpend: 3},
+			userB: {MaxSpend: 3},
+		},
+	}, nil)
+	t0 := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		t := t0.Add(-d)
+		return &t
+	}
+	it := arvados.InstanceType{Price: 0.5}
+	history := []container.QueueEnt{
+		// Finished 1h ago after running 2h: 1.0
+		{
+			Container:    arvados.Container{UUID: test.ContainerUUID(1), RuntimeUserUUID: userA, StartedAt: ago(3 * time.Hour), FinishedAt: ago(time.Hour)},
+			InstanceType: it,
+		},
+		// Still running, started 10h ago, but only the last
+		// 4h count: 2.0
+		{
+			Container:    arvados.Container{UUID: test.ContainerUUID(2), RuntimeUserUUID: userA, StartedAt: ago(10 * time.Hour)},
+			InstanceType: it,
+		},
+		// Finished before the SpendPeriod: 0
+		{
+			Container:    arvados.Container{UUID: test.ContainerUUID(3), RuntimeUserUUID: userB, StartedAt: ago(7 * time.Hour), FinishedAt: ago(5 * time.Hour)},
+			InstanceType: it,
+		},
+	}
+	var since time.Time
+	qt.loadHistory(ctxlog.TestLogger(c), func(t time.Time) ([]container.QueueEnt, error) {
+		since = t
+		return history, nil
+	})
+	// Wait for loadHistory's goroutine to deliver the history.
+	for deadline := time.Now().Add(time.Second); len(qt.history) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	c.Check(qt.historyT0.Sub(since), check.Equals, 4*time.Hour)
+	qt.historyT0 = t0
+	qt.begin(t0, nil, nil, nil)
+	status := qt.status()
+	c.Assert(status, check.HasLen, 2)
+	c.Check(status[0].UUID, check.Equals, userA)
+	c.Check(math.Round(status[0].Spend*1e6)/1e6, check.Equals, 3.0)
+	c.Check(qt.exceeded(history[1], it), check.Matches, `.* has reached its spending quota of 3 per 4h0m0s`)
+	c.Check(status[1].Spend, check.Equals, 0.0)
+
+	// Restored spend expires at the end of the SpendPeriod.
+	qt.begin(t0.Add(2*time.Hour), nil, nil, nil)
+	c.Check(math.Round(qt.status()[0].Spend*1e6)/1e6, check.Equals, 1.5)
+}
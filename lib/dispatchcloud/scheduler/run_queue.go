@@ -34,6 +34,15 @@ func (sch *Scheduler) runQueue() {
 
 	running := sch.pool.Running()
 	unalloc := sch.pool.Unallocated()
+	instances := sch.pool.ContainerInstances()
+
+	if sch.fairShare != nil {
+		sorted = sch.fairShare.order(sorted, running, instances, time.Now())
+	}
+	if sch.quota != nil {
+		sch.quota.begin(time.Now(), sorted, running, instances)
+		defer sch.quota.end()
+	}
 
 	sch.logger.WithFields(logrus.Fields{
 		"Containers": len(sorted),
@@ -41,35 +50,94 @@ func (sch *Scheduler) runQueue() {
 	}).Debug("runQueue")
 
 	dontstart := map[arvados.InstanceType]bool{}
+	// Instance types for which we have already locked a container
+	// during this pass on the strength of Packable(). Packable
+	// reports current capacity, so relying on it more than once
+	// per pass could lock more containers than will fit. Locked
+	// containers don't pack onto these types either: that would
+	// take the room reserved for the container we just locked.
+	// (StartContainer allocates the packed container's resources
+	// right away, so Locked containers don't need to reserve
+	// anything for each other.)
+	packlocked := map[arvados.InstanceType]bool{}
 	var overquota []container.QueueEnt // entries that are unmappable because of worker pool quota
+	// Locked entries held back by a user/project quota or
+	// fair-share maximum.
+	var held []container.QueueEnt
 	var containerAllocatedWorkerBootingCount int
 
 tryrun:
-	for i, ctr := range sorted {
-		ctr, it := ctr.Container, ctr.InstanceType
+	for i, ent := range sorted {
+		ctr, types := ent.Container, ent.InstanceTypes
 		logger := sch.logger.WithFields(logrus.Fields{
 			"ContainerUUID": ctr.UUID,
-			"InstanceType":  it.Name,
 		})
 		if _, running := running[ctr.UUID]; running || ctr.Priority < 1 {
 			continue
 		}
+		if sch.fairShare != nil && sch.fairShare.held[ctr.UUID] {
+			logger.Debug("not starting: over fair-share maximum")
+			if ctr.State == arvados.ContainerStateLocked {
+				held = append(held, ent)
+			}
+			continue
+		}
+		// Instance types are listed in order of preference, so
+		// each of the following uses the first acceptable type
+		// that meets the condition: an unallocated worker, room
+		// to pack onto a busy worker, or not having recently
+		// failed to create.
+		hasUnalloc := func(it arvados.InstanceType) bool { return unalloc[it] > 0 }
+		creatable := func(it arvados.InstanceType) bool { return !sch.pool.AtCapacity(it) }
 		switch ctr.State {
 		case arvados.ContainerStateQueued:
-			if unalloc[it] < 1 && sch.pool.AtQuota() {
-				logger.Debug("not locking: AtQuota and no unalloc workers")
-				overquota = sorted[i:]
-				break tryrun
+			it, ok := firstType(types, hasUnalloc)
+			packable := false
+			if !ok {
+				it, packable = firstType(types, func(it arvados.InstanceType) bool {
+					return !packlocked[it] && sch.pool.Packable(it, ctr)
+				})
+			}
+			if !ok && !packable {
+				if sch.pool.AtQuota() {
+					logger.Debug("not locking: AtQuota and no unalloc workers")
+					overquota = sorted[i:]
+					break tryrun
+				}
+				if it, ok = firstType(types, creatable); !ok {
+					logger.Debug("not locking: all instance types are at capacity and no unalloc workers")
+					continue
+				}
+			}
+			logger = logger.WithField("InstanceType", it.Name)
+			if sch.overQuota(logger, ent, it) {
+				// Leave it in the queue. The reason
+				// is reported by QuotaStatus.
+				continue
 			}
 			if sch.pool.KillContainer(ctr.UUID, "about to lock") {
 				logger.Info("not locking: crunch-run process from previous attempt has not exited")
 				continue
 			}
 			go sch.lockContainer(logger, ctr.UUID)
-			unalloc[it]--
-		case arvados.ContainerStateLocked:
-			if unalloc[it] > 0 {
+			if packable {
+				packlocked[it] = true
+			} else {
 				unalloc[it]--
+			}
+		case arvados.ContainerStateLocked:
+			it, packable := firstType(types, func(it arvados.InstanceType) bool {
+				return !dontstart[it] && !packlocked[it] && sch.pool.Packable(it, ctr)
+			})
+			var ok, create bool
+			if packable {
+				// There is room for this container on
+				// a worker that is already running
+				// other containers, so it doesn't need
+				// an unallocated worker.
+			} else if it, ok = firstType(types, hasUnalloc); ok {
+				// Use an idle worker (after checking
+				// user/project quotas, below).
 			} else if sch.pool.AtQuota() {
 				// Don't let lower-priority containers
 				// starve this one by using keeping
@@ -78,21 +146,42 @@ tryrun:
 				logger.Trace("overquota")
 				overquota = sorted[i:]
 				break tryrun
-			} else if sch.pool.Create(it) {
+			} else if it, ok = firstType(types, creatable); !ok {
+				// Every acceptable instance type has
+				// failed to create recently. The pool
+				// will notify us when it is willing to
+				// try again.
+				logger.Trace("all instance types are at capacity")
+				continue
+			} else {
+				// Create a new instance (after
+				// checking user/project quotas,
+				// below).
+				create = true
+			}
+			if sch.overQuota(logger.WithField("InstanceType", it.Name), ent, it) {
+				// Unlock it so it doesn't tie up a
+				// lock while waiting.
+				held = append(held, ent)
+				continue
+			}
+			if create {
+				if !sch.pool.Create(it) {
+					// Failed despite not being at
+					// quota, e.g., cloud ops
+					// throttled.
+					logger.WithField("InstanceType", it.Name).Trace("pool declined to create new instance")
+					continue
+				}
 				// Success. (Note pool.Create works
 				// asynchronously and does its own
 				// logging about the eventual outcome,
 				// so we don't need to.)
-				logger.Info("creating new instance")
-			} else {
-				// Failed despite not being at quota,
-				// e.g., cloud ops throttled.  TODO:
-				// avoid getting starved here if
-				// instances of a specific type always
-				// fail.
-				logger.Trace("pool declined to create new instance")
-				continue
+				logger.WithField("InstanceType", it.Name).Info("creating new instance")
+			} else if !packable {
+				unalloc[it]--
 			}
+			logger = logger.WithField("InstanceType", it.Name)
 
 			if dontstart[it] {
 				// We already tried & failed to start
@@ -113,6 +202,15 @@ tryrun:
 	sch.mContainersAllocatedNotStarted.Set(float64(containerAllocatedWorkerBootingCount))
 	sch.mContainersNotAllocatedOverQuota.Set(float64(len(overquota)))
 
+	for _, ent := range held {
+		logger := sch.logger.WithField("ContainerUUID", ent.Container.UUID)
+		logger.Debug("unlock because it is held back by a user/project quota or fair-share maximum")
+		err := sch.queue.Unlock(ent.Container.UUID)
+		if err != nil {
+			logger.WithError(err).Warn("error unlocking")
+		}
+	}
+
 	if len(overquota) > 0 {
 		// Unlock any containers that are unmappable while
 		// we're at quota.
@@ -138,6 +236,33 @@ tryrun:
 	}
 }
 
+// firstType returns the first of the given instance types for which
+// ok returns true.
+func firstType(types []arvados.InstanceType, ok func(arvados.InstanceType) bool) (arvados.InstanceType, bool) {
+	for _, it := range types {
+		if ok(it) {
+			return it, true
+		}
+	}
+	return arvados.InstanceType{}, false
+}
+
+// overQuota returns true if starting the given container on an
+// instance of the given type would exceed a user/project quota.
+// Otherwise, it counts the instance toward the container's quotas
+// and returns false.
+func (sch *Scheduler) overQuota(logger logrus.FieldLogger, ent container.QueueEnt, it arvados.InstanceType) bool {
+	if sch.quota == nil {
+		return false
+	}
+	if reason := sch.quota.exceeded(ent, it); reason != "" {
+		logger.WithField("Reason", reason).Debug("not starting: over quota")
+		return true
+	}
+	sch.quota.allocate(ent, it)
+	return false
+}
+
 // Lock the given container. Should be called in a new goroutine.
 func (sch *Scheduler) lockContainer(logger logrus.FieldLogger, uuid string) {
 	if !sch.uuidLock(uuid, "lock") {
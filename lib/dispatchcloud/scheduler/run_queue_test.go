@@ -6,6 +6,7 @@ package scheduler
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -36,16 +37,20 @@ type stubQuotaError struct {
 func (stubQuotaError) IsQuotaError() bool { return true }
 
 type stubPool struct {
-	notify    <-chan struct{}
-	unalloc   map[arvados.InstanceType]int // idle+booting+unknown
-	idle      map[arvados.InstanceType]int
-	unknown   map[arvados.InstanceType]int
-	running   map[string]time.Time
-	quota     int
-	canCreate int
-	creates   []arvados.InstanceType
-	starts    []string
-	shutdowns int
+	notify     <-chan struct{}
+	unalloc    map[arvados.InstanceType]int // idle+booting+unknown
+	idle       map[arvados.InstanceType]int
+	unknown    map[arvados.InstanceType]int
+	packable   map[arvados.InstanceType]int // room for more containers on running workers
+	atCapacity map[arvados.InstanceType]bool
+	preempted  map[string]string // container UUID => reason
+	running    map[string]time.Time
+	instances  map[string]worker.ContainerInstance // container UUID => instance (default: one instance per container)
+	quota      int
+	canCreate  int
+	creates    []arvados.InstanceType
+	starts     []string
+	shutdowns  int
 	sync.Mutex
 }
 
@@ -54,6 +59,11 @@ func (p *stubPool) AtQuota() bool {
 	defer p.Unlock()
 	return len(p.unalloc)+len(p.running)+len(p.unknown) >= p.quota
 }
+func (p *stubPool) AtCapacity(it arvados.InstanceType) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.atCapacity[it]
+}
 func (p *stubPool) Subscribe() <-chan struct{}  { return p.notify }
 func (p *stubPool) Unsubscribe(<-chan struct{}) {}
 func (p *stubPool) Running() map[string]time.Time {
@@ -65,6 +75,15 @@ func (p *stubPool) Running() map[string]time.Time {
 	}
 	return r
 }
+func (p *stubPool) ContainerInstances() map[string]worker.ContainerInstance {
+	p.Lock()
+	defer p.Unlock()
+	r := map[string]worker.ContainerInstance{}
+	for k, v := range p.instances {
+		r[k] = v
+	}
+	return r
+}
 func (p *stubPool) Unallocated() map[arvados.InstanceType]int {
 	p.Lock()
 	defer p.Unlock()
@@ -77,6 +96,9 @@ func (p *stubPool) Unallocated() map[arvados.InstanceType]int {
 func (p *stubPool) Create(it arvados.InstanceType) bool {
 	p.Lock()
 	defer p.Unlock()
+	if p.atCapacity[it] {
+		return false
+	}
 	p.creates = append(p.creates, it)
 	if p.canCreate < 1 {
 		return false
@@ -86,6 +108,15 @@ func (p *stubPool) Create(it arvados.InstanceType) bool {
 	return true
 }
 func (p *stubPool) ForgetContainer(uuid string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.preempted, uuid)
+}
+func (p *stubPool) Preempted(uuid string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	reason, ok := p.preempted[uuid]
+	return reason, ok
 }
 func (p *stubPool) KillContainer(uuid, reason string) bool {
 	p.Lock()
@@ -108,10 +139,20 @@ func (p *stubPool) CountWorkers() map[worker.State]int {
 		worker.StateUnknown: len(p.unknown),
 	}
 }
+func (p *stubPool) Packable(it arvados.InstanceType, ctr arvados.Container) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.packable[it] > 0
+}
 func (p *stubPool) StartContainer(it arvados.InstanceType, ctr arvados.Container) bool {
 	p.Lock()
 	defer p.Unlock()
 	p.starts = append(p.starts, ctr.UUID)
+	if p.packable[it] > 0 {
+		p.packable[it]--
+		p.running[ctr.UUID] = time.Time{}
+		return true
+	}
 	if p.idle[it] == 0 {
 		return false
 	}
@@ -121,8 +162,8 @@ func (p *stubPool) StartContainer(it arvados.InstanceType, ctr arvados.Container
 	return true
 }
 
-func chooseType(ctr *arvados.Container) (arvados.InstanceType, error) {
-	return test.InstanceType(ctr.RuntimeConstraints.VCPUs), nil
+func chooseType(ctr *arvados.Container) ([]arvados.InstanceType, error) {
+	return []arvados.InstanceType{test.InstanceType(ctr.RuntimeConstraints.VCPUs)}, nil
 }
 
 var _ = check.Suite(&SchedulerSuite{})
@@ -533,3 +574,228 @@ func (*SchedulerSuite) TestContainersMetrics(c *check.C) {
 
 	c.Check(int(testutil.ToFloat64(sch.mLongestWaitTimeSinceQueue)), check.Equals, 0)
 }
+
+// Start locked containers on running workers that have room for
+// them, even when the pool is at quota.
+func (*SchedulerSuite) TestPackLocked(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := test.Queue{
+		ChooseType: chooseType,
+	}
+	for i := 1; i <= 3; i++ {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i),
+			Priority: int64(10 - i),
+			State:    arvados.ContainerStateLocked,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 2,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	queue.Update()
+	pool := stubPool{
+		quota:   1,
+		unalloc: map[arvados.InstanceType]int{},
+		idle:    map[arvados.InstanceType]int{},
+		packable: map[arvados.InstanceType]int{
+			test.InstanceType(2): 2,
+		},
+		running: map[string]time.Time{
+			test.ContainerUUID(9): time.Now(),
+		},
+	}
+	sch := New(ctx, &queue, &pool, nil, time.Millisecond, time.Millisecond)
+	sch.runQueue()
+	c.Check(pool.creates, check.HasLen, 0)
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1), test.ContainerUUID(2)})
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: "Locked", To: "Queued"},
+	})
+}
+
+// When the pool is at quota, lock at most one queued container per
+// pass on the strength of room on running workers.
+func (*SchedulerSuite) TestPackQueued(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := test.Queue{
+		ChooseType: chooseType,
+	}
+	for i := 1; i <= 2; i++ {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i),
+			Priority: int64(10 - i),
+			State:    arvados.ContainerStateQueued,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 2,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	queue.Update()
+	pool := stubPool{
+		quota:   1,
+		unalloc: map[arvados.InstanceType]int{},
+		idle:    map[arvados.InstanceType]int{},
+		packable: map[arvados.InstanceType]int{
+			test.InstanceType(2): 2,
+		},
+		running: map[string]time.Time{
+			test.ContainerUUID(9): time.Now(),
+		},
+	}
+	sch := New(ctx, &queue, &pool, nil, time.Millisecond, time.Millisecond)
+	sch.runQueue()
+	for deadline := time.Now().Add(time.Second); len(queue.StateChanges()) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(1), From: "Queued", To: "Locked"},
+	})
+	c.Check(pool.starts, check.HasLen, 0)
+}
+
+// A lower-priority locked container doesn't take the room on a
+// running worker that a queued container was just locked for.
+func (*SchedulerSuite) TestPackQueuedThenLocked(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := test.Queue{
+		ChooseType: chooseType,
+	}
+	for i, state := range []arvados.ContainerState{
+		arvados.ContainerStateQueued,
+		arvados.ContainerStateLocked,
+	} {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i + 1),
+			Priority: int64(10 - i),
+			State:    state,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 2,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	queue.Update()
+	pool := stubPool{
+		quota:   1,
+		unalloc: map[arvados.InstanceType]int{},
+		idle:    map[arvados.InstanceType]int{},
+		packable: map[arvados.InstanceType]int{
+			test.InstanceType(2): 1,
+		},
+		running: map[string]time.Time{
+			test.ContainerUUID(9): time.Now(),
+		},
+	}
+	sch := New(ctx, &queue, &pool, nil, time.Millisecond, time.Millisecond)
+	sch.runQueue()
+	c.Check(pool.starts, check.HasLen, 0)
+	for deadline := time.Now().Add(time.Second); len(queue.StateChanges()) < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	changes := append([]test.QueueStateChange(nil), queue.StateChanges()...)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].UUID < changes[j].UUID })
+	c.Check(changes, check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(1), From: "Queued", To: "Locked"},
+		{UUID: test.ContainerUUID(2), From: "Locked", To: "Queued"},
+	})
+}
+
+// If the preferred instance type is at capacity, use an idle worker
+// of another acceptable type, or create one.
+func (*SchedulerSuite) TestFallbackToNextInstanceType(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := test.Queue{
+		ChooseType: func(*arvados.Container) ([]arvados.InstanceType, error) {
+			return []arvados.InstanceType{test.InstanceType(2), test.InstanceType(4)}, nil
+		},
+	}
+	for i, state := range []arvados.ContainerState{
+		arvados.ContainerStateLocked,
+		arvados.ContainerStateLocked,
+		arvados.ContainerStateQueued,
+	} {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i + 1),
+			Priority: int64(10 - i),
+			State:    state,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 2,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	queue.Update()
+	pool := stubPool{
+		quota:     1000,
+		canCreate: 2,
+		atCapacity: map[arvados.InstanceType]bool{
+			test.InstanceType(2): true,
+		},
+		unalloc: map[arvados.InstanceType]int{
+			test.InstanceType(4): 1,
+		},
+		idle: map[arvados.InstanceType]int{
+			test.InstanceType(4): 1,
+		},
+		running: map[string]time.Time{},
+	}
+	sch := New(ctx, &queue, &pool, nil, time.Millisecond, time.Millisecond)
+	sch.runQueue()
+	c.Check(pool.creates, check.DeepEquals, []arvados.InstanceType{test.InstanceType(4)})
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1), test.ContainerUUID(2)})
+	c.Check(pool.running, check.HasLen, 1)
+	for deadline := time.Now().Add(time.Second); len(queue.StateChanges()) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: "Queued", To: "Locked"},
+	})
+}
+
+// If every acceptable instance type is at capacity, don't create
+// instances or lock containers, but don't give up on lower-priority
+// containers that can use other instance types.
+func (*SchedulerSuite) TestAllInstanceTypesAtCapacity(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := test.Queue{
+		ChooseType: chooseType,
+	}
+	for i, state := range []arvados.ContainerState{
+		arvados.ContainerStateLocked,
+		arvados.ContainerStateQueued,
+		arvados.ContainerStateQueued,
+	} {
+		vcpus := 2
+		if i == 2 {
+			vcpus = 1
+		}
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i + 1),
+			Priority: int64(10 - i),
+			State:    state,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: vcpus,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	queue.Update()
+	pool := stubPool{
+		quota:     1000,
+		canCreate: 1,
+		atCapacity: map[arvados.InstanceType]bool{
+			test.InstanceType(2): true,
+		},
+		unalloc: map[arvados.InstanceType]int{},
+		idle:    map[arvados.InstanceType]int{},
+		running: map[string]time.Time{},
+	}
+	sch := New(ctx, &queue, &pool, nil, time.Millisecond, time.Millisecond)
+	sch.runQueue()
+	c.Check(pool.creates, check.HasLen, 0)
+	c.Check(pool.starts, check.HasLen, 0)
+	for deadline := time.Now().Add(time.Second); len(queue.StateChanges()) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: "Queued", To: "Locked"},
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"github.com/prometheus/client_golang/prometheus"
@@ -36,6 +37,8 @@ type Scheduler struct {
 	reg                 *prometheus.Registry
 	staleLockTimeout    time.Duration
 	queueUpdateInterval time.Duration
+	fairShare           *fairShare
+	quota               *quotaTracker
 
 	uuidOp map[string]string // operation in progress: "lock", "cancel", ...
 	mtx    sync.Mutex
@@ -71,6 +74,43 @@ func New(ctx context.Context, queue ContainerQueue, pool WorkerPool, reg *promet
 	return sch
 }
 
+// EnableFairShare configures the scheduler to start containers in
+// fair-share order (see arvados.FairShareConfig) rather than strict
+// priority order. It must be called before Start.
+//
+// If history is not nil, it is used to load the containers that are
+// running or finished recently, so usage from before the scheduler
+// started is taken into account. See (*container.Queue)FetchHistory.
+func (sch *Scheduler) EnableFairShare(cfg arvados.FairShareConfig, history func(since time.Time) ([]container.QueueEnt, error)) {
+	sch.fairShare = newFairShare(cfg, sch.reg)
+	if history != nil {
+		sch.fairShare.loadHistory(sch.logger, history)
+	}
+}
+
+// EnableQuotas configures the scheduler to enforce the given
+// per-user and per-project quotas. It must be called before Start.
+//
+// If history is not nil, it is used to load the containers that are
+// running or finished during the last SpendPeriod, so spend from
+// before the scheduler started counts toward MaxSpend. See
+// (*container.Queue)FetchHistory.
+func (sch *Scheduler) EnableQuotas(cfg arvados.QuotaConfig, history func(since time.Time) ([]container.QueueEnt, error)) {
+	sch.quota = newQuotaTracker(cfg, sch.reg)
+	if history != nil {
+		sch.quota.loadHistory(sch.logger, history)
+	}
+}
+
+// QuotaStatus returns the current usage of each configured quota. It
+// returns nil if quotas are not enabled.
+func (sch *Scheduler) QuotaStatus() []QuotaUsage {
+	if sch.quota == nil {
+		return nil
+	}
+	return sch.quota.status()
+}
+
 func (sch *Scheduler) registerMetrics(reg *prometheus.Registry) {
 	if reg == nil {
 		reg = prometheus.NewRegistry()
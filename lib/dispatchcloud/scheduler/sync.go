@@ -25,15 +25,22 @@ var reportedUnexpectedState = false
 //
 // Running containers whose crunch-run processes have exited are
 // cancelled.
+//
+// Locked and running containers whose instances were preempted by
+// the cloud provider are requeued and cancelled, respectively, and
+// the preemption is recorded in the queue.
 func (sch *Scheduler) sync() {
 	anyUnknownWorkers := sch.pool.CountWorkers()[worker.StateUnknown] > 0
 	running := sch.pool.Running()
 	qEntries, qUpdated := sch.queue.Entries()
 	for uuid, ent := range qEntries {
 		exited, running := running[uuid]
+		lost := !running || (!exited.IsZero() && qUpdated.After(exited))
 		switch ent.Container.State {
 		case arvados.ContainerStateRunning:
-			if !running {
+			if reason, preempted := sch.pool.Preempted(uuid); preempted && lost {
+				go sch.cancelPreempted(ent, reason)
+			} else if !running {
 				if !anyUnknownWorkers {
 					go sch.cancel(uuid, "not running on any worker")
 				}
@@ -76,7 +83,9 @@ func (sch *Scheduler) sync() {
 				sch.queue.Forget(uuid)
 			}
 		case arvados.ContainerStateLocked:
-			if running && !exited.IsZero() && qUpdated.After(exited) {
+			if reason, preempted := sch.pool.Preempted(uuid); preempted && lost {
+				go sch.requeuePreempted(ent, reason)
+			} else if running && !exited.IsZero() && qUpdated.After(exited) {
 				go sch.requeue(ent, "crunch-run exited")
 			} else if running && exited.IsZero() && ent.Container.Priority == 0 {
 				go sch.kill(uuid, "priority=0")
@@ -143,3 +152,64 @@ func (sch *Scheduler) requeue(ent container.QueueEnt, reason string) {
 		logger.WithError(err).Error("error requeueing container")
 	}
 }
+
+// cancelPreempted cancels a running container whose instance was
+// preempted, after adding the reason to its runtime_status. Its
+// container request can then retry with a new container, if its
+// container_count_max allows another attempt. Should be called in a
+// new goroutine.
+//
+// Preemption counts (see container.Queue.RecordPreemption) are kept
+// in memory, so a dispatcher restart resets the count toward
+// PreemptionFallbackThreshold.
+func (sch *Scheduler) cancelPreempted(ent container.QueueEnt, reason string) {
+	uuid := ent.Container.UUID
+	if !sch.uuidLock(uuid, "cancel") {
+		return
+	}
+	defer sch.uuidUnlock(uuid)
+	logger := sch.logger.WithFields(logrus.Fields{
+		"ContainerUUID": uuid,
+		"InstanceType":  ent.InstanceType.Name,
+		"Reason":        reason,
+	})
+	logger.Info("cancelling container because its instance was preempted")
+	err := sch.queue.UpdateRuntimeStatus(uuid, map[string]string{
+		"error":       "Cloud instance was preempted",
+		"errorDetail": fmt.Sprintf("The cloud provider reclaimed the %s instance this container was running on (%s).", ent.InstanceType.Name, reason),
+	})
+	if err != nil {
+		logger.WithError(err).Warn("error updating runtime_status")
+	}
+	err = sch.queue.Cancel(uuid)
+	if err != nil {
+		logger.WithError(err).Print("error cancelling container")
+		return
+	}
+	sch.queue.RecordPreemption(uuid)
+	sch.pool.ForgetContainer(uuid)
+}
+
+// requeuePreempted unlocks a locked container whose instance was
+// preempted before the container started running. Should be called
+// in a new goroutine.
+func (sch *Scheduler) requeuePreempted(ent container.QueueEnt, reason string) {
+	uuid := ent.Container.UUID
+	if !sch.uuidLock(uuid, "requeue") {
+		return
+	}
+	defer sch.uuidUnlock(uuid)
+	logger := sch.logger.WithFields(logrus.Fields{
+		"ContainerUUID": uuid,
+		"InstanceType":  ent.InstanceType.Name,
+		"Reason":        reason,
+	})
+	logger.Info("requeueing locked container because its instance was preempted")
+	err := sch.queue.Unlock(uuid)
+	if err != nil {
+		logger.WithError(err).Error("error requeueing container")
+		return
+	}
+	sch.queue.RecordPreemption(uuid)
+	sch.pool.ForgetContainer(uuid)
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"time"
 
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
 	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -116,3 +117,107 @@ func (*SchedulerSuite) TestCancelOrphanedContainers(c *check.C) {
 	}
 	c.Check(ents, check.HasLen, 0)
 }
+
+// Ensure the scheduler cancels a running container, and requeues a
+// locked container, when the pool reports that the instance it was
+// using has been preempted.
+func (*SchedulerSuite) TestPreemptedContainers(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	pool := stubPool{
+		preempted: map[string]string{
+			test.ContainerUUID(1): "preemption probe succeeded",
+			test.ContainerUUID(2): "preemption probe succeeded",
+		},
+	}
+	queue := test.Queue{
+		ChooseType: chooseType,
+		Containers: []arvados.Container{
+			{
+				UUID:     test.ContainerUUID(1),
+				Priority: 1,
+				State:    arvados.ContainerStateRunning,
+				RuntimeConstraints: arvados.RuntimeConstraints{
+					VCPUs: 1,
+					RAM:   1 << 30,
+				},
+				RuntimeStatus: map[string]interface{}{
+					"activity": "running step 3",
+				},
+			},
+			{
+				UUID:     test.ContainerUUID(2),
+				Priority: 1,
+				State:    arvados.ContainerStateLocked,
+				RuntimeConstraints: arvados.RuntimeConstraints{
+					VCPUs: 1,
+					RAM:   1 << 30,
+				},
+			},
+		},
+	}
+	queue.Update()
+
+	sch := New(ctx, &queue, &pool, nil, time.Millisecond, time.Millisecond)
+	sch.sync()
+
+	var ents map[string]container.QueueEnt
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		ents, _ = queue.Entries()
+		if (ents[test.ContainerUUID(1)].Preemptions == 1 &&
+			ents[test.ContainerUUID(2)].Preemptions == 1) ||
+			time.Now().After(deadline) {
+			break
+		}
+	}
+	c.Check(ents[test.ContainerUUID(1)].Preemptions, check.Equals, 1)
+	c.Check(ents[test.ContainerUUID(1)].Container.State, check.Equals, arvados.ContainerStateCancelled)
+	c.Check(ents[test.ContainerUUID(1)].Container.RuntimeStatus["error"], check.Equals, "Cloud instance was preempted")
+	c.Check(ents[test.ContainerUUID(1)].Container.RuntimeStatus["activity"], check.Equals, "running step 3")
+	c.Check(ents[test.ContainerUUID(2)].Preemptions, check.Equals, 1)
+	c.Check(ents[test.ContainerUUID(2)].Container.State, check.Equals, arvados.ContainerStateQueued)
+	c.Check(queue.StateChanges(), check.HasLen, 2)
+
+	_, preempted := pool.Preempted(test.ContainerUUID(1))
+	c.Check(preempted, check.Equals, false)
+	_, preempted = pool.Preempted(test.ContainerUUID(2))
+	c.Check(preempted, check.Equals, false)
+}
+
+// Ensure the scheduler doesn't act on a preemption report while the
+// container's crunch-run process is still running.
+func (*SchedulerSuite) TestPreemptedContainerStillRunning(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	pool := stubPool{
+		preempted: map[string]string{
+			test.ContainerUUID(1): "cloud provider reported preemption",
+		},
+		running: map[string]time.Time{
+			test.ContainerUUID(1): {},
+		},
+	}
+	queue := test.Queue{
+		ChooseType: chooseType,
+		Containers: []arvados.Container{
+			{
+				UUID:     test.ContainerUUID(1),
+				Priority: 1,
+				State:    arvados.ContainerStateRunning,
+				RuntimeConstraints: arvados.RuntimeConstraints{
+					VCPUs: 1,
+					RAM:   1 << 30,
+				},
+			},
+		},
+	}
+	queue.Update()
+
+	sch := New(ctx, &queue, &pool, nil, time.Millisecond, time.Millisecond)
+	for i := 0; i < 10; i++ {
+		sch.sync()
+		time.Sleep(time.Millisecond)
+	}
+	ents, _ := queue.Entries()
+	c.Check(ents[test.ContainerUUID(1)].Container.State, check.Equals, arvados.ContainerStateRunning)
+	c.Check(ents[test.ContainerUUID(1)].Preemptions, check.Equals, 0)
+	c.Check(queue.StateChanges(), check.HasLen, 0)
+}
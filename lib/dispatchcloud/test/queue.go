@@ -22,7 +22,11 @@ type Queue struct {
 
 	// ChooseType will be called for each entry in Containers. It
 	// must not be nil.
-	ChooseType func(*arvados.Container) (arvados.InstanceType, error)
+	ChooseType func(*arvados.Container) ([]arvados.InstanceType, error)
+
+	// OwnerUUIDs, if not nil, is used to populate the OwnerUUID
+	// field of each entry, keyed by container UUID.
+	OwnerUUIDs map[string]string
 
 	Logger logrus.FieldLogger
 
@@ -30,6 +34,7 @@ type Queue struct {
 	updTime      time.Time
 	subscribers  map[<-chan struct{}]chan struct{}
 	stateChanges []QueueStateChange
+	preemptions  map[string]int
 
 	mtx sync.Mutex
 }
@@ -95,6 +100,56 @@ func (q *Queue) Cancel(uuid string) error {
 	return q.changeState(uuid, q.entries[uuid].Container.State, arvados.ContainerStateCancelled)
 }
 
+// UpdateRuntimeStatus sets (or, if the given value is "", deletes)
+// the given keys in the runtime_status of a Locked or Running
+// container.
+func (q *Queue) UpdateRuntimeStatus(uuid string, update map[string]string) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	ent, ok := q.entries[uuid]
+	if !ok {
+		return fmt.Errorf("no such container: %s", uuid)
+	}
+	if ent.Container.State != arvados.ContainerStateLocked && ent.Container.State != arvados.ContainerStateRunning {
+		return fmt.Errorf("cannot set runtime_status: state=%q", ent.Container.State)
+	}
+	rs := map[string]interface{}{}
+	for k, v := range ent.Container.RuntimeStatus {
+		rs[k] = v
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(rs, k)
+		} else {
+			rs[k] = v
+		}
+	}
+	ent.Container.RuntimeStatus = rs
+	q.entries[uuid] = ent
+	for i, ctr := range q.Containers {
+		if ctr.UUID == uuid {
+			q.Containers[i].RuntimeStatus = rs
+		}
+	}
+	return nil
+}
+
+// RecordPreemption increments the Preemptions field of the given
+// container's queue entry. Unlike container.Queue, it does not
+// change the entry's InstanceType.
+func (q *Queue) RecordPreemption(uuid string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.preemptions == nil {
+		q.preemptions = map[string]int{}
+	}
+	q.preemptions[uuid]++
+	if ent, ok := q.entries[uuid]; ok {
+		ent.Preemptions = q.preemptions[uuid]
+		q.entries[uuid] = ent
+	}
+}
+
 func (q *Queue) Subscribe() <-chan struct{} {
 	q.mtx.Lock()
 	defer q.mtx.Unlock()
@@ -156,12 +211,18 @@ func (q *Queue) Update() error {
 			ent.Container = ctr
 			upd[ctr.UUID] = ent
 		} else {
-			it, _ := q.ChooseType(&ctr)
-			upd[ctr.UUID] = container.QueueEnt{
-				Container:    ctr,
-				InstanceType: it,
-				FirstSeenAt:  time.Now(),
+			types, _ := q.ChooseType(&ctr)
+			ent := container.QueueEnt{
+				Container:     ctr,
+				InstanceTypes: types,
+				FirstSeenAt:   time.Now(),
+				OwnerUUID:     q.OwnerUUIDs[ctr.UUID],
+				Preemptions:   q.preemptions[ctr.UUID],
+			}
+			if len(types) > 0 {
+				ent.InstanceType = types[0]
 			}
+			upd[ctr.UUID] = ent
 		}
 	}
 	q.entries = upd
@@ -57,6 +57,13 @@ type StubDriver struct {
 	// called.
 	HoldCloudOps bool
 
+	// Create() returns a CapacityError for instance types whose
+	// names are true in this map.
+	AtCapacity map[string]bool
+
+	// If true, Create() returns a QuotaError.
+	AtQuota bool
+
 	instanceSets []*StubInstanceSet
 	holdCloudOps chan bool
 }
@@ -121,6 +128,12 @@ func (sis *StubInstanceSet) Create(it arvados.InstanceType, image cloud.ImageID,
 		return nil, RateLimitError{sis.allowCreateCall}
 	}
 	sis.allowCreateCall = time.Now().Add(sis.driver.MinTimeBetweenCreateCalls)
+	if sis.driver.AtQuota {
+		return nil, QuotaError{}
+	}
+	if sis.driver.AtCapacity[it.Name] {
+		return nil, CapacityError{it.Name}
+	}
 	ak := sis.driver.AuthorizedKeys
 	if authKey != nil {
 		ak = append([]ssh.PublicKey{authKey}, ak...)
@@ -176,6 +189,16 @@ type RateLimitError struct{ Retry time.Time }
 func (e RateLimitError) Error() string            { return fmt.Sprintf("rate limited until %s", e.Retry) }
 func (e RateLimitError) EarliestRetry() time.Time { return e.Retry }
 
+type CapacityError struct{ InstanceType string }
+
+func (e CapacityError) Error() string         { return "insufficient capacity for " + e.InstanceType }
+func (e CapacityError) IsCapacityError() bool { return true }
+
+type QuotaError struct{}
+
+func (e QuotaError) Error() string      { return "quota exceeded" }
+func (e QuotaError) IsQuotaError() bool { return true }
+
 // StubVM is a fake server that runs an SSH service. It represents a
 // VM running in a fake cloud.
 //
@@ -187,6 +210,7 @@ type StubVM struct {
 	Boot                  time.Time
 	Broken                time.Time
 	ReportBroken          time.Time
+	Preempted             time.Time // cloud provider reports preemption after this time
 	CrunchRunMissing      bool
 	CrunchRunCrashRate    float64
 	CrunchRunDetachDelay  time.Duration
@@ -425,6 +449,13 @@ func (si stubInstance) Destroy() error {
 	return nil
 }
 
+// Preempted implements cloud.PreemptibleInstance.
+func (si stubInstance) Preempted() bool {
+	si.svm.Lock()
+	defer si.svm.Unlock()
+	return !si.svm.Preempted.IsZero() && si.svm.Preempted.Before(time.Now())
+}
+
 func (si stubInstance) ProviderType() string {
 	return si.svm.providerType
 }
@@ -81,8 +81,19 @@ const (
 	// instances have been shutdown.
 	quotaErrorTTL = time.Minute
 
+	// Time to wait before trying again to create an instance of
+	// a type that failed to create. The delay doubles after each
+	// consecutive failure, up to the maximum.
+	createFailureBackoffMin = time.Minute
+	createFailureBackoffMax = time.Minute * 16
+
 	// Time between "X failed because rate limiting" messages
 	logRateLimitErrorInterval = time.Second * 10
+
+	// Time to remember that a container was running on a
+	// preempted instance, if the scheduler doesn't call
+	// ForgetContainer.
+	preemptedTTL = time.Hour
 )
 
 func duration(conf arvados.Duration, def time.Duration) time.Duration {
@@ -92,6 +103,23 @@ func duration(conf arvados.Duration, def time.Duration) time.Duration {
 	return def
 }
 
+// runnerArgs returns the crunch-run arguments to use for all
+// containers, according to the cluster configuration.
+func runnerArgs(cluster *arvados.Cluster) []string {
+	args := []string{"--runtime-engine=" + cluster.Containers.RuntimeEngine}
+	if d := cluster.Containers.OutputCheckpointInterval; d > 0 {
+		args = append(args, "--output-checkpoint-interval="+d.String())
+		args = append(args, "--partial-output-ttl="+cluster.Containers.PartialOutputTTL.String())
+	}
+	if cluster.Containers.Logging.StructuredLogs {
+		args = append(args, "--structured-logs")
+		if cluster.Containers.Logging.StructuredLogsIncludeStdio {
+			args = append(args, "--structured-logs-stdio")
+		}
+	}
+	return append(args, cluster.Containers.CrunchRunArgumentsList...)
+}
+
 // NewPool creates a Pool of workers backed by instanceSet.
 //
 // New instances are configured and set up according to the given
@@ -105,11 +133,13 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		newExecutor:                    newExecutor,
 		cluster:                        cluster,
 		bootProbeCommand:               cluster.Containers.CloudVMs.BootProbeCommand,
+		preemptionProbeCommand:         cluster.Containers.CloudVMs.PreemptionProbeCommand,
 		runnerSource:                   cluster.Containers.CloudVMs.DeployRunnerBinary,
 		imageID:                        cloud.ImageID(cluster.Containers.CloudVMs.ImageID),
 		instanceTypes:                  cluster.InstanceTypes,
 		maxProbesPerSecond:             cluster.Containers.CloudVMs.MaxProbesPerSecond,
 		maxConcurrentInstanceCreateOps: cluster.Containers.CloudVMs.MaxConcurrentInstanceCreateOps,
+		maxContainersPerInstance:       cluster.Containers.CloudVMs.MaxContainersPerInstance,
 		probeInterval:                  duration(cluster.Containers.CloudVMs.ProbeInterval, defaultProbeInterval),
 		syncInterval:                   duration(cluster.Containers.CloudVMs.SyncInterval, defaultSyncInterval),
 		timeoutIdle:                    duration(cluster.Containers.CloudVMs.TimeoutIdle, defaultTimeoutIdle),
@@ -123,7 +153,7 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		installPublicKey:               installPublicKey,
 		tagKeyPrefix:                   cluster.Containers.CloudVMs.TagKeyPrefix,
 		runnerCmdDefault:               cluster.Containers.CrunchRunCommand,
-		runnerArgs:                     append([]string{"--runtime-engine=" + cluster.Containers.RuntimeEngine}, cluster.Containers.CrunchRunArgumentsList...),
+		runnerArgs:                     runnerArgs(cluster),
 		stop:                           make(chan bool),
 	}
 	wp.registerMetrics(reg)
@@ -147,6 +177,7 @@ type Pool struct {
 	newExecutor                    func(cloud.Instance) Executor
 	cluster                        *arvados.Cluster
 	bootProbeCommand               string
+	preemptionProbeCommand         string
 	runnerSource                   string
 	imageID                        cloud.ImageID
 	instanceTypes                  map[string]arvados.InstanceType
@@ -154,6 +185,7 @@ type Pool struct {
 	probeInterval                  time.Duration
 	maxProbesPerSecond             int
 	maxConcurrentInstanceCreateOps int
+	maxContainersPerInstance       int
 	timeoutIdle                    time.Duration
 	timeoutBooting                 time.Duration
 	timeoutProbe                   time.Duration
@@ -171,16 +203,19 @@ type Pool struct {
 	subscribers  map[<-chan struct{}]chan<- struct{}
 	creating     map[string]createCall // unfinished (cloud.InstanceSet)Create calls (key is instance secret)
 	workers      map[cloud.InstanceID]*worker
-	loaded       bool                 // loaded list of instances from InstanceSet at least once
-	exited       map[string]time.Time // containers whose crunch-run proc has exited, but ForgetContainer has not been called
+	loaded       bool                  // loaded list of instances from InstanceSet at least once
+	exited       map[string]time.Time  // containers whose crunch-run proc has exited, but ForgetContainer has not been called
+	preempted    map[string]preemption // containers that were running on preempted instances
 	atQuotaUntil time.Time
 	atQuotaErr   cloud.QuotaError
+	atCapacity   map[string]createFailure // instance types that recently failed to create (key is type name)
 	stop         chan bool
 	mtx          sync.RWMutex
 	setupOnce    sync.Once
 	runnerData   []byte
 	runnerMD5    [md5.Size]byte
 	runnerCmd    string
+	estimate     func(*arvados.Container) Resources // resources needed by a container (nil if packing is disabled)
 
 	mContainersRunning        prometheus.Gauge
 	mInstances                *prometheus.GaugeVec
@@ -194,6 +229,20 @@ type Pool struct {
 	mTimeFromShutdownToGone   prometheus.Summary
 	mTimeFromQueueToCrunchRun prometheus.Summary
 	mRunProbeDuration         *prometheus.SummaryVec
+	mPreemptions              *prometheus.CounterVec
+	mCreateFailures           *prometheus.CounterVec
+}
+
+// createFailure records consecutive failures to create instances of
+// one instance type.
+type createFailure struct {
+	count int
+	until time.Time // don't try again before this time
+}
+
+type preemption struct {
+	reason string
+	time   time.Time
 }
 
 type createCall struct {
@@ -317,6 +366,9 @@ func (wp *Pool) Create(it arvados.InstanceType) bool {
 	if time.Now().Before(wp.atQuotaUntil) || wp.instanceSet.throttleCreate.Error() != nil {
 		return false
 	}
+	if time.Now().Before(wp.atCapacity[it.Name].until) {
+		return false
+	}
 	// The maxConcurrentInstanceCreateOps knob throttles the number of node create
 	// requests in flight. It was added to work around a limitation in Azure's
 	// managed disks, which support no more than 20 concurrent node creation
@@ -349,15 +401,24 @@ func (wp *Pool) Create(it arvados.InstanceType) bool {
 		// worker.
 		defer delete(wp.creating, secret)
 		if err != nil {
-			if err, ok := err.(cloud.QuotaError); ok && err.IsQuotaError() {
-				wp.atQuotaErr = err
+			quotaErr, _ := err.(cloud.QuotaError)
+			atQuota := quotaErr != nil && quotaErr.IsQuotaError()
+			if atQuota {
+				wp.atQuotaErr = quotaErr
 				wp.atQuotaUntil = time.Now().Add(quotaErrorTTL)
 				time.AfterFunc(quotaErrorTTL, wp.notify)
 			}
 			logger.WithError(err).Error("create failed")
 			wp.instanceSet.throttleCreate.CheckRateLimitError(err, wp.logger, "create instance", wp.notify)
+			if _, rateLimited := err.(cloud.RateLimitError); !rateLimited && !atQuota {
+				// Quota and rate-limit errors are
+				// not specific to this instance type,
+				// and are handled above.
+				wp.backoffCreate(it, err)
+			}
 			return
 		}
+		delete(wp.atCapacity, it.Name)
 		wp.updateWorker(inst, it)
 	}()
 	return true
@@ -371,6 +432,44 @@ func (wp *Pool) AtQuota() bool {
 	return time.Now().Before(wp.atQuotaUntil)
 }
 
+// AtCapacity returns true if creating an instance of the given type
+// has failed recently, and Create will not try again until a backoff
+// period has passed.
+func (wp *Pool) AtCapacity(it arvados.InstanceType) bool {
+	wp.setupOnce.Do(wp.setup)
+	wp.mtx.RLock()
+	defer wp.mtx.RUnlock()
+	return time.Now().Before(wp.atCapacity[it.Name].until)
+}
+
+// backoffCreate records a failure to create an instance of the given
+// type, and stops Create from trying that type again until a backoff
+// period has passed. The period doubles after each consecutive
+// failure.
+//
+// Caller must have lock.
+func (wp *Pool) backoffCreate(it arvados.InstanceType, err error) {
+	cf := wp.atCapacity[it.Name]
+	backoff := createFailureBackoffMin << uint(cf.count)
+	if backoff > createFailureBackoffMax || backoff <= 0 {
+		backoff = createFailureBackoffMax
+	}
+	cf.count++
+	cf.until = time.Now().Add(backoff)
+	wp.atCapacity[it.Name] = cf
+	capacityErr, _ := err.(cloud.CapacityError)
+	wp.logger.WithFields(logrus.Fields{
+		"InstanceType":  it.Name,
+		"Failures":      cf.count,
+		"CapacityError": capacityErr != nil && capacityErr.IsCapacityError(),
+		"Until":         cf.until,
+	}).Info("not creating more instances of this type until backoff period ends")
+	if wp.mCreateFailures != nil {
+		wp.mCreateFailures.WithLabelValues(it.Name).Inc()
+	}
+	time.AfterFunc(backoff, wp.notify)
+}
+
 // SetIdleBehavior determines how the indicated instance will behave
 // when it has no containers running.
 func (wp *Pool) SetIdleBehavior(id cloud.InstanceID, idleBehavior IdleBehavior) error {
@@ -462,6 +561,7 @@ func (wp *Pool) updateWorker(inst cloud.Instance, it arvados.InstanceType) (*wor
 		updated:      now,
 		running:      make(map[string]*remoteRunner),
 		starting:     make(map[string]*remoteRunner),
+		allocated:    make(map[string]allocation),
 		probing:      make(chan struct{}, 1),
 	}
 	wp.workers[id] = wkr
@@ -533,12 +633,115 @@ func (wp *Pool) Running() map[string]time.Time {
 	return r
 }
 
-// StartContainer starts a container on an idle worker immediately if
-// possible, otherwise returns false.
+// A ContainerInstance identifies the worker a container has been
+// assigned to.
+type ContainerInstance struct {
+	Instance     cloud.InstanceID
+	InstanceType arvados.InstanceType
+}
+
+// ContainerInstances returns the worker each container is being
+// prepared/run on, keyed by container UUID. When packing is enabled,
+// several containers can share a single instance.
+func (wp *Pool) ContainerInstances() map[string]ContainerInstance {
+	wp.setupOnce.Do(wp.setup)
+	wp.mtx.RLock()
+	defer wp.mtx.RUnlock()
+	r := map[string]ContainerInstance{}
+	for id, wkr := range wp.workers {
+		ci := ContainerInstance{Instance: id, InstanceType: wkr.instType}
+		for uuid := range wkr.running {
+			r[uuid] = ci
+		}
+		for uuid := range wkr.starting {
+			r[uuid] = ci
+		}
+	}
+	return r
+}
+
+// EnablePacking enables running multiple containers concurrently on
+// a single worker, up to the configured MaxContainersPerInstance. The
+// estimate func returns the resources needed by a given container;
+// it should be consistent with the way instance types are chosen.
+//
+// EnablePacking has no effect if MaxContainersPerInstance is less
+// than 2.
+func (wp *Pool) EnablePacking(estimate func(*arvados.Container) Resources) {
+	if wp.maxContainersPerInstance < 2 {
+		return
+	}
+	wp.mtx.Lock()
+	defer wp.mtx.Unlock()
+	wp.estimate = estimate
+}
+
+// Packable returns true if the given container can start right away
+// on a worker of the given type that is already running other
+// containers.
+func (wp *Pool) Packable(it arvados.InstanceType, ctr arvados.Container) bool {
+	wp.setupOnce.Do(wp.setup)
+	wp.mtx.RLock()
+	defer wp.mtx.RUnlock()
+	wkr, _ := wp.findPackable(it, ctr)
+	return wkr != nil
+}
+
+// findPackable returns a worker of the given type that is already
+// running other containers and has enough unallocated resources to
+// run ctr, along with the resources to allocate, or nil if there is
+// no such worker.
+//
+// If there are several such workers, it returns the one with the
+// fewest unallocated VCPUs, so the remaining space on other workers
+// stays available for larger containers, and lightly used workers
+// become idle sooner.
+//
+// Caller must have lock.
+func (wp *Pool) findPackable(it arvados.InstanceType, ctr arvados.Container) (*worker, *allocation) {
+	if wp.estimate == nil {
+		return nil, nil
+	}
+	need := wp.estimate(&ctr)
+	var best *worker
+	var bestAlloc *allocation
+	var bestFree Resources
+	for _, wkr := range wp.workers {
+		if wkr.instType != it ||
+			wkr.state != StateRunning ||
+			wkr.idleBehavior != IdleBehaviorRun ||
+			len(wkr.running)+len(wkr.starting) >= wp.maxContainersPerInstance {
+			continue
+		}
+		free, gpuDevices, ok := wkr.unallocated()
+		if !ok || !free.Fits(need) {
+			continue
+		}
+		if best == nil || free.VCPUs < bestFree.VCPUs {
+			best, bestFree = wkr, free
+			bestAlloc = &allocation{
+				Resources:  need,
+				gpuDevices: gpuDevices[:need.GPUs],
+			}
+		}
+	}
+	return best, bestAlloc
+}
+
+// StartContainer starts a container immediately if possible,
+// otherwise returns false.
+//
+// If packing is enabled (see EnablePacking), StartContainer prefers a
+// worker that is already running other containers and has enough
+// unallocated resources. Otherwise, it uses an idle worker.
 func (wp *Pool) StartContainer(it arvados.InstanceType, ctr arvados.Container) bool {
 	wp.setupOnce.Do(wp.setup)
 	wp.mtx.Lock()
 	defer wp.mtx.Unlock()
+	if wkr, alloc := wp.findPackable(it, ctr); wkr != nil {
+		wkr.startContainer(ctr, alloc)
+		return true
+	}
 	var wkr *worker
 	for _, w := range wp.workers {
 		if w.instType == it && w.state == StateIdle && w.idleBehavior == IdleBehaviorRun {
@@ -550,7 +753,21 @@ func (wp *Pool) StartContainer(it arvados.InstanceType, ctr arvados.Container) b
 	if wkr == nil {
 		return false
 	}
-	wkr.startContainer(ctr)
+	var alloc *allocation
+	if wp.estimate != nil {
+		need := wp.estimate(&ctr)
+		_, gpuDevices, _ := wkr.unallocated()
+		if need.GPUs > len(gpuDevices) {
+			// Shouldn't happen: instance type was chosen
+			// to fit this container.
+			need.GPUs = len(gpuDevices)
+		}
+		alloc = &allocation{
+			Resources:  need,
+			gpuDevices: gpuDevices[:need.GPUs],
+		}
+	}
+	wkr.startContainer(ctr, alloc)
 	return true
 }
 
@@ -599,6 +816,19 @@ func (wp *Pool) ForgetContainer(uuid string) {
 		wp.logger.WithField("ContainerUUID", uuid).Debug("clearing placeholder for exited crunch-run process")
 		delete(wp.exited, uuid)
 	}
+	delete(wp.preempted, uuid)
+}
+
+// Preempted returns true, along with an explanation, if the given
+// container was running on an instance that the cloud provider has
+// reclaimed or announced it will reclaim. The record is kept until
+// ForgetContainer is called.
+func (wp *Pool) Preempted(uuid string) (string, bool) {
+	wp.setupOnce.Do(wp.setup)
+	wp.mtx.RLock()
+	defer wp.mtx.RUnlock()
+	p, ok := wp.preempted[uuid]
+	return p.reason, ok
 }
 
 func (wp *Pool) registerMetrics(reg *prometheus.Registry) {
@@ -660,6 +890,28 @@ func (wp *Pool) registerMetrics(reg *prometheus.Registry) {
 		wp.mDisappearances.WithLabelValues(v).Add(0)
 	}
 	reg.MustRegister(wp.mDisappearances)
+	wp.mCreateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "instances_create_failed",
+		Help:      "Number of failed attempts to create a cloud VM.",
+	}, []string{"instance_type"})
+	for _, it := range wp.instanceTypes {
+		wp.mCreateFailures.WithLabelValues(it.Name).Add(0)
+	}
+	reg.MustRegister(wp.mCreateFailures)
+	wp.mPreemptions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "instances_preempted",
+		Help:      "Number of preemptible instances reclaimed by the cloud provider.",
+	}, []string{"instance_type"})
+	for _, it := range wp.instanceTypes {
+		if it.Preemptible {
+			wp.mPreemptions.WithLabelValues(it.Name).Add(0)
+		}
+	}
+	reg.MustRegister(wp.mPreemptions)
 	wp.mTimeToSSH = prometheus.NewSummary(prometheus.SummaryOpts{
 		Namespace:  "arvados",
 		Subsystem:  "dispatchcloud",
@@ -870,6 +1122,8 @@ func (wp *Pool) KillInstance(id cloud.InstanceID, reason string) error {
 func (wp *Pool) setup() {
 	wp.creating = map[string]createCall{}
 	wp.exited = map[string]time.Time{}
+	wp.preempted = map[string]preemption{}
+	wp.atCapacity = map[string]createFailure{}
 	wp.workers = map[cloud.InstanceID]*worker{}
 	wp.subscribers = map[<-chan struct{}]chan<- struct{}{}
 	wp.loadRunnerData()
@@ -948,12 +1202,17 @@ func (wp *Pool) sync(threshold time.Time, instances []cloud.Instance) {
 			wp.logger.WithField("Instance", inst.ID()).Errorf("unknown InstanceType tag %q --- ignoring", itTag)
 			continue
 		}
-		if wkr, isNew := wp.updateWorker(inst, it); isNew {
+		wkr, isNew := wp.updateWorker(inst, it)
+		if isNew {
 			notify = true
 		} else if wkr.state == StateShutdown && time.Since(wkr.destroyed) > wp.timeoutShutdown {
 			wp.logger.WithField("Instance", inst.ID()).Info("worker still listed after shutdown; retrying")
 			wkr.shutdown()
 		}
+		if pi, ok := inst.(cloud.PreemptibleInstance); ok && pi.Preempted() {
+			wkr.setPreempted("cloud provider reported preemption")
+			notify = true
+		}
 	}
 
 	for id, wkr := range wp.workers {
@@ -965,6 +1224,11 @@ func (wp *Pool) sync(threshold time.Time, instances []cloud.Instance) {
 			"WorkerState": wkr.state,
 		})
 		logger.Info("instance disappeared in cloud")
+		if wkr.instType.Preemptible && wkr.destroyed.IsZero() {
+			// We didn't try to shut it down, so the
+			// cloud provider must have reclaimed it.
+			wkr.setPreempted("preemptible instance disappeared")
+		}
 		wkr.reportBootOutcome(BootOutcomeDisappeared)
 		if wp.mDisappearances != nil {
 			wp.mDisappearances.WithLabelValues(stateString[wkr.state]).Inc()
@@ -978,6 +1242,12 @@ func (wp *Pool) sync(threshold time.Time, instances []cloud.Instance) {
 		notify = true
 	}
 
+	for uuid, p := range wp.preempted {
+		if time.Since(p.time) > preemptedTTL {
+			delete(wp.preempted, uuid)
+		}
+	}
+
 	if !wp.loaded {
 		notify = true
 		wp.loaded = true
@@ -15,6 +15,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	check "gopkg.in/check.v1"
 )
@@ -208,6 +209,260 @@ func (suite *PoolSuite) TestDrain(c *check.C) {
 	}
 }
 
+func (suite *PoolSuite) TestPacking(c *check.C) {
+	driver := test.StubDriver{}
+	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger)
+	c.Assert(err, check.IsNil)
+
+	type1 := arvados.InstanceType{Name: "g4", ProviderType: "g4.large", VCPUs: 4, RAM: 8 * GiB, Scratch: 100 * GiB, Price: .4}
+	type1.CUDA.DeviceCount = 2
+	pool := &Pool{
+		arvClient:                arvados.NewClientFromEnv(),
+		logger:                   suite.logger,
+		newExecutor:              func(cloud.Instance) Executor { return &stubExecutor{} },
+		cluster:                  suite.testCluster,
+		instanceSet:              &throttledInstanceSet{InstanceSet: instanceSet},
+		maxContainersPerInstance: 3,
+		instanceTypes: arvados.InstanceTypeMap{
+			type1.Name: type1,
+		},
+	}
+	pool.EnablePacking(func(ctr *arvados.Container) Resources {
+		return Resources{
+			VCPUs: ctr.RuntimeConstraints.VCPUs,
+			RAM:   ctr.RuntimeConstraints.RAM,
+			GPUs:  ctr.RuntimeConstraints.CUDA.DeviceCount,
+		}
+	})
+	notify := pool.Subscribe()
+	defer pool.Unsubscribe(notify)
+
+	pool.Create(type1)
+	suite.wait(c, pool, notify, func() bool {
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		return len(pool.workers) == 1
+	})
+	var wkr *worker
+	for _, wkr = range pool.workers {
+		wkr.state = StateIdle
+		wkr.idleBehavior = IdleBehaviorRun
+	}
+
+	ctr := func(uuid string, vcpus int, gpus int) arvados.Container {
+		ctr := arvados.Container{UUID: uuid}
+		ctr.RuntimeConstraints.VCPUs = vcpus
+		ctr.RuntimeConstraints.RAM = 1 << 30
+		ctr.RuntimeConstraints.CUDA.DeviceCount = gpus
+		return ctr
+	}
+	ctr1 := ctr(test.ContainerUUID(1), 2, 1)
+	ctr2 := ctr(test.ContainerUUID(2), 1, 1)
+	ctr3 := ctr(test.ContainerUUID(3), 2, 0)
+	ctr4 := ctr(test.ContainerUUID(4), 1, 0)
+
+	// Nothing to pack onto until a container is running.
+	c.Check(pool.Packable(type1, ctr1), check.Equals, false)
+	c.Check(pool.StartContainer(type1, ctr1), check.Equals, true)
+	c.Check(pool.Packable(type1, ctr2), check.Equals, true)
+	c.Check(pool.StartContainer(type1, ctr2), check.Equals, true)
+	// Only 1 VCPU left.
+	c.Check(pool.Packable(type1, ctr3), check.Equals, false)
+	c.Check(pool.StartContainer(type1, ctr3), check.Equals, false)
+	// VCPUs left, but no more than 3 containers per instance.
+	c.Check(pool.Packable(type1, ctr4), check.Equals, true)
+	c.Check(pool.StartContainer(type1, ctr4), check.Equals, true)
+	c.Check(pool.Packable(type1, ctr(test.ContainerUUID(5), 0, 0)), check.Equals, false)
+
+	ci := pool.ContainerInstances()
+	c.Check(ci, check.HasLen, 3)
+	for _, uuid := range []string{ctr1.UUID, ctr2.UUID, ctr4.UUID} {
+		c.Check(ci[uuid], check.Equals, ContainerInstance{Instance: wkr.instance.ID(), InstanceType: type1})
+	}
+
+	pool.mtx.Lock()
+	c.Check(wkr.allocated[ctr1.UUID].gpuDevices, check.DeepEquals, []int{0})
+	c.Check(wkr.allocated[ctr2.UUID].gpuDevices, check.DeepEquals, []int{1})
+	c.Check(wkr.allocated[ctr4.UUID].gpuDevices, check.HasLen, 0)
+	for uuid, rr := range wkr.starting {
+		if uuid == ctr2.UUID {
+			c.Check(string(rr.configJSON), check.Matches, `.*"CUDA_VISIBLE_DEVICES":"1".*`)
+		} else if uuid == ctr4.UUID {
+			c.Check(string(rr.configJSON), check.Not(check.Matches), `.*CUDA_VISIBLE_DEVICES.*`)
+		}
+	}
+	pool.mtx.Unlock()
+
+	// When a container finishes, its resources become available
+	// again.
+	suite.wait(c, pool, notify, func() bool {
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		return len(wkr.running) == 3
+	})
+	pool.mtx.Lock()
+	wkr.closeRunner(ctr1.UUID)
+	pool.mtx.Unlock()
+	c.Check(pool.Packable(type1, ctr3), check.Equals, true)
+
+	// A container started by a previous dispatcher process has
+	// unknown resource needs, so nothing else gets packed.
+	pool.mtx.Lock()
+	wkr.running[test.ContainerUUID(6)] = newRemoteRunner(test.ContainerUUID(6), wkr)
+	pool.mtx.Unlock()
+	c.Check(pool.Packable(type1, ctr3), check.Equals, false)
+}
+
+func (suite *PoolSuite) TestPreempted(c *check.C) {
+	driver := test.StubDriver{
+		SetupVM: func(svm *test.StubVM) {
+			svm.Preempted = time.Now()
+		},
+	}
+	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger)
+	c.Assert(err, check.IsNil)
+
+	type1 := test.InstanceType(1)
+	type1.Preemptible = true
+	pool := &Pool{
+		arvClient:   arvados.NewClientFromEnv(),
+		logger:      suite.logger,
+		newExecutor: func(cloud.Instance) Executor { return &stubExecutor{} },
+		cluster:     suite.testCluster,
+		instanceSet: &throttledInstanceSet{InstanceSet: instanceSet},
+		instanceTypes: arvados.InstanceTypeMap{
+			type1.Name: type1,
+		},
+	}
+	pool.registerMetrics(prometheus.NewRegistry())
+	notify := pool.Subscribe()
+	defer pool.Unsubscribe(notify)
+
+	pool.Create(type1)
+	suite.wait(c, pool, notify, func() bool {
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		return len(pool.workers) == 1
+	})
+	uuid := test.ContainerUUID(1)
+	var wkr *worker
+	pool.mtx.Lock()
+	for _, wkr = range pool.workers {
+		wkr.state = StateRunning
+		wkr.idleBehavior = IdleBehaviorRun
+		wkr.running[uuid] = newRemoteRunner(uuid, wkr)
+	}
+	pool.mtx.Unlock()
+
+	c.Check(pool.getInstancesAndSync(), check.IsNil)
+	reason, preempted := pool.Preempted(uuid)
+	c.Check(preempted, check.Equals, true)
+	c.Check(reason, check.Equals, "cloud provider reported preemption")
+	c.Check(testutil.ToFloat64(pool.mPreemptions.WithLabelValues(type1.Name)), check.Equals, float64(1))
+	pool.mtx.RLock()
+	c.Check(wkr.idleBehavior, check.Equals, IdleBehaviorDrain)
+	pool.mtx.RUnlock()
+
+	// Subsequent reports for the same instance are not counted
+	// again.
+	c.Check(pool.getInstancesAndSync(), check.IsNil)
+	c.Check(testutil.ToFloat64(pool.mPreemptions.WithLabelValues(type1.Name)), check.Equals, float64(1))
+
+	pool.ForgetContainer(uuid)
+	_, preempted = pool.Preempted(uuid)
+	c.Check(preempted, check.Equals, false)
+}
+
+func (suite *PoolSuite) TestCreateBackoff(c *check.C) {
+	type1 := test.InstanceType(1)
+	type2 := test.InstanceType(2)
+	driver := test.StubDriver{
+		AtCapacity: map[string]bool{type1.Name: true},
+	}
+	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger)
+	c.Assert(err, check.IsNil)
+
+	pool := &Pool{
+		arvClient:   arvados.NewClientFromEnv(),
+		logger:      suite.logger,
+		newExecutor: func(cloud.Instance) Executor { return &stubExecutor{} },
+		cluster:     suite.testCluster,
+		instanceSet: &throttledInstanceSet{InstanceSet: instanceSet},
+		instanceTypes: arvados.InstanceTypeMap{
+			type1.Name: type1,
+			type2.Name: type2,
+		},
+	}
+	pool.registerMetrics(prometheus.NewRegistry())
+	notify := pool.Subscribe()
+	defer pool.Unsubscribe(notify)
+
+	c.Check(pool.AtCapacity(type1), check.Equals, false)
+	c.Check(pool.Create(type1), check.Equals, true)
+	suite.wait(c, pool, notify, func() bool { return pool.AtCapacity(type1) })
+	c.Check(testutil.ToFloat64(pool.mCreateFailures.WithLabelValues(type1.Name)), check.Equals, float64(1))
+
+	// Don't retry until the backoff period ends, but other types
+	// are still available.
+	c.Check(pool.Create(type1), check.Equals, false)
+	c.Check(pool.AtCapacity(type2), check.Equals, false)
+
+	pool.mtx.Lock()
+	firstBackoff := time.Until(pool.atCapacity[type1.Name].until)
+	pool.atCapacity[type1.Name] = createFailure{count: 1}
+	pool.mtx.Unlock()
+	c.Check(firstBackoff > createFailureBackoffMin/2, check.Equals, true)
+
+	// Backoff period doubles after each consecutive failure.
+	c.Check(pool.Create(type1), check.Equals, true)
+	suite.wait(c, pool, notify, func() bool { return pool.AtCapacity(type1) })
+	pool.mtx.Lock()
+	c.Check(time.Until(pool.atCapacity[type1.Name].until) > firstBackoff, check.Equals, true)
+	pool.atCapacity[type1.Name] = createFailure{count: 2}
+	pool.mtx.Unlock()
+
+	// Success resets the failure count.
+	delete(driver.AtCapacity, type1.Name)
+	c.Check(pool.Create(type1), check.Equals, true)
+	suite.wait(c, pool, notify, func() bool {
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		return len(pool.workers) == 1
+	})
+	pool.mtx.RLock()
+	_, failed := pool.atCapacity[type1.Name]
+	pool.mtx.RUnlock()
+	c.Check(failed, check.Equals, false)
+}
+
+// A quota error is not specific to the requested instance type, so
+// it doesn't trigger the per-type backoff.
+func (suite *PoolSuite) TestCreateQuotaErrorNoBackoff(c *check.C) {
+	type1 := test.InstanceType(1)
+	driver := test.StubDriver{AtQuota: true}
+	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger)
+	c.Assert(err, check.IsNil)
+
+	pool := &Pool{
+		arvClient:   arvados.NewClientFromEnv(),
+		logger:      suite.logger,
+		newExecutor: func(cloud.Instance) Executor { return &stubExecutor{} },
+		cluster:     suite.testCluster,
+		instanceSet: &throttledInstanceSet{InstanceSet: instanceSet},
+		instanceTypes: arvados.InstanceTypeMap{
+			type1.Name: type1,
+		},
+	}
+	pool.registerMetrics(prometheus.NewRegistry())
+	notify := pool.Subscribe()
+	defer pool.Unsubscribe(notify)
+
+	c.Check(pool.Create(type1), check.Equals, true)
+	suite.wait(c, pool, notify, pool.AtQuota)
+	c.Check(pool.AtCapacity(type1), check.Equals, false)
+	c.Check(testutil.ToFloat64(pool.mCreateFailures.WithLabelValues(type1.Name)), check.Equals, float64(0))
+}
+
 func (suite *PoolSuite) TestNodeCreateThrottle(c *check.C) {
 	driver := test.StubDriver{HoldCloudOps: true}
 	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger)
@@ -0,0 +1,67 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package worker
+
+import (
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Resources is an amount of each compute resource that a container
+// needs, or that a worker has available.
+type Resources struct {
+	VCPUs   int
+	RAM     int64
+	Scratch int64
+	GPUs    int
+}
+
+// InstanceResources returns the resources provided by an instance of
+// the given type.
+func InstanceResources(it arvados.InstanceType) Resources {
+	return Resources{
+		VCPUs:   it.VCPUs,
+		RAM:     int64(it.RAM),
+		Scratch: int64(it.Scratch),
+		GPUs:    it.CUDA.DeviceCount,
+	}
+}
+
+// Fits returns true if need is no larger than r in every dimension.
+func (r Resources) Fits(need Resources) bool {
+	return need.VCPUs <= r.VCPUs &&
+		need.RAM <= r.RAM &&
+		need.Scratch <= r.Scratch &&
+		need.GPUs <= r.GPUs
+}
+
+// Sub returns r minus need.
+func (r Resources) Sub(need Resources) Resources {
+	return Resources{
+		VCPUs:   r.VCPUs - need.VCPUs,
+		RAM:     r.RAM - need.RAM,
+		Scratch: r.Scratch - need.Scratch,
+		GPUs:    r.GPUs - need.GPUs,
+	}
+}
+
+// allocation records the resources reserved for a container that
+// was started on a worker by this dispatcher process.
+type allocation struct {
+	Resources
+	gpuDevices []int // CUDA device numbers assigned to the container
+}
+
+// cudaVisibleDevices returns a CUDA_VISIBLE_DEVICES value for the
+// allocation, or "" if no devices are assigned.
+func (a allocation) cudaVisibleDevices() string {
+	var ids []string
+	for _, dev := range a.gpuDevices {
+		ids = append(ids, strconv.Itoa(dev))
+	}
+	return strings.Join(ids, ",")
+}
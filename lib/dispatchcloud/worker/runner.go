@@ -59,9 +59,21 @@ func newRemoteRunner(uuid string, wkr *worker) *remoteRunner {
 	if wkr.wp.arvClient.Insecure {
 		configData.Env["ARVADOS_API_HOST_INSECURE"] = "1"
 	}
+	vcpus := wkr.instType.VCPUs
+	if alloc, ok := wkr.allocated[uuid]; ok {
+		// The container shares this instance with other
+		// containers, so it only gets its own share of
+		// VCPUs and CUDA devices.
+		if alloc.VCPUs > 0 {
+			vcpus = alloc.VCPUs
+		}
+		if devs := alloc.cudaVisibleDevices(); devs != "" {
+			configData.Env["CUDA_VISIBLE_DEVICES"] = devs
+		}
+	}
 	if bufs := wkr.wp.cluster.Containers.LocalKeepBlobBuffersPerVCPU; bufs > 0 {
 		configData.Cluster = wkr.wp.cluster
-		configData.KeepBuffers = bufs * wkr.instType.VCPUs
+		configData.KeepBuffers = bufs * vcpus
 	}
 	configJSON, err := json.Marshal(configData)
 	if err != nil {
@@ -107,10 +107,12 @@ type worker struct {
 	lastUUID            string
 	running             map[string]*remoteRunner // remember to update state idle<->running when this changes
 	starting            map[string]*remoteRunner // remember to update state idle<->running when this changes
+	allocated           map[string]allocation    // resources reserved for containers started by this process (only when packing)
 	probing             chan struct{}
 	bootOutcomeReported bool
 	timeToReadyReported bool
 	staleRunLockSince   time.Time
+	preempted           bool
 }
 
 func (wkr *worker) onUnkillable(uuid string) {
@@ -162,13 +164,22 @@ func (wkr *worker) setIdleBehavior(idleBehavior IdleBehavior) {
 	wkr.shutdownIfIdle()
 }
 
+// Start a container. If alloc is not nil, the given resources are
+// reserved for the container until its crunch-run process ends.
+//
 // caller must have lock.
-func (wkr *worker) startContainer(ctr arvados.Container) {
+func (wkr *worker) startContainer(ctr arvados.Container, alloc *allocation) {
 	logger := wkr.logger.WithFields(logrus.Fields{
 		"ContainerUUID": ctr.UUID,
 		"Priority":      ctr.Priority,
 	})
 	logger.Debug("starting container")
+	if alloc != nil {
+		if wkr.allocated == nil {
+			wkr.allocated = map[string]allocation{}
+		}
+		wkr.allocated[ctr.UUID] = *alloc
+	}
 	rr := newRemoteRunner(ctr.UUID, wkr)
 	wkr.starting[ctr.UUID] = rr
 	if wkr.state != StateRunning {
@@ -227,6 +238,7 @@ func (wkr *worker) probeAndUpdate() {
 	wkr.mtx.Lock()
 	updated := wkr.updated
 	initialState := wkr.state
+	alreadyPreempted := wkr.preempted
 	wkr.mtx.Unlock()
 
 	var (
@@ -266,8 +278,12 @@ func (wkr *worker) probeAndUpdate() {
 	if booted || wkr.state == StateUnknown {
 		ctrUUIDs, reportedBroken, ok = wkr.probeRunning()
 	}
+	preempted := booted && !alreadyPreempted && wkr.probePreempted()
 	wkr.mtx.Lock()
 	defer wkr.mtx.Unlock()
+	if preempted {
+		wkr.setPreempted("preemption probe succeeded")
+	}
 	if reportedBroken && wkr.idleBehavior == IdleBehaviorRun {
 		logger.Info("probe reported broken instance")
 		wkr.reportBootOutcome(BootOutcomeFailed)
@@ -429,6 +445,27 @@ func (wkr *worker) probeRunning() (running []string, reportsBroken, ok bool) {
 	return
 }
 
+// probePreempted returns true if the configured preemption probe
+// command indicates the cloud provider is about to reclaim the
+// instance. It always returns false for non-preemptible instance
+// types, and if no preemption probe command is configured.
+func (wkr *worker) probePreempted() bool {
+	cmd := wkr.wp.preemptionProbeCommand
+	if cmd == "" || !wkr.instType.Preemptible {
+		return false
+	}
+	stdout, stderr, err := wkr.executor.Execute(nil, cmd, nil)
+	if err != nil {
+		return false
+	}
+	wkr.logger.WithFields(logrus.Fields{
+		"Command": cmd,
+		"stdout":  string(stdout),
+		"stderr":  string(stderr),
+	}).Info("preemption probe succeeded")
+	return true
+}
+
 func (wkr *worker) probeBooted() (ok bool, stderr []byte) {
 	cmd := wkr.wp.bootProbeCommand
 	if cmd == "" {
@@ -647,6 +684,65 @@ func (wkr *worker) updateRunning(ctrUUIDs []string) (changed bool) {
 	return
 }
 
+// setPreempted records that the cloud provider has reclaimed, or is
+// about to reclaim, this worker's instance. Containers running on
+// the worker are reported as preempted (see Pool.Preempted), and no
+// new containers are started on it.
+//
+// caller must have lock.
+func (wkr *worker) setPreempted(reason string) {
+	if wkr.preempted {
+		return
+	}
+	wkr.preempted = true
+	wkr.logger.WithFields(logrus.Fields{
+		"Reason":            reason,
+		"RunningContainers": len(wkr.running) + len(wkr.starting),
+	}).Warn("instance preempted")
+	if wkr.wp.mPreemptions != nil {
+		wkr.wp.mPreemptions.WithLabelValues(wkr.instType.Name).Inc()
+	}
+	now := time.Now()
+	for _, rrs := range []map[string]*remoteRunner{wkr.running, wkr.starting} {
+		for uuid := range rrs {
+			wkr.wp.preempted[uuid] = preemption{reason: reason, time: now}
+		}
+	}
+	if wkr.idleBehavior == IdleBehaviorRun && wkr.state != StateShutdown {
+		wkr.setIdleBehavior(IdleBehaviorDrain)
+	}
+}
+
+// unallocated returns the resources on this worker that are not
+// reserved for any container, and the CUDA device numbers that are
+// not assigned to any container. It returns ok==false if the worker
+// is running a container whose resource needs are unknown, e.g., one
+// started by a previous dispatcher process.
+//
+// caller must have lock.
+func (wkr *worker) unallocated() (free Resources, gpuDevices []int, ok bool) {
+	free = InstanceResources(wkr.instType)
+	usedGPUs := map[int]bool{}
+	for _, rrs := range []map[string]*remoteRunner{wkr.running, wkr.starting} {
+		for uuid := range rrs {
+			alloc, known := wkr.allocated[uuid]
+			if !known {
+				return Resources{}, nil, false
+			}
+			free = free.Sub(alloc.Resources)
+			for _, dev := range alloc.gpuDevices {
+				usedGPUs[dev] = true
+			}
+		}
+	}
+	for dev := 0; dev < wkr.instType.CUDA.DeviceCount; dev++ {
+		if !usedGPUs[dev] {
+			gpuDevices = append(gpuDevices, dev)
+		}
+	}
+	return free, gpuDevices, true
+}
+
 // caller must have lock.
 func (wkr *worker) closeRunner(uuid string) {
 	rr := wkr.running[uuid]
@@ -655,6 +751,7 @@ func (wkr *worker) closeRunner(uuid string) {
 	}
 	wkr.logger.WithField("ContainerUUID", uuid).Info("crunch-run process ended")
 	delete(wkr.running, uuid)
+	delete(wkr.allocated, uuid)
 	rr.Close()
 
 	now := time.Now()
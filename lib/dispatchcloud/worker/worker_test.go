@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/cloud"
@@ -300,11 +301,14 @@ type stubResp struct {
 type stubExecutor struct {
 	response map[string]stubResp
 	stdin    bytes.Buffer
+	mtx      sync.Mutex
 }
 
 func (se *stubExecutor) SetTarget(cloud.ExecutorTarget) {}
 func (se *stubExecutor) Close()                         {}
 func (se *stubExecutor) Execute(env map[string]string, cmd string, stdin io.Reader) (stdout, stderr []byte, err error) {
+	se.mtx.Lock()
+	defer se.mtx.Unlock()
 	if stdin != nil {
 		_, err = io.Copy(&se.stdin, stdin)
 		if err != nil {
@@ -171,6 +171,16 @@ func (disp *dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Contain
 		disp.logger.Printf("Submitting container %s to LSF", ctr.UUID)
 		cmd := []string{disp.Cluster.Containers.CrunchRunCommand}
 		cmd = append(cmd, "--runtime-engine="+disp.Cluster.Containers.RuntimeEngine)
+		if d := disp.Cluster.Containers.OutputCheckpointInterval; d > 0 {
+			cmd = append(cmd, "--output-checkpoint-interval="+d.String())
+			cmd = append(cmd, "--partial-output-ttl="+disp.Cluster.Containers.PartialOutputTTL.String())
+		}
+		if disp.Cluster.Containers.Logging.StructuredLogs {
+			cmd = append(cmd, "--structured-logs")
+			if disp.Cluster.Containers.Logging.StructuredLogsIncludeStdio {
+				cmd = append(cmd, "--structured-logs-stdio")
+			}
+		}
 		cmd = append(cmd, disp.Cluster.Containers.CrunchRunArgumentsList...)
 		err := disp.submit(ctr, cmd)
 		if err != nil {
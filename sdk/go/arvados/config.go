@@ -57,6 +57,12 @@ func (sc *Config) GetCluster(clusterID string) (*Cluster, error) {
 	return &cc, nil
 }
 
+type KeepproxyBlockCacheConfig struct {
+	MaxMemory ByteSize
+	Directory string
+	MaxDisk   ByteSize
+}
+
 type WebDAVCacheConfig struct {
 	TTL                  Duration
 	UUIDTTL              Duration
@@ -67,6 +73,11 @@ type WebDAVCacheConfig struct {
 	MaxSessions          int
 }
 
+type WebDAVLocksConfig struct {
+	Backend    string
+	MaxTimeout Duration
+}
+
 type UploadDownloadPermission struct {
 	Upload   bool
 	Download bool
@@ -107,6 +118,7 @@ type Cluster struct {
 		SendTimeout                    Duration
 		WebsocketClientEventQueue      int
 		WebsocketServerEventQueue      int
+		WebsocketUpstreamFeed          string
 		KeepServiceRequestTimeout      Duration
 		VocabularyPath                 string
 	}
@@ -125,6 +137,8 @@ type Cluster struct {
 		BlobTrashConcurrency         int
 		BlobDeleteConcurrency        int
 		BlobReplicateConcurrency     int
+		BlobScrubInterval            Duration
+		BlobScrubMaxBytesPerSecond   ByteSize
 		CollectionVersioning         bool
 		DefaultTrashLifetime         Duration
 		DefaultReplication           int
@@ -134,6 +148,7 @@ type Cluster struct {
 		TrustAllContent              bool
 		ForwardSlashNameSubstitution string
 		S3FolderObjects              bool
+		S3MultipartUploadTTL         Duration
 
 		BlobMissingReport        string
 		BalancePeriod            Duration
@@ -141,10 +156,15 @@ type Cluster struct {
 		BalanceCollectionBuffers int
 		BalanceTimeout           Duration
 		BalanceUpdateLimit       int
+		BalanceLifecycleRules    map[string]LifecycleRule
+		BalanceStateFile         string
+		BalanceFullRunInterval   Duration
 
 		WebDAVCache WebDAVCacheConfig
+		WebDAVLocks WebDAVLocksConfig
 
 		KeepproxyPermission UploadDownloadRolePermissions
+		KeepproxyBlockCache KeepproxyBlockCacheConfig
 		WebDAVPermission    UploadDownloadRolePermissions
 		WebDAVLogEvents     bool
 	}
@@ -286,9 +306,31 @@ type Cluster struct {
 	}
 }
 
+// LifecycleRule is a policy for moving collections from one storage
+// class to another as they age. See BalanceLifecycleRules in
+// config.default.yml.
+type LifecycleRule struct {
+	FromStorageClass string
+	ToStorageClass   string
+	MinAge           Duration
+	ProjectUUID      string
+}
+
 type StorageClassConfig struct {
-	Default  bool
-	Priority int
+	Default       bool
+	Priority      int
+	ErasureCoding ErasureCodingConfig
+}
+
+type ErasureCodingConfig struct {
+	DataShards   int
+	ParityShards int
+}
+
+// Enabled returns true if blocks in the storage class should be
+// stored as erasure-coded shards instead of full replicas.
+func (ec ErasureCodingConfig) Enabled() bool {
+	return ec.DataShards > 0
 }
 
 type Volume struct {
@@ -298,6 +340,13 @@ type Volume struct {
 	StorageClasses   map[string]bool
 	Driver           string
 	DriverParameters json.RawMessage
+	Compression      string
+	Encryption       VolumeEncryption
+}
+
+type VolumeEncryption struct {
+	KeyProvider string
+	KeyFile     string
 }
 
 type S3VolumeDriverParameters struct {
@@ -430,6 +479,26 @@ type InstanceType struct {
 	CUDA            CUDAFeatures
 }
 
+type FairShareConfig struct {
+	Enable             bool
+	GroupBy            string
+	UsageHalfLife      Duration
+	DefaultWeight      float64
+	Weights            map[string]float64
+	MaxShareMultiplier float64
+}
+
+type QuotaConfig struct {
+	SpendPeriod Duration
+	Limits      map[string]QuotaLimits
+}
+
+type QuotaLimits struct {
+	MaxInstances int
+	MaxVCPUs     int
+	MaxSpend     float64
+}
+
 type ContainersConfig struct {
 	CloudVMs                      CloudVMsConfig
 	CrunchRunCommand              string
@@ -440,6 +509,7 @@ type ContainersConfig struct {
 	MaxComputeVMs                 int
 	MaxDispatchAttempts           int
 	MaxRetryAttempts              int
+	MaximumPriceFactor            float64
 	MinRetryPeriod                Duration
 	ReserveExtraRAM               ByteSize
 	StaleLockTimeout              Duration
@@ -448,6 +518,10 @@ type ContainersConfig struct {
 	RuntimeEngine                 string
 	LocalKeepBlobBuffersPerVCPU   int
 	LocalKeepLogsToContainerLog   string
+	OutputCheckpointInterval      Duration
+	PartialOutputTTL              Duration
+	FairShare                     FairShareConfig
+	Quotas                        QuotaConfig
 
 	JobsAPI struct {
 		Enable         string
@@ -464,6 +538,8 @@ type ContainersConfig struct {
 		LogPartialLineThrottlePeriod Duration
 		LogUpdatePeriod              Duration
 		LogUpdateSize                ByteSize
+		StructuredLogs               bool
+		StructuredLogsIncludeStdio   bool
 	}
 	ShellAccess struct {
 		Admin bool
@@ -499,7 +575,10 @@ type CloudVMsConfig struct {
 	MaxCloudOpsPerSecond           int
 	MaxProbesPerSecond             int
 	MaxConcurrentInstanceCreateOps int
+	MaxContainersPerInstance       int
 	PollInterval                   Duration
+	PreemptionFallbackThreshold    int
+	PreemptionProbeCommand         string
 	ProbeInterval                  Duration
 	SSHPort                        string
 	SyncInterval                   Duration
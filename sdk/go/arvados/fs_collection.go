@@ -47,6 +47,9 @@ type collectionFileSystem struct {
 	savedPDH       atomic.Value
 	replicas       int
 	storageClasses []string
+	// properties of the collection when the filesystem was
+	// loaded, reported in .arvados#collection
+	properties map[string]interface{}
 	// guessSignatureTTL tracks a lower bound for the server's
 	// configured BlobSigningTTL. The guess is initially zero, and
 	// increases when we come across a signature with an expiry
@@ -69,6 +72,7 @@ func (c *Collection) FileSystem(client apiClient, kc keepClient) (CollectionFile
 	fs := &collectionFileSystem{
 		uuid:           c.UUID,
 		storageClasses: c.StorageClassesDesired,
+		properties:     c.Properties,
 		fileSystem: fileSystem{
 			fsBackend: keepBackend{apiClient: client, keepClient: kc},
 			thr:       newThrottle(concurrentWriters),
@@ -944,6 +948,7 @@ func (dn *dirnode) Child(name string, replace func(inode) (inode, error)) (inode
 				return nil, err
 			}
 			coll.UUID = dn.fs.uuid
+			coll.Properties = dn.fs.properties
 			data, err := json.Marshal(&coll)
 			if err == nil {
 				data = append(data, '\n')
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -1578,6 +1579,22 @@ type CollectionFSUnitSuite struct{}
 
 var _ = check.Suite(&CollectionFSUnitSuite{})
 
+func (s *CollectionFSUnitSuite) TestCollectionMetadataFile(c *check.C) {
+	fs, err := (&Collection{
+		UUID:       "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		Properties: map[string]interface{}{"color": "blue"},
+	}).FileSystem(nil, nil)
+	c.Assert(err, check.IsNil)
+	f, err := fs.Open(".arvados#collection")
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	var coll Collection
+	c.Assert(json.Unmarshal(buf, &coll), check.IsNil)
+	c.Check(coll.UUID, check.Equals, "zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	c.Check(coll.Properties, check.DeepEquals, map[string]interface{}{"color": "blue"})
+}
+
 // expect ~2 seconds to load a manifest with 256K files
 func (s *CollectionFSUnitSuite) TestLargeManifest(c *check.C) {
 	if testing.Short() {
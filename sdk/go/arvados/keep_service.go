@@ -13,6 +13,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 )
 
 // KeepService is an arvados#keepService record
@@ -49,6 +51,11 @@ type KeepServiceIndexEntry struct {
 	SizedDigest
 	// Time of last write, in nanoseconds since Unix epoch
 	Mtime int64
+	// If IsShard is true, this entry is an erasure-coded shard
+	// of the block (rather than a complete copy), and ShardIndex
+	// is the index of the shard.
+	IsShard    bool
+	ShardIndex int
 }
 
 // EachKeepService calls f once for every readable
@@ -145,6 +152,24 @@ func (s *KeepService) IndexMount(ctx context.Context, c *Client, mountUUID strin
 	return s.index(ctx, c, s.url("mounts/"+mountUUID+"/blocks?prefix="+prefix))
 }
 
+// CorruptBlocksMount returns an unsorted list of blocks that have
+// been found to be corrupt at the given mount point. The Mtime of
+// each entry is the time the corruption was detected.
+func (s *KeepService) CorruptBlocksMount(ctx context.Context, c *Client, mountUUID string) ([]KeepServiceIndexEntry, error) {
+	return s.index(ctx, c, s.url("mounts/"+mountUUID+"/corrupt"))
+}
+
+// IndexMountChanges returns an unsorted list of index entries for
+// blocks that have been written, touched, trashed, or untrashed on
+// the given mount since the given time. Blocks that no longer exist
+// on the mount have Mtime==0, and (unless they are shards) no size.
+//
+// An error is returned if the server cannot report all changes since
+// the given time, e.g., because it has restarted since then.
+func (s *KeepService) IndexMountChanges(ctx context.Context, c *Client, mountUUID string, since time.Time) ([]KeepServiceIndexEntry, error) {
+	return s.index(ctx, c, s.url(fmt.Sprintf("mounts/%s/changes?since=%d", mountUUID, since.UnixNano())))
+}
+
 // Index returns an unsorted list of blocks that can be retrieved from
 // this server.
 func (s *KeepService) Index(ctx context.Context, c *Client, prefix string) ([]KeepServiceIndexEntry, error) {
@@ -199,10 +224,18 @@ func (s *KeepService) index(ctx context.Context, c *Client, url string) ([]KeepS
 			// 33658-09-27.)
 			mtime = mtime * 1e9
 		}
-		entries = append(entries, KeepServiceIndexEntry{
+		ent := KeepServiceIndexEntry{
 			SizedDigest: SizedDigest(fields[0]),
 			Mtime:       mtime,
-		})
+		}
+		if hash, size, idx, ok := erasure.ParseShardKey(strings.SplitN(fields[0], "+", 2)[0]); ok {
+			// Shard entries look like
+			// "{hash}.{blocksize}.{shardindex}+{shardsize}".
+			ent.SizedDigest = SizedDigest(fmt.Sprintf("%s+%d", hash, size))
+			ent.IsShard = true
+			ent.ShardIndex = idx
+		}
+		entries = append(entries, ent)
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("Error scanning index response: %v", err)
@@ -26,3 +26,28 @@ func (*KeepServiceSuite) TestIndexTimeout(c *check.C) {
 	_, err := (&KeepService{}).IndexMount(context.Background(), client, "fake", "")
 	c.Check(err, check.ErrorMatches, `.*timeout.*`)
 }
+
+func (*KeepServiceSuite) TestIndexShards(c *check.C) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: &stubTransport{
+				Responses: map[string]string{
+					"/mounts/fake/blocks": "acbd18db4cc2f85cedef654fccc4a4d8+3 1234567890123456789\n" +
+						"37b51d194a7513e45b56f6524f2d51f2.3.4+1 1234567890123456789\n" +
+						"\n",
+				},
+			},
+		},
+		APIHost:   "zzzzz.arvadosapi.com",
+		AuthToken: "xyzzy",
+	}
+	ents, err := (&KeepService{ServiceHost: "keep0.zzzzz.arvadosapi.com", ServicePort: 25107}).IndexMount(context.Background(), client, "fake", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(ents, check.HasLen, 2)
+	c.Check(ents[0].SizedDigest, check.Equals, SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3"))
+	c.Check(ents[0].IsShard, check.Equals, false)
+	c.Check(ents[1].SizedDigest, check.Equals, SizedDigest("37b51d194a7513e45b56f6524f2d51f2+3"))
+	c.Check(ents[1].IsShard, check.Equals, true)
+	c.Check(ents[1].ShardIndex, check.Equals, 4)
+	c.Check(ents[1].Mtime, check.Equals, int64(1234567890123456789))
+}
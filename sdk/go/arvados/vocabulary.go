@@ -37,6 +37,7 @@ func (v *Vocabulary) systemTagKeys() map[string]bool {
 		"docker-image-repo-tag": true,
 		"filters":               true,
 		"container_request":     true,
+		"s3_objects":            true,
 	}
 }
 
@@ -238,6 +238,7 @@ func (s *VocabularySuite) TestNewVocabulary(c *check.C) {
 					"docker-image-repo-tag": true,
 					"filters":               true,
 					"container_request":     true,
+					"s3_objects":            true,
 				},
 				StrictTags: false,
 				Tags: map[string]VocabularyTag{
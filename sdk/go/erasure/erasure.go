@@ -0,0 +1,215 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package erasure implements Reed-Solomon erasure coding for Keep
+// blocks.
+//
+// A block is divided into N equal-sized data shards (the last one
+// padded with zeroes), and M parity shards are computed from them.
+// The original block can be reassembled from any N of the N+M
+// shards.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+var (
+	ErrTooFewShards    = errors.New("too few shards available to reconstruct block")
+	ErrShardSize       = errors.New("shards have inconsistent sizes")
+	ErrInvalidEncoding = errors.New("invalid number of data/parity shards")
+)
+
+// Codec encodes and decodes blocks using a fixed number of data and
+// parity shards.
+type Codec struct {
+	dataShards   int
+	parityShards int
+	// (dataShards+parityShards) x dataShards encoding matrix. The
+	// top dataShards rows form an identity matrix, so the data
+	// shards are just the original data.
+	matrix matrix
+}
+
+// New returns a Codec that encodes blocks as dataShards data shards
+// and parityShards parity shards.
+func New(dataShards, parityShards int) (*Codec, error) {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, ErrInvalidEncoding
+	}
+	total := dataShards + parityShards
+	// Start with a Vandermonde matrix, which has the property
+	// that any dataShards rows are linearly independent, then
+	// convert it to systematic form by multiplying by the
+	// inverse of its top square.
+	vm := newMatrix(total, dataShards)
+	for r := 0; r < total; r++ {
+		for c := 0; c < dataShards; c++ {
+			vm[r][c] = gfExp(byte(r), c)
+		}
+	}
+	top, err := vm.subMatrix(0, dataShards).invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Codec{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       vm.multiply(top),
+	}, nil
+}
+
+// DataShards returns the number of data shards per block.
+func (c *Codec) DataShards() int { return c.dataShards }
+
+// ParityShards returns the number of parity shards per block.
+func (c *Codec) ParityShards() int { return c.parityShards }
+
+// TotalShards returns the total number of shards per block.
+func (c *Codec) TotalShards() int { return c.dataShards + c.parityShards }
+
+// ShardSize returns the size of each shard of a block with the given
+// size.
+func (c *Codec) ShardSize(blockSize int) int {
+	return (blockSize + c.dataShards - 1) / c.dataShards
+}
+
+// Encode splits block into data shards and returns them along with
+// the computed parity shards.
+func (c *Codec) Encode(block []byte) [][]byte {
+	size := c.ShardSize(len(block))
+	shards := make([][]byte, c.TotalShards())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < c.dataShards && i*size < len(block) {
+			copy(shards[i], block[i*size:])
+		}
+	}
+	c.encodeParity(shards)
+	return shards
+}
+
+// encodeParity computes the parity shards from the data shards.
+func (c *Codec) encodeParity(shards [][]byte) {
+	for p := c.dataShards; p < len(shards); p++ {
+		c.matrix.multiplyRow(p, shards[:c.dataShards], shards[p])
+	}
+}
+
+// Reconstruct fills in the missing (nil) entries in shards, which
+// must have length TotalShards(). At least DataShards() entries must
+// be non-nil, and all non-nil entries must have the same length.
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.TotalShards() {
+		return fmt.Errorf("wrong number of shards: %d != %d", len(shards), c.TotalShards())
+	}
+	size := -1
+	var have []int
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size < 0 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return ErrShardSize
+		}
+		have = append(have, i)
+	}
+	if len(have) == len(shards) {
+		return nil
+	} else if len(have) < c.dataShards {
+		return ErrTooFewShards
+	}
+	have = have[:c.dataShards]
+
+	// Recover any missing data shards by inverting the rows of
+	// the encoding matrix that correspond to the shards we have.
+	sub := newMatrix(c.dataShards, c.dataShards)
+	input := make([][]byte, c.dataShards)
+	for r, i := range have {
+		copy(sub[r], c.matrix[i])
+		input[r] = shards[i]
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < c.dataShards; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			dec.multiplyRow(i, input, shards[i])
+		}
+	}
+	// Recompute any missing parity shards from the (now
+	// complete) data shards.
+	for p := c.dataShards; p < len(shards); p++ {
+		if shards[p] == nil {
+			shards[p] = make([]byte, size)
+			c.matrix.multiplyRow(p, shards[:c.dataShards], shards[p])
+		}
+	}
+	return nil
+}
+
+// Join writes the original block content, which is blockSize bytes
+// long, from the data shards to w. The data shards must all be
+// present.
+func (c *Codec) Join(w io.Writer, shards [][]byte, blockSize int) error {
+	if len(shards) < c.dataShards {
+		return ErrTooFewShards
+	}
+	todo := blockSize
+	for _, shard := range shards[:c.dataShards] {
+		if shard == nil {
+			return ErrTooFewShards
+		}
+		if todo == 0 {
+			break
+		}
+		n := len(shard)
+		if n > todo {
+			n = todo
+		}
+		if _, err := w.Write(shard[:n]); err != nil {
+			return err
+		}
+		todo -= n
+	}
+	if todo > 0 {
+		return ErrShardSize
+	}
+	return nil
+}
+
+var shardKeyRegexp = regexp.MustCompile(`^([0-9a-f]{32})\.(\d+)\.(\d+)$`)
+
+// ShardKey returns the name used to store the given shard of a block
+// on a volume, like "{hash}.{blocksize}.{shardindex}".
+func ShardKey(hash string, blockSize, index int) string {
+	return fmt.Sprintf("%s.%d.%d", hash, blockSize, index)
+}
+
+// ParseShardKey returns the block hash, block size, and shard index
+// encoded in a key returned by ShardKey. If key is not a shard key,
+// ok is false.
+func ParseShardKey(key string) (hash string, blockSize, index int, ok bool) {
+	m := shardKeyRegexp.FindStringSubmatch(key)
+	if m == nil {
+		return "", 0, 0, false
+	}
+	blockSize, err := strconv.Atoi(m[2])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	index, err = strconv.Atoi(m[3])
+	if err != nil || index > 255 {
+		return "", 0, 0, false
+	}
+	return m[1], blockSize, index, true
+}
@@ -0,0 +1,138 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package erasure
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestReconstruct(t *testing.T) {
+	for _, trial := range []struct {
+		data, parity, size int
+	}{
+		{1, 1, 0},
+		{1, 2, 100},
+		{4, 2, 1},
+		{4, 2, 1000},
+		{6, 3, 1 << 16},
+		{6, 3, 1<<16 + 1},
+		{10, 4, 12345},
+	} {
+		codec, err := New(trial.data, trial.parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := make([]byte, trial.size)
+		rand.Read(block)
+		shards := codec.Encode(block)
+		if len(shards) != trial.data+trial.parity {
+			t.Fatalf("%+v: got %d shards", trial, len(shards))
+		}
+		// Try losing each possible combination of "parity"
+		// consecutive shards (wrapping around).
+		for first := range shards {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			for i := 0; i < trial.parity; i++ {
+				damaged[(first+i)%len(damaged)] = nil
+			}
+			if err := codec.Reconstruct(damaged); err != nil {
+				t.Fatalf("%+v: reconstruct: %s", trial, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Errorf("%+v: shard %d was not reconstructed correctly", trial, i)
+				}
+			}
+			var buf bytes.Buffer
+			if err := codec.Join(&buf, damaged, trial.size); err != nil {
+				t.Fatalf("%+v: join: %s", trial, err)
+			}
+			if !bytes.Equal(buf.Bytes(), block) {
+				t.Errorf("%+v: joined data does not match original block", trial)
+			}
+		}
+	}
+}
+
+func TestTooFewShards(t *testing.T) {
+	codec, err := New(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := codec.Encode([]byte("foobarbaz"))
+	shards[0], shards[3], shards[5] = nil, nil, nil
+	if err := codec.Reconstruct(shards); err != ErrTooFewShards {
+		t.Errorf("expected ErrTooFewShards, got %v", err)
+	}
+}
+
+func TestInvalidEncoding(t *testing.T) {
+	for _, nm := range [][2]int{{0, 1}, {1, -1}, {200, 57}} {
+		if _, err := New(nm[0], nm[1]); err != ErrInvalidEncoding {
+			t.Errorf("New(%d, %d): expected ErrInvalidEncoding, got %v", nm[0], nm[1], err)
+		}
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	hash := "acbd18db4cc2f85cedef654fccc4a4d8"
+	key := ShardKey(hash, 3, 7)
+	if key != hash+".3.7" {
+		t.Errorf("unexpected shard key %q", key)
+	}
+	gotHash, size, idx, ok := ParseShardKey(key)
+	if !ok || gotHash != hash || size != 3 || idx != 7 {
+		t.Errorf("ParseShardKey(%q) returned %q, %d, %d, %v", key, gotHash, size, idx, ok)
+	}
+	for _, bad := range []string{hash, hash + ".3", hash + ".3.256", hash + ".trash.123", "x" + key} {
+		if _, _, _, ok := ParseShardKey(bad); ok {
+			t.Errorf("ParseShardKey(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	hash := "acbd18db4cc2f85cedef654fccc4a4d8"
+	var vols []Volume
+	for _, srv := range []string{"a", "b", "c"} {
+		for i := 0; i < 3; i++ {
+			vols = append(vols, Volume{UUID: fmt.Sprintf("zzzzz-nyw5e-%s%014d", srv, i), FailureDomain: srv})
+		}
+	}
+	placement := Placement(hash, vols, 5)
+	perDomain := map[byte]int{}
+	seen := map[string]bool{}
+	for i, uuid := range placement {
+		if uuid == "" || seen[uuid] {
+			t.Fatalf("shard %d placed on %q in %q", i, uuid, placement)
+		}
+		seen[uuid] = true
+		perDomain[uuid[12]]++
+	}
+	for domain, n := range perDomain {
+		if n > 2 {
+			t.Errorf("%d of 5 shards placed in failure domain %c", n, domain)
+		}
+	}
+
+	// Order of the input list doesn't matter.
+	rev := make([]Volume, len(vols))
+	for i, vol := range vols {
+		rev[len(vols)-1-i] = vol
+	}
+	if again := Placement(hash, rev, 5); fmt.Sprint(again) != fmt.Sprint(placement) {
+		t.Errorf("placement depends on input order: %q != %q", again, placement)
+	}
+
+	// Not enough volumes.
+	placement = Placement(hash, vols[:2], 3)
+	if placement[0] == "" || placement[1] == "" || placement[2] != "" {
+		t.Errorf("unexpected placement with too few volumes: %q", placement)
+	}
+}
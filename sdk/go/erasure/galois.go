@@ -0,0 +1,156 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package erasure
+
+import "errors"
+
+// Arithmetic in GF(2^8) using the primitive polynomial
+// x^8+x^4+x^3+x^2+1 (0x11d) and generator 2.
+
+var (
+	gfLogTable [256]byte
+	gfExpTable [510]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExpTable[i] = byte(x)
+		gfExpTable[i+255] = byte(x)
+		gfLogTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExpTable[int(gfLogTable[a])+int(gfLogTable[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExpTable[int(gfLogTable[a])+255-int(gfLogTable[b])]
+}
+
+// gfExp returns a**n.
+func gfExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	} else if a == 0 {
+		return 0
+	}
+	return gfExpTable[(int(gfLogTable[a])*n)%255]
+}
+
+var errSingular = errors.New("matrix is singular")
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+// subMatrix returns a copy of rows [start,end).
+func (m matrix) subMatrix(start, end int) matrix {
+	sub := newMatrix(end-start, len(m[0]))
+	for r := range sub {
+		copy(sub[r], m[start+r])
+	}
+	return sub
+}
+
+func (m matrix) multiply(n matrix) matrix {
+	out := newMatrix(len(m), len(n[0]))
+	for r := range out {
+		for c := range out[r] {
+			var v byte
+			for i := range n {
+				v ^= gfMul(m[r][i], n[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// multiplyRow computes the dot product of row r of m with the given
+// input vectors, and stores the result in out.
+func (m matrix) multiplyRow(r int, input [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for c, coef := range m[r] {
+		if coef == 0 {
+			continue
+		}
+		in := input[c]
+		if coef == 1 {
+			for i := range out {
+				out[i] ^= in[i]
+			}
+			continue
+		}
+		logCoef := int(gfLogTable[coef])
+		for i, v := range in {
+			if v != 0 {
+				out[i] ^= gfExpTable[logCoef+int(gfLogTable[v])]
+			}
+		}
+	}
+}
+
+// invert returns the inverse of a square matrix, using Gauss-Jordan
+// elimination.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		if work[c][c] == 0 {
+			for r := c + 1; r < n; r++ {
+				if work[r][c] != 0 {
+					work[c], work[r] = work[r], work[c]
+					break
+				}
+			}
+		}
+		if work[c][c] == 0 {
+			return nil, errSingular
+		}
+		if pivot := work[c][c]; pivot != 1 {
+			for i := range work[c] {
+				work[c][i] = gfDiv(work[c][i], pivot)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			f := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(f, work[c][i])
+			}
+		}
+	}
+	inv := newMatrix(n, n)
+	for r := range inv {
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
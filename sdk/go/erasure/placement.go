@@ -0,0 +1,67 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package erasure
+
+import (
+	"bytes"
+	"crypto/md5"
+	"sort"
+)
+
+// A Volume is a candidate location for storing shards.
+type Volume struct {
+	UUID string
+
+	// Volumes with the same FailureDomain are expected to become
+	// unavailable together, e.g., because they are attached to
+	// the same server.
+	FailureDomain string
+}
+
+// Placement returns the UUIDs of the volumes where shards 0 through
+// total-1 of the block with the given hash should be stored. If there
+// are fewer than total volumes, the remaining entries are "".
+//
+// Each shard goes on a different volume. Volumes are considered in
+// rendezvous order (by md5 of hash and volume UUID), but each shard
+// goes in the failure domain that has been used the fewest times so
+// far, so losing one failure domain loses as few shards as possible.
+//
+// The result depends only on the hash, the volume UUIDs, and which
+// volumes share a failure domain, so keepstore and keep-balance
+// agree on the placement even though they describe failure domains
+// differently.
+func Placement(hash string, vols []Volume, total int) []string {
+	vols = append([]Volume(nil), vols...)
+	weight := make(map[string][md5.Size]byte, len(vols))
+	for _, vol := range vols {
+		weight[vol.UUID] = md5.Sum([]byte(hash + vol.UUID))
+	}
+	sort.Slice(vols, func(i, j int) bool {
+		wi, wj := weight[vols[i].UUID], weight[vols[j].UUID]
+		return bytes.Compare(wi[:], wj[:]) < 0
+	})
+	placement := make([]string, total)
+	used := make([]bool, len(vols))
+	domainUsed := map[string]int{}
+	for i := range placement {
+		best := -1
+		for j, vol := range vols {
+			if used[j] {
+				continue
+			}
+			if best < 0 || domainUsed[vol.FailureDomain] < domainUsed[vols[best].FailureDomain] {
+				best = j
+			}
+		}
+		if best < 0 {
+			break
+		}
+		used[best] = true
+		domainUsed[vols[best].FailureDomain]++
+		placement[i] = vols[best].UUID
+	}
+	return placement
+}
@@ -0,0 +1,22 @@
+# Copyright (C) The Arvados Authors. All rights reserved.
+#
+# SPDX-License-Identifier: AGPL-3.0
+
+class CreateWebdavLocks < ActiveRecord::Migration[5.2]
+  def change
+    # WebDAV locks held by keep-web clients. This table is read and
+    # updated by keep-web directly; it is not exposed through the
+    # API.
+    create_table :webdav_locks, :id => false do |t|
+      t.string :token, :null => false
+      t.string :collection_uuid, :null => false
+      t.text :path, :null => false
+      t.boolean :zero_depth, :null => false, :default => false
+      t.text :owner_xml
+      t.datetime :created_at, :null => false
+      t.datetime :expires_at, :null => false
+    end
+    add_index :webdav_locks, :token, :unique => true
+    add_index :webdav_locks, [:collection_uuid, :expires_at]
+  end
+end
@@ -1303,6 +1303,21 @@ CREATE SEQUENCE public.virtual_machines_id_seq
 ALTER SEQUENCE public.virtual_machines_id_seq OWNED BY public.virtual_machines.id;
 
 
+--
+-- Name: webdav_locks; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.webdav_locks (
+    token character varying NOT NULL,
+    collection_uuid character varying NOT NULL,
+    path text NOT NULL,
+    zero_depth boolean DEFAULT false NOT NULL,
+    owner_xml text,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL
+);
+
+
 --
 -- Name: workflows; Type: TABLE; Schema: public; Owner: -
 --
@@ -2730,6 +2745,20 @@ CREATE INDEX index_virtual_machines_on_owner_uuid ON public.virtual_machines USI
 CREATE UNIQUE INDEX index_virtual_machines_on_uuid ON public.virtual_machines USING btree (uuid);
 
 
+--
+-- Name: index_webdav_locks_on_collection_uuid_and_expires_at; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX index_webdav_locks_on_collection_uuid_and_expires_at ON public.webdav_locks USING btree (collection_uuid, expires_at);
+
+
+--
+-- Name: index_webdav_locks_on_token; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX index_webdav_locks_on_token ON public.webdav_locks USING btree (token);
+
+
 --
 -- Name: index_workflows_on_modified_at_uuid; Type: INDEX; Schema: public; Owner: -
 --
@@ -3147,6 +3176,7 @@ INSERT INTO "schema_migrations" (version) VALUES
 ('20210126183521'),
 ('20210621204455'),
 ('20210816191509'),
-('20211027154300');
+('20211027154300'),
+('20211115190510');
 
 
@@ -198,7 +198,18 @@ func (lr *LocalRun) run(dispatcher *dispatch.Dispatcher,
 		waitGroup.Add(1)
 		defer waitGroup.Done()
 
-		cmd := exec.Command(*crunchRunCommand, "--runtime-engine="+lr.cluster.Containers.RuntimeEngine, uuid)
+		args := []string{"--runtime-engine=" + lr.cluster.Containers.RuntimeEngine}
+		if d := lr.cluster.Containers.OutputCheckpointInterval; d > 0 {
+			args = append(args, "--output-checkpoint-interval="+d.String())
+			args = append(args, "--partial-output-ttl="+lr.cluster.Containers.PartialOutputTTL.String())
+		}
+		if lr.cluster.Containers.Logging.StructuredLogs {
+			args = append(args, "--structured-logs")
+			if lr.cluster.Containers.Logging.StructuredLogsIncludeStdio {
+				args = append(args, "--structured-logs-stdio")
+			}
+		}
+		cmd := exec.Command(*crunchRunCommand, append(args, uuid)...)
 		cmd.Stdin = nil
 		cmd.Stderr = os.Stderr
 		cmd.Stdout = os.Stderr
@@ -232,14 +232,14 @@ func (disp *Dispatcher) sbatchArgs(container arvados.Container) ([]string, error
 	if disp.cluster == nil {
 		// no instance types configured
 		args = append(args, disp.slurmConstraintArgs(container)...)
-	} else if it, err := dispatchcloud.ChooseInstanceType(disp.cluster, &container); err == dispatchcloud.ErrInstanceTypesNotConfigured {
+	} else if types, err := dispatchcloud.ChooseInstanceType(disp.cluster, &container); err == dispatchcloud.ErrInstanceTypesNotConfigured {
 		// ditto
 		args = append(args, disp.slurmConstraintArgs(container)...)
 	} else if err != nil {
 		return nil, err
 	} else {
 		// use instancetype constraint instead of slurm mem/cpu/tmp specs
-		args = append(args, "--constraint=instancetype="+it.Name)
+		args = append(args, "--constraint=instancetype="+types[0].Name)
 	}
 
 	if len(container.SchedulingParameters.Partitions) > 0 {
@@ -254,6 +254,16 @@ func (disp *Dispatcher) submit(container arvados.Container, crunchRunCommand []s
 	// underlying array, which is shared with other goroutines.
 	crArgs := append([]string(nil), crunchRunCommand...)
 	crArgs = append(crArgs, "--runtime-engine="+disp.cluster.Containers.RuntimeEngine)
+	if d := disp.cluster.Containers.OutputCheckpointInterval; d > 0 {
+		crArgs = append(crArgs, "--output-checkpoint-interval="+d.String())
+		crArgs = append(crArgs, "--partial-output-ttl="+disp.cluster.Containers.PartialOutputTTL.String())
+	}
+	if disp.cluster.Containers.Logging.StructuredLogs {
+		crArgs = append(crArgs, "--structured-logs")
+		if disp.cluster.Containers.Logging.StructuredLogsIncludeStdio {
+			crArgs = append(crArgs, "--structured-logs-stdio")
+		}
+	}
 	crArgs = append(crArgs, container.UUID)
 	crScript := strings.NewReader(execScript(crArgs))
 
@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/jmoiron/sqlx"
 	"github.com/sirupsen/logrus"
@@ -46,20 +47,43 @@ type Balancer struct {
 
 	LostBlocksFile string
 
+	// StateFile, if not empty, is where information gathered
+	// during the run is saved so the next run can be
+	// incremental.
+	StateFile string
+
 	*BlockStateMap
 	KeepServices       map[string]*KeepService
 	DefaultReplication int
 	MinMtime           int64
 
+	// ErasureCoding maps each erasure-coded storage class to its
+	// configuration.
+	ErasureCoding map[string]arvados.ErasureCodingConfig
+
 	classes       []string
 	mounts        int
 	mountsByClass map[string]map[*KeepMount]bool
+	shardVolumes  map[string][]erasure.Volume
 	collScanned   int64
+	corruptRepls  int64
 	serviceRoots  map[string]string
 	errors        []error
 	stats         balancerStats
 	mutex         sync.Mutex
 	lostBlocks    io.Writer
+
+	lifecycleRules []*lifecycleRule
+
+	// state gathered during this run, to be saved in StateFile
+	// (nil if StateFile is empty)
+	state *balanceState
+	// state saved by the previous run (nil if this is a full
+	// run)
+	prevState *balanceState
+
+	// per-project usage report (nil if not requested)
+	report *projectReport
 }
 
 // Run performs a balance operation using the given config and
@@ -79,6 +103,13 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(cluster.Collections.BalanceTimeout.Duration()))
 	defer cancel()
 
+	bal.ErasureCoding = map[string]arvados.ErasureCodingConfig{}
+	for class, sc := range cluster.StorageClasses {
+		if sc.ErasureCoding.Enabled() {
+			bal.ErasureCoding[class] = sc.ErasureCoding
+		}
+	}
+
 	var lbFile *os.File
 	if bal.LostBlocksFile != "" {
 		tmpfn := bal.LostBlocksFile + ".tmp"
@@ -143,6 +174,13 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		nextRunOptions.SafeRendezvousState = rs
 	}
 
+	if err = bal.setupLifecycleRules(ctx, cluster); err != nil {
+		return
+	}
+	bal.loadState(cluster)
+	if runOptions.ProjectReport {
+		bal.report = newProjectReport()
+	}
 	if err = bal.GetCurrentState(ctx, client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers); err != nil {
 		return
 	}
@@ -181,6 +219,13 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 			return
 		}
 	}
+	if bal.state != nil {
+		err = bal.state.save(bal.StateFile)
+		if err != nil {
+			err = fmt.Errorf("error saving state: %w", err)
+			return
+		}
+	}
 	return
 }
 
@@ -352,6 +397,10 @@ func (bal *Balancer) ClearTrashLists(ctx context.Context, c *arvados.Client) err
 // It determines the desired replication level by retrieving all
 // collection manifests in the database (API server).
 //
+// In an incremental run, it retrieves only the index entries and
+// collections that have changed since the previous run, and merges
+// them into the state saved by the previous run.
+//
 // It encodes the resulting information in BlockStateMap.
 func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pageSize, bufs int) error {
 	ctx, cancel := context.WithCancel(ctx)
@@ -359,6 +408,7 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 
 	defer bal.time("get_state", "wall clock time to get current state")()
 	bal.BlockStateMap = NewBlockStateMap()
+	bal.BlockStateMap.erasureCoding = bal.ErasureCoding
 
 	dd, err := c.DiscoveryDocument()
 	if err != nil {
@@ -397,8 +447,7 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 		wg.Add(1)
 		go func(mounts []*KeepMount) {
 			defer wg.Done()
-			bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
-			idx, err := mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, "")
+			idx, err := bal.getMountIndex(ctx, c, mounts)
 			if err != nil {
 				select {
 				case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
@@ -413,6 +462,10 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 				// will be wasted.
 				return
 			}
+			if bal.state != nil {
+				bal.state.setIndex(mounts[0].UUID, idx)
+			}
+			idx = bal.excludeCorruptReplicas(ctx, c, mounts[0], idx)
 			for _, mount := range mounts {
 				bal.logf("%s: add %d entries to map", mount, len(idx))
 				bal.BlockStateMap.AddReplicas(mount, idx)
@@ -422,56 +475,72 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 		}(mounts)
 	}
 
-	collQ := make(chan arvados.Collection, bufs)
-
-	// Retrieve all collections from the database and send them to
-	// collQ.
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err = EachCollection(ctx, bal.DB, c,
-			func(coll arvados.Collection) error {
-				collQ <- coll
-				if len(errs) > 0 {
-					// some other GetCurrentState
-					// error happened: no point
-					// getting any more
-					// collections.
-					return fmt.Errorf("")
+	if bal.prevState != nil {
+		// Update the collections saved by the previous run.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bal.addCollectionsIncremental(ctx)
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
 				}
-				return nil
-			}, func(done, total int) {
-				bal.logf("collections: %d/%d", done, total)
-			})
-		close(collQ)
-		if err != nil {
-			select {
-			case errs <- err:
-			default:
+				cancel()
 			}
-			cancel()
-		}
-	}()
+		}()
+	} else {
+		collQ := make(chan arvados.Collection, bufs)
 
-	// Parse manifests from collQ and pass the block hashes to
-	// BlockStateMap to track desired replication.
-	for i := 0; i < runtime.NumCPU(); i++ {
+		// Retrieve all collections from the database and send them to
+		// collQ.
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for coll := range collQ {
-				err := bal.addCollection(coll)
-				if err != nil || len(errs) > 0 {
-					select {
-					case errs <- err:
-					default:
+			err = EachCollection(ctx, bal.DB, c,
+				func(coll arvados.Collection) error {
+					collQ <- coll
+					if len(errs) > 0 {
+						// some other GetCurrentState
+						// error happened: no point
+						// getting any more
+						// collections.
+						return fmt.Errorf("")
 					}
-					cancel()
-					continue
+					return nil
+				}, func(done, total int) {
+					bal.logf("collections: %d/%d", done, total)
+				})
+			close(collQ)
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
 				}
-				atomic.AddInt64(&bal.collScanned, 1)
+				cancel()
 			}
 		}()
+
+		// Parse manifests from collQ and pass the block hashes to
+		// BlockStateMap to track desired replication.
+		for i := 0; i < runtime.NumCPU(); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for coll := range collQ {
+					err := bal.addCollection(coll)
+					if err != nil || len(errs) > 0 {
+						select {
+						case errs <- err:
+						default:
+						}
+						cancel()
+						continue
+					}
+					atomic.AddInt64(&bal.collScanned, 1)
+				}
+			}()
+		}
 	}
 
 	wg.Wait()
@@ -481,11 +550,52 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 	return nil
 }
 
+// excludeCorruptReplicas returns the given index entries, minus the
+// ones keepstore has reported as corrupt. This ensures corrupt
+// replicas are not counted, so good copies can be pulled to replace
+// them.
+func (bal *Balancer) excludeCorruptReplicas(ctx context.Context, c *arvados.Client, mount *KeepMount, idx []arvados.KeepServiceIndexEntry) []arvados.KeepServiceIndexEntry {
+	corrupt, err := mount.KeepService.CorruptBlocksMount(ctx, c, mount.UUID)
+	if err != nil {
+		// Older keepstore versions don't support this, so
+		// carry on without it.
+		bal.logf("mount %s: error retrieving list of corrupt blocks (ignored): %v", mount, err)
+		return idx
+	}
+	if len(corrupt) == 0 {
+		return idx
+	}
+	isCorrupt := make(map[arvados.SizedDigest]bool, len(corrupt))
+	for _, ent := range corrupt {
+		isCorrupt[ent.SizedDigest] = true
+	}
+	good := make([]arvados.KeepServiceIndexEntry, 0, len(idx))
+	for _, ent := range idx {
+		if !ent.IsShard && isCorrupt[ent.SizedDigest] {
+			bal.logf("mount %s: excluding corrupt replica of block %s", mount, ent.SizedDigest)
+			atomic.AddInt64(&bal.corruptRepls, 1)
+			continue
+		}
+		good = append(good, ent)
+	}
+	return good
+}
+
 func (bal *Balancer) addCollection(coll arvados.Collection) error {
 	blkids, err := coll.SizedDigests()
 	if err != nil {
 		return fmt.Errorf("%v: %v", coll.UUID, err)
 	}
+	if bal.state != nil {
+		bal.state.setCollection(newCollectionState(coll, blkids))
+	}
+	bal.addCollectionBlocks(coll, blkids)
+	return nil
+}
+
+// addCollectionBlocks updates the desired replication of the given
+// blocks, which are referenced by the given collection.
+func (bal *Balancer) addCollectionBlocks(coll arvados.Collection, blkids []arvados.SizedDigest) {
 	repl := bal.DefaultReplication
 	if coll.ReplicationDesired != nil {
 		repl = *coll.ReplicationDesired
@@ -497,8 +607,39 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 	if bal.LostBlocksFile != "" {
 		pdh = coll.PortableDataHash
 	}
-	bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl, blkids)
-	return nil
+	classes := coll.StorageClassesDesired
+	if newClasses, applied := bal.applyLifecycleRules(coll); len(applied) > 0 {
+		// The new storage classes will be saved in
+		// updateCollections. Until then, the old classes are
+		// still in effect (the update is skipped if the
+		// collection has been modified since we read it), so
+		// the blocks are wanted in both.
+		bal.Logger.Debugf("%v: lifecycle rules change storage classes from %v to %v", coll.UUID, classes, newClasses)
+		for _, rule := range applied {
+			atomic.AddInt64(&rule.applied, 1)
+		}
+		classes = append([]string(nil), classes...)
+		for _, class := range newClasses {
+			found := false
+			for _, c := range classes {
+				found = found || c == class
+			}
+			if !found {
+				classes = append(classes, class)
+			}
+		}
+	}
+	bal.BlockStateMap.IncreaseDesired(pdh, classes, repl, blkids)
+	if bal.report != nil {
+		if len(classes) == 0 {
+			classes = defaultClasses
+		}
+		owners := make([]projectClass, len(classes))
+		for i, class := range classes {
+			owners[i] = bal.report.intern(coll.OwnerUUID, class)
+		}
+		bal.BlockStateMap.AddOwners(owners, blkids)
+	}
 }
 
 // ComputeChangeSets compares, for each known block, the current and
@@ -576,6 +717,7 @@ func (bal *Balancer) setupLookupTables() {
 	// class" case in balanceBlock depends on the order classes
 	// are considered.
 	sort.Strings(bal.classes)
+	bal.setupShardVolumes()
 }
 
 const (
@@ -648,6 +790,23 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		srvRendezvous[srv] = i
 	}
 
+	// Plan the shard layout for each erasure-coded storage
+	// class. If an erasure-coded class can't be satisfied that
+	// way (e.g., no server has enough volumes in the class), it
+	// is satisfied with full replicas instead, like any other
+	// class.
+	plans := map[string]*shardPlan{}
+	for _, class := range bal.classes {
+		if ec := bal.ErasureCoding[class]; ec.Enabled() && blk.Desired[class] > 0 {
+			if plan := bal.planShards(blkid, blk, class, ec, srvRendezvous); plan != nil {
+				plans[class] = plan
+			}
+		}
+	}
+	// shardSrc is a server that can reassemble the block from
+	// shards, in case there are no full replicas to pull from.
+	shardSrc := bal.shardSource(blk, srvRendezvous)
+
 	// Below we set underreplicated=true if we find any storage
 	// class that's currently underreplicated -- in that case we
 	// won't want to trash any replicas.
@@ -656,7 +815,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 	unsafeToDelete := make(map[int64]bool, len(slots))
 	for _, class := range bal.classes {
 		desired := blk.Desired[class]
-		if desired == 0 {
+		if desired == 0 || plans[class] != nil {
 			continue
 		}
 
@@ -777,6 +936,14 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 	}
 
+	for _, plan := range plans {
+		if !plan.complete() {
+			// Keep all full replicas until the shard set
+			// is complete.
+			underreplicated = true
+		}
+	}
+
 	// TODO: If multiple replicas are trashable, prefer the oldest
 	// replica that doesn't have a timestamp collision with
 	// others.
@@ -792,14 +959,21 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 	}
 
+	have := len(blk.Replicas)
+	if shardSrc != nil {
+		have++
+	}
 	classState := make(map[string]balancedBlockState, len(bal.classes))
 	for _, class := range bal.classes {
-		classState[class] = computeBlockState(slots, bal.mountsByClass[class], len(blk.Replicas), blk.Desired[class])
+		classState[class] = computeBlockState(slots, bal.mountsByClass[class], have, blk.Desired[class])
 	}
-	blockState := computeBlockState(slots, nil, len(blk.Replicas), 0)
+	blockState := computeBlockState(slots, nil, have, 0)
 
 	var lost bool
 	var changes []string
+	if len(plans) > 0 && have == 0 {
+		lost = true
+	}
 	for _, slot := range slots {
 		// TODO: request a Touch if Mtime is duplicated.
 		var change int
@@ -811,15 +985,21 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				From:        slot.mnt,
 			})
 			change = changeTrash
-		case slot.repl == nil && slot.want && len(blk.Replicas) == 0:
+		case slot.repl == nil && slot.want && have == 0:
 			lost = true
 			change = changeNone
 		case slot.repl == nil && slot.want && !slot.mnt.ReadOnly:
-			slot.mnt.KeepService.AddPull(Pull{
+			pull := Pull{
 				SizedDigest: blkid,
-				From:        blk.Replicas[0].KeepMount.KeepService,
 				To:          slot.mnt,
-			})
+			}
+			if len(blk.Replicas) > 0 {
+				pull.From = blk.Replicas[0].KeepMount.KeepService
+			} else {
+				pull.From = shardSrc
+				pull.FromShards = true
+			}
+			slot.mnt.KeepService.AddPull(pull)
 			change = changePull
 		case slot.repl != nil:
 			change = changeStay
@@ -835,6 +1015,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 			changes = append(changes, fmt.Sprintf("%s:%d/%s=%s,%d", srv.ServiceHost, srv.ServicePort, slot.mnt.UUID, changeName[change], mtime))
 		}
 	}
+	changes = append(changes, bal.balanceShards(blkid, blk, plans, shardSrc, underreplicated, classState, &blockState)...)
 	if bal.Dumper != nil {
 		bal.Dumper.Printf("%s refs=%d needed=%d unneeded=%d pulling=%v %v %v", blkid, blk.RefCount, blockState.needed, blockState.unneeded, blockState.pulling, blk.Desired, changes)
 	}
@@ -936,6 +1117,10 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	for result := range results {
 		bytes := result.blkid.Size()
 
+		if bal.report != nil {
+			bal.report.add(result)
+		}
+
 		if rc := int64(result.blk.RefCount); rc > 0 {
 			s.collectionBytes += rc * bytes
 			s.collectionBlockBytes += bytes
@@ -1033,6 +1218,9 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	}
 	bal.stats = s
 	bal.Metrics.UpdateStats(s)
+	if bal.report != nil {
+		bal.report.finish()
+	}
 }
 
 // PrintStatistics writes statistics about the computed changes to
@@ -1046,6 +1234,7 @@ func (bal *Balancer) PrintStatistics() {
 	bal.logf("%s overreplicated (have>want>0)", bal.stats.overrep)
 	bal.logf("%s unreferenced (have>want=0, new)", bal.stats.unref)
 	bal.logf("%s garbage (have>want=0, old)", bal.stats.garbage)
+	bal.logf("%d replicas reported corrupt by keepstore (not counted above)", atomic.LoadInt64(&bal.corruptRepls))
 	for _, class := range bal.classes {
 		cs := bal.stats.classStats[class]
 		bal.logf("===")
@@ -1054,6 +1243,10 @@ func (bal *Balancer) PrintStatistics() {
 		bal.logf("storage class %q: %s pulling", class, cs.pulling)
 		bal.logf("storage class %q: %s unachievable", class, cs.unachievable)
 	}
+	for _, rule := range bal.lifecycleRules {
+		bal.logf("===")
+		bal.logf("lifecycle rule %q: %d collections moving from storage class %q to %q", rule.name, atomic.LoadInt64(&rule.applied), rule.FromStorageClass, rule.ToStorageClass)
+	}
 	bal.logf("===")
 	bal.logf("%s total commitment (excluding unreferenced)", bal.stats.desired)
 	bal.logf("%s total usage", bal.stats.current)
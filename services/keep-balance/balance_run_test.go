@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -423,6 +424,31 @@ func (s *runSuite) TestRefuseSameDeviceDifferentVolumes(c *check.C) {
 	c.Check(pullReqs.Count(), check.Equals, 0)
 }
 
+func (s *runSuite) TestExcludeCorruptReplicas(c *check.C) {
+	mnt := &KeepMount{
+		KeepMount:   stubMounts["keep0.zzzzz.arvadosapi.com:25107"][0],
+		KeepService: &KeepService{KeepService: stubServices[0]},
+	}
+	reqs := s.stub.serveStatic("/mounts/"+mnt.UUID+"/corrupt", "acbd18db4cc2f85cedef654fccc4a4d8+3 12345678\n\n")
+	foo := arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	bar := arvados.SizedDigest("37b51d194a7513e45b56f6524f2d51f2+3")
+	idx := []arvados.KeepServiceIndexEntry{
+		{SizedDigest: foo, Mtime: 12345678},
+		{SizedDigest: bar, Mtime: 12345678},
+	}
+	bal := &Balancer{Logger: ctxlog.TestLogger(c)}
+	idx = bal.excludeCorruptReplicas(context.Background(), s.client, mnt, idx)
+	c.Check(reqs.Count(), check.Equals, 1)
+	c.Check(idx, check.DeepEquals, []arvados.KeepServiceIndexEntry{{SizedDigest: bar, Mtime: 12345678}})
+	c.Check(bal.corruptRepls, check.Equals, int64(1))
+
+	// A keepstore server that doesn't report corrupt blocks
+	// doesn't cause an error.
+	mnt.UUID = "zzzzz-ivpuk-999999999999999"
+	idx = bal.excludeCorruptReplicas(context.Background(), s.client, mnt, idx)
+	c.Check(idx, check.HasLen, 1)
+}
+
 func (s *runSuite) TestWriteLostBlocks(c *check.C) {
 	lostf, err := ioutil.TempFile("", "keep-balance-lost-blocks-test-")
 	c.Assert(err, check.IsNil)
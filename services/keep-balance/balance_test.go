@@ -95,6 +95,7 @@ func (bal *balancerSuite) SetUpTest(c *check.C) {
 	}
 
 	bal.MinMtime = time.Now().UnixNano() - bal.signatureTTL*1e9
+	bal.ErasureCoding = nil
 	bal.cleanupMounts()
 }
 
@@ -18,6 +18,14 @@ type Replica struct {
 	Mtime int64
 }
 
+// Shard is an erasure-coded shard of a block, as reported in a
+// keepstore index response.
+type Shard struct {
+	*KeepMount
+	Index int
+	Mtime int64
+}
+
 // BlockState indicates the desired storage class and number of
 // replicas (according to the collections we know about) and the
 // replicas actually stored (according to the keepstore indexes we
@@ -26,7 +34,9 @@ type BlockState struct {
 	Refs     map[string]bool // pdh => true (only tracked when len(Replicas)==0)
 	RefCount int
 	Replicas []Replica
+	Shards   []Shard
 	Desired  map[string]int
+	Owners   []projectClass // only tracked when a project report is requested
 	// TODO: Support combinations of classes ("private + durable")
 	// by replacing the map[string]int with a map[*[]string]int
 	// here, where the map keys come from a pool of semantically
@@ -46,6 +56,38 @@ func (bs *BlockState) addReplica(r Replica) {
 	bs.Refs = nil
 }
 
+func (bs *BlockState) addShard(sh Shard) {
+	// Unlike addReplica, we keep tracking PDHs: a block whose
+	// only copies are shards might still be reported as lost,
+	// if there are too few shards to reconstruct it.
+	bs.Shards = append(bs.Shards, sh)
+}
+
+// shardSets returns the number of servers that have a complete set
+// of the block's erasure-coded shards on mounts with the given
+// storage class.
+func (bs *BlockState) shardSets(class string, ec arvados.ErasureCodingConfig) int {
+	total := ec.DataShards + ec.ParityShards
+	indexes := map[*KeepService]map[int]bool{}
+	for _, sh := range bs.Shards {
+		if !sh.KeepMount.StorageClasses[class] || sh.Index >= total {
+			continue
+		}
+		srv := sh.KeepMount.KeepService
+		if indexes[srv] == nil {
+			indexes[srv] = map[int]bool{}
+		}
+		indexes[srv][sh.Index] = true
+	}
+	sets := 0
+	for _, idx := range indexes {
+		if len(idx) == total {
+			sets++
+		}
+	}
+	return sets
+}
+
 func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
 	if pdh != "" && len(bs.Replicas) == 0 {
 		// Note we only track PDHs if there's a possibility
@@ -69,11 +111,24 @@ func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
 	}
 }
 
+func (bs *BlockState) addOwner(pc projectClass) {
+	for _, o := range bs.Owners {
+		if o == pc {
+			return
+		}
+	}
+	bs.Owners = append(bs.Owners, pc)
+}
+
 // BlockStateMap is a goroutine-safe wrapper around a
 // map[arvados.SizedDigest]*BlockState.
 type BlockStateMap struct {
 	entries map[arvados.SizedDigest]*BlockState
 	mutex   sync.Mutex
+
+	// erasure-coded storage classes, used by
+	// GetConfirmedReplication to count complete shard sets
+	erasureCoding map[string]arvados.ErasureCodingConfig
 }
 
 // NewBlockStateMap returns a newly allocated BlockStateMap.
@@ -106,13 +161,21 @@ func (bsm *BlockStateMap) Apply(f func(arvados.SizedDigest, *BlockState)) {
 	}
 }
 
-// AddReplicas updates the map to indicate that mnt has a replica of
-// each block in idx.
+// AddReplicas updates the map to indicate that mnt has a replica (or
+// an erasure-coded shard) of each block in idx.
 func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceIndexEntry) {
 	bsm.mutex.Lock()
 	defer bsm.mutex.Unlock()
 
 	for _, ent := range idx {
+		if ent.IsShard {
+			bsm.get(ent.SizedDigest).addShard(Shard{
+				KeepMount: mnt,
+				Index:     ent.ShardIndex,
+				Mtime:     ent.Mtime,
+			})
+			continue
+		}
 		bsm.get(ent.SizedDigest).addReplica(Replica{
 			KeepMount: mnt,
 			Mtime:     ent.Mtime,
@@ -134,6 +197,21 @@ func (bsm *BlockStateMap) IncreaseDesired(pdh string, classes []string, n int, b
 	}
 }
 
+// AddOwners updates the map to indicate that the given blocks are
+// referenced by collections owned by the given projects, in the
+// given storage classes.
+func (bsm *BlockStateMap) AddOwners(owners []projectClass, blocks []arvados.SizedDigest) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	for _, blkid := range blocks {
+		blk := bsm.get(blkid)
+		for _, pc := range owners {
+			blk.addOwner(pc)
+		}
+	}
+}
+
 // GetConfirmedReplication returns the replication level of the given
 // blocks, considering only the specified storage classes.
 //
@@ -166,6 +244,15 @@ func (bsm *BlockStateMap) GetConfirmedReplication(blkids []arvados.SizedDigest,
 				perclass[c] = n + r.KeepMount.Replication
 			}
 		}
+		for c, ec := range bsm.erasureCoding {
+			// Each complete shard set counts as one
+			// replica.
+			sets := bsm.get(blkid).shardSets(c, ec)
+			total += sets
+			if n, ok := perclass[c]; ok {
+				perclass[c] = n + sets
+			}
+		}
 		if total == 0 {
 			return 0
 		}
@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 )
 
 // Pull is a request to retrieve a block from a remote server, and
@@ -18,6 +19,15 @@ type Pull struct {
 	arvados.SizedDigest
 	From *KeepService
 	To   *KeepMount
+
+	// If IsShard is true, To should store the erasure-coded shard
+	// with the given index, rather than a full replica.
+	IsShard    bool
+	ShardIndex int
+
+	// FromShards indicates that From does not have a full
+	// replica, but has enough shards to reconstruct the block.
+	FromShards bool
 }
 
 // MarshalJSON formats a pull request the way keepstore wants to see
@@ -28,8 +38,16 @@ func (p Pull) MarshalJSON() ([]byte, error) {
 		Servers   []string `json:"servers"`
 		MountUUID string   `json:"mount_uuid"`
 	}
+	locator := string(p.SizedDigest[:32])
+	if p.IsShard {
+		locator = erasure.ShardKey(locator, int(p.SizedDigest.Size()), p.ShardIndex)
+	} else if p.FromShards {
+		// The source server needs a size hint in order to
+		// find the shards.
+		locator = string(p.SizedDigest)
+	}
 	return json.Marshal(KeepstorePullRequest{
-		Locator:   string(p.SizedDigest[:32]),
+		Locator:   locator,
 		Servers:   []string{p.From.URLBase()},
 		MountUUID: p.To.KeepMount.UUID,
 	})
@@ -40,18 +58,27 @@ type Trash struct {
 	arvados.SizedDigest
 	Mtime int64
 	From  *KeepMount
+
+	// If IsShard is true, the erasure-coded shard with the given
+	// index should be deleted, rather than a full replica.
+	IsShard    bool
+	ShardIndex int
 }
 
 // MarshalJSON formats a trash request the way keepstore wants to see
-// it, i.e., as a bare locator with no +size hint.
+// it, i.e., as a bare locator with no +size hint, or a shard key.
 func (t Trash) MarshalJSON() ([]byte, error) {
 	type KeepstoreTrashRequest struct {
 		Locator    string `json:"locator"`
 		BlockMtime int64  `json:"block_mtime"`
 		MountUUID  string `json:"mount_uuid"`
 	}
+	locator := string(t.SizedDigest[:32])
+	if t.IsShard {
+		locator = erasure.ShardKey(locator, int(t.SizedDigest.Size()), t.ShardIndex)
+	}
 	return json.Marshal(KeepstoreTrashRequest{
-		Locator:    string(t.SizedDigest[:32]),
+		Locator:    locator,
 		BlockMtime: t.Mtime,
 		MountUUID:  t.From.KeepMount.UUID,
 	})
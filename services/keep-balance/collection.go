@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"runtime"
@@ -47,43 +48,15 @@ func EachCollection(ctx context.Context, db *sqlx.DB, c *arvados.Client, f func(
 	}
 	var newestModifiedAt time.Time
 
-	rows, err := db.QueryxContext(ctx, `SELECT
-		uuid, manifest_text, modified_at, portable_data_hash,
-		replication_desired, replication_confirmed, replication_confirmed_at,
-		storage_classes_desired, storage_classes_confirmed, storage_classes_confirmed_at,
-		is_trashed
-		FROM collections`)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
 	progressTicker := time.NewTicker(10 * time.Second)
 	defer progressTicker.Stop()
 	callCount := 0
-	for rows.Next() {
-		var coll arvados.Collection
-		var classesDesired, classesConfirmed []byte
-		err = rows.Scan(&coll.UUID, &coll.ManifestText, &coll.ModifiedAt, &coll.PortableDataHash,
-			&coll.ReplicationDesired, &coll.ReplicationConfirmed, &coll.ReplicationConfirmedAt,
-			&classesDesired, &classesConfirmed, &coll.StorageClassesConfirmedAt,
-			&coll.IsTrashed)
-		if err != nil {
-			return err
-		}
-
-		err = json.Unmarshal(classesDesired, &coll.StorageClassesDesired)
-		if err != nil && len(classesDesired) > 0 {
-			return err
-		}
-		err = json.Unmarshal(classesConfirmed, &coll.StorageClassesConfirmed)
-		if err != nil && len(classesConfirmed) > 0 {
-			return err
-		}
+	err = scanCollections(ctx, db, "", nil, func(coll arvados.Collection) error {
 		if newestModifiedAt.IsZero() || newestModifiedAt.Before(coll.ModifiedAt) {
 			newestModifiedAt = coll.ModifiedAt
 		}
 		callCount++
-		err = f(coll)
+		err := f(coll)
 		if err != nil {
 			return err
 		}
@@ -92,12 +65,12 @@ func EachCollection(ctx context.Context, db *sqlx.DB, c *arvados.Client, f func(
 			progress(callCount, expectCount)
 		default:
 		}
-	}
-	progress(callCount, expectCount)
-	err = rows.Close()
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	progress(callCount, expectCount)
 	if checkCount, err := countCollections(c, arvados.ResourceListParams{
 		Filters: []arvados.Filter{{
 			Attr:     "modified_at",
@@ -114,6 +87,47 @@ func EachCollection(ctx context.Context, db *sqlx.DB, c *arvados.Client, f func(
 	return nil
 }
 
+// scanCollections retrieves collections from the database, using the
+// given SQL condition (e.g., "WHERE modified_at >= $1") and
+// arguments, and calls f once for each one.
+func scanCollections(ctx context.Context, db *sqlx.DB, where string, args []interface{}, f func(arvados.Collection) error) error {
+	rows, err := db.QueryxContext(ctx, `SELECT
+		uuid, owner_uuid, manifest_text, modified_at, portable_data_hash,
+		replication_desired, replication_confirmed, replication_confirmed_at,
+		storage_classes_desired, storage_classes_confirmed, storage_classes_confirmed_at,
+		is_trashed
+		FROM collections `+where, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var coll arvados.Collection
+		var classesDesired, classesConfirmed []byte
+		err = rows.Scan(&coll.UUID, &coll.OwnerUUID, &coll.ManifestText, &coll.ModifiedAt, &coll.PortableDataHash,
+			&coll.ReplicationDesired, &coll.ReplicationConfirmed, &coll.ReplicationConfirmedAt,
+			&classesDesired, &classesConfirmed, &coll.StorageClassesConfirmedAt,
+			&coll.IsTrashed)
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal(classesDesired, &coll.StorageClassesDesired)
+		if err != nil && len(classesDesired) > 0 {
+			return err
+		}
+		err = json.Unmarshal(classesConfirmed, &coll.StorageClassesConfirmed)
+		if err != nil && len(classesConfirmed) > 0 {
+			return err
+		}
+		err = f(coll)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Close()
+}
+
 func (bal *Balancer) updateCollections(ctx context.Context, c *arvados.Client, cluster *arvados.Cluster) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -128,7 +142,7 @@ func (bal *Balancer) updateCollections(ctx context.Context, c *arvados.Client, c
 	collQ := make(chan arvados.Collection, cluster.Collections.BalanceCollectionBuffers)
 	go func() {
 		defer close(collQ)
-		err := EachCollection(ctx, bal.DB, c, func(coll arvados.Collection) error {
+		send := func(coll arvados.Collection) error {
 			if atomic.LoadInt64(&updated) >= int64(cluster.Collections.BalanceUpdateLimit) {
 				bal.logf("reached BalanceUpdateLimit (%d)", cluster.Collections.BalanceUpdateLimit)
 				cancel()
@@ -136,9 +150,18 @@ func (bal *Balancer) updateCollections(ctx context.Context, c *arvados.Client, c
 			}
 			collQ <- coll
 			return nil
-		}, func(done, total int) {
-			bal.logf("update collections: %d/%d (%d updated @ %.01f updates/s)", done, total, atomic.LoadInt64(&updated), float64(atomic.LoadInt64(&updated))/time.Since(threshold).Seconds())
-		})
+		}
+		var err error
+		if bal.prevState != nil {
+			// In an incremental run, the saved state
+			// is up to date, and has everything we need
+			// except the manifest text.
+			err = bal.state.eachSavedCollection(send)
+		} else {
+			err = EachCollection(ctx, bal.DB, c, send, func(done, total int) {
+				bal.logf("update collections: %d/%d (%d updated @ %.01f updates/s)", done, total, atomic.LoadInt64(&updated), float64(atomic.LoadInt64(&updated))/time.Since(threshold).Seconds())
+			})
+		}
 		if err != nil && err != context.Canceled {
 			select {
 			case errs <- err:
@@ -179,12 +202,21 @@ func (bal *Balancer) updateCollections(ctx context.Context, c *arvados.Client, c
 				if ctx.Err() != nil || len(errs) > 0 {
 					continue
 				}
-				blkids, err := coll.SizedDigests()
-				if err != nil {
+				saved := bal.state.collection(coll.UUID)
+				var blkids []arvados.SizedDigest
+				if bal.prevState != nil {
+					blkids = saved.Blocks
+				} else if blkids, err = coll.SizedDigests(); err != nil {
 					bal.logf("%s: %s", coll.UUID, err)
 					continue
 				}
-				repl := bal.BlockStateMap.GetConfirmedReplication(blkids, coll.StorageClassesDesired)
+				// If lifecycle rules apply, save the
+				// new storage classes, and confirm
+				// replication in the new classes.
+				classesDesired, applied := bal.applyLifecycleRules(coll)
+				moveClasses := len(applied) > 0
+
+				repl := bal.BlockStateMap.GetConfirmedReplication(blkids, classesDesired)
 
 				desired := bal.DefaultReplication
 				if coll.ReplicationDesired != nil {
@@ -201,28 +233,65 @@ func (bal *Balancer) updateCollections(ctx context.Context, c *arvados.Client, c
 				}
 				classes := emptyJSONArray
 				if repl > 0 {
-					classes, err = json.Marshal(coll.StorageClassesDesired)
+					classes, err = json.Marshal(classesDesired)
 					if err != nil {
 						bal.logf("BUG? json.Marshal(%v) failed: %s", classes, err)
 						continue
 					}
 				}
-				needUpdate := coll.ReplicationConfirmed == nil || *coll.ReplicationConfirmed != repl || len(coll.StorageClassesConfirmed) != len(coll.StorageClassesDesired)
-				for i := range coll.StorageClassesDesired {
-					if !needUpdate && coll.StorageClassesDesired[i] != coll.StorageClassesConfirmed[i] {
+				needUpdate := moveClasses || coll.ReplicationConfirmed == nil || *coll.ReplicationConfirmed != repl || len(coll.StorageClassesConfirmed) != len(classesDesired)
+				for i := range classesDesired {
+					if !needUpdate && classesDesired[i] != coll.StorageClassesConfirmed[i] {
 						needUpdate = true
 					}
 				}
 				if !needUpdate {
 					continue
 				}
-				_, err = tx.ExecContext(ctx, `update collections set
-					replication_confirmed=$1,
-					replication_confirmed_at=$2,
-					storage_classes_confirmed=$3,
-					storage_classes_confirmed_at=$2
-					where uuid=$4`,
-					repl, thresholdStr, classes, coll.UUID)
+				if moveClasses {
+					var desiredJSON []byte
+					desiredJSON, err = json.Marshal(classesDesired)
+					if err != nil {
+						bal.logf("BUG? json.Marshal(%v) failed: %s", classesDesired, err)
+						continue
+					}
+					// Don't overwrite changes made by
+					// users since we read the
+					// collection: the "modified_at"
+					// condition makes this a no-op if
+					// the collection has been updated.
+					var res sql.Result
+					res, err = tx.ExecContext(ctx, `update collections set
+						replication_confirmed=$1,
+						replication_confirmed_at=$2,
+						storage_classes_confirmed=$3,
+						storage_classes_confirmed_at=$2,
+						storage_classes_desired=$5
+						where uuid=$4 and modified_at=$6`,
+						repl, thresholdStr, classes, coll.UUID, desiredJSON, coll.ModifiedAt)
+					if err == nil {
+						var n int64
+						n, err = res.RowsAffected()
+						if err == nil && n == 0 {
+							// The collection was
+							// modified, so the
+							// stored classes are
+							// still in effect, and
+							// the saved state
+							// should reflect that.
+							bal.logf("%s: not applying lifecycle rules: collection was modified since it was read", coll.UUID)
+							continue
+						}
+					}
+				} else {
+					_, err = tx.ExecContext(ctx, `update collections set
+						replication_confirmed=$1,
+						replication_confirmed_at=$2,
+						storage_classes_confirmed=$3,
+						storage_classes_confirmed_at=$2
+						where uuid=$4`,
+						repl, thresholdStr, classes, coll.UUID)
+				}
 				if err != nil {
 					if ctx.Err() == nil {
 						bal.logf("%s: update failed: %s", coll.UUID, err)
@@ -230,6 +299,20 @@ func (bal *Balancer) updateCollections(ctx context.Context, c *arvados.Client, c
 					continue
 				}
 				atomic.AddInt64(&updated, 1)
+				if saved != nil {
+					// Keep the saved state
+					// consistent with the
+					// database.
+					saved.ReplicationConfirmed = &repl
+					if repl > 0 {
+						saved.StorageClassesConfirmed = classesDesired
+					} else {
+						saved.StorageClassesConfirmed = []string{}
+					}
+					if moveClasses {
+						saved.StorageClassesDesired = classesDesired
+					}
+				}
 				if txPending++; txPending >= txBatch {
 					err = flush(false)
 					if err != nil {
@@ -0,0 +1,290 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
+)
+
+// shardPlan is the desired layout of the erasure-coded shards of a
+// block in one storage class.
+//
+// Shard i belongs on the i'th volume returned by erasure.Placement,
+// which spreads the shards across servers so losing one server
+// loses as few shards as possible. This is where keepstore writes
+// them in the first place. A shard that is already stored on some
+// other volume is left where it is.
+type shardPlan struct {
+	class string
+	ec    arvados.ErasureCodingConfig
+
+	// have[i] is an existing copy of shard i, or nil.
+	have []*Shard
+	// want[i] is the mount where shard i should be, or nil if
+	// there is no suitable mount.
+	want []*KeepMount
+}
+
+// complete returns true if all shards are present.
+func (plan *shardPlan) complete() bool {
+	for _, sh := range plan.have {
+		if sh == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// present returns the number of shards present.
+func (plan *shardPlan) present() int {
+	n := 0
+	for _, sh := range plan.have {
+		if sh != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// setupShardVolumes prepares the list of volumes where shards can
+// be stored in each erasure-coded storage class, for use with
+// erasure.Placement. It must be called after mountsByClass is
+// populated.
+//
+// Volumes that are reported by the same set of servers are in the
+// same failure domain. This corresponds to keepstore's rule, which
+// uses the AccessViaHosts entries in the cluster config.
+func (bal *Balancer) setupShardVolumes() {
+	bal.shardVolumes = map[string][]erasure.Volume{}
+	for class := range bal.ErasureCoding {
+		servers := map[string][]string{}
+		writable := map[string]bool{}
+		for mnt := range bal.mountsByClass[class] {
+			servers[mnt.UUID] = append(servers[mnt.UUID], mnt.KeepService.UUID)
+			writable[mnt.UUID] = writable[mnt.UUID] || !mnt.ReadOnly
+		}
+		for uuid, srvs := range servers {
+			if !writable[uuid] {
+				continue
+			}
+			sort.Strings(srvs)
+			bal.shardVolumes[class] = append(bal.shardVolumes[class], erasure.Volume{
+				UUID:          uuid,
+				FailureDomain: strings.Join(srvs, " "),
+			})
+		}
+	}
+}
+
+// planShards returns the desired layout of blk's shards in the given
+// erasure-coded storage class. It returns nil if there is no complete
+// shard set already, and not enough writable volumes in the class to
+// store one.
+func (bal *Balancer) planShards(blkid arvados.SizedDigest, blk *BlockState, class string, ec arvados.ErasureCodingConfig, srvRendezvous map[*KeepService]int) *shardPlan {
+	total := ec.DataShards + ec.ParityShards
+	inClass := bal.mountsByClass[class]
+
+	// All writable volumes in the class, in order of
+	// preference. The first total entries are where shards
+	// 0..total-1 belong.
+	vols := bal.shardVolumes[class]
+	order := erasure.Placement(string(blkid[:32]), vols, len(vols))
+
+	plan := &shardPlan{
+		class: class,
+		ec:    ec,
+		have:  make([]*Shard, total),
+		want:  make([]*KeepMount, total),
+	}
+	// Prefer the copy of each shard that is on the volume where
+	// it belongs, then any other copy. Don't count two shards on
+	// the same volume.
+	used := map[string]bool{}
+	for pass := 0; pass < 2; pass++ {
+		for i := range blk.Shards {
+			sh := &blk.Shards[i]
+			if !inClass[sh.KeepMount] || sh.Index >= total || plan.have[sh.Index] != nil || used[sh.KeepMount.UUID] {
+				continue
+			}
+			if pass == 0 && (sh.Index >= len(order) || order[sh.Index] != sh.KeepMount.UUID) {
+				continue
+			}
+			plan.have[sh.Index] = sh
+			plan.want[sh.Index] = sh.KeepMount
+			used[sh.KeepMount.UUID] = true
+		}
+	}
+	if !plan.complete() && len(vols) < total {
+		return nil
+	}
+
+	// writableMount returns the best writable view of the given
+	// volume, in case it is reported by more than one server.
+	writableMount := func(uuid string) *KeepMount {
+		var best *KeepMount
+		for mnt := range inClass {
+			if mnt.UUID == uuid && !mnt.ReadOnly && (best == nil || srvRendezvous[mnt.KeepService] < srvRendezvous[best.KeepService]) {
+				best = mnt
+			}
+		}
+		return best
+	}
+	for i := range plan.want {
+		if plan.want[i] != nil {
+			continue
+		}
+		uuid := order[i]
+		if used[uuid] {
+			// The volume where shard i belongs is
+			// occupied by a different shard, so use the
+			// first unused volume instead.
+			uuid = ""
+			for _, u := range order {
+				if !used[u] {
+					uuid = u
+					break
+				}
+			}
+		}
+		if uuid != "" {
+			plan.want[i] = writableMount(uuid)
+			used[uuid] = true
+		}
+	}
+	return plan
+}
+
+// shardSource returns the server that has the most shards of blk in
+// an erasure-coded storage class that has enough shards to
+// reassemble it, or nil if there is no such class. Keepstore can read
+// shards from other servers' volumes as long as they are stored
+// where they belong, and always reads its own volumes.
+func (bal *Balancer) shardSource(blk *BlockState, srvRendezvous map[*KeepService]int) *KeepService {
+	classes := make([]string, 0, len(bal.ErasureCoding))
+	for class := range bal.ErasureCoding {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		ec := bal.ErasureCoding[class]
+		indexes := map[int]bool{}
+		count := map[*KeepService]int{}
+		for _, sh := range blk.Shards {
+			if !bal.mountsByClass[class][sh.KeepMount] || sh.Index >= ec.DataShards+ec.ParityShards {
+				continue
+			}
+			indexes[sh.Index] = true
+			count[sh.KeepMount.KeepService]++
+		}
+		if len(indexes) < ec.DataShards {
+			continue
+		}
+		var best *KeepService
+		for srv, n := range count {
+			if best == nil || n > count[best] || (n == count[best] && srvRendezvous[srv] < srvRendezvous[best]) {
+				best = srv
+			}
+		}
+		return best
+	}
+	return nil
+}
+
+// balanceShards adds the pull and trash requests needed to achieve
+// the given shard plans, and updates classState and blockState
+// accordingly. It returns a description of the changes, for
+// bal.Dumper.
+//
+// A complete shard set counts as one replica in its storage class.
+// Shards that are not part of any plan are trashed, but only if
+// the block is not underreplicated.
+func (bal *Balancer) balanceShards(blkid arvados.SizedDigest, blk *BlockState, plans map[string]*shardPlan, shardSrc *KeepService, underreplicated bool, classState map[string]balancedBlockState, blockState *balancedBlockState) []string {
+	var changes []string
+	dump := func(mnt *KeepMount, change, index int, mtime int64) {
+		if bal.Dumper != nil {
+			srv := mnt.KeepService
+			changes = append(changes, fmt.Sprintf("%s:%d/%s=%s,%d,shard%d", srv.ServiceHost, srv.ServicePort, mnt.UUID, changeName[change], mtime, index))
+		}
+	}
+
+	// Keep track of the wanted shards, including other views of
+	// the same volume via different servers.
+	wanted := map[*Shard]bool{}
+	wantedDev := map[string]bool{}
+	devKey := func(mnt *KeepMount, index int) string {
+		return fmt.Sprintf("%s/%d", mnt.UUID, index)
+	}
+
+	classes := make([]string, 0, len(plans))
+	for class := range plans {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		plan := plans[class]
+		var src *KeepService
+		if plan.present() < plan.ec.DataShards && len(blk.Replicas) > 0 {
+			src = blk.Replicas[0].KeepMount.KeepService
+		} else {
+			src = shardSrc
+		}
+		var state balancedBlockState
+		for i, sh := range plan.have {
+			if sh != nil {
+				wanted[sh] = true
+				wantedDev[devKey(sh.KeepMount, i)] = true
+				dump(sh.KeepMount, changeStay, i, sh.Mtime)
+				continue
+			}
+			mnt := plan.want[i]
+			if mnt == nil || src == nil {
+				state.unachievable = true
+				continue
+			}
+			mnt.KeepService.AddPull(Pull{
+				SizedDigest: blkid,
+				From:        src,
+				To:          mnt,
+				IsShard:     true,
+				ShardIndex:  i,
+			})
+			dump(mnt, changePull, i, 0)
+		}
+		if plan.complete() {
+			state.needed = 1
+		} else if !state.unachievable {
+			state.pulling = 1
+		}
+		classState[class] = state
+		blockState.needed += state.needed
+		blockState.pulling += state.pulling
+		blockState.unachievable = blockState.unachievable || state.unachievable
+	}
+
+	for i := range blk.Shards {
+		sh := &blk.Shards[i]
+		if wanted[sh] || wantedDev[devKey(sh.KeepMount, sh.Index)] {
+			continue
+		}
+		if underreplicated || sh.Mtime >= bal.MinMtime {
+			dump(sh.KeepMount, changeStay, sh.Index, sh.Mtime)
+			continue
+		}
+		sh.KeepMount.KeepService.AddTrash(Trash{
+			SizedDigest: blkid,
+			Mtime:       sh.Mtime,
+			From:        sh.KeepMount,
+			IsShard:     true,
+			ShardIndex:  sh.Index,
+		})
+		dump(sh.KeepMount, changeTrash, sh.Index, sh.Mtime)
+	}
+	return changes
+}
@@ -0,0 +1,230 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+// setupErasureCoding gives the server in the given probe position
+// (for known block 0) five mounts in the erasure-coded storage class
+// "ec", and returns them in the order keepstore would use to store
+// shards 0..4 of known block 0.
+func (bal *balancerSuite) setupErasureCoding(slot int) []*KeepMount {
+	bal.ErasureCoding = map[string]arvados.ErasureCodingConfig{
+		"ec": {DataShards: 3, ParityShards: 2},
+	}
+	srv := bal.srvList(0, slots{slot})[0]
+	srv.mounts = nil
+	for i := 0; i < 5; i++ {
+		srv.mounts = append(srv.mounts, &KeepMount{
+			KeepMount: arvados.KeepMount{
+				UUID:           fmt.Sprintf("zzzzz-mount-ec%013d", i+100*slot),
+				DeviceID:       fmt.Sprintf("ec-%d-%d", slot, i),
+				Replication:    1,
+				StorageClasses: map[string]bool{"ec": true},
+			},
+			KeepService: srv,
+		})
+	}
+	mnts := append([]*KeepMount(nil), srv.mounts...)
+	sort.Slice(mnts, func(i, j int) bool {
+		return rendezvousLess(mnts[i].UUID, mnts[j].UUID, knownBlkid(0))
+	})
+	bal.setupLookupTables()
+	return mnts
+}
+
+// shardList returns a "current shards" slice with the given shard
+// indexes stored on the given mounts.
+func (bal *balancerSuite) shardList(mnts []*KeepMount, indexes ...int) (shards []Shard) {
+	mtime := time.Now().UnixNano() - (bal.signatureTTL+86400)*1e9
+	for i, idx := range indexes {
+		shards = append(shards, Shard{KeepMount: mnts[i], Index: idx, Mtime: mtime})
+	}
+	return
+}
+
+type shardChanges struct {
+	pulls   []string // "mountUUID/index" or "mountUUID" for full replicas
+	trashes []string
+}
+
+func (bal *balancerSuite) balanceShards(c *check.C, blk *BlockState) (shardChanges, balanceResult) {
+	for _, srv := range bal.srvs {
+		srv.ChangeSet = &ChangeSet{}
+	}
+	result := bal.balanceBlock(knownBlkid(0), blk)
+	var chg shardChanges
+	for _, srv := range bal.srvs {
+		for _, pull := range srv.Pulls {
+			if pull.IsShard {
+				c.Check(pull.To.KeepService, check.Equals, srv)
+				chg.pulls = append(chg.pulls, fmt.Sprintf("%s/%d", pull.To.UUID, pull.ShardIndex))
+			} else {
+				chg.pulls = append(chg.pulls, pull.To.UUID)
+			}
+		}
+		for _, trash := range srv.Trashes {
+			if trash.IsShard {
+				chg.trashes = append(chg.trashes, fmt.Sprintf("%s/%d", trash.From.UUID, trash.ShardIndex))
+			} else {
+				chg.trashes = append(chg.trashes, trash.From.UUID)
+			}
+		}
+	}
+	sort.Strings(chg.pulls)
+	sort.Strings(chg.trashes)
+	return chg, result
+}
+
+func shardKeys(mnts []*KeepMount, indexes ...int) []string {
+	var keys []string
+	for _, idx := range indexes {
+		keys = append(keys, fmt.Sprintf("%s/%d", mnts[idx].UUID, idx))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (bal *balancerSuite) TestErasureCodingEncode(c *check.C) {
+	mnts := bal.setupErasureCoding(2)
+	chg, result := bal.balanceShards(c, &BlockState{
+		Replicas: bal.replList(0, slots{0, 1}),
+		Desired:  map[string]int{"ec": 1},
+	})
+	c.Check(chg.pulls, check.DeepEquals, shardKeys(mnts, 0, 1, 2, 3, 4))
+	c.Check(chg.trashes, check.IsNil)
+	c.Check(result.classState["ec"], check.Equals, balancedBlockState{pulling: 1})
+	for _, pull := range bal.srvList(0, slots{2})[0].Pulls {
+		c.Check(pull.From, check.Equals, bal.srvList(0, slots{0})[0])
+	}
+}
+
+func (bal *balancerSuite) TestErasureCodingComplete(c *check.C) {
+	mnts := bal.setupErasureCoding(2)
+	replicas := bal.replList(0, slots{0, 1})
+	chg, result := bal.balanceShards(c, &BlockState{
+		Replicas: replicas,
+		Shards:   bal.shardList(mnts, 0, 1, 2, 3, 4),
+		Desired:  map[string]int{"ec": 1},
+	})
+	c.Check(chg.pulls, check.IsNil)
+	c.Check(chg.trashes, check.DeepEquals, []string{replicas[0].UUID, replicas[1].UUID})
+	c.Check(result.classState["ec"], check.Equals, balancedBlockState{needed: 1})
+	c.Check(result.lost, check.Equals, false)
+}
+
+func (bal *balancerSuite) TestErasureCodingRebuild(c *check.C) {
+	mnts := bal.setupErasureCoding(2)
+	// Shard 3 is missing. Shard 2 is stored on the wrong mount,
+	// but it's not worth moving.
+	chg, _ := bal.balanceShards(c, &BlockState{
+		Shards:  bal.shardList([]*KeepMount{mnts[0], mnts[1], mnts[3], mnts[4]}, 0, 1, 2, 4),
+		Desired: map[string]int{"ec": 1},
+	})
+	c.Check(chg.pulls, check.DeepEquals, []string{fmt.Sprintf("%s/3", mnts[2].UUID)})
+	c.Check(chg.trashes, check.IsNil)
+	pulls := bal.srvList(0, slots{2})[0].Pulls
+	c.Assert(pulls, check.HasLen, 1)
+	c.Check(pulls[0].From, check.Equals, bal.srvList(0, slots{2})[0])
+}
+
+func (bal *balancerSuite) TestErasureCodingLost(c *check.C) {
+	mnts := bal.setupErasureCoding(2)
+	chg, result := bal.balanceShards(c, &BlockState{
+		Shards:  bal.shardList(mnts, 0, 1),
+		Desired: map[string]int{"ec": 1},
+	})
+	c.Check(chg.pulls, check.IsNil)
+	c.Check(chg.trashes, check.IsNil)
+	c.Check(result.lost, check.Equals, true)
+	c.Check(result.classState["ec"].unachievable, check.Equals, true)
+}
+
+func (bal *balancerSuite) TestErasureCodingToReplicas(c *check.C) {
+	mnts := bal.setupErasureCoding(2)
+	// No full replicas yet, so pull from the shards, and don't
+	// trash any shards.
+	chg, result := bal.balanceShards(c, &BlockState{
+		Shards:  bal.shardList(mnts, 0, 1, 2, 3, 4),
+		Desired: map[string]int{"default": 2},
+	})
+	c.Check(chg.pulls, check.HasLen, 2)
+	c.Check(chg.trashes, check.IsNil)
+	c.Check(result.lost, check.Equals, false)
+	for _, srv := range bal.srvList(0, slots{0, 1}) {
+		c.Assert(srv.Pulls, check.HasLen, 1)
+		c.Check(srv.Pulls[0].FromShards, check.Equals, true)
+		c.Check(srv.Pulls[0].From, check.Equals, bal.srvList(0, slots{2})[0])
+	}
+
+	// Once the full replicas exist, trash the shards.
+	chg, _ = bal.balanceShards(c, &BlockState{
+		Replicas: bal.replList(0, slots{0, 1}),
+		Shards:   bal.shardList(mnts, 0, 1, 2, 3, 4),
+		Desired:  map[string]int{"default": 2},
+	})
+	c.Check(chg.pulls, check.IsNil)
+	c.Check(chg.trashes, check.DeepEquals, shardKeys(mnts, 0, 1, 2, 3, 4))
+}
+
+func (bal *balancerSuite) TestErasureCodingSpreadAcrossServers(c *check.C) {
+	bal.ErasureCoding = map[string]arvados.ErasureCodingConfig{
+		"ec": {DataShards: 3, ParityShards: 2},
+	}
+	// Three servers with two erasure-coded mounts each.
+	for _, srv := range bal.srvList(0, slots{2, 3, 4}) {
+		srv.mounts = nil
+		for i := 0; i < 2; i++ {
+			srv.mounts = append(srv.mounts, &KeepMount{
+				KeepMount: arvados.KeepMount{
+					UUID:           fmt.Sprintf("%s-ec%d", srv.UUID, i),
+					Replication:    1,
+					StorageClasses: map[string]bool{"ec": true},
+				},
+				KeepService: srv,
+			})
+		}
+	}
+	bal.setupLookupTables()
+	chg, result := bal.balanceShards(c, &BlockState{
+		Replicas: bal.replList(0, slots{0, 1}),
+		Desired:  map[string]int{"ec": 1},
+	})
+	c.Check(chg.pulls, check.HasLen, 5)
+	c.Check(result.classState["ec"], check.Equals, balancedBlockState{pulling: 1})
+	for _, srv := range bal.srvList(0, slots{2, 3, 4}) {
+		// No server gets more than 2 of the 5 shards, so
+		// losing any one server leaves enough shards to
+		// reassemble the block.
+		c.Check(len(srv.Pulls) >= 1 && len(srv.Pulls) <= 2, check.Equals, true, check.Commentf("%s has %d shards", srv, len(srv.Pulls)))
+		for _, pull := range srv.Pulls {
+			c.Check(pull.From, check.Equals, bal.srvList(0, slots{0})[0])
+		}
+	}
+
+	// Once the shards are in place, nothing changes, and the
+	// full replicas are trashed.
+	var shards []Shard
+	for _, srv := range bal.srvList(0, slots{2, 3, 4}) {
+		for _, pull := range srv.Pulls {
+			shards = append(shards, Shard{KeepMount: pull.To, Index: pull.ShardIndex})
+		}
+	}
+	chg, result = bal.balanceShards(c, &BlockState{
+		Replicas: bal.replList(0, slots{0, 1}),
+		Shards:   shards,
+		Desired:  map[string]int{"ec": 1},
+	})
+	c.Check(chg.pulls, check.IsNil)
+	c.Check(chg.trashes, check.HasLen, 2)
+	c.Check(result.classState["ec"], check.Equals, balancedBlockState{needed: 1})
+}
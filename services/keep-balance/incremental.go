@@ -0,0 +1,347 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// incrementalOverlap is subtracted from the previous run's start
+// time when retrieving changes since the previous run, to allow for
+// clock skew between hosts, and database transactions that were in
+// progress when the previous run started.
+const incrementalOverlap = 5 * time.Minute
+
+// balanceState is the information gathered by a run that is saved
+// in BalanceStateFile, so the next run can be incremental.
+type balanceState struct {
+	// Start time of the run that saved this state
+	Started time.Time
+	// Start time of the most recent full run
+	FullRunStarted time.Time
+	// Collections, by UUID
+	Collections map[string]*collectionState
+	// Keepstore index entries, by mount UUID
+	Indexes map[string][]arvados.KeepServiceIndexEntry
+
+	mtx sync.Mutex
+}
+
+// collectionState is a collection, with the manifest text reduced to
+// the list of blocks it references.
+type collectionState struct {
+	UUID                    string
+	OwnerUUID               string
+	PortableDataHash        string
+	ModifiedAt              time.Time
+	ReplicationDesired      *int
+	ReplicationConfirmed    *int
+	StorageClassesDesired   []string
+	StorageClassesConfirmed []string
+	Blocks                  []arvados.SizedDigest
+
+	// The collection still exists in the database
+	seen bool
+}
+
+func newBalanceState(started time.Time) *balanceState {
+	return &balanceState{
+		Started:        started,
+		FullRunStarted: started,
+		Collections:    map[string]*collectionState{},
+		Indexes:        map[string][]arvados.KeepServiceIndexEntry{},
+	}
+}
+
+func newCollectionState(coll arvados.Collection, blkids []arvados.SizedDigest) *collectionState {
+	return &collectionState{
+		UUID:                    coll.UUID,
+		OwnerUUID:               coll.OwnerUUID,
+		PortableDataHash:        coll.PortableDataHash,
+		ModifiedAt:              coll.ModifiedAt,
+		ReplicationDesired:      coll.ReplicationDesired,
+		ReplicationConfirmed:    coll.ReplicationConfirmed,
+		StorageClassesDesired:   coll.StorageClassesDesired,
+		StorageClassesConfirmed: coll.StorageClassesConfirmed,
+		Blocks:                  blkids,
+	}
+}
+
+// collection returns an arvados.Collection with the saved fields
+// (but no manifest text).
+func (cs *collectionState) collection() arvados.Collection {
+	return arvados.Collection{
+		UUID:                    cs.UUID,
+		OwnerUUID:               cs.OwnerUUID,
+		PortableDataHash:        cs.PortableDataHash,
+		ModifiedAt:              cs.ModifiedAt,
+		ReplicationDesired:      cs.ReplicationDesired,
+		ReplicationConfirmed:    cs.ReplicationConfirmed,
+		StorageClassesDesired:   cs.StorageClassesDesired,
+		StorageClassesConfirmed: cs.StorageClassesConfirmed,
+	}
+}
+
+func (st *balanceState) setCollection(cs *collectionState) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.Collections[cs.UUID] = cs
+}
+
+// collection returns the saved state of the collection with the
+// given UUID, or nil if there is none.
+func (st *balanceState) collection(uuid string) *collectionState {
+	if st == nil {
+		return nil
+	}
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	return st.Collections[uuid]
+}
+
+func (st *balanceState) setIndex(mountUUID string, idx []arvados.KeepServiceIndexEntry) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.Indexes[mountUUID] = idx
+}
+
+// takeIndex removes and returns the saved index for the given mount.
+func (st *balanceState) takeIndex(mountUUID string) ([]arvados.KeepServiceIndexEntry, bool) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	idx, ok := st.Indexes[mountUUID]
+	delete(st.Indexes, mountUUID)
+	return idx, ok
+}
+
+func loadBalanceState(fnm string) (*balanceState, error) {
+	f, err := os.Open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var st balanceState
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&st)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", fnm, err)
+	}
+	if st.Collections == nil {
+		st.Collections = map[string]*collectionState{}
+	}
+	if st.Indexes == nil {
+		st.Indexes = map[string][]arvados.KeepServiceIndexEntry{}
+	}
+	return &st, nil
+}
+
+// save writes the state to the given file, replacing it atomically.
+func (st *balanceState) save(fnm string) error {
+	f, err := os.CreateTemp(filepath.Dir(fnm), filepath.Base(fnm)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	st.mtx.Lock()
+	err = gob.NewEncoder(bufw).Encode(st)
+	st.mtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding state: %w", err)
+	}
+	if err = bufw.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fnm)
+}
+
+// loadState prepares to save state for the next run, and, if a full
+// run is not due, loads the state saved by the previous run so this
+// run can be incremental.
+func (bal *Balancer) loadState(cluster *arvados.Cluster) {
+	bal.state, bal.prevState = nil, nil
+	if bal.StateFile == "" {
+		return
+	}
+	now := time.Now()
+	bal.state = newBalanceState(now)
+	prev, err := loadBalanceState(bal.StateFile)
+	if os.IsNotExist(err) {
+		bal.logf("no saved state in %s, doing a full run", bal.StateFile)
+		return
+	} else if err != nil {
+		bal.logf("error loading saved state, doing a full run: %s", err)
+		return
+	}
+	if age := now.Sub(prev.FullRunStarted); age > cluster.Collections.BalanceFullRunInterval.Duration() {
+		bal.logf("last full run started %v ago, doing a full run", age)
+		return
+	}
+	bal.prevState = prev
+	bal.state.FullRunStarted = prev.FullRunStarted
+	bal.logf("doing an incremental run: retrieving changes since previous run at %v", prev.Started)
+}
+
+// getMountIndex returns the index for the device attached to the
+// given (equivalent) mounts.
+//
+// In an incremental run, it retrieves the changes reported by each
+// of the mounts since the previous run, and merges them into the
+// saved index. If any of the mounts can't report changes, or there
+// is no saved index for the device, it retrieves the full index.
+func (bal *Balancer) getMountIndex(ctx context.Context, c *arvados.Client, mounts []*KeepMount) ([]arvados.KeepServiceIndexEntry, error) {
+	if bal.prevState != nil {
+		if prev, ok := bal.prevState.takeIndex(mounts[0].UUID); ok {
+			idx, err := bal.getMountIndexChanges(ctx, c, mounts, prev)
+			if err == nil {
+				return idx, nil
+			} else if ctx.Err() != nil {
+				return nil, err
+			}
+			bal.logf("mount %s: cannot retrieve changes, retrieving full index instead: %s", mounts[0], err)
+		}
+	}
+	bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
+	return mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, "")
+}
+
+func (bal *Balancer) getMountIndexChanges(ctx context.Context, c *arvados.Client, mounts []*KeepMount, prev []arvados.KeepServiceIndexEntry) ([]arvados.KeepServiceIndexEntry, error) {
+	since := bal.prevState.Started.Add(-incrementalOverlap)
+	var changes []arvados.KeepServiceIndexEntry
+	for _, mnt := range mounts {
+		bal.logf("mount %s: retrieve changes since %v from %s", mnt, since, mnt.KeepService)
+		ents, err := mnt.KeepService.IndexMountChanges(ctx, c, mnt.UUID, since)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, ents...)
+	}
+	bal.logf("mount %s: merging %d changes into %d saved index entries", mounts[0], len(changes), len(prev))
+	return mergeIndexChanges(prev, changes), nil
+}
+
+// indexKey returns a key that identifies the block or shard
+// described by an index entry, regardless of whether its size is
+// known.
+func indexKey(ent arvados.KeepServiceIndexEntry) string {
+	key := string(ent.SizedDigest)
+	if len(key) > 32 {
+		key = key[:32]
+	}
+	if ent.IsShard {
+		key += fmt.Sprintf(".%d", ent.ShardIndex)
+	}
+	return key
+}
+
+// mergeIndexChanges returns the index entries in idx, updated
+// according to the given changes. Changes with Mtime==0 indicate
+// blocks that no longer exist. If there are multiple changes for
+// the same block, the last one takes effect.
+func mergeIndexChanges(idx, changes []arvados.KeepServiceIndexEntry) []arvados.KeepServiceIndexEntry {
+	changed := make(map[string]arvados.KeepServiceIndexEntry, len(changes))
+	for _, ent := range changes {
+		changed[indexKey(ent)] = ent
+	}
+	merged := make([]arvados.KeepServiceIndexEntry, 0, len(idx)+len(changes))
+	for _, ent := range idx {
+		key := indexKey(ent)
+		if ch, ok := changed[key]; ok {
+			ent = ch
+			delete(changed, key)
+		}
+		if ent.Mtime != 0 {
+			merged = append(merged, ent)
+		}
+	}
+	for _, ent := range changed {
+		if ent.Mtime != 0 {
+			merged = append(merged, ent)
+		}
+	}
+	return merged
+}
+
+// addCollectionsIncremental updates the collections saved by the
+// previous run with the ones that have been modified or deleted
+// since then, and adds all of them to BlockStateMap.
+func (bal *Balancer) addCollectionsIncremental(ctx context.Context) error {
+	colls := bal.prevState.Collections
+	since := bal.prevState.Started.Add(-incrementalOverlap)
+	modified := 0
+	err := scanCollections(ctx, bal.DB, `WHERE modified_at >= $1`, []interface{}{since}, func(coll arvados.Collection) error {
+		blkids, err := coll.SizedDigests()
+		if err != nil {
+			return fmt.Errorf("%v: %v", coll.UUID, err)
+		}
+		colls[coll.UUID] = newCollectionState(coll, blkids)
+		modified++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err := bal.DB.QueryxContext(ctx, `SELECT uuid FROM collections`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return err
+		}
+		if cs, ok := colls[uuid]; ok {
+			cs.seen = true
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	deleted := 0
+	for uuid, cs := range colls {
+		if !cs.seen {
+			delete(colls, uuid)
+			deleted++
+			continue
+		}
+		bal.addCollectionBlocks(cs.collection(), cs.Blocks)
+		atomic.AddInt64(&bal.collScanned, 1)
+	}
+	bal.logf("collections: %d modified and %d deleted since previous run, %d total", modified, deleted, len(colls))
+	bal.state.mtx.Lock()
+	bal.state.Collections = colls
+	bal.state.mtx.Unlock()
+	return nil
+}
+
+// eachSavedCollection calls f for each collection in the saved
+// state.
+func (st *balanceState) eachSavedCollection(f func(arvados.Collection) error) error {
+	for _, cs := range st.Collections {
+		if err := f(cs.collection()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&incrementalSuite{})
+
+type incrementalSuite struct{}
+
+const (
+	fooBlock = arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	barBlock = arvados.SizedDigest("37b51d194a7513e45b56f6524f2d51f2+3")
+	bazBlock = arvados.SizedDigest("73feffa4b7f6bb68e44cf984c85f6e88+3")
+)
+
+func (s *incrementalSuite) TestMergeIndexChanges(c *check.C) {
+	idx := []arvados.KeepServiceIndexEntry{
+		{SizedDigest: fooBlock, Mtime: 1000},
+		{SizedDigest: barBlock, Mtime: 1000},
+		{SizedDigest: bazBlock, Mtime: 1000, IsShard: true, ShardIndex: 1},
+		{SizedDigest: bazBlock, Mtime: 1000, IsShard: true, ShardIndex: 2},
+	}
+	changes := []arvados.KeepServiceIndexEntry{
+		// foo was touched
+		{SizedDigest: fooBlock, Mtime: 2000},
+		// bar was trashed (size is not reported)
+		{SizedDigest: arvados.SizedDigest(string(barBlock)[:32]), Mtime: 0},
+		// baz shard 1 was trashed, shard 3 was written
+		{SizedDigest: bazBlock, Mtime: 0, IsShard: true, ShardIndex: 1},
+		{SizedDigest: bazBlock, Mtime: 3000, IsShard: true, ShardIndex: 3},
+		// baz was written and then trashed
+		{SizedDigest: bazBlock, Mtime: 3000},
+		{SizedDigest: arvados.SizedDigest(string(bazBlock)[:32]), Mtime: 0},
+	}
+	merged := mergeIndexChanges(idx, changes)
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].SizedDigest < merged[j].SizedDigest || (merged[i].SizedDigest == merged[j].SizedDigest && merged[i].ShardIndex < merged[j].ShardIndex)
+	})
+	c.Check(merged, check.DeepEquals, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: bazBlock, Mtime: 1000, IsShard: true, ShardIndex: 2},
+		{SizedDigest: bazBlock, Mtime: 3000, IsShard: true, ShardIndex: 3},
+		{SizedDigest: fooBlock, Mtime: 2000},
+	})
+}
+
+func (s *incrementalSuite) TestSaveLoad(c *check.C) {
+	fnm := filepath.Join(c.MkDir(), "state")
+	repl := 2
+	st := newBalanceState(time.Now())
+	st.setCollection(newCollectionState(arvados.Collection{
+		UUID:                  "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		OwnerUUID:             "zzzzz-j7d0g-aaaaaaaaaaaaaaa",
+		PortableDataHash:      "fa7aeb5140e2848d39b416daeef4ffc5+45",
+		ModifiedAt:            time.Now().Add(-time.Hour),
+		ReplicationDesired:    &repl,
+		StorageClassesDesired: []string{"default"},
+	}, []arvados.SizedDigest{fooBlock, barBlock}))
+	st.setIndex("zzzzz-ivpuk-000000000000000", []arvados.KeepServiceIndexEntry{{SizedDigest: fooBlock, Mtime: 1000}})
+	c.Assert(st.save(fnm), check.IsNil)
+
+	loaded, err := loadBalanceState(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(loaded.Started.Equal(st.Started), check.Equals, true)
+	c.Check(loaded.FullRunStarted.Equal(st.FullRunStarted), check.Equals, true)
+	c.Check(loaded.Indexes, check.DeepEquals, st.Indexes)
+	c.Assert(loaded.Collections, check.HasLen, 1)
+	cs := loaded.collection("zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	c.Assert(cs, check.NotNil)
+	c.Check(cs.Blocks, check.DeepEquals, []arvados.SizedDigest{fooBlock, barBlock})
+	c.Check(*cs.ReplicationDesired, check.Equals, 2)
+	c.Check(cs.collection().ModifiedAt.Equal(st.Collections[cs.UUID].ModifiedAt), check.Equals, true)
+
+	_, err = loadBalanceState(fnm + "-nonexistent")
+	c.Check(err, check.NotNil)
+}
+
+func (s *incrementalSuite) TestLoadState(c *check.C) {
+	fnm := filepath.Join(c.MkDir(), "state")
+	cluster := &arvados.Cluster{}
+	cluster.Collections.BalanceFullRunInterval = arvados.Duration(time.Hour)
+	bal := &Balancer{Logger: ctxlog.TestLogger(c), StateFile: fnm}
+
+	// No saved state => full run
+	bal.loadState(cluster)
+	c.Check(bal.prevState, check.IsNil)
+	c.Assert(bal.state, check.NotNil)
+	c.Check(bal.state.save(fnm), check.IsNil)
+
+	// Recent full run => incremental run
+	bal.loadState(cluster)
+	c.Check(bal.prevState, check.NotNil)
+	c.Check(bal.state.FullRunStarted.Equal(bal.prevState.FullRunStarted), check.Equals, true)
+	c.Check(bal.state.Started.After(bal.prevState.Started), check.Equals, true)
+
+	// Full run is due
+	cluster.Collections.BalanceFullRunInterval = arvados.Duration(time.Nanosecond)
+	bal.loadState(cluster)
+	c.Check(bal.prevState, check.IsNil)
+}
+
+func (s *runSuite) TestGetMountIndexIncremental(c *check.C) {
+	mnt := &KeepMount{
+		KeepMount:   stubMounts["keep0.zzzzz.arvadosapi.com:25107"][0],
+		KeepService: &KeepService{KeepService: stubServices[0]},
+	}
+	changesReqs := s.stub.serveStatic("/mounts/"+mnt.UUID+"/changes", "acbd18db4cc2f85cedef654fccc4a4d8+3 1700000001000000000\n37b51d194a7513e45b56f6524f2d51f2 0\n\n")
+	indexReqs := s.stub.serveStatic("/mounts/"+mnt.UUID+"/blocks", "acbd18db4cc2f85cedef654fccc4a4d8+3 1700000000000000000\n\n")
+	bal := &Balancer{Logger: ctxlog.TestLogger(c)}
+	bal.prevState = newBalanceState(time.Now().Add(-time.Hour))
+	bal.prevState.setIndex(mnt.UUID, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: fooBlock, Mtime: 1700000000000000000},
+		{SizedDigest: barBlock, Mtime: 1700000000000000000},
+	})
+	idx, err := bal.getMountIndex(context.Background(), s.client, []*KeepMount{mnt})
+	c.Check(err, check.IsNil)
+	c.Check(idx, check.DeepEquals, []arvados.KeepServiceIndexEntry{{SizedDigest: fooBlock, Mtime: 1700000001000000000}})
+	c.Check(changesReqs.Count(), check.Equals, 1)
+	c.Check(indexReqs.Count(), check.Equals, 0)
+	c.Check(changesReqs.reqs[0].URL.Query().Get("since"), check.Not(check.Equals), "")
+
+	// If the keepstore server can't report changes (here, the
+	// stub server responds 404), the full index is retrieved
+	// instead.
+	mnt.UUID = "zzzzz-ivpuk-999999999999999"
+	bal.prevState.setIndex(mnt.UUID, []arvados.KeepServiceIndexEntry{{SizedDigest: barBlock, Mtime: 1700000000000000000}})
+	indexReqs = s.stub.serveStatic("/mounts/"+mnt.UUID+"/blocks", "acbd18db4cc2f85cedef654fccc4a4d8+3 1700000000000000000\n\n")
+	idx, err = bal.getMountIndex(context.Background(), s.client, []*KeepMount{mnt})
+	c.Check(err, check.IsNil)
+	c.Check(idx, check.DeepEquals, []arvados.KeepServiceIndexEntry{{SizedDigest: fooBlock, Mtime: 1700000000000000000}})
+	c.Check(indexReqs.Count(), check.Equals, 1)
+}
@@ -0,0 +1,122 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// lifecycleRule is a configured lifecycle rule, with the set of
+// projects it applies to.
+type lifecycleRule struct {
+	name string
+	arvados.LifecycleRule
+
+	// projects is the set of UUIDs of ProjectUUID and its
+	// descendant projects (nil if ProjectUUID is empty).
+	projects map[string]bool
+	// modifiedBefore is the modified_at threshold: the rule
+	// applies to collections that have not been modified since
+	// this time.
+	modifiedBefore time.Time
+	// applied is the number of collections the rule has been
+	// applied to during the current run.
+	applied int64
+}
+
+// setupLifecycleRules loads the lifecycle rules from the cluster
+// config, and looks up the descendants of each rule's ProjectUUID
+// in the database.
+func (bal *Balancer) setupLifecycleRules(ctx context.Context, cluster *arvados.Cluster) error {
+	bal.lifecycleRules = nil
+	now := time.Now()
+	for name, rule := range cluster.Collections.BalanceLifecycleRules {
+		if rule.FromStorageClass == "" {
+			continue
+		}
+		lr := &lifecycleRule{
+			name:           name,
+			LifecycleRule:  rule,
+			modifiedBefore: now.Add(-rule.MinAge.Duration()),
+		}
+		if rule.ProjectUUID != "" {
+			var uuids []string
+			err := bal.DB.SelectContext(ctx, &uuids, `WITH RECURSIVE tree(uuid) AS (
+					SELECT $1::varchar
+					UNION
+					SELECT groups.uuid FROM groups, tree
+					WHERE groups.owner_uuid = tree.uuid AND groups.group_class = 'project')
+				SELECT uuid FROM tree`, rule.ProjectUUID)
+			if err != nil {
+				return err
+			}
+			lr.projects = make(map[string]bool, len(uuids))
+			for _, uuid := range uuids {
+				lr.projects[uuid] = true
+			}
+		}
+		bal.lifecycleRules = append(bal.lifecycleRules, lr)
+	}
+	sort.Slice(bal.lifecycleRules, func(i, j int) bool {
+		return bal.lifecycleRules[i].name < bal.lifecycleRules[j].name
+	})
+	return nil
+}
+
+// applyLifecycleRules returns the storage classes coll should have,
+// according to the lifecycle rules, and the rules that were applied
+// to get there (none, if coll.StorageClassesDesired is already
+// correct).
+//
+// Rules are applied in order of name, repeatedly, so a collection
+// can move through several classes in one run if it is old enough.
+func (bal *Balancer) applyLifecycleRules(coll arvados.Collection) (classes []string, applied []*lifecycleRule) {
+	classes = coll.StorageClassesDesired
+	for pass := 0; pass < len(bal.lifecycleRules); pass++ {
+		appliedThisPass := false
+		for _, rule := range bal.lifecycleRules {
+			if !coll.ModifiedAt.Before(rule.modifiedBefore) {
+				continue
+			}
+			if rule.projects != nil && !rule.projects[coll.OwnerUUID] {
+				continue
+			}
+			idx := -1
+			for i, class := range classes {
+				if class == rule.FromStorageClass {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				continue
+			}
+			// Replace FromStorageClass with
+			// ToStorageClass, unless ToStorageClass is
+			// already listed.
+			newClasses := make([]string, 0, len(classes))
+			for i, class := range classes {
+				if class == rule.ToStorageClass {
+					continue
+				} else if i == idx {
+					newClasses = append(newClasses, rule.ToStorageClass)
+				} else {
+					newClasses = append(newClasses, class)
+				}
+			}
+			classes = newClasses
+			applied = append(applied, rule)
+			appliedThisPass = true
+		}
+		if !appliedThisPass {
+			break
+		}
+	}
+	return
+}
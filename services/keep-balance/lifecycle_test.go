@@ -0,0 +1,108 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&lifecycleSuite{})
+
+type lifecycleSuite struct{}
+
+func (s *lifecycleSuite) TestApplyLifecycleRules(c *check.C) {
+	now := time.Now()
+	bal := &Balancer{
+		lifecycleRules: []*lifecycleRule{
+			{
+				name: "a-fast-to-warm",
+				LifecycleRule: arvados.LifecycleRule{
+					FromStorageClass: "fast",
+					ToStorageClass:   "warm",
+				},
+				modifiedBefore: now.Add(-30 * 24 * time.Hour),
+			},
+			{
+				name: "b-project-to-archive",
+				LifecycleRule: arvados.LifecycleRule{
+					FromStorageClass: "warm",
+					ToStorageClass:   "archive",
+					ProjectUUID:      "zzzzz-j7d0g-000000000000000",
+				},
+				projects: map[string]bool{
+					"zzzzz-j7d0g-000000000000000": true,
+					"zzzzz-j7d0g-111111111111111": true,
+				},
+				modifiedBefore: now.Add(-90 * 24 * time.Hour),
+			},
+		},
+	}
+	for _, trial := range []struct {
+		owner   string
+		age     time.Duration
+		classes []string
+		expect  []string
+		applied []string
+	}{
+		// too new
+		{"zzzzz-j7d0g-000000000000000", 24 * time.Hour, []string{"fast"}, []string{"fast"}, nil},
+		// fast -> warm
+		{"zzzzz-j7d0g-000000000000000", 60 * 24 * time.Hour, []string{"fast"}, []string{"warm"}, []string{"a-fast-to-warm"}},
+		// fast -> warm -> archive
+		{"zzzzz-j7d0g-111111111111111", 100 * 24 * time.Hour, []string{"fast"}, []string{"archive"}, []string{"a-fast-to-warm", "b-project-to-archive"}},
+		// not in project, so stays in warm
+		{"zzzzz-j7d0g-222222222222222", 100 * 24 * time.Hour, []string{"fast"}, []string{"warm"}, []string{"a-fast-to-warm"}},
+		// other classes are left alone
+		{"zzzzz-j7d0g-222222222222222", 100 * 24 * time.Hour, []string{"default", "fast"}, []string{"default", "warm"}, []string{"a-fast-to-warm"}},
+		// don't list warm twice
+		{"zzzzz-j7d0g-222222222222222", 100 * 24 * time.Hour, []string{"fast", "warm"}, []string{"warm"}, []string{"a-fast-to-warm"}},
+		// no matching classes
+		{"zzzzz-j7d0g-000000000000000", 100 * 24 * time.Hour, []string{"default"}, []string{"default"}, nil},
+	} {
+		coll := arvados.Collection{
+			OwnerUUID:             trial.owner,
+			ModifiedAt:            now.Add(-trial.age),
+			StorageClassesDesired: trial.classes,
+		}
+		classes, applied := bal.applyLifecycleRules(coll)
+		c.Check(classes, check.DeepEquals, trial.expect, check.Commentf("%+v", trial))
+		var names []string
+		for _, rule := range applied {
+			names = append(names, rule.name)
+		}
+		c.Check(names, check.DeepEquals, trial.applied, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *lifecycleSuite) TestAddCollectionKeepsOldClasses(c *check.C) {
+	bal := &Balancer{
+		Logger:             ctxlog.TestLogger(c),
+		BlockStateMap:      NewBlockStateMap(),
+		DefaultReplication: 2,
+		lifecycleRules: []*lifecycleRule{{
+			name: "fast-to-archive",
+			LifecycleRule: arvados.LifecycleRule{
+				FromStorageClass: "fast",
+				ToStorageClass:   "archive",
+			},
+			modifiedBefore: time.Now(),
+		}},
+	}
+	blkid := arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	bal.addCollectionBlocks(arvados.Collection{
+		ModifiedAt:            time.Now().Add(-time.Hour),
+		StorageClassesDesired: []string{"fast"},
+	}, []arvados.SizedDigest{blkid})
+	// Until updateCollections saves the new classes, the block
+	// is wanted in both the old and new classes.
+	bal.BlockStateMap.Apply(func(id arvados.SizedDigest, blk *BlockState) {
+		c.Check(id, check.Equals, blkid)
+		c.Check(blk.Desired, check.DeepEquals, map[string]int{"fast": 2, "archive": 2})
+	})
+}
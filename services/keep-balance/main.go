@@ -17,6 +17,7 @@ import (
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/lib/service"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"github.com/jmoiron/sqlx"
@@ -42,6 +43,8 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 		"send trash requests (delete unreferenced old blocks, and excess replicas of overreplicated blocks)")
 	flags.BoolVar(&options.CommitConfirmedFields, "commit-confirmed-fields", true,
 		"update collection fields (replicas_confirmed, storage_classes_confirmed, etc.)")
+	flags.BoolVar(&options.ProjectReport, "project-report", false,
+		"attribute storage usage to owning projects and storage classes, and serve the report at /report")
 	dumpFlag := flags.Bool("dump", false, "dump details for each block to stdout")
 	pprofAddr := flags.String("pprof", "", "serve Go profile data at `[addr]:port`")
 	// "show version" is implemented by service.Command, so we
@@ -78,6 +81,7 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 		"commit-pulls":            true,
 		"commit-trash":            true,
 		"commit-confirmed-fields": true,
+		"project-report":          true,
 		"dump":                    true,
 	}
 	flags.Visit(func(f *flag.Flag) {
@@ -123,11 +127,16 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 				Dumper:     options.Dumper,
 				DB:         db,
 			}
-			srv.Handler = &health.Handler{
+			mux := http.NewServeMux()
+			mux.Handle("/_health/", &health.Handler{
 				Token:  cluster.ManagementToken,
 				Prefix: "/_health/",
 				Routes: health.Routes{"ping": srv.CheckHealth},
+			})
+			if cluster.ManagementToken != "" {
+				mux.Handle("/report", auth.RequireLiteralToken(cluster.ManagementToken, http.HandlerFunc(srv.ServeReport)))
 			}
+			srv.Handler = mux
 
 			go srv.run()
 			return srv
@@ -0,0 +1,216 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// projectClass identifies an owning project (or user) and a storage
+// class in which it wants a block to be stored.
+type projectClass struct {
+	project string
+	class   string
+}
+
+// projectReport attributes storage usage to the projects that own
+// the collections referencing each block, by storage class.
+//
+// Blocks referenced by more than one project are counted in full
+// for each of them; ExclusiveBytes indicates how much of a
+// project's usage would be freed if the project's collections were
+// deleted.
+type projectReport struct {
+	Generated time.Time          `json:"generated_at"`
+	Rows      []projectReportRow `json:"items"`
+
+	// projects, by UUID, used to avoid storing a separate copy
+	// of each project UUID for each collection
+	projects map[string]string
+	rows     map[projectClass]*projectReportRow
+	mtx      sync.Mutex
+}
+
+type projectReportRow struct {
+	// Owner UUID of the collections that reference the blocks,
+	// or "" for unreferenced blocks
+	ProjectUUID  string `json:"project_uuid"`
+	StorageClass string `json:"storage_class"`
+	// Number of distinct blocks
+	Blocks int64 `json:"blocks"`
+	// Total size of distinct blocks
+	UniqueBytes int64 `json:"unique_bytes"`
+	// Total size of blocks not referenced by any other project
+	ExclusiveBytes int64 `json:"exclusive_bytes"`
+	// Total size of all replicas currently stored
+	ReplicatedBytes int64 `json:"replicated_bytes"`
+	// Blocks (and their total size) with fewer replicas than
+	// desired, including lost blocks
+	UnderreplicatedBlocks int64 `json:"underreplicated_blocks"`
+	UnderreplicatedBytes  int64 `json:"underreplicated_bytes"`
+	// Blocks (and their total size) with no replicas at all
+	LostBlocks int64 `json:"lost_blocks"`
+	LostBytes  int64 `json:"lost_bytes"`
+	// Total size of replicas that will be trashed
+	PendingTrashBytes int64 `json:"pending_trash_bytes"`
+}
+
+var projectReportCSVHeader = []string{
+	"project_uuid",
+	"storage_class",
+	"blocks",
+	"unique_bytes",
+	"exclusive_bytes",
+	"replicated_bytes",
+	"underreplicated_blocks",
+	"underreplicated_bytes",
+	"lost_blocks",
+	"lost_bytes",
+	"pending_trash_bytes",
+}
+
+func newProjectReport() *projectReport {
+	return &projectReport{
+		projects: map[string]string{},
+		rows:     map[projectClass]*projectReportRow{},
+	}
+}
+
+// intern returns a projectClass for the given project and class,
+// sharing the project UUID string with previous calls.
+func (rpt *projectReport) intern(project, class string) projectClass {
+	rpt.mtx.Lock()
+	defer rpt.mtx.Unlock()
+	if p, ok := rpt.projects[project]; ok {
+		project = p
+	} else {
+		rpt.projects[project] = project
+	}
+	return projectClass{project: project, class: class}
+}
+
+func (rpt *projectReport) row(pc projectClass) *projectReportRow {
+	row := rpt.rows[pc]
+	if row == nil {
+		row = &projectReportRow{ProjectUUID: pc.project, StorageClass: pc.class}
+		rpt.rows[pc] = row
+	}
+	return row
+}
+
+// add updates the report with the outcome of balancing a single
+// block.
+func (rpt *projectReport) add(result balanceResult) {
+	rpt.mtx.Lock()
+	defer rpt.mtx.Unlock()
+	bytes := result.blkid.Size()
+	owners := result.blk.Owners
+	if len(owners) == 0 {
+		// Unreferenced block: attribute existing replicas to
+		// the "" project.
+		for class, state := range result.classState {
+			if state.unneeded == 0 {
+				continue
+			}
+			row := rpt.row(projectClass{class: class})
+			row.Blocks++
+			row.UniqueBytes += bytes
+			row.ExclusiveBytes += bytes
+			row.ReplicatedBytes += bytes * int64(state.unneeded)
+			row.PendingTrashBytes += bytes * int64(state.unneeded)
+		}
+		return
+	}
+	exclusive := true
+	for _, pc := range owners[1:] {
+		if pc.project != owners[0].project {
+			exclusive = false
+			break
+		}
+	}
+	for _, pc := range owners {
+		state := result.classState[pc.class]
+		row := rpt.row(pc)
+		row.Blocks++
+		row.UniqueBytes += bytes
+		if exclusive {
+			row.ExclusiveBytes += bytes
+		}
+		row.ReplicatedBytes += bytes * int64(state.needed+state.unneeded)
+		row.PendingTrashBytes += bytes * int64(state.unneeded)
+		if result.lost {
+			row.LostBlocks++
+			row.LostBytes += bytes
+		}
+		if result.lost || state.pulling > 0 || state.unachievable {
+			row.UnderreplicatedBlocks++
+			row.UnderreplicatedBytes += bytes
+		}
+	}
+}
+
+// finish sorts the accumulated rows by project and storage class,
+// and marks the report as complete.
+func (rpt *projectReport) finish() {
+	rpt.mtx.Lock()
+	defer rpt.mtx.Unlock()
+	rpt.Rows = make([]projectReportRow, 0, len(rpt.rows))
+	for _, row := range rpt.rows {
+		rpt.Rows = append(rpt.Rows, *row)
+	}
+	sort.Slice(rpt.Rows, func(i, j int) bool {
+		if a, b := rpt.Rows[i].ProjectUUID, rpt.Rows[j].ProjectUUID; a != b {
+			return a < b
+		}
+		return rpt.Rows[i].StorageClass < rpt.Rows[j].StorageClass
+	})
+	rpt.Generated = time.Now()
+	rpt.rows = nil
+	rpt.projects = nil
+}
+
+// ServeHTTP writes the report as JSON, or as CSV if the request has
+// a "format=csv" query parameter.
+func (rpt *projectReport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if rpt == nil {
+		http.Error(w, "report not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	switch req.FormValue("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(rpt)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write(projectReportCSVHeader)
+		for _, row := range rpt.Rows {
+			cw.Write([]string{
+				row.ProjectUUID,
+				row.StorageClass,
+				strconv.FormatInt(row.Blocks, 10),
+				strconv.FormatInt(row.UniqueBytes, 10),
+				strconv.FormatInt(row.ExclusiveBytes, 10),
+				strconv.FormatInt(row.ReplicatedBytes, 10),
+				strconv.FormatInt(row.UnderreplicatedBlocks, 10),
+				strconv.FormatInt(row.UnderreplicatedBytes, 10),
+				strconv.FormatInt(row.LostBlocks, 10),
+				strconv.FormatInt(row.LostBytes, 10),
+				strconv.FormatInt(row.PendingTrashBytes, 10),
+			})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "unsupported format (use json or csv)", http.StatusBadRequest)
+	}
+}
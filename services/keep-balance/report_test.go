@@ -0,0 +1,161 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&reportSuite{})
+
+type reportSuite struct{}
+
+const (
+	projectA = "zzzzz-j7d0g-aaaaaaaaaaaaaaa"
+	projectB = "zzzzz-j7d0g-bbbbbbbbbbbbbbb"
+)
+
+func (s *reportSuite) TestAddCollectionOwners(c *check.C) {
+	bal := &Balancer{
+		Logger:             ctxlog.TestLogger(c),
+		BlockStateMap:      NewBlockStateMap(),
+		DefaultReplication: 2,
+		report:             newProjectReport(),
+	}
+	bal.addCollectionBlocks(arvados.Collection{OwnerUUID: projectA}, []arvados.SizedDigest{fooBlock, barBlock})
+	bal.addCollectionBlocks(arvados.Collection{OwnerUUID: projectA}, []arvados.SizedDigest{fooBlock})
+	bal.addCollectionBlocks(arvados.Collection{OwnerUUID: projectB, StorageClassesDesired: []string{"archive", "default"}}, []arvados.SizedDigest{barBlock})
+	c.Check(bal.BlockStateMap.get(fooBlock).Owners, check.DeepEquals, []projectClass{{projectA, "default"}})
+	c.Check(bal.BlockStateMap.get(barBlock).Owners, check.DeepEquals, []projectClass{{projectA, "default"}, {projectB, "archive"}, {projectB, "default"}})
+
+	// Owners are not tracked if no report was requested.
+	bal.report = nil
+	bal.addCollectionBlocks(arvados.Collection{OwnerUUID: projectA}, []arvados.SizedDigest{bazBlock})
+	c.Check(bal.BlockStateMap.get(bazBlock).Owners, check.HasLen, 0)
+}
+
+func (s *reportSuite) TestReport(c *check.C) {
+	rpt := newProjectReport()
+	pcA := rpt.intern(projectA, "default")
+	pcB := rpt.intern(projectB, "default")
+	// foo is only in project A, has 3 replicas, 1 unneeded
+	rpt.add(balanceResult{
+		blkid: fooBlock,
+		blk:   &BlockState{Owners: []projectClass{pcA}},
+		classState: map[string]balancedBlockState{
+			"default": {needed: 2, unneeded: 1},
+		},
+	})
+	// bar is shared by projects A and B, has 1 of 2 replicas
+	rpt.add(balanceResult{
+		blkid: barBlock,
+		blk:   &BlockState{Owners: []projectClass{pcA, pcB}},
+		classState: map[string]balancedBlockState{
+			"default": {needed: 1, pulling: 1},
+		},
+	})
+	// baz is in project B, and lost
+	rpt.add(balanceResult{
+		blkid: bazBlock,
+		blk:   &BlockState{Owners: []projectClass{pcB}},
+		lost:  true,
+		classState: map[string]balancedBlockState{
+			"default": {unachievable: true},
+		},
+	})
+	// an unreferenced block with 2 replicas
+	rpt.add(balanceResult{
+		blkid: arvados.SizedDigest("d41d8cd98f00b204e9800998ecf8427e+10"),
+		blk:   &BlockState{},
+		classState: map[string]balancedBlockState{
+			"default": {unneeded: 2},
+			"archive": {},
+		},
+	})
+	rpt.finish()
+	c.Check(rpt.Rows, check.DeepEquals, []projectReportRow{
+		{
+			StorageClass:      "default",
+			Blocks:            1,
+			UniqueBytes:       10,
+			ExclusiveBytes:    10,
+			ReplicatedBytes:   20,
+			PendingTrashBytes: 20,
+		},
+		{
+			ProjectUUID:           projectA,
+			StorageClass:          "default",
+			Blocks:                2,
+			UniqueBytes:           6,
+			ExclusiveBytes:        3,
+			ReplicatedBytes:       12,
+			UnderreplicatedBlocks: 1,
+			UnderreplicatedBytes:  3,
+			PendingTrashBytes:     3,
+		},
+		{
+			ProjectUUID:           projectB,
+			StorageClass:          "default",
+			Blocks:                2,
+			UniqueBytes:           6,
+			ExclusiveBytes:        3,
+			ReplicatedBytes:       3,
+			UnderreplicatedBlocks: 2,
+			UnderreplicatedBytes:  6,
+			LostBlocks:            1,
+			LostBytes:             3,
+		},
+	})
+}
+
+func (s *reportSuite) TestServeReport(c *check.C) {
+	srv := &Server{}
+	resp := httptest.NewRecorder()
+	srv.ServeReport(resp, httptest.NewRequest("GET", "/report", nil))
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	srv.RunOptions.ProjectReport = true
+	resp = httptest.NewRecorder()
+	srv.ServeReport(resp, httptest.NewRequest("GET", "/report", nil))
+	c.Check(resp.Code, check.Equals, http.StatusServiceUnavailable)
+
+	srv.report = newProjectReport()
+	srv.report.add(balanceResult{
+		blkid:      fooBlock,
+		blk:        &BlockState{Owners: []projectClass{{projectA, "default"}}},
+		classState: map[string]balancedBlockState{"default": {needed: 2}},
+	})
+	srv.report.finish()
+
+	resp = httptest.NewRecorder()
+	srv.ServeReport(resp, httptest.NewRequest("GET", "/report", nil))
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/json")
+	var rpt projectReport
+	c.Check(json.Unmarshal(resp.Body.Bytes(), &rpt), check.IsNil)
+	c.Check(rpt.Generated.IsZero(), check.Equals, false)
+	c.Check(rpt.Rows, check.DeepEquals, srv.report.Rows)
+
+	resp = httptest.NewRecorder()
+	srv.ServeReport(resp, httptest.NewRequest("GET", "/report?format=csv", nil))
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/csv")
+	c.Check(strings.Split(resp.Body.String(), "\n"), check.DeepEquals, []string{
+		strings.Join(projectReportCSVHeader, ","),
+		projectA + ",default,1,3,3,6,0,0,0,0,0",
+		"",
+	})
+
+	resp = httptest.NewRecorder()
+	srv.ServeReport(resp, httptest.NewRequest("GET", "/report?format=xml", nil))
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+}
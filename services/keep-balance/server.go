@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -28,6 +29,7 @@ type RunOptions struct {
 	CommitPulls           bool
 	CommitTrash           bool
 	CommitConfirmedFields bool
+	ProjectReport         bool
 	Logger                logrus.FieldLogger
 	Dumper                logrus.FieldLogger
 
@@ -50,6 +52,15 @@ type Server struct {
 	Dumper logrus.FieldLogger
 
 	DB *sqlx.DB
+
+	// most recent per-project usage report (see
+	// RunOptions.ProjectReport)
+	report *projectReport
+
+	// mtx protects RunOptions and report, which are updated by
+	// the run loop and read by ServeReport. The run loop itself
+	// can read RunOptions without locking.
+	mtx sync.Mutex
 }
 
 // CheckHealth implements service.Handler.
@@ -84,12 +95,31 @@ func (srv *Server) runOnce() (*Balancer, error) {
 		Dumper:         srv.Dumper,
 		Metrics:        srv.Metrics,
 		LostBlocksFile: srv.Cluster.Collections.BlobMissingReport,
+		StateFile:      srv.Cluster.Collections.BalanceStateFile,
 	}
-	var err error
-	srv.RunOptions, err = bal.Run(srv.ArvClient, srv.Cluster, srv.RunOptions)
+	runOptions, err := bal.Run(srv.ArvClient, srv.Cluster, srv.RunOptions)
+	srv.mtx.Lock()
+	srv.RunOptions = runOptions
+	if err == nil && bal.report != nil {
+		srv.report = bal.report
+	}
+	srv.mtx.Unlock()
 	return bal, err
 }
 
+// ServeReport serves the per-project usage report from the most
+// recent successful run.
+func (srv *Server) ServeReport(w http.ResponseWriter, req *http.Request) {
+	srv.mtx.Lock()
+	enabled, rpt := srv.RunOptions.ProjectReport, srv.report
+	srv.mtx.Unlock()
+	if !enabled {
+		http.Error(w, "project report not enabled (use the -project-report flag)", http.StatusNotFound)
+		return
+	}
+	rpt.ServeHTTP(w, req)
+}
+
 // RunForever runs forever, or (for testing purposes) until the given
 // stop channel is ready to receive.
 func (srv *Server) runForever(stop <-chan interface{}) error {
@@ -0,0 +1,244 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+// archiveFormats maps each supported archive format (as given in an
+// "archive" query parameter) to its filename extension and content
+// type.
+var archiveFormats = map[string]struct {
+	ext         string
+	contentType string
+}{
+	"zip":    {".zip", "application/zip"},
+	"tar":    {".tar", "application/x-tar"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+}
+
+// archiveFormat returns the archive format requested by r, either
+// with an "archive" query parameter (e.g., "?archive=zip") or with
+// an Accept header listing one of the archive content types. It
+// returns "" if no archive format was requested, or the requested
+// format is not supported.
+func archiveFormat(r *http.Request) string {
+	if format := r.FormValue("archive"); format != "" {
+		if format == "tgz" {
+			format = "tar.gz"
+		}
+		if _, ok := archiveFormats[format]; ok {
+			return format
+		}
+		return ""
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		switch mediatype {
+		case "application/zip":
+			return "zip"
+		case "application/x-tar":
+			return "tar"
+		case "application/gzip", "application/x-gzip", "application/x-gtar":
+			return "tar.gz"
+		}
+	}
+	return ""
+}
+
+// serveArchive sends the contents of directory dir in fs as a zip,
+// tar, or tar.gz archive. Files are read from fs as the archive is
+// written, so arbitrarily large directories can be sent without
+// buffering. In the archive, all entries are inside a top-level
+// directory called name.
+//
+// logpath and collection are passed to logUploadOrDownload.
+func (h *handler) serveArchive(w http.ResponseWriter, r *http.Request, fs http.FileSystem, dir, name, format string, arvclient *arvadosclient.ArvadosClient, logfs arvados.CustomFileSystem, logpath string, collection *arvados.Collection, tokenUser *arvados.User) {
+	if !h.userPermittedToUploadOrDownload("GET", tokenUser) {
+		http.Error(w, "Not permitted", http.StatusForbidden)
+		return
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "download"
+	}
+	name = strings.Replace(name, "/", "_", -1)
+	af := archiveFormats[format]
+	w.Header().Set("Content-Type", af.contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.QuoteToASCII(name+af.ext))
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	h.logUploadOrDownload(r, arvclient, logfs, logpath, collection, tokenUser)
+	w.WriteHeader(http.StatusOK)
+	err := writeArchive(w, fs, dir, name, format)
+	if err != nil {
+		// It's too late to send an error response. The
+		// client will see a truncated archive.
+		ctxlog.FromContext(r.Context()).WithError(err).Error("error writing archive")
+	}
+}
+
+// writeArchive writes the contents of directory dir in fs to w as an
+// archive in the given format, with all entries inside a top-level
+// directory called prefix.
+func writeArchive(w io.Writer, fs http.FileSystem, dir, prefix, format string) error {
+	var aw archiveWriter
+	switch format {
+	case "zip":
+		aw = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	case "tar":
+		aw = &tarArchiveWriter{tw: tar.NewWriter(w)}
+	case "tar.gz":
+		gzw := gzip.NewWriter(w)
+		aw = &tarArchiveWriter{tw: tar.NewWriter(gzw), gzw: gzw}
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+	err := walkArchive(fs, dir, prefix, aw)
+	if err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// walkArchive adds the directory dir (in fs) and everything
+// underneath it to aw, using name as the directory's name in the
+// archive.
+func walkArchive(fs http.FileSystem, dir, name string, aw archiveWriter) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	fi, err := d.Stat()
+	if err != nil {
+		d.Close()
+		return err
+	}
+	ents, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	err = aw.AddDir(name+"/", fi)
+	if err != nil {
+		return err
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	for _, ent := range ents {
+		fspath := path.Join(dir, ent.Name())
+		arcpath := name + "/" + ent.Name()
+		if ent.IsDir() {
+			err = walkArchive(fs, fspath, arcpath, aw)
+		} else if ent.Mode().IsRegular() {
+			err = addArchiveFile(fs, fspath, arcpath, ent, aw)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addArchiveFile(fs http.FileSystem, fspath, arcpath string, fi os.FileInfo, aw archiveWriter) error {
+	f, err := fs.Open(fspath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fw, err := aw.AddFile(arcpath, fi)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(fw, f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fspath, err)
+	} else if n != fi.Size() {
+		return fmt.Errorf("%s: read %d bytes, expected %d", fspath, n, fi.Size())
+	}
+	return nil
+}
+
+type archiveWriter interface {
+	AddDir(name string, fi os.FileInfo) error
+	AddFile(name string, fi os.FileInfo) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (aw *zipArchiveWriter) AddDir(name string, fi os.FileInfo) error {
+	_, err := aw.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Modified: fi.ModTime(),
+	})
+	return err
+}
+
+func (aw *zipArchiveWriter) AddFile(name string, fi os.FileInfo) (io.Writer, error) {
+	return aw.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Modified: fi.ModTime(),
+		// Most large data files are already compressed,
+		// so compressing again would only cost CPU time.
+		Method: zip.Store,
+	})
+}
+
+func (aw *zipArchiveWriter) Close() error {
+	return aw.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw  *tar.Writer
+	gzw *gzip.Writer // nil if not compressing
+}
+
+func (aw *tarArchiveWriter) AddDir(name string, fi os.FileInfo) error {
+	return aw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  fi.ModTime(),
+		Format:   tar.FormatPAX,
+	})
+}
+
+func (aw *tarArchiveWriter) AddFile(name string, fi os.FileInfo) (io.Writer, error) {
+	err := aw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     fi.Size(),
+		Mode:     0644,
+		ModTime:  fi.ModTime(),
+		Format:   tar.FormatPAX,
+	})
+	return aw.tw, err
+}
+
+func (aw *tarArchiveWriter) Close() error {
+	err := aw.tw.Close()
+	if err == nil && aw.gzw != nil {
+		err = aw.gzw.Close()
+	}
+	return err
+}
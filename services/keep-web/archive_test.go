@@ -0,0 +1,213 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestArchiveFormat(c *check.C) {
+	for _, trial := range []struct {
+		query  string
+		accept string
+		expect string
+	}{
+		{"", "", ""},
+		{"", "text/html", ""},
+		{"?archive=zip", "", "zip"},
+		{"?archive=tar", "", "tar"},
+		{"?archive=tar.gz", "", "tar.gz"},
+		{"?archive=tgz", "", "tar.gz"},
+		{"?archive=rar", "", ""},
+		{"?archive=rar", "application/zip", ""},
+		{"?archive=tar", "application/zip", "tar"},
+		{"", "application/zip", "zip"},
+		{"", "text/html;q=0.9, application/x-tar", "tar"},
+		{"", "application/gzip", "tar.gz"},
+		{"", "application/x-gtar", "tar.gz"},
+	} {
+		r := httptest.NewRequest("GET", "/dir/"+trial.query, nil)
+		if trial.accept != "" {
+			r.Header.Set("Accept", trial.accept)
+		}
+		c.Check(archiveFormat(r), check.Equals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *UnitSuite) TestWriteArchive(c *check.C) {
+	tmpdir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(tmpdir, "dir", "sub", "empty"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpdir, "dir", "foo"), []byte("foo"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpdir, "dir", "sub", "bar"), []byte("barbar"), 0644), check.IsNil)
+	expect := map[string]string{
+		"dir/":           "",
+		"dir/foo":        "foo",
+		"dir/sub/":       "",
+		"dir/sub/bar":    "barbar",
+		"dir/sub/empty/": "",
+	}
+
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		c.Logf("format %s", format)
+		var buf bytes.Buffer
+		err := writeArchive(&buf, http.Dir(tmpdir), "/dir", "dir", format)
+		c.Assert(err, check.IsNil)
+		c.Check(readArchive(c, buf.Bytes(), format), check.DeepEquals, expect)
+	}
+
+	err := writeArchive(ioutil.Discard, http.Dir(tmpdir), "/dir", "dir", "rar")
+	c.Check(err, check.ErrorMatches, `unsupported archive format "rar"`)
+	err = writeArchive(ioutil.Discard, http.Dir(tmpdir), "/nonexistent", "dir", "zip")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+// readArchive returns the entries of the given archive, as a map of
+// name to content.
+func readArchive(c *check.C, data []byte, format string) map[string]string {
+	got := map[string]string{}
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		c.Assert(err, check.IsNil)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			c.Assert(err, check.IsNil)
+			buf, err := ioutil.ReadAll(rc)
+			c.Assert(err, check.IsNil)
+			rc.Close()
+			got[f.Name] = string(buf)
+		}
+	case "tar", "tar.gz":
+		var r io.Reader = bytes.NewReader(data)
+		if format == "tar.gz" {
+			gzr, err := gzip.NewReader(r)
+			c.Assert(err, check.IsNil)
+			r = gzr
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, check.IsNil)
+			buf, err := ioutil.ReadAll(tr)
+			c.Assert(err, check.IsNil)
+			got[hdr.Name] = string(buf)
+		}
+	}
+	return got
+}
+
+func (s *IntegrationSuite) TestArchiveDownload(c *check.C) {
+	h := handler{Config: newConfig(ctxlog.TestLogger(c), s.ArvConfig)}
+	for _, trial := range []struct {
+		path   string
+		query  string
+		accept string
+		format string
+		expect map[string]string
+	}{
+		{
+			path:   "/c=" + arvadostest.FooAndBarFilesInDirUUID + "/",
+			query:  "?archive=zip",
+			format: "zip",
+			expect: map[string]string{
+				"foo_file_in_dir/":         "",
+				"foo_file_in_dir/dir1/":    "",
+				"foo_file_in_dir/dir1/bar": "bar",
+				"foo_file_in_dir/dir1/foo": "foo",
+			},
+		},
+		{
+			path:   "/c=" + arvadostest.FooAndBarFilesInDirUUID + "/dir1",
+			accept: "application/x-tar",
+			format: "tar",
+			expect: map[string]string{
+				"dir1/":    "",
+				"dir1/bar": "bar",
+				"dir1/foo": "foo",
+			},
+		},
+		{
+			path:   "/by_id/" + arvadostest.FooAndBarFilesInDirUUID + "/dir1/",
+			query:  "?archive=tar.gz",
+			format: "tar.gz",
+			expect: map[string]string{
+				"dir1/":    "",
+				"dir1/bar": "bar",
+				"dir1/foo": "foo",
+			},
+		},
+	} {
+		c.Logf("trial %+v", trial)
+		u := mustParseURL("http://collections.example.com" + trial.path + trial.query)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"Bearer " + arvadostest.ActiveToken},
+			},
+		}
+		if trial.accept != "" {
+			req.Header.Set("Accept", trial.accept)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		c.Assert(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("Content-Type"), check.Equals, archiveFormats[trial.format].contentType)
+		c.Check(resp.Header().Get("Content-Disposition"), check.Matches, `attachment; filename=".*`+archiveFormats[trial.format].ext+`"`)
+		c.Check(readArchive(c, resp.Body.Bytes(), trial.format), check.DeepEquals, trial.expect)
+	}
+
+	// Project directories can't be archived
+	u := mustParseURL("http://collections.example.com/users/active/?archive=zip")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"Bearer " + arvadostest.ActiveToken},
+		},
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *IntegrationSuite) TestArchiveDownloadPermission(c *check.C) {
+	config := newConfig(ctxlog.TestLogger(c), s.ArvConfig)
+	h := handler{Config: config}
+	config.cluster.Collections.WebDAVPermission.User.Download = false
+	u := mustParseURL("http://collections.example.com/c=" + arvadostest.FooAndBarFilesInDirUUID + "/?archive=zip")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"Bearer " + arvadostest.ActiveToken},
+		},
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+}
@@ -36,7 +36,7 @@ type handler struct {
 	clientPool    *arvadosclient.ClientPool
 	setupOnce     sync.Once
 	healthHandler http.Handler
-	webdavLS      webdav.LockSystem
+	webdavLocks   webdavLockStore
 }
 
 // parseCollectionIDFromDNSName returns a UUID or PDH if s begins with
@@ -92,9 +92,25 @@ func (h *handler) setup() {
 		Prefix: "/_health/",
 	}
 
-	// Even though we don't accept LOCK requests, every webdav
-	// handler must have a non-nil LockSystem.
-	h.webdavLS = &noLockSystem{}
+	var err error
+	h.webdavLocks, err = newWebdavLockStore(h.Config.cluster)
+	if err != nil {
+		// configure() has already checked the config, so
+		// this should only happen in tests.
+		logrus.WithError(err).Error("using in-memory WebDAV lock store")
+		h.webdavLocks = &memLockStore{}
+	}
+}
+
+// webdavLockSystem returns a webdav.LockSystem for a webdav handler.
+// resolve maps the handler's resource names to collection UUIDs and
+// paths.
+func (h *handler) webdavLockSystem(resolve func(name string) (collectionUUID, path string)) webdav.LockSystem {
+	return &webdavLockSystem{
+		store:      h.webdavLocks,
+		maxTimeout: h.Config.cluster.Collections.WebDAVLocks.MaxTimeout.Duration(),
+		resolve:    resolve,
+	}
 }
 
 func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
@@ -514,7 +530,9 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 				writing:       writeMethod[r.Method],
 				alwaysReadEOF: r.Method == "PROPFIND",
 			},
-			LockSystem: h.webdavLS,
+			LockSystem: h.webdavLockSystem(func(name string) (string, string) {
+				return webdavLockNamespace(collection), name
+			}),
 			Logger: func(_ *http.Request, err error) {
 				if err != nil {
 					ctxlog.FromContext(r.Context()).WithError(err).Error("error reported by webdav handler")
@@ -540,6 +558,14 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	if stat, err := f.Stat(); err != nil {
 		// Can't get Size/IsDir (shouldn't happen with a collectionFS!)
 		http.Error(w, "stat: "+err.Error(), http.StatusInternalServerError)
+	} else if format := archiveFormat(r); stat.IsDir() && format != "" {
+		name := collection.Name
+		if openPath != "/" {
+			name = stat.Name()
+		} else if name == "" {
+			name = collectionID
+		}
+		h.serveArchive(w, r, fs, openPath, name, format, sess.arvadosclient, nil, strings.Join(targetPath, "/"), collection, tokenUser)
 	} else if stat.IsDir() && !strings.HasSuffix(r.URL.Path, "/") {
 		// If client requests ".../dirname", redirect to
 		// ".../dirname/". This way, relative links in the
@@ -616,7 +642,18 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 		return
 	}
 	defer f.Close()
-	if fi, err := f.Stat(); err == nil && fi.IsDir() && r.Method == "GET" {
+	if fi, err := f.Stat(); err == nil && fi.IsDir() && (r.Method == "GET" || r.Method == "HEAD") && archiveFormat(r) != "" {
+		// Only directories inside a collection can be
+		// downloaded as archives: walking an entire project
+		// or home directory would be too expensive.
+		if coll, _ := h.determineCollection(fs, r.URL.Path); coll == nil {
+			http.Error(w, "archive download is only supported for collections and directories inside collections", http.StatusBadRequest)
+			return
+		}
+		tokenUser, _ := h.Config.Cache.GetTokenUser(tokens[0])
+		h.serveArchive(w, r, fs, r.URL.Path, fi.Name(), archiveFormat(r), sess.arvadosclient, fs, r.URL.Path, nil, tokenUser)
+		return
+	} else if err == nil && fi.IsDir() && r.Method == "GET" {
 		if !strings.HasSuffix(r.URL.Path, "/") {
 			h.seeOtherWithCookie(w, r, r.URL.Path+"/", credentialsOK)
 		} else {
@@ -643,7 +680,12 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 			writing:       writeMethod[r.Method],
 			alwaysReadEOF: r.Method == "PROPFIND",
 		},
-		LockSystem: h.webdavLS,
+		LockSystem: h.webdavLockSystem(func(name string) (string, string) {
+			if coll, rest := h.determineCollection(fs, name); coll != nil {
+				return webdavLockNamespace(coll), "/" + rest
+			}
+			return "", name
+		}),
 		Logger: func(_ *http.Request, err error) {
 			if err != nil {
 				ctxlog.FromContext(r.Context()).WithError(err).Error("error reported by webdav handler")
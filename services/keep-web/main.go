@@ -86,6 +86,9 @@ func configure(logger log.FieldLogger, args []string) (*Config, error) {
 		return nil, err
 	}
 	cfg := newConfig(logger, arvCfg)
+	if _, err := newWebdavLockStore(cfg.cluster); err != nil {
+		return nil, err
+	}
 
 	if *dumpConfig {
 		out, err := yaml.Marshal(cfg)
@@ -284,6 +284,14 @@ var InternalError = "InternalError"
 var UnauthorizedAccess = "UnauthorizedAccess"
 var InvalidRequest = "InvalidRequest"
 var SignatureDoesNotMatch = "SignatureDoesNotMatch"
+var NoSuchUpload = "NoSuchUpload"
+var InvalidPart = "InvalidPart"
+var InvalidPartOrder = "InvalidPartOrder"
+var BadDigest = "BadDigest"
+var MalformedXML = "MalformedXML"
+var NotImplemented = "NotImplemented"
+var InvalidTag = "InvalidTag"
+var AccessDenied = "AccessDenied"
 
 var reRawQueryIndicatesAPI = regexp.MustCompile(`^[a-z]+(&|$)`)
 
@@ -309,9 +317,15 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		return false
 	}
 
+	if s3isMultipartRequest(r) {
+		h.serveS3Multipart(w, r, token)
+		return true
+	}
+
 	var err error
 	var fs arvados.CustomFileSystem
 	var arvclient *arvadosclient.ArvadosClient
+	var client *arvados.Client
 	if r.Method == http.MethodGet || r.Method == http.MethodHead {
 		// Use a single session (cached FileSystem) across
 		// multiple read requests.
@@ -322,13 +336,13 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			return true
 		}
 		arvclient = sess.arvadosclient
+		client = sess.client
 	} else {
 		// Create a FileSystem for this request, to avoid
 		// exposing incomplete write operations to concurrent
 		// requests.
 		var kc *keepclient.KeepClient
 		var release func()
-		var client *arvados.Client
 		arvclient, kc, client, release, err = h.getClients(r.Header.Get("X-Request-Id"), token)
 		if err != nil {
 			s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
@@ -339,18 +353,7 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		fs.ForwardSlashNameSubstitution(h.Config.cluster.Collections.ForwardSlashNameSubstitution)
 	}
 
-	var objectNameGiven bool
-	var bucketName string
-	fspath := "/by_id"
-	if id := parseCollectionIDFromDNSName(r.Host); id != "" {
-		fspath += "/" + id
-		bucketName = id
-		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 0
-	} else {
-		bucketName = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
-		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 1
-	}
-	fspath += reMultipleSlashChars.ReplaceAllString(r.URL.Path, "/")
+	bucketName, fspath, objectNameGiven := s3pathInfo(r)
 
 	switch {
 	case r.Method == http.MethodGet && !objectNameGiven:
@@ -375,6 +378,11 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			h.s3list(bucketName, w, r, fs)
 		}
 		return true
+	case objectNameGiven && s3isTaggingRequest(r):
+		// GetObjectTagging, PutObjectTagging,
+		// DeleteObjectTagging
+		h.serveS3Tagging(w, r, client, token, fs, fspath)
+		return true
 	case r.Method == http.MethodGet || r.Method == http.MethodHead:
 		if reRawQueryIndicatesAPI.MatchString(r.URL.RawQuery) {
 			// GetObjectRetention ("GET /bucketid/objectid?retention&versionID=..."), etc.
@@ -412,6 +420,10 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		}
 		h.logUploadOrDownload(r, arvclient, fs, fspath, nil, tokenUser)
 
+		if coll, key := h.s3objectKey(fs, fspath); coll != nil {
+			s3setMetadataHeaders(w, s3getObjectProperties(coll.Properties, key))
+		}
+
 		// shallow copy r, and change URL path
 		r := *r
 		r.URL.Path = fspath
@@ -427,6 +439,14 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			s3ErrorResponse(w, InvalidArgument, "Missing object name in PUT request.", r.URL.Path, http.StatusBadRequest)
 			return true
 		}
+		props, err := s3requestProperties(r)
+		if err != nil {
+			s3ErrorResponse(w, InvalidArgument, err.Error(), r.URL.Path, http.StatusBadRequest)
+			return true
+		}
+		if !h.s3checkVocabulary(w, r, client, props, InvalidArgument) {
+			return true
+		}
 		var objectIsDir bool
 		if strings.HasSuffix(fspath, "/") {
 			if !h.Config.cluster.Collections.S3FolderObjects {
@@ -461,28 +481,8 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			s3ErrorResponse(w, InvalidArgument, "object name conflicts with existing object", r.URL.Path, http.StatusBadRequest)
 			return true
 		}
-		// create missing parent/intermediate directories, if any
-		for i, c := range fspath {
-			if i > 0 && c == '/' {
-				dir := fspath[:i]
-				if strings.HasSuffix(dir, "/") {
-					err = errors.New("invalid object name (consecutive '/' chars)")
-					s3ErrorResponse(w, InvalidArgument, err.Error(), r.URL.Path, http.StatusBadRequest)
-					return true
-				}
-				err = fs.Mkdir(dir, 0755)
-				if errors.Is(err, arvados.ErrInvalidArgument) || errors.Is(err, arvados.ErrInvalidOperation) {
-					// Cannot create a directory
-					// here.
-					err = fmt.Errorf("mkdir %q failed: %w", dir, err)
-					s3ErrorResponse(w, InvalidArgument, err.Error(), r.URL.Path, http.StatusBadRequest)
-					return true
-				} else if err != nil && !os.IsExist(err) {
-					err = fmt.Errorf("mkdir %q failed: %w", dir, err)
-					s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
-					return true
-				}
-			}
+		if !s3mkdirParents(w, r, fs, fspath) {
+			return true
 		}
 		if !objectIsDir {
 			f, err := fs.OpenFile(fspath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
@@ -524,6 +524,9 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		}
 		// Ensure a subsequent read operation will see the changes.
 		h.Config.Cache.ResetSession(token)
+		if !h.s3applyProperties(w, r, client, token, fs, fspath, props) {
+			return true
+		}
 		w.WriteHeader(http.StatusOK)
 		return true
 	case r.Method == http.MethodDelete:
@@ -536,6 +539,7 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			s3ErrorResponse(w, InvalidArgument, "missing object name in DELETE request", r.URL.Path, http.StatusBadRequest)
 			return true
 		}
+		coll, key := h.s3objectKey(fs, fspath)
 		if strings.HasSuffix(fspath, "/") {
 			fspath = strings.TrimSuffix(fspath, "/")
 			fi, err := fs.Stat(fspath)
@@ -578,6 +582,15 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		}
 		// Ensure a subsequent read operation will see the changes.
 		h.Config.Cache.ResetSession(token)
+		if coll != nil && coll.UUID != "" && !s3getObjectProperties(coll.Properties, key).empty() {
+			// The object is already gone, so a failure
+			// here only leaves a stale entry, which will
+			// be replaced if the object is written again.
+			err = s3updateObjectProperties(r, client, coll.UUID, key, func(p *s3objectProperties) { *p = s3objectProperties{} })
+			if err != nil {
+				ctxlog.FromContext(r.Context()).WithError(err).Warn("error removing metadata and tags of deleted object")
+			}
+		}
 		w.WriteHeader(http.StatusNoContent)
 		return true
 	default:
@@ -586,6 +599,52 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 	}
 }
 
+// s3pathInfo returns the bucket name and the corresponding site
+// filesystem path for an S3 request, and whether the request path
+// includes an object name.
+func s3pathInfo(r *http.Request) (bucketName, fspath string, objectNameGiven bool) {
+	fspath = "/by_id"
+	if id := parseCollectionIDFromDNSName(r.Host); id != "" {
+		fspath += "/" + id
+		bucketName = id
+		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 0
+	} else {
+		bucketName = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 1
+	}
+	fspath += reMultipleSlashChars.ReplaceAllString(r.URL.Path, "/")
+	return
+}
+
+// s3mkdirParents creates missing parent/intermediate directories of
+// fspath, if any. If this fails, it sends an error response and
+// returns false.
+func s3mkdirParents(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, fspath string) bool {
+	for i, c := range fspath {
+		if i > 0 && c == '/' {
+			dir := fspath[:i]
+			if strings.HasSuffix(dir, "/") {
+				err := errors.New("invalid object name (consecutive '/' chars)")
+				s3ErrorResponse(w, InvalidArgument, err.Error(), r.URL.Path, http.StatusBadRequest)
+				return false
+			}
+			err := fs.Mkdir(dir, 0755)
+			if errors.Is(err, arvados.ErrInvalidArgument) || errors.Is(err, arvados.ErrInvalidOperation) {
+				// Cannot create a directory
+				// here.
+				err = fmt.Errorf("mkdir %q failed: %w", dir, err)
+				s3ErrorResponse(w, InvalidArgument, err.Error(), r.URL.Path, http.StatusBadRequest)
+				return false
+			} else if err != nil && !os.IsExist(err) {
+				err = fmt.Errorf("mkdir %q failed: %w", dir, err)
+				s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Call fn on the given path (directory) and its contents, in
 // lexicographic order.
 //
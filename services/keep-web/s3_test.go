@@ -634,7 +634,7 @@ func (s *IntegrationSuite) TestS3UnsupportedAPIs(c *check.C) {
 		{"PUT", "/", "acl"},                   // PutBucketAcl
 		{"PUT", "/foo", "acl"},                // PutObjectAcl
 		{"DELETE", "/", "tagging"},            // DeleteBucketTagging
-		{"DELETE", "/foo", "tagging"},         // DeleteObjectTagging
+		{"PUT", "/foo", "retention"},          // PutObjectRetention
 	} {
 		for _, bucket := range []*s3.Bucket{stage.collbucket, stage.projbucket} {
 			c.Logf("trial %v bucket %v", trial, bucket)
@@ -0,0 +1,688 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+)
+
+// A multipart upload is stored as a project (the upload ID is the
+// project UUID) in the user's home project. Each part is stored as a
+// collection in that project, containing a single file. When the
+// upload is completed, the parts are spliced together into the
+// target file, and the project is deleted.
+//
+// The project's trash_at is set when the upload is initiated, so
+// abandoned uploads are cleaned up automatically.
+const (
+	s3MaxParts   = 10000
+	s3MaxUploads = 1000
+
+	// name of the file in each part collection
+	s3PartFilename = "data"
+
+	s3UploadBucketProperty = "s3_upload_bucket"
+	s3UploadKeyProperty    = "s3_upload_key"
+	// object metadata and tags to apply when the upload is
+	// completed (see s3requestProperties)
+	s3UploadPropertiesProperty = "s3_upload_properties"
+	s3PartETagProperty         = "s3_etag"
+)
+
+type s3initiateMultipartUploadResult struct {
+	XMLName  string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3completeMultipartUploadResult struct {
+	XMLName  string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type s3part struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type s3listPartsResult struct {
+	XMLName              string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string
+	Key                  string
+	UploadId             string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Part                 []s3part
+}
+
+type s3upload struct {
+	Key       string
+	UploadId  string
+	Initiated string
+}
+
+type s3listMultipartUploadsResult struct {
+	XMLName            string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string
+	KeyMarker          string
+	UploadIdMarker     string
+	NextKeyMarker      string
+	NextUploadIdMarker string
+	Prefix             string
+	Delimiter          string `xml:",omitempty"`
+	MaxUploads         int
+	IsTruncated        bool
+	Upload             []s3upload
+	CommonPrefixes     []commonPrefix
+}
+
+// s3isMultipartRequest returns true if r is one of the multipart
+// upload APIs (CreateMultipartUpload, UploadPart, ListParts, etc.).
+func s3isMultipartRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	_, uploadID := q["uploadId"]
+	return uploads || uploadID
+}
+
+func s3partName(n int) string {
+	return fmt.Sprintf("part-%05d", n)
+}
+
+// s3partNumber returns the part number of the part collection with
+// the given name.
+func s3partNumber(name string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(name, "part-"))
+	return n
+}
+
+func s3timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// s3multipart holds the state needed to handle a single multipart
+// upload request.
+type s3multipart struct {
+	h         *handler
+	w         http.ResponseWriter
+	r         *http.Request
+	token     string
+	client    *arvados.Client
+	arvclient *arvadosclient.ArvadosClient
+	kc        *keepclient.KeepClient
+	fs        arvados.CustomFileSystem
+	bucket    string
+	key       string
+	fspath    string
+}
+
+func (h *handler) serveS3Multipart(w http.ResponseWriter, r *http.Request, token string) {
+	arvclient, kc, client, release, err := h.getClients(r.Header.Get("X-Request-Id"), token)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+		return
+	}
+	defer release()
+	fs := client.SiteFileSystem(kc)
+	fs.ForwardSlashNameSubstitution(h.Config.cluster.Collections.ForwardSlashNameSubstitution)
+
+	bucket, fspath, objectNameGiven := s3pathInfo(r)
+	mp := &s3multipart{
+		h:         h,
+		w:         w,
+		r:         r,
+		token:     token,
+		client:    client,
+		arvclient: arvclient,
+		kc:        kc,
+		fs:        fs,
+		bucket:    bucket,
+		key:       strings.TrimPrefix(fspath, "/by_id/"+bucket+"/"),
+		fspath:    fspath,
+	}
+	_, uploads := r.URL.Query()["uploads"]
+	switch {
+	case r.Method == http.MethodGet && uploads && !objectNameGiven:
+		mp.listUploads()
+	case !objectNameGiven:
+		s3ErrorResponse(w, InvalidArgument, "missing object name in multipart upload request", r.URL.Path, http.StatusBadRequest)
+	case strings.HasSuffix(r.URL.Path, "/"):
+		s3ErrorResponse(w, InvalidArgument, "invalid object name: trailing slash", r.URL.Path, http.StatusBadRequest)
+	case r.Method == http.MethodPost && uploads:
+		mp.create()
+	case r.Method == http.MethodPut:
+		mp.uploadPart()
+	case r.Method == http.MethodGet:
+		mp.listParts()
+	case r.Method == http.MethodPost:
+		mp.complete()
+	case r.Method == http.MethodDelete:
+		mp.abort()
+	default:
+		s3ErrorResponse(w, InvalidRequest, "method not allowed", r.URL.Path, http.StatusMethodNotAllowed)
+	}
+}
+
+func (mp *s3multipart) error(s3code string, err error, code int) {
+	s3ErrorResponse(mp.w, s3code, err.Error(), mp.r.URL.Path, code)
+}
+
+func (mp *s3multipart) writeXML(resp interface{}) {
+	mp.w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(mp.w, xml.Header)
+	if err := xml.NewEncoder(mp.w).Encode(resp); err != nil {
+		ctxlog.FromContext(mp.r.Context()).WithError(err).Error("error writing xml response")
+	}
+}
+
+// checkPermission returns false (after sending an error response)
+// if the token user is not permitted to upload files.
+func (mp *s3multipart) checkPermission() bool {
+	tokenUser, _ := mp.h.Config.Cache.GetTokenUser(mp.token)
+	if !mp.h.userPermittedToUploadOrDownload(http.MethodPut, tokenUser) {
+		http.Error(mp.w, "Not permitted", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// getUpload returns the project that stores the upload with the
+// given ID. If the upload does not exist, or belongs to a different
+// bucket or key, it sends an error response and returns false.
+func (mp *s3multipart) getUpload() (arvados.Group, bool) {
+	var upload arvados.Group
+	uploadID := mp.r.URL.Query().Get("uploadId")
+	if !arvadosclient.UUIDMatch(uploadID) || uploadID[6:11] != "j7d0g" {
+		mp.error(NoSuchUpload, errors.New("invalid upload ID"), http.StatusNotFound)
+		return upload, false
+	}
+	err := mp.client.RequestAndDecodeContext(mp.r.Context(), &upload, "GET", "arvados/v1/groups/"+uploadID, nil, nil)
+	if err != nil {
+		var te *arvados.TransactionError
+		if errors.As(err, &te) && te.StatusCode == http.StatusNotFound {
+			mp.error(NoSuchUpload, errors.New("the specified upload does not exist"), http.StatusNotFound)
+		} else {
+			mp.error(InternalError, err, http.StatusBadGateway)
+		}
+		return upload, false
+	}
+	if upload.Properties[s3UploadBucketProperty] != mp.bucket || upload.Properties[s3UploadKeyProperty] != mp.key {
+		mp.error(NoSuchUpload, errors.New("the specified upload does not exist"), http.StatusNotFound)
+		return upload, false
+	}
+	return upload, true
+}
+
+// getParts returns the part collections of the given upload,
+// ordered by part number, starting after the given part number. If
+// there are more than limit parts, only the first limit parts are
+// returned, and truncated is true.
+func (mp *s3multipart) getParts(upload arvados.Group, after, limit int, selectFields []string) (parts []arvados.Collection, truncated bool, err error) {
+	for len(parts) <= limit {
+		var resp arvados.CollectionList
+		pageLimit := limit + 1 - len(parts)
+		err = mp.client.RequestAndDecodeContext(mp.r.Context(), &resp, "GET", "arvados/v1/collections", nil, arvados.ResourceListParams{
+			Filters: []arvados.Filter{
+				{"owner_uuid", "=", upload.UUID},
+				{"name", "like", "part-%"},
+				{"name", ">", s3partName(after)},
+			},
+			Order:  "name",
+			Limit:  &pageLimit,
+			Select: selectFields,
+			Count:  "none",
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if len(resp.Items) == 0 {
+			break
+		}
+		parts = append(parts, resp.Items...)
+		after = s3partNumber(parts[len(parts)-1].Name)
+	}
+	if len(parts) > limit {
+		return parts[:limit], true, nil
+	}
+	return parts, false, nil
+}
+
+// CreateMultipartUpload
+func (mp *s3multipart) create() {
+	if !mp.checkPermission() {
+		return
+	}
+	if fi, err := mp.fs.Stat("/by_id/" + mp.bucket); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		s3ErrorResponse(mp.w, NoSuchBucket, "The specified bucket does not exist.", mp.r.URL.Path, http.StatusNotFound)
+		return
+	} else if err != nil {
+		mp.error(InternalError, err, http.StatusBadGateway)
+		return
+	}
+	props, err := s3requestProperties(mp.r)
+	if err != nil {
+		mp.error(InvalidArgument, err, http.StatusBadRequest)
+		return
+	}
+	if !mp.h.s3checkVocabulary(mp.w, mp.r, mp.client, props, InvalidArgument) {
+		return
+	}
+	trashAt := time.Now().Add(mp.h.Config.cluster.Collections.S3MultipartUploadTTL.Duration())
+	var upload arvados.Group
+	err = mp.client.RequestAndDecodeContext(mp.r.Context(), &upload, "POST", "arvados/v1/groups", nil, map[string]interface{}{
+		"group": map[string]interface{}{
+			"group_class": "project",
+			"name":        "S3 multipart upload to " + mp.bucket,
+			"trash_at":    trashAt.UTC(),
+			"properties": map[string]interface{}{
+				s3UploadBucketProperty:     mp.bucket,
+				s3UploadKeyProperty:        mp.key,
+				s3UploadPropertiesProperty: props,
+			},
+		},
+		"ensure_unique_name": true,
+	})
+	if err != nil {
+		mp.error(InternalError, fmt.Errorf("error creating upload project: %w", err), http.StatusBadGateway)
+		return
+	}
+	mp.writeXML(s3initiateMultipartUploadResult{
+		Bucket:   mp.bucket,
+		Key:      mp.key,
+		UploadId: upload.UUID,
+	})
+}
+
+// UploadPart
+func (mp *s3multipart) uploadPart() {
+	if !mp.checkPermission() {
+		return
+	}
+	if mp.r.Header.Get("X-Amz-Copy-Source") != "" {
+		mp.error(NotImplemented, errors.New("UploadPartCopy is not supported"), http.StatusNotImplemented)
+		return
+	}
+	n, err := strconv.Atoi(mp.r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > s3MaxParts {
+		mp.error(InvalidArgument, fmt.Errorf("part number must be an integer between 1 and %d", s3MaxParts), http.StatusBadRequest)
+		return
+	}
+	upload, ok := mp.getUpload()
+	if !ok {
+		return
+	}
+
+	// Write the part data to Keep using a new in-memory
+	// collection.
+	cfs, err := (&arvados.Collection{}).FileSystem(mp.client, mp.kc)
+	if err != nil {
+		mp.error(InternalError, err, http.StatusInternalServerError)
+		return
+	}
+	f, err := cfs.OpenFile(s3PartFilename, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		mp.error(InternalError, err, http.StatusInternalServerError)
+		return
+	}
+	hash := md5.New()
+	_, err = io.Copy(f, io.TeeReader(mp.r.Body, hash))
+	if err != nil {
+		f.Close()
+		mp.error(InternalError, fmt.Errorf("error reading request body: %w", err), http.StatusBadGateway)
+		return
+	}
+	if err = f.Close(); err != nil {
+		mp.error(InternalError, fmt.Errorf("write failed: %w", err), http.StatusBadGateway)
+		return
+	}
+	sum := hash.Sum(nil)
+	if want := mp.r.Header.Get("Content-Md5"); want != "" && want != base64.StdEncoding.EncodeToString(sum) {
+		mp.error(BadDigest, errors.New("the Content-MD5 you specified did not match what we received"), http.StatusBadRequest)
+		return
+	}
+	etag := `"` + hex.EncodeToString(sum) + `"`
+	txt, err := cfs.MarshalManifest(".")
+	if err != nil {
+		mp.error(InternalError, fmt.Errorf("write failed: %w", err), http.StatusBadGateway)
+		return
+	}
+
+	// Save the part, replacing any part previously uploaded with
+	// the same part number.
+	attrs := map[string]interface{}{
+		"owner_uuid":    upload.UUID,
+		"name":          s3partName(n),
+		"manifest_text": txt,
+		"properties":    map[string]interface{}{s3PartETagProperty: etag},
+	}
+	var existing arvados.CollectionList
+	err = mp.client.RequestAndDecodeContext(mp.r.Context(), &existing, "GET", "arvados/v1/collections", nil, arvados.ResourceListParams{
+		Filters: []arvados.Filter{
+			{"owner_uuid", "=", upload.UUID},
+			{"name", "=", s3partName(n)},
+		},
+		Select: []string{"uuid"},
+		Count:  "none",
+	})
+	if err == nil && len(existing.Items) > 0 {
+		err = mp.client.RequestAndDecodeContext(mp.r.Context(), nil, "PUT", "arvados/v1/collections/"+existing.Items[0].UUID, nil, map[string]interface{}{
+			"collection": attrs,
+		})
+	} else if err == nil {
+		err = mp.client.RequestAndDecodeContext(mp.r.Context(), nil, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+			"collection": attrs,
+		})
+	}
+	if err != nil {
+		mp.error(InternalError, fmt.Errorf("error saving part: %w", err), http.StatusBadGateway)
+		return
+	}
+	mp.w.Header().Set("ETag", etag)
+	mp.w.WriteHeader(http.StatusOK)
+}
+
+// ListParts
+func (mp *s3multipart) listParts() {
+	upload, ok := mp.getUpload()
+	if !ok {
+		return
+	}
+	marker, _ := strconv.Atoi(mp.r.FormValue("part-number-marker"))
+	maxParts := s3MaxKeys
+	if mk, _ := strconv.Atoi(mp.r.FormValue("max-parts")); mk > 0 && mk < s3MaxKeys {
+		maxParts = mk
+	}
+	parts, truncated, err := mp.getParts(upload, marker, maxParts, []string{"name", "modified_at", "properties", "file_size_total"})
+	if err != nil {
+		mp.error(InternalError, err, http.StatusBadGateway)
+		return
+	}
+	resp := s3listPartsResult{
+		Bucket:           mp.bucket,
+		Key:              mp.key,
+		UploadId:         upload.UUID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+		IsTruncated:      truncated,
+	}
+	for _, coll := range parts {
+		n := s3partNumber(coll.Name)
+		etag, _ := coll.Properties[s3PartETagProperty].(string)
+		resp.Part = append(resp.Part, s3part{
+			PartNumber:   n,
+			LastModified: s3timestamp(coll.ModifiedAt),
+			ETag:         etag,
+			Size:         coll.FileSizeTotal,
+		})
+		resp.NextPartNumberMarker = n
+	}
+	mp.writeXML(resp)
+}
+
+// CompleteMultipartUpload
+func (mp *s3multipart) complete() {
+	if !mp.checkPermission() {
+		return
+	}
+	upload, ok := mp.getUpload()
+	if !ok {
+		return
+	}
+	var req s3completeMultipartUpload
+	if err := xml.NewDecoder(mp.r.Body).Decode(&req); err != nil {
+		mp.error(MalformedXML, fmt.Errorf("error decoding request body: %w", err), http.StatusBadRequest)
+		return
+	} else if len(req.Parts) == 0 {
+		mp.error(MalformedXML, errors.New("request body does not list any parts"), http.StatusBadRequest)
+		return
+	}
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			mp.error(InvalidPartOrder, errors.New("the list of parts was not in ascending order"), http.StatusBadRequest)
+			return
+		}
+	}
+	saved, _, err := mp.getParts(upload, 0, s3MaxParts, []string{"name", "manifest_text", "properties"})
+	if err != nil {
+		mp.error(InternalError, err, http.StatusBadGateway)
+		return
+	}
+	byName := make(map[string]arvados.Collection, len(saved))
+	for _, coll := range saved {
+		byName[coll.Name] = coll
+	}
+	var manifests []string
+	etagHash := md5.New()
+	for _, part := range req.Parts {
+		coll, ok := byName[s3partName(part.PartNumber)]
+		etag, _ := coll.Properties[s3PartETagProperty].(string)
+		if !ok || strings.Trim(etag, `"`) != strings.Trim(part.ETag, `"`) {
+			mp.error(InvalidPart, fmt.Errorf("part %d was not found, or its ETag did not match", part.PartNumber), http.StatusBadRequest)
+			return
+		}
+		sum, _ := hex.DecodeString(strings.Trim(etag, `"`))
+		etagHash.Write(sum)
+		manifests = append(manifests, coll.ManifestText)
+	}
+
+	// Splice the concatenated parts into the target collection.
+	txt, err := concatManifests(manifests, s3PartFilename)
+	if err != nil {
+		mp.error(InternalError, err, http.StatusInternalServerError)
+		return
+	}
+	cfs, err := (&arvados.Collection{ManifestText: txt}).FileSystem(mp.client, mp.kc)
+	if err != nil {
+		mp.error(InternalError, err, http.StatusInternalServerError)
+		return
+	}
+	snap, err := arvados.Snapshot(cfs, s3PartFilename)
+	if err != nil {
+		mp.error(InternalError, err, http.StatusInternalServerError)
+		return
+	}
+	fi, err := mp.fs.Stat(mp.fspath)
+	if err != nil && err.Error() == "not a directory" {
+		// requested foo/bar, but foo is a file
+		mp.error(InvalidArgument, errors.New("object name conflicts with existing object"), http.StatusBadRequest)
+		return
+	} else if err == nil && fi.IsDir() {
+		mp.error(InvalidArgument, errors.New("object name conflicts with existing directory"), http.StatusBadRequest)
+		return
+	}
+	if !s3mkdirParents(mp.w, mp.r, mp.fs, mp.fspath) {
+		return
+	}
+	err = arvados.Splice(mp.fs, mp.fspath, snap)
+	if errors.Is(err, arvados.ErrInvalidArgument) || errors.Is(err, arvados.ErrInvalidOperation) {
+		mp.error(InvalidArgument, fmt.Errorf("cannot write %q: %w", mp.r.URL.Path, err), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		mp.error(InternalError, fmt.Errorf("cannot write %q: %w", mp.r.URL.Path, err), http.StatusInternalServerError)
+		return
+	}
+	tokenUser, _ := mp.h.Config.Cache.GetTokenUser(mp.token)
+	mp.h.logUploadOrDownload(mp.r, mp.arvclient, mp.fs, mp.fspath, nil, tokenUser)
+	err = mp.fs.Sync()
+	if err != nil {
+		mp.error(InternalError, fmt.Errorf("sync failed: %w", err), http.StatusInternalServerError)
+		return
+	}
+	// Ensure a subsequent read operation will see the changes.
+	mp.h.Config.Cache.ResetSession(mp.token)
+	props := s3parseObjectProperties(upload.Properties[s3UploadPropertiesProperty])
+	if !mp.h.s3applyProperties(mp.w, mp.r, mp.client, mp.token, mp.fs, mp.fspath, props) {
+		return
+	}
+
+	err = mp.client.RequestAndDecodeContext(mp.r.Context(), nil, "DELETE", "arvados/v1/groups/"+upload.UUID, nil, nil)
+	if err != nil {
+		// The upload is complete, and the project will
+		// be trashed eventually anyway.
+		ctxlog.FromContext(mp.r.Context()).WithError(err).Warn("error deleting completed multipart upload project")
+	}
+	mp.writeXML(s3completeMultipartUploadResult{
+		Location: mp.r.URL.Path,
+		Bucket:   mp.bucket,
+		Key:      mp.key,
+		ETag:     fmt.Sprintf(`"%x-%d"`, etagHash.Sum(nil), len(req.Parts)),
+	})
+}
+
+// AbortMultipartUpload
+func (mp *s3multipart) abort() {
+	if !mp.checkPermission() {
+		return
+	}
+	upload, ok := mp.getUpload()
+	if !ok {
+		return
+	}
+	err := mp.client.RequestAndDecodeContext(mp.r.Context(), nil, "DELETE", "arvados/v1/groups/"+upload.UUID, nil, nil)
+	if err != nil {
+		mp.error(InternalError, err, http.StatusBadGateway)
+		return
+	}
+	mp.w.WriteHeader(http.StatusNoContent)
+}
+
+// ListMultipartUploads
+func (mp *s3multipart) listUploads() {
+	resp := s3listMultipartUploadsResult{
+		Bucket:         mp.bucket,
+		KeyMarker:      mp.r.FormValue("key-marker"),
+		UploadIdMarker: mp.r.FormValue("upload-id-marker"),
+		Prefix:         mp.r.FormValue("prefix"),
+		Delimiter:      mp.r.FormValue("delimiter"),
+		MaxUploads:     s3MaxUploads,
+	}
+	if mk, _ := strconv.Atoi(mp.r.FormValue("max-uploads")); mk > 0 && mk < s3MaxUploads {
+		resp.MaxUploads = mk
+	}
+	var uploads []arvados.Group
+	for {
+		var page arvados.GroupList
+		err := mp.client.RequestAndDecodeContext(mp.r.Context(), &page, "GET", "arvados/v1/groups", nil, arvados.ResourceListParams{
+			Filters: []arvados.Filter{
+				{"group_class", "=", "project"},
+				{"properties." + s3UploadBucketProperty, "=", mp.bucket},
+			},
+			Order:  "uuid",
+			Offset: len(uploads),
+			Count:  "none",
+		})
+		if err != nil {
+			mp.error(InternalError, err, http.StatusBadGateway)
+			return
+		}
+		uploads = append(uploads, page.Items...)
+		if len(page.Items) == 0 {
+			break
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		ki, _ := uploads[i].Properties[s3UploadKeyProperty].(string)
+		kj, _ := uploads[j].Properties[s3UploadKeyProperty].(string)
+		if ki != kj {
+			return ki < kj
+		}
+		return uploads[i].UUID < uploads[j].UUID
+	})
+	commonPrefixes := map[string]bool{}
+	for _, upload := range uploads {
+		key, _ := upload.Properties[s3UploadKeyProperty].(string)
+		if !strings.HasPrefix(key, resp.Prefix) {
+			continue
+		}
+		if key < resp.KeyMarker || (key == resp.KeyMarker && (resp.UploadIdMarker == "" || upload.UUID <= resp.UploadIdMarker)) {
+			continue
+		}
+		if resp.Delimiter != "" {
+			if idx := strings.Index(key[len(resp.Prefix):], resp.Delimiter); idx >= 0 {
+				commonPrefixes[key[:len(resp.Prefix)+idx+len(resp.Delimiter)]] = true
+				continue
+			}
+		}
+		if len(resp.Upload) >= resp.MaxUploads {
+			resp.IsTruncated = true
+			break
+		}
+		resp.Upload = append(resp.Upload, s3upload{
+			Key:       key,
+			UploadId:  upload.UUID,
+			Initiated: s3timestamp(upload.CreatedAt),
+		})
+		resp.NextKeyMarker = key
+		resp.NextUploadIdMarker = upload.UUID
+	}
+	for prefix := range commonPrefixes {
+		resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix{prefix})
+	}
+	sort.Slice(resp.CommonPrefixes, func(i, j int) bool { return resp.CommonPrefixes[i].Prefix < resp.CommonPrefixes[j].Prefix })
+	mp.writeXML(resp)
+}
+
+// concatManifests returns a manifest text with a single file, whose
+// content is the concatenation of the files with the given name in
+// each of the given manifests.
+func concatManifests(manifests []string, name string) (string, error) {
+	var blocks, segments []string
+	var pos int64
+	for _, txt := range manifests {
+		m := manifest.Manifest{Text: txt}
+		for seg := range m.FileSegmentIterByName("./" + name) {
+			if seg.Len == 0 {
+				continue
+			}
+			loc, err := manifest.ParseBlockLocator(seg.Locator)
+			if err != nil {
+				return "", err
+			}
+			blocks = append(blocks, seg.Locator)
+			segments = append(segments, fmt.Sprintf("%d:%d:%s", pos+int64(seg.Offset), seg.Len, manifest.EscapeName(name)))
+			pos += int64(loc.Size)
+		}
+		if m.Err != nil {
+			return "", m.Err
+		}
+	}
+	if len(blocks) == 0 {
+		return ". d41d8cd98f00b204e9800998ecf8427e+0 0:0:" + manifest.EscapeName(name) + "\n", nil
+	}
+	return ". " + strings.Join(blocks, " ") + " " + strings.Join(segments, " ") + "\n", nil
+}
@@ -0,0 +1,134 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+
+	"github.com/AdRoll/goamz/s3"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestS3ConcatManifests(c *check.C) {
+	txt, err := concatManifests([]string{
+		". acbd18db4cc2f85cedef654fccc4a4d8+3+Afoo@12345678 0:3:data\n",
+		". 37b51d194a7513e45b56f6524f2d51f2+3 73feffa4b7f6bb68e44cf984c85f6e88+3 1:2:data 2:1:data 3:3:data\n",
+		". d41d8cd98f00b204e9800998ecf8427e+0 0:0:data\n",
+	}, "data")
+	c.Check(err, check.IsNil)
+	c.Check(txt, check.Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3+Afoo@12345678 37b51d194a7513e45b56f6524f2d51f2+3 37b51d194a7513e45b56f6524f2d51f2+3 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:data 4:2:data 8:1:data 9:3:data\n")
+
+	txt, err = concatManifests([]string{". d41d8cd98f00b204e9800998ecf8427e+0 0:0:data\n"}, "data")
+	c.Check(err, check.IsNil)
+	c.Check(txt, check.Equals, ". d41d8cd98f00b204e9800998ecf8427e+0 0:0:data\n")
+}
+
+func (s *IntegrationSuite) TestS3CollectionMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage.collbucket, "")
+}
+func (s *IntegrationSuite) TestS3ProjectMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage.projbucket, stage.coll.Name+"/")
+}
+func (s *IntegrationSuite) testS3MultipartUpload(c *check.C, bucket *s3.Bucket, prefix string) {
+	key := prefix + "newdir/multipart-file"
+	multi, err := bucket.InitMulti(key, "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	c.Check(multi.UploadId, check.Matches, `zzzzz-j7d0g-[a-z0-9]{15}`)
+
+	data := make([][]byte, 3)
+	var parts []s3.Part
+	for i := range data {
+		data[i] = make([]byte, 1<<20+i)
+		rand.Read(data[i])
+		part, err := multi.PutPart(i+1, bytes.NewReader(data[i]))
+		c.Assert(err, check.IsNil)
+		parts = append(parts, part)
+	}
+	// Replace part 2
+	rand.Read(data[1])
+	parts[1], err = multi.PutPart(2, bytes.NewReader(data[1]))
+	c.Assert(err, check.IsNil)
+
+	multis, _, err := bucket.ListMulti(prefix, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(multis, check.HasLen, 1)
+	c.Check(multis[0].Key, check.Equals, key)
+	c.Check(multis[0].UploadId, check.Equals, multi.UploadId)
+
+	listed, err := multi.ListParts()
+	c.Assert(err, check.IsNil)
+	c.Check(listed, check.DeepEquals, parts)
+
+	// Wrong ETag
+	badparts := append([]s3.Part(nil), parts...)
+	badparts[0].ETag = `"d41d8cd98f00b204e9800998ecf8427e"`
+	err = multi.Complete(badparts)
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, InvalidPart)
+
+	err = multi.Complete(parts)
+	c.Assert(err, check.IsNil)
+
+	rdr, err := bucket.GetReader(key)
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(rdr)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf, bytes.Join(data, nil)), check.Equals, true)
+
+	// Completed upload is no longer listed
+	multis, _, err = bucket.ListMulti(prefix, "")
+	c.Assert(err, check.IsNil)
+	c.Check(multis, check.HasLen, 0)
+}
+
+func (s *IntegrationSuite) TestS3MultipartAbort(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	bucket := stage.collbucket
+
+	multi, err := bucket.InitMulti("aborted-file", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	_, err = multi.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Assert(err, check.IsNil)
+
+	// Aborting requires upload permission
+	s.testServer.Config.cluster.Collections.WebDAVPermission.User.Upload = false
+	err = multi.Abort()
+	s.testServer.Config.cluster.Collections.WebDAVPermission.User.Upload = true
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).StatusCode, check.Equals, 403)
+	listed, err := multi.ListParts()
+	c.Assert(err, check.IsNil)
+	c.Check(listed, check.HasLen, 1)
+
+	c.Check(multi.Abort(), check.IsNil)
+
+	_, err = multi.PutPart(2, bytes.NewReader([]byte("bar")))
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).StatusCode, check.Equals, 404)
+	c.Check(err.(*s3.Error).Code, check.Equals, NoSuchUpload)
+
+	_, err = multi.ListParts()
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, NoSuchUpload)
+
+	_, err = bucket.GetReader("aborted-file")
+	c.Check(err.(*s3.Error).Code, check.Equals, NoSuchKey)
+
+	// An upload ID can't be used with a different key
+	multi, err = bucket.InitMulti("file1", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	defer multi.Abort()
+	multi.Key = "file2"
+	_, err = multi.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, NoSuchUpload)
+}
@@ -0,0 +1,419 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// S3 user metadata and object tags are stored in the "s3_objects"
+// collection property, which maps the path of each object within the
+// collection to its metadata and tags:
+//
+//	"s3_objects": {
+//	  "dir/file.txt": {
+//	    "metadata": {"color": "blue"},
+//	    "tags": {"shape": "round"}
+//	  }
+//	}
+//
+// S3 requests only read and write this property. Other collection
+// properties are not exposed as metadata or tags, and are left alone
+// when an object's metadata or tags are replaced or deleted.
+const (
+	s3MetadataHeaderPrefix = "X-Amz-Meta-"
+	s3ObjectsProperty      = "s3_objects"
+)
+
+// s3objectProperties holds the user metadata and tags of a single
+// object.
+type s3objectProperties struct {
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Tags     map[string]interface{} `json:"tags,omitempty"`
+}
+
+func (p s3objectProperties) empty() bool {
+	return len(p.Metadata) == 0 && len(p.Tags) == 0
+}
+
+// s3parseObjectProperties converts a JSON-decoded entry of the
+// s3_objects property to an s3objectProperties. Invalid entries are
+// treated as empty.
+func s3parseObjectProperties(v interface{}) s3objectProperties {
+	switch v := v.(type) {
+	case s3objectProperties:
+		return v
+	case map[string]interface{}:
+		md, _ := v["metadata"].(map[string]interface{})
+		tags, _ := v["tags"].(map[string]interface{})
+		return s3objectProperties{Metadata: md, Tags: tags}
+	default:
+		return s3objectProperties{}
+	}
+}
+
+// s3getObjectProperties returns the metadata and tags of the object
+// with the given key, given the properties of the collection
+// containing it.
+func s3getObjectProperties(props map[string]interface{}, key string) s3objectProperties {
+	objects, _ := props[s3ObjectsProperty].(map[string]interface{})
+	return s3parseObjectProperties(objects[key])
+}
+
+// s3setObjectProperties updates props (the properties of a
+// collection) so the object with the given key has the given
+// metadata and tags. If p is empty, the object's entry is removed.
+func s3setObjectProperties(props map[string]interface{}, key string, p s3objectProperties) {
+	objects, _ := props[s3ObjectsProperty].(map[string]interface{})
+	if p.empty() {
+		delete(objects, key)
+	} else {
+		if objects == nil {
+			objects = map[string]interface{}{}
+		}
+		objects[key] = p
+	}
+	if len(objects) == 0 {
+		delete(props, s3ObjectsProperty)
+	} else {
+		props[s3ObjectsProperty] = objects
+	}
+}
+
+type s3tagging struct {
+	XMLName string  `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Tagging"`
+	TagSet  []s3tag `xml:"TagSet>Tag"`
+}
+
+type s3tag struct {
+	Key   string
+	Value string
+}
+
+// s3isTaggingRequest returns true if r is a GetObjectTagging,
+// PutObjectTagging, or DeleteObjectTagging request.
+func s3isTaggingRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["tagging"]
+	return ok
+}
+
+// s3requestProperties returns the object metadata and tags
+// indicated by the user metadata (x-amz-meta-*) and tagging
+// (x-amz-tagging) headers of a PutObject or CreateMultipartUpload
+// request.
+func s3requestProperties(r *http.Request) (s3objectProperties, error) {
+	var p s3objectProperties
+	dec := new(mime.WordDecoder)
+	for k, v := range r.Header {
+		if !strings.HasPrefix(k, s3MetadataHeaderPrefix) || len(k) == len(s3MetadataHeaderPrefix) {
+			continue
+		}
+		val, err := dec.DecodeHeader(strings.Join(v, ","))
+		if err != nil {
+			return s3objectProperties{}, fmt.Errorf("invalid value for metadata header %q: %w", k, err)
+		}
+		if p.Metadata == nil {
+			p.Metadata = map[string]interface{}{}
+		}
+		p.Metadata[strings.ToLower(k[len(s3MetadataHeaderPrefix):])] = val
+	}
+	if hdr := r.Header.Get("X-Amz-Tagging"); hdr != "" {
+		tags, err := url.ParseQuery(hdr)
+		if err != nil {
+			return s3objectProperties{}, fmt.Errorf("invalid x-amz-tagging header: %w", err)
+		}
+		for k, v := range tags {
+			if k == "" {
+				return s3objectProperties{}, errors.New("invalid x-amz-tagging header: empty tag key")
+			}
+			if p.Tags == nil {
+				p.Tags = map[string]interface{}{}
+			}
+			p.Tags[k] = v[len(v)-1]
+		}
+	}
+	return p, nil
+}
+
+// s3setMetadataHeaders adds x-amz-meta-* and x-amz-tagging-count
+// response headers corresponding to the given object metadata and
+// tags.
+//
+// Metadata entries whose keys cannot be used in an HTTP header, and
+// entries that are not strings, are omitted.
+func s3setMetadataHeaders(w http.ResponseWriter, p s3objectProperties) {
+	for k, v := range p.Metadata {
+		v, ok := v.(string)
+		if !ok || !s3validMetadataKey(k) {
+			continue
+		}
+		w.Header().Set(s3MetadataHeaderPrefix+k, mime.BEncoding.Encode("UTF-8", v))
+	}
+	ntags := 0
+	for _, v := range p.Tags {
+		if _, ok := v.(string); ok {
+			ntags++
+		}
+	}
+	if ntags > 0 {
+		w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(ntags))
+	}
+}
+
+// s3validMetadataKey returns true if k can be used as the suffix of an
+// x-amz-meta-* header name.
+func s3validMetadataKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// s3objectKey returns the (already loaded) collection containing the
+// object at fspath, and the key of the object's entry in the
+// collection's s3_objects property. It returns nil if fspath is not
+// inside a collection.
+func (h *handler) s3objectKey(fs arvados.CustomFileSystem, fspath string) (*arvados.Collection, string) {
+	coll, rest := h.determineCollection(fs, fspath)
+	if coll == nil {
+		return nil, ""
+	}
+	// A folder object "foo/" is written as "foo/." (see
+	// PutObject).
+	return coll, strings.TrimSuffix(rest, ".")
+}
+
+// s3objectCollection returns the UUID of the collection containing
+// the object at fspath, and the object's key, or "" if the object
+// does not exist or is not inside a collection. If it returns "", it
+// has already sent an error response.
+func (h *handler) s3objectCollection(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, fspath string) (string, string) {
+	fi, err := fs.Stat(strings.TrimSuffix(fspath, "/"))
+	if os.IsNotExist(err) ||
+		(err != nil && err.Error() == "not a directory") ||
+		(err == nil && fi.IsDir() && !strings.HasSuffix(fspath, "/")) {
+		s3ErrorResponse(w, NoSuchKey, "The specified key does not exist.", r.URL.Path, http.StatusNotFound)
+		return "", ""
+	} else if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusBadGateway)
+		return "", ""
+	}
+	coll, key := h.s3objectKey(fs, fspath)
+	if coll == nil || coll.UUID == "" || key == "" {
+		// e.g., a subproject in a project bucket, or a
+		// collection accessed by PDH
+		s3ErrorResponse(w, InvalidRequest, "object is not in a writable collection, so it cannot have tags or metadata", r.URL.Path, http.StatusBadRequest)
+		return "", ""
+	}
+	return coll.UUID, key
+}
+
+// s3collectionProperties returns the current properties of the
+// collection with the given UUID.
+func s3collectionProperties(r *http.Request, client *arvados.Client, uuid string) (map[string]interface{}, error) {
+	var coll arvados.Collection
+	err := client.RequestAndDecodeContext(r.Context(), &coll, "GET", "arvados/v1/collections/"+uuid, nil, map[string]interface{}{
+		"select": []string{"uuid", "properties"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if coll.Properties == nil {
+		coll.Properties = map[string]interface{}{}
+	}
+	return coll.Properties, nil
+}
+
+// s3checkVocabulary checks that the given metadata and tags (being
+// added by the client) conform to the site's metadata vocabulary. If
+// not, it sends an error response with the given S3 error code and
+// returns false.
+//
+// The controller does not check the contents of the s3_objects
+// property, so this is the only place the vocabulary is enforced.
+func (h *handler) s3checkVocabulary(w http.ResponseWriter, r *http.Request, client *arvados.Client, p s3objectProperties, s3code string) bool {
+	if p.empty() {
+		return true
+	}
+	var raw json.RawMessage
+	err := client.RequestAndDecodeContext(r.Context(), &raw, "GET", "arvados/v1/vocabulary", nil, nil)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, fmt.Sprintf("error retrieving vocabulary: %s", err), r.URL.Path, http.StatusBadGateway)
+		return false
+	}
+	var managed []string
+	for k := range h.Config.cluster.Collections.ManagedProperties {
+		managed = append(managed, k)
+	}
+	voc, err := arvados.NewVocabulary(raw, managed)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, fmt.Sprintf("error loading vocabulary: %s", err), r.URL.Path, http.StatusInternalServerError)
+		return false
+	}
+	for _, props := range []map[string]interface{}{p.Metadata, p.Tags} {
+		err = voc.Check(props)
+		if err != nil {
+			s3ErrorResponse(w, s3code, err.Error(), r.URL.Path, http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// s3updateObjectProperties calls update to modify the metadata and
+// tags of the object with the given key in the collection with the
+// given UUID, and saves the result. Other collection properties, and
+// the entries of other objects, are preserved.
+func s3updateObjectProperties(r *http.Request, client *arvados.Client, uuid, key string, update func(*s3objectProperties)) error {
+	props, err := s3collectionProperties(r, client, uuid)
+	if err != nil {
+		return err
+	}
+	p := s3getObjectProperties(props, key)
+	update(&p)
+	s3setObjectProperties(props, key, p)
+	return client.RequestAndDecodeContext(r.Context(), nil, "PUT", "arvados/v1/collections/"+uuid, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"properties": props,
+		},
+	})
+}
+
+// s3propertiesError sends an S3 error response for an error returned
+// by the API server when reading or updating collection properties.
+// Errors caused by invalid properties (e.g., vocabulary violations
+// detected by the controller) are reported as s3code with status
+// 400.
+func s3propertiesError(w http.ResponseWriter, r *http.Request, s3code string, err error) {
+	var te *arvados.TransactionError
+	if errors.As(err, &te) {
+		if te.StatusCode == http.StatusBadRequest || te.StatusCode == http.StatusUnprocessableEntity {
+			s3ErrorResponse(w, s3code, err.Error(), r.URL.Path, http.StatusBadRequest)
+		} else if te.StatusCode == http.StatusForbidden || te.StatusCode == http.StatusUnauthorized {
+			s3ErrorResponse(w, AccessDenied, err.Error(), r.URL.Path, http.StatusForbidden)
+		} else if te.StatusCode == http.StatusNotFound {
+			s3ErrorResponse(w, NoSuchKey, err.Error(), r.URL.Path, http.StatusNotFound)
+		} else {
+			s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusBadGateway)
+		}
+		return
+	}
+	s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusBadGateway)
+}
+
+// s3applyProperties replaces the metadata and tags of the object at
+// fspath with p. It is used after PutObject and
+// CompleteMultipartUpload requests, which replace any metadata and
+// tags of an existing object, like S3. If it fails, it sends an error
+// response and returns false.
+//
+// The collection is only updated if p is non-empty or the object
+// already has an entry in the already-loaded collection properties,
+// so writing an object without metadata or tags does not cost an
+// extra API call.
+func (h *handler) s3applyProperties(w http.ResponseWriter, r *http.Request, client *arvados.Client, token string, fs arvados.CustomFileSystem, fspath string, p s3objectProperties) bool {
+	coll, key := h.s3objectKey(fs, fspath)
+	if coll == nil || coll.UUID == "" || key == "" {
+		if p.empty() {
+			return true
+		}
+		s3ErrorResponse(w, InvalidArgument, "object is not in a writable collection, so it cannot have tags or metadata", r.URL.Path, http.StatusBadRequest)
+		return false
+	}
+	if p.empty() && s3getObjectProperties(coll.Properties, key).empty() {
+		return true
+	}
+	err := s3updateObjectProperties(r, client, coll.UUID, key, func(old *s3objectProperties) { *old = p })
+	if err != nil {
+		s3propertiesError(w, r, InvalidArgument, err)
+		return false
+	}
+	h.Config.Cache.ResetSession(token)
+	return true
+}
+
+// serveS3Tagging handles GetObjectTagging, PutObjectTagging, and
+// DeleteObjectTagging requests.
+func (h *handler) serveS3Tagging(w http.ResponseWriter, r *http.Request, client *arvados.Client, token string, fs arvados.CustomFileSystem, fspath string) {
+	uuid, key := h.s3objectCollection(w, r, fs, fspath)
+	if uuid == "" {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		props, err := s3collectionProperties(r, client, uuid)
+		if err != nil {
+			s3propertiesError(w, r, InternalError, err)
+			return
+		}
+		var resp s3tagging
+		resp.TagSet = []s3tag{}
+		for k, v := range s3getObjectProperties(props, key).Tags {
+			if v, ok := v.(string); ok {
+				resp.TagSet = append(resp.TagSet, s3tag{Key: k, Value: v})
+			}
+		}
+		sort.Slice(resp.TagSet, func(i, j int) bool { return resp.TagSet[i].Key < resp.TagSet[j].Key })
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(resp)
+	case http.MethodPut, http.MethodDelete:
+		tags := map[string]interface{}{}
+		if r.Method == http.MethodPut {
+			var req s3tagging
+			err := xml.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				s3ErrorResponse(w, MalformedXML, fmt.Sprintf("error decoding request body: %s", err), r.URL.Path, http.StatusBadRequest)
+				return
+			}
+			for _, tag := range req.TagSet {
+				if tag.Key == "" {
+					s3ErrorResponse(w, InvalidTag, "tag key cannot be empty", r.URL.Path, http.StatusBadRequest)
+					return
+				} else if _, dup := tags[tag.Key]; dup {
+					s3ErrorResponse(w, InvalidTag, fmt.Sprintf("duplicate tag key %q", tag.Key), r.URL.Path, http.StatusBadRequest)
+					return
+				}
+				tags[tag.Key] = tag.Value
+			}
+			if !h.s3checkVocabulary(w, r, client, s3objectProperties{Tags: tags}, InvalidTag) {
+				return
+			}
+		}
+		err := s3updateObjectProperties(r, client, uuid, key, func(p *s3objectProperties) { p.Tags = tags })
+		if err != nil {
+			s3propertiesError(w, r, InvalidTag, err)
+			return
+		}
+		// Ensure a subsequent HEAD request will see the new
+		// tag count.
+		h.Config.Cache.ResetSession(token)
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		s3ErrorResponse(w, InvalidRequest, "method not allowed", r.URL.Path, http.StatusMethodNotAllowed)
+	}
+}
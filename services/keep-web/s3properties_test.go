@@ -0,0 +1,286 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	aws_aws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	aws_credentials "github.com/aws/aws-sdk-go/aws/credentials"
+	aws_session "github.com/aws/aws-sdk-go/aws/session"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestS3RequestProperties(c *check.C) {
+	r := httptest.NewRequest("PUT", "/bucket/key", nil)
+	r.Header.Set("X-Amz-Meta-Color", "blue")
+	r.Header.Set("x-amz-meta-drink", "=?UTF-8?b?Y2Fmw6k=?=")
+	r.Header.Set("X-Amz-Tagging", "shape=round&size=&color=red")
+	r.Header.Set("Content-Type", "text/plain")
+	props, err := s3requestProperties(r)
+	c.Check(err, check.IsNil)
+	c.Check(props, check.DeepEquals, s3objectProperties{
+		Metadata: map[string]interface{}{
+			"color": "blue",
+			"drink": "café",
+		},
+		Tags: map[string]interface{}{
+			"color": "red",
+			"shape": "round",
+			"size":  "",
+		},
+	})
+
+	r.Header.Set("X-Amz-Tagging", "=foo")
+	_, err = s3requestProperties(r)
+	c.Check(err, check.ErrorMatches, `.*empty tag key.*`)
+
+	r = httptest.NewRequest("PUT", "/bucket/key", nil)
+	props, err = s3requestProperties(r)
+	c.Check(err, check.IsNil)
+	c.Check(props.empty(), check.Equals, true)
+}
+
+func (s *UnitSuite) TestS3SetMetadataHeaders(c *check.C) {
+	resp := httptest.NewRecorder()
+	s3setMetadataHeaders(resp, s3objectProperties{
+		Metadata: map[string]interface{}{
+			"color":      "blue",
+			"name":       "café",
+			"has space":  "ok",
+			"non-string": 1234,
+		},
+		Tags: map[string]interface{}{
+			"shape": "round",
+			"size":  "",
+			"list":  []interface{}{"a", "b"},
+		},
+	})
+	c.Check(resp.Header().Get("X-Amz-Meta-Color"), check.Equals, "blue")
+	c.Check(resp.Header().Get("X-Amz-Meta-Name"), check.Equals, "=?UTF-8?b?Y2Fmw6k=?=")
+	c.Check(resp.Header().Get("X-Amz-Tagging-Count"), check.Equals, "2")
+	c.Check(resp.Header(), check.HasLen, 3)
+
+	resp = httptest.NewRecorder()
+	s3setMetadataHeaders(resp, s3objectProperties{})
+	c.Check(resp.Header(), check.HasLen, 0)
+}
+
+func (s *UnitSuite) TestS3ObjectProperties(c *check.C) {
+	props := map[string]interface{}{
+		"other": "value",
+		s3ObjectsProperty: map[string]interface{}{
+			"dir/file": map[string]interface{}{
+				"metadata": map[string]interface{}{"color": "blue"},
+				"tags":     map[string]interface{}{"shape": "round"},
+			},
+		},
+	}
+	c.Check(s3getObjectProperties(props, "dir/file"), check.DeepEquals, s3objectProperties{
+		Metadata: map[string]interface{}{"color": "blue"},
+		Tags:     map[string]interface{}{"shape": "round"},
+	})
+	c.Check(s3getObjectProperties(props, "dir/other").empty(), check.Equals, true)
+	c.Check(s3getObjectProperties(nil, "dir/file").empty(), check.Equals, true)
+
+	s3setObjectProperties(props, "file2", s3objectProperties{Tags: map[string]interface{}{"size": "large"}})
+	c.Check(s3getObjectProperties(props, "file2").Tags, check.DeepEquals, map[string]interface{}{"size": "large"})
+	c.Check(s3getObjectProperties(props, "dir/file").Tags, check.DeepEquals, map[string]interface{}{"shape": "round"})
+
+	s3setObjectProperties(props, "dir/file", s3objectProperties{})
+	s3setObjectProperties(props, "file2", s3objectProperties{})
+	c.Check(props, check.DeepEquals, map[string]interface{}{"other": "value"})
+}
+
+func (s *IntegrationSuite) s3awsClient() *aws_s3.S3 {
+	sess := aws_session.Must(aws_session.NewSession(&aws_aws.Config{
+		Region:           aws_aws.String("auto"),
+		Endpoint:         aws_aws.String("http://" + s.testServer.Addr),
+		Credentials:      aws_credentials.NewStaticCredentials(url.QueryEscape(arvadostest.ActiveTokenV2), url.QueryEscape(arvadostest.ActiveTokenV2), ""),
+		S3ForcePathStyle: aws_aws.Bool(true),
+	}))
+	return aws_s3.New(sess)
+}
+
+func (s *IntegrationSuite) TestS3CollectionObjectTagging(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3ObjectTagging(c, stage, stage.collbucket.Name, "")
+}
+func (s *IntegrationSuite) TestS3ProjectObjectTagging(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3ObjectTagging(c, stage, stage.projbucket.Name, stage.coll.Name+"/")
+}
+func (s *IntegrationSuite) testS3ObjectTagging(c *check.C, stage s3stage, bucket, prefix string) {
+	client := s.s3awsClient()
+	ctx := context.Background()
+	key := prefix + "tagged-file"
+
+	// Metadata and tags supplied with PutObject are saved in the
+	// s3_objects collection property.
+	_, err := client.PutObjectWithContext(ctx, &aws_s3.PutObjectInput{
+		Bucket:   aws_aws.String(bucket),
+		Key:      aws_aws.String(key),
+		Body:     bytes.NewReader([]byte("foo")),
+		Metadata: map[string]*string{"Color": aws_aws.String("blue")},
+		Tagging:  aws_aws.String("shape=round"),
+	})
+	c.Assert(err, check.IsNil)
+	var coll arvados.Collection
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties[s3ObjectsProperty], check.DeepEquals, map[string]interface{}{
+		"tagged-file": map[string]interface{}{
+			"metadata": map[string]interface{}{"color": "blue"},
+			"tags":     map[string]interface{}{"shape": "round"},
+		},
+	})
+
+	head, err := client.HeadObjectWithContext(ctx, &aws_s3.HeadObjectInput{
+		Bucket: aws_aws.String(bucket),
+		Key:    aws_aws.String(key),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(*head.Metadata["Color"], check.Equals, "blue")
+	c.Check(head.Metadata["Shape"], check.IsNil)
+
+	// Other objects in the same collection have their own
+	// (empty) metadata and tags.
+	head, err = client.HeadObjectWithContext(ctx, &aws_s3.HeadObjectInput{
+		Bucket: aws_aws.String(bucket),
+		Key:    aws_aws.String(prefix + "sailboat.txt"),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(head.Metadata, check.HasLen, 0)
+
+	// Other collection properties are not exposed as tags, and
+	// are preserved when tags are replaced.
+	coll.Properties["color"] = "green"
+	coll.Properties["number"] = 1234
+	err = stage.arv.RequestAndDecode(&coll, "PUT", "arvados/v1/collections/"+stage.coll.UUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"properties": coll.Properties,
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	tags, err := client.GetObjectTaggingWithContext(ctx, &aws_s3.GetObjectTaggingInput{
+		Bucket: aws_aws.String(bucket),
+		Key:    aws_aws.String(key),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(tags.TagSet, check.DeepEquals, []*aws_s3.Tag{
+		{Key: aws_aws.String("shape"), Value: aws_aws.String("round")},
+	})
+
+	_, err = client.PutObjectTaggingWithContext(ctx, &aws_s3.PutObjectTaggingInput{
+		Bucket: aws_aws.String(bucket),
+		Key:    aws_aws.String(key),
+		Tagging: &aws_s3.Tagging{TagSet: []*aws_s3.Tag{
+			{Key: aws_aws.String("size"), Value: aws_aws.String("large")},
+		}},
+	})
+	c.Assert(err, check.IsNil)
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties, check.DeepEquals, map[string]interface{}{
+		"color":  "green",
+		"number": float64(1234),
+		s3ObjectsProperty: map[string]interface{}{
+			"tagged-file": map[string]interface{}{
+				"metadata": map[string]interface{}{"color": "blue"},
+				"tags":     map[string]interface{}{"size": "large"},
+			},
+		},
+	})
+
+	_, err = client.DeleteObjectTaggingWithContext(ctx, &aws_s3.DeleteObjectTaggingInput{
+		Bucket: aws_aws.String(bucket),
+		Key:    aws_aws.String(key),
+	})
+	c.Assert(err, check.IsNil)
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties, check.DeepEquals, map[string]interface{}{
+		"color":  "green",
+		"number": float64(1234),
+		s3ObjectsProperty: map[string]interface{}{
+			"tagged-file": map[string]interface{}{
+				"metadata": map[string]interface{}{"color": "blue"},
+			},
+		},
+	})
+
+	// Deleting the object removes its entry.
+	_, err = client.DeleteObjectWithContext(ctx, &aws_s3.DeleteObjectInput{
+		Bucket: aws_aws.String(bucket),
+		Key:    aws_aws.String(key),
+	})
+	c.Assert(err, check.IsNil)
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties, check.DeepEquals, map[string]interface{}{
+		"color":  "green",
+		"number": float64(1234),
+	})
+
+	_, err = client.GetObjectTaggingWithContext(ctx, &aws_s3.GetObjectTaggingInput{
+		Bucket: aws_aws.String(bucket),
+		Key:    aws_aws.String(prefix + "nonexistent-file"),
+	})
+	c.Assert(err, check.NotNil)
+	c.Check(err.(awserr.RequestFailure).StatusCode(), check.Equals, http.StatusNotFound)
+	c.Check(err.(awserr.Error).Code(), check.Equals, NoSuchKey)
+}
+
+func (s *IntegrationSuite) TestS3TaggingVocabulary(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	client := s.s3awsClient()
+	ctx := context.Background()
+
+	var voc arvados.Vocabulary
+	err := stage.arv.RequestAndDecode(&voc, "GET", "arvados/v1/vocabulary", nil, nil)
+	c.Assert(err, check.IsNil)
+	if !voc.StrictTags {
+		c.Skip("test server vocabulary is not strict")
+	}
+
+	_, err = client.PutObjectWithContext(ctx, &aws_s3.PutObjectInput{
+		Bucket:   aws_aws.String(stage.collbucket.Name),
+		Key:      aws_aws.String("new-file"),
+		Body:     bytes.NewReader([]byte("foo")),
+		Metadata: map[string]*string{"Undefined-Key": aws_aws.String("x")},
+	})
+	c.Assert(err, check.NotNil)
+	c.Check(err.(awserr.RequestFailure).StatusCode(), check.Equals, http.StatusBadRequest)
+	c.Check(err.(awserr.Error).Code(), check.Equals, InvalidArgument)
+	// Nothing was written
+	_, err = client.HeadObjectWithContext(ctx, &aws_s3.HeadObjectInput{
+		Bucket: aws_aws.String(stage.collbucket.Name),
+		Key:    aws_aws.String("new-file"),
+	})
+	c.Check(err, check.NotNil)
+
+	_, err = client.PutObjectTaggingWithContext(ctx, &aws_s3.PutObjectTaggingInput{
+		Bucket: aws_aws.String(stage.collbucket.Name),
+		Key:    aws_aws.String("sailboat.txt"),
+		Tagging: &aws_s3.Tagging{TagSet: []*aws_s3.Tag{
+			{Key: aws_aws.String("undefined-key"), Value: aws_aws.String("x")},
+		}},
+	})
+	c.Assert(err, check.NotNil)
+	c.Check(err.(awserr.RequestFailure).StatusCode(), check.Equals, http.StatusBadRequest)
+	c.Check(err.(awserr.Error).Code(), check.Equals, InvalidTag)
+}
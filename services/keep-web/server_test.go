@@ -446,6 +446,12 @@ func (s *IntegrationSuite) SetUpTest(c *check.C) {
 	cfg.cluster.ManagementToken = arvadostest.ManagementToken
 	cfg.cluster.SystemRootToken = arvadostest.SystemRootToken
 	cfg.cluster.Users.AnonymousUserToken = arvadostest.AnonymousToken
+	// Store WebDAV locks in the test database.
+	testCfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, check.IsNil)
+	testCluster, err := testCfg.GetCluster("")
+	c.Assert(err, check.IsNil)
+	cfg.cluster.PostgreSQL = testCluster.PostgreSQL
 	s.ArvConfig = arvCfg
 	s.testServer = &server{Config: cfg}
 	logger := ctxlog.TestLogger(c)
@@ -9,12 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	prand "math/rand"
 	"os"
 	"path"
 	"strings"
-	"sync/atomic"
-	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 
@@ -23,9 +20,7 @@ import (
 )
 
 var (
-	lockPrefix     string = uuid()
-	nextLockSuffix int64  = prand.Int63()
-	errReadOnly           = errors.New("read-only filesystem")
+	errReadOnly = errors.New("read-only filesystem")
 )
 
 // webdavFS implements a webdav.FileSystem by wrapping an
@@ -142,45 +137,6 @@ func (readEOF) Read(p []byte) (int, error) {
 	return 0, io.EOF
 }
 
-// noLockSystem implements webdav.LockSystem by returning success for
-// every possible locking operation, even though it has no side
-// effects such as actually locking anything. This works for a
-// read-only webdav filesystem because webdav locks only apply to
-// writes.
-//
-// This is more suitable than webdav.NewMemLS() for two reasons:
-// First, it allows keep-web to use one locker for all collections
-// even though coll1.vhost/foo and coll2.vhost/foo have the same path
-// but represent different resources. Additionally, it returns valid
-// tokens (rfc2518 specifies that tokens are represented as URIs and
-// are unique across all resources for all time), which might improve
-// client compatibility.
-//
-// However, it does also permit impossible operations, like acquiring
-// conflicting locks and releasing non-existent locks.  This might
-// confuse some clients if they try to probe for correctness.
-//
-// Currently this is a moot point: the LOCK and UNLOCK methods are not
-// accepted by keep-web, so it suffices to implement the
-// webdav.LockSystem interface.
-type noLockSystem struct{}
-
-func (*noLockSystem) Confirm(time.Time, string, string, ...webdav.Condition) (func(), error) {
-	return noop, nil
-}
-
-func (*noLockSystem) Create(now time.Time, details webdav.LockDetails) (token string, err error) {
-	return fmt.Sprintf("opaquelocktoken:%s-%x", lockPrefix, atomic.AddInt64(&nextLockSuffix, 1)), nil
-}
-
-func (*noLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
-	return webdav.LockDetails{}, nil
-}
-
-func (*noLockSystem) Unlock(now time.Time, token string) error {
-	return nil
-}
-
 func noop() {}
 
 // Return a version 1 variant 4 UUID, meaning all bits are random
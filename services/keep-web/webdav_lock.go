@@ -0,0 +1,251 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"golang.org/x/net/webdav"
+)
+
+// webdavLock is a WebDAV lock on a file or directory in a
+// collection.
+type webdavLock struct {
+	Token string
+	// UUID of the collection containing the locked resource (or
+	// its portable data hash, if it was accessed by PDH), or ""
+	// if the resource is not inside a collection (e.g., a project
+	// directory in a site filesystem). See webdavLockNamespace.
+	CollectionUUID string
+	// Path of the locked resource, relative to the collection
+	// root (or the site filesystem root, if CollectionUUID is
+	// ""), with a leading "/".
+	Path      string
+	ZeroDepth bool
+	OwnerXML  string
+	Expires   time.Time
+}
+
+// covers returns true if the lock applies to the given path in the
+// same collection.
+func (lock *webdavLock) covers(path string) bool {
+	return lock.Path == path || (!lock.ZeroDepth && pathIsAncestor(lock.Path, path))
+}
+
+// conflicts returns true if lock and other cannot both be held.
+func (lock *webdavLock) conflicts(other webdavLock) bool {
+	return lock.CollectionUUID == other.CollectionUUID &&
+		(lock.covers(other.Path) || other.covers(lock.Path))
+}
+
+func pathIsAncestor(dir, path string) bool {
+	return (dir == "/" && path != "/") || strings.HasPrefix(path, dir+"/")
+}
+
+// webdavLockStore stores webdav locks.
+//
+// All methods ignore locks that expired before the given time.
+type webdavLockStore interface {
+	// Save the given lock, unless it conflicts with an existing
+	// lock, in which case return webdav.ErrLocked. The
+	// check-and-save operation must be atomic with respect to
+	// other create calls -- including calls in other processes,
+	// if the store is shared.
+	create(now time.Time, lock webdavLock) error
+	// Return the lock with the given token, or
+	// webdav.ErrNoSuchLock.
+	get(now time.Time, token string) (webdavLock, error)
+	// Change the expiry time of the lock with the given token,
+	// and return the updated lock, or webdav.ErrNoSuchLock.
+	refresh(now time.Time, token string, expires time.Time) (webdavLock, error)
+	// Delete the lock with the given token, or return
+	// webdav.ErrNoSuchLock.
+	remove(now time.Time, token string) error
+}
+
+// webdavLockSystem implements webdav.LockSystem for a single webdav
+// handler, using a store that is shared by all handlers.
+//
+// Resource names passed in by the webdav handler are mapped to a
+// collection UUID and a path within that collection, so a given file
+// has the same locks regardless of how it is addressed (e.g.,
+// collection vhost, /c=uuid/..., /by_id/uuid/..., or
+// /users/name/project/collection/...).
+type webdavLockSystem struct {
+	store      webdavLockStore
+	maxTimeout time.Duration
+	// resolve returns the collection UUID and path corresponding
+	// to the given webdav resource name.
+	resolve func(name string) (collectionUUID, path string)
+}
+
+func (ls *webdavLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	coll, path := ls.resolve(details.Root)
+	lock := webdavLock{
+		Token:          "opaquelocktoken:" + uuid(),
+		CollectionUUID: coll,
+		Path:           path,
+		ZeroDepth:      details.ZeroDepth,
+		OwnerXML:       details.OwnerXML,
+		Expires:        now.Add(ls.timeout(details.Duration)),
+	}
+	err := ls.store.create(now, lock)
+	if err != nil {
+		return "", err
+	}
+	return lock.Token, nil
+}
+
+func (ls *webdavLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	lock, err := ls.store.refresh(now, token, now.Add(ls.timeout(duration)))
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	return ls.details(now, lock), nil
+}
+
+func (ls *webdavLockSystem) Unlock(now time.Time, token string) error {
+	return ls.store.remove(now, token)
+}
+
+// Confirm succeeds if, for each non-empty name, the conditions
+// include the token of a current lock that covers that name.
+//
+// Unlike webdav.NewMemLS(), this does not prevent the confirmed
+// locks from being released or refreshed by other requests while the
+// returned release func has not been called yet.
+func (ls *webdavLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+		coll, path := ls.resolve(name)
+		ok := false
+		for _, cond := range conditions {
+			if cond.Token == "" || cond.Not {
+				continue
+			}
+			lock, err := ls.store.get(now, cond.Token)
+			if err == webdav.ErrNoSuchLock {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if lock.CollectionUUID == coll && lock.covers(path) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	return noop, nil
+}
+
+// timeout returns the lock duration to use when a client requests
+// the given duration (negative means infinite).
+func (ls *webdavLockSystem) timeout(requested time.Duration) time.Duration {
+	if requested < 0 || requested > ls.maxTimeout {
+		return ls.maxTimeout
+	}
+	return requested
+}
+
+func (ls *webdavLockSystem) details(now time.Time, lock webdavLock) webdav.LockDetails {
+	return webdav.LockDetails{
+		// The webdav handler only uses Root to build the
+		// lockroot element of a LOCK response, so returning
+		// the collection-relative path is good enough.
+		Root:      lock.Path,
+		Duration:  lock.Expires.Sub(now),
+		OwnerXML:  lock.OwnerXML,
+		ZeroDepth: lock.ZeroDepth,
+	}
+}
+
+// memLockStore is a webdavLockStore that stores locks in memory. It
+// is only suitable when a single keep-web process serves all WebDAV
+// requests.
+type memLockStore struct {
+	locks map[string]webdavLock
+	mtx   sync.Mutex
+}
+
+func (store *memLockStore) create(now time.Time, lock webdavLock) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if store.locks == nil {
+		store.locks = map[string]webdavLock{}
+	}
+	for token, other := range store.locks {
+		if other.Expires.Before(now) {
+			delete(store.locks, token)
+		} else if lock.conflicts(other) {
+			return webdav.ErrLocked
+		}
+	}
+	store.locks[lock.Token] = lock
+	return nil
+}
+
+func (store *memLockStore) get(now time.Time, token string) (webdavLock, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	lock, ok := store.locks[token]
+	if !ok || lock.Expires.Before(now) {
+		return webdavLock{}, webdav.ErrNoSuchLock
+	}
+	return lock, nil
+}
+
+func (store *memLockStore) refresh(now time.Time, token string, expires time.Time) (webdavLock, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	lock, ok := store.locks[token]
+	if !ok || lock.Expires.Before(now) {
+		return webdavLock{}, webdav.ErrNoSuchLock
+	}
+	lock.Expires = expires
+	store.locks[token] = lock
+	return lock, nil
+}
+
+func (store *memLockStore) remove(now time.Time, token string) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	lock, ok := store.locks[token]
+	if !ok || lock.Expires.Before(now) {
+		return webdav.ErrNoSuchLock
+	}
+	delete(store.locks, token)
+	return nil
+}
+
+// webdavLockNamespace returns the CollectionUUID to use for locks on
+// resources in the given collection.
+func webdavLockNamespace(coll *arvados.Collection) string {
+	if coll.UUID != "" {
+		return coll.UUID
+	}
+	return coll.PortableDataHash
+}
+
+// newWebdavLockStore returns a webdavLockStore for the backend
+// specified in the cluster config (Collections.WebDAVLocks.Backend).
+func newWebdavLockStore(cluster *arvados.Cluster) (webdavLockStore, error) {
+	switch backend := cluster.Collections.WebDAVLocks.Backend; backend {
+	case "memory", "":
+		return &memLockStore{}, nil
+	case "database":
+		return &dbLockStore{cluster: cluster}, nil
+	default:
+		return nil, fmt.Errorf("unsupported Collections.WebDAVLocks.Backend %q (must be \"database\" or \"memory\")", backend)
+	}
+}
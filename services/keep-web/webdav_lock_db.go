@@ -0,0 +1,144 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"golang.org/x/net/webdav"
+)
+
+// Advisory lock class used to serialize lock creation for each
+// collection (the second key is a hash of the collection UUID).
+const webdavLockAdvisoryClass = 10002
+
+// dbLockStore is a webdavLockStore that stores locks in the
+// webdav_locks table in the Arvados database, so they are shared by
+// all keep-web processes.
+type dbLockStore struct {
+	cluster *arvados.Cluster
+
+	db  *sqlx.DB
+	mtx sync.Mutex
+}
+
+func (store *dbLockStore) getdb() (*sqlx.DB, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if store.db != nil {
+		return store.db, nil
+	}
+	db, err := sqlx.Open("postgres", store.cluster.PostgreSQL.Connection.String())
+	if err != nil {
+		return nil, fmt.Errorf("postgresql connection failed: %w", err)
+	}
+	if p := store.cluster.PostgreSQL.ConnectionPool; p > 0 {
+		db.SetMaxOpenConns(p)
+	}
+	store.db = db
+	return db, nil
+}
+
+func (store *dbLockStore) create(now time.Time, lock webdavLock) error {
+	db, err := store.getdb()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, webdavLockAdvisoryClass, lock.CollectionUUID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM webdav_locks WHERE collection_uuid=$1 AND expires_at<$2`, lock.CollectionUUID, now.UTC())
+	if err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT token, collection_uuid, path, zero_depth, owner_xml, expires_at FROM webdav_locks WHERE collection_uuid=$1`, lock.CollectionUUID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		other, err := scanWebdavLock(rows)
+		if err != nil {
+			return err
+		}
+		if lock.conflicts(other) {
+			return webdav.ErrLocked
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = tx.ExecContext(ctx, `INSERT INTO webdav_locks (token, collection_uuid, path, zero_depth, owner_xml, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		lock.Token, lock.CollectionUUID, lock.Path, lock.ZeroDepth, lock.OwnerXML, now.UTC(), lock.Expires.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *dbLockStore) get(now time.Time, token string) (webdavLock, error) {
+	db, err := store.getdb()
+	if err != nil {
+		return webdavLock{}, err
+	}
+	row := db.QueryRowContext(context.Background(), `SELECT token, collection_uuid, path, zero_depth, owner_xml, expires_at FROM webdav_locks WHERE token=$1 AND expires_at>=$2`, token, now.UTC())
+	return scanWebdavLock(row)
+}
+
+func (store *dbLockStore) refresh(now time.Time, token string, expires time.Time) (webdavLock, error) {
+	db, err := store.getdb()
+	if err != nil {
+		return webdavLock{}, err
+	}
+	row := db.QueryRowContext(context.Background(), `UPDATE webdav_locks SET expires_at=$1 WHERE token=$2 AND expires_at>=$3 RETURNING token, collection_uuid, path, zero_depth, owner_xml, expires_at`, expires.UTC(), token, now.UTC())
+	return scanWebdavLock(row)
+}
+
+func (store *dbLockStore) remove(now time.Time, token string) error {
+	db, err := store.getdb()
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(context.Background(), `DELETE FROM webdav_locks WHERE token=$1 AND expires_at>=$2`, token, now.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return webdav.ErrNoSuchLock
+	}
+	return nil
+}
+
+// scanWebdavLock reads a lock from a *sql.Row or *sql.Rows. It
+// returns webdav.ErrNoSuchLock if there is no row.
+func scanWebdavLock(row interface{ Scan(...interface{}) error }) (webdavLock, error) {
+	var lock webdavLock
+	var ownerXML sql.NullString
+	err := row.Scan(&lock.Token, &lock.CollectionUUID, &lock.Path, &lock.ZeroDepth, &ownerXML, &lock.Expires)
+	if err == sql.ErrNoRows {
+		return webdavLock{}, webdav.ErrNoSuchLock
+	} else if err != nil {
+		return webdavLock{}, err
+	}
+	lock.OwnerXML = ownerXML.String
+	return lock, nil
+}
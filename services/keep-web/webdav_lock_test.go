@@ -0,0 +1,210 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"golang.org/x/net/webdav"
+	check "gopkg.in/check.v1"
+)
+
+var _ webdav.LockSystem = &webdavLockSystem{}
+
+func (s *UnitSuite) TestWebdavLockSystemMemory(c *check.C) {
+	testWebdavLockSystem(c, &memLockStore{})
+}
+
+func (s *IntegrationSuite) TestWebdavLockSystemDatabase(c *check.C) {
+	testWebdavLockSystem(c, &dbLockStore{cluster: s.testServer.Config.cluster})
+}
+
+func testWebdavLockSystem(c *check.C, store webdavLockStore) {
+	coll1 := "zzzzz-4zz18-" + strings.Repeat("1", 15)
+	coll2 := "zzzzz-4zz18-" + strings.Repeat("2", 15)
+	// ls1 and ls2 are two webdav handlers that address the same
+	// collection differently: ls1 is a collection handler for
+	// coll1, ls2 is a site filesystem handler.
+	ls1 := &webdavLockSystem{
+		store:      store,
+		maxTimeout: time.Hour,
+		resolve:    func(name string) (string, string) { return coll1, name },
+	}
+	ls2 := &webdavLockSystem{
+		store:      store,
+		maxTimeout: time.Hour,
+		resolve: func(name string) (string, string) {
+			for _, coll := range []string{coll1, coll2} {
+				if name == "/by_id/"+coll {
+					return coll, "/"
+				} else if strings.HasPrefix(name, "/by_id/"+coll+"/") {
+					return coll, name[len("/by_id/"+coll):]
+				}
+			}
+			return "", name
+		},
+	}
+	now := time.Now()
+
+	// Depth-infinity lock on a directory
+	dirToken, err := ls1.Create(now, webdav.LockDetails{Root: "/dir", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	c.Check(dirToken, check.Matches, `opaquelocktoken:[0-9a-f-]{36}`)
+	defer ls1.Unlock(now, dirToken)
+
+	// Conflicts with locks on the same dir, its descendants, and
+	// its ancestors, regardless of how they are addressed
+	for _, trial := range []struct {
+		ls   *webdavLockSystem
+		root string
+		zero bool
+	}{
+		{ls1, "/dir", true},
+		{ls1, "/dir/file", true},
+		{ls2, "/by_id/" + coll1 + "/dir/subdir/file", true},
+		{ls2, "/by_id/" + coll1, false},
+		{ls1, "/", false},
+	} {
+		_, err = trial.ls.Create(now, webdav.LockDetails{Root: trial.root, Duration: time.Minute, ZeroDepth: trial.zero})
+		c.Check(err, check.Equals, webdav.ErrLocked, check.Commentf("%+v", trial))
+	}
+
+	// Doesn't conflict with zero-depth locks on ancestors, or
+	// locks on siblings and other collections
+	for _, trial := range []struct {
+		ls   *webdavLockSystem
+		root string
+	}{
+		{ls1, "/"},
+		{ls1, "/dir2"},
+		{ls2, "/by_id/" + coll1 + "/dirfile"},
+		{ls2, "/by_id/" + coll2 + "/dir"},
+		{ls2, "/users"},
+	} {
+		token, err := trial.ls.Create(now, webdav.LockDetails{Root: trial.root, Duration: time.Minute, ZeroDepth: true})
+		c.Check(err, check.IsNil, check.Commentf("%+v", trial))
+		c.Check(trial.ls.Unlock(now, token), check.IsNil)
+	}
+
+	// Confirm succeeds only if a covering lock token is given
+	release, err := ls2.Confirm(now, "/by_id/"+coll1+"/dir/file", "", webdav.Condition{Token: "opaquelocktoken:bogus"}, webdav.Condition{Token: dirToken})
+	c.Check(err, check.IsNil)
+	release()
+	_, err = ls1.Confirm(now, "/dir/file", "/dir2/file", webdav.Condition{Token: dirToken})
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+	_, err = ls2.Confirm(now, "/by_id/"+coll2+"/dir/file", "", webdav.Condition{Token: dirToken})
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+	_, err = ls1.Confirm(now, "/dir", "", webdav.Condition{Token: dirToken, Not: true})
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+
+	// Refresh extends the lock; infinite/excessive timeouts are
+	// capped
+	details, err := ls1.Refresh(now.Add(50*time.Second), dirToken, -1)
+	c.Check(err, check.IsNil)
+	c.Check(details.Root, check.Equals, "/dir")
+	c.Check(details.ZeroDepth, check.Equals, false)
+	c.Check(details.Duration, check.Equals, time.Hour)
+	_, err = ls1.Create(now.Add(2*time.Minute), webdav.LockDetails{Root: "/dir/file", Duration: time.Minute})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+	_, err = ls1.Refresh(now, "opaquelocktoken:bogus", time.Minute)
+	c.Check(err, check.Equals, webdav.ErrNoSuchLock)
+
+	// Expired locks are ignored
+	later := now.Add(2 * time.Hour)
+	_, err = ls1.Confirm(later, "/dir", "", webdav.Condition{Token: dirToken})
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+	_, err = ls1.Refresh(later, dirToken, time.Minute)
+	c.Check(err, check.Equals, webdav.ErrNoSuchLock)
+	c.Check(ls1.Unlock(later, dirToken), check.Equals, webdav.ErrNoSuchLock)
+	token, err := ls1.Create(later, webdav.LockDetails{Root: "/dir/file", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+	c.Check(ls1.Unlock(later, token), check.IsNil)
+
+	// Unlock releases the lock
+	token, err = ls1.Create(now, webdav.LockDetails{Root: "/dir3", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	c.Check(ls1.Unlock(now, token), check.IsNil)
+	c.Check(ls1.Unlock(now, token), check.Equals, webdav.ErrNoSuchLock)
+	token, err = ls1.Create(now, webdav.LockDetails{Root: "/dir3", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+	c.Check(ls1.Unlock(now, token), check.IsNil)
+}
+
+func (s *UnitSuite) TestNewWebdavLockStore(c *check.C) {
+	cluster := &arvados.Cluster{}
+	store, err := newWebdavLockStore(cluster)
+	c.Check(err, check.IsNil)
+	c.Check(store, check.FitsTypeOf, &memLockStore{})
+	cluster.Collections.WebDAVLocks.Backend = "database"
+	store, err = newWebdavLockStore(cluster)
+	c.Check(err, check.IsNil)
+	c.Check(store, check.FitsTypeOf, &dbLockStore{})
+	cluster.Collections.WebDAVLocks.Backend = "redis"
+	_, err = newWebdavLockStore(cluster)
+	c.Check(err, check.ErrorMatches, `unsupported .*"redis".*`)
+}
+
+func (s *UnitSuite) TestWebdavLockNamespace(c *check.C) {
+	c.Check(webdavLockNamespace(&arvados.Collection{
+		UUID:             arvadostest.FooCollection,
+		PortableDataHash: arvadostest.FooCollectionPDH,
+	}), check.Equals, arvadostest.FooCollection)
+	c.Check(webdavLockNamespace(&arvados.Collection{
+		PortableDataHash: arvadostest.FooCollectionPDH,
+	}), check.Equals, arvadostest.FooCollectionPDH)
+}
+
+// Locks acquired by one user through one URL prevent another user
+// from modifying the file through a different URL.
+func (s *IntegrationSuite) TestWebdavLockPreventsWrites(c *check.C) {
+	arv := arvados.NewClientFromEnv()
+	arv.AuthToken = arvadostest.ActiveToken
+	var coll arvados.Collection
+	err := arv.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	defer arv.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	lockURL := "http://" + s.testServer.Addr + "/c=" + coll.UUID + "/foo"
+	writeURL := "http://" + s.testServer.Addr + "/collections/" + coll.UUID + "/foo"
+	do := func(method, url, token string, hdr http.Header, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do("LOCK", lockURL, arvadostest.ActiveToken, http.Header{"Timeout": {"Second-60"}},
+		`<?xml version="1.0" encoding="utf-8"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	lockToken := resp.Header.Get("Lock-Token")
+	c.Check(lockToken, check.Matches, `<opaquelocktoken:.*>`)
+
+	resp = do("PUT", writeURL, arvadostest.AdminToken, nil, "admin")
+	c.Check(resp.StatusCode, check.Equals, http.StatusLocked)
+	resp = do("DELETE", writeURL, arvadostest.AdminToken, nil, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusLocked)
+
+	resp = do("PUT", writeURL, arvadostest.ActiveToken, http.Header{"If": {"(" + lockToken + ")"}}, "active")
+	c.Check(resp.StatusCode, check.Equals, http.StatusCreated)
+
+	resp = do("UNLOCK", lockURL, arvadostest.ActiveToken, http.Header{"Lock-Token": {lockToken}}, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+
+	resp = do("PUT", writeURL, arvadostest.AdminToken, nil, "admin")
+	c.Check(resp.StatusCode, check.Equals, http.StatusCreated)
+}
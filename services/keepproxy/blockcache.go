@@ -0,0 +1,367 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var blockHashRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// blockCache is a bounded cache of block data, keyed by block hash,
+// with an optional in-memory tier and an optional on-disk tier.
+//
+// Both tiers are LRU. A block found on disk is also copied into
+// memory. Callers are responsible for checking permission before
+// returning cached data to a client.
+type blockCache struct {
+	maxMemory int64
+	dir       string
+	maxDisk   int64
+	logger    logrus.FieldLogger
+
+	mtx      sync.Mutex
+	mem      lruIndex
+	memData  map[string][]byte
+	disk     lruIndex
+	tmpCount int
+
+	hits     prometheus.Counter
+	misses   prometheus.Counter
+	hitBytes prometheus.Counter
+}
+
+// newBlockCache returns a blockCache using the given configuration,
+// or nil if caching is disabled. If reg is not nil, cache metrics
+// are registered there.
+//
+// If a cache directory is configured, blocks already stored there
+// are indexed, and the directory is created if needed.
+func newBlockCache(cfg arvados.KeepproxyBlockCacheConfig, logger logrus.FieldLogger, reg *prometheus.Registry) (*blockCache, error) {
+	if cfg.MaxMemory <= 0 && (cfg.Directory == "" || cfg.MaxDisk <= 0) {
+		return nil, nil
+	}
+	bc := &blockCache{
+		maxMemory: int64(cfg.MaxMemory),
+		logger:    logger,
+		memData:   map[string][]byte{},
+	}
+	if cfg.Directory != "" && cfg.MaxDisk > 0 {
+		bc.dir = cfg.Directory
+		bc.maxDisk = int64(cfg.MaxDisk)
+		err := bc.loadDisk()
+		if err != nil {
+			return nil, err
+		}
+	}
+	bc.setupMetrics(reg)
+	return bc, nil
+}
+
+func (bc *blockCache) setupMetrics(reg *prometheus.Registry) {
+	bc.hits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_blockcache",
+		Name:      "hits",
+		Help:      "Number of block requests served from cache.",
+	})
+	bc.misses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_blockcache",
+		Name:      "misses",
+		Help:      "Number of block requests not found in cache.",
+	})
+	bc.hitBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_blockcache",
+		Name:      "hit_bytes",
+		Help:      "Total size of blocks served from cache.",
+	})
+	memBytes := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_blockcache",
+		Name:      "memory_bytes",
+		Help:      "Total size of blocks cached in memory.",
+	}, func() float64 { return float64(bc.stats().memBytes) })
+	memBlocks := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_blockcache",
+		Name:      "memory_blocks",
+		Help:      "Number of blocks cached in memory.",
+	}, func() float64 { return float64(bc.stats().memBlocks) })
+	diskBytes := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_blockcache",
+		Name:      "disk_bytes",
+		Help:      "Total size of blocks cached on disk.",
+	}, func() float64 { return float64(bc.stats().diskBytes) })
+	diskBlocks := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_blockcache",
+		Name:      "disk_blocks",
+		Help:      "Number of blocks cached on disk.",
+	}, func() float64 { return float64(bc.stats().diskBlocks) })
+	if reg != nil {
+		reg.MustRegister(bc.hits, bc.misses, bc.hitBytes, memBytes, memBlocks, diskBytes, diskBlocks)
+	}
+}
+
+type blockCacheStats struct {
+	memBytes   int64
+	memBlocks  int
+	diskBytes  int64
+	diskBlocks int
+}
+
+func (bc *blockCache) stats() blockCacheStats {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	return blockCacheStats{
+		memBytes:   bc.mem.size,
+		memBlocks:  bc.mem.len(),
+		diskBytes:  bc.disk.size,
+		diskBlocks: bc.disk.len(),
+	}
+}
+
+// Get returns the cached data for the block with the given hash, and
+// updates the hit/miss metrics. If the block is not cached, it
+// returns nil, false.
+func (bc *blockCache) Get(hash string) ([]byte, bool) {
+	data, ok := bc.get(hash)
+	if ok {
+		bc.hits.Inc()
+		bc.hitBytes.Add(float64(len(data)))
+	} else {
+		bc.misses.Inc()
+	}
+	return data, ok
+}
+
+func (bc *blockCache) get(hash string) ([]byte, bool) {
+	bc.mtx.Lock()
+	if data, ok := bc.memData[hash]; ok {
+		bc.mem.touch(hash)
+		bc.mtx.Unlock()
+		return data, true
+	}
+	onDisk := bc.disk.touch(hash)
+	bc.mtx.Unlock()
+	if !onDisk {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(bc.diskPath(hash))
+	if err == nil && fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		err = fmt.Errorf("checksum mismatch")
+	}
+	if err != nil {
+		bc.logger.WithError(err).WithField("hash", hash).Warn("error reading cached block from disk; removing from cache")
+		bc.mtx.Lock()
+		bc.disk.remove(hash)
+		bc.mtx.Unlock()
+		os.Remove(bc.diskPath(hash))
+		return nil, false
+	}
+	bc.mtx.Lock()
+	bc.putMemLocked(hash, data)
+	bc.mtx.Unlock()
+	return data, true
+}
+
+// Put adds a block to the cache. The caller must ensure data matches
+// the given hash.
+func (bc *blockCache) Put(hash string, data []byte) {
+	if !blockHashRe.MatchString(hash) {
+		return
+	}
+	bc.mtx.Lock()
+	bc.putMemLocked(hash, data)
+	writeDisk := bc.dir != "" && int64(len(data)) <= bc.maxDisk && !bc.disk.has(hash)
+	bc.mtx.Unlock()
+	if writeDisk {
+		err := bc.putDisk(hash, data)
+		if err != nil {
+			bc.logger.WithError(err).WithField("hash", hash).Warn("error writing block to disk cache")
+		}
+	}
+}
+
+func (bc *blockCache) putMemLocked(hash string, data []byte) {
+	if bc.maxMemory <= 0 || int64(len(data)) > bc.maxMemory || bc.mem.has(hash) {
+		return
+	}
+	for bc.mem.size+int64(len(data)) > bc.maxMemory {
+		evicted := bc.mem.removeOldest()
+		delete(bc.memData, evicted)
+	}
+	bc.mem.add(hash, int64(len(data)))
+	bc.memData[hash] = data
+}
+
+func (bc *blockCache) putDisk(hash string, data []byte) error {
+	fnm := bc.diskPath(hash)
+	err := os.MkdirAll(filepath.Dir(fnm), 0700)
+	if err != nil {
+		return err
+	}
+	bc.mtx.Lock()
+	bc.tmpCount++
+	tmp := fmt.Sprintf("%s.tmp%d", fnm, bc.tmpCount)
+	bc.mtx.Unlock()
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, fnm)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	if bc.disk.has(hash) {
+		// Another goroutine wrote the same block
+		// concurrently.
+		return nil
+	}
+	var evict []string
+	for bc.disk.size+int64(len(data)) > bc.maxDisk {
+		evict = append(evict, bc.disk.removeOldest())
+	}
+	bc.disk.add(hash, int64(len(data)))
+	for _, evicted := range evict {
+		os.Remove(bc.diskPath(evicted))
+	}
+	return nil
+}
+
+func (bc *blockCache) diskPath(hash string) string {
+	return filepath.Join(bc.dir, hash[:3], hash)
+}
+
+// loadDisk indexes the blocks already present in the cache
+// directory, oldest first, and removes leftover temp files and any
+// blocks that exceed the configured size limit.
+func (bc *blockCache) loadDisk() error {
+	err := os.MkdirAll(bc.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("error creating block cache directory: %w", err)
+	}
+	var found []os.FileInfo
+	err = filepath.Walk(bc.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if !blockHashRe.MatchString(fi.Name()) || filepath.Dir(path) != filepath.Join(bc.dir, fi.Name()[:3]) {
+			bc.logger.WithField("path", path).Info("removing unexpected file from block cache directory")
+			return os.Remove(path)
+		}
+		found = append(found, fi)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error scanning block cache directory: %w", err)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ModTime().Before(found[j].ModTime()) })
+	for _, fi := range found {
+		bc.disk.add(fi.Name(), fi.Size())
+	}
+	for bc.disk.size > bc.maxDisk {
+		os.Remove(bc.diskPath(bc.disk.removeOldest()))
+	}
+	bc.logger.WithField("blocks", bc.disk.len()).WithField("bytes", bc.disk.size).Info("loaded block cache index")
+	return nil
+}
+
+// lruIndex tracks the sizes and recency of cached blocks. It is not
+// safe for concurrent use.
+type lruIndex struct {
+	list  *list.List // front = most recently used
+	elems map[string]*list.Element
+	size  int64
+}
+
+type lruEntry struct {
+	hash string
+	size int64
+}
+
+func (idx *lruIndex) init() {
+	if idx.elems == nil {
+		idx.list = list.New()
+		idx.elems = map[string]*list.Element{}
+	}
+}
+
+func (idx *lruIndex) len() int {
+	return len(idx.elems)
+}
+
+func (idx *lruIndex) has(hash string) bool {
+	_, ok := idx.elems[hash]
+	return ok
+}
+
+// touch marks the given entry as most recently used, and returns
+// false if there is no such entry.
+func (idx *lruIndex) touch(hash string) bool {
+	e, ok := idx.elems[hash]
+	if ok {
+		idx.list.MoveToFront(e)
+	}
+	return ok
+}
+
+func (idx *lruIndex) add(hash string, size int64) {
+	idx.init()
+	idx.elems[hash] = idx.list.PushFront(&lruEntry{hash: hash, size: size})
+	idx.size += size
+}
+
+func (idx *lruIndex) remove(hash string) {
+	if e, ok := idx.elems[hash]; ok {
+		idx.list.Remove(e)
+		delete(idx.elems, hash)
+		idx.size -= e.Value.(*lruEntry).size
+	}
+}
+
+// removeOldest removes the least recently used entry and returns its
+// hash. It must not be called when the index is empty.
+func (idx *lruIndex) removeOldest() string {
+	ent := idx.list.Back().Value.(*lruEntry)
+	idx.remove(ent.hash)
+	return ent.hash
+}
+
+// cacheable returns true if the block with the given locator and size
+// should be added to the cache after it is retrieved. It is safe to
+// call on a nil *blockCache.
+func (bc *blockCache) cacheable(locator string, size int64) bool {
+	if bc == nil || size < 0 || !blockHashRe.MatchString(locator[:32]) {
+		return false
+	}
+	if strings.Contains(locator, "+R") && !strings.Contains(locator, "+A") {
+		return false
+	}
+	return size <= bc.maxMemory || (bc.dir != "" && size <= bc.maxDisk)
+}
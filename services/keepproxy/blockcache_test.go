@@ -0,0 +1,160 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&BlockCacheSuite{})
+
+type BlockCacheSuite struct{}
+
+func testBlock(size int, seed byte) (string, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i)
+	}
+	return fmt.Sprintf("%x", md5.Sum(data)), data
+}
+
+func (s *BlockCacheSuite) TestDisabled(c *C) {
+	bc, err := newBlockCache(arvados.KeepproxyBlockCacheConfig{}, ctxlog.TestLogger(c), nil)
+	c.Check(err, IsNil)
+	c.Check(bc, IsNil)
+	c.Check(bc.cacheable("d41d8cd98f00b204e9800998ecf8427e+0", 0), Equals, false)
+
+	bc, err = newBlockCache(arvados.KeepproxyBlockCacheConfig{Directory: c.MkDir()}, ctxlog.TestLogger(c), nil)
+	c.Check(err, IsNil)
+	c.Check(bc, IsNil)
+}
+
+func (s *BlockCacheSuite) TestMemory(c *C) {
+	reg := prometheus.NewRegistry()
+	bc, err := newBlockCache(arvados.KeepproxyBlockCacheConfig{MaxMemory: 3000}, ctxlog.TestLogger(c), reg)
+	c.Assert(err, IsNil)
+	c.Assert(bc, NotNil)
+
+	c.Check(bc.cacheable("d41d8cd98f00b204e9800998ecf8427e+1000", 1000), Equals, true)
+	c.Check(bc.cacheable("d41d8cd98f00b204e9800998ecf8427e+4000", 4000), Equals, false)
+	c.Check(bc.cacheable("d41d8cd98f00b204e9800998ecf8427e+1000+Rzzzzz-1234", 1000), Equals, false)
+
+	var hashes []string
+	for i := 0; i < 4; i++ {
+		hash, data := testBlock(1000, byte(i))
+		hashes = append(hashes, hash)
+		bc.Put(hash, data)
+		if i == 1 {
+			// Use the first block, so the second one
+			// gets evicted instead.
+			_, ok := bc.Get(hashes[0])
+			c.Check(ok, Equals, true)
+		}
+	}
+	for i, expect := range []bool{true, false, true, true} {
+		data, ok := bc.Get(hashes[i])
+		c.Check(ok, Equals, expect, Commentf("block %d", i))
+		if ok {
+			c.Check(fmt.Sprintf("%x", md5.Sum(data)), Equals, hashes[i])
+		}
+	}
+	c.Check(bc.stats(), DeepEquals, blockCacheStats{memBytes: 3000, memBlocks: 3})
+
+	// Too big
+	hash, data := testBlock(4000, 0)
+	bc.Put(hash, data)
+	_, ok := bc.Get(hash)
+	c.Check(ok, Equals, false)
+
+	c.Check(testutil.ToFloat64(bc.hits), Equals, float64(4))
+	c.Check(testutil.ToFloat64(bc.misses), Equals, float64(2))
+	c.Check(testutil.ToFloat64(bc.hitBytes), Equals, float64(4000))
+	n, err := testutil.GatherAndCount(reg)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 7)
+}
+
+func (s *BlockCacheSuite) TestDisk(c *C) {
+	dir := c.MkDir()
+	cfg := arvados.KeepproxyBlockCacheConfig{Directory: dir, MaxDisk: 2500}
+	bc, err := newBlockCache(cfg, ctxlog.TestLogger(c), nil)
+	c.Assert(err, IsNil)
+
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		hash, data := testBlock(1000, byte(i))
+		hashes = append(hashes, hash)
+		bc.Put(hash, data)
+	}
+	_, ok := bc.Get(hashes[0])
+	c.Check(ok, Equals, false)
+	for _, hash := range hashes[1:] {
+		data, ok := bc.Get(hash)
+		c.Check(ok, Equals, true)
+		c.Check(fmt.Sprintf("%x", md5.Sum(data)), Equals, hash)
+	}
+	_, err = os.Stat(filepath.Join(dir, hashes[0][:3], hashes[0]))
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(bc.stats(), DeepEquals, blockCacheStats{diskBytes: 2000, diskBlocks: 2})
+
+	// A new cache using the same directory finds the existing
+	// blocks, and cleans up junk.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, hashes[1][:3], hashes[1]+".tmp1"), []byte("junk"), 0600), IsNil)
+	bc, err = newBlockCache(cfg, ctxlog.TestLogger(c), nil)
+	c.Assert(err, IsNil)
+	c.Check(bc.stats(), DeepEquals, blockCacheStats{diskBytes: 2000, diskBlocks: 2})
+	_, err = os.Stat(filepath.Join(dir, hashes[1][:3], hashes[1]+".tmp1"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// Corrupt blocks are detected and removed.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, hashes[1][:3], hashes[1]), []byte("corrupt"), 0600), IsNil)
+	_, ok = bc.Get(hashes[1])
+	c.Check(ok, Equals, false)
+	_, ok = bc.Get(hashes[2])
+	c.Check(ok, Equals, true)
+	c.Check(bc.stats(), DeepEquals, blockCacheStats{diskBytes: 1000, diskBlocks: 1})
+
+	// Starting with a smaller size limit evicts the oldest
+	// blocks.
+	bc.Put(hashes[0], mustTestBlock(1000, 0))
+	cfg.MaxDisk = 1500
+	bc, err = newBlockCache(cfg, ctxlog.TestLogger(c), nil)
+	c.Assert(err, IsNil)
+	c.Check(bc.stats(), DeepEquals, blockCacheStats{diskBytes: 1000, diskBlocks: 1})
+}
+
+func (s *BlockCacheSuite) TestMemoryAndDisk(c *C) {
+	bc, err := newBlockCache(arvados.KeepproxyBlockCacheConfig{MaxMemory: 1000, Directory: c.MkDir(), MaxDisk: 3000}, ctxlog.TestLogger(c), nil)
+	c.Assert(err, IsNil)
+	hash0, data0 := testBlock(1000, 0)
+	hash1, data1 := testBlock(1000, 1)
+	bc.Put(hash0, data0)
+	bc.Put(hash1, data1)
+	c.Check(bc.stats(), DeepEquals, blockCacheStats{memBytes: 1000, memBlocks: 1, diskBytes: 2000, diskBlocks: 2})
+	c.Check(bc.cacheable(hash0+"+2000", 2000), Equals, true)
+
+	// Reading hash0 from disk brings it back into memory.
+	_, ok := bc.Get(hash0)
+	c.Check(ok, Equals, true)
+	bc.mtx.Lock()
+	_, inMem := bc.memData[hash0]
+	bc.mtx.Unlock()
+	c.Check(inMem, Equals, true)
+}
+
+func mustTestBlock(size int, seed byte) []byte {
+	_, data := testBlock(size, seed)
+	return data
+}
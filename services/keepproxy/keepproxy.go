@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
@@ -24,6 +25,7 @@ import (
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
@@ -32,6 +34,8 @@ import (
 	"github.com/ghodss/yaml"
 	"github.com/gorilla/mux"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -322,10 +326,11 @@ type proxyHandler struct {
 	http.Handler
 	*keepclient.KeepClient
 	*APITokenCache
-	timeout   time.Duration
-	transport *http.Transport
-	logger    logrus.FieldLogger
-	cluster   *arvados.Cluster
+	timeout    time.Duration
+	transport  *http.Transport
+	logger     logrus.FieldLogger
+	cluster    *arvados.Cluster
+	blockCache *blockCache
 }
 
 // MakeRESTRouter returns an http.Handler that passes GET and PUT
@@ -347,6 +352,15 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, cluster *a
 		return nil, fmt.Errorf("Error from lru.New2Q: %v", err)
 	}
 
+	reg := prometheus.NewRegistry()
+	bc, err := newBlockCache(cluster.Collections.KeepproxyBlockCache, logger, reg)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up block cache: %v", err)
+	}
+	if bc != nil && cluster.Collections.BlobSigning && cluster.Collections.BlobSigningKey == "" {
+		logger.Warn("Collections.KeepproxyBlockCache is enabled, but Collections.BlobSigningKey is not configured, so cached blocks will never be used")
+	}
+
 	h := &proxyHandler{
 		Handler:    rest,
 		KeepClient: kc,
@@ -356,8 +370,9 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, cluster *a
 			tokens:     cacheQ,
 			expireTime: 300,
 		},
-		logger:  logger,
-		cluster: cluster,
+		logger:     logger,
+		cluster:    cluster,
+		blockCache: bc,
 	}
 
 	rest.HandleFunc(`/{locator:[0-9a-f]{32}\+.*}`, h.Get).Methods("GET", "HEAD")
@@ -380,6 +395,12 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, cluster *a
 		Prefix: "/_health/",
 	}).Methods("GET")
 
+	if cluster.ManagementToken != "" {
+		rest.Handle("/metrics", auth.RequireLiteralToken(cluster.ManagementToken, promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+			ErrorLog: logger,
+		}))).Methods("GET")
+	}
+
 	rest.NotFoundHandler = InvalidPathHandler{}
 	return h, nil
 }
@@ -471,6 +492,23 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if data, ok := h.getCachedBlock(locator, tok); ok {
+		status = http.StatusOK
+		expectLength = int64(len(data))
+		proxiedURI = "cache"
+		resp.Header().Set("Content-Length", fmt.Sprint(expectLength))
+		if req.Method == "GET" {
+			var n int
+			n, err = resp.Write(data)
+			responseLength = int64(n)
+		}
+		return
+	}
+
+	// cacheBuf receives a copy of the block data as it is sent to
+	// the client, if the block should be added to the cache.
+	var cacheBuf *bytes.Buffer
+
 	switch req.Method {
 	case "HEAD":
 		expectLength, proxiedURI, err = kc.Ask(locator)
@@ -479,6 +517,10 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 		if reader != nil {
 			defer reader.Close()
 		}
+		if err == nil && h.blockCache.cacheable(locator, expectLength) {
+			cacheBuf = bytes.NewBuffer(make([]byte, 0, expectLength))
+			reader = ioutil.NopCloser(io.TeeReader(reader, cacheBuf))
+		}
 	default:
 		status, err = http.StatusNotImplemented, errMethodNotSupported
 		return
@@ -500,6 +542,12 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 			if err == nil && expectLength > -1 && responseLength != expectLength {
 				err = errContentLengthMismatch
 			}
+			if err == nil && cacheBuf != nil {
+				// The block data has been received
+				// in full, and its checksum has been
+				// verified by keepclient.
+				h.blockCache.Put(locator[:32], cacheBuf.Bytes())
+			}
 		}
 	case keepclient.Error:
 		if respErr == keepclient.BlockNotFound {
@@ -514,6 +562,35 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// getCachedBlock returns the data for the requested block from the
+// block cache, if caching is enabled, the block is cached, and the
+// given token is permitted to read the block.
+//
+// When blob signing is enabled, the signature is checked here just
+// like keepstore would check it. If the signature is missing or
+// invalid, the request is not served from the cache, so the client
+// gets the same error from keepstore that it would get without a
+// cache.
+func (h *proxyHandler) getCachedBlock(locator, tok string) ([]byte, bool) {
+	if h.blockCache == nil || !blockHashRe.MatchString(locator[:32]) {
+		return nil, false
+	}
+	if strings.Contains(locator, "+R") && !strings.Contains(locator, "+A") {
+		// Blocks on remote clusters are not cached.
+		return nil, false
+	}
+	if h.cluster.Collections.BlobSigning {
+		if h.cluster.Collections.BlobSigningKey == "" {
+			return nil, false
+		}
+		err := keepclient.VerifySignature(locator, tok, h.cluster.Collections.BlobSigningTTL.Duration(), []byte(h.cluster.Collections.BlobSigningKey))
+		if err != nil {
+			return nil, false
+		}
+	}
+	return h.blockCache.Get(locator[:32])
+}
+
 var errLengthRequired = errors.New(http.StatusText(http.StatusLengthRequired))
 var errLengthMismatch = errors.New("Locator size hint does not match Content-Length header")
 
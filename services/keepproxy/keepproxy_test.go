@@ -23,6 +23,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 
 	"gopkg.in/check.v1"
@@ -420,6 +421,65 @@ func (s *ServerRequiredSuite) TestPutAskGet(c *C) {
 	}
 }
 
+func (s *ServerRequiredSuite) TestBlockCache(c *C) {
+	kc, _ := runProxy(c, false, false, nil)
+	defer closeListener()
+
+	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, IsNil)
+	cluster, err := cfg.GetCluster("")
+	c.Assert(err, IsNil)
+	c.Assert(cluster.Collections.BlobSigning, Equals, true)
+	cluster.ManagementToken = arvadostest.ManagementToken
+	cluster.Collections.KeepproxyBlockCache.MaxMemory = 1 << 20
+	rtr, err := MakeRESTRouter(router.(*proxyHandler).KeepClient, 10*time.Second, cluster, ctxlog.TestLogger(c))
+	c.Assert(err, IsNil)
+
+	content := []byte("TestBlockCache")
+	locator, _, err := kc.PutB(content)
+	c.Assert(err, IsNil)
+	unsigned := strings.SplitN(locator, "+A", 2)[0]
+
+	get := func(method, locator, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://"+listener.Addr().String()+"/"+locator, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		rtr.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// First request is a cache miss, second is a hit
+	for i := 0; i < 2; i++ {
+		resp := get("GET", locator, kc.Arvados.ApiToken)
+		c.Check(resp.Code, Equals, http.StatusOK)
+		c.Check(resp.Body.Bytes(), DeepEquals, content)
+	}
+	resp := get("HEAD", locator, kc.Arvados.ApiToken)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Length"), Equals, fmt.Sprint(len(content)))
+
+	// Signatures are still checked when the block is cached
+	resp = get("GET", unsigned, kc.Arvados.ApiToken)
+	c.Check(resp.Code, Not(Equals), http.StatusOK)
+	resp = get("GET", locator, arvadostest.SpectatorToken)
+	c.Check(resp.Code, Not(Equals), http.StatusOK)
+
+	bc := router.(*proxyHandler).blockCache
+	c.Check(bc, IsNil)
+	bc = rtr.(*proxyHandler).blockCache
+	c.Check(testutil.ToFloat64(bc.hits), Equals, float64(2))
+	c.Check(testutil.ToFloat64(bc.misses), Equals, float64(1))
+
+	req, err := http.NewRequest("GET", "http://"+listener.Addr().String()+"/metrics", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "Bearer "+arvadostest.ManagementToken)
+	resp = httptest.NewRecorder()
+	rtr.ServeHTTP(resp, req)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Matches, `(?ms).*\narvados_keepproxy_blockcache_hits 2\n.*`)
+}
+
 func (s *ServerRequiredSuite) TestPutAskGetForbidden(c *C) {
 	kc, _ := runProxy(c, true, false, nil)
 	defer closeListener()
@@ -5,7 +5,6 @@
 package keepstore
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -146,24 +145,24 @@ func (v *AzureBlobVolume) checkTrashed(loc string) (bool, map[string]string, err
 	return false, metadata, nil
 }
 
-// Get reads a Keep block that has been stored as a block blob in the
-// container.
+// ReadBlock reads a Keep block that has been stored as a block blob
+// in the container, and writes it to w.
 //
 // If the block is younger than azureWriteRaceInterval and is
 // unexpectedly empty, assume a PutBlob operation is in progress, and
 // wait for it to finish writing.
-func (v *AzureBlobVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+func (v *AzureBlobVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
 	trashed, _, err := v.checkTrashed(loc)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	if trashed {
-		return 0, os.ErrNotExist
+		return os.ErrNotExist
 	}
 	var deadline time.Time
 	haveDeadline := false
-	size, err := v.get(ctx, loc, buf)
-	for err == nil && size == 0 && loc != "d41d8cd98f00b204e9800998ecf8427e" {
+	size, err := v.get(ctx, loc, w)
+	for err == nil && size == 0 && loc != emptyBlockHash {
 		// Seeing a brand new empty block probably means we're
 		// in a race with CreateBlob, which under the hood
 		// (apparently) does "CreateEmpty" and "CommitData"
@@ -185,18 +184,22 @@ func (v *AzureBlobVolume) Get(ctx context.Context, loc string, buf []byte) (int,
 		}
 		select {
 		case <-ctx.Done():
-			return 0, ctx.Err()
+			return ctx.Err()
 		case <-time.After(v.WriteRacePollTime.Duration()):
 		}
-		size, err = v.get(ctx, loc, buf)
+		size, err = v.get(ctx, loc, w)
 	}
 	if haveDeadline {
 		ctxlog.FromContext(ctx).Printf("Race ended with size==%d", size)
 	}
-	return size, err
+	return err
 }
 
-func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int, error) {
+// get copies the blob data to w, and returns the number of bytes
+// copied. If MaxGetBytes is smaller than BlockSize, the data is
+// retrieved in pieces, one after another, so it can be written to w
+// in order without buffering.
+func (v *AzureBlobVolume) get(ctx context.Context, loc string, w io.Writer) (int, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -206,7 +209,7 @@ func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int,
 	}
 
 	pieces := 1
-	expectSize := len(buf)
+	expectSize := -1
 	if pieceSize < BlockSize {
 		// Unfortunately the handler doesn't tell us how long the blob
 		// is expected to be, so we have to ask Azure.
@@ -214,8 +217,8 @@ func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int,
 		if err != nil {
 			return 0, v.translateError(err)
 		}
-		if props.ContentLength > int64(BlockSize) || props.ContentLength < 0 {
-			return 0, fmt.Errorf("block %s invalid size %d (max %d)", loc, props.ContentLength, BlockSize)
+		if props.ContentLength > int64(maxStoredBlockSize) || props.ContentLength < 0 {
+			return 0, fmt.Errorf("block %s invalid size %d (max %d)", loc, props.ContentLength, maxStoredBlockSize)
 		}
 		expectSize = int(props.ContentLength)
 		pieces = (expectSize + pieceSize - 1) / pieceSize
@@ -225,143 +228,77 @@ func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int,
 		return 0, nil
 	}
 
-	// We'll update this actualSize if/when we get the last piece.
-	actualSize := -1
-	errors := make(chan error, pieces)
-	var wg sync.WaitGroup
-	wg.Add(pieces)
+	size := 0
 	for p := 0; p < pieces; p++ {
-		// Each goroutine retrieves one piece. If we hit an
-		// error, it is sent to the errors chan so get() can
-		// return it -- but only if the error happens before
-		// ctx is done. This way, if ctx is done before we hit
-		// any other error (e.g., requesting client has hung
-		// up), we return the original ctx.Err() instead of
-		// the secondary errors from the transfers that got
-		// interrupted as a result.
-		go func(p int) {
-			defer wg.Done()
-			startPos := p * pieceSize
-			endPos := startPos + pieceSize
-			if endPos > expectSize {
-				endPos = expectSize
+		startPos := p * pieceSize
+		endPos := startPos + pieceSize
+		if expectSize >= 0 && endPos > expectSize {
+			endPos = expectSize
+		}
+		var rdr io.ReadCloser
+		var err error
+		gotRdr := make(chan struct{})
+		go func() {
+			defer close(gotRdr)
+			if pieces == 1 {
+				rdr, err = v.container.GetBlob(loc)
+			} else {
+				rdr, err = v.container.GetBlobRange(loc, startPos, endPos-1, nil)
 			}
-			var rdr io.ReadCloser
-			var err error
-			gotRdr := make(chan struct{})
+		}()
+		select {
+		case <-ctx.Done():
 			go func() {
-				defer close(gotRdr)
-				if startPos == 0 && endPos == expectSize {
-					rdr, err = v.container.GetBlob(loc)
-				} else {
-					rdr, err = v.container.GetBlobRange(loc, startPos, endPos-1, nil)
+				<-gotRdr
+				if err == nil {
+					rdr.Close()
 				}
 			}()
-			select {
-			case <-ctx.Done():
-				go func() {
-					<-gotRdr
-					if err == nil {
-						rdr.Close()
-					}
-				}()
-				return
-			case <-gotRdr:
-			}
-			if err != nil {
-				errors <- err
-				cancel()
-				return
-			}
-			go func() {
-				// Close the reader when the client
-				// hangs up or another piece fails
-				// (possibly interrupting ReadFull())
-				// or when all pieces succeed and
-				// get() returns.
-				<-ctx.Done()
-				rdr.Close()
-			}()
-			n, err := io.ReadFull(rdr, buf[startPos:endPos])
-			if pieces == 1 && (err == io.ErrUnexpectedEOF || err == io.EOF) {
-				// If we don't know the actual size,
-				// and just tried reading 64 MiB, it's
-				// normal to encounter EOF.
-			} else if err != nil {
-				if ctx.Err() == nil {
-					errors <- err
-				}
-				cancel()
-				return
-			}
-			if p == pieces-1 {
-				actualSize = startPos + n
-			}
-		}(p)
-	}
-	wg.Wait()
-	close(errors)
-	if len(errors) > 0 {
-		return 0, v.translateError(<-errors)
-	}
-	if ctx.Err() != nil {
-		return 0, ctx.Err()
-	}
-	return actualSize, nil
-}
-
-// Compare the given data with existing stored data.
-func (v *AzureBlobVolume) Compare(ctx context.Context, loc string, expect []byte) error {
-	trashed, _, err := v.checkTrashed(loc)
-	if err != nil {
-		return err
-	}
-	if trashed {
-		return os.ErrNotExist
-	}
-	var rdr io.ReadCloser
-	gotRdr := make(chan struct{})
-	go func() {
-		defer close(gotRdr)
-		rdr, err = v.container.GetBlob(loc)
-	}()
-	select {
-	case <-ctx.Done():
-		go func() {
-			<-gotRdr
-			if err == nil {
-				rdr.Close()
+			return size, ctx.Err()
+		case <-gotRdr:
+		}
+		if err != nil {
+			return size, v.translateError(err)
+		}
+		// Close the reader when the client hangs up
+		// (possibly interrupting io.Copy()) or when get()
+		// returns.
+		go func(rdr io.ReadCloser) {
+			<-ctx.Done()
+			rdr.Close()
+		}(rdr)
+		n, err := io.Copy(w, rdr)
+		size += int(n)
+		if err != nil {
+			if ctx.Err() != nil {
+				return size, ctx.Err()
 			}
-		}()
-		return ctx.Err()
-	case <-gotRdr:
-	}
-	if err != nil {
-		return v.translateError(err)
+			return size, v.translateError(err)
+		}
+		if pieces > 1 && int(n) != endPos-startPos {
+			return size, io.ErrUnexpectedEOF
+		}
 	}
-	defer rdr.Close()
-	return compareReaderWithBuf(ctx, rdr, expect, loc[:32])
+	return size, nil
 }
 
-// Put stores a Keep block as a block blob in the container.
-func (v *AzureBlobVolume) Put(ctx context.Context, loc string, block []byte) error {
+// WriteBlock stores a Keep block as a block blob in the container.
+func (v *AzureBlobVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
 	// Send the block data through a pipe, so that (if we need to)
 	// we can close the pipe early and abandon our
-	// CreateBlockBlobFromReader() goroutine, without worrying
-	// about CreateBlockBlobFromReader() accessing our block
-	// buffer after we release it.
+	// CreateBlockBlobFromReader() goroutine.
 	bufr, bufw := io.Pipe()
 	go func() {
-		io.Copy(bufw, bytes.NewReader(block))
-		bufw.Close()
+		_, err := io.Copy(bufw, rdr)
+		bufw.CloseWithError(err)
 	}()
 	errChan := make(chan error)
 	go func() {
 		var body io.Reader = bufr
-		if len(block) == 0 {
+		if size == 0 {
 			// We must send a "Content-Length: 0" header,
 			// but the http client interprets
 			// ContentLength==0 as "unknown" unless it can
@@ -370,7 +307,7 @@ func (v *AzureBlobVolume) Put(ctx context.Context, loc string, block []byte) err
 			body = http.NoBody
 			bufr.Close()
 		}
-		errChan <- v.container.CreateBlockBlobFromReader(loc, len(block), body, nil)
+		errChan <- v.container.CreateBlockBlobFromReader(loc, size, body, nil)
 	}()
 	select {
 	case <-ctx.Done():
@@ -566,7 +503,7 @@ func (v *AzureBlobVolume) translateError(err error) error {
 	}
 }
 
-var keepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var keepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}(\.\d+\.\d+)?$`)
 
 func (v *AzureBlobVolume) isKeepBlock(s string) bool {
 	return keepBlockRegexp.MatchString(s)
@@ -478,12 +478,12 @@ func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeRangeFenceposts(c *check.C) {
 			data[i] = byte((i + 7) & 0xff)
 		}
 		hash := fmt.Sprintf("%x", md5.Sum(data))
-		err := v.Put(context.Background(), hash, data)
+		err := putWithPipe(context.Background(), hash, data, v)
 		if err != nil {
 			c.Error(err)
 		}
 		gotData := make([]byte, len(data))
-		gotLen, err := v.Get(context.Background(), hash, gotData)
+		gotLen, err := getWithPipe(context.Background(), hash, gotData, v)
 		if err != nil {
 			c.Error(err)
 		}
@@ -508,7 +508,7 @@ func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeCreateBlobRace(c *check.C) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := v.Put(context.Background(), TestHash, TestBlock)
+		err := putWithPipe(context.Background(), TestHash, TestBlock, v)
 		if err != nil {
 			c.Error(err)
 		}
@@ -520,7 +520,7 @@ func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeCreateBlobRace(c *check.C) {
 	go func() {
 		defer wg.Done()
 		buf := make([]byte, len(TestBlock))
-		_, err := v.Get(context.Background(), TestHash, buf)
+		_, err := getWithPipe(context.Background(), TestHash, buf, v)
 		if err != nil {
 			c.Error(err)
 		}
@@ -554,7 +554,7 @@ func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeCreateBlobRaceDeadline(c *che
 	go func() {
 		defer close(allDone)
 		buf := make([]byte, BlockSize)
-		n, err := v.Get(context.Background(), TestHash, buf)
+		n, err := getWithPipe(context.Background(), TestHash, buf, v)
 		if err != nil {
 			c.Error(err)
 			return
@@ -579,21 +579,14 @@ func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeCreateBlobRaceDeadline(c *che
 func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeContextCancelGet(c *check.C) {
 	s.testAzureBlobVolumeContextCancel(c, func(ctx context.Context, v *TestableAzureBlobVolume) error {
 		v.PutRaw(TestHash, TestBlock)
-		_, err := v.Get(ctx, TestHash, make([]byte, BlockSize))
+		_, err := getWithPipe(ctx, TestHash, make([]byte, BlockSize), v)
 		return err
 	})
 }
 
 func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeContextCancelPut(c *check.C) {
 	s.testAzureBlobVolumeContextCancel(c, func(ctx context.Context, v *TestableAzureBlobVolume) error {
-		return v.Put(ctx, TestHash, make([]byte, BlockSize))
-	})
-}
-
-func (s *StubbedAzureBlobSuite) TestAzureBlobVolumeContextCancelCompare(c *check.C) {
-	s.testAzureBlobVolumeContextCancel(c, func(ctx context.Context, v *TestableAzureBlobVolume) error {
-		v.PutRaw(TestHash, TestBlock)
-		return v.Compare(ctx, TestHash, TestBlock2)
+		return putWithPipe(ctx, TestHash, make([]byte, BlockSize), v)
 	})
 }
 
@@ -647,21 +640,21 @@ func (s *StubbedAzureBlobSuite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"Errors":0,.*`)
 
 	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
-	_, err := volume.Get(context.Background(), loc, make([]byte, 3))
+	_, err := getWithPipe(context.Background(), loc, make([]byte, 3), volume)
 	c.Check(err, check.NotNil)
 	c.Check(stats(), check.Matches, `.*"Ops":[^0],.*`)
 	c.Check(stats(), check.Matches, `.*"Errors":[^0],.*`)
 	c.Check(stats(), check.Matches, `.*"storage\.AzureStorageServiceError 404 \(404 Not Found\)":[^0].*`)
 	c.Check(stats(), check.Matches, `.*"InBytes":0,.*`)
 
-	err = volume.Put(context.Background(), loc, []byte("foo"))
+	err = putWithPipe(context.Background(), loc, []byte("foo"), volume)
 	c.Check(err, check.IsNil)
 	c.Check(stats(), check.Matches, `.*"OutBytes":3,.*`)
 	c.Check(stats(), check.Matches, `.*"CreateOps":1,.*`)
 
-	_, err = volume.Get(context.Background(), loc, make([]byte, 3))
+	_, err = getWithPipe(context.Background(), loc, make([]byte, 3), volume)
 	c.Check(err, check.IsNil)
-	_, err = volume.Get(context.Background(), loc, make([]byte, 3))
+	_, err = getWithPipe(context.Background(), loc, make([]byte, 3), volume)
 	c.Check(err, check.IsNil)
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 }
@@ -0,0 +1,90 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"sync"
+	"time"
+)
+
+// maxChangeJournalEntries is the maximum number of blocks a
+// changeJournal tracks. If more blocks than this change between
+// keep-balance runs, the journal is reset, and keep-balance falls
+// back to retrieving the full index.
+var maxChangeJournalEntries = 1 << 20
+
+// changeJournal records which blocks have been written, touched,
+// trashed, or untrashed on a mount, so keep-balance can retrieve
+// index entries for just the blocks that have changed since its
+// previous run.
+type changeJournal struct {
+	// The journal includes all changes since start.
+	start   time.Time
+	changes map[string]journalEntry
+	mtx     sync.Mutex
+}
+
+type journalEntry struct {
+	// Block size, or -1 if unknown
+	size int
+	// Time of most recent change
+	time time.Time
+}
+
+func newChangeJournal() *changeJournal {
+	return &changeJournal{
+		start:   time.Now(),
+		changes: map[string]journalEntry{},
+	}
+}
+
+// record notes that the given block has changed. If size is -1, the
+// size recorded by an earlier change (if any) is retained.
+func (cj *changeJournal) record(loc string, size int) {
+	cj.mtx.Lock()
+	defer cj.mtx.Unlock()
+	now := time.Now()
+	if size < 0 {
+		if ent, ok := cj.changes[loc]; ok {
+			size = ent.size
+		}
+	}
+	if _, ok := cj.changes[loc]; !ok && len(cj.changes) >= maxChangeJournalEntries {
+		// Rather than grow without bound, start over. The
+		// next request for changes since an earlier time
+		// will fail.
+		cj.changes = map[string]journalEntry{}
+		cj.start = now
+	}
+	cj.changes[loc] = journalEntry{size: size, time: now}
+}
+
+// since returns the blocks that have changed since t, with their
+// sizes (-1 if unknown). If the journal does not go back as far as
+// t, ok is false.
+//
+// Changes before t are discarded, on the assumption that the caller
+// (keep-balance) will not ask for changes before t again.
+func (cj *changeJournal) since(t time.Time) (changed map[string]int, ok bool) {
+	cj.mtx.Lock()
+	defer cj.mtx.Unlock()
+	if t.Before(cj.start) {
+		return nil, false
+	}
+	changed = map[string]int{}
+	for loc, ent := range cj.changes {
+		if ent.time.Before(t) {
+			delete(cj.changes, loc)
+		} else {
+			changed[loc] = ent.size
+		}
+	}
+	if now := time.Now(); t.After(now) {
+		cj.start = now
+	} else {
+		cj.start = t
+	}
+	return changed, true
+}
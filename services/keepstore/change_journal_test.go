@@ -0,0 +1,140 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ChangeJournalSuite{})
+
+type ChangeJournalSuite struct {
+	cluster *arvados.Cluster
+	handler *handler
+	mnt     *VolumeMount
+	mock    *MockVolume
+}
+
+func (s *ChangeJournalSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "mock"},
+	}
+	s.cluster.Collections.BlobTrash = true
+	s.cluster.Collections.BlobSigningTTL = arvados.Duration(0)
+	s.handler = &handler{}
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	s.mnt = s.handler.volmgr.AllWritable()[0]
+	s.mock = s.mnt.Volume.(*MockVolume)
+}
+
+func (s *ChangeJournalSuite) TestJournal(c *check.C) {
+	cj := newChangeJournal()
+	t0 := time.Now()
+	cj.record(TestHash, 3)
+	cj.record(TestHash2, -1)
+	changed, ok := cj.since(t0)
+	c.Check(ok, check.Equals, true)
+	c.Check(changed, check.DeepEquals, map[string]int{TestHash: 3, TestHash2: -1})
+
+	// Size is retained if a later change doesn't know it
+	cj.record(TestHash, -1)
+	changed, ok = cj.since(t0)
+	c.Check(ok, check.Equals, true)
+	c.Check(changed[TestHash], check.Equals, 3)
+
+	// Changes before the requested time are discarded
+	t1 := time.Now()
+	cj.record(TestHash3, 4)
+	changed, ok = cj.since(t1)
+	c.Check(ok, check.Equals, true)
+	c.Check(changed, check.DeepEquals, map[string]int{TestHash3: 4})
+	_, ok = cj.since(t0)
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *ChangeJournalSuite) TestJournalOverflow(c *check.C) {
+	defer func(orig int) { maxChangeJournalEntries = orig }(maxChangeJournalEntries)
+	maxChangeJournalEntries = 2
+	cj := newChangeJournal()
+	t0 := time.Now()
+	cj.record(TestHash, 3)
+	cj.record(TestHash2, 3)
+	cj.record(TestHash2, 3)
+	_, ok := cj.since(t0)
+	c.Check(ok, check.Equals, true)
+	cj.record(TestHash3, 3)
+	_, ok = cj.since(t0)
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *ChangeJournalSuite) TestHandler(c *check.C) {
+	t0 := time.Now()
+
+	resp := s.getChanges("", t0)
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	resp = s.getChanges(s.cluster.SystemRootToken, t0)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "\n")
+
+	// Written blocks are reported with their current
+	// timestamps, and trashed blocks are reported with a zero
+	// timestamp.
+	for _, blk := range [][]byte{TestBlock, TestBlock2} {
+		resp = IssueRequest(s.handler, &RequestTester{
+			method:      "PUT",
+			uri:         fmt.Sprintf("/%x", md5.Sum(blk)),
+			requestBody: blk,
+		})
+		c.Assert(resp.Code, check.Equals, http.StatusOK)
+	}
+	c.Check(s.mnt.Trash(TestHash2), check.IsNil)
+	resp = s.getChanges(s.cluster.SystemRootToken, t0)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	lines := strings.Split(resp.Body.String(), "\n")
+	sort.Strings(lines)
+	c.Check(lines, check.DeepEquals, []string{
+		"",
+		"",
+		fmt.Sprintf("%s+%d %d", TestHash, len(TestBlock), s.mock.Timestamps[TestHash].UnixNano()),
+		TestHash2 + " 0",
+	})
+
+	// Touched blocks whose size is not in the journal are
+	// reported with the size from the volume index.
+	t1 := time.Now()
+	s.mock.Store[TestHash3] = TestBlock3
+	s.mock.Timestamps[TestHash3] = t0
+	c.Check(s.mnt.Touch(TestHash3), check.IsNil)
+	resp = s.getChanges(s.cluster.SystemRootToken, t1)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, fmt.Sprintf("%s+%d 123456789\n\n", TestHash3, len(TestBlock3)))
+
+	// After a restart, the journal can't report changes before
+	// the restart.
+	s.mnt.changes = newChangeJournal()
+	resp = s.getChanges(s.cluster.SystemRootToken, t1)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+}
+
+func (s *ChangeJournalSuite) getChanges(token string, since time.Time) *httptest.ResponseRecorder {
+	return IssueRequest(s.handler, &RequestTester{
+		method:   "GET",
+		uri:      fmt.Sprintf("/mounts/%s/changes?since=%d", s.mnt.UUID, since.UnixNano()),
+		apiToken: token,
+	})
+}
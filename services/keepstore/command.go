@@ -169,7 +169,8 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 	h.Logger.Printf("keepstore %s starting, pid %d", cmd.Version.String(), os.Getpid())
 
 	// Start a round-robin VolumeManager with the configured volumes.
-	vm, err := makeRRVolumeManager(h.Logger, h.Cluster, serviceURL, newVolumeMetricsVecs(reg))
+	metrics := newVolumeMetricsVecs(reg)
+	vm, err := makeRRVolumeManager(h.Logger, h.Cluster, serviceURL, metrics)
 	if err != nil {
 		return err
 	}
@@ -212,5 +213,11 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 		go emptyTrash(h.volmgr.writables, d)
 	}
 
+	if h.Cluster.Collections.BlobScrubInterval > 0 {
+		for _, mnt := range h.volmgr.readables {
+			go newScrubber(h.Cluster, h.Logger, mnt, metrics).run(ctx)
+		}
+	}
+
 	return nil
 }
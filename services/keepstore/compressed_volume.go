@@ -0,0 +1,232 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Blocks written to a compressed volume are stored with a header
+//
+//	"ARVZ" codec (1 byte) logical size (8 bytes, big endian)
+//
+// followed by the encoded data. The locator, and the hash used to
+// verify the data, always refer to the logical (uncompressed)
+// content.
+//
+// Data without a header (e.g., blocks written before compression
+// was enabled on the volume) is returned as is. A block that does
+// not compress well is also stored as is, unless its content
+// happens to start with the header magic, in which case it is
+// stored with a "none" codec header to avoid ambiguity.
+var compressedMagic = []byte("ARVZ")
+
+const (
+	compressedHeaderLen = 13
+
+	codecNone byte = 0
+	codecZstd byte = 1
+)
+
+var compressionCodecs = map[string]byte{
+	"zstd": codecZstd,
+}
+
+var (
+	zstdEncoder   *zstd.Encoder
+	zstdDecoder   *zstd.Decoder
+	zstdSetupOnce sync.Once
+)
+
+func setupZstd() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	zstdDecoder, err = zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecodeAllCapLimit(true))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// compressedVolume wraps a Volume, transparently compressing data on
+// write and decompressing it on read.
+type compressedVolume struct {
+	Volume
+	codec     byte
+	byteStats *prometheus.CounterVec
+	index     *logicalSizeIndex
+
+	// Each operation uses one buffer of
+	// compressedVolumeBufSize bytes: half for the block data,
+	// and half for the compressed data.
+	bufs *bufferPool
+}
+
+const compressedVolumeBufSize = 2 * maxStoredBlockSize
+
+func newCompressedVolume(vol Volume, compression string, metrics *volumeMetricsVecs, bufs *bufferPool) (*compressedVolume, error) {
+	codec, ok := compressionCodecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	zstdSetupOnce.Do(setupZstd)
+	return &compressedVolume{
+		Volume:    vol,
+		codec:     codec,
+		bufs:      bufs,
+		byteStats: metrics.getCompressionVecFor(prometheus.Labels{"device_id": vol.GetDeviceID()}),
+		index: newLogicalSizeIndex(vol, compressedHeaderLen, func(hdr []byte, stored int) int {
+			if _, size, ok := parseCompressedHeader(hdr); ok {
+				return size
+			}
+			return stored
+		}),
+	}, nil
+}
+
+func (v *compressedVolume) String() string {
+	return v.Volume.String() + " (compressed)"
+}
+
+// InternalStats returns the wrapped volume's internal stats, if
+// any.
+func (v *compressedVolume) InternalStats() interface{} {
+	if is, ok := v.Volume.(InternalStatser); ok {
+		return is.InternalStats()
+	}
+	return nil
+}
+
+// WriteBlock implements BlockWriter.
+func (v *compressedVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
+	return v.WriteBlockWithLogicalSize(ctx, loc, rdr, size, size)
+}
+
+// WriteBlockWithLogicalSize implements logicalSizeVolume.
+func (v *compressedVolume) WriteBlockWithLogicalSize(ctx context.Context, loc string, rdr io.Reader, size, logicalSize int) error {
+	buf, err := getBufferWithContext(ctx, v.bufs, compressedVolumeBufSize)
+	if err != nil {
+		return err
+	}
+	defer v.bufs.Put(buf)
+	data, err := readBlockData(rdr, buf[:maxStoredBlockSize], size)
+	if err != nil {
+		return err
+	}
+	stored := v.encode(buf[maxStoredBlockSize:maxStoredBlockSize], data)
+	err = writeWithLogicalSize(ctx, v.Volume, loc, bytes.NewReader(stored), len(stored), logicalSize)
+	if err != nil {
+		return err
+	}
+	v.byteStats.With(prometheus.Labels{"direction": "out", "size": "logical"}).Add(float64(size))
+	v.byteStats.With(prometheus.Labels{"direction": "out", "size": "stored"}).Add(float64(len(stored)))
+	v.index.remember(loc, size)
+	return nil
+}
+
+// encode appends the stored representation of data to dst and
+// returns the result, which might be data itself.
+func (v *compressedVolume) encode(dst, data []byte) []byte {
+	dst = appendCompressedHeader(dst, v.codec, len(data))
+	dst = zstdEncoder.EncodeAll(data, dst)
+	if len(dst) < len(data) {
+		return dst
+	}
+	// Compression doesn't save any space.
+	if !bytes.HasPrefix(data, compressedMagic) {
+		return data
+	}
+	dst = appendCompressedHeader(dst[:0], codecNone, len(data))
+	return append(dst, data...)
+}
+
+func appendCompressedHeader(dst []byte, codec byte, size int) []byte {
+	dst = append(dst, compressedMagic...)
+	dst = append(dst, codec)
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(size))
+	return append(dst, sz[:]...)
+}
+
+// parseCompressedHeader returns the codec and logical size
+// indicated by the given header. If hdr is not a valid header, ok
+// is false.
+func parseCompressedHeader(hdr []byte) (codec byte, size int, ok bool) {
+	if len(hdr) < compressedHeaderLen || !bytes.HasPrefix(hdr, compressedMagic) {
+		return 0, 0, false
+	}
+	codec = hdr[len(compressedMagic)]
+	if codec != codecNone && codec != codecZstd {
+		return 0, 0, false
+	}
+	sz := binary.BigEndian.Uint64(hdr[len(compressedMagic)+1 : compressedHeaderLen])
+	if sz > BlockSize {
+		return 0, 0, false
+	}
+	return codec, int(sz), true
+}
+
+// ReadBlock implements BlockReader.
+func (v *compressedVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
+	buf, err := getBufferWithContext(ctx, v.bufs, compressedVolumeBufSize)
+	if err != nil {
+		return err
+	}
+	defer v.bufs.Put(buf)
+	bw := &fixedBufferWriter{buf: buf[:0:maxStoredBlockSize]}
+	err = v.Volume.ReadBlock(ctx, loc, bw)
+	if errors.Is(err, errBufferFull) {
+		return fmt.Errorf("%s: stored data is larger than the maximum block size", loc)
+	} else if err != nil {
+		return err
+	}
+	stored := bw.buf
+	data := stored
+	codec, size, ok := parseCompressedHeader(stored)
+	if ok {
+		switch codec {
+		case codecNone:
+			data = stored[compressedHeaderLen:]
+		case codecZstd:
+			dec := buf[maxStoredBlockSize:][:0:BlockSize]
+			data, err = zstdDecoder.DecodeAll(stored[compressedHeaderLen:], dec)
+			if err != nil {
+				return fmt.Errorf("%s: error decompressing block: %w", loc, err)
+			}
+		}
+		if len(data) != size {
+			return fmt.Errorf("%s: decompressed size %d does not match size %d in header", loc, len(data), size)
+		}
+	}
+	v.byteStats.With(prometheus.Labels{"direction": "in", "size": "logical"}).Add(float64(len(data)))
+	v.byteStats.With(prometheus.Labels{"direction": "in", "size": "stored"}).Add(float64(len(stored)))
+	v.index.remember(loc, len(data))
+	_, err = w.Write(data)
+	return err
+}
+
+// IndexTo implements Volume. Sizes reported by the wrapped volume
+// are replaced with logical sizes.
+func (v *compressedVolume) IndexTo(prefix string, w io.Writer) error {
+	return v.index.IndexTo(prefix, w)
+}
+
+// IndexWithLogicalSizesTo implements logicalSizeVolume.
+func (v *compressedVolume) IndexWithLogicalSizesTo(prefix string, w io.Writer) error {
+	return v.index.IndexWithLogicalSizesTo(prefix, w)
+}
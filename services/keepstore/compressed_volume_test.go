@@ -0,0 +1,204 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	check "gopkg.in/check.v1"
+)
+
+// testableCompressedVolume is a TestableVolume that compresses data
+// before storing it in an underlying TestableVolume.
+type testableCompressedVolume struct {
+	*compressedVolume
+	inner TestableVolume
+}
+
+func newTestableCompressedVolume(c *check.C, inner TestableVolume, metrics *volumeMetricsVecs) *testableCompressedVolume {
+	cv, err := newCompressedVolume(inner, "zstd", metrics, newBufferPool(ctxlog.TestLogger(c), 4, compressedVolumeBufSize))
+	c.Assert(err, check.IsNil)
+	return &testableCompressedVolume{compressedVolume: cv, inner: inner}
+}
+
+func (v *testableCompressedVolume) PutRaw(loc string, data []byte) {
+	v.inner.PutRaw(loc, v.encode(nil, data))
+	v.index.remember(loc, len(data))
+}
+
+func (v *testableCompressedVolume) TouchWithDate(loc string, t time.Time) {
+	v.inner.TouchWithDate(loc, t)
+}
+
+func (v *testableCompressedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return v.inner.ReadWriteOperationLabelValues()
+}
+
+func (v *testableCompressedVolume) Teardown() {
+	v.inner.Teardown()
+}
+
+var _ = check.Suite(&CompressedVolumeSuite{})
+
+type CompressedVolumeSuite struct {
+	registry *prometheus.Registry
+	metrics  *volumeMetricsVecs
+	mock     *MockVolume
+	bufs     *bufferPool
+	vol      *compressedVolume
+}
+
+func (s *CompressedVolumeSuite) SetUpTest(c *check.C) {
+	s.registry = prometheus.NewRegistry()
+	s.metrics = newVolumeMetricsVecs(s.registry)
+	mock, err := newMockVolume(testCluster(c), arvados.Volume{Replication: 1}, ctxlog.TestLogger(c), s.metrics)
+	c.Assert(err, check.IsNil)
+	s.mock = mock.(*MockVolume)
+	s.bufs = newBufferPool(ctxlog.TestLogger(c), 2, compressedVolumeBufSize)
+	s.vol, err = newCompressedVolume(s.mock, "zstd", s.metrics, s.bufs)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *CompressedVolumeSuite) TestUnsupportedCompression(c *check.C) {
+	_, err := newCompressedVolume(s.mock, "lzma", s.metrics, s.bufs)
+	c.Check(err, check.ErrorMatches, `unsupported compression "lzma"`)
+}
+
+func (s *CompressedVolumeSuite) TestCompressibleBlock(c *check.C) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(s.vol.WriteBlock(context.Background(), hash, bytes.NewReader(data), len(data)), check.IsNil)
+
+	stored := s.mock.Store[hash]
+	c.Check(len(stored) < len(data)/10, check.Equals, true)
+	codec, size, ok := parseCompressedHeader(stored)
+	c.Check(ok, check.Equals, true)
+	c.Check(codec, check.Equals, codecZstd)
+	c.Check(size, check.Equals, len(data))
+
+	c.Check(s.mock.LogicalSizes[hash], check.Equals, len(data))
+	s.checkRead(c, s.vol, hash, data)
+
+	// A new wrapper with an empty size cache uses the logical
+	// size recorded by the wrapped volume.
+	vol, err := newCompressedVolume(s.mock, "zstd", s.metrics, s.bufs)
+	c.Assert(err, check.IsNil)
+	reads := s.mock.CallCount("ReadBlock")
+	s.checkIndex(c, vol, fmt.Sprintf("%s+%d 123456789\n", hash, len(data)))
+	c.Check(s.mock.CallCount("ReadBlock"), check.Equals, reads)
+
+	// Without a recorded size, IndexTo has to get the logical
+	// size from the stored header.
+	delete(s.mock.LogicalSizes, hash)
+	vol, err = newCompressedVolume(s.mock, "zstd", s.metrics, s.bufs)
+	c.Assert(err, check.IsNil)
+	s.checkIndex(c, vol, fmt.Sprintf("%s+%d 123456789\n", hash, len(data)))
+	c.Check(s.mock.CallCount("ReadBlock"), check.Equals, reads+1)
+
+	c.Check(s.byteCount(c, "out", "logical"), check.Equals, float64(len(data)))
+	c.Check(s.byteCount(c, "out", "stored"), check.Equals, float64(len(stored)))
+	c.Check(s.byteCount(c, "in", "logical"), check.Equals, float64(len(data)))
+	c.Check(s.byteCount(c, "in", "stored"), check.Equals, float64(len(stored)))
+}
+
+func (s *CompressedVolumeSuite) TestIncompressibleBlock(c *check.C) {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(s.vol.WriteBlock(context.Background(), hash, bytes.NewReader(data), len(data)), check.IsNil)
+	c.Check(s.mock.Store[hash], check.DeepEquals, data)
+	s.checkRead(c, s.vol, hash, data)
+}
+
+func (s *CompressedVolumeSuite) TestIncompressibleBlockWithMagic(c *check.C) {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	copy(data, compressedMagic)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(s.vol.WriteBlock(context.Background(), hash, bytes.NewReader(data), len(data)), check.IsNil)
+	codec, size, ok := parseCompressedHeader(s.mock.Store[hash])
+	c.Check(ok, check.Equals, true)
+	c.Check(codec, check.Equals, codecNone)
+	c.Check(size, check.Equals, len(data))
+	s.checkRead(c, s.vol, hash, data)
+}
+
+func (s *CompressedVolumeSuite) TestUncompressedBlock(c *check.C) {
+	// Block written before compression was enabled
+	s.mock.Store[TestHash] = TestBlock
+	s.mock.Timestamps[TestHash] = time.Now()
+	s.checkRead(c, s.vol, TestHash, TestBlock)
+	s.checkIndex(c, s.vol, fmt.Sprintf("%s+%d 123456789\n", TestHash, len(TestBlock)))
+}
+
+func (s *CompressedVolumeSuite) TestWriteShortData(c *check.C) {
+	err := s.vol.WriteBlock(context.Background(), TestHash, bytes.NewReader(TestBlock), len(TestBlock)+1)
+	c.Check(err, check.NotNil)
+	err = s.vol.WriteBlock(context.Background(), TestHash, bytes.NewReader(TestBlock), len(TestBlock)-1)
+	c.Check(err, check.NotNil)
+	c.Check(s.mock.Store, check.HasLen, 0)
+}
+
+func (s *CompressedVolumeSuite) TestBufferLimit(c *check.C) {
+	// With all buffers in use, operations wait, and give up
+	// when the context is cancelled.
+	held := [][]byte{s.bufs.Get(compressedVolumeBufSize), s.bufs.Get(compressedVolumeBufSize)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := s.vol.WriteBlock(ctx, TestHash, bytes.NewReader(TestBlock), len(TestBlock))
+	c.Check(err, check.Equals, ErrClientDisconnect)
+	err = s.vol.ReadBlock(ctx, TestHash, &bytes.Buffer{})
+	c.Check(err, check.Equals, ErrClientDisconnect)
+	c.Check(s.mock.CallCount("WriteBlock"), check.Equals, 0)
+
+	for _, buf := range held {
+		s.bufs.Put(buf)
+	}
+	err = s.vol.WriteBlock(context.Background(), TestHash, bytes.NewReader(TestBlock), len(TestBlock))
+	c.Check(err, check.IsNil)
+}
+
+func (s *CompressedVolumeSuite) TestCorruptCompressedBlock(c *check.C) {
+	stored := appendCompressedHeader(nil, codecZstd, len(TestBlock))
+	stored = append(stored, "this is not zstd data"...)
+	s.mock.Store[TestHash] = stored
+	s.mock.Timestamps[TestHash] = time.Now()
+	buf := &bytes.Buffer{}
+	err := s.vol.ReadBlock(context.Background(), TestHash, buf)
+	c.Check(err, check.ErrorMatches, `.*error decompressing block.*`)
+	c.Check(buf.Len(), check.Equals, 0)
+}
+
+func (s *CompressedVolumeSuite) checkRead(c *check.C, vol Volume, hash string, expect []byte) {
+	buf := &bytes.Buffer{}
+	c.Check(vol.ReadBlock(context.Background(), hash, buf), check.IsNil)
+	c.Check(buf.Bytes(), check.DeepEquals, expect)
+}
+
+func (s *CompressedVolumeSuite) checkIndex(c *check.C, vol Volume, expect string) {
+	buf := &bytes.Buffer{}
+	c.Check(vol.IndexTo("", buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, expect)
+}
+
+func (s *CompressedVolumeSuite) byteCount(c *check.C, direction, size string) float64 {
+	var pb dto.Metric
+	err := s.metrics.compressionBytes.With(prometheus.Labels{
+		"device_id": s.mock.GetDeviceID(),
+		"direction": direction,
+		"size":      size,
+	}).Write(&pb)
+	c.Assert(err, check.IsNil)
+	return pb.GetCounter().GetValue()
+}
@@ -22,10 +22,6 @@ func NewCountingReader(r io.Reader, f func(uint64)) io.ReadCloser {
 	}
 }
 
-func NewCountingReaderAtSeeker(r readerAtSeeker, f func(uint64)) *countingReaderAtSeeker {
-	return &countingReaderAtSeeker{readerAtSeeker: r, counter: f}
-}
-
 type countingReadWriter struct {
 	reader  io.Reader
 	writer  io.Writer
@@ -50,25 +46,3 @@ func (crw *countingReadWriter) Close() error {
 	}
 	return nil
 }
-
-type readerAtSeeker interface {
-	io.ReadSeeker
-	io.ReaderAt
-}
-
-type countingReaderAtSeeker struct {
-	readerAtSeeker
-	counter func(uint64)
-}
-
-func (crw *countingReaderAtSeeker) Read(buf []byte) (int, error) {
-	n, err := crw.readerAtSeeker.Read(buf)
-	crw.counter(uint64(n))
-	return n, err
-}
-
-func (crw *countingReaderAtSeeker) ReadAt(buf []byte, off int64) (int, error) {
-	n, err := crw.readerAtSeeker.ReadAt(buf, off)
-	crw.counter(uint64(n))
-	return n, err
-}
@@ -0,0 +1,351 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Blocks written to an encrypted volume are stored as
+//
+//	"ARVE"
+//	version (1 byte)
+//	logical size (8 bytes, big endian)
+//	key ID length (1 byte)
+//	key ID
+//	wrapped data key length (2 bytes, big endian)
+//	wrapped data key
+//	nonce (12 bytes)
+//	ciphertext
+//
+// The ciphertext is the block data encrypted with AES-256-GCM using
+// a random data key. The additional authenticated data is the
+// locator followed by everything before the ciphertext, so a stored
+// block can't be moved to a different locator or have its header
+// modified without detection.
+//
+// The data key is wrapped (encrypted) by a keyProvider, which
+// returns an ID that identifies the key-encryption key it used.
+//
+// Data without a header (i.e., blocks written before encryption was
+// enabled on the volume) is returned as is.
+var encryptedMagic = []byte("ARVE")
+
+const (
+	encryptedVersion = 1
+
+	// length of the magic, version, and logical size fields
+	encryptedSizeHeaderLen = 13
+
+	dataKeyLen = 32
+)
+
+// A keyProvider wraps and unwraps the per-block data keys used by an
+// encryptedVolume, in the style of a key management service: the
+// key-encryption keys never leave the provider.
+type keyProvider interface {
+	// WrapKey encrypts a data key with the provider's current
+	// key-encryption key, and returns the wrapped key along with
+	// an identifier for the key-encryption key.
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+
+	// UnwrapKey decrypts a data key that was returned by
+	// WrapKey.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+var keyProviders = map[string]func(arvados.VolumeEncryption) (keyProvider, error){
+	"file": newFileKeyProvider,
+}
+
+// fileKeyProvider wraps data keys with AES-256-GCM, using keys
+// loaded from a local file.
+type fileKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func newFileKeyProvider(cfg arvados.VolumeEncryption) (keyProvider, error) {
+	buf, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	kp := &fileKeyProvider{keys: map[string]cipher.AEAD{}}
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s line %d: key must be 64 hexadecimal digits", cfg.KeyFile, i+1)
+		}
+		aead, err := newAESGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		// Identify each key by a prefix of its hash, so the
+		// ID doesn't depend on the order of keys in the file.
+		id := fmt.Sprintf("%x", sha256.Sum256(key))[:16]
+		kp.keys[id] = aead
+		if kp.current == "" {
+			kp.current = id
+		}
+	}
+	if kp.current == "" {
+		return nil, fmt.Errorf("%s: no keys found", cfg.KeyFile)
+	}
+	return kp, nil
+}
+
+func (kp *fileKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	aead := kp.keys[kp.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dataKey)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return kp.current, aead.Seal(nonce, nonce, dataKey, []byte(kp.current)), nil
+}
+
+func (kp *fileKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := kp.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found", keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedVolume wraps a Volume, transparently encrypting data on
+// write and decrypting it on read.
+type encryptedVolume struct {
+	Volume
+	keys  keyProvider
+	index *logicalSizeIndex
+
+	// Each operation uses one buffer of maxStoredBlockSize
+	// bytes. Data is encrypted and decrypted in place.
+	bufs *bufferPool
+}
+
+func newEncryptedVolume(vol Volume, cfg arvados.VolumeEncryption, bufs *bufferPool) (*encryptedVolume, error) {
+	newKeyProvider, ok := keyProviders[cfg.KeyProvider]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encryption key provider %q", cfg.KeyProvider)
+	}
+	keys, err := newKeyProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing encryption key provider: %w", err)
+	}
+	return &encryptedVolume{
+		Volume: vol,
+		keys:   keys,
+		bufs:   bufs,
+		index: newLogicalSizeIndex(vol, encryptedSizeHeaderLen, func(hdr []byte, stored int) int {
+			if len(hdr) == encryptedSizeHeaderLen && bytes.HasPrefix(hdr, encryptedMagic) {
+				return int(binary.BigEndian.Uint64(hdr[len(encryptedMagic)+1:]))
+			}
+			return stored
+		}),
+	}, nil
+}
+
+func (v *encryptedVolume) String() string {
+	return v.Volume.String() + " (encrypted)"
+}
+
+// InternalStats returns the wrapped volume's internal stats, if
+// any.
+func (v *encryptedVolume) InternalStats() interface{} {
+	if is, ok := v.Volume.(InternalStatser); ok {
+		return is.InternalStats()
+	}
+	return nil
+}
+
+// WriteBlock implements BlockWriter.
+func (v *encryptedVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
+	return v.WriteBlockWithLogicalSize(ctx, loc, rdr, size, size)
+}
+
+// WriteBlockWithLogicalSize implements logicalSizeVolume.
+func (v *encryptedVolume) WriteBlockWithLogicalSize(ctx context.Context, loc string, rdr io.Reader, size, logicalSize int) error {
+	buf, err := getBufferWithContext(ctx, v.bufs, maxStoredBlockSize)
+	if err != nil {
+		return err
+	}
+	defer v.bufs.Put(buf)
+	data, err := readBlockData(rdr, buf, size)
+	if err != nil {
+		return err
+	}
+	hdr, ciphertext, err := v.encrypt(loc, data)
+	if err != nil {
+		return fmt.Errorf("%s: error encrypting block: %w", loc, err)
+	}
+	stored := io.MultiReader(bytes.NewReader(hdr), bytes.NewReader(ciphertext))
+	err = writeWithLogicalSize(ctx, v.Volume, loc, stored, len(hdr)+len(ciphertext), logicalSize)
+	if err != nil {
+		return err
+	}
+	v.index.remember(loc, size)
+	return nil
+}
+
+// encrypt encrypts the given block data, in place if data has
+// enough spare capacity for the authentication tag, and returns the
+// ciphertext along with the header that is stored before it.
+func (v *encryptedVolume) encrypt(loc string, data []byte) (hdr, ciphertext []byte, err error) {
+	dataKey := make([]byte, dataKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	keyID, wrapped, err := v.keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAESGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	overhead := encryptedSizeHeaderLen + 1 + len(keyID) + 2 + len(wrapped) + aead.NonceSize() + aead.Overhead()
+	if len(keyID) > 255 || overhead > maxWrapperOverhead {
+		return nil, nil, fmt.Errorf("key ID (%d bytes) or wrapped key (%d bytes) is too long", len(keyID), len(wrapped))
+	}
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(len(data)))
+	hdr = make([]byte, 0, overhead-aead.Overhead())
+	hdr = append(hdr, encryptedMagic...)
+	hdr = append(hdr, encryptedVersion)
+	hdr = append(hdr, sz[:]...)
+	hdr = append(hdr, byte(len(keyID)))
+	hdr = append(hdr, keyID...)
+	hdr = append(hdr, byte(len(wrapped)>>8), byte(len(wrapped)))
+	hdr = append(hdr, wrapped...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	hdr = append(hdr, nonce...)
+	aad := append([]byte(loc), hdr...)
+	return hdr, aead.Seal(data[:0], nonce, data, aad), nil
+}
+
+// decrypt returns the block data represented by stored, decrypting
+// it in place. If stored does not have an encryption header, it is
+// returned as is.
+func (v *encryptedVolume) decrypt(loc string, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, encryptedMagic) {
+		return stored, nil
+	}
+	hdr := stored
+	next := func(n int) ([]byte, error) {
+		if len(hdr) < n {
+			return nil, errors.New("truncated header")
+		}
+		field := hdr[:n]
+		hdr = hdr[n:]
+		return field, nil
+	}
+	field, err := next(encryptedSizeHeaderLen + 1)
+	if err != nil {
+		return nil, err
+	}
+	if version := field[len(encryptedMagic)]; version != encryptedVersion {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	size := binary.BigEndian.Uint64(field[len(encryptedMagic)+1 : encryptedSizeHeaderLen])
+	keyID, err := next(int(field[encryptedSizeHeaderLen]))
+	if err != nil {
+		return nil, err
+	}
+	field, err = next(2)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := next(int(binary.BigEndian.Uint16(field)))
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := v.keys.UnwrapKey(string(keyID), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	aead, err := newAESGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := next(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	aad := append([]byte(loc), stored[:len(stored)-len(hdr)]...)
+	data, err := aead.Open(hdr[:0], nonce, hdr, aad)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != size {
+		return nil, fmt.Errorf("decrypted size %d does not match size %d in header", len(data), size)
+	}
+	return data, nil
+}
+
+// ReadBlock implements BlockReader.
+func (v *encryptedVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
+	buf, err := getBufferWithContext(ctx, v.bufs, maxStoredBlockSize)
+	if err != nil {
+		return err
+	}
+	defer v.bufs.Put(buf)
+	bw := &fixedBufferWriter{buf: buf[:0]}
+	err = v.Volume.ReadBlock(ctx, loc, bw)
+	if errors.Is(err, errBufferFull) {
+		return fmt.Errorf("%s: stored data is larger than the maximum block size", loc)
+	} else if err != nil {
+		return err
+	}
+	data, err := v.decrypt(loc, bw.buf)
+	if err != nil {
+		return fmt.Errorf("%s: error decrypting block: %w", loc, err)
+	}
+	v.index.remember(loc, len(data))
+	_, err = w.Write(data)
+	return err
+}
+
+// IndexTo implements Volume. Sizes reported by the wrapped volume
+// are replaced with logical sizes.
+func (v *encryptedVolume) IndexTo(prefix string, w io.Writer) error {
+	return v.index.IndexTo(prefix, w)
+}
+
+// IndexWithLogicalSizesTo implements logicalSizeVolume.
+func (v *encryptedVolume) IndexWithLogicalSizesTo(prefix string, w io.Writer) error {
+	return v.index.IndexWithLogicalSizesTo(prefix, w)
+}
@@ -0,0 +1,289 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+const (
+	testEncryptionKey1 = "0000000000000000000000000000000000000000000000000000000000000001"
+	testEncryptionKey2 = "0000000000000000000000000000000000000000000000000000000000000002"
+)
+
+// testableEncryptedVolume is a TestableVolume that encrypts data
+// before storing it in an underlying TestableVolume.
+type testableEncryptedVolume struct {
+	*encryptedVolume
+	inner TestableVolume
+}
+
+func newTestableEncryptedVolume(c *check.C, inner TestableVolume) *testableEncryptedVolume {
+	ev, err := newEncryptedVolume(inner, arvados.VolumeEncryption{
+		KeyProvider: "file",
+		KeyFile:     writeTestKeyFile(c, testEncryptionKey1),
+	}, newBufferPool(ctxlog.TestLogger(c), 4, maxStoredBlockSize))
+	c.Assert(err, check.IsNil)
+	return &testableEncryptedVolume{encryptedVolume: ev, inner: inner}
+}
+
+func (v *testableEncryptedVolume) PutRaw(loc string, data []byte) {
+	hdr, ciphertext, err := v.encrypt(loc, append([]byte(nil), data...))
+	if err != nil {
+		panic(err)
+	}
+	v.inner.PutRaw(loc, append(hdr, ciphertext...))
+	v.index.remember(loc, len(data))
+}
+
+func (v *testableEncryptedVolume) TouchWithDate(loc string, t time.Time) {
+	v.inner.TouchWithDate(loc, t)
+}
+
+func (v *testableEncryptedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return v.inner.ReadWriteOperationLabelValues()
+}
+
+func (v *testableEncryptedVolume) Teardown() {
+	v.inner.Teardown()
+}
+
+func writeTestKeyFile(c *check.C, keys ...string) string {
+	fnm := filepath.Join(c.MkDir(), "keyfile")
+	content := "# test keys\n\n"
+	for _, key := range keys {
+		content += key + "\n"
+	}
+	c.Assert(ioutil.WriteFile(fnm, []byte(content), 0600), check.IsNil)
+	return fnm
+}
+
+var _ = check.Suite(&EncryptedVolumeSuite{})
+
+type EncryptedVolumeSuite struct {
+	metrics *volumeMetricsVecs
+	mock    *MockVolume
+	bufs    *bufferPool
+}
+
+func (s *EncryptedVolumeSuite) SetUpTest(c *check.C) {
+	s.metrics = newVolumeMetricsVecs(prometheus.NewRegistry())
+	mock, err := newMockVolume(testCluster(c), arvados.Volume{Replication: 1}, ctxlog.TestLogger(c), s.metrics)
+	c.Assert(err, check.IsNil)
+	s.mock = mock.(*MockVolume)
+	s.bufs = newBufferPool(ctxlog.TestLogger(c), 2, maxStoredBlockSize)
+}
+
+func (s *EncryptedVolumeSuite) newVolume(c *check.C, keys ...string) *encryptedVolume {
+	vol, err := newEncryptedVolume(s.mock, arvados.VolumeEncryption{
+		KeyProvider: "file",
+		KeyFile:     writeTestKeyFile(c, keys...),
+	}, s.bufs)
+	c.Assert(err, check.IsNil)
+	return vol
+}
+
+func (s *EncryptedVolumeSuite) TestKeyFileErrors(c *check.C) {
+	for _, trial := range []struct {
+		keys   []string
+		errMsg string
+	}{
+		{nil, `.*no keys found`},
+		{[]string{"abcdef"}, `.*line 3: key must be 64 hexadecimal digits`},
+		{[]string{testEncryptionKey1, "zz" + testEncryptionKey2[2:]}, `.*line 4: key must be 64 hexadecimal digits`},
+	} {
+		_, err := newEncryptedVolume(s.mock, arvados.VolumeEncryption{
+			KeyProvider: "file",
+			KeyFile:     writeTestKeyFile(c, trial.keys...),
+		}, s.bufs)
+		c.Check(err, check.ErrorMatches, trial.errMsg)
+	}
+	_, err := newEncryptedVolume(s.mock, arvados.VolumeEncryption{KeyProvider: "kms"}, s.bufs)
+	c.Check(err, check.ErrorMatches, `unsupported encryption key provider "kms"`)
+}
+
+func (s *EncryptedVolumeSuite) TestRoundTrip(c *check.C) {
+	vol := s.newVolume(c, testEncryptionKey1)
+	data := bytes.Repeat([]byte("ACGT"), 1<<16)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(vol.WriteBlock(context.Background(), hash, bytes.NewReader(data), len(data)), check.IsNil)
+
+	stored := s.mock.Store[hash]
+	c.Check(bytes.HasPrefix(stored, encryptedMagic), check.Equals, true)
+	c.Check(bytes.Contains(stored, []byte("ACGTACGT")), check.Equals, false)
+	s.checkRead(c, vol, hash, data)
+
+	// A new volume (with an empty size cache) gets logical
+	// sizes recorded by the wrapped volume, or, failing that,
+	// from the stored headers.
+	c.Check(s.mock.LogicalSizes[hash], check.Equals, len(data))
+	s.checkIndex(c, s.newVolume(c, testEncryptionKey1), fmt.Sprintf("%s+%d 123456789\n", hash, len(data)))
+	delete(s.mock.LogicalSizes, hash)
+	s.checkIndex(c, s.newVolume(c, testEncryptionKey1), fmt.Sprintf("%s+%d 123456789\n", hash, len(data)))
+}
+
+func (s *EncryptedVolumeSuite) TestKeyRotation(c *check.C) {
+	vol := s.newVolume(c, testEncryptionKey1)
+	c.Assert(vol.WriteBlock(context.Background(), TestHash, bytes.NewReader(TestBlock), len(TestBlock)), check.IsNil)
+
+	// Add a new key at the top of the key file: new blocks are
+	// encrypted with the new key, and old blocks are still
+	// readable.
+	vol = s.newVolume(c, testEncryptionKey2, testEncryptionKey1)
+	s.checkRead(c, vol, TestHash, TestBlock)
+	c.Assert(vol.WriteBlock(context.Background(), TestHash2, bytes.NewReader(TestBlock2), len(TestBlock2)), check.IsNil)
+
+	// Without the old key, the old block is unreadable.
+	vol = s.newVolume(c, testEncryptionKey2)
+	s.checkRead(c, vol, TestHash2, TestBlock2)
+	err := vol.ReadBlock(context.Background(), TestHash, &bytes.Buffer{})
+	c.Check(err, check.ErrorMatches, `.*error unwrapping data key: key ".*" not found`)
+}
+
+func (s *EncryptedVolumeSuite) TestTamperedBlock(c *check.C) {
+	vol := s.newVolume(c, testEncryptionKey1)
+	c.Assert(vol.WriteBlock(context.Background(), TestHash, bytes.NewReader(TestBlock), len(TestBlock)), check.IsNil)
+	stored := s.mock.Store[TestHash]
+
+	// Modified ciphertext
+	s.mock.Store[TestHash] = append(append([]byte(nil), stored[:len(stored)-1]...), stored[len(stored)-1]^1)
+	buf := &bytes.Buffer{}
+	err := vol.ReadBlock(context.Background(), TestHash, buf)
+	c.Check(err, check.ErrorMatches, `.*error decrypting block.*`)
+	c.Check(buf.Len(), check.Equals, 0)
+
+	// Valid ciphertext moved to a different locator
+	delete(s.mock.Store, TestHash)
+	s.mock.Store[TestHash2] = stored
+	s.mock.Timestamps[TestHash2] = time.Now()
+	err = vol.ReadBlock(context.Background(), TestHash2, buf)
+	c.Check(err, check.ErrorMatches, `.*error decrypting block.*`)
+
+	// Truncated header
+	s.mock.Store[TestHash2] = stored[:20]
+	err = vol.ReadBlock(context.Background(), TestHash2, buf)
+	c.Check(err, check.ErrorMatches, `.*truncated header`)
+}
+
+func (s *EncryptedVolumeSuite) TestUnencryptedBlock(c *check.C) {
+	// Block written before encryption was enabled
+	s.mock.Store[TestHash] = TestBlock
+	s.mock.Timestamps[TestHash] = time.Now()
+	vol := s.newVolume(c, testEncryptionKey1)
+	s.checkRead(c, vol, TestHash, TestBlock)
+	s.checkIndex(c, vol, fmt.Sprintf("%s+%d 123456789\n", TestHash, len(TestBlock)))
+}
+
+func (s *EncryptedVolumeSuite) TestCompressedEncryptedBlock(c *check.C) {
+	ev := s.newVolume(c, testEncryptionKey1)
+	cbufs := newBufferPool(ctxlog.TestLogger(c), 1, compressedVolumeBufSize)
+	cv, err := newCompressedVolume(ev, "zstd", s.metrics, cbufs)
+	c.Assert(err, check.IsNil)
+	data := bytes.Repeat([]byte("ACGT"), 1<<16)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(cv.WriteBlock(context.Background(), hash, bytes.NewReader(data), len(data)), check.IsNil)
+	c.Check(len(s.mock.Store[hash]) < len(data)/10, check.Equals, true)
+	s.checkRead(c, cv, hash, data)
+
+	// The logical size recorded by the underlying volume is the
+	// uncompressed size, not the size of the compressed data
+	// given to the encryption layer.
+	c.Check(s.mock.LogicalSizes[hash], check.Equals, len(data))
+	ev = s.newVolume(c, testEncryptionKey1)
+	cv, err = newCompressedVolume(ev, "zstd", s.metrics, cbufs)
+	c.Assert(err, check.IsNil)
+	s.checkIndex(c, cv, fmt.Sprintf("%s+%d 123456789\n", hash, len(data)))
+
+	delete(s.mock.LogicalSizes, hash)
+	ev = s.newVolume(c, testEncryptionKey1)
+	cv, err = newCompressedVolume(ev, "zstd", s.metrics, cbufs)
+	c.Assert(err, check.IsNil)
+	s.checkIndex(c, cv, fmt.Sprintf("%s+%d 123456789\n", hash, len(data)))
+}
+
+func (s *EncryptedVolumeSuite) TestFullSizeBlock(c *check.C) {
+	vol := s.newVolume(c, testEncryptionKey1)
+	data := make([]byte, BlockSize)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(vol.WriteBlock(context.Background(), hash, bytes.NewReader(data), len(data)), check.IsNil)
+	c.Check(len(s.mock.Store[hash]) > BlockSize, check.Equals, true)
+	c.Check(len(s.mock.Store[hash]) <= maxStoredBlockSize, check.Equals, true)
+	s.checkRead(c, vol, hash, data)
+}
+
+func (s *EncryptedVolumeSuite) TestHandler(c *check.C) {
+	cluster := testCluster(c)
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver:      "mock",
+			Replication: 1,
+			Encryption: arvados.VolumeEncryption{
+				KeyProvider: "file",
+				KeyFile:     writeTestKeyFile(c, testEncryptionKey1),
+			},
+		},
+	}
+	h := &handler{}
+	c.Assert(h.setup(context.Background(), cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	mnts := h.volmgr.AllWritable()
+	c.Assert(mnts, check.HasLen, 1)
+	vol, ok := mnts[0].Volume.(*encryptedVolume)
+	c.Assert(ok, check.Equals, true)
+	mock := vol.Volume.(*MockVolume)
+
+	resp := IssueRequest(h, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		requestBody: TestBlock,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(bytes.Contains(mock.Store[TestHash], TestBlock), check.Equals, false)
+
+	resp = IssueRequest(h, &RequestTester{
+		method: "GET",
+		uri:    "/" + TestHash,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, string(TestBlock))
+
+	// Data retrieved by the pull worker is encrypted, too.
+	defer func(orig func(string, *keepclient.KeepClient) (io.ReadCloser, int64, string, error)) {
+		GetContent = orig
+	}(GetContent)
+	GetContent = func(signedLocator string, keepClient *keepclient.KeepClient) (io.ReadCloser, int64, string, error) {
+		return ioutil.NopCloser(bytes.NewReader(TestBlock2)), int64(len(TestBlock2)), "", nil
+	}
+	err := h.pullItemAndProcess(PullRequest{Locator: TestHash2, Servers: []string{"http://keep.example:25107"}})
+	c.Check(err, check.IsNil)
+	c.Check(mock.Store[TestHash2], check.NotNil)
+	c.Check(bytes.Contains(mock.Store[TestHash2], TestBlock2), check.Equals, false)
+	s.checkRead(c, vol, TestHash2, TestBlock2)
+}
+
+func (s *EncryptedVolumeSuite) checkRead(c *check.C, vol Volume, hash string, expect []byte) {
+	buf := &bytes.Buffer{}
+	c.Check(vol.ReadBlock(context.Background(), hash, buf), check.IsNil)
+	c.Check(buf.Bytes(), check.DeepEquals, expect)
+}
+
+func (s *EncryptedVolumeSuite) checkIndex(c *check.C, vol Volume, expect string) {
+	buf := &bytes.Buffer{}
+	c.Check(vol.IndexTo("", buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, expect)
+}
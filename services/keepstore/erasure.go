@@ -0,0 +1,435 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
+)
+
+// isShardKey returns true if loc is the key of an erasure-coded
+// shard rather than a whole block.
+func isShardKey(loc string) bool {
+	_, _, _, ok := erasure.ParseShardKey(loc)
+	return ok
+}
+
+// shardStore is a volume where erasure-coded shards can be stored:
+// either a local mount, or a volume that is only accessible through
+// a different keepstore server.
+type shardStore interface {
+	readShard(ctx context.Context, key string, w io.Writer) error
+	writeShard(ctx context.Context, key string, data []byte) error
+	touchShard(ctx context.Context, key string) error
+	String() string
+}
+
+type localShardStore struct {
+	*VolumeMount
+}
+
+func (ls localShardStore) readShard(ctx context.Context, key string, w io.Writer) error {
+	return ls.ReadBlock(ctx, key, w)
+}
+
+func (ls localShardStore) writeShard(ctx context.Context, key string, data []byte) error {
+	return ls.WriteBlock(ctx, key, bytes.NewReader(data), len(data))
+}
+
+func (ls localShardStore) touchShard(ctx context.Context, key string) error {
+	return ls.Touch(key)
+}
+
+// remoteShardStore accesses shards on a volume that is mounted by
+// other keepstore servers, using their /mounts/{uuid}/blocks/{key}
+// API.
+type remoteShardStore struct {
+	uuid string
+	// servers that provide the volume, writable ones first
+	servers []arvados.URL
+	client  *http.Client
+	token   string
+}
+
+func (rs *remoteShardStore) String() string {
+	return fmt.Sprintf("remote volume %s", rs.uuid)
+}
+
+func (rs *remoteShardStore) readShard(ctx context.Context, key string, w io.Writer) error {
+	return rs.do(ctx, "GET", key, nil, w)
+}
+
+func (rs *remoteShardStore) writeShard(ctx context.Context, key string, data []byte) error {
+	return rs.do(ctx, "PUT", key, data, nil)
+}
+
+func (rs *remoteShardStore) touchShard(ctx context.Context, key string) error {
+	return rs.do(ctx, "TOUCH", key, nil, nil)
+}
+
+// do sends the given request to each server that provides the
+// volume, until one succeeds. A 404 response is reported as an
+// os.ErrNotExist error.
+func (rs *remoteShardStore) do(ctx context.Context, method, key string, body []byte, w io.Writer) error {
+	err := fmt.Errorf("no servers provide volume %s", rs.uuid)
+	for _, srv := range rs.servers {
+		u := url.URL(srv)
+		u.Path = "/mounts/" + rs.uuid + "/blocks/" + key
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+rs.token)
+		var resp *http.Response
+		resp, err = rs.client.Do(req)
+		if err != nil {
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			err = os.ErrNotExist
+		case resp.StatusCode != http.StatusOK:
+			err = fmt.Errorf("%s %s: %s", method, u.String(), resp.Status)
+		case w != nil:
+			_, err = io.Copy(w, resp.Body)
+		}
+		resp.Body.Close()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// setupShardVolumes prepares the list of volumes where each
+// erasure-coded storage class can store shards. This includes
+// volumes that are only accessible via other keepstore servers.
+//
+// Volumes that are accessible through the same set of servers are
+// in the same failure domain. keep-balance uses the same rule, based
+// on which servers report each mount, so both agree on where each
+// shard belongs.
+func (vm *RRVolumeManager) setupShardVolumes(cluster *arvados.Cluster) {
+	vm.shardVolumes = make(map[string][]erasure.Volume)
+	vm.remoteShardStores = make(map[string]*remoteShardStore)
+	if len(vm.codecs) == 0 {
+		return
+	}
+	client := arvados.DefaultSecureClient
+	if cluster.TLS.Insecure {
+		client = arvados.InsecureHTTPClient
+	}
+	for uuid, cfgvol := range cluster.Volumes {
+		var servers []string
+		var writableVia, readOnlyVia []arvados.URL
+		for u, va := range cfgvol.AccessViaHosts {
+			servers = append(servers, u.String())
+			if va.ReadOnly {
+				readOnlyVia = append(readOnlyVia, u)
+			} else {
+				writableVia = append(writableVia, u)
+			}
+		}
+		if len(cfgvol.AccessViaHosts) == 0 {
+			for u := range cluster.Services.Keepstore.InternalURLs {
+				servers = append(servers, u.String())
+			}
+		} else if len(writableVia) == 0 {
+			continue
+		}
+		if cfgvol.ReadOnly {
+			continue
+		}
+		sort.Strings(servers)
+		sc := cfgvol.StorageClasses
+		if len(sc) == 0 {
+			sc = map[string]bool{"default": true}
+		}
+		for class := range sc {
+			if vm.codecs[class] != nil {
+				vm.shardVolumes[class] = append(vm.shardVolumes[class], erasure.Volume{
+					UUID:          uuid,
+					FailureDomain: strings.Join(servers, " "),
+				})
+			}
+		}
+		sortURLs(writableVia)
+		sortURLs(readOnlyVia)
+		vm.remoteShardStores[uuid] = &remoteShardStore{
+			uuid:    uuid,
+			servers: append(writableVia, readOnlyVia...),
+			client:  client,
+			token:   cluster.SystemRootToken,
+		}
+	}
+}
+
+func sortURLs(urls []arvados.URL) {
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].String() < urls[j].String()
+	})
+}
+
+// shardPlacement returns the volumes where shards 0..N-1 of the given
+// block belong in the given storage class (nil if there is no
+// suitable volume). Volumes mounted on this server are accessed
+// directly, others via the keepstore servers that provide them.
+func (vm *RRVolumeManager) shardPlacement(class, hash string) []shardStore {
+	codec := vm.codecs[class]
+	if codec == nil {
+		return nil
+	}
+	uuids := erasure.Placement(hash, vm.shardVolumes[class], codec.TotalShards())
+	stores := make([]shardStore, len(uuids))
+	for i, uuid := range uuids {
+		if uuid == "" {
+			continue
+		} else if mnt := vm.Lookup(uuid, true); mnt != nil {
+			stores[i] = localShardStore{mnt}
+		} else if rs := vm.remoteShardStores[uuid]; rs != nil {
+			stores[i] = rs
+		}
+	}
+	return stores
+}
+
+// putShards encodes block and writes the resulting shards to the
+// volumes where they belong in the given storage class.
+func putShards(ctx context.Context, volmgr *RRVolumeManager, codec *erasure.Codec, class, hash string, block []byte) error {
+	stores := volmgr.shardPlacement(class, hash)
+	for _, store := range stores {
+		if store == nil {
+			return fmt.Errorf("storage class %q needs %d writable volumes for erasure coding, but only %d are available", class, codec.TotalShards(), len(volmgr.shardVolumes[class]))
+		}
+	}
+	shards := codec.Encode(block)
+	errs := make(chan error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		i, shard, store := i, shard, stores[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := erasure.ShardKey(hash, len(block), i)
+			err := store.writeShard(ctx, key, shard)
+			if err != nil {
+				errs <- fmt.Errorf("%s: write %s failed: %w", store, key, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// touchShards updates the timestamps of an existing shard set of the
+// given block, so it doesn't need to be encoded and written again. It
+// returns false if any shard could not be touched.
+//
+// The shards are not verified: a shard has no checksum of its own,
+// so that would mean reading and reassembling the whole block. A
+// corrupt shard is detected when the block is reassembled, and
+// replaced by keep-balance like a missing one.
+func touchShards(ctx context.Context, volmgr *RRVolumeManager, class, hash string, blockSize int) bool {
+	log := ctxlog.FromContext(ctx)
+	stores := volmgr.shardPlacement(class, hash)
+	if len(stores) == 0 {
+		return false
+	}
+	ok := make(chan bool, len(stores))
+	for i, store := range stores {
+		i, store := i, store
+		go func() {
+			if store == nil {
+				ok <- false
+				return
+			}
+			key := erasure.ShardKey(hash, blockSize, i)
+			err := store.touchShard(ctx, key)
+			if err != nil && !os.IsNotExist(err) && ctx.Err() == nil {
+				log.WithError(err).Errorf("%s: touch %s failed", store, key)
+			}
+			ok <- err == nil
+		}()
+	}
+	all := true
+	for range stores {
+		all = <-ok && all
+	}
+	return all
+}
+
+// readShards reads the shards of the given block from the volumes
+// in the given storage class, and returns them in a slice suitable
+// for passing to codec.Reconstruct (missing shards are nil). It
+// stops reading as soon as enough shards have been found to
+// reconstruct the block, unless all is true.
+func readShards(ctx context.Context, volmgr *RRVolumeManager, codec *erasure.Codec, class, hash string, blockSize int, all bool) ([][]byte, int) {
+	log := ctxlog.FromContext(ctx)
+	shards := make([][]byte, codec.TotalShards())
+	shardSize := codec.ShardSize(blockSize)
+	found := 0
+	placement := volmgr.shardPlacement(class, hash)
+	var local []shardStore
+	for _, mnt := range volmgr.Mounts() {
+		if mnt.StorageClasses[class] {
+			local = append(local, localShardStore{mnt})
+		}
+	}
+	for i := range shards {
+		if found >= codec.DataShards() && !all {
+			break
+		}
+		key := erasure.ShardKey(hash, blockSize, i)
+		// Try the volume where the shard belongs first, then
+		// the local mounts, in case the shard has been
+		// written somewhere else.
+		var try []shardStore
+		if i < len(placement) && placement[i] != nil {
+			try = append(try, placement[i])
+		}
+		try = append(try, local...)
+		for _, store := range try {
+			if ctx.Err() != nil {
+				return shards, found
+			}
+			var buf bytes.Buffer
+			err := store.readShard(ctx, key, &buf)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				log.WithError(err).Warnf("%s: read %s failed", store, key)
+				continue
+			} else if buf.Len() != shardSize {
+				log.Warnf("%s: read %s returned %d bytes, expected %d", store, key, buf.Len(), shardSize)
+				continue
+			}
+			shards[i] = buf.Bytes()
+			found++
+			break
+		}
+	}
+	return shards, found
+}
+
+// reconstructBlock reassembles the given block from its shards,
+// checks that the result matches hash, and writes it to w.
+func reconstructBlock(codec *erasure.Codec, shards [][]byte, hash string, blockSize int, w io.Writer) error {
+	if err := codec.Reconstruct(shards); err != nil {
+		return err
+	}
+	hcw := newHashCheckWriter(ioutil.Discard, hash)
+	if err := codec.Join(hcw, shards, blockSize); err != nil {
+		return err
+	}
+	if err := hcw.Check(); err != nil {
+		return err
+	}
+	return codec.Join(w, shards, blockSize)
+}
+
+// getShardedBlock looks for erasure-coded shards of the given block
+// in each erasure-coded storage class, and if enough shards are
+// found, reassembles the block and writes it to w.
+//
+// The block data is verified before anything is written to w.
+func getShardedBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, blockSize int, w io.Writer) error {
+	log := ctxlog.FromContext(ctx)
+	errorToCaller := NotFoundError
+	for _, class := range volmgr.erasureCodedClasses() {
+		codec := volmgr.codecs[class]
+		shards, found := readShards(ctx, volmgr, codec, class, hash, blockSize, false)
+		if ctx.Err() != nil {
+			return ErrClientDisconnect
+		}
+		if found < codec.DataShards() {
+			if found > 0 {
+				log.Warnf("%s: found only %d of %d shards needed to reconstruct block in storage class %q", hash, found, codec.DataShards(), class)
+			}
+			continue
+		}
+		var buf bytes.Buffer
+		err := reconstructBlock(codec, shards, hash, blockSize, &buf)
+		if err == DiskHashError {
+			log.Errorf("%s: checksum mismatch in block reconstructed from shards in storage class %q", hash, class)
+			errorToCaller = DiskHashError
+			continue
+		} else if err != nil {
+			log.WithError(err).Errorf("%s: error reconstructing block from shards in storage class %q", hash, class)
+			continue
+		}
+		if n, err := buf.WriteTo(w); err != nil && n > 0 {
+			return errPartialResponse
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	return errorToCaller
+}
+
+// pullShard stores the indicated shard of a block on the given
+// mount. If enough other shards of the block are available, the
+// missing shard is computed from them. Otherwise, getBlock
+// is called to retrieve the complete block, and the shard is computed
+// from that.
+func pullShard(ctx context.Context, volmgr *RRVolumeManager, mnt *VolumeMount, shardKey string, getBlock func(loc string) (io.ReadCloser, int64, error)) error {
+	hash, blockSize, idx, ok := erasure.ParseShardKey(shardKey)
+	if !ok {
+		return fmt.Errorf("invalid shard key %q", shardKey)
+	}
+	var class string
+	var codec *erasure.Codec
+	for c := range mnt.StorageClasses {
+		if volmgr.codecs[c] != nil {
+			class, codec = c, volmgr.codecs[c]
+			break
+		}
+	}
+	if codec == nil {
+		return fmt.Errorf("mount %s does not have an erasure-coded storage class", mnt.UUID)
+	} else if idx >= codec.TotalShards() {
+		return fmt.Errorf("shard index %d out of range for storage class %q", idx, class)
+	}
+
+	shards, found := readShards(ctx, volmgr, codec, class, hash, blockSize, true)
+	if found < codec.DataShards() || reconstructBlock(codec, shards, hash, blockSize, ioutil.Discard) != nil {
+		// Not enough good shards available, so get the whole
+		// block from a remote server and re-encode it.
+		rdr, size, err := getBlock(fmt.Sprintf("%s+%d", hash, blockSize))
+		if err != nil {
+			return err
+		}
+		defer rdr.Close()
+		if size != int64(blockSize) {
+			return fmt.Errorf("remote server returned %d bytes, expected %d", size, blockSize)
+		}
+		buf, err := getBufferWithContext(ctx, bufs, blockSize)
+		if err != nil {
+			return err
+		}
+		defer bufs.Put(buf)
+		hcr := newHashCheckReader(rdr, hash, blockSize, RequestHashError)
+		if _, err := io.ReadFull(hcr, buf[:blockSize]); err != nil {
+			return err
+		}
+		shards = codec.Encode(buf[:blockSize])
+	}
+	return mnt.WriteBlock(ctx, shardKey, bytes.NewReader(shards[idx]), len(shards[idx]))
+}
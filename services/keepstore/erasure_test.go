@@ -0,0 +1,307 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ErasureSuite{})
+
+type ErasureSuite struct {
+	cluster *arvados.Cluster
+	handler *handler
+}
+
+func (s *ErasureSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.StorageClasses = map[string]arvados.StorageClassConfig{
+		"default": {Default: true},
+		"ec":      {ErasureCoding: arvados.ErasureCodingConfig{DataShards: 3, ParityShards: 2}},
+	}
+	s.cluster.Volumes = map[string]arvados.Volume{}
+	for i := 0; i < 5; i++ {
+		s.cluster.Volumes[fmt.Sprintf("zzzzz-nyw5e-%015d", i)] = arvados.Volume{
+			Driver:         "mock",
+			Replication:    1,
+			StorageClasses: map[string]bool{"ec": true},
+		}
+	}
+	s.cluster.Volumes["zzzzz-nyw5e-999999999999999"] = arvados.Volume{
+		Driver:      "mock",
+		Replication: 1,
+	}
+	s.handler = &handler{}
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+}
+
+// shardMockVolumes returns the mock volumes in the "ec" class, in
+// shard order for TestHash.
+func (s *ErasureSuite) shardMockVolumes() []*MockVolume {
+	var vols []*MockVolume
+	for _, store := range s.handler.volmgr.shardPlacement("ec", TestHash) {
+		if store, ok := store.(localShardStore); ok {
+			vols = append(vols, store.Volume.(*MockVolume))
+		}
+	}
+	return vols
+}
+
+func (s *ErasureSuite) TestPutAndGet(c *check.C) {
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:         "PUT",
+		uri:            "/" + TestHash,
+		requestBody:    TestBlock,
+		storageClasses: "ec",
+	})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Keep-Replicas-Stored"), check.Equals, "1")
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "ec=1")
+
+	vols := s.shardMockVolumes()
+	c.Assert(vols, check.HasLen, 5)
+	for i, v := range vols {
+		c.Check(v.Store[TestHash], check.IsNil)
+		c.Check(v.Store[erasure.ShardKey(TestHash, len(TestBlock), i)], check.HasLen, (len(TestBlock)+2)/3)
+	}
+
+	// Lose two shards.
+	delete(vols[0].Store, erasure.ShardKey(TestHash, len(TestBlock), 0))
+	delete(vols[3].Store, erasure.ShardKey(TestHash, len(TestBlock), 3))
+
+	resp = IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, string(TestBlock))
+
+	// Shards can't be found without a size hint.
+	resp = IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    "/" + TestHash,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	// Lose one more shard, leaving too few to reconstruct.
+	delete(vols[4].Store, erasure.ShardKey(TestHash, len(TestBlock), 4))
+	resp = IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+	})
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *ErasureSuite) TestCorruptShard(c *check.C) {
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:         "PUT",
+		uri:            "/" + TestHash,
+		requestBody:    TestBlock,
+		storageClasses: "ec",
+	})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	vols := s.shardMockVolumes()
+	key := erasure.ShardKey(TestHash, len(TestBlock), 1)
+	vols[1].Store[key] = bytes.Repeat([]byte{'x'}, len(vols[1].Store[key]))
+
+	resp = IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+	})
+	c.Check(resp.Code, check.Equals, DiskHashError.HTTPCode)
+}
+
+func (s *ErasureSuite) TestFallBackToReplicas(c *check.C) {
+	// With one volume missing, there aren't enough volumes to
+	// store all shards, so a full replica is stored instead.
+	delete(s.cluster.Volumes, "zzzzz-nyw5e-000000000000004")
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:         "PUT",
+		uri:            "/" + TestHash,
+		requestBody:    TestBlock,
+		storageClasses: "ec",
+	})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Keep-Replicas-Stored"), check.Equals, "1")
+	found := 0
+	for _, v := range s.shardMockVolumes() {
+		if bytes.Equal(v.Store[TestHash], TestBlock) {
+			found++
+		}
+	}
+	c.Check(found, check.Equals, 1)
+}
+
+func (s *ErasureSuite) TestPullShard(c *check.C) {
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:         "PUT",
+		uri:            "/" + TestHash,
+		requestBody:    TestBlock,
+		storageClasses: "ec",
+	})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	vols := s.shardMockVolumes()
+	var mnts []*VolumeMount
+	for _, store := range s.handler.volmgr.shardPlacement("ec", TestHash) {
+		mnts = append(mnts, store.(localShardStore).VolumeMount)
+	}
+	key := erasure.ShardKey(TestHash, len(TestBlock), 2)
+	want := vols[2].Store[key]
+	delete(vols[2].Store, key)
+
+	// Rebuild the missing shard from the others.
+	err := s.handler.pullItemAndProcess(PullRequest{Locator: key, MountUUID: mnts[2].UUID})
+	c.Check(err, check.IsNil)
+	c.Check(vols[2].Store[key], check.DeepEquals, want)
+
+	// Lose all but one shard, so the shard has to be computed
+	// from a full copy of the block retrieved from a remote
+	// server.
+	for i := 0; i < 4; i++ {
+		delete(vols[i].Store, erasure.ShardKey(TestHash, len(TestBlock), i))
+	}
+	var gotLocator string
+	defer func(orig func(string, *keepclient.KeepClient) (io.ReadCloser, int64, string, error)) {
+		GetContent = orig
+	}(GetContent)
+	GetContent = func(signedLocator string, keepClient *keepclient.KeepClient) (io.ReadCloser, int64, string, error) {
+		gotLocator = signedLocator
+		return ioutil.NopCloser(bytes.NewReader(TestBlock)), int64(len(TestBlock)), "", nil
+	}
+	key = erasure.ShardKey(TestHash, len(TestBlock), 0)
+	err = s.handler.pullItemAndProcess(PullRequest{Locator: key, MountUUID: mnts[0].UUID, Servers: []string{"http://keep.example:25107"}})
+	c.Check(err, check.IsNil)
+	c.Check(gotLocator, check.Matches, fmt.Sprintf(`%s\+%d.*`, TestHash, len(TestBlock)))
+	c.Check(vols[0].Store[key], check.HasLen, (len(TestBlock)+2)/3)
+
+	resp = IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+	})
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *ErasureSuite) TestTouchExistingShards(c *check.C) {
+	for i := 0; i < 2; i++ {
+		resp := IssueRequest(s.handler, &RequestTester{
+			method:         "PUT",
+			uri:            "/" + TestHash,
+			requestBody:    TestBlock,
+			storageClasses: "ec",
+		})
+		c.Assert(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "ec=1")
+	}
+	// The second PUT touches the existing shards instead of
+	// writing them again.
+	for _, v := range s.shardMockVolumes() {
+		c.Check(v.CallCount("WriteBlock"), check.Equals, 1)
+	}
+
+	// If a shard is missing, the whole set is written again.
+	vols := s.shardMockVolumes()
+	delete(vols[1].Store, erasure.ShardKey(TestHash, len(TestBlock), 1))
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:         "PUT",
+		uri:            "/" + TestHash,
+		requestBody:    TestBlock,
+		storageClasses: "ec",
+	})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	for _, v := range vols {
+		c.Check(v.CallCount("WriteBlock"), check.Equals, 2)
+	}
+}
+
+func (s *ErasureSuite) TestShardsOnOtherServers(c *check.C) {
+	// Server A has volumes 0-2, server B has volumes 3-5.
+	var handlerB handler
+	srvB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlerB.ServeHTTP(w, req)
+	}))
+	defer srvB.Close()
+	urlB, err := url.Parse(srvB.URL)
+	c.Assert(err, check.IsNil)
+	s.cluster.Services.Keepstore.InternalURLs = map[arvados.URL]arvados.ServiceInstance{
+		testServiceURL:     {},
+		arvados.URL(*urlB): {},
+	}
+	s.cluster.Volumes = map[string]arvados.Volume{}
+	for i := 0; i < 6; i++ {
+		host := testServiceURL
+		if i >= 3 {
+			host = arvados.URL(*urlB)
+		}
+		s.cluster.Volumes[fmt.Sprintf("zzzzz-nyw5e-%015d", i)] = arvados.Volume{
+			AccessViaHosts: map[arvados.URL]arvados.VolumeAccess{host: {}},
+			Driver:         "mock",
+			Replication:    1,
+			StorageClasses: map[string]bool{"ec": true},
+		}
+	}
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	c.Assert(handlerB.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), arvados.URL(*urlB)), check.IsNil)
+
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:         "PUT",
+		uri:            "/" + TestHash,
+		requestBody:    TestBlock,
+		storageClasses: "ec",
+	})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "ec=1")
+
+	// Each server has 2 or 3 of the 5 shards.
+	shardsOn := func(h *handler) (keys []string) {
+		for _, mnt := range h.volmgr.Mounts() {
+			for key := range mnt.Volume.(*MockVolume).Store {
+				keys = append(keys, key)
+			}
+		}
+		return
+	}
+	keysA, keysB := shardsOn(s.handler), shardsOn(&handlerB)
+	c.Check(len(keysA)+len(keysB), check.Equals, 5)
+	c.Check(len(keysA) >= 2, check.Equals, true)
+	c.Check(len(keysB) >= 2, check.Equals, true)
+
+	// Server A can reassemble the block after losing all of its
+	// own shards but one.
+	for _, mnt := range s.handler.volmgr.Mounts() {
+		for _, key := range keysA[1:] {
+			delete(mnt.Volume.(*MockVolume).Store, key)
+		}
+	}
+	resp = IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, string(TestBlock))
+
+	// Peer shard access requires the system token.
+	req, err := http.NewRequest("GET", srvB.URL+"/mounts/zzzzz-nyw5e-000000000000003/blocks/"+keysB[0], nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "Bearer "+arvadostest.ActiveTokenV2)
+	peerResp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	peerResp.Body.Close()
+	c.Check(peerResp.StatusCode, check.Equals, http.StatusUnauthorized)
+}
@@ -91,7 +91,7 @@ func (s *HandlerSuite) TestGetHandler(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	vols := s.handler.volmgr.AllWritable()
-	err := vols[0].Put(context.Background(), TestHash, TestBlock)
+	err := putWithPipe(context.Background(), TestHash, TestBlock, vols[0])
 	c.Check(err, check.IsNil)
 
 	// Create locators for testing.
@@ -104,7 +104,7 @@ func (s *HandlerSuite) TestGetHandler(c *check.C) {
 		unsignedLocator  = "/" + TestHash
 		validTimestamp   = time.Now().Add(s.cluster.Collections.BlobSigningTTL.Duration())
 		expiredTimestamp = time.Now().Add(-time.Hour)
-		signedLocator    = "/" + SignLocator(s.cluster, TestHash, knownToken, validTimestamp)
+		signedLocator    = "/" + SignLocator(s.cluster, fmt.Sprintf("%s+%d", TestHash, len(TestBlock)), knownToken, validTimestamp)
 		expiredLocator   = "/" + SignLocator(s.cluster, TestHash, knownToken, expiredTimestamp)
 	)
 
@@ -126,10 +126,11 @@ func (s *HandlerSuite) TestGetHandler(c *check.C) {
 		string(TestBlock),
 		response)
 
+	// The response size isn't known in advance, so there is no
+	// Content-Length header.
 	receivedLen := response.Header().Get("Content-Length")
-	expectedLen := fmt.Sprintf("%d", len(TestBlock))
-	if receivedLen != expectedLen {
-		c.Errorf("expected Content-Length %s, got %s", expectedLen, receivedLen)
+	if receivedLen != "" {
+		c.Errorf("expected no Content-Length, got %s", receivedLen)
 	}
 
 	// ----------------
@@ -148,10 +149,12 @@ func (s *HandlerSuite) TestGetHandler(c *check.C) {
 	ExpectBody(c,
 		"Authenticated request, signed locator", string(TestBlock), response)
 
+	// Even with a size hint, there is no Content-Length header:
+	// the hint comes from the client, and the stored block might
+	// not match it.
 	receivedLen = response.Header().Get("Content-Length")
-	expectedLen = fmt.Sprintf("%d", len(TestBlock))
-	if receivedLen != expectedLen {
-		c.Errorf("expected Content-Length %s, got %s", expectedLen, receivedLen)
+	if receivedLen != "" {
+		c.Errorf("expected no Content-Length, got %s", receivedLen)
 	}
 
 	// Authenticated request, unsigned locator
@@ -303,15 +306,13 @@ func (s *HandlerSuite) TestPutAndDeleteSkipReadonlyVolumes(c *check.C) {
 		callcount int
 	}
 	for _, e := range []expect{
-		{"zzzzz-nyw5e-000000000000000", "Get", 0},
-		{"zzzzz-nyw5e-000000000000000", "Compare", 0},
+		{"zzzzz-nyw5e-000000000000000", "ReadBlock", 0},
 		{"zzzzz-nyw5e-000000000000000", "Touch", 0},
-		{"zzzzz-nyw5e-000000000000000", "Put", 0},
+		{"zzzzz-nyw5e-000000000000000", "WriteBlock", 0},
 		{"zzzzz-nyw5e-000000000000000", "Delete", 0},
-		{"zzzzz-nyw5e-111111111111111", "Get", 0},
-		{"zzzzz-nyw5e-111111111111111", "Compare", 1},
-		{"zzzzz-nyw5e-111111111111111", "Touch", 1},
-		{"zzzzz-nyw5e-111111111111111", "Put", 1},
+		{"zzzzz-nyw5e-111111111111111", "ReadBlock", 0},
+		{"zzzzz-nyw5e-111111111111111", "Touch", 0},
+		{"zzzzz-nyw5e-111111111111111", "WriteBlock", 1},
 		{"zzzzz-nyw5e-111111111111111", "Delete", 1},
 	} {
 		if calls := s.handler.volmgr.mountMap[e.volid].Volume.(*MockVolume).CallCount(e.method); calls != e.callcount {
@@ -336,8 +337,8 @@ func (s *HandlerSuite) TestReadsOrderedByStorageClassPriority(c *check.C) {
 		priority1 int // priority of class1, thus vol1
 		priority2 int // priority of class2
 		priority3 int // priority of class3 (vol2 priority will be max(priority2, priority3))
-		get1      int // expected number of "get" ops on vol1
-		get2      int // expected number of "get" ops on vol2
+		get1      int // expected number of "read" ops on vol1
+		get2      int // expected number of "read" ops on vol2
 	}{
 		{100, 50, 50, 1, 0},   // class1 has higher priority => try vol1 first, no need to try vol2
 		{100, 100, 100, 1, 0}, // same priority, vol1 is first lexicographically => try vol1 first and succeed
@@ -363,8 +364,8 @@ func (s *HandlerSuite) TestReadsOrderedByStorageClassPriority(c *check.C) {
 				method: "GET",
 				uri:    "/" + TestHash,
 			})
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("Get"), check.Equals, trial.get1)
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-222222222222222"].Volume.(*MockVolume).CallCount("Get"), check.Equals, trial.get2)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("ReadBlock"), check.Equals, trial.get1)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-222222222222222"].Volume.(*MockVolume).CallCount("ReadBlock"), check.Equals, trial.get2)
 	}
 }
 
@@ -385,7 +386,52 @@ func (s *HandlerSuite) TestPutWithNoWritableVolumes(c *check.C) {
 			storageClasses: "class1",
 		})
 	c.Check(resp.Code, check.Equals, FullError.HTTPCode)
-	c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("Put"), check.Equals, 0)
+	c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("WriteBlock"), check.Equals, 0)
+}
+
+// A streaming write can't be retried on another volume once it has
+// consumed the request body, so PutBlock skips volumes that don't
+// have room for the block.
+func (s *HandlerSuite) TestPutSkipsVolumeWithoutRoom(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	vols := s.handler.volmgr.writables
+	c.Assert(vols, check.HasLen, 2)
+	full := vols[0].Volume.(*MockVolume)
+	full.Store["filler"] = make([]byte, full.Status().BytesFree)
+	c.Assert(full.Status().BytesFree, check.Equals, uint64(0))
+
+	resp := IssueRequest(s.handler,
+		&RequestTester{
+			method:      "PUT",
+			uri:         "/" + TestHash,
+			requestBody: TestBlock,
+		})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(full.CallCount("WriteBlock"), check.Equals, 0)
+	c.Check(vols[1].Volume.(*MockVolume).Store[TestHash], check.DeepEquals, TestBlock)
+}
+
+// An existing copy of the block is touched only if its data is
+// intact.
+func (s *HandlerSuite) TestPutDoesNotTouchCorruptBlock(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	for _, mnt := range s.handler.volmgr.writables {
+		v := mnt.Volume.(*MockVolume)
+		v.Store[TestHash] = []byte("corrupt data")
+		v.Timestamps[TestHash] = time.Now().Add(-time.Hour)
+	}
+
+	resp := IssueRequest(s.handler,
+		&RequestTester{
+			method:      "PUT",
+			uri:         "/" + TestHash,
+			requestBody: TestBlock,
+		})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	for _, mnt := range s.handler.volmgr.writables {
+		c.Check(mnt.Volume.(*MockVolume).CallCount("Touch"), check.Equals, 0)
+	}
+	c.Check(s.handler.volmgr.writables[0].Volume.(*MockVolume).Store[TestHash], check.DeepEquals, TestBlock)
 }
 
 func (s *HandlerSuite) TestConcurrentWritesToMultipleStorageClasses(c *check.C) {
@@ -407,28 +453,28 @@ func (s *HandlerSuite) TestConcurrentWritesToMultipleStorageClasses(c *check.C)
 	for _, trial := range []struct {
 		setCounter uint32 // value to stuff vm.counter, to control offset
 		classes    string // desired classes
-		put111     int    // expected number of "put" ops on 11111... after 2x put reqs
-		put121     int    // expected number of "put" ops on 12121...
-		put222     int    // expected number of "put" ops on 22222...
-		cmp111     int    // expected number of "compare" ops on 11111... after 2x put reqs
-		cmp121     int    // expected number of "compare" ops on 12121...
-		cmp222     int    // expected number of "compare" ops on 22222...
+		put111     int    // expected number of "write" ops on 11111... after 2x put reqs
+		put121     int    // expected number of "write" ops on 12121...
+		put222     int    // expected number of "write" ops on 22222...
+		cmp111     int    // expected number of "touch" ops on 11111... after 2x put reqs (only verified copies are touched)
+		cmp121     int    // expected number of "touch" ops on 12121...
+		cmp222     int    // expected number of "touch" ops on 22222...
 	}{
 		{0, "class1",
 			1, 0, 0,
-			2, 1, 0}, // first put compares on all vols with class2; second put succeeds after checking 121
+			1, 0, 0}, // first put finds no existing copies; second put succeeds after touching 111
 		{0, "class2",
 			0, 1, 0,
-			0, 2, 1}, // first put compares on all vols with class2; second put succeeds after checking 121
+			0, 1, 0}, // first put finds no existing copies; second put succeeds after touching 121
 		{0, "class1,class2",
 			1, 1, 0,
-			2, 2, 1}, // first put compares on all vols; second put succeeds after checking 111 and 121
+			1, 1, 0}, // first put finds no existing copies; second put succeeds after touching 111 and 121
 		{1, "class1,class2",
 			0, 1, 0, // vm.counter offset is 1 so the first volume attempted is 121
-			2, 2, 1}, // first put compares on all vols; second put succeeds after checking 111 and 121
+			0, 1, 0}, // first put finds no existing copies; second put succeeds after touching 121
 		{0, "class1,class2,class404",
 			1, 1, 0,
-			2, 2, 1}, // first put compares on all vols; second put doesn't compare on 222 because it already satisfied class2 on 121
+			1, 1, 0}, // first put finds no existing copies; second put doesn't look at 222 because 121 already satisfied class2
 	} {
 		c.Logf("%+v", trial)
 		s.cluster.StorageClasses = map[string]arvados.StorageClassConfig{
@@ -447,12 +493,12 @@ func (s *HandlerSuite) TestConcurrentWritesToMultipleStorageClasses(c *check.C)
 					storageClasses: trial.classes,
 				})
 		}
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("Put"), check.Equals, trial.put111)
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-121212121212121"].Volume.(*MockVolume).CallCount("Put"), check.Equals, trial.put121)
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-222222222222222"].Volume.(*MockVolume).CallCount("Put"), check.Equals, trial.put222)
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("Compare"), check.Equals, trial.cmp111)
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-121212121212121"].Volume.(*MockVolume).CallCount("Compare"), check.Equals, trial.cmp121)
-		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-222222222222222"].Volume.(*MockVolume).CallCount("Compare"), check.Equals, trial.cmp222)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("WriteBlock"), check.Equals, trial.put111)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-121212121212121"].Volume.(*MockVolume).CallCount("WriteBlock"), check.Equals, trial.put121)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-222222222222222"].Volume.(*MockVolume).CallCount("WriteBlock"), check.Equals, trial.put222)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-111111111111111"].Volume.(*MockVolume).CallCount("Touch"), check.Equals, trial.cmp111)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-121212121212121"].Volume.(*MockVolume).CallCount("Touch"), check.Equals, trial.cmp121)
+		c.Check(s.handler.volmgr.mountMap["zzzzz-nyw5e-222222222222222"].Volume.(*MockVolume).CallCount("Touch"), check.Equals, trial.cmp222)
 	}
 }
 
@@ -460,7 +506,7 @@ func (s *HandlerSuite) TestConcurrentWritesToMultipleStorageClasses(c *check.C)
 func (s *HandlerSuite) TestTouchHandler(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 	vols := s.handler.volmgr.AllWritable()
-	vols[0].Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, vols[0])
 	vols[0].Volume.(*MockVolume).TouchWithDate(TestHash, time.Now().Add(-time.Hour))
 	afterPut := time.Now()
 	t, err := vols[0].Mtime(TestHash)
@@ -524,10 +570,10 @@ func (s *HandlerSuite) TestIndexHandler(c *check.C) {
 	// Include multiple blocks on different volumes, and
 	// some metadata files (which should be omitted from index listings)
 	vols := s.handler.volmgr.AllWritable()
-	vols[0].Put(context.Background(), TestHash, TestBlock)
-	vols[1].Put(context.Background(), TestHash2, TestBlock2)
-	vols[0].Put(context.Background(), TestHash+".meta", []byte("metadata"))
-	vols[1].Put(context.Background(), TestHash2+".meta", []byte("metadata"))
+	putWithPipe(context.Background(), TestHash, TestBlock, vols[0])
+	putWithPipe(context.Background(), TestHash2, TestBlock2, vols[1])
+	putWithPipe(context.Background(), TestHash+".meta", []byte("metadata"), vols[0])
+	putWithPipe(context.Background(), TestHash2+".meta", []byte("metadata"), vols[1])
 
 	s.cluster.SystemRootToken = "DATA MANAGER TOKEN"
 
@@ -699,7 +745,7 @@ func (s *HandlerSuite) TestDeleteHandler(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	vols := s.handler.volmgr.AllWritable()
-	vols[0].Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, vols[0])
 
 	// Explicitly set the BlobSigningTTL to 0 for these
 	// tests, to ensure the MockVolume deletes the blocks
@@ -786,7 +832,7 @@ func (s *HandlerSuite) TestDeleteHandler(c *check.C) {
 	}
 	// Confirm the block has been deleted
 	buf := make([]byte, BlockSize)
-	_, err := vols[0].Get(context.Background(), TestHash, buf)
+	_, err := getWithPipe(context.Background(), TestHash, buf, vols[0])
 	var blockDeleted = os.IsNotExist(err)
 	if !blockDeleted {
 		c.Error("superuserExistingBlockReq: block not deleted")
@@ -794,7 +840,7 @@ func (s *HandlerSuite) TestDeleteHandler(c *check.C) {
 
 	// A DELETE request on a block newer than BlobSigningTTL
 	// should return success but leave the block on the volume.
-	vols[0].Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, vols[0])
 	s.cluster.Collections.BlobSigningTTL = arvados.Duration(time.Hour)
 
 	response = IssueRequest(s.handler, superuserExistingBlockReq)
@@ -810,7 +856,7 @@ func (s *HandlerSuite) TestDeleteHandler(c *check.C) {
 			expectedDc, responseDc)
 	}
 	// Confirm the block has NOT been deleted.
-	_, err = vols[0].Get(context.Background(), TestHash, buf)
+	_, err = getWithPipe(context.Background(), TestHash, buf, vols[0])
 	if err != nil {
 		c.Errorf("testing delete on new block: %s\n", err)
 	}
@@ -1090,14 +1136,16 @@ func ExpectBody(
 	}
 }
 
-// See #7121
-func (s *HandlerSuite) TestPutNeedsOnlyOneBuffer(c *check.C) {
+// See #7121. PUT streams data to the volume, so it should not need
+// a buffer from the pool at all.
+func (s *HandlerSuite) TestPutNeedsNoBuffer(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	defer func(orig *bufferPool) {
 		bufs = orig
 	}(bufs)
 	bufs = newBufferPool(ctxlog.TestLogger(c), 1, BlockSize)
+	defer bufs.Put(bufs.Get(BlockSize))
 
 	ok := make(chan struct{})
 	go func() {
@@ -1109,7 +1157,7 @@ func (s *HandlerSuite) TestPutNeedsOnlyOneBuffer(c *check.C) {
 					requestBody: TestBlock,
 				})
 			ExpectStatusCode(c,
-				"TestPutNeedsOnlyOneBuffer", http.StatusOK, response)
+				"TestPutNeedsNoBuffer", http.StatusOK, response)
 		}
 		ok <- struct{}{}
 	}()
@@ -1117,7 +1165,7 @@ func (s *HandlerSuite) TestPutNeedsOnlyOneBuffer(c *check.C) {
 	select {
 	case <-ok:
 	case <-time.After(time.Second):
-		c.Fatal("PUT deadlocks with MaxKeepBlobBuffers==1")
+		c.Fatal("PUT deadlocks with no buffers available")
 	}
 }
 
@@ -1164,7 +1212,7 @@ func (s *HandlerSuite) TestGetHandlerClientDisconnect(c *check.C) {
 	bufs = newBufferPool(ctxlog.TestLogger(c), 1, BlockSize)
 	defer bufs.Put(bufs.Get(BlockSize))
 
-	err := s.handler.volmgr.AllWritable()[0].Put(context.Background(), TestHash, TestBlock)
+	err := putWithPipe(context.Background(), TestHash, TestBlock, s.handler.volmgr.AllWritable()[0])
 	c.Assert(err, check.IsNil)
 
 	resp := httptest.NewRecorder()
@@ -1185,7 +1233,7 @@ func (s *HandlerSuite) TestGetHandlerClientDisconnect(c *check.C) {
 
 	ExpectStatusCode(c, "client disconnect", http.StatusServiceUnavailable, resp)
 	for i, v := range s.handler.volmgr.AllWritable() {
-		if calls := v.Volume.(*MockVolume).called["GET"]; calls != 0 {
+		if calls := v.Volume.(*MockVolume).called["ReadBlock"]; calls != 0 {
 			c.Errorf("volume %d got %d calls, expected 0", i, calls)
 		}
 	}
@@ -1197,7 +1245,7 @@ func (s *HandlerSuite) TestGetHandlerNoBufferLeak(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	vols := s.handler.volmgr.AllWritable()
-	if err := vols[0].Put(context.Background(), TestHash, TestBlock); err != nil {
+	if err := putWithPipe(context.Background(), TestHash, TestBlock, vols[0]); err != nil {
 		c.Error(err)
 	}
 
@@ -1304,7 +1352,7 @@ func (s *HandlerSuite) TestUntrashHandler(c *check.C) {
 
 	// Set up Keep volumes
 	vols := s.handler.volmgr.AllWritable()
-	vols[0].Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, vols[0])
 
 	s.cluster.SystemRootToken = "DATA MANAGER TOKEN"
 
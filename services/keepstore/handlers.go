@@ -5,12 +5,14 @@
 package keepstore
 
 import (
+	"bytes"
 	"container/list"
 	"context"
-	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"regexp"
@@ -18,7 +20,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/cmd"
@@ -81,6 +82,12 @@ func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *promethe
 	rtr.HandleFunc(`/mounts`, rtr.MountsHandler).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks`, rtr.handleIndex).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks/`, rtr.handleIndex).Methods("GET")
+	rtr.HandleFunc(`/mounts/{uuid}/corrupt`, rtr.handleCorrupt).Methods("GET")
+	rtr.HandleFunc(`/mounts/{uuid}/changes`, rtr.handleChanges).Methods("GET")
+	// Read, write, or touch an erasure-coded shard on the given
+	// mount. Privileged client (i.e., another keepstore server)
+	// only.
+	rtr.HandleFunc(`/mounts/{uuid}/blocks/{key:[0-9a-f]{32}\.[0-9]+\.[0-9]+}`, rtr.handleShard).Methods("GET", "PUT", "TOUCH")
 
 	// Replace the current pull queue.
 	rtr.HandleFunc(`/pull`, rtr.handlePull).Methods("PUT")
@@ -127,22 +134,35 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// TODO: Probe volumes to check whether the block _might_
-	// exist. Some volumes/types could support a quick existence
-	// check without causing other operations to suffer. If all
-	// volumes support that, and assure us the block definitely
-	// isn't here, we can return 404 now instead of waiting for a
-	// buffer.
-
-	buf, err := getBufferWithContext(req.Context(), bufs, BlockSize)
-	if err != nil {
-		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
-		return
+	// The size hint is needed to find erasure-coded shards. It
+	// comes from the client, though, and the stored block isn't
+	// known to have the same size until all of it has been sent,
+	// so it isn't used for a Content-Length header: the response
+	// is sent with chunked encoding.
+	size := -1
+	if hints := mux.Vars(req)["hints"]; hints != "" {
+		if n, err := strconv.Atoi(strings.SplitN(hints, "+", 2)[0]); err == nil && n >= 0 && n <= BlockSize {
+			size = n
+		}
 	}
-	defer bufs.Put(buf)
+	resp.Header().Set("Content-Type", "application/octet-stream")
 
-	size, err := GetBlock(req.Context(), rtr.volmgr, mux.Vars(req)["hash"], buf, resp)
-	if err != nil {
+	hash := mux.Vars(req)["hash"]
+	err := GetBlock(req.Context(), rtr.volmgr, hash, resp)
+	if err == NotFoundError && size >= 0 {
+		// Shards are stored under a key that includes the
+		// block size, so we can only look for them if the
+		// locator has a size hint.
+		err = getShardedBlock(req.Context(), rtr.volmgr, hash, size, resp)
+	}
+	if err == errPartialResponse {
+		// We have already sent some data, so we can't send
+		// an error status. The best we can do is abort the
+		// response so the client doesn't mistake the
+		// truncated data for a complete block.
+		panic(http.ErrAbortHandler)
+	} else if err != nil {
+		resp.Header().Del("Content-Type")
 		code := http.StatusInternalServerError
 		if err, ok := err.(*KeepError); ok {
 			code = err.HTTPCode
@@ -150,10 +170,6 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, err.Error(), code)
 		return
 	}
-
-	resp.Header().Set("Content-Length", strconv.Itoa(size))
-	resp.Header().Set("Content-Type", "application/octet-stream")
-	resp.Write(buf[:size])
 }
 
 // Get a buffer from the pool -- but give up and return a non-nil
@@ -205,6 +221,49 @@ func (rtr *router) handleTOUCH(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// handleShard reads, writes, or touches an erasure-coded shard on a
+// specific mount, on behalf of another keepstore server that does not
+// have the mount.
+func (rtr *router) handleShard(resp http.ResponseWriter, req *http.Request) {
+	if !rtr.isSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	key := mux.Vars(req)["key"]
+	mnt := rtr.volmgr.Lookup(mux.Vars(req)["uuid"], req.Method != "GET")
+	if mnt == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+	var err error
+	switch req.Method {
+	case "GET":
+		var n uint64
+		err = mnt.ReadBlock(req.Context(), key, NewCountingWriter(resp, func(c uint64) { n += c }))
+		if err != nil && n > 0 {
+			panic(http.ErrAbortHandler)
+		}
+	case "PUT":
+		if req.ContentLength < 0 {
+			http.Error(resp, SizeRequiredError.Error(), SizeRequiredError.HTTPCode)
+			return
+		} else if req.ContentLength > BlockSize {
+			http.Error(resp, TooLongError.Error(), TooLongError.HTTPCode)
+			return
+		}
+		err = mnt.WriteBlock(req.Context(), key, req.Body, int(req.ContentLength))
+	case "TOUCH":
+		err = mnt.Touch(key)
+	}
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		http.Error(resp, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 	hash := mux.Vars(req)["hash"]
 
@@ -242,21 +301,7 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	buf, err := getBufferWithContext(req.Context(), bufs, int(req.ContentLength))
-	if err != nil {
-		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-
-	_, err = io.ReadFull(req.Body, buf)
-	if err != nil {
-		http.Error(resp, err.Error(), 500)
-		bufs.Put(buf)
-		return
-	}
-
-	result, err := PutBlock(req.Context(), rtr.volmgr, buf, hash, wantStorageClasses)
-	bufs.Put(buf)
+	result, err := PutBlock(req.Context(), rtr.volmgr, req.Body, int(req.ContentLength), hash, wantStorageClasses)
 
 	if err != nil {
 		code := http.StatusInternalServerError
@@ -325,6 +370,99 @@ func (rtr *router) handleIndex(resp http.ResponseWriter, req *http.Request) {
 	resp.Write([]byte{'\n'})
 }
 
+// handleCorrupt responds with a list of blocks that have been found
+// to be corrupt on the given mount, in the same format as
+// handleIndex.
+func (rtr *router) handleCorrupt(resp http.ResponseWriter, req *http.Request) {
+	if !rtr.isSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	mnt := rtr.volmgr.Lookup(mux.Vars(req)["uuid"], false)
+	if mnt == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+	if err := mnt.corrupt.writeIndex(resp); err != nil {
+		return
+	}
+	resp.Write([]byte{'\n'})
+}
+
+// handleChanges responds to "/mounts/{uuid}/changes?since=T"
+// requests with index entries for the blocks that have been written,
+// touched, trashed, or untrashed on the given mount since T
+// (nanoseconds since the Unix epoch). Blocks that no longer exist on
+// the mount are listed with a zero timestamp and no size.
+//
+// If the mount's change journal does not go back as far as T (e.g.,
+// because keepstore has restarted since then), the response status
+// is 410, and the caller should retrieve the full index instead.
+func (rtr *router) handleChanges(resp http.ResponseWriter, req *http.Request) {
+	if !rtr.isSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	mnt := rtr.volmgr.Lookup(mux.Vars(req)["uuid"], false)
+	if mnt == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+	since, err := strconv.ParseInt(req.FormValue("since"), 10, 64)
+	if err != nil {
+		http.Error(resp, "invalid since parameter", http.StatusBadRequest)
+		return
+	}
+	changed, ok := mnt.changes.since(time.Unix(0, since))
+	if !ok {
+		http.Error(resp, "change journal does not go back far enough", http.StatusGone)
+		return
+	}
+	for loc, size := range changed {
+		if err := writeChangedIndexEntry(resp, mnt, loc, size); err != nil {
+			// As in handleIndex, the missing trailing
+			// newline tells the client the response is
+			// incomplete.
+			ctxlog.FromContext(req.Context()).WithError(err).Errorf("truncating changes response after error from volume %s", mnt)
+			return
+		}
+	}
+	resp.Write([]byte{'\n'})
+}
+
+// writeChangedIndexEntry writes the current index entry for the given
+// block, or a zero-timestamp entry if the block no longer exists.
+func writeChangedIndexEntry(w io.Writer, mnt *VolumeMount, loc string, size int) error {
+	mtime, err := mnt.Mtime(loc)
+	if os.IsNotExist(err) {
+		_, err = fmt.Fprintf(w, "%s 0\n", loc)
+		return err
+	} else if err != nil {
+		return err
+	}
+	if size >= 0 {
+		_, err = fmt.Fprintf(w, "%s+%d %d\n", loc, size, mtime.UnixNano())
+		return err
+	}
+	// The size is unknown (the block was touched or untrashed,
+	// but not written, since the journal started), so get it
+	// from the volume's index.
+	var buf bytes.Buffer
+	err = mnt.IndexTo(loc, &buf)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, loc+"+") {
+			_, err = fmt.Fprintln(w, line)
+			return err
+		}
+	}
+	// Deleted since we called Mtime.
+	_, err = fmt.Fprintf(w, "%s 0\n", loc)
+	return err
+}
+
 // MountsHandler responds to "GET /mounts" requests.
 func (rtr *router) MountsHandler(resp http.ResponseWriter, req *http.Request) {
 	err := json.NewEncoder(resp).Encode(rtr.volmgr.Mounts())
@@ -667,58 +805,72 @@ func (rtr *router) handleUntrash(resp http.ResponseWriter, req *http.Request) {
 // block is stored on, so it should be responsible for figuring out
 // which volume to check for fetching blocks, storing blocks, etc.
 
-// GetBlock fetches the block identified by "hash" into the provided
-// buf, and returns the data size.
+// errPartialResponse is returned by GetBlock if an error occurs
+// after some of the block data has already been written to the
+// response.
+var errPartialResponse = errors.New("error after sending partial response")
+
+// GetBlock finds the block identified by "hash" and writes its
+// content to resp, verifying the MD5 hash as the data flows through.
+// Block data is streamed from the volume to the client: no buffer
+// is needed to hold the whole block.
 //
 // If the block cannot be found on any volume, returns NotFoundError.
 //
-// If the block found does not have the correct MD5 hash, returns
-// DiskHashError.
+// If an error occurs before any data is written to resp, GetBlock
+// tries the next volume. If an error occurs (or the data turns out
+// not to match the hash) after some data has been written, there is
+// no way to recover, and GetBlock returns errPartialResponse.
 //
-func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte, resp http.ResponseWriter) (int, error) {
+func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, resp http.ResponseWriter) error {
 	log := ctxlog.FromContext(ctx)
 
 	// Attempt to read the requested hash from a keep volume.
 	errorToCaller := NotFoundError
 
 	for _, vol := range volmgr.AllReadable() {
-		size, err := vol.Get(ctx, hash, buf)
-		select {
-		case <-ctx.Done():
-			return 0, ErrClientDisconnect
-		default:
+		if ctx.Err() != nil {
+			return ErrClientDisconnect
 		}
-		if err != nil {
-			// IsNotExist is an expected error and may be
-			// ignored. All other errors are logged. In
-			// any case we continue trying to read other
-			// volumes. If all volumes report IsNotExist,
-			// we return a NotFoundError.
-			if !os.IsNotExist(err) {
-				log.WithError(err).Errorf("Get(%s) failed on %s", hash, vol)
-			}
-			// If some volume returns a transient error, return it to the caller
-			// instead of "Not found" so it can retry.
-			if err == VolumeBusyError {
-				errorToCaller = err.(*KeepError)
+		hcw := newHashCheckWriter(resp, hash)
+		err := vol.ReadBlock(ctx, hash, hcw)
+		if err == nil {
+			err = hcw.Check()
+		}
+		if err == nil {
+			if errorToCaller == DiskHashError {
+				log.Warnf("after checksum mismatch for block %s on a different volume, a good copy was found on volume %s and returned", hash, vol)
 			}
-			continue
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ErrClientDisconnect
 		}
-		// Check the file checksum.
-		filehash := fmt.Sprintf("%x", md5.Sum(buf[:size]))
-		if filehash != hash {
+		if err == DiskHashError {
 			// TODO: Try harder to tell a sysadmin about
 			// this.
-			log.Errorf("checksum mismatch for block %s (actual %s), size %d on %s", hash, filehash, size, vol)
+			log.Errorf("checksum mismatch for block %s, size %d on %s", hash, hcw.BytesWritten(), vol)
 			errorToCaller = DiskHashError
-			continue
+		} else if !os.IsNotExist(err) {
+			// IsNotExist is an expected error and may be
+			// ignored. All other errors are logged.
+			log.WithError(err).Errorf("ReadBlock(%s) failed on %s", hash, vol)
 		}
-		if errorToCaller == DiskHashError {
-			log.Warn("after checksum mismatch for block %s on a different volume, a good copy was found on volume %s and returned", hash, vol)
+		if hcw.BytesWritten() > 0 {
+			return errPartialResponse
+		}
+		// Nothing has been sent yet, so we can continue
+		// trying to read other volumes. If all volumes report
+		// IsNotExist, we return a NotFoundError.
+		//
+		// If some volume returns a transient error, return it
+		// to the caller instead of "Not found" so it can
+		// retry.
+		if err == VolumeBusyError {
+			errorToCaller = err.(*KeepError)
 		}
-		return size, nil
 	}
-	return 0, errorToCaller
+	return errorToCaller
 }
 
 type putProgress struct {
@@ -777,6 +929,15 @@ func (pr *putProgress) Sub(mnt *VolumeMount) {
 	}
 }
 
+// AddShards records that a complete set of erasure-coded shards has
+// been stored in the given storage class. A complete shard set counts
+// as one replica.
+func (pr *putProgress) AddShards(class string) {
+	pr.totalReplication++
+	pr.classDone[class]++
+	delete(pr.classTodo, class)
+}
+
 func (pr *putProgress) Done() bool {
 	return len(pr.classTodo) == 0 && pr.totalReplication > 0
 }
@@ -833,22 +994,35 @@ func newPutProgress(classes []string) putProgress {
 	return pr
 }
 
-// PutBlock stores the given block on one or more volumes.
+// PutBlock reads a block of the given size from rdr and stores it on
+// one or more volumes.
 //
-// The MD5 checksum of the block must match the given hash.
+// The MD5 checksum of the data must match the given hash. The data
+// is checked as it flows through to the first volume, so no buffer
+// is needed to hold the whole block. If the checksum does not match,
+// the write is abandoned.
 //
-// The block is written to each writable volume (ordered by priority
-// and then UUID, see volume.go) until at least one replica has been
-// stored in each of the requested storage classes.
+// If any of the requested storage classes are erasure-coded, the
+// block is read into a buffer, and its data and parity shards are
+// written to distinct volumes in each erasure-coded class (see
+// erasure.go). If that fails, full replicas are stored instead.
+//
+// The block is written to the first suitable writable volume
+// (ordered by priority and then UUID, see volume.go). A write that
+// fails after consuming data from rdr cannot be retried on another
+// volume, so volumes that report less free space than the block size
+// are skipped. If more
+// replicas are needed to satisfy the requested storage classes,
+// they are copied from the first volume to other writable volumes
+// until at least one replica has been stored in each of the
+// requested storage classes.
 //
 // The returned error, if any, is a KeepError with one of the
 // following codes:
 //
-// 500 Collision
-//        A different block with the same hash already exists on this
-//        Keep server.
 // 422 MD5Fail
-//        The MD5 hash of the BLOCK does not match the argument HASH.
+//        The MD5 hash of the data read from rdr does not match the
+//        argument HASH.
 // 503 Full
 //        There was not enough space left in any Keep volume to store
 //        the object.
@@ -856,27 +1030,76 @@ func newPutProgress(classes []string) putProgress {
 //        The object could not be stored for some other reason (e.g.
 //        all writes failed). The text of the error message should
 //        provide as much detail as possible.
-func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash string, wantStorageClasses []string) (putProgress, error) {
+func PutBlock(ctx context.Context, volmgr *RRVolumeManager, rdr io.Reader, size int, hash string, wantStorageClasses []string) (putProgress, error) {
 	log := ctxlog.FromContext(ctx)
 
-	// Check that BLOCK's checksum matches HASH.
-	blockhash := fmt.Sprintf("%x", md5.Sum(block))
-	if blockhash != hash {
-		log.Printf("%s: MD5 checksum %s did not match request", hash, blockhash)
+	if size == 0 && hash != emptyBlockHash {
+		// A volume might not read anything from a
+		// zero-length reader, so we need to check this case
+		// up front.
+		log.Printf("%s: MD5 checksum did not match request", hash)
 		return putProgress{}, RequestHashError
 	}
+	hcr := newHashCheckReader(rdr, hash, size, RequestHashError)
 
 	result := newPutProgress(wantStorageClasses)
 
 	// If we already have this data, it's intact on disk, and we
-	// can update its timestamp, return success. If we have
-	// different data with the same hash, return failure.
-	if err := CompareAndTouch(ctx, volmgr, hash, block, &result); err != nil || result.Done() {
-		return result, err
-	}
+	// can update its timestamp, we don't need to write it again.
+	TouchExisting(ctx, volmgr, hash, size, &result)
 	if ctx.Err() != nil {
 		return result, ErrClientDisconnect
 	}
+	if result.Done() {
+		// Consume the data anyway, to confirm the caller
+		// sent what they said they were sending.
+		if _, err := io.Copy(ioutil.Discard, hcr); err == RequestHashError {
+			log.Printf("%s: MD5 checksum did not match request", hash)
+			return putProgress{}, RequestHashError
+		} else if err != nil {
+			return putProgress{}, err
+		}
+		return result, nil
+	}
+
+	// Erasure-coded storage classes need the whole block in
+	// memory in order to compute parity shards.
+	var ecClasses []string
+	for _, class := range volmgr.erasureCodedClasses() {
+		if result.classTodo[class] {
+			ecClasses = append(ecClasses, class)
+		}
+	}
+	if len(ecClasses) > 0 {
+		buf, err := getBufferWithContext(ctx, bufs, size)
+		if err != nil {
+			return result, err
+		}
+		defer bufs.Put(buf)
+		buf = buf[:size]
+		if _, err := io.ReadFull(hcr, buf); err == RequestHashError {
+			log.Printf("%s: MD5 checksum did not match request", hash)
+			return putProgress{}, RequestHashError
+		} else if err != nil {
+			return putProgress{}, err
+		}
+		for _, class := range ecClasses {
+			err := putShards(ctx, volmgr, volmgr.codecs[class], class, hash, buf)
+			if ctx.Err() != nil {
+				return result, ErrClientDisconnect
+			} else if err != nil {
+				// Fall back to storing full replicas
+				// on the volumes in this class.
+				log.WithError(err).Errorf("%s: failed to store erasure-coded shards in storage class %q", hash, class)
+				continue
+			}
+			result.AddShards(class)
+		}
+		if result.Done() {
+			return result, nil
+		}
+		hcr = newHashCheckReader(bytes.NewReader(buf), hash, size, RequestHashError)
+	}
 
 	writables := volmgr.NextWritable()
 	if len(writables) == 0 {
@@ -884,14 +1107,71 @@ func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash s
 		return result, FullError
 	}
 
+	// Write the data to the first suitable volume. We can only
+	// retry on a different volume if the failed attempt didn't
+	// consume any data from rdr.
+	var src *VolumeMount
+	allFull := true
+	for _, mnt := range writables {
+		if !result.Want(mnt) {
+			continue
+		}
+		if !hasRoom(mnt, size) {
+			log.Debugf("PutBlock: skipping %s, not enough free space", mnt.UUID)
+			continue
+		}
+		log.Debugf("PutBlock: start write to %s", mnt.UUID)
+		err := mnt.WriteBlock(ctx, hash, hcr, size)
+		if ctx.Err() != nil {
+			return result, ErrClientDisconnect
+		} else if hcr.Err() == RequestHashError {
+			log.Printf("%s: MD5 checksum did not match request", hash)
+			return putProgress{}, RequestHashError
+		} else if err == nil {
+			log.Debugf("PutBlock: write to %s succeeded", mnt.UUID)
+			result.Add(mnt)
+			src = mnt
+			break
+		}
+		log.Debugf("PutBlock: write to %s failed", mnt.UUID)
+		if err != FullError {
+			// The volume is not full but the write did
+			// not succeed. Report the error and continue
+			// trying.
+			allFull = false
+			log.WithError(err).Errorf("%s: WriteBlock(%s) failed", mnt.Volume, hash)
+		}
+		if hcr.BytesRead() > 0 {
+			if hcr.Err() != nil {
+				// Error reading from client.
+				return putProgress{}, hcr.Err()
+			}
+			break
+		}
+	}
+	if src == nil {
+		if result.totalReplication > 0 {
+			// Some, but not all, of the storage classes
+			// were satisfied by existing replicas. This
+			// qualifies as success.
+			return result, nil
+		} else if allFull {
+			log.Error("all volumes with qualifying storage classes are full")
+			return putProgress{}, FullError
+		} else {
+			// Already logged the non-full errors.
+			return putProgress{}, GenericError
+		}
+	}
+
+	// Copy the block from src to other volumes as needed to
+	// satisfy the requested storage classes.
 	var wg sync.WaitGroup
 	var mtx sync.Mutex
 	cond := sync.Cond{L: &mtx}
 	// pending predicts what result will be if all pending writes
 	// succeed.
 	pending := result.Copy()
-	var allFull atomic.Value
-	allFull.Store(true)
 
 	// We hold the lock for the duration of the "each volume" loop
 	// below, except when it is released during cond.Wait().
@@ -910,27 +1190,23 @@ func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash s
 		pending.Add(mnt)
 		wg.Add(1)
 		go func() {
-			log.Debugf("PutBlock: start write to %s", mnt.UUID)
+			log.Debugf("PutBlock: start copy from %s to %s", src.UUID, mnt.UUID)
 			defer wg.Done()
-			err := mnt.Put(ctx, hash, block)
+			err := copyBlock(ctx, src, mnt, hash, size)
 
 			mtx.Lock()
 			if err != nil {
-				log.Debugf("PutBlock: write to %s failed", mnt.UUID)
+				log.Debugf("PutBlock: copy to %s failed", mnt.UUID)
 				pending.Sub(mnt)
 			} else {
-				log.Debugf("PutBlock: write to %s succeeded", mnt.UUID)
+				log.Debugf("PutBlock: copy to %s succeeded", mnt.UUID)
 				result.Add(mnt)
 			}
 			cond.Broadcast()
 			mtx.Unlock()
 
 			if err != nil && err != FullError && ctx.Err() == nil {
-				// The volume is not full but the
-				// write did not succeed.  Report the
-				// error and continue trying.
-				allFull.Store(false)
-				log.WithError(err).Errorf("%s: Put(%s) failed", mnt.Volume, hash)
+				log.WithError(err).Errorf("%s: copy(%s) from %s failed", mnt.Volume, hash, src.Volume)
 			}
 		}()
 	}
@@ -939,67 +1215,82 @@ func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash s
 	if ctx.Err() != nil {
 		return result, ErrClientDisconnect
 	}
-	if result.Done() {
-		return result, nil
-	}
+	// Even if some of the storage classes were not satisfied,
+	// the first write succeeded. This qualifies as success.
+	return result, nil
+}
 
-	if result.totalReplication > 0 {
-		// Some, but not all, of the storage classes were
-		// satisfied. This qualifies as success.
-		return result, nil
-	} else if allFull.Load().(bool) {
-		log.Error("all volumes with qualifying storage classes are full")
-		return putProgress{}, FullError
-	} else {
-		// Already logged the non-full errors.
-		return putProgress{}, GenericError
-	}
+// hasRoom returns false if the given mount's volume reports less than
+// size bytes of free space. Volumes that don't report their free space
+// are assumed to have room.
+func hasRoom(mnt *VolumeMount, size int) bool {
+	st := mnt.Status()
+	return st == nil || st.BytesFree >= uint64(size)
 }
 
-// CompareAndTouch looks for volumes where the given content already
-// exists and its modification time can be updated (i.e., it is
-// protected from garbage collection), and updates result accordingly.
-// It returns when the result is Done() or all volumes have been
-// checked.
-func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte, result *putProgress) error {
+// TouchExisting looks for volumes where the given block already
+// exists, is intact, and its modification time can be updated (i.e.,
+// it is protected from garbage collection), and updates result
+// accordingly. Existing shard sets in erasure-coded storage classes
+// are touched in the same way. It returns when the result is Done()
+// or all volumes have been checked.
+func TouchExisting(ctx context.Context, volmgr *RRVolumeManager, hash string, size int, result *putProgress) {
 	log := ctxlog.FromContext(ctx)
+	for _, class := range volmgr.erasureCodedClasses() {
+		if !result.classTodo[class] {
+			continue
+		}
+		if touchShards(ctx, volmgr, class, hash, size) {
+			result.AddShards(class)
+			if result.Done() {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
 	for _, mnt := range volmgr.AllWritable() {
 		if !result.Want(mnt) {
 			continue
 		}
-		err := mnt.Compare(ctx, hash, buf)
-		if ctx.Err() != nil {
-			return nil
-		} else if err == CollisionError {
-			// Stop if we have a block with same hash but
-			// different content. (It will be impossible
-			// to tell which one is wanted if we have
-			// both, so there's no point writing it even
-			// on a different volume.)
-			log.Errorf("collision in Compare(%s) on volume %s", hash, mnt.Volume)
-			return CollisionError
-		} else if os.IsNotExist(err) {
+		_, err := mnt.Mtime(hash)
+		if os.IsNotExist(err) {
 			// Block does not exist. This is the only
 			// "normal" error: we don't log anything.
 			continue
+		}
+		// Verify the existing data before touching it, so a
+		// corrupt copy isn't protected from garbage
+		// collection.
+		err = checkBlockHash(ctx, mnt, hash)
+		if ctx.Err() != nil {
+			return
 		} else if err != nil {
-			// Couldn't open file, data is corrupt on
+			// Couldn't read the data, data is corrupt on
 			// disk, etc.: log this abnormal condition,
 			// and try the next volume.
-			log.WithError(err).Warnf("error in Compare(%s) on volume %s", hash, mnt.Volume)
+			log.WithError(err).Warnf("error verifying existing block %s on volume %s", hash, mnt.Volume)
 			continue
 		}
-		if err := mnt.Touch(hash); err != nil {
+		err = mnt.Touch(hash)
+		if ctx.Err() != nil {
+			return
+		} else if os.IsNotExist(err) {
+			// Deleted since we verified it.
+			continue
+		} else if err != nil {
 			log.WithError(err).Errorf("error in Touch(%s) on volume %s", hash, mnt.Volume)
 			continue
 		}
-		// Compare and Touch both worked --> done.
+		// Touch doesn't know the size, but we do.
+		mnt.changes.record(hash, size)
+		// Verify and touch both worked --> done.
 		result.Add(mnt)
 		if result.Done() {
-			return nil
+			return
 		}
 	}
-	return nil
 }
 
 var validLocatorRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
@@ -0,0 +1,180 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// emptyBlockHash is the MD5 digest of a zero-length block.
+const emptyBlockHash = "d41d8cd98f00b204e9800998ecf8427e"
+
+// hashCheckReader passes data through from an underlying reader,
+// computing the MD5 digest as it goes. When the expected number of
+// bytes have been read, it compares the digest with the expected
+// hash, and returns mismatchErr (instead of io.EOF or nil) if they
+// differ.
+//
+// When a mismatch is detected, the last chunk of data is withheld
+// from the consumer. This ensures a consumer that stops reading as
+// soon as it has the expected number of bytes (like an HTTP client
+// sending a request body with a known Content-Length) never sends a
+// complete -- but wrong -- block to a backend.
+type hashCheckReader struct {
+	r           io.Reader
+	hash        hash.Hash
+	expectHash  string
+	expectSize  int
+	mismatchErr error
+	n           int
+	err         error
+}
+
+func newHashCheckReader(r io.Reader, expectHash string, expectSize int, mismatchErr error) *hashCheckReader {
+	return &hashCheckReader{
+		r:           r,
+		hash:        md5.New(),
+		expectHash:  expectHash,
+		expectSize:  expectSize,
+		mismatchErr: mismatchErr,
+	}
+}
+
+func (hcr *hashCheckReader) Read(p []byte) (int, error) {
+	if hcr.err != nil {
+		return 0, hcr.err
+	}
+	if len(p) > hcr.expectSize-hcr.n+1 {
+		// Read at most one byte past the expected end, so
+		// we can detect an oversized body without
+		// consuming more than necessary.
+		p = p[:hcr.expectSize-hcr.n+1]
+	}
+	n, err := hcr.r.Read(p)
+	hcr.hash.Write(p[:n])
+	hcr.n += n
+	switch {
+	case hcr.n > hcr.expectSize:
+		hcr.err = hcr.mismatchErr
+		return 0, hcr.err
+	case hcr.n == hcr.expectSize && (err == nil || err == io.EOF):
+		if fmt.Sprintf("%x", hcr.hash.Sum(nil)) != hcr.expectHash {
+			hcr.err = hcr.mismatchErr
+			return 0, hcr.err
+		}
+		// Return EOF on the next call, per io.Reader
+		// convention.
+		hcr.err = io.EOF
+		if n > 0 {
+			return n, nil
+		}
+		return 0, io.EOF
+	case err == io.EOF:
+		err = io.ErrUnexpectedEOF
+	}
+	hcr.err = err
+	return n, err
+}
+
+// Err returns the error (if any) that has been returned to the
+// reader's consumer, other than io.EOF.
+func (hcr *hashCheckReader) Err() error {
+	if hcr.err == io.EOF {
+		return nil
+	}
+	return hcr.err
+}
+
+// BytesRead returns the number of bytes read so far.
+func (hcr *hashCheckReader) BytesRead() int {
+	return hcr.n
+}
+
+// hashCheckWriter passes data through to an underlying writer,
+// computing the MD5 digest as it goes. After all data has been
+// written, Check reports whether the data matched the expected
+// hash.
+type hashCheckWriter struct {
+	w          io.Writer
+	hash       hash.Hash
+	expectHash string
+	n          int
+}
+
+func newHashCheckWriter(w io.Writer, expectHash string) *hashCheckWriter {
+	return &hashCheckWriter{
+		w:          w,
+		hash:       md5.New(),
+		expectHash: expectHash,
+	}
+}
+
+func (hcw *hashCheckWriter) Write(p []byte) (int, error) {
+	n, err := hcw.w.Write(p)
+	hcw.hash.Write(p[:n])
+	hcw.n += n
+	return n, err
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (hcw *hashCheckWriter) BytesWritten() int {
+	return hcw.n
+}
+
+// Check returns DiskHashError if the data written so far does not
+// match the expected hash.
+func (hcw *hashCheckWriter) Check() error {
+	if fmt.Sprintf("%x", hcw.hash.Sum(nil)) != hcw.expectHash {
+		return DiskHashError
+	}
+	return nil
+}
+
+// checkBlockHash reads the block stored on the given volume as loc,
+// and returns nil if its content matches loc, DiskHashError if not,
+// or whatever error was encountered reading the block. Only a small
+// constant amount of memory is used regardless of block size.
+func checkBlockHash(ctx context.Context, v BlockReader, loc string) error {
+	hcw := newHashCheckWriter(ioutil.Discard, loc[:32])
+	if err := v.ReadBlock(ctx, loc, hcw); err != nil {
+		return err
+	}
+	return hcw.Check()
+}
+
+// copyBlock copies a block from one volume to another without
+// buffering the whole block, verifying the hash as the data flows
+// through. If the data read from src does not match loc, the write
+// fails and copyBlock returns DiskHashError.
+func copyBlock(ctx context.Context, src BlockReader, dst BlockWriter, loc string, size int) error {
+	if size == 0 && loc[:32] != emptyBlockHash {
+		// A consumer might not read anything from a
+		// zero-length reader, so we need to check this
+		// case up front.
+		return DiskHashError
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.ReadBlock(ctx, loc, pw))
+	}()
+	hcr := newHashCheckReader(pr, loc[:32], size, DiskHashError)
+	err := dst.WriteBlock(ctx, loc, hcr, size)
+	// Unblock the reader goroutine if WriteBlock returned
+	// without consuming all of the data.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if hcr.Err() != nil {
+		// Report the problem with the source data rather
+		// than the resulting write error.
+		return hcr.Err()
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing/iotest"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&HashCheckSuite{})
+
+type HashCheckSuite struct{}
+
+func (s *HashCheckSuite) TestHashCheckReader(c *check.C) {
+	fooMD5 := "acbd18db4cc2f85cedef654fccc4a4d8"
+
+	for _, trial := range []struct {
+		data      string
+		size      int
+		expectErr error
+		expectBuf string
+	}{
+		{"foo", 3, nil, "foo"},
+		{"fo", 3, io.ErrUnexpectedEOF, "fo"},
+		// Data beyond the expected size is not read.
+		{"fooo", 3, nil, "foo"},
+		{"bar", 3, RequestHashError, "ba"},
+		{"foo", 2, RequestHashError, "f"},
+	} {
+		c.Logf("%+v", trial)
+		hcr := newHashCheckReader(iotest.OneByteReader(bytes.NewBufferString(trial.data)), fooMD5, trial.size, RequestHashError)
+		buf, err := ioutil.ReadAll(hcr)
+		c.Check(err, check.Equals, trial.expectErr)
+		c.Check(hcr.Err(), check.Equals, trial.expectErr)
+		// When the hash doesn't match, the last chunk must
+		// be withheld so the consumer never sees a complete
+		// block.
+		c.Check(string(buf), check.Equals, trial.expectBuf)
+	}
+
+	// Using a large buffer, everything arrives in one Read
+	// call, so nothing at all is returned on mismatch.
+	hcr := newHashCheckReader(bytes.NewBufferString("bar"), fooMD5, 3, RequestHashError)
+	buf := make([]byte, 1000)
+	n, err := hcr.Read(buf)
+	c.Check(n, check.Equals, 0)
+	c.Check(err, check.Equals, RequestHashError)
+
+	// An oversized body is detected if the excess data arrives
+	// in the same Read call.
+	hcr = newHashCheckReader(bytes.NewBufferString("fooo"), fooMD5, 3, RequestHashError)
+	n, err = hcr.Read(buf)
+	c.Check(n, check.Equals, 0)
+	c.Check(err, check.Equals, RequestHashError)
+
+	// Data is passed through as soon as the expected size is
+	// reached, without waiting for the underlying reader to
+	// return EOF.
+	pr, pw := io.Pipe()
+	go pw.Write([]byte("foo"))
+	hcr = newHashCheckReader(pr, fooMD5, 3, RequestHashError)
+	n, err = hcr.Read(buf)
+	c.Check(n, check.Equals, 3)
+	c.Check(err, check.IsNil)
+	n, err = hcr.Read(buf)
+	c.Check(n, check.Equals, 0)
+	c.Check(err, check.Equals, io.EOF)
+	c.Check(hcr.Err(), check.IsNil)
+	c.Check(hcr.BytesRead(), check.Equals, 3)
+}
+
+func (s *HashCheckSuite) TestHashCheckWriter(c *check.C) {
+	fooMD5 := "acbd18db4cc2f85cedef654fccc4a4d8"
+
+	var buf bytes.Buffer
+	hcw := newHashCheckWriter(&buf, fooMD5)
+	io.Copy(hcw, iotest.OneByteReader(bytes.NewBufferString("foo")))
+	c.Check(hcw.Check(), check.IsNil)
+	c.Check(hcw.BytesWritten(), check.Equals, 3)
+	c.Check(buf.String(), check.Equals, "foo")
+
+	hcw = newHashCheckWriter(ioutil.Discard, fooMD5)
+	hcw.Write([]byte("fooo"))
+	c.Check(hcw.Check(), check.Equals, DiskHashError)
+}
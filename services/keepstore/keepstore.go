@@ -27,7 +27,6 @@ type KeepError struct {
 var (
 	BadRequestError     = &KeepError{400, "Bad Request"}
 	UnauthorizedError   = &KeepError{401, "Unauthorized"}
-	CollisionError      = &KeepError{500, "Collision"}
 	RequestHashError    = &KeepError{422, "Hash mismatch in request"}
 	PermissionError     = &KeepError{403, "Forbidden"}
 	DiskHashError       = &KeepError{500, "Hash mismatch in stored data"}
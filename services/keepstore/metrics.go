@@ -69,6 +69,12 @@ type volumeMetricsVecs struct {
 	ioBytes     *prometheus.CounterVec
 	errCounters *prometheus.CounterVec
 	opsCounters *prometheus.CounterVec
+
+	compressionBytes *prometheus.CounterVec
+
+	scrubBlocks    *prometheus.CounterVec
+	scrubBytes     *prometheus.CounterVec
+	scrubCompleted *prometheus.GaugeVec
 }
 
 func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
@@ -103,6 +109,46 @@ func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
 		[]string{"device_id", "direction"},
 	)
 	reg.MustRegister(m.ioBytes)
+	m.compressionBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_compression_bytes",
+			Help:      "Logical and stored sizes of blocks read from and written to compressed volumes",
+		},
+		[]string{"device_id", "direction", "size"},
+	)
+	reg.MustRegister(m.compressionBytes)
+	m.scrubBlocks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_scrub_blocks",
+			Help:      "Number of blocks verified by scrubber",
+		},
+		[]string{"device_id", "result"},
+	)
+	reg.MustRegister(m.scrubBlocks)
+	m.scrubBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_scrub_bytes",
+			Help:      "Number of bytes read by scrubber",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.scrubBytes)
+	m.scrubCompleted = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_scrub_last_completed_timestamp_seconds",
+			Help:      "Time the last complete scrub pass finished",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.scrubCompleted)
 
 	return m
 }
@@ -113,3 +159,7 @@ func (vm *volumeMetricsVecs) getCounterVecsFor(lbls prometheus.Labels) (opsCV, e
 	ioCV = vm.ioBytes.MustCurryWith(lbls)
 	return
 }
+
+func (vm *volumeMetricsVecs) getCompressionVecFor(lbls prometheus.Labels) *prometheus.CounterVec {
+	return vm.compressionBytes.MustCurryWith(lbls)
+}
@@ -22,8 +22,8 @@ func (s *HandlerSuite) TestMounts(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	vols := s.handler.volmgr.AllWritable()
-	vols[0].Put(context.Background(), TestHash, TestBlock)
-	vols[1].Put(context.Background(), TestHash2, TestBlock2)
+	putWithPipe(context.Background(), TestHash, TestBlock, vols[0])
+	putWithPipe(context.Background(), TestHash2, TestBlock2, vols[1])
 
 	resp := s.call("GET", "/mounts", "", nil)
 	c.Check(resp.Code, check.Equals, http.StatusOK)
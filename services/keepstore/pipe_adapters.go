@@ -54,7 +54,7 @@ func putWithPipe(ctx context.Context, loc string, buf []byte, bw BlockWriter) er
 
 	putErr := make(chan error, 1)
 	go func() {
-		putErr <- bw.WriteBlock(ctx, loc, piper)
+		putErr <- bw.WriteBlock(ctx, loc, piper, len(buf))
 		close(putErr)
 	}()
 
@@ -5,6 +5,7 @@
 package keepstore
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -177,7 +178,7 @@ func (rrc *remoteResponseCacher) Close() error {
 		rrc.ResponseWriter.Write(rrc.Buffer)
 		return nil
 	}
-	_, err := PutBlock(rrc.Context, rrc.VolumeManager, rrc.Buffer, rrc.Locator[:32], nil)
+	_, err := PutBlock(rrc.Context, rrc.VolumeManager, bytes.NewReader(rrc.Buffer), len(rrc.Buffer), rrc.Locator[:32], nil)
 	if rrc.Context.Err() != nil {
 		// If caller hung up, log that instead of subsequent/misleading errors.
 		http.Error(rrc.ResponseWriter, rrc.Context.Err().Error(), http.StatusGatewayTimeout)
@@ -8,7 +8,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"strings"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
@@ -38,6 +38,10 @@ func (h *handler) runPullWorker(pullq *WorkQueue) {
 // only attempt to write the data to the corresponding
 // volume. Otherwise it writes to any local volume, as a PUT request
 // would.
+//
+// If the PR locator is a shard key (see erasure.go), the indicated
+// shard is rebuilt from other local shards if possible, or computed
+// from a full copy of the block retrieved from the PR servers.
 func (h *handler) pullItemAndProcess(pullRequest PullRequest) error {
 	var vol *VolumeMount
 	if uuid := pullRequest.MountUUID; uuid != "" {
@@ -57,6 +61,22 @@ func (h *handler) pullItemAndProcess(pullRequest PullRequest) error {
 	}
 	keepClient.SetServiceRoots(serviceRoots, nil, nil)
 
+	if isShardKey(pullRequest.Locator) {
+		// The locator identifies a single shard of an
+		// erasure-coded block.
+		if vol == nil {
+			return fmt.Errorf("pull req for shard has no mount: %v", pullRequest)
+		}
+		return pullShard(context.Background(), h.volmgr, vol, pullRequest.Locator, func(loc string) (io.ReadCloser, int64, error) {
+			signedLocator := SignLocator(h.Cluster, loc, keepClient.Arvados.ApiToken, time.Now().Add(time.Minute))
+			reader, contentLen, _, err := GetContent(signedLocator, &keepClient)
+			if err == nil && reader == nil {
+				err = fmt.Errorf("No reader found for : %s", signedLocator)
+			}
+			return reader, contentLen, err
+		})
+	}
+
 	signedLocator := SignLocator(h.Cluster, pullRequest.Locator, keepClient.Arvados.ApiToken, time.Now().Add(time.Minute))
 
 	reader, contentLen, _, err := GetContent(signedLocator, &keepClient)
@@ -68,16 +88,15 @@ func (h *handler) pullItemAndProcess(pullRequest PullRequest) error {
 	}
 	defer reader.Close()
 
-	readContent, err := ioutil.ReadAll(reader)
-	if err != nil {
-		return err
-	}
-
-	if (readContent == nil) || (int64(len(readContent)) != contentLen) {
-		return fmt.Errorf("Content not found for: %s", signedLocator)
+	// The locator has a size hint if the block is only available
+	// as erasure-coded shards on the source server.
+	hash := strings.SplitN(pullRequest.Locator, "+", 2)[0]
+	if vol == nil {
+		// Pass a nil interface, not a nil *VolumeMount, so
+		// writePulledBlock writes to any local volume.
+		return writePulledBlock(h.volmgr, nil, reader, int(contentLen), hash)
 	}
-
-	return writePulledBlock(h.volmgr, vol, readContent, pullRequest.Locator)
+	return writePulledBlock(h.volmgr, vol, reader, int(contentLen), hash)
 }
 
 // GetContent fetches the content for the given locator using keepclient.
@@ -85,10 +104,17 @@ var GetContent = func(signedLocator string, keepClient *keepclient.KeepClient) (
 	return keepClient.Get(signedLocator)
 }
 
-var writePulledBlock = func(volmgr *RRVolumeManager, volume Volume, data []byte, locator string) error {
+// writePulledBlock streams the data from rdr to the given volume, or
+// (if volume is nil) to any local volume, as a PUT request would.
+var writePulledBlock = func(volmgr *RRVolumeManager, volume Volume, rdr io.Reader, size int, locator string) error {
 	if volume != nil {
-		return volume.Put(context.Background(), locator, data)
+		hcr := newHashCheckReader(rdr, locator, size, RequestHashError)
+		err := volume.WriteBlock(context.Background(), locator, hcr, size)
+		if hcr.Err() != nil {
+			return hcr.Err()
+		}
+		return err
 	}
-	_, err := PutBlock(context.Background(), volmgr, data, locator, nil)
+	_, err := PutBlock(context.Background(), volmgr, rdr, size, locator, nil)
 	return err
 }
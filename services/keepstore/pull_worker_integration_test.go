@@ -86,8 +86,10 @@ func (s *HandlerSuite) TestPullWorkerIntegration_GetExistingLocator(c *check.C)
 func (s *HandlerSuite) performPullWorkerIntegrationTest(testData PullWorkIntegrationTestData, pullRequest PullRequest, c *check.C) {
 
 	// Override writePulledBlock to mock PutBlock functionality
-	defer func(orig func(*RRVolumeManager, Volume, []byte, string) error) { writePulledBlock = orig }(writePulledBlock)
-	writePulledBlock = func(_ *RRVolumeManager, _ Volume, content []byte, _ string) error {
+	defer func(orig func(*RRVolumeManager, Volume, io.Reader, int, string) error) { writePulledBlock = orig }(writePulledBlock)
+	writePulledBlock = func(_ *RRVolumeManager, _ Volume, rdr io.Reader, _ int, _ string) error {
+		content, err := ioutil.ReadAll(rdr)
+		c.Check(err, check.IsNil)
 		c.Check(string(content), check.Equals, testData.Content)
 		return nil
 	}
@@ -93,7 +93,7 @@ type PullWorkerTestData struct {
 // Ensure MountUUID in a pull list is correctly translated to a Volume
 // argument passed to writePulledBlock().
 func (s *PullWorkerTestSuite) TestSpecifyMountUUID(c *C) {
-	defer func(f func(*RRVolumeManager, Volume, []byte, string) error) {
+	defer func(f func(*RRVolumeManager, Volume, io.Reader, int, string) error) {
 		writePulledBlock = f
 	}(writePulledBlock)
 	pullq := s.handler.Handler.(*router).pullq
@@ -111,7 +111,7 @@ func (s *PullWorkerTestSuite) TestSpecifyMountUUID(c *C) {
 			expectVolume: s.handler.volmgr.Mounts()[0].Volume,
 		},
 	} {
-		writePulledBlock = func(_ *RRVolumeManager, v Volume, _ []byte, _ string) error {
+		writePulledBlock = func(_ *RRVolumeManager, v Volume, _ io.Reader, _ int, _ string) error {
 			c.Check(v, Equals, spec.expectVolume)
 			return nil
 		}
@@ -258,12 +258,16 @@ func (s *PullWorkerTestSuite) performTest(testData PullWorkerTestData, c *C) {
 	}
 
 	// Override writePulledBlock to mock PutBlock functionality
-	defer func(orig func(*RRVolumeManager, Volume, []byte, string) error) { writePulledBlock = orig }(writePulledBlock)
-	writePulledBlock = func(_ *RRVolumeManager, v Volume, content []byte, locator string) error {
+	defer func(orig func(*RRVolumeManager, Volume, io.Reader, int, string) error) { writePulledBlock = orig }(writePulledBlock)
+	writePulledBlock = func(_ *RRVolumeManager, v Volume, rdr io.Reader, _ int, locator string) error {
 		if testData.putError {
 			s.putError = errors.New("Error putting data")
 			return s.putError
 		}
+		content, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return err
+		}
 		s.putContent = content
 		return nil
 	}
@@ -6,9 +6,7 @@ package keepstore
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -334,122 +332,78 @@ func (v *S3Volume) getReader(key string) (rdr io.ReadCloser, err error) {
 	return
 }
 
-// Get a block: copy the block data into buf, and return the number of
-// bytes copied.
-func (v *S3Volume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+// ReadBlock retrieves a block and writes its content to w.
+func (v *S3Volume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
 	key := v.key(loc)
 	rdr, err := v.getReaderWithContext(ctx, key)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	var n int
 	ready := make(chan bool)
 	go func() {
 		defer close(ready)
 
 		defer rdr.Close()
-		n, err = io.ReadFull(rdr, buf)
-
-		switch err {
-		case nil, io.EOF, io.ErrUnexpectedEOF:
-			err = nil
-		default:
+		_, err = io.Copy(w, rdr)
+		if err != nil {
 			err = v.translateError(err)
 		}
 	}()
 	select {
 	case <-ctx.Done():
-		v.logger.Debugf("s3: interrupting ReadFull() with Close() because %s", ctx.Err())
+		v.logger.Debugf("s3: interrupting io.Copy() with Close() because %s", ctx.Err())
 		rdr.Close()
-		// Must wait for ReadFull to return, to ensure it
-		// doesn't write to buf after we return.
-		v.logger.Debug("s3: waiting for ReadFull() to fail")
+		// Must wait for io.Copy to return, to ensure it
+		// doesn't write to w after we return.
+		v.logger.Debug("s3: waiting for io.Copy() to fail")
 		<-ready
-		return 0, ctx.Err()
-	case <-ready:
-		return n, err
-	}
-}
-
-// Compare the given data with the stored data.
-func (v *S3Volume) Compare(ctx context.Context, loc string, expect []byte) error {
-	key := v.key(loc)
-	errChan := make(chan error, 1)
-	go func() {
-		_, err := v.bucket.Head("recent/"+key, nil)
-		errChan <- err
-	}()
-	var err error
-	select {
-	case <-ctx.Done():
 		return ctx.Err()
-	case err = <-errChan:
-	}
-	if err != nil {
-		// Checking for "loc" itself here would interfere with
-		// future GET requests.
-		//
-		// On AWS, if X doesn't exist, a HEAD or GET request
-		// for X causes X's non-existence to be cached. Thus,
-		// if we test for X, then create X and return a
-		// signature to our client, the client might still get
-		// 404 from all keepstores when trying to read it.
-		//
-		// To avoid this, we avoid doing HEAD X or GET X until
-		// we know X has been written.
-		//
-		// Note that X might exist even though recent/X
-		// doesn't: for example, the response to HEAD recent/X
-		// might itself come from a stale cache. In such
-		// cases, we will return a false negative and
-		// PutHandler might needlessly create another replica
-		// on a different volume. That's not ideal, but it's
-		// better than passing the eventually-consistent
-		// problem on to our clients.
-		return v.translateError(err)
-	}
-	rdr, err := v.getReaderWithContext(ctx, key)
-	if err != nil {
+	case <-ready:
 		return err
 	}
-	defer rdr.Close()
-	return v.translateError(compareReaderWithBuf(ctx, rdr, expect, loc[:32]))
 }
 
-// Put writes a block.
-func (v *S3Volume) Put(ctx context.Context, loc string, block []byte) error {
+// WriteBlock reads size bytes from rdr and writes them as a block.
+func (v *S3Volume) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
 	var opts s3.Options
-	size := len(block)
 	if size > 0 {
-		md5, err := hex.DecodeString(loc)
-		if err != nil {
-			return err
+		// Erasure-coded shards are not named by the MD5 hash
+		// of their content, so we can only send ContentMD5
+		// for whole blocks.
+		if !isShardKey(loc) {
+			md5, err := hex.DecodeString(loc)
+			if err != nil {
+				return err
+			}
+			opts.ContentMD5 = base64.StdEncoding.EncodeToString(md5)
+		}
+		if !v.V2Signature {
+			// In AWS regions that use V4 signatures, we
+			// need to provide ContentSHA256 up
+			// front. Otherwise, the S3 library reads the
+			// entire request body into a new buffer in
+			// order to compute the SHA256 before sending
+			// the request. We can't compute the SHA256
+			// without reading the data, so we send it
+			// unsigned, and rely on ContentMD5 to ensure
+			// integrity.
+			opts.ContentSHA256 = "UNSIGNED-PAYLOAD"
 		}
-		opts.ContentMD5 = base64.StdEncoding.EncodeToString(md5)
-		// In AWS regions that use V4 signatures, we need to
-		// provide ContentSHA256 up front. Otherwise, the S3
-		// library reads the request body (from our buffer)
-		// into another new buffer in order to compute the
-		// SHA256 before sending the request -- which would
-		// mean consuming 128 MiB of memory for the duration
-		// of a 64 MiB write.
-		opts.ContentSHA256 = fmt.Sprintf("%x", sha256.Sum256(block))
 	}
 
 	key := v.key(loc)
 
 	// Send the block data through a pipe, so that (if we need to)
 	// we can close the pipe early and abandon our PutReader()
-	// goroutine, without worrying about PutReader() accessing our
-	// block buffer after we release it.
+	// goroutine.
 	bufr, bufw := io.Pipe()
 	go func() {
-		io.Copy(bufw, bytes.NewReader(block))
-		bufw.Close()
+		_, err := io.Copy(bufw, rdr)
+		bufw.CloseWithError(err)
 	}()
 
 	var err error
@@ -732,10 +686,10 @@ func (v *S3Volume) String() string {
 	return fmt.Sprintf("s3-bucket:%+q", v.Bucket)
 }
 
-var s3KeepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var s3KeepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}(\.\d+\.\d+)?$`)
 
 func (v *S3Volume) isKeepBlock(s string) (string, bool) {
-	if v.PrefixLength > 0 && len(s) == v.PrefixLength+33 && s[:v.PrefixLength] == s[v.PrefixLength+1:v.PrefixLength*2+1] {
+	if v.PrefixLength > 0 && len(s) >= v.PrefixLength+33 && s[v.PrefixLength] == '/' && s[:v.PrefixLength] == s[v.PrefixLength+1:v.PrefixLength*2+1] {
 		s = s[v.PrefixLength+1:]
 	}
 	return s, s3KeepBlockRegexp.MatchString(s)
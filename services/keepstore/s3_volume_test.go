@@ -131,7 +131,7 @@ func (s *StubbedS3Suite) TestSignatureVersion(c *check.C) {
 	}
 	err := vol.check()
 	c.Check(err, check.IsNil)
-	err = vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+	err = putWithPipe(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"), &vol)
 	c.Check(err, check.IsNil)
 	c.Check(header.Get("Authorization"), check.Matches, `AWS4-HMAC-SHA256 .*`)
 
@@ -151,7 +151,7 @@ func (s *StubbedS3Suite) TestSignatureVersion(c *check.C) {
 	}
 	err = vol.check()
 	c.Check(err, check.IsNil)
-	err = vol.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+	err = putWithPipe(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"), &vol)
 	c.Check(err, check.IsNil)
 	c.Check(header.Get("Authorization"), check.Matches, `AWS xxx:.*`)
 }
@@ -203,20 +203,20 @@ func (s *StubbedS3Suite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"Ops":0,.*`)
 
 	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
-	_, err := v.Get(context.Background(), loc, make([]byte, 3))
+	_, err := getWithPipe(context.Background(), loc, make([]byte, 3), v)
 	c.Check(err, check.NotNil)
 	c.Check(stats(), check.Matches, `.*"Ops":[^0],.*`)
 	c.Check(stats(), check.Matches, `.*"\*s3.Error 404 [^"]*":[^0].*`)
 	c.Check(stats(), check.Matches, `.*"InBytes":0,.*`)
 
-	err = v.Put(context.Background(), loc, []byte("foo"))
+	err = putWithPipe(context.Background(), loc, []byte("foo"), v)
 	c.Check(err, check.IsNil)
 	c.Check(stats(), check.Matches, `.*"OutBytes":3,.*`)
 	c.Check(stats(), check.Matches, `.*"PutOps":2,.*`)
 
-	_, err = v.Get(context.Background(), loc, make([]byte, 3))
+	_, err = getWithPipe(context.Background(), loc, make([]byte, 3), v)
 	c.Check(err, check.IsNil)
-	_, err = v.Get(context.Background(), loc, make([]byte, 3))
+	_, err = getWithPipe(context.Background(), loc, make([]byte, 3), v)
 	c.Check(err, check.IsNil)
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 }
@@ -246,26 +246,17 @@ func (s *StubbedS3Suite) TestGetContextCancel(c *check.C) {
 	buf := make([]byte, 3)
 
 	s.testContextCancel(c, func(ctx context.Context, v *TestableS3Volume) error {
-		_, err := v.Get(ctx, loc, buf)
+		_, err := getWithPipe(ctx, loc, buf, v)
 		return err
 	})
 }
 
-func (s *StubbedS3Suite) TestCompareContextCancel(c *check.C) {
-	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
-	buf := []byte("bar")
-
-	s.testContextCancel(c, func(ctx context.Context, v *TestableS3Volume) error {
-		return v.Compare(ctx, loc, buf)
-	})
-}
-
 func (s *StubbedS3Suite) TestPutContextCancel(c *check.C) {
 	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
 	buf := []byte("foo")
 
 	s.testContextCancel(c, func(ctx context.Context, v *TestableS3Volume) error {
-		return v.Put(ctx, loc, buf)
+		return putWithPipe(ctx, loc, buf, v)
 	})
 }
 
@@ -454,7 +445,7 @@ func (s *StubbedS3Suite) TestBackendStates(c *check.C) {
 			// Check canGet
 			loc, blk := setupScenario()
 			buf := make([]byte, len(blk))
-			_, err := v.Get(context.Background(), loc, buf)
+			_, err := getWithPipe(context.Background(), loc, buf, v)
 			c.Check(err == nil, check.Equals, scenario.canGet)
 			if err != nil {
 				c.Check(os.IsNotExist(err), check.Equals, true)
@@ -464,7 +455,7 @@ func (s *StubbedS3Suite) TestBackendStates(c *check.C) {
 			loc, _ = setupScenario()
 			err = v.Trash(loc)
 			c.Check(err == nil, check.Equals, scenario.canTrash)
-			_, err = v.Get(context.Background(), loc, buf)
+			_, err = getWithPipe(context.Background(), loc, buf, v)
 			c.Check(err == nil, check.Equals, scenario.canGetAfterTrash)
 			if err != nil {
 				c.Check(os.IsNotExist(err), check.Equals, true)
@@ -479,7 +470,7 @@ func (s *StubbedS3Suite) TestBackendStates(c *check.C) {
 				// should be able to Get after Untrash --
 				// regardless of timestamps, errors, race
 				// conditions, etc.
-				_, err = v.Get(context.Background(), loc, buf)
+				_, err = getWithPipe(context.Background(), loc, buf, v)
 				c.Check(err, check.IsNil)
 			}
 
@@ -500,7 +491,7 @@ func (s *StubbedS3Suite) TestBackendStates(c *check.C) {
 			// Check for current Mtime after Put (applies to all
 			// scenarios)
 			loc, blk = setupScenario()
-			err = v.Put(context.Background(), loc, blk)
+			err = putWithPipe(context.Background(), loc, blk, v)
 			c.Check(err, check.IsNil)
 			t, err := v.Mtime(loc)
 			c.Check(err, check.IsNil)
@@ -76,15 +76,14 @@ func chooseS3VolumeDriver(cluster *arvados.Cluster, volume arvados.Volume, logge
 
 const (
 	PartSize         = 5 * 1024 * 1024
-	ReadConcurrency  = 13
 	WriteConcurrency = 5
 )
 
-var s3AWSKeepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var s3AWSKeepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}(\.\d+\.\d+)?$`)
 var s3AWSZeroTime time.Time
 
 func (v *S3AWSVolume) isKeepBlock(s string) (string, bool) {
-	if v.PrefixLength > 0 && len(s) == v.PrefixLength+33 && s[:v.PrefixLength] == s[v.PrefixLength+1:v.PrefixLength*2+1] {
+	if v.PrefixLength > 0 && len(s) >= v.PrefixLength+33 && s[v.PrefixLength] == '/' && s[:v.PrefixLength] == s[v.PrefixLength+1:v.PrefixLength*2+1] {
 		s = s[v.PrefixLength+1:]
 	}
 	return s, s3AWSKeepBlockRegexp.MatchString(s)
@@ -236,57 +235,6 @@ func (v *S3AWSVolume) GetDeviceID() string {
 	return "s3://" + v.Endpoint + "/" + v.Bucket
 }
 
-// Compare the given data with the stored data.
-func (v *S3AWSVolume) Compare(ctx context.Context, loc string, expect []byte) error {
-	key := v.key(loc)
-	errChan := make(chan error, 1)
-	go func() {
-		_, err := v.head("recent/" + key)
-		errChan <- err
-	}()
-	var err error
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err = <-errChan:
-	}
-	if err != nil {
-		// Checking for the key itself here would interfere
-		// with future GET requests.
-		//
-		// On AWS, if X doesn't exist, a HEAD or GET request
-		// for X causes X's non-existence to be cached. Thus,
-		// if we test for X, then create X and return a
-		// signature to our client, the client might still get
-		// 404 from all keepstores when trying to read it.
-		//
-		// To avoid this, we avoid doing HEAD X or GET X until
-		// we know X has been written.
-		//
-		// Note that X might exist even though recent/X
-		// doesn't: for example, the response to HEAD recent/X
-		// might itself come from a stale cache. In such
-		// cases, we will return a false negative and
-		// PutHandler might needlessly create another replica
-		// on a different volume. That's not ideal, but it's
-		// better than passing the eventually-consistent
-		// problem on to our clients.
-		return v.translateError(err)
-	}
-
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(v.bucket.bucket),
-		Key:    aws.String(key),
-	}
-
-	req := v.bucket.svc.GetObjectRequest(input)
-	result, err := req.Send(ctx)
-	if err != nil {
-		return v.translateError(err)
-	}
-	return v.translateError(compareReaderWithBuf(ctx, result.Body, expect, loc[:32]))
-}
-
 // EmptyTrash looks for trashed blocks that exceeded BlobTrashLifetime
 // and deletes them from the volume.
 func (v *S3AWSVolume) EmptyTrash() {
@@ -461,22 +409,17 @@ func (v *S3AWSVolume) head(key string) (result *s3.HeadObjectOutput, err error)
 	return
 }
 
-// Get a block: copy the block data into buf, and return the number of
-// bytes copied.
-func (v *S3AWSVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
-	// Do not use getWithPipe here: the BlockReader interface does not pass
-	// through 'buf []byte', and we don't want to allocate two buffers for each
-	// read request. Instead, use a version of ReadBlock that accepts 'buf []byte'
-	// as an input.
+// ReadBlock retrieves a block and writes its content to w.
+func (v *S3AWSVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
 	key := v.key(loc)
-	count, err := v.readWorker(ctx, key, buf)
+	err := v.readWorker(ctx, key, w)
 	if err == nil {
-		return count, err
+		return nil
 	}
 
 	err = v.translateError(err)
 	if !os.IsNotExist(err) {
-		return 0, err
+		return err
 	}
 
 	_, err = v.head("recent/" + key)
@@ -484,40 +427,39 @@ func (v *S3AWSVolume) Get(ctx context.Context, loc string, buf []byte) (int, err
 	if err != nil {
 		// If we can't read recent/X, there's no point in
 		// trying fixRace. Give up.
-		return 0, err
+		return err
 	}
 	if !v.fixRace(key) {
-		err = os.ErrNotExist
-		return 0, err
+		return os.ErrNotExist
 	}
 
-	count, err = v.readWorker(ctx, key, buf)
+	err = v.readWorker(ctx, key, w)
 	if err != nil {
 		v.logger.Warnf("reading %s after successful fixRace: %s", loc, err)
-		err = v.translateError(err)
-		return 0, err
+		return v.translateError(err)
 	}
-	return count, err
+	return nil
 }
 
-func (v *S3AWSVolume) readWorker(ctx context.Context, key string, buf []byte) (int, error) {
-	awsBuf := aws.NewWriteAtBuffer(buf)
-	downloader := s3manager.NewDownloaderWithClient(v.bucket.svc, func(u *s3manager.Downloader) {
-		u.PartSize = PartSize
-		u.Concurrency = ReadConcurrency
-	})
-
-	v.logger.Debugf("Partsize: %d; Concurrency: %d\n", downloader.PartSize, downloader.Concurrency)
-
-	count, err := downloader.DownloadWithContext(ctx, awsBuf, &s3.GetObjectInput{
+// readWorker streams the object data to w. It does not write
+// anything to w unless the GET request succeeds, so a "not found"
+// error can be handled by the caller.
+func (v *S3AWSVolume) readWorker(ctx context.Context, key string, w io.Writer) error {
+	req := v.bucket.svc.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(v.bucket.bucket),
 		Key:    aws.String(key),
 	})
+	result, err := req.Send(ctx)
 	v.bucket.stats.TickOps("get")
 	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	if err != nil {
+		v.bucket.stats.TickErr(err)
+		return v.translateError(err)
+	}
+	defer result.Body.Close()
+	_, err = io.Copy(w, NewCountingReader(result.Body, v.bucket.stats.TickInBytes))
 	v.bucket.stats.TickErr(err)
-	v.bucket.stats.TickInBytes(uint64(count))
-	return int(count), v.translateError(err)
+	return v.translateError(err)
 }
 
 func (v *S3AWSVolume) writeObject(ctx context.Context, key string, r io.Reader) error {
@@ -533,7 +475,10 @@ func (v *S3AWSVolume) writeObject(ctx context.Context, key string, r io.Reader)
 		Body:   r,
 	}
 
-	if loc, ok := v.isKeepBlock(key); ok {
+	// Erasure-coded shards are not named by the MD5 hash of
+	// their content, so we can only send ContentMD5 for whole
+	// blocks.
+	if loc, ok := v.isKeepBlock(key); ok && !isShardKey(loc) {
 		var contentMD5 string
 		md5, err := hex.DecodeString(loc)
 		if err != nil {
@@ -552,12 +497,11 @@ func (v *S3AWSVolume) writeObject(ctx context.Context, key string, r io.Reader)
 		u.Concurrency = WriteConcurrency
 	})
 
-	// Unlike the goamz S3 driver, we don't need to precompute ContentSHA256:
-	// the aws-sdk-go v2 SDK uses a ReadSeeker to avoid having to copy the
-	// block, so there is no extra memory use to be concerned about. See
-	// makeSha256Reader in aws/signer/v4/v4.go. In fact, we explicitly disable
-	// calculating the Sha-256 because we don't need it; we already use md5sum
-	// hashes that match the name of the block.
+	// We don't precompute ContentSHA256, and we explicitly disable
+	// calculating the Sha-256 because we don't need it; we already use
+	// md5sum hashes that match the name of the block. The uploader reads
+	// at most PartSize bytes into memory per concurrent part, so memory
+	// use does not depend on the size of the block.
 	_, err := uploader.UploadWithContext(ctx, &uploadInput, s3manager.WithUploaderRequestOptions(func(r *aws.Request) {
 		r.HTTPRequest.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
 	}))
@@ -569,16 +513,12 @@ func (v *S3AWSVolume) writeObject(ctx context.Context, key string, r io.Reader)
 	return v.translateError(err)
 }
 
-// Put writes a block.
-func (v *S3AWSVolume) Put(ctx context.Context, loc string, block []byte) error {
-	// Do not use putWithPipe here; we want to pass an io.ReadSeeker to the S3
-	// sdk to avoid memory allocation there. See #17339 for more information.
+// WriteBlock reads size bytes from rdr and writes them as a block.
+func (v *S3AWSVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
-
-	rdr := bytes.NewReader(block)
-	r := NewCountingReaderAtSeeker(rdr, v.bucket.stats.TickOutBytes)
+	r := NewCountingReader(rdr, v.bucket.stats.TickOutBytes)
 	key := v.key(loc)
 	err := v.writeObject(ctx, key, r)
 	if err != nil {
@@ -0,0 +1,265 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// corruptBlock is a block that failed hash verification during a
+// scrub pass.
+type corruptBlock struct {
+	Size     int
+	Detected time.Time
+}
+
+// corruptBlockSet tracks the corrupt blocks found on a mount. The
+// zero value is an empty set.
+type corruptBlockSet struct {
+	blocks map[string]corruptBlock
+	mtx    sync.Mutex
+}
+
+func (cbs *corruptBlockSet) add(loc string, size int) {
+	cbs.mtx.Lock()
+	defer cbs.mtx.Unlock()
+	if cbs.blocks == nil {
+		cbs.blocks = map[string]corruptBlock{}
+	}
+	if _, ok := cbs.blocks[loc]; !ok {
+		cbs.blocks[loc] = corruptBlock{Size: size, Detected: time.Now()}
+	}
+}
+
+func (cbs *corruptBlockSet) forget(loc string) {
+	cbs.mtx.Lock()
+	defer cbs.mtx.Unlock()
+	delete(cbs.blocks, loc)
+}
+
+// list returns the locators of all blocks in the set, sorted.
+func (cbs *corruptBlockSet) list() []string {
+	cbs.mtx.Lock()
+	defer cbs.mtx.Unlock()
+	var locs []string
+	for loc := range cbs.blocks {
+		locs = append(locs, loc)
+	}
+	sort.Strings(locs)
+	return locs
+}
+
+// writeIndex writes the corrupt blocks to w, using the same format
+// as Volume.IndexTo, except that the timestamp is the time the
+// corruption was detected.
+func (cbs *corruptBlockSet) writeIndex(w io.Writer) error {
+	cbs.mtx.Lock()
+	defer cbs.mtx.Unlock()
+	for loc, cb := range cbs.blocks {
+		_, err := fmt.Fprintf(w, "%s+%d %d\n", loc, cb.Size, cb.Detected.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubber periodically re-reads all of the blocks on a mount,
+// verifies their hashes, and quarantines any corrupt blocks by
+// moving them to the trash.
+type scrubber struct {
+	cluster *arvados.Cluster
+	logger  logrus.FieldLogger
+	mnt     *VolumeMount
+
+	blocks    *prometheus.CounterVec
+	bytes     prometheus.Counter
+	completed prometheus.Gauge
+
+	// Total bytes read and total time spent in the current
+	// pass, used to enforce BlobScrubMaxBytesPerSecond.
+	passBytes int64
+	passStart time.Time
+}
+
+func newScrubber(cluster *arvados.Cluster, logger logrus.FieldLogger, mnt *VolumeMount, metrics *volumeMetricsVecs) *scrubber {
+	lbls := prometheus.Labels{"device_id": mnt.DeviceID}
+	return &scrubber{
+		cluster:   cluster,
+		logger:    logger.WithField("mount", mnt.UUID),
+		mnt:       mnt,
+		blocks:    metrics.scrubBlocks.MustCurryWith(lbls),
+		bytes:     metrics.scrubBytes.With(lbls),
+		completed: metrics.scrubCompleted.With(lbls),
+	}
+}
+
+// run starts a new scrub pass every BlobScrubInterval until ctx is
+// cancelled.
+func (s *scrubber) run(ctx context.Context) {
+	interval := s.cluster.Collections.BlobScrubInterval.Duration()
+	for {
+		t0 := time.Now()
+		err := s.scrubPass(ctx)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			s.logger.WithError(err).Error("scrub pass failed")
+		} else {
+			s.logger.Infof("scrub pass completed in %v", time.Since(t0))
+			s.completed.Set(float64(time.Now().Unix()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(t0.Add(interval))):
+		}
+	}
+}
+
+// scrubPass verifies every block on the mount.
+func (s *scrubber) scrubPass(ctx context.Context) error {
+	s.passBytes = 0
+	s.passStart = time.Now()
+	// Get the index in 16 pieces, to avoid holding the whole
+	// index in memory or holding an index request open for the
+	// entire pass.
+	for _, prefix := range "0123456789abcdef" {
+		blocks, err := s.index(string(prefix))
+		if err != nil {
+			return err
+		}
+		for _, blk := range blocks {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.scrubBlock(ctx, blk.loc, blk.size)
+		}
+	}
+	// Forget about corrupt blocks that are now gone, either
+	// because they have been moved to the trash, or because
+	// they were deleted by keep-balance.
+	for _, loc := range s.mnt.corrupt.list() {
+		if _, err := s.mnt.Mtime(loc); os.IsNotExist(err) {
+			s.mnt.corrupt.forget(loc)
+		}
+	}
+	return nil
+}
+
+type scrubIndexEntry struct {
+	loc  string
+	size int
+}
+
+func (s *scrubber) index(prefix string) ([]scrubIndexEntry, error) {
+	var buf bytes.Buffer
+	err := s.mnt.IndexTo(prefix, &buf)
+	if err != nil {
+		return nil, fmt.Errorf("error getting index: %w", err)
+	}
+	var blocks []scrubIndexEntry
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		plus := strings.IndexByte(line, '+')
+		space := strings.IndexByte(line, ' ')
+		if plus < 0 || space < plus {
+			return nil, fmt.Errorf("malformed index line %q", line)
+		}
+		loc := line[:plus]
+		if isShardKey(loc) {
+			// Erasure-coded shards can't be verified
+			// individually.
+			continue
+		}
+		size, err := strconv.Atoi(line[plus+1 : space])
+		if err != nil {
+			return nil, fmt.Errorf("malformed index line %q", line)
+		}
+		blocks = append(blocks, scrubIndexEntry{loc: loc, size: size})
+	}
+	return blocks, scanner.Err()
+}
+
+// scrubBlock verifies a single block, and quarantines it if it is
+// corrupt.
+func (s *scrubber) scrubBlock(ctx context.Context, loc string, size int) {
+	s.throttle(ctx, size)
+	err := checkBlockHash(ctx, s.mnt, loc)
+	s.bytes.Add(float64(size))
+	switch {
+	case err == nil:
+		s.blocks.With(prometheus.Labels{"result": "ok"}).Inc()
+		s.mnt.corrupt.forget(loc)
+	case os.IsNotExist(err):
+		// Deleted since we got the index.
+	case err == DiskHashError:
+		s.blocks.With(prometheus.Labels{"result": "corrupt"}).Inc()
+		s.quarantine(loc, size)
+	default:
+		if ctx.Err() == nil {
+			s.blocks.With(prometheus.Labels{"result": "error"}).Inc()
+			s.logger.WithError(err).Warnf("scrub: error reading block %s", loc)
+		}
+	}
+}
+
+// throttle waits as needed to keep the pass's average read rate
+// below BlobScrubMaxBytesPerSecond, then accounts for an additional
+// size bytes about to be read.
+func (s *scrubber) throttle(ctx context.Context, size int) {
+	rate := int64(s.cluster.Collections.BlobScrubMaxBytesPerSecond)
+	if rate <= 0 {
+		return
+	}
+	due := s.passStart.Add(time.Duration(float64(s.passBytes) / float64(rate) * float64(time.Second)))
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Until(due)):
+	}
+	s.passBytes += int64(size)
+}
+
+// quarantine records the given block as corrupt, so keep-balance
+// can replace it with a good copy, and moves it to the trash.
+func (s *scrubber) quarantine(loc string, size int) {
+	s.mnt.corrupt.add(loc, size)
+	logger := s.logger.WithField("block", loc)
+	if s.mnt.ReadOnly {
+		logger.Error("scrub: checksum mismatch; cannot move block to trash because mount is read-only")
+		return
+	}
+	if !s.cluster.Collections.BlobTrash {
+		logger.Error("scrub: checksum mismatch; cannot move block to trash because Collections.BlobTrash is false")
+		return
+	}
+	err := s.mnt.Trash(loc)
+	if err != nil {
+		logger.WithError(err).Error("scrub: checksum mismatch; error moving block to trash")
+		return
+	}
+	if _, err := s.mnt.Mtime(loc); err == nil {
+		// Trash() declined to trash the block because it
+		// is newer than BlobSigningTTL.
+		logger.Error("scrub: checksum mismatch; block is too new to move to trash")
+		return
+	}
+	logger.Error("scrub: checksum mismatch; moved block to trash")
+}
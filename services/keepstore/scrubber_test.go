@@ -0,0 +1,135 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ScrubberSuite{})
+
+type ScrubberSuite struct {
+	cluster *arvados.Cluster
+	handler *handler
+	mnt     *VolumeMount
+	mock    *MockVolume
+	metrics *volumeMetricsVecs
+}
+
+func (s *ScrubberSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "mock"},
+	}
+	s.cluster.Collections.BlobTrash = true
+	s.cluster.Collections.BlobSigningTTL = arvados.Duration(time.Hour)
+	s.cluster.Collections.BlobScrubMaxBytesPerSecond = 0
+	s.handler = &handler{}
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	mnts := s.handler.volmgr.AllReadable()
+	c.Assert(mnts, check.HasLen, 1)
+	s.mnt = mnts[0]
+	s.mock = s.mnt.Volume.(*MockVolume)
+	s.metrics = newVolumeMetricsVecs(prometheus.NewRegistry())
+
+	// A good block, and a corrupt block old enough to be
+	// trashed.
+	s.mock.Store[TestHash] = TestBlock
+	s.mock.Timestamps[TestHash] = time.Now().Add(-2 * time.Hour)
+	s.mock.Store[TestHash2] = []byte("this is not the right data")
+	s.mock.Timestamps[TestHash2] = time.Now().Add(-2 * time.Hour)
+}
+
+func (s *ScrubberSuite) TestQuarantine(c *check.C) {
+	scr := newScrubber(s.cluster, s.handler.Logger, s.mnt, s.metrics)
+	c.Check(scr.scrubPass(context.Background()), check.IsNil)
+
+	c.Check(s.mock.Store[TestHash], check.NotNil)
+	c.Check(s.mock.Store[TestHash2], check.IsNil)
+	c.Check(s.blockCount(c, "ok"), check.Equals, float64(1))
+	c.Check(s.blockCount(c, "corrupt"), check.Equals, float64(1))
+	c.Check(s.blockCount(c, "error"), check.Equals, float64(0))
+
+	// The corrupt block was moved to the trash, so it is no
+	// longer reported.
+	c.Check(s.mnt.corrupt.list(), check.HasLen, 0)
+}
+
+func (s *ScrubberSuite) TestCorruptIndex(c *check.C) {
+	s.mock.Timestamps[TestHash2] = time.Now()
+	scr := newScrubber(s.cluster, s.handler.Logger, s.mnt, s.metrics)
+	c.Check(scr.scrubPass(context.Background()), check.IsNil)
+
+	// The corrupt block is too new to trash, so it stays on the
+	// volume and is reported via the corrupt index.
+	c.Check(s.mock.Store[TestHash2], check.NotNil)
+	c.Check(s.mnt.corrupt.list(), check.DeepEquals, []string{TestHash2})
+
+	resp := IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    "/mounts/" + s.mnt.UUID + "/corrupt",
+	})
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	resp = IssueRequest(s.handler, &RequestTester{
+		method:   "GET",
+		uri:      "/mounts/" + s.mnt.UUID + "/corrupt",
+		apiToken: s.cluster.SystemRootToken,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(strings.HasPrefix(resp.Body.String(), TestHash2+"+26 "), check.Equals, true)
+	c.Check(strings.HasSuffix(resp.Body.String(), "\n\n"), check.Equals, true)
+
+	resp = IssueRequest(s.handler, &RequestTester{
+		method:   "GET",
+		uri:      "/mounts/zzzzz-nyw5e-999999999999999/corrupt",
+		apiToken: s.cluster.SystemRootToken,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	// Writing a good copy removes the block from the corrupt
+	// index.
+	err := s.mnt.WriteBlock(context.Background(), TestHash2, bytes.NewReader(TestBlock2), len(TestBlock2))
+	c.Check(err, check.IsNil)
+	c.Check(s.mnt.corrupt.list(), check.HasLen, 0)
+}
+
+func (s *ScrubberSuite) TestReadOnly(c *check.C) {
+	s.mnt.ReadOnly = true
+	scr := newScrubber(s.cluster, s.handler.Logger, s.mnt, s.metrics)
+	c.Check(scr.scrubPass(context.Background()), check.IsNil)
+	c.Check(s.mock.Store[TestHash2], check.NotNil)
+	c.Check(s.mnt.corrupt.list(), check.DeepEquals, []string{TestHash2})
+}
+
+func (s *ScrubberSuite) TestThrottle(c *check.C) {
+	// Both blocks are at least 26 bytes.
+	s.cluster.Collections.BlobScrubMaxBytesPerSecond = 260
+	scr := newScrubber(s.cluster, s.handler.Logger, s.mnt, s.metrics)
+	t0 := time.Now()
+	c.Check(scr.scrubPass(context.Background()), check.IsNil)
+	// The second block can't be read until the first block's
+	// share of the rate limit (at least 1/10 s) has elapsed.
+	c.Check(time.Since(t0) >= 100*time.Millisecond, check.Equals, true)
+}
+
+func (s *ScrubberSuite) blockCount(c *check.C, result string) float64 {
+	var pb dto.Metric
+	err := s.metrics.scrubBlocks.With(prometheus.Labels{
+		"device_id": s.mnt.DeviceID,
+		"result":    result,
+	}).Write(&pb)
+	c.Assert(err, check.IsNil)
+	return pb.GetCounter().GetValue()
+}
@@ -7,6 +7,7 @@ package keepstore
 import (
 	"container/list"
 	"context"
+	"net/http/httptest"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -254,15 +255,15 @@ func (s *HandlerSuite) performTrashWorkerTest(c *check.C, testData TrashWorkerTe
 	// Put test content
 	mounts := s.handler.volmgr.AllWritable()
 	if testData.CreateData {
-		mounts[0].Put(context.Background(), testData.Locator1, testData.Block1)
-		mounts[0].Put(context.Background(), testData.Locator1+".meta", []byte("metadata"))
+		putWithPipe(context.Background(), testData.Locator1, testData.Block1, mounts[0])
+		putWithPipe(context.Background(), testData.Locator1+".meta", []byte("metadata"), mounts[0])
 
 		if testData.CreateInVolume1 {
-			mounts[0].Put(context.Background(), testData.Locator2, testData.Block2)
-			mounts[0].Put(context.Background(), testData.Locator2+".meta", []byte("metadata"))
+			putWithPipe(context.Background(), testData.Locator2, testData.Block2, mounts[0])
+			putWithPipe(context.Background(), testData.Locator2+".meta", []byte("metadata"), mounts[0])
 		} else {
-			mounts[1].Put(context.Background(), testData.Locator2, testData.Block2)
-			mounts[1].Put(context.Background(), testData.Locator2+".meta", []byte("metadata"))
+			putWithPipe(context.Background(), testData.Locator2, testData.Block2, mounts[1])
+			putWithPipe(context.Background(), testData.Locator2+".meta", []byte("metadata"), mounts[1])
 		}
 	}
 
@@ -326,8 +327,9 @@ func (s *HandlerSuite) performTrashWorkerTest(c *check.C, testData TrashWorkerTe
 	expectEqualWithin(c, time.Second, 0, func() interface{} { return trashq.Status().InProgress })
 
 	// Verify Locator1 to be un/deleted as expected
-	buf := make([]byte, BlockSize)
-	size, err := GetBlock(context.Background(), s.handler.volmgr, testData.Locator1, buf, nil)
+	resp := httptest.NewRecorder()
+	err := GetBlock(context.Background(), s.handler.volmgr, testData.Locator1, resp)
+	size := resp.Body.Len()
 	if testData.ExpectLocator1 {
 		if size == 0 || err != nil {
 			c.Errorf("Expected Locator1 to be still present: %s", testData.Locator1)
@@ -340,7 +342,9 @@ func (s *HandlerSuite) performTrashWorkerTest(c *check.C, testData TrashWorkerTe
 
 	// Verify Locator2 to be un/deleted as expected
 	if testData.Locator1 != testData.Locator2 {
-		size, err = GetBlock(context.Background(), s.handler.volmgr, testData.Locator2, buf, nil)
+		resp = httptest.NewRecorder()
+		err = GetBlock(context.Background(), s.handler.volmgr, testData.Locator2, resp)
+		size = resp.Body.Len()
 		if testData.ExpectLocator2 {
 			if size == 0 || err != nil {
 				c.Errorf("Expected Locator2 to be still present: %s", testData.Locator2)
@@ -359,7 +363,7 @@ func (s *HandlerSuite) performTrashWorkerTest(c *check.C, testData TrashWorkerTe
 		locatorFoundIn := 0
 		for _, volume := range s.handler.volmgr.AllReadable() {
 			buf := make([]byte, BlockSize)
-			if _, err := volume.Get(context.Background(), testData.Locator1, buf); err == nil {
+			if _, err := getWithPipe(context.Background(), testData.Locator1, buf, volume); err == nil {
 				locatorFoundIn = locatorFoundIn + 1
 			}
 		}
@@ -25,6 +25,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 func init() {
@@ -75,6 +76,8 @@ type UnixVolume struct {
 	locker sync.Locker
 
 	os osWithStats
+
+	xattrWarnOnce sync.Once
 }
 
 // GetDeviceID returns a globally unique ID for the volume's root
@@ -212,19 +215,13 @@ func (v *UnixVolume) stat(path string) (os.FileInfo, error) {
 	if err == nil {
 		if stat.Size() < 0 {
 			err = os.ErrInvalid
-		} else if stat.Size() > BlockSize {
+		} else if stat.Size() > maxStoredBlockSize {
 			err = TooLongError
 		}
 	}
 	return stat, err
 }
 
-// Get retrieves a block, copies it to the given slice, and returns
-// the number of bytes copied.
-func (v *UnixVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
-	return getWithPipe(ctx, loc, buf, v)
-}
-
 // ReadBlock implements BlockReader.
 func (v *UnixVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
 	path := v.blockPath(loc)
@@ -241,29 +238,23 @@ func (v *UnixVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) err
 	})
 }
 
-// Compare returns nil if Get(loc) would return the same content as
-// expect. It is functionally equivalent to Get() followed by
-// bytes.Compare(), but uses less memory.
-func (v *UnixVolume) Compare(ctx context.Context, loc string, expect []byte) error {
-	path := v.blockPath(loc)
-	if _, err := v.stat(path); err != nil {
-		return v.translateError(err)
-	}
-	return v.getFunc(ctx, path, func(rdr io.Reader) error {
-		return compareReaderWithBuf(ctx, rdr, expect, loc[:32])
-	})
+// xattrLogicalSize is the extended attribute where UnixVolume
+// records the logical size of a block written by a volume wrapper.
+const xattrLogicalSize = "user.arvados.logical_size"
+
+// WriteBlock implements BlockWriter.
+func (v *UnixVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
+	return v.writeBlock(ctx, loc, rdr, size, -1)
 }
 
-// Put stores a block of data identified by the locator string
-// "loc".  It returns nil on success.  If the volume is full, it
-// returns a FullError.  If the write fails due to some other error,
-// that error is returned.
-func (v *UnixVolume) Put(ctx context.Context, loc string, block []byte) error {
-	return putWithPipe(ctx, loc, block, v)
+// WriteBlockWithLogicalSize implements logicalSizeVolume. The logical
+// size is recorded in an extended attribute. If the filesystem does
+// not support extended attributes, the block is written without it.
+func (v *UnixVolume) WriteBlockWithLogicalSize(ctx context.Context, loc string, rdr io.Reader, size, logicalSize int) error {
+	return v.writeBlock(ctx, loc, rdr, size, logicalSize)
 }
 
-// WriteBlock implements BlockWriter.
-func (v *UnixVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader) error {
+func (v *UnixVolume) writeBlock(ctx context.Context, loc string, rdr io.Reader, size, logicalSize int) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
@@ -292,6 +283,19 @@ func (v *UnixVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader)
 	if err != nil {
 		return fmt.Errorf("error writing %s: %s", bpath, err)
 	}
+	if n != int64(size) {
+		return fmt.Errorf("error writing %s: wrote %d bytes, expected %d", bpath, n, size)
+	}
+	if logicalSize >= 0 {
+		err = v.os.Setxattr(tmpfile.Name(), xattrLogicalSize, []byte(strconv.Itoa(logicalSize)))
+		if err != nil {
+			// The wrapper can still get the logical
+			// size from the stored data when needed.
+			v.xattrWarnOnce.Do(func() {
+				v.logger.WithError(err).Warnf("cannot record logical block sizes on %s, index requests will be slower", v)
+			})
+		}
+	}
 	if err = tmpfile.Close(); err != nil {
 		return fmt.Errorf("error closing %s: %s", tmpfile.Name(), err)
 	}
@@ -347,7 +351,9 @@ func (v *UnixVolume) Status() *VolumeStatus {
 }
 
 var blockDirRe = regexp.MustCompile(`^[0-9a-f]+$`)
-var blockFileRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+// blockFileRe matches block files, including erasure-coded shards
+// (see erasure.ShardKey).
+var blockFileRe = regexp.MustCompile(`^[0-9a-f]{32}(\.\d+\.\d+)?$`)
 
 // IndexTo writes (to the given Writer) a list of blocks found on this
 // volume which begin with the specified prefix. If the prefix is an
@@ -364,6 +370,15 @@ var blockFileRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
 //     e4de7a2810f5554cd39b36d8ddb132ff+67108864 1388701136
 //
 func (v *UnixVolume) IndexTo(prefix string, w io.Writer) error {
+	return v.indexTo(prefix, w, false)
+}
+
+// IndexWithLogicalSizesTo implements logicalSizeVolume.
+func (v *UnixVolume) IndexWithLogicalSizesTo(prefix string, w io.Writer) error {
+	return v.indexTo(prefix, w, true)
+}
+
+func (v *UnixVolume) indexTo(prefix string, w io.Writer, logicalSizes bool) error {
 	rootdir, err := v.os.Open(v.Root)
 	if err != nil {
 		return err
@@ -419,10 +434,18 @@ func (v *UnixVolume) IndexTo(prefix string, w io.Writer) error {
 			if !blockFileRe.MatchString(name) {
 				continue
 			}
+			var logical string
+			if logicalSizes {
+				buf, err := v.os.Getxattr(filepath.Join(blockdirpath, name), xattrLogicalSize)
+				if n, perr := strconv.Atoi(string(buf)); err == nil && perr == nil {
+					logical = " " + strconv.Itoa(n)
+				}
+			}
 			_, err = fmt.Fprint(w,
 				name,
 				"+", fileInfo.Size(),
 				" ", fileInfo.ModTime().UnixNano(),
+				logical,
 				"\n")
 			if err != nil {
 				return fmt.Errorf("error writing: %s", err)
@@ -646,7 +669,7 @@ func (v *UnixVolume) translateError(err error) error {
 	}
 }
 
-var unixTrashLocRegexp = regexp.MustCompile(`/([0-9a-f]{32})\.trash\.(\d+)$`)
+var unixTrashLocRegexp = regexp.MustCompile(`/([0-9a-f]{32}(?:\.\d+\.\d+)?)\.trash\.(\d+)$`)
 
 // EmptyTrash walks hierarchy looking for {hash}.trash.*
 // and deletes those with deadline < now.
@@ -739,6 +762,7 @@ type unixStats struct {
 	RenameOps  uint64
 	UnlinkOps  uint64
 	ReaddirOps uint64
+	XattrOps   uint64
 }
 
 func (s *unixStats) TickErr(err error) {
@@ -792,6 +816,32 @@ func (o *osWithStats) Stat(path string) (os.FileInfo, error) {
 	return fi, err
 }
 
+func (o *osWithStats) Setxattr(path, attr string, data []byte) error {
+	o.stats.TickOps("setxattr")
+	o.stats.Tick(&o.stats.XattrOps)
+	err := unix.Setxattr(path, attr, data, 0)
+	o.stats.TickErr(err)
+	return err
+}
+
+// Getxattr returns the value of the given extended attribute, which
+// is expected to be short.
+func (o *osWithStats) Getxattr(path, attr string) ([]byte, error) {
+	o.stats.TickOps("getxattr")
+	o.stats.Tick(&o.stats.XattrOps)
+	var buf [64]byte
+	n, err := unix.Getxattr(path, attr, buf[:])
+	if err == unix.ENODATA {
+		// Not an error: the attribute just isn't set.
+		return nil, err
+	}
+	o.stats.TickErr(err)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
 func (o *osWithStats) TempFile(dir, base string) (*os.File, error) {
 	o.stats.TickOps("create")
 	o.stats.Tick(&o.stats.CreateOps)
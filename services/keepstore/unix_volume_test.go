@@ -21,6 +21,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 	check "gopkg.in/check.v1"
 )
 
@@ -36,7 +37,7 @@ func (v *TestableUnixVolume) PutRaw(locator string, data []byte) {
 		v.volume.ReadOnly = orig
 	}(v.volume.ReadOnly)
 	v.volume.ReadOnly = false
-	err := v.Put(context.Background(), locator, data)
+	err := putWithPipe(context.Background(), locator, data, v)
 	if err != nil {
 		v.t.Fatal(err)
 	}
@@ -129,13 +130,34 @@ func (s *UnixVolumeSuite) TestUnixVolumeHandlersWithGenericVolumeTests(c *check.
 	})
 }
 
+// compressed; serialize = false; readonly = false
+func (s *UnixVolumeSuite) TestUnixVolumeWithGenericTestsCompressed(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return newTestableCompressedVolume(c, s.newTestableUnixVolume(c, cluster, volume, metrics, false), metrics)
+	})
+}
+
+// compressed; serialize = false; readonly = true
+func (s *UnixVolumeSuite) TestUnixVolumeWithGenericTestsCompressedReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return newTestableCompressedVolume(c, s.newTestableUnixVolume(c, cluster, volume, metrics, true), metrics)
+	})
+}
+
+// encrypted; serialize = false; readonly = false
+func (s *UnixVolumeSuite) TestUnixVolumeWithGenericTestsEncrypted(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return newTestableEncryptedVolume(c, s.newTestableUnixVolume(c, cluster, volume, metrics, false))
+	})
+}
+
 func (s *UnixVolumeSuite) TestGetNotFound(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
 	defer v.Teardown()
-	v.Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, v)
 
 	buf := make([]byte, BlockSize)
-	n, err := v.Get(context.Background(), TestHash2, buf)
+	n, err := getWithPipe(context.Background(), TestHash2, buf, v)
 	switch {
 	case os.IsNotExist(err):
 		break
@@ -150,7 +172,7 @@ func (s *UnixVolumeSuite) TestPut(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
 	defer v.Teardown()
 
-	err := v.Put(context.Background(), TestHash, TestBlock)
+	err := putWithPipe(context.Background(), TestHash, TestBlock, v)
 	if err != nil {
 		c.Error(err)
 	}
@@ -163,13 +185,35 @@ func (s *UnixVolumeSuite) TestPut(c *check.C) {
 	}
 }
 
+func (s *UnixVolumeSuite) TestLogicalSize(c *check.C) {
+	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
+	defer v.Teardown()
+
+	err := v.WriteBlockWithLogicalSize(context.Background(), TestHash, bytes.NewReader(TestBlock), len(TestBlock), 12345)
+	c.Assert(err, check.IsNil)
+	if _, err := unix.Getxattr(v.blockPath(TestHash), xattrLogicalSize, nil); err != nil {
+		c.Skip(fmt.Sprintf("extended attributes not supported: %s", err))
+	}
+	c.Assert(v.WriteBlock(context.Background(), TestHash2, bytes.NewReader(TestBlock2), len(TestBlock2)), check.IsNil)
+
+	buf := &bytes.Buffer{}
+	c.Assert(v.IndexWithLogicalSizesTo("", buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, fmt.Sprintf(`(?ms).*^%s\+%d \d+ 12345$.*`, TestHash, len(TestBlock)))
+	c.Check(buf.String(), check.Matches, fmt.Sprintf(`(?ms).*^%s\+%d \d+$.*`, TestHash2, len(TestBlock2)))
+
+	// The recorded size isn't included in the regular index.
+	buf.Reset()
+	c.Assert(v.IndexTo("", buf), check.IsNil)
+	c.Check(buf.String(), check.Not(check.Matches), `(?ms).* 12345$.*`)
+}
+
 func (s *UnixVolumeSuite) TestPutBadVolume(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
 	defer v.Teardown()
 
 	err := os.RemoveAll(v.Root)
 	c.Assert(err, check.IsNil)
-	err = v.Put(context.Background(), TestHash, TestBlock)
+	err = putWithPipe(context.Background(), TestHash, TestBlock, v)
 	c.Check(err, check.IsNil)
 }
 
@@ -180,12 +224,12 @@ func (s *UnixVolumeSuite) TestUnixVolumeReadonly(c *check.C) {
 	v.PutRaw(TestHash, TestBlock)
 
 	buf := make([]byte, BlockSize)
-	_, err := v.Get(context.Background(), TestHash, buf)
+	_, err := getWithPipe(context.Background(), TestHash, buf, v)
 	if err != nil {
 		c.Errorf("got err %v, expected nil", err)
 	}
 
-	err = v.Put(context.Background(), TestHash, TestBlock)
+	err = putWithPipe(context.Background(), TestHash, TestBlock, v)
 	if err != MethodDisabledError {
 		c.Errorf("got err %v, expected MethodDisabledError", err)
 	}
@@ -245,7 +289,7 @@ func (s *UnixVolumeSuite) TestUnixVolumeGetFuncWorkerError(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
 	defer v.Teardown()
 
-	v.Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, v)
 	mockErr := errors.New("Mock error")
 	err := v.getFunc(context.Background(), v.blockPath(TestHash), func(rdr io.Reader) error {
 		return mockErr
@@ -276,7 +320,7 @@ func (s *UnixVolumeSuite) TestUnixVolumeGetFuncWorkerWaitsOnMutex(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
 	defer v.Teardown()
 
-	v.Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, v)
 
 	mtx := NewMockMutex()
 	v.locker = mtx
@@ -307,23 +351,18 @@ func (s *UnixVolumeSuite) TestUnixVolumeGetFuncWorkerWaitsOnMutex(c *check.C) {
 	}
 }
 
-func (s *UnixVolumeSuite) TestUnixVolumeCompare(c *check.C) {
+func (s *UnixVolumeSuite) TestUnixVolumeCheckBlockHash(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
 	defer v.Teardown()
 
-	v.Put(context.Background(), TestHash, TestBlock)
-	err := v.Compare(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, v)
+	err := checkBlockHash(context.Background(), v, TestHash)
 	if err != nil {
 		c.Errorf("Got err %q, expected nil", err)
 	}
 
-	err = v.Compare(context.Background(), TestHash, []byte("baddata"))
-	if err != CollisionError {
-		c.Errorf("Got err %q, expected %q", err, CollisionError)
-	}
-
-	v.Put(context.Background(), TestHash, []byte("baddata"))
-	err = v.Compare(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, []byte("baddata"), v)
+	err = checkBlockHash(context.Background(), v, TestHash)
 	if err != DiskHashError {
 		c.Errorf("Got err %q, expected %q", err, DiskHashError)
 	}
@@ -334,7 +373,7 @@ func (s *UnixVolumeSuite) TestUnixVolumeCompare(c *check.C) {
 		p := fmt.Sprintf("%s/%s/%s", v.Root, TestHash[:3], TestHash)
 		err = os.Chmod(p, 000)
 		c.Assert(err, check.IsNil)
-		err = v.Compare(context.Background(), TestHash, TestBlock)
+		err = checkBlockHash(context.Background(), v, TestHash)
 		c.Check(err, check.ErrorMatches, ".*permission denied.*")
 	}
 }
@@ -350,7 +389,7 @@ func (s *UnixVolumeSuite) TestUnixVolumeContextCancelPut(c *check.C) {
 		time.Sleep(50 * time.Millisecond)
 		v.locker.Unlock()
 	}()
-	err := v.Put(ctx, TestHash, TestBlock)
+	err := putWithPipe(ctx, TestHash, TestBlock, v)
 	if err != context.Canceled {
 		c.Errorf("Put() returned %s -- expected short read / canceled", err)
 	}
@@ -373,7 +412,7 @@ func (s *UnixVolumeSuite) TestUnixVolumeContextCancelGet(c *check.C) {
 		cancel()
 	}()
 	buf := make([]byte, len(TestBlock))
-	n, err := v.Get(ctx, TestHash, buf)
+	n, err := getWithPipe(ctx, TestHash, buf, v)
 	if n == len(TestBlock) || err != context.Canceled {
 		c.Errorf("Get() returned %d, %s -- expected short read / canceled", n, err)
 	}
@@ -391,7 +430,7 @@ func (s *UnixVolumeSuite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"Errors":0,.*`)
 
 	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
-	_, err := vol.Get(context.Background(), loc, make([]byte, 3))
+	_, err := getWithPipe(context.Background(), loc, make([]byte, 3), vol)
 	c.Check(err, check.NotNil)
 	c.Check(stats(), check.Matches, `.*"StatOps":[^0],.*`)
 	c.Check(stats(), check.Matches, `.*"Errors":[^0],.*`)
@@ -400,7 +439,7 @@ func (s *UnixVolumeSuite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"OpenOps":0,.*`)
 	c.Check(stats(), check.Matches, `.*"CreateOps":0,.*`)
 
-	err = vol.Put(context.Background(), loc, []byte("foo"))
+	err = putWithPipe(context.Background(), loc, []byte("foo"), vol)
 	c.Check(err, check.IsNil)
 	c.Check(stats(), check.Matches, `.*"OutBytes":3,.*`)
 	c.Check(stats(), check.Matches, `.*"CreateOps":1,.*`)
@@ -413,9 +452,9 @@ func (s *UnixVolumeSuite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"OpenOps":1,.*`)
 	c.Check(stats(), check.Matches, `.*"UtimesOps":2,.*`)
 
-	_, err = vol.Get(context.Background(), loc, make([]byte, 3))
+	_, err = getWithPipe(context.Background(), loc, make([]byte, 3), vol)
 	c.Check(err, check.IsNil)
-	err = vol.Compare(context.Background(), loc, []byte("foo"))
+	err = checkBlockHash(context.Background(), vol, loc)
 	c.Check(err, check.IsNil)
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 	c.Check(stats(), check.Matches, `.*"OpenOps":3,.*`)
@@ -15,13 +15,14 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 	"github.com/sirupsen/logrus"
 )
 
 type BlockWriter interface {
-	// WriteBlock reads all data from r, writes it to a backing
-	// store as "loc", and returns the number of bytes written.
-	WriteBlock(ctx context.Context, loc string, r io.Reader) error
+	// WriteBlock reads size bytes from r and writes them to a
+	// backing store as "loc".
+	WriteBlock(ctx context.Context, loc string, r io.Reader, size int) error
 }
 
 type BlockReader interface {
@@ -36,15 +37,21 @@ var driver = map[string]func(*arvados.Cluster, arvados.Volume, logrus.FieldLogge
 // for example, a single mounted disk, a RAID array, an Amazon S3 volume,
 // etc.
 type Volume interface {
-	// Get a block: copy the block data into buf, and return the
-	// number of bytes copied.
+	// ReadBlock retrieves a block and writes its content to w as
+	// it is read from the backing store.
 	//
 	// loc is guaranteed to consist of 32 or more lowercase hex
 	// digits.
 	//
-	// Get should not verify the integrity of the data: it should
-	// just return whatever was found in its backing
-	// store. (Integrity checking is the caller's responsibility.)
+	// ReadBlock should not verify the integrity of the data: it
+	// should just write whatever was found in its backing
+	// store. (Integrity checking is the caller's responsibility,
+	// typically by passing a hashCheckWriter as w.)
+	//
+	// ReadBlock must not write anything to w until it has
+	// established that the block exists and can be read. This
+	// allows the caller to try a different volume when
+	// ReadBlock returns an error without writing any data.
 	//
 	// If an error is encountered that prevents it from
 	// retrieving the data, that error should be returned so the
@@ -59,54 +66,55 @@ type Volume interface {
 	// access log if the block is not found on any other volumes
 	// either).
 	//
-	// If the data in the backing store is bigger than len(buf),
-	// then Get is permitted to return an error without reading
-	// any of the data.
-	//
-	// len(buf) will not exceed BlockSize.
-	Get(ctx context.Context, loc string, buf []byte) (int, error)
-
-	// Compare the given data with the stored data (i.e., what Get
-	// would return). If equal, return nil. If not, return
-	// CollisionError or DiskHashError (depending on whether the
-	// data on disk matches the expected hash), or whatever error
-	// was encountered opening/reading the stored data.
-	Compare(ctx context.Context, loc string, data []byte) error
+	// If the data in the backing store is bigger than
+	// maxStoredBlockSize, ReadBlock is permitted to return an
+	// error without writing any of the data.
+	BlockReader
 
-	// Put writes a block to an underlying storage device.
+	// WriteBlock reads size bytes from r and writes them to an
+	// underlying storage device as a block.
 	//
-	// loc is as described in Get.
+	// loc is as described in ReadBlock.
 	//
-	// len(block) is guaranteed to be between 0 and BlockSize.
+	// size is guaranteed to be between 0 and maxStoredBlockSize
+	// (which is slightly bigger than BlockSize, to allow for
+	// headers added by volume wrappers like encryptedVolume).
 	//
-	// If a block is already stored under the same name (loc) with
-	// different content, Put must either overwrite the existing
-	// data with the new data or return a non-nil error. When
-	// overwriting existing data, it must never leave the storage
-	// device in an inconsistent state: a subsequent call to Get
-	// must return either the entire old block, the entire new
-	// block, or an error. (An implementation that cannot peform
-	// atomic updates must leave the old data alone and return an
-	// error.)
-	//
-	// Put also sets the timestamp for the given locator to the
-	// current time.
+	// If r returns an error (for example, because the data read
+	// so far does not match the expected hash), WriteBlock must
+	// return a non-nil error and must not leave a partial or
+	// corrupt block in place of loc.
 	//
-	// Put must return a non-nil error unless it can guarantee
-	// that the entire block has been written and flushed to
-	// persistent storage, and that its timestamp is current. Of
-	// course, this guarantee is only as good as the underlying
-	// storage device, but it is Put's responsibility to at least
-	// get whatever guarantee is offered by the storage device.
-	//
-	// Put should not verify that loc==hash(block): this is the
-	// caller's responsibility.
-	Put(ctx context.Context, loc string, block []byte) error
+	// If a block is already stored under the same name (loc) with
+	// different content, WriteBlock must either overwrite the
+	// existing data with the new data or return a non-nil
+	// error. When overwriting existing data, it must never leave
+	// the storage device in an inconsistent state: a subsequent
+	// call to ReadBlock must return either the entire old block,
+	// the entire new block, or an error. (An implementation that
+	// cannot peform atomic updates must leave the old data alone
+	// and return an error.)
+	//
+	// WriteBlock also sets the timestamp for the given locator to
+	// the current time.
+	//
+	// WriteBlock must return a non-nil error unless it can
+	// guarantee that the entire block has been written and
+	// flushed to persistent storage, and that its timestamp is
+	// current. Of course, this guarantee is only as good as the
+	// underlying storage device, but it is WriteBlock's
+	// responsibility to at least get whatever guarantee is
+	// offered by the storage device.
+	//
+	// WriteBlock should not verify that loc==hash(block): this
+	// is the caller's responsibility, typically by passing a
+	// hashCheckReader as r.
+	BlockWriter
 
 	// Touch sets the timestamp for the given locator to the
 	// current time.
 	//
-	// loc is as described in Get.
+	// loc is as described in ReadBlock.
 	//
 	// If invoked at time t0, Touch must guarantee that a
 	// subsequent call to Mtime will return a timestamp no older
@@ -131,14 +139,14 @@ type Volume interface {
 
 	// Mtime returns the stored timestamp for the given locator.
 	//
-	// loc is as described in Get.
+	// loc is as described in ReadBlock.
 	//
 	// Mtime must return a non-nil error if the given block is not
 	// found or the timestamp could not be retrieved.
 	Mtime(loc string) (time.Time, error)
 
 	// IndexTo writes a complete list of locators with the given
-	// prefix for which Get() can retrieve data.
+	// prefix for which ReadBlock() can retrieve data.
 	//
 	// prefix consists of zero or more lowercase hexadecimal
 	// digits.
@@ -173,16 +181,16 @@ type Volume interface {
 	// device to trash area. The block then stays in trash for
 	// BlobTrashLifetime before it is actually deleted.
 	//
-	// loc is as described in Get.
+	// loc is as described in ReadBlock.
 	//
 	// If the timestamp for the given locator is newer than
 	// BlobSigningTTL, Trash must not trash the data.
 	//
-	// If a Trash operation overlaps with any Touch or Put
+	// If a Trash operation overlaps with any Touch or WriteBlock
 	// operations on the same locator, the implementation must
 	// ensure one of the following outcomes:
 	//
-	//   - Touch and Put return a non-nil error, or
+	//   - Touch and WriteBlock return a non-nil error, or
 	//   - Trash does not trash the block, or
 	//   - Both of the above.
 	//
@@ -196,7 +204,7 @@ type Volume interface {
 	// with the same underlying storage device must either work
 	// reliably or fail outright.
 	//
-	// Corollary: A successful Touch or Put guarantees a block
+	// Corollary: A successful Touch or WriteBlock guarantees a block
 	// will not be trashed for at least BlobSigningTTL seconds.
 	Trash(loc string) error
 
@@ -269,6 +277,54 @@ type VolumeManager interface {
 type VolumeMount struct {
 	arvados.KeepMount
 	Volume
+
+	// Blocks found to be corrupt by the scrubber
+	corrupt corruptBlockSet
+
+	// Blocks changed since keep-balance last asked
+	changes *changeJournal
+}
+
+// WriteBlock writes a block to the mount's volume. If the block was
+// previously found to be corrupt, it is no longer considered
+// corrupt.
+func (mnt *VolumeMount) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
+	err := mnt.Volume.WriteBlock(ctx, loc, rdr, size)
+	if err == nil {
+		mnt.corrupt.forget(loc)
+		mnt.changes.record(loc, size)
+	}
+	return err
+}
+
+// Touch updates the block's timestamp on the mount's volume, and
+// records the change in the mount's change journal.
+func (mnt *VolumeMount) Touch(loc string) error {
+	err := mnt.Volume.Touch(loc)
+	if err == nil {
+		mnt.changes.record(loc, -1)
+	}
+	return err
+}
+
+// Trash moves the block to the trash on the mount's volume, and
+// records the change in the mount's change journal.
+func (mnt *VolumeMount) Trash(loc string) error {
+	err := mnt.Volume.Trash(loc)
+	if err == nil {
+		mnt.changes.record(loc, -1)
+	}
+	return err
+}
+
+// Untrash restores the block from the trash on the mount's volume,
+// and records the change in the mount's change journal.
+func (mnt *VolumeMount) Untrash(loc string) error {
+	err := mnt.Volume.Untrash(loc)
+	if err == nil {
+		mnt.changes.record(loc, -1)
+	}
+	return err
 }
 
 // Generate a UUID the way API server would for a "KeepVolumeMount"
@@ -296,13 +352,38 @@ type RRVolumeManager struct {
 	writables []*VolumeMount
 	counter   uint32
 	iostats   map[Volume]*ioStats
+
+	// codecs maps each erasure-coded storage class to the codec
+	// used to encode its blocks.
+	codecs map[string]*erasure.Codec
+	// shardVolumes lists the volumes, on this server and others,
+	// where each erasure-coded storage class can store shards.
+	shardVolumes map[string][]erasure.Volume
+	// remoteShardStores provides access to shards on volumes
+	// through other keepstore servers.
+	remoteShardStores map[string]*remoteShardStore
 }
 
 func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, myURL arvados.URL, metrics *volumeMetricsVecs) (*RRVolumeManager, error) {
 	vm := &RRVolumeManager{
 		iostats: make(map[Volume]*ioStats),
+		codecs:  make(map[string]*erasure.Codec),
+	}
+	for class, sccfg := range cluster.StorageClasses {
+		if !sccfg.ErasureCoding.Enabled() {
+			continue
+		}
+		codec, err := erasure.New(sccfg.ErasureCoding.DataShards, sccfg.ErasureCoding.ParityShards)
+		if err != nil {
+			return nil, fmt.Errorf("storage class %q: %s", class, err)
+		}
+		vm.codecs[class] = codec
 	}
+	vm.setupShardVolumes(cluster)
 	vm.mountMap = make(map[string]*VolumeMount)
+	// Volume wrapper buffer pools are shared by all volumes, and
+	// only allocated if needed.
+	var encryptionBufs, compressionBufs *bufferPool
 	for uuid, cfgvol := range cluster.Volumes {
 		va, ok := cfgvol.AccessViaHosts[myURL]
 		if !ok && len(cfgvol.AccessViaHosts) > 0 {
@@ -316,6 +397,26 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 		if err != nil {
 			return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
 		}
+		if cfgvol.Encryption.KeyProvider != "" {
+			if encryptionBufs == nil {
+				encryptionBufs = newWrapperBufferPool(logger, cluster, maxStoredBlockSize)
+			}
+			vol, err = newEncryptedVolume(vol, cfgvol.Encryption, encryptionBufs)
+			if err != nil {
+				return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
+			}
+		}
+		// Compress before encrypting: encrypted data doesn't
+		// compress.
+		if cfgvol.Compression != "" {
+			if compressionBufs == nil {
+				compressionBufs = newWrapperBufferPool(logger, cluster, compressedVolumeBufSize)
+			}
+			vol, err = newCompressedVolume(vol, cfgvol.Compression, metrics, compressionBufs)
+			if err != nil {
+				return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
+			}
+		}
 		logger.Printf("started volume %s (%s), ReadOnly=%v", uuid, vol, cfgvol.ReadOnly || va.ReadOnly)
 
 		sc := cfgvol.StorageClasses
@@ -334,7 +435,8 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 				Replication:    repl,
 				StorageClasses: sc,
 			},
-			Volume: vol,
+			Volume:  vol,
+			changes: newChangeJournal(),
 		}
 		vm.iostats[vol] = &ioStats{}
 		vm.mounts = append(vm.mounts, mnt)
@@ -388,13 +490,24 @@ func (vm *RRVolumeManager) Lookup(uuid string, needWrite bool) *VolumeMount {
 	return nil
 }
 
+// erasureCodedClasses returns the names of the erasure-coded storage
+// classes, sorted by name.
+func (vm *RRVolumeManager) erasureCodedClasses() []string {
+	var classes []string
+	for class := range vm.codecs {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
 // AllReadable returns an array of all readable volumes
 func (vm *RRVolumeManager) AllReadable() []*VolumeMount {
 	return vm.readables
 }
 
 // AllWritable returns writable volumes, sorted by priority/uuid. Used
-// by CompareAndTouch to ensure higher-priority volumes are checked
+// by TouchExisting to ensure higher-priority volumes are checked
 // first.
 func (vm *RRVolumeManager) AllWritable() []*VolumeMount {
 	return vm.writables
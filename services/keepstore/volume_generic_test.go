@@ -51,15 +51,12 @@ func DoGenericVolumeTests(t TB, readonly bool, factory TestableVolumeFactory) {
 	s.testGet(t, factory)
 	s.testGetNoSuchBlock(t, factory)
 
-	s.testCompareNonexistent(t, factory)
-	s.testCompareSameContent(t, factory, TestHash, TestBlock)
-	s.testCompareSameContent(t, factory, EmptyHash, EmptyBlock)
-	s.testCompareWithCollision(t, factory, TestHash, TestBlock, []byte("baddata"))
-	s.testCompareWithCollision(t, factory, TestHash, TestBlock, EmptyBlock)
-	s.testCompareWithCollision(t, factory, EmptyHash, EmptyBlock, TestBlock)
-	s.testCompareWithCorruptStoredData(t, factory, TestHash, TestBlock, []byte("baddata"))
-	s.testCompareWithCorruptStoredData(t, factory, TestHash, TestBlock, EmptyBlock)
-	s.testCompareWithCorruptStoredData(t, factory, EmptyHash, EmptyBlock, []byte("baddata"))
+	s.testCheckBlockHashNonexistent(t, factory)
+	s.testCheckBlockHashSameContent(t, factory, TestHash, TestBlock)
+	s.testCheckBlockHashSameContent(t, factory, EmptyHash, EmptyBlock)
+	s.testCheckBlockHashWithCorruptStoredData(t, factory, TestHash, TestBlock, []byte("baddata"))
+	s.testCheckBlockHashWithCorruptStoredData(t, factory, TestHash, TestBlock, EmptyBlock)
+	s.testCheckBlockHashWithCorruptStoredData(t, factory, EmptyHash, EmptyBlock, []byte("baddata"))
 
 	if !readonly {
 		s.testPutBlockWithSameContent(t, factory, TestHash, TestBlock)
@@ -134,7 +131,7 @@ func (s *genericVolumeSuite) testGet(t TB, factory TestableVolumeFactory) {
 	v.PutRaw(TestHash, TestBlock)
 
 	buf := make([]byte, BlockSize)
-	n, err := v.Get(context.Background(), TestHash, buf)
+	n, err := getWithPipe(context.Background(), TestHash, buf, v)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -152,74 +149,55 @@ func (s *genericVolumeSuite) testGetNoSuchBlock(t TB, factory TestableVolumeFact
 	defer v.Teardown()
 
 	buf := make([]byte, BlockSize)
-	if _, err := v.Get(context.Background(), TestHash2, buf); err == nil {
+	if _, err := getWithPipe(context.Background(), TestHash2, buf, v); err == nil {
 		t.Errorf("Expected error while getting non-existing block %v", TestHash2)
 	}
 }
 
-// Compare() should return os.ErrNotExist if the block does not exist.
-// Otherwise, writing new data causes CompareAndTouch() to generate
-// error logs even though everything is working fine.
-func (s *genericVolumeSuite) testCompareNonexistent(t TB, factory TestableVolumeFactory) {
+// ReadBlock() (and therefore checkBlockHash()) should return
+// os.ErrNotExist if the block does not exist. Otherwise, writing new
+// data causes TouchExisting() to generate error logs even though
+// everything is working fine.
+func (s *genericVolumeSuite) testCheckBlockHashNonexistent(t TB, factory TestableVolumeFactory) {
 	s.setup(t)
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
-	err := v.Compare(context.Background(), TestHash, TestBlock)
-	if err != os.ErrNotExist {
+	err := checkBlockHash(context.Background(), v, TestHash)
+	if !os.IsNotExist(err) {
 		t.Errorf("Got err %T %q, expected os.ErrNotExist", err, err)
 	}
 }
 
-// Put a test block and compare the locator with same content
+// Put a test block and check the stored content against its hash.
 // Test should pass for both writable and read-only volumes
-func (s *genericVolumeSuite) testCompareSameContent(t TB, factory TestableVolumeFactory, testHash string, testData []byte) {
+func (s *genericVolumeSuite) testCheckBlockHashSameContent(t TB, factory TestableVolumeFactory, testHash string, testData []byte) {
 	s.setup(t)
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
 	v.PutRaw(testHash, testData)
 
-	// Compare the block locator with same content
-	err := v.Compare(context.Background(), testHash, testData)
+	err := checkBlockHash(context.Background(), v, testHash)
 	if err != nil {
 		t.Errorf("Got err %q, expected nil", err)
 	}
 }
 
-// Test behavior of Compare() when stored data matches expected
-// checksum but differs from new data we need to store. Requires
-// testHash = md5(testDataA).
-//
-// Test should pass for both writable and read-only volumes
-func (s *genericVolumeSuite) testCompareWithCollision(t TB, factory TestableVolumeFactory, testHash string, testDataA, testDataB []byte) {
-	s.setup(t)
-	v := s.newVolume(t, factory)
-	defer v.Teardown()
-
-	v.PutRaw(testHash, testDataA)
-
-	// Compare the block locator with different content; collision
-	err := v.Compare(context.Background(), TestHash, testDataB)
-	if err == nil {
-		t.Errorf("Got err nil, expected error due to collision")
-	}
-}
-
-// Test behavior of Compare() when stored data has become
+// Test behavior of checkBlockHash() when stored data has become
 // corrupted. Requires testHash = md5(testDataA) != md5(testDataB).
 //
 // Test should pass for both writable and read-only volumes
-func (s *genericVolumeSuite) testCompareWithCorruptStoredData(t TB, factory TestableVolumeFactory, testHash string, testDataA, testDataB []byte) {
+func (s *genericVolumeSuite) testCheckBlockHashWithCorruptStoredData(t TB, factory TestableVolumeFactory, testHash string, testDataA, testDataB []byte) {
 	s.setup(t)
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
-	v.PutRaw(TestHash, testDataB)
+	v.PutRaw(testHash, testDataB)
 
-	err := v.Compare(context.Background(), testHash, testDataA)
-	if err == nil || err == CollisionError {
-		t.Errorf("Got err %+v, expected non-collision error", err)
+	err := checkBlockHash(context.Background(), v, testHash)
+	if err != DiskHashError {
+		t.Errorf("Got err %+v, expected DiskHashError", err)
 	}
 }
 
@@ -230,12 +208,12 @@ func (s *genericVolumeSuite) testPutBlockWithSameContent(t TB, factory TestableV
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
-	err := v.Put(context.Background(), testHash, testData)
+	err := putWithPipe(context.Background(), testHash, testData, v)
 	if err != nil {
 		t.Errorf("Got err putting block %q: %q, expected nil", TestBlock, err)
 	}
 
-	err = v.Put(context.Background(), testHash, testData)
+	err = putWithPipe(context.Background(), testHash, testData, v)
 	if err != nil {
 		t.Errorf("Got err putting block second time %q: %q, expected nil", TestBlock, err)
 	}
@@ -250,9 +228,9 @@ func (s *genericVolumeSuite) testPutBlockWithDifferentContent(t TB, factory Test
 
 	v.PutRaw(testHash, testDataA)
 
-	putErr := v.Put(context.Background(), testHash, testDataB)
+	putErr := putWithPipe(context.Background(), testHash, testDataB, v)
 	buf := make([]byte, BlockSize)
-	n, getErr := v.Get(context.Background(), testHash, buf)
+	n, getErr := getWithPipe(context.Background(), testHash, buf, v)
 	if putErr == nil {
 		// Put must not return a nil error unless it has
 		// overwritten the existing data.
@@ -276,23 +254,23 @@ func (s *genericVolumeSuite) testPutMultipleBlocks(t TB, factory TestableVolumeF
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
-	err := v.Put(context.Background(), TestHash, TestBlock)
+	err := putWithPipe(context.Background(), TestHash, TestBlock, v)
 	if err != nil {
 		t.Errorf("Got err putting block %q: %q, expected nil", TestBlock, err)
 	}
 
-	err = v.Put(context.Background(), TestHash2, TestBlock2)
+	err = putWithPipe(context.Background(), TestHash2, TestBlock2, v)
 	if err != nil {
 		t.Errorf("Got err putting block %q: %q, expected nil", TestBlock2, err)
 	}
 
-	err = v.Put(context.Background(), TestHash3, TestBlock3)
+	err = putWithPipe(context.Background(), TestHash3, TestBlock3, v)
 	if err != nil {
 		t.Errorf("Got err putting block %q: %q, expected nil", TestBlock3, err)
 	}
 
 	data := make([]byte, BlockSize)
-	n, err := v.Get(context.Background(), TestHash, data)
+	n, err := getWithPipe(context.Background(), TestHash, data, v)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -301,7 +279,7 @@ func (s *genericVolumeSuite) testPutMultipleBlocks(t TB, factory TestableVolumeF
 		}
 	}
 
-	n, err = v.Get(context.Background(), TestHash2, data)
+	n, err = getWithPipe(context.Background(), TestHash2, data, v)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -310,7 +288,7 @@ func (s *genericVolumeSuite) testPutMultipleBlocks(t TB, factory TestableVolumeF
 		}
 	}
 
-	n, err = v.Get(context.Background(), TestHash3, data)
+	n, err = getWithPipe(context.Background(), TestHash3, data, v)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -329,7 +307,7 @@ func (s *genericVolumeSuite) testPutAndTouch(t TB, factory TestableVolumeFactory
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
-	if err := v.Put(context.Background(), TestHash, TestBlock); err != nil {
+	if err := putWithPipe(context.Background(), TestHash, TestBlock, v); err != nil {
 		t.Error(err)
 	}
 
@@ -349,7 +327,7 @@ func (s *genericVolumeSuite) testPutAndTouch(t TB, factory TestableVolumeFactory
 	}
 
 	// Write the same block again.
-	if err := v.Put(context.Background(), TestHash, TestBlock); err != nil {
+	if err := putWithPipe(context.Background(), TestHash, TestBlock, v); err != nil {
 		t.Error(err)
 	}
 
@@ -472,13 +450,13 @@ func (s *genericVolumeSuite) testDeleteNewBlock(t TB, factory TestableVolumeFact
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
-	v.Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, v)
 
 	if err := v.Trash(TestHash); err != nil {
 		t.Error(err)
 	}
 	data := make([]byte, BlockSize)
-	n, err := v.Get(context.Background(), TestHash, data)
+	n, err := getWithPipe(context.Background(), TestHash, data, v)
 	if err != nil {
 		t.Error(err)
 	} else if bytes.Compare(data[:n], TestBlock) != 0 {
@@ -495,14 +473,14 @@ func (s *genericVolumeSuite) testDeleteOldBlock(t TB, factory TestableVolumeFact
 	v := s.newVolume(t, factory)
 	defer v.Teardown()
 
-	v.Put(context.Background(), TestHash, TestBlock)
+	putWithPipe(context.Background(), TestHash, TestBlock, v)
 	v.TouchWithDate(TestHash, time.Now().Add(-2*s.cluster.Collections.BlobSigningTTL.Duration()))
 
 	if err := v.Trash(TestHash); err != nil {
 		t.Error(err)
 	}
 	data := make([]byte, BlockSize)
-	if _, err := v.Get(context.Background(), TestHash, data); err == nil || !os.IsNotExist(err) {
+	if _, err := getWithPipe(context.Background(), TestHash, data, v); err == nil || !os.IsNotExist(err) {
 		t.Errorf("os.IsNotExist(%v) should have been true", err)
 	}
 
@@ -511,7 +489,7 @@ func (s *genericVolumeSuite) testDeleteOldBlock(t TB, factory TestableVolumeFact
 		t.Fatalf("os.IsNotExist(%v) should have been true", err)
 	}
 
-	err = v.Compare(context.Background(), TestHash, TestBlock)
+	err = checkBlockHash(context.Background(), v, TestHash)
 	if err == nil || !os.IsNotExist(err) {
 		t.Fatalf("os.IsNotExist(%v) should have been true", err)
 	}
@@ -601,7 +579,7 @@ func (s *genericVolumeSuite) testMetrics(t TB, readonly bool, factory TestableVo
 
 	// Test Put if volume is writable
 	if !readonly {
-		err = v.Put(context.Background(), TestHash, TestBlock)
+		err = putWithPipe(context.Background(), TestHash, TestBlock, v)
 		if err != nil {
 			t.Errorf("Got err putting block %q: %q, expected nil", TestBlock, err)
 		}
@@ -619,7 +597,7 @@ func (s *genericVolumeSuite) testMetrics(t TB, readonly bool, factory TestableVo
 	}
 
 	buf := make([]byte, BlockSize)
-	_, err = v.Get(context.Background(), TestHash, buf)
+	_, err = getWithPipe(context.Background(), TestHash, buf, v)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -658,17 +636,17 @@ func (s *genericVolumeSuite) testUpdateReadOnly(t TB, factory TestableVolumeFact
 	buf := make([]byte, BlockSize)
 
 	// Get from read-only volume should succeed
-	_, err := v.Get(context.Background(), TestHash, buf)
+	_, err := getWithPipe(context.Background(), TestHash, buf, v)
 	if err != nil {
 		t.Errorf("got err %v, expected nil", err)
 	}
 
 	// Put a new block to read-only volume should result in error
-	err = v.Put(context.Background(), TestHash2, TestBlock2)
+	err = putWithPipe(context.Background(), TestHash2, TestBlock2, v)
 	if err == nil {
 		t.Errorf("Expected error when putting block in a read-only volume")
 	}
-	_, err = v.Get(context.Background(), TestHash2, buf)
+	_, err = getWithPipe(context.Background(), TestHash2, buf, v)
 	if err == nil {
 		t.Errorf("Expected error when getting block whose put in read-only volume failed")
 	}
@@ -686,7 +664,7 @@ func (s *genericVolumeSuite) testUpdateReadOnly(t TB, factory TestableVolumeFact
 	}
 
 	// Overwriting an existing block in read-only volume should result in error
-	err = v.Put(context.Background(), TestHash, TestBlock)
+	err = putWithPipe(context.Background(), TestHash, TestBlock, v)
 	if err == nil {
 		t.Errorf("Expected error when putting block in a read-only volume")
 	}
@@ -706,7 +684,7 @@ func (s *genericVolumeSuite) testGetConcurrent(t TB, factory TestableVolumeFacto
 	sem := make(chan int)
 	go func() {
 		buf := make([]byte, BlockSize)
-		n, err := v.Get(context.Background(), TestHash, buf)
+		n, err := getWithPipe(context.Background(), TestHash, buf, v)
 		if err != nil {
 			t.Errorf("err1: %v", err)
 		}
@@ -718,7 +696,7 @@ func (s *genericVolumeSuite) testGetConcurrent(t TB, factory TestableVolumeFacto
 
 	go func() {
 		buf := make([]byte, BlockSize)
-		n, err := v.Get(context.Background(), TestHash2, buf)
+		n, err := getWithPipe(context.Background(), TestHash2, buf, v)
 		if err != nil {
 			t.Errorf("err2: %v", err)
 		}
@@ -730,7 +708,7 @@ func (s *genericVolumeSuite) testGetConcurrent(t TB, factory TestableVolumeFacto
 
 	go func() {
 		buf := make([]byte, BlockSize)
-		n, err := v.Get(context.Background(), TestHash3, buf)
+		n, err := getWithPipe(context.Background(), TestHash3, buf, v)
 		if err != nil {
 			t.Errorf("err3: %v", err)
 		}
@@ -755,7 +733,7 @@ func (s *genericVolumeSuite) testPutConcurrent(t TB, factory TestableVolumeFacto
 
 	sem := make(chan int)
 	go func(sem chan int) {
-		err := v.Put(context.Background(), TestHash, TestBlock)
+		err := putWithPipe(context.Background(), TestHash, TestBlock, v)
 		if err != nil {
 			t.Errorf("err1: %v", err)
 		}
@@ -763,7 +741,7 @@ func (s *genericVolumeSuite) testPutConcurrent(t TB, factory TestableVolumeFacto
 	}(sem)
 
 	go func(sem chan int) {
-		err := v.Put(context.Background(), TestHash2, TestBlock2)
+		err := putWithPipe(context.Background(), TestHash2, TestBlock2, v)
 		if err != nil {
 			t.Errorf("err2: %v", err)
 		}
@@ -771,7 +749,7 @@ func (s *genericVolumeSuite) testPutConcurrent(t TB, factory TestableVolumeFacto
 	}(sem)
 
 	go func(sem chan int) {
-		err := v.Put(context.Background(), TestHash3, TestBlock3)
+		err := putWithPipe(context.Background(), TestHash3, TestBlock3, v)
 		if err != nil {
 			t.Errorf("err3: %v", err)
 		}
@@ -785,7 +763,7 @@ func (s *genericVolumeSuite) testPutConcurrent(t TB, factory TestableVolumeFacto
 
 	// Double check that we actually wrote the blocks we expected to write.
 	buf := make([]byte, BlockSize)
-	n, err := v.Get(context.Background(), TestHash, buf)
+	n, err := getWithPipe(context.Background(), TestHash, buf, v)
 	if err != nil {
 		t.Errorf("Get #1: %v", err)
 	}
@@ -793,7 +771,7 @@ func (s *genericVolumeSuite) testPutConcurrent(t TB, factory TestableVolumeFacto
 		t.Errorf("Get #1: expected %s, got %s", string(TestBlock), string(buf[:n]))
 	}
 
-	n, err = v.Get(context.Background(), TestHash2, buf)
+	n, err = getWithPipe(context.Background(), TestHash2, buf, v)
 	if err != nil {
 		t.Errorf("Get #2: %v", err)
 	}
@@ -801,7 +779,7 @@ func (s *genericVolumeSuite) testPutConcurrent(t TB, factory TestableVolumeFacto
 		t.Errorf("Get #2: expected %s, got %s", string(TestBlock2), string(buf[:n]))
 	}
 
-	n, err = v.Get(context.Background(), TestHash3, buf)
+	n, err = getWithPipe(context.Background(), TestHash3, buf, v)
 	if err != nil {
 		t.Errorf("Get #3: %v", err)
 	}
@@ -820,12 +798,12 @@ func (s *genericVolumeSuite) testPutFullBlock(t TB, factory TestableVolumeFactor
 	wdata[0] = 'a'
 	wdata[BlockSize-1] = 'z'
 	hash := fmt.Sprintf("%x", md5.Sum(wdata))
-	err := v.Put(context.Background(), hash, wdata)
+	err := putWithPipe(context.Background(), hash, wdata, v)
 	if err != nil {
 		t.Fatal(err)
 	}
 	buf := make([]byte, BlockSize)
-	n, err := v.Get(context.Background(), hash, buf)
+	n, err := getWithPipe(context.Background(), hash, buf, v)
 	if err != nil {
 		t.Error(err)
 	}
@@ -849,7 +827,7 @@ func (s *genericVolumeSuite) testTrashUntrash(t TB, readonly bool, factory Testa
 	v.TouchWithDate(TestHash, time.Now().Add(-2*s.cluster.Collections.BlobSigningTTL.Duration()))
 
 	buf := make([]byte, BlockSize)
-	n, err := v.Get(context.Background(), TestHash, buf)
+	n, err := getWithPipe(context.Background(), TestHash, buf, v)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -868,7 +846,7 @@ func (s *genericVolumeSuite) testTrashUntrash(t TB, readonly bool, factory Testa
 			t.Fatal(err)
 		}
 	} else {
-		_, err = v.Get(context.Background(), TestHash, buf)
+		_, err = getWithPipe(context.Background(), TestHash, buf, v)
 		if err == nil || !os.IsNotExist(err) {
 			t.Errorf("os.IsNotExist(%v) should have been true", err)
 		}
@@ -881,7 +859,7 @@ func (s *genericVolumeSuite) testTrashUntrash(t TB, readonly bool, factory Testa
 	}
 
 	// Get the block - after trash and untrash sequence
-	n, err = v.Get(context.Background(), TestHash, buf)
+	n, err = getWithPipe(context.Background(), TestHash, buf, v)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -897,7 +875,7 @@ func (s *genericVolumeSuite) testTrashEmptyTrashUntrash(t TB, factory TestableVo
 
 	checkGet := func() error {
 		buf := make([]byte, BlockSize)
-		n, err := v.Get(context.Background(), TestHash, buf)
+		n, err := getWithPipe(context.Background(), TestHash, buf, v)
 		if err != nil {
 			return err
 		}
@@ -910,7 +888,7 @@ func (s *genericVolumeSuite) testTrashEmptyTrashUntrash(t TB, factory TestableVo
 			return err
 		}
 
-		err = v.Compare(context.Background(), TestHash, TestBlock)
+		err = checkBlockHash(context.Background(), v, TestHash)
 		if err != nil {
 			return err
 		}
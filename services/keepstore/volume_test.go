@@ -5,12 +5,11 @@
 package keepstore
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"sync"
@@ -31,7 +30,7 @@ var (
 	TestBlock3 = []byte("Now is the time for all good men to come to the aid of their country.")
 	TestHash3  = "eed29bbffbc2dbe5e5ee0bb71888e61f"
 
-	// BadBlock is used to test collisions and corruption.
+	// BadBlock is used to test corruption.
 	// It must not match any test hashes.
 	BadBlock = []byte("The magic words are squeamish ossifrage.")
 
@@ -53,7 +52,7 @@ type TestableVolume interface {
 	ReadWriteOperationLabelValues() (r, w string)
 
 	// Specify the value Mtime() should return, until the next
-	// call to Touch, TouchWithDate, or Put.
+	// call to Touch, TouchWithDate, or WriteBlock.
 	TouchWithDate(locator string, lastPut time.Time)
 
 	// Clean up, delete temporary files.
@@ -69,12 +68,16 @@ type MockVolume struct {
 	Store      map[string][]byte
 	Timestamps map[string]time.Time
 
+	// LogicalSizes has the logical sizes recorded by
+	// WriteBlockWithLogicalSize.
+	LogicalSizes map[string]int
+
 	// Bad volumes return an error for every operation.
 	Bad            bool
 	BadVolumeError error
 
 	// Touchable volumes' Touch() method succeeds for a locator
-	// that has been Put().
+	// that has been written.
 	Touchable bool
 
 	// Gate is a "starting gate", allowing test cases to pause
@@ -100,16 +103,17 @@ func newMockVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logru
 	gate := make(chan struct{})
 	close(gate)
 	return &MockVolume{
-		Store:      make(map[string][]byte),
-		Timestamps: make(map[string]time.Time),
-		Bad:        false,
-		Touchable:  true,
-		called:     map[string]int{},
-		Gate:       gate,
-		cluster:    cluster,
-		volume:     volume,
-		logger:     logger,
-		metrics:    metrics,
+		Store:        make(map[string][]byte),
+		Timestamps:   make(map[string]time.Time),
+		LogicalSizes: make(map[string]int),
+		Bad:          false,
+		Touchable:    true,
+		called:       map[string]int{},
+		Gate:         gate,
+		cluster:      cluster,
+		volume:       volume,
+		logger:       logger,
+		metrics:      metrics,
 	}, nil
 }
 
@@ -134,38 +138,20 @@ func (v *MockVolume) gotCall(method string) {
 	}
 }
 
-func (v *MockVolume) Compare(ctx context.Context, loc string, buf []byte) error {
-	v.gotCall("Compare")
+func (v *MockVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
+	v.gotCall("ReadBlock")
 	<-v.Gate
 	if v.Bad {
 		return v.BadVolumeError
 	} else if block, ok := v.Store[loc]; ok {
-		if fmt.Sprintf("%x", md5.Sum(block)) != loc {
-			return DiskHashError
-		}
-		if bytes.Compare(buf, block) != 0 {
-			return CollisionError
-		}
-		return nil
-	} else {
-		return os.ErrNotExist
-	}
-}
-
-func (v *MockVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
-	v.gotCall("Get")
-	<-v.Gate
-	if v.Bad {
-		return 0, v.BadVolumeError
-	} else if block, ok := v.Store[loc]; ok {
-		copy(buf[:len(block)], block)
-		return len(block), nil
+		_, err := w.Write(block)
+		return err
 	}
-	return 0, os.ErrNotExist
+	return os.ErrNotExist
 }
 
-func (v *MockVolume) Put(ctx context.Context, loc string, block []byte) error {
-	v.gotCall("Put")
+func (v *MockVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader, size int) error {
+	v.gotCall("WriteBlock")
 	<-v.Gate
 	if v.Bad {
 		return v.BadVolumeError
@@ -173,8 +159,25 @@ func (v *MockVolume) Put(ctx context.Context, loc string, block []byte) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
+	block, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
 	v.Store[loc] = block
-	return v.Touch(loc)
+	delete(v.LogicalSizes, loc)
+	// Set the timestamp directly, so the "Touch" call count
+	// reflects only the caller's own calls to Touch.
+	v.Timestamps[loc] = time.Now()
+	return nil
+}
+
+func (v *MockVolume) WriteBlockWithLogicalSize(ctx context.Context, loc string, rdr io.Reader, size, logicalSize int) error {
+	err := v.WriteBlock(ctx, loc, rdr, size)
+	if err != nil {
+		return err
+	}
+	v.LogicalSizes[loc] = logicalSize
+	return nil
 }
 
 func (v *MockVolume) Touch(loc string) error {
@@ -213,14 +216,26 @@ func (v *MockVolume) Mtime(loc string) (time.Time, error) {
 }
 
 func (v *MockVolume) IndexTo(prefix string, w io.Writer) error {
+	return v.indexTo(prefix, w, false)
+}
+
+func (v *MockVolume) IndexWithLogicalSizesTo(prefix string, w io.Writer) error {
+	return v.indexTo(prefix, w, true)
+}
+
+func (v *MockVolume) indexTo(prefix string, w io.Writer, logicalSizes bool) error {
 	v.gotCall("IndexTo")
 	<-v.Gate
 	for loc, block := range v.Store {
 		if !IsValidLocator(loc) || !strings.HasPrefix(loc, prefix) {
 			continue
 		}
-		_, err := fmt.Fprintf(w, "%s+%d %d\n",
-			loc, len(block), 123456789)
+		var logical string
+		if size, ok := v.LogicalSizes[loc]; ok && logicalSizes {
+			logical = fmt.Sprintf(" %d", size)
+		}
+		_, err := fmt.Fprintf(w, "%s+%d %d%s\n",
+			loc, len(block), 123456789, logical)
 		if err != nil {
 			return err
 		}
@@ -239,6 +254,8 @@ func (v *MockVolume) Trash(loc string) error {
 			return nil
 		}
 		delete(v.Store, loc)
+		delete(v.LogicalSizes, loc)
+		delete(v.Timestamps, loc)
 		return nil
 	}
 	return os.ErrNotExist
@@ -0,0 +1,270 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// Volume wrappers (compressedVolume, encryptedVolume) transform
+// block data on its way to and from an underlying Volume. The
+// locator always refers to the logical content.
+
+const (
+	// Maximum number of bytes a volume wrapper can add to the
+	// size of a block.
+	maxWrapperOverhead = 1024
+
+	// Maximum size of the data stored by a Volume driver for a
+	// single block.
+	maxStoredBlockSize = BlockSize + maxWrapperOverhead
+
+	// Maximum number of logical block sizes remembered by a
+	// logicalSizeIndex.
+	logicalSizeCacheMax = 1 << 20
+)
+
+var errBufferFull = errors.New("buffer full")
+
+// newWrapperBufferPool returns a pool of buffers of the given size
+// for one volume wrapper layer, limited to the same number of
+// buffers as the main keepstore buffer pool.
+//
+// Each layer has its own pool, and each operation takes a single
+// buffer from it, so an operation that is already holding a buffer
+// from bufs or from an outer layer (e.g., a compressedVolume writing
+// to an encryptedVolume) never waits for a buffer from a pool it is
+// already using.
+func newWrapperBufferPool(logger logrus.FieldLogger, cluster *arvados.Cluster, bufSize int) *bufferPool {
+	count := cluster.API.MaxKeepBlobBuffers
+	if count < 1 {
+		count = 1
+	}
+	return newBufferPool(logger, count, bufSize)
+}
+
+// A logicalSizeVolume is a Volume that can record the logical size
+// of a block written by a volume wrapper along with the stored
+// data, so the wrapper can build an index without reading the
+// header of every stored block.
+//
+// The recorded size is always the size of the block's content as
+// identified by its locator, so when wrappers are nested the
+// outermost wrapper's logical size is passed through to the
+// underlying volume.
+type logicalSizeVolume interface {
+	Volume
+
+	// WriteBlockWithLogicalSize is like WriteBlock, and also
+	// records logicalSize, if possible.
+	WriteBlockWithLogicalSize(ctx context.Context, loc string, rdr io.Reader, size, logicalSize int) error
+
+	// IndexWithLogicalSizesTo is like IndexTo, but each block
+	// that has a recorded logical size is followed by a third
+	// field with that size:
+	//
+	//	locator+storedsize mtime logicalsize
+	IndexWithLogicalSizesTo(prefix string, w io.Writer) error
+}
+
+// writeWithLogicalSize writes a block to vol, recording its logical
+// size if vol supports it.
+func writeWithLogicalSize(ctx context.Context, vol Volume, loc string, rdr io.Reader, size, logicalSize int) error {
+	if lv, ok := vol.(logicalSizeVolume); ok {
+		return lv.WriteBlockWithLogicalSize(ctx, loc, rdr, size, logicalSize)
+	}
+	return vol.WriteBlock(ctx, loc, rdr, size)
+}
+
+// readBlockData reads exactly size bytes from r into buf, and
+// returns an error if r provides fewer or more than size bytes, or
+// returns an error (e.g., a hash mismatch) before EOF.
+func readBlockData(r io.Reader, buf []byte, size int) ([]byte, error) {
+	n, err := io.ReadFull(r, buf[:size+1])
+	if err == nil {
+		return nil, fmt.Errorf("block data is longer than expected size %d", size)
+	} else if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	} else if n != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf[:size], nil
+}
+
+// logicalSizeIndex generates an index for a volume wrapper, using
+// logical sizes instead of the stored sizes reported by the wrapped
+// volume.
+type logicalSizeIndex struct {
+	vol       Volume
+	headerLen int
+	// Return the logical size given the first headerLen bytes of
+	// a stored block (fewer if the block is shorter than that)
+	// and its stored size.
+	logicalSize func(hdr []byte, stored int) int
+
+	sizes map[string]int
+	mtx   sync.Mutex
+}
+
+func newLogicalSizeIndex(vol Volume, headerLen int, logicalSize func([]byte, int) int) *logicalSizeIndex {
+	return &logicalSizeIndex{
+		vol:         vol,
+		headerLen:   headerLen,
+		logicalSize: logicalSize,
+		sizes:       map[string]int{},
+	}
+}
+
+// IndexTo writes the wrapped volume's index to w, with stored sizes
+// replaced by logical sizes.
+func (idx *logicalSizeIndex) IndexTo(prefix string, w io.Writer) error {
+	return idx.indexTo(prefix, w, false)
+}
+
+// IndexWithLogicalSizesTo is like IndexTo, but passes through logical
+// sizes recorded by the wrapped volume in the third field instead
+// of using them in place of the stored size. A wrapper uses this to
+// implement logicalSizeVolume on behalf of an outer wrapper.
+func (idx *logicalSizeIndex) IndexWithLogicalSizesTo(prefix string, w io.Writer) error {
+	return idx.indexTo(prefix, w, true)
+}
+
+func (idx *logicalSizeIndex) indexTo(prefix string, w io.Writer, passRecorded bool) error {
+	indexTo := idx.vol.IndexTo
+	if lv, ok := idx.vol.(logicalSizeVolume); ok {
+		indexTo = lv.IndexWithLogicalSizesTo
+	}
+	pr, pw := io.Pipe()
+	errIndex := make(chan error, 1)
+	go func() {
+		err := indexTo(prefix, pw)
+		pw.CloseWithError(err)
+		errIndex <- err
+	}()
+	err := idx.rewrite(pr, w, passRecorded)
+	pr.CloseWithError(err)
+	if ierr := <-errIndex; ierr != nil {
+		return ierr
+	}
+	return err
+}
+
+func (idx *logicalSizeIndex) rewrite(r io.Reader, w io.Writer, passRecorded bool) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// line is "loc+size mtime", possibly followed by
+		// " logicalsize" if the wrapped volume recorded it
+		fields := strings.Split(line, " ")
+		plus := strings.IndexByte(line, '+')
+		if plus < 0 || len(fields) < 2 || len(fields) > 3 || plus > len(fields[0]) {
+			return fmt.Errorf("malformed index line from %s: %q", idx.vol, line)
+		}
+		loc := line[:plus]
+		if len(fields) == 3 {
+			if passRecorded {
+				_, err := fmt.Fprintf(w, "%s\n", line)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			size, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return fmt.Errorf("malformed size %q in index from %s", fields[2], idx.vol)
+			}
+			_, err = fmt.Fprintf(w, "%s+%d %s\n", loc, size, fields[1])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		size, err := idx.get(loc, fields[0][plus+1:])
+		if os.IsNotExist(err) {
+			// Deleted since the wrapped volume's index
+			// was generated.
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s+%d %s\n", loc, size, fields[1])
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// get returns the logical size of the given block, reading its
+// header from the wrapped volume if it is not cached. This is only
+// needed for blocks that were written without a recorded logical
+// size, e.g., by a version of keepstore that didn't record them, or
+// on a volume driver that can't.
+func (idx *logicalSizeIndex) get(loc, storedSize string) (int, error) {
+	idx.mtx.Lock()
+	size, ok := idx.sizes[loc]
+	idx.mtx.Unlock()
+	if ok {
+		return size, nil
+	}
+	stored, err := strconv.Atoi(storedSize)
+	if err != nil {
+		return 0, fmt.Errorf("malformed size %q in index from %s", storedSize, idx.vol)
+	}
+	hw := &fixedBufferWriter{buf: make([]byte, 0, idx.headerLen)}
+	if stored > 0 {
+		err = idx.vol.ReadBlock(context.Background(), loc, hw)
+		if os.IsNotExist(err) {
+			return 0, err
+		} else if err != nil && !errors.Is(err, errBufferFull) {
+			return 0, fmt.Errorf("error reading header of %s from %s: %w", loc, idx.vol, err)
+		}
+	}
+	size = idx.logicalSize(hw.buf, stored)
+	idx.remember(loc, size)
+	return size, nil
+}
+
+// remember records the logical size of a block that has just been
+// read or written.
+func (idx *logicalSizeIndex) remember(loc string, size int) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	if len(idx.sizes) >= logicalSizeCacheMax {
+		for k := range idx.sizes {
+			delete(idx.sizes, k)
+			break
+		}
+	}
+	idx.sizes[loc] = size
+}
+
+// fixedBufferWriter appends data to buf without growing it beyond
+// its original capacity. When buf is full, Write returns
+// errBufferFull.
+type fixedBufferWriter struct {
+	buf []byte
+}
+
+func (fw *fixedBufferWriter) Write(p []byte) (int, error) {
+	avail := cap(fw.buf) - len(fw.buf)
+	if len(p) > avail {
+		fw.buf = append(fw.buf, p[:avail]...)
+		return avail, errBufferFull
+	}
+	fw.buf = append(fw.buf, p...)
+	return len(p), nil
+}
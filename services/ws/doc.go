@@ -3,8 +3,10 @@
 // SPDX-License-Identifier: AGPL-3.0
 
 // Package ws exposes Arvados APIs (currently just one, the
-// cache-invalidation event feed at "ws://.../websocket") to
-// websocket clients.
+// cache-invalidation event feed) to websocket clients. The v0
+// protocol is served at "ws://.../websocket", and the v1 protocol,
+// with filters, subscription IDs, and resumable cursors, is served at
+// "ws://.../arvados/v1/events.ws".
 //
 // Installation and configuration
 //
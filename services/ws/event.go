@@ -6,6 +6,7 @@ package ws
 
 import (
 	"database/sql"
+	"fmt"
 	"sync"
 	"time"
 
@@ -19,10 +20,111 @@ type eventSink interface {
 	Stop()
 }
 
+// An eventSource delivers events to any number of sinks (one per
+// client connection). Implementations are pgEventSource, which
+// listens for PostgreSQL notifications, and feedEventSource, which
+// receives events from an upstreamFeed.
+//
+// Permission checks are not the event source's concern: each
+// session filters the events it receives through its own
+// permChecker.
 type eventSource interface {
 	NewSink() eventSink
 	DB() *sql.DB
 	DBHealth() error
+
+	// Run receives events and sends them to sinks. It returns
+	// when the event source stops, after disconnecting all
+	// sinks.
+	Run()
+
+	// WaitReady returns when Run is ready to receive events, or
+	// has failed.
+	WaitReady()
+}
+
+// eventFanout sends events to a dynamic set of sinks.
+type eventFanout struct {
+	sinks map[*fanoutSink]bool
+	mtx   sync.Mutex
+}
+
+// NewSink returns an eventSink, whose Channel() method returns a
+// channel: a pointer to each subsequent event will be sent to that
+// channel.
+//
+// The caller must ensure events are received from the sink channel as
+// quickly as possible because when one sink stops being ready, all
+// other sinks block.
+func (f *eventFanout) NewSink() eventSink {
+	sink := &fanoutSink{
+		channel: make(chan *event, 1),
+		fanout:  f,
+	}
+	f.mtx.Lock()
+	if f.sinks == nil {
+		f.sinks = make(map[*fanoutSink]bool)
+	}
+	f.sinks[sink] = true
+	f.mtx.Unlock()
+	return sink
+}
+
+// send sends e to all sinks, and returns the number of sinks.
+func (f *eventFanout) send(e *event) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for sink := range f.sinks {
+		sink.channel <- e
+	}
+	return len(f.sinks)
+}
+
+// closeAll closes all sinks' channels.
+func (f *eventFanout) closeAll() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for sink := range f.sinks {
+		close(sink.channel)
+	}
+	f.sinks = nil
+}
+
+// status returns the number of sinks, and the number of events
+// waiting in sink channels.
+func (f *eventFanout) status() (sinks, blocked int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for sink := range f.sinks {
+		blocked += len(sink.channel)
+	}
+	return len(f.sinks), blocked
+}
+
+type fanoutSink struct {
+	channel chan *event
+	fanout  *eventFanout
+}
+
+func (sink *fanoutSink) Channel() <-chan *event {
+	return sink.channel
+}
+
+// Stop sending events to the sink's channel.
+func (sink *fanoutSink) Stop() {
+	go func() {
+		// Ensure this sink cannot fill up and block the
+		// server-side queue (which otherwise could in turn
+		// block our mtx.Lock() here)
+		for range sink.channel {
+		}
+	}()
+	sink.fanout.mtx.Lock()
+	if _, ok := sink.fanout.sinks[sink]; ok {
+		delete(sink.fanout.sinks, sink)
+		close(sink.channel)
+	}
+	sink.fanout.mtx.Unlock()
 }
 
 type event struct {
@@ -47,9 +149,24 @@ func (e *event) Detail() *arvados.Log {
 	if e.logRow != nil || e.err != nil {
 		return e.logRow
 	}
+	e.logRow, e.err = scanLogRow(e.db.QueryRow(`SELECT `+logRowColumns+` FROM logs WHERE id = $1`, e.LogID))
+	if e.err != nil {
+		e.logger.WithField("LogID", e.LogID).WithError(e.err).Error("failed to load log row")
+		return nil
+	}
+	return e.logRow
+}
+
+// logRowColumns are the columns of the logs table that are loaded by
+// scanLogRow.
+const logRowColumns = `id, uuid, object_uuid, COALESCE(object_owner_uuid,''), COALESCE(event_type,''), event_at, created_at, properties`
+
+// scanLogRow loads a log entry from a database row that contains
+// logRowColumns.
+func scanLogRow(row interface{ Scan(...interface{}) error }) (*arvados.Log, error) {
 	var logRow arvados.Log
 	var propYAML []byte
-	e.err = e.db.QueryRow(`SELECT id, uuid, object_uuid, COALESCE(object_owner_uuid,''), COALESCE(event_type,''), event_at, created_at, properties FROM logs WHERE id = $1`, e.LogID).Scan(
+	err := row.Scan(
 		&logRow.ID,
 		&logRow.UUID,
 		&logRow.ObjectUUID,
@@ -58,15 +175,12 @@ func (e *event) Detail() *arvados.Log {
 		&logRow.EventAt,
 		&logRow.CreatedAt,
 		&propYAML)
-	if e.err != nil {
-		e.logger.WithField("LogID", e.LogID).WithError(e.err).Error("QueryRow failed")
-		return nil
+	if err != nil {
+		return nil, fmt.Errorf("scan failed: %w", err)
 	}
-	e.err = yaml.Unmarshal(propYAML, &logRow.Properties)
-	if e.err != nil {
-		e.logger.WithField("LogID", e.LogID).WithError(e.err).Error("yaml decode failed")
-		return nil
+	err = yaml.Unmarshal(propYAML, &logRow.Properties)
+	if err != nil {
+		return nil, fmt.Errorf("yaml decode failed: %w", err)
 	}
-	e.logRow = &logRow
-	return e.logRow
+	return &logRow, nil
 }
@@ -0,0 +1,379 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Interval between keepalive messages on an idle event feed.
+	eventFeedKeepalive = 10 * time.Second
+	// If no data arrives from an upstream event feed for this
+	// long, the connection is considered dead.
+	eventFeedTimeout = 3 * eventFeedKeepalive
+	// Maximum number of events queued for sending to a
+	// downstream process.
+	eventFeedQueueSize = 1024
+)
+
+// An upstreamFeed delivers log entries to a feedEventSource.
+//
+// Outside tests, the only implementation is httpUpstreamFeed, which
+// relays the events received by another arvados-ws process. This
+// lets several arvados-ws processes share one PostgreSQL listener,
+// but it is not a general-purpose message bus: the upstream process
+// is a single point of failure, and events are not persisted.
+type upstreamFeed interface {
+	// Subscribe returns a channel that receives each subsequent
+	// log entry. The channel is closed when ctx is done, or when
+	// the subscription is interrupted and events may have been
+	// missed.
+	Subscribe(ctx context.Context) (<-chan *arvados.Log, error)
+}
+
+// newUpstreamFeed returns the upstreamFeed specified in the cluster
+// configuration.
+func newUpstreamFeed(cluster *arvados.Cluster) (upstreamFeed, error) {
+	u, err := url.Parse(cluster.API.WebsocketUpstreamFeed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API.WebsocketUpstreamFeed: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid API.WebsocketUpstreamFeed: unsupported scheme %q", u.Scheme)
+	}
+	return newHTTPUpstreamFeed(u, cluster)
+}
+
+// feedEventSource is an eventSource that receives events from an
+// upstreamFeed. Unlike pgEventSource, it does not need to load each log
+// entry from the database. If DataSource is empty, it does not
+// connect to a database at all, and DB() returns nil.
+type feedEventSource struct {
+	Feed         upstreamFeed
+	DataSource   string
+	MaxOpenConns int
+	Logger       logrus.FieldLogger
+	Reg          *prometheus.Registry
+
+	db        *sql.DB
+	fanout    eventFanout
+	eventsIn  prometheus.Counter
+	eventsOut prometheus.Counter
+	cancel    func()
+
+	setupOnce sync.Once
+	ready     chan bool
+}
+
+func (bs *feedEventSource) setup() {
+	bs.ready = make(chan bool)
+	bs.eventsIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "ws",
+		Name:      "events_in",
+		Help:      "Number of events received from upstream event feed",
+	})
+	bs.eventsOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "ws",
+		Name:      "events_out",
+		Help:      "Number of events sent to client sessions (before filtering)",
+	})
+	if bs.Reg != nil {
+		bs.Reg.MustRegister(bs.eventsIn, bs.eventsOut)
+		bs.Reg.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "arvados",
+				Subsystem: "ws",
+				Name:      "sinks",
+				Help:      "Number of active sinks (connections)",
+			}, func() float64 {
+				sinks, _ := bs.fanout.status()
+				return float64(sinks)
+			}))
+	}
+}
+
+// Close stops receiving new events and disconnects all clients.
+func (bs *feedEventSource) Close() {
+	bs.WaitReady()
+	bs.cancel()
+}
+
+// WaitReady returns when the upstream feed subscription is ready.
+func (bs *feedEventSource) WaitReady() {
+	bs.setupOnce.Do(bs.setup)
+	<-bs.ready
+}
+
+// Run receives events from the upstream feed and sends them to all sinks. It
+// returns if the subscription is interrupted, because clients
+// would otherwise miss events without knowing it.
+func (bs *feedEventSource) Run() {
+	bs.setupOnce.Do(bs.setup)
+	ready := bs.ready
+	defer func() {
+		if ready != nil {
+			close(ready)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bs.cancel = cancel
+	defer cancel()
+
+	// Disconnect all clients
+	defer bs.fanout.closeAll()
+
+	if bs.DataSource != "" {
+		db, err := sql.Open("postgres", bs.DataSource)
+		if err != nil {
+			bs.Logger.WithError(err).Error("sql.Open failed")
+			return
+		}
+		db.SetMaxOpenConns(bs.MaxOpenConns)
+		if err = db.Ping(); err != nil {
+			bs.Logger.WithError(err).Error("db.Ping failed")
+			return
+		}
+		bs.db = db
+	}
+
+	incoming, err := bs.Feed.Subscribe(ctx)
+	if err != nil {
+		bs.Logger.WithError(err).Error("upstream event feed subscribe failed")
+		return
+	}
+	close(ready)
+	// Avoid double-close in deferred func
+	ready = nil
+
+	var serial uint64
+	for lg := range incoming {
+		serial++
+		now := time.Now()
+		e := &event{
+			LogID:    lg.ID,
+			Received: now,
+			Ready:    now,
+			Serial:   serial,
+			db:       bs.db,
+			logger:   bs.Logger,
+			logRow:   lg,
+		}
+		bs.eventsIn.Inc()
+		bs.eventsOut.Add(float64(bs.fanout.send(e)))
+	}
+	if ctx.Err() == nil {
+		bs.Logger.Error("upstream event feed subscription interrupted")
+	}
+}
+
+// NewSink subscribes to the event source. See (*eventFanout)NewSink.
+func (bs *feedEventSource) NewSink() eventSink {
+	return bs.fanout.NewSink()
+}
+
+func (bs *feedEventSource) DB() *sql.DB {
+	bs.WaitReady()
+	return bs.db
+}
+
+func (bs *feedEventSource) DBHealth() error {
+	if bs.db == nil {
+		return errors.New("database not connected")
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second))
+	defer cancel()
+	var i int
+	return bs.db.QueryRowContext(ctx, "SELECT 1").Scan(&i)
+}
+
+func (bs *feedEventSource) DebugStatus() interface{} {
+	sinks, blocked := bs.fanout.status()
+	status := map[string]interface{}{
+		"Sinks":        sinks,
+		"SinksBlocked": blocked,
+	}
+	if bs.db != nil {
+		status["DBStats"] = bs.db.Stats()
+	}
+	return status
+}
+
+// httpUpstreamFeed receives events from another arvados-ws process's
+// event feed (see eventFeedHandler).
+type httpUpstreamFeed struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newHTTPUpstreamFeed(u *url.URL, cluster *arvados.Cluster) (upstreamFeed, error) {
+	if cluster.ManagementToken == "" {
+		return nil, errors.New("ManagementToken must be configured to use an upstream event feed")
+	}
+	feedURL := *u
+	feedURL.Path = strings.TrimSuffix(feedURL.Path, "/") + "/_events"
+	return &httpUpstreamFeed{
+		url:    feedURL.String(),
+		token:  cluster.ManagementToken,
+		client: &http.Client{},
+	}, nil
+}
+
+func (feed *httpUpstreamFeed) Subscribe(ctx context.Context) (<-chan *arvados.Log, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, "GET", feed.url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+feed.token)
+	resp, err := feed.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("upstream event feed returned %s", resp.Status)
+	}
+
+	// Cancel the request if the upstream feed stops sending
+	// events and keepalives.
+	idle := time.AfterFunc(eventFeedTimeout, cancel)
+
+	ch := make(chan *arvados.Log)
+	go func() {
+		defer close(ch)
+		defer cancel()
+		defer idle.Stop()
+		defer resp.Body.Close()
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg eventFeedMessage
+			err := dec.Decode(&msg)
+			if err != nil {
+				return
+			}
+			idle.Reset(eventFeedTimeout)
+			if msg.Log == nil {
+				// keepalive
+				continue
+			}
+			select {
+			case ch <- msg.Log:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// eventFeedMessage is sent by eventFeedHandler for each event. Log
+// is nil in keepalive messages.
+type eventFeedMessage struct {
+	Log *arvados.Log `json:"log,omitempty"`
+}
+
+// eventFeedHandler sends all events from an eventSource, without
+// permission checks, as a stream of JSON-encoded eventFeedMessages.
+// It is used as the upstream feed by httpUpstreamFeed.
+//
+// The caller is responsible for authorizing the request.
+type eventFeedHandler struct {
+	eventSource eventSource
+}
+
+func (h *eventFeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logger := ctxlog.FromContext(r.Context())
+	sink := h.eventSource.NewSink()
+	defer sink.Stop()
+
+	// Move events from the sink to a queue, so a slow downstream
+	// process can't block the event source. If the queue fills
+	// up, disconnect.
+	queue := make(chan *event, eventFeedQueueSize)
+	overflow := make(chan struct{})
+	go func() {
+		defer close(queue)
+		for e := range sink.Channel() {
+			select {
+			case queue <- e:
+			default:
+				close(overflow)
+				for range sink.Channel() {
+				}
+				return
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		// Send the response header now, so the downstream
+		// process knows its subscription is active.
+		flusher.Flush()
+	}
+	keepalive := time.NewTicker(eventFeedKeepalive)
+	defer keepalive.Stop()
+	for {
+		var msg eventFeedMessage
+		select {
+		case <-r.Context().Done():
+			return
+		case <-overflow:
+			logger.WithError(errQueueFull).Error("disconnecting event feed subscriber")
+			return
+		case <-keepalive.C:
+		case e, ok := <-queue:
+			if !ok {
+				// Event source stopped. Disconnect, so
+				// the downstream process knows events
+				// may have been missed.
+				return
+			}
+			msg.Log = e.Detail()
+			if msg.Log == nil {
+				continue
+			}
+		}
+		err := enc.Encode(msg)
+		if err != nil {
+			if r.Context().Err() == nil {
+				logger.WithError(err).Info("error writing to event feed")
+			}
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
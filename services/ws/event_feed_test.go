@@ -0,0 +1,252 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/websocket"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&eventFeedSuite{})
+
+type eventFeedSuite struct{}
+
+// memUpstreamFeed is an in-process upstreamFeed for testing.
+type memUpstreamFeed struct {
+	mtx  sync.Mutex
+	subs map[chan *arvados.Log]bool
+}
+
+func (feed *memUpstreamFeed) Subscribe(ctx context.Context) (<-chan *arvados.Log, error) {
+	ch := make(chan *arvados.Log)
+	feed.mtx.Lock()
+	if feed.subs == nil {
+		feed.subs = map[chan *arvados.Log]bool{}
+	}
+	feed.subs[ch] = true
+	feed.mtx.Unlock()
+	go func() {
+		<-ctx.Done()
+		feed.mtx.Lock()
+		defer feed.mtx.Unlock()
+		if feed.subs[ch] {
+			delete(feed.subs, ch)
+			close(ch)
+		}
+	}()
+	return ch, nil
+}
+
+// Publish sends lg to all subscribers.
+func (feed *memUpstreamFeed) Publish(lg *arvados.Log) {
+	feed.mtx.Lock()
+	defer feed.mtx.Unlock()
+	for ch := range feed.subs {
+		ch <- lg
+	}
+}
+
+// Interrupt closes all subscriptions, as if the feed had lost its
+// connections.
+func (feed *memUpstreamFeed) Interrupt() {
+	feed.mtx.Lock()
+	defer feed.mtx.Unlock()
+	for ch := range feed.subs {
+		close(ch)
+	}
+	feed.subs = nil
+}
+
+type allowPermChecker struct{ deny map[string]bool }
+
+func (pc *allowPermChecker) SetToken(string) {}
+func (pc *allowPermChecker) Check(ctx context.Context, uuid string) (bool, error) {
+	return !pc.deny[uuid], nil
+}
+
+func (s *eventFeedSuite) newFeedEventSource(c *check.C, feed upstreamFeed) *feedEventSource {
+	bs := &feedEventSource{
+		Feed:   feed,
+		Logger: ctxlog.TestLogger(c),
+		Reg:    prometheus.NewRegistry(),
+	}
+	go bs.Run()
+	bs.WaitReady()
+	return bs
+}
+
+func (s *eventFeedSuite) TestFeedEventSource(c *check.C) {
+	feed := &memUpstreamFeed{}
+	bs := s.newFeedEventSource(c, feed)
+	defer bs.Close()
+	c.Check(bs.DB(), check.IsNil)
+	c.Check(bs.DBHealth(), check.NotNil)
+
+	sinks := make([]eventSink, 4)
+	for i := range sinks {
+		sinks[i] = bs.NewSink()
+	}
+	go func() {
+		for i := 1; i <= 3; i++ {
+			feed.Publish(&arvados.Log{ID: uint64(i)})
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, sink := range sinks {
+		wg.Add(1)
+		go func(sink eventSink) {
+			defer wg.Done()
+			for i := 1; i <= 3; i++ {
+				select {
+				case e := <-sink.Channel():
+					c.Check(e.LogID, check.Equals, uint64(i))
+					if c.Check(e.Detail(), check.NotNil) {
+						c.Check(e.Detail().ID, check.Equals, uint64(i))
+					}
+				case <-time.After(10 * time.Second):
+					c.Error("timed out")
+					return
+				}
+			}
+		}(sink)
+	}
+	wg.Wait()
+
+	// If the upstream feed subscription is interrupted, all sinks are
+	// closed.
+	feed.Interrupt()
+	for _, sink := range sinks {
+		for range sink.Channel() {
+		}
+	}
+}
+
+// A downstream feedEventSource receives events via an upstream
+// router's event feed.
+func (s *eventFeedSuite) TestHTTPEventFeed(c *check.C) {
+	upstreamFeed := &memUpstreamFeed{}
+	upstream := s.newFeedEventSource(c, upstreamFeed)
+	defer upstream.Close()
+	cluster := &arvados.Cluster{ManagementToken: "abcdefg"}
+	srv := httptest.NewServer(&router{
+		cluster:     cluster,
+		eventSource: upstream,
+		reg:         prometheus.NewRegistry(),
+	})
+	defer srv.Close()
+
+	for _, token := range []string{"", "wrongtoken"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/_events", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, check.Not(check.Equals), http.StatusOK)
+	}
+
+	cluster.API.WebsocketUpstreamFeed = srv.URL + "/"
+	feed, err := newUpstreamFeed(cluster)
+	c.Assert(err, check.IsNil)
+	downstream := s.newFeedEventSource(c, feed)
+	defer downstream.Close()
+	sink := downstream.NewSink()
+	defer sink.Stop()
+
+	for i := 1; i <= 3; i++ {
+		upstreamFeed.Publish(&arvados.Log{ID: uint64(i), EventType: "update", Properties: map[string]interface{}{"foo": "bar"}})
+	}
+	for i := 1; i <= 3; i++ {
+		select {
+		case e := <-sink.Channel():
+			c.Check(e.LogID, check.Equals, uint64(i))
+			c.Check(e.Detail().EventType, check.Equals, "update")
+			c.Check(e.Detail().Properties["foo"], check.Equals, "bar")
+		case <-time.After(10 * time.Second):
+			c.Fatal("timed out")
+		}
+	}
+
+	// When the upstream event source stops, the downstream
+	// event source stops too.
+	upstreamFeed.Interrupt()
+	select {
+	case _, ok := <-sink.Channel():
+		c.Check(ok, check.Equals, false)
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out")
+	}
+}
+
+func (s *eventFeedSuite) TestNewUpstreamFeed(c *check.C) {
+	for _, trial := range []struct {
+		url   string
+		token string
+		err   string
+	}{
+		{"http://ws.example:8005/", "abcdefg", ""},
+		{"https://ws.example/", "abcdefg", ""},
+		{"http://ws.example:8005/", "", `ManagementToken must be configured.*`},
+		{"nats://ws.example/", "abcdefg", `.*unsupported scheme "nats"`},
+		{"://", "abcdefg", `invalid API.WebsocketUpstreamFeed.*`},
+	} {
+		cluster := &arvados.Cluster{ManagementToken: trial.token}
+		cluster.API.WebsocketUpstreamFeed = trial.url
+		_, err := newUpstreamFeed(cluster)
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+}
+
+// Sessions still check permission on events from an upstream feed.
+func (s *eventFeedSuite) TestSessionPermission(c *check.C) {
+	feed := &memUpstreamFeed{}
+	bs := s.newFeedEventSource(c, feed)
+	defer bs.Close()
+	cluster := &arvados.Cluster{}
+	cluster.API.SendTimeout = arvados.Duration(time.Minute)
+	cluster.API.WebsocketClientEventQueue = 64
+	srv := httptest.NewServer(&router{
+		cluster:     cluster,
+		client:      &arvados.Client{},
+		eventSource: bs,
+		newPermChecker: func() permChecker {
+			return &allowPermChecker{deny: map[string]bool{"zzzzz-7fd4e-000000000000000": true}}
+		},
+		reg: prometheus.NewRegistry(),
+	})
+	defer srv.Close()
+
+	conn, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/websocket", "", srv.URL)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	r := json.NewDecoder(conn)
+	c.Check(json.NewEncoder(conn).Encode(map[string]interface{}{"method": "subscribe"}), check.IsNil)
+	var msg map[string]interface{}
+	c.Check(r.Decode(&msg), check.IsNil)
+	c.Check(msg["status"], check.Equals, float64(200))
+
+	go func() {
+		feed.Publish(&arvados.Log{ID: 1, ObjectUUID: "zzzzz-7fd4e-000000000000000", EventType: "update"})
+		feed.Publish(&arvados.Log{ID: 2, ObjectUUID: "zzzzz-7fd4e-111111111111111", EventType: "update"})
+	}()
+	var lg arvados.Log
+	c.Check(r.Decode(&lg), check.IsNil)
+	c.Check(lg.ID, check.Equals, uint64(2))
+	c.Check(lg.ObjectUUID, check.Equals, "zzzzz-7fd4e-111111111111111")
+}
@@ -29,8 +29,7 @@ type pgEventSource struct {
 	db         *sql.DB
 	pqListener *pq.Listener
 	queue      chan *event
-	sinks      map[*pgEventSink]bool
-	mtx        sync.Mutex
+	fanout     eventFanout
 
 	lastQDelay time.Duration
 	eventsIn   prometheus.Counter
@@ -87,7 +86,10 @@ func (ps *pgEventSource) setup() {
 			Subsystem: "ws",
 			Name:      "sinks",
 			Help:      "Number of active sinks (connections)",
-		}, func() float64 { return float64(len(ps.sinks)) }))
+		}, func() float64 {
+			sinks, _ := ps.fanout.status()
+			return float64(sinks)
+		}))
 	ps.Reg.MustRegister(prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
 			Namespace: "arvados",
@@ -95,12 +97,7 @@ func (ps *pgEventSource) setup() {
 			Name:      "sinks_blocked",
 			Help:      "Number of sinks (connections) that are busy and blocking the main event stream",
 		}, func() float64 {
-			ps.mtx.Lock()
-			defer ps.mtx.Unlock()
-			blocked := 0
-			for sink := range ps.sinks {
-				blocked += len(sink.channel)
-			}
+			_, blocked := ps.fanout.status()
 			return float64(blocked)
 		}))
 	ps.eventsIn = prometheus.NewCounter(prometheus.CounterOpts{
@@ -181,15 +178,8 @@ func (ps *pgEventSource) Run() {
 	ps.cancel = cancel
 	defer cancel()
 
-	defer func() {
-		// Disconnect all clients
-		ps.mtx.Lock()
-		for sink := range ps.sinks {
-			close(sink.channel)
-		}
-		ps.sinks = nil
-		ps.mtx.Unlock()
-	}()
+	// Disconnect all clients
+	defer ps.fanout.closeAll()
 
 	db, err := sql.Open("postgres", ps.DataSource)
 	if err != nil {
@@ -238,12 +228,7 @@ func (ps *pgEventSource) Run() {
 			e.Ready = time.Now()
 			ps.lastQDelay = e.Ready.Sub(e.Received)
 
-			ps.mtx.Lock()
-			for sink := range ps.sinks {
-				sink.channel <- e
-				ps.eventsOut.Inc()
-			}
-			ps.mtx.Unlock()
+			ps.eventsOut.Add(float64(ps.fanout.send(e)))
 		}
 	}()
 
@@ -302,25 +287,9 @@ func (ps *pgEventSource) Run() {
 	}
 }
 
-// NewSink subscribes to the event source. NewSink returns an
-// eventSink, whose Channel() method returns a channel: a pointer to
-// each subsequent event will be sent to that channel.
-//
-// The caller must ensure events are received from the sink channel as
-// quickly as possible because when one sink stops being ready, all
-// other sinks block.
+// NewSink subscribes to the event source. See (*eventFanout)NewSink.
 func (ps *pgEventSource) NewSink() eventSink {
-	sink := &pgEventSink{
-		channel: make(chan *event, 1),
-		source:  ps,
-	}
-	ps.mtx.Lock()
-	if ps.sinks == nil {
-		ps.sinks = make(map[*pgEventSink]bool)
-	}
-	ps.sinks[sink] = true
-	ps.mtx.Unlock()
-	return sink
+	return ps.fanout.NewSink()
 }
 
 func (ps *pgEventSource) DB() *sql.DB {
@@ -339,44 +308,13 @@ func (ps *pgEventSource) DBHealth() error {
 }
 
 func (ps *pgEventSource) DebugStatus() interface{} {
-	ps.mtx.Lock()
-	defer ps.mtx.Unlock()
-	blocked := 0
-	for sink := range ps.sinks {
-		blocked += len(sink.channel)
-	}
+	sinks, blocked := ps.fanout.status()
 	return map[string]interface{}{
 		"Queue":        len(ps.queue),
 		"QueueLimit":   cap(ps.queue),
 		"QueueDelay":   stats.Duration(ps.lastQDelay),
-		"Sinks":        len(ps.sinks),
+		"Sinks":        sinks,
 		"SinksBlocked": blocked,
 		"DBStats":      ps.db.Stats(),
 	}
 }
-
-type pgEventSink struct {
-	channel chan *event
-	source  *pgEventSource
-}
-
-func (sink *pgEventSink) Channel() <-chan *event {
-	return sink.channel
-}
-
-// Stop sending events to the sink's channel.
-func (sink *pgEventSink) Stop() {
-	go func() {
-		// Ensure this sink cannot fill up and block the
-		// server-side queue (which otherwise could in turn
-		// block our mtx.Lock() here)
-		for range sink.channel {
-		}
-	}()
-	sink.source.mtx.Lock()
-	if _, ok := sink.source.sinks[sink]; ok {
-		delete(sink.source.sinks, sink)
-		close(sink.channel)
-	}
-	sink.source.mtx.Unlock()
-}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"github.com/prometheus/client_golang/prometheus"
@@ -55,6 +56,11 @@ func (rtr *router) setup() {
 	rtr.mux = http.NewServeMux()
 	rtr.mux.Handle("/websocket", rtr.makeServer(newSessionV0, mSockets.WithLabelValues("0")))
 	rtr.mux.Handle("/arvados/v1/events.ws", rtr.makeServer(newSessionV1, mSockets.WithLabelValues("1")))
+	if rtr.cluster.ManagementToken != "" {
+		// Upstream event feed for other arvados-ws processes
+		// (see httpUpstreamFeed).
+		rtr.mux.Handle("/_events", auth.RequireLiteralToken(rtr.cluster.ManagementToken, &eventFeedHandler{eventSource: rtr.eventSource}))
+	}
 	rtr.mux.Handle("/_health/", &health.Handler{
 		Token:  rtr.cluster.ManagementToken,
 		Prefix: "/_health/",
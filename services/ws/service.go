@@ -24,12 +24,27 @@ func newHandler(ctx context.Context, cluster *arvados.Cluster, token string, reg
 	if err != nil {
 		return service.ErrorHandler(ctx, cluster, fmt.Errorf("error initializing client from cluster config: %s", err))
 	}
-	eventSource := &pgEventSource{
-		DataSource:   cluster.PostgreSQL.Connection.String(),
-		MaxOpenConns: cluster.PostgreSQL.ConnectionPool,
-		QueueSize:    cluster.API.WebsocketServerEventQueue,
-		Logger:       ctxlog.FromContext(ctx),
-		Reg:          reg,
+	var eventSource eventSource
+	if cluster.API.WebsocketUpstreamFeed == "" {
+		eventSource = &pgEventSource{
+			DataSource:   cluster.PostgreSQL.Connection.String(),
+			MaxOpenConns: cluster.PostgreSQL.ConnectionPool,
+			QueueSize:    cluster.API.WebsocketServerEventQueue,
+			Logger:       ctxlog.FromContext(ctx),
+			Reg:          reg,
+		}
+	} else {
+		feed, err := newUpstreamFeed(cluster)
+		if err != nil {
+			return service.ErrorHandler(ctx, cluster, err)
+		}
+		eventSource = &feedEventSource{
+			Feed:         feed,
+			DataSource:   cluster.PostgreSQL.Connection.String(),
+			MaxOpenConns: cluster.PostgreSQL.ConnectionPool,
+			Logger:       ctxlog.FromContext(ctx),
+			Reg:          reg,
+		}
 	}
 	done := make(chan struct{})
 	go func() {
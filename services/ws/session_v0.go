@@ -119,17 +119,7 @@ func (sess *v0session) EventMessage(e *event) ([]byte, error) {
 		return nil, nil
 	}
 
-	var permTarget string
-	if detail.EventType == "delete" {
-		// It's pointless to check permission by reading
-		// ObjectUUID if it has just been deleted, but if the
-		// client has permission on the parent project then
-		// it's OK to send the event.
-		permTarget = detail.ObjectOwnerUUID
-	} else {
-		permTarget = detail.ObjectUUID
-	}
-	ok, err := sess.permChecker.Check(sess.ws.Request().Context(), permTarget)
+	ok, err := sess.permChecker.Check(sess.ws.Request().Context(), permTarget(detail))
 	if err != nil || !ok {
 		return nil, err
 	}
@@ -145,26 +135,46 @@ func (sess *v0session) EventMessage(e *event) ([]byte, error) {
 		"event_type":        detail.EventType,
 		"event_at":          detail.EventAt,
 	}
+	msg["properties"] = sendProperties(detail)
+	return json.Marshal(msg)
+}
+
+// permTarget returns the UUID of the object the client must be able
+// to read in order to receive the given event.
+func permTarget(detail *arvados.Log) string {
+	if detail.EventType == "delete" {
+		// It's pointless to check permission by reading
+		// ObjectUUID if it has just been deleted, but if the
+		// client has permission on the parent project then
+		// it's OK to send the event.
+		return detail.ObjectOwnerUUID
+	}
+	return detail.ObjectUUID
+}
+
+// sendProperties returns the subset of the log entry's properties
+// that should be sent to clients: either the entire properties hash
+// (for log entries with a "text" property) or just the
+// sendObjectAttributes keys from old_attributes and new_attributes.
+func sendProperties(detail *arvados.Log) map[string]interface{} {
 	if detail.Properties != nil && detail.Properties["text"] != nil {
-		msg["properties"] = detail.Properties
-	} else {
-		msgProps := map[string]map[string]interface{}{}
-		for _, ak := range []string{"old_attributes", "new_attributes"} {
-			eventAttrs, ok := detail.Properties[ak].(map[string]interface{})
-			if !ok {
-				continue
-			}
-			msgAttrs := map[string]interface{}{}
-			for _, k := range sendObjectAttributes {
-				if v, ok := eventAttrs[k]; ok {
-					msgAttrs[k] = v
-				}
+		return detail.Properties
+	}
+	msgProps := map[string]interface{}{}
+	for _, ak := range []string{"old_attributes", "new_attributes"} {
+		eventAttrs, ok := detail.Properties[ak].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		msgAttrs := map[string]interface{}{}
+		for _, k := range sendObjectAttributes {
+			if v, ok := eventAttrs[k]; ok {
+				msgAttrs[k] = v
 			}
-			msgProps[ak] = msgAttrs
 		}
-		msg["properties"] = msgProps
+		msgProps[ak] = msgAttrs
 	}
-	return json.Marshal(msg)
+	return msgProps
 }
 
 func (sess *v0session) Filter(e *event) bool {
@@ -6,13 +6,465 @@ package ws
 
 import (
 	"database/sql"
-	"errors"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/sirupsen/logrus"
 )
 
-// newSessionV1 returns a v1 session -- see
-// https://dev.arvados.org/projects/arvados/wiki/Websocket_server
+const (
+	// v1replayMaxAge is the age of the oldest event that can be
+	// replayed to a client that subscribes with a cursor.
+	v1replayMaxAge = time.Hour
+
+	// v1replayBatchSize is the maximum number of log rows loaded
+	// from the database at a time while replaying.
+	v1replayBatchSize = 1000
+)
+
+type v1session struct {
+	ac          *arvados.Client
+	ws          wsConn
+	sendq       chan<- interface{}
+	db          *sql.DB
+	permChecker permChecker
+	log         logrus.FieldLogger
+
+	mtx           sync.Mutex
+	subscriptions map[string]*v1subscription
+	replayed      map[*event]string // queued event => subscription ID
+	lastSubID     uint64
+}
+
+type v1subscription struct {
+	id      string
+	filters []v1filter
+
+	// live is false while old events are being replayed. During
+	// that time, new events that match the filters are held in
+	// pending, so they can be sent after the replayed events.
+	//
+	// pending is limited to the size of the session's outgoing
+	// queue. If more events arrive, pending is discarded and
+	// overflow is set, and the replay continues by reading the
+	// discarded events (and any others) from the database.
+	live     bool
+	pending  []*event
+	overflow bool
+}
+
+func (sub *v1subscription) match(attrs map[string]interface{}) bool {
+	for i := range sub.filters {
+		if !sub.filters[i].check(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+// v1request is a message received from a v1 client.
+type v1request struct {
+	Method       string          `json:"method"`
+	ID           json.RawMessage `json:"id"`
+	Filters      []interface{}   `json:"filters"`
+	Cursor       string          `json:"cursor"`
+	Subscription string          `json:"subscription"`
+}
+
+// newSessionV1 returns a v1 session, which supports multiple
+// subscriptions per connection, each with its own REST-API-style
+// filters, and resuming from a cursor after reconnecting.
+//
+// Each client request is a JSON object with a "method" key and an
+// optional "id" key. The server acknowledges each request with a
+// message containing the same "id" and an HTTP-style "status", plus
+// an "error" message if the request failed.
+//
+// A "subscribe" request has a "filters" array and an optional
+// "cursor". The response includes a server-assigned "subscription"
+// ID and a "cursor". Each subsequent event message lists the IDs of
+// the subscriptions it matches, along with the event's own cursor.
+// If a client reconnects and subscribes with the cursor of the last
+// event it received, the events it missed are sent before any new
+// events, as long as they are less than v1replayMaxAge old. If older
+// events were missed, the response has "incomplete": true.
+//
+// An "unsubscribe" request has a "subscription" ID.
+//
+// The server does not keep track of which events a client has
+// received or processed. A client that needs to see every event
+// should remember the cursor of the last event it has processed, and
+// use it when subscribing after reconnecting. Such a client may
+// receive some events more than once, but does not miss any (except
+// events older than v1replayMaxAge, as indicated by "incomplete").
 func newSessionV1(ws wsConn, sendq chan<- interface{}, db *sql.DB, pc permChecker, ac *arvados.Client) (session, error) {
-	return nil, errors.New("Not implemented")
+	sess := &v1session{
+		sendq:         sendq,
+		ws:            ws,
+		db:            db,
+		ac:            ac,
+		permChecker:   pc,
+		log:           ctxlog.FromContext(ws.Request().Context()),
+		subscriptions: map[string]*v1subscription{},
+		replayed:      map[*event]string{},
+	}
+	var token string
+	if creds := auth.CredentialsFromRequest(ws.Request()); len(creds.Tokens) > 0 {
+		token = creds.Tokens[0]
+	}
+	sess.permChecker.SetToken(token)
+	return sess, nil
+}
+
+func (sess *v1session) Receive(buf []byte) error {
+	var req v1request
+	if err := json.Unmarshal(buf, &req); err != nil {
+		sess.log.WithError(err).Info("invalid message from client")
+		sess.reply(nil, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON message: " + err.Error()})
+		return nil
+	}
+	switch req.Method {
+	case "subscribe":
+		sess.subscribe(req)
+	case "unsubscribe":
+		sess.mtx.Lock()
+		_, found := sess.subscriptions[req.Subscription]
+		delete(sess.subscriptions, req.Subscription)
+		sess.mtx.Unlock()
+		sess.log.WithField("subscription", req.Subscription).WithField("found", found).Debug("unsubscribe")
+		if found {
+			sess.reply(req.ID, http.StatusOK, nil)
+		} else {
+			sess.reply(req.ID, http.StatusNotFound, map[string]interface{}{"error": "no such subscription"})
+		}
+	default:
+		sess.log.WithField("Method", req.Method).Info("unknown method")
+		sess.reply(req.ID, http.StatusBadRequest, map[string]interface{}{"error": "unknown method " + strconv.Quote(req.Method)})
+	}
+	return nil
+}
+
+// reply queues a response to a client request.
+func (sess *v1session) reply(id json.RawMessage, status int, msg map[string]interface{}) {
+	if msg == nil {
+		msg = map[string]interface{}{}
+	}
+	msg["status"] = status
+	if len(id) > 0 {
+		msg["id"] = id
+	}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		sess.log.WithError(err).Error("error encoding response")
+		return
+	}
+	sess.sendq <- buf
+}
+
+func (sess *v1session) subscribe(req v1request) {
+	filters, err := compileV1Filters(req.Filters, sess.ac.KindForUUID)
+	if err != nil {
+		sess.reply(req.ID, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	var cursor uint64
+	if req.Cursor != "" {
+		cursor, err = strconv.ParseUint(req.Cursor, 10, 64)
+		if err != nil {
+			sess.reply(req.ID, http.StatusBadRequest, map[string]interface{}{"error": "invalid cursor " + strconv.Quote(req.Cursor)})
+			return
+		}
+	}
+	// Load the discovery document now (if it isn't already
+	// cached) so object kinds can be looked up without blocking
+	// in Filter.
+	if _, err := sess.ac.DiscoveryDocument(); err != nil {
+		sess.log.WithError(err).Error("error loading discovery document")
+		sess.reply(req.ID, http.StatusInternalServerError, map[string]interface{}{"error": "server error"})
+		return
+	}
+
+	sess.mtx.Lock()
+	sess.lastSubID++
+	sub := &v1subscription{
+		id:      strconv.FormatUint(sess.lastSubID, 10),
+		filters: filters,
+		live:    req.Cursor == "",
+	}
+	sess.subscriptions[sub.id] = sub
+	sess.mtx.Unlock()
+	sess.log.WithField("subscription", sub.id).WithField("cursor", req.Cursor).Debug("subscribe")
+
+	resp := map[string]interface{}{"subscription": sub.id}
+	if req.Cursor == "" {
+		// The subscription is already live, so the client
+		// will receive all events after the current last ID.
+		var lastID sql.NullInt64
+		err = sess.db.QueryRow(`SELECT MAX(id) FROM logs`).Scan(&lastID)
+		if err != nil {
+			sess.log.WithError(err).Error("error getting last log ID")
+			sess.unsubscribeFailed(req.ID, sub)
+			return
+		}
+		resp["cursor"] = strconv.FormatInt(lastID.Int64, 10)
+		sess.reply(req.ID, http.StatusOK, resp)
+		return
+	}
+
+	since := time.Now().UTC().Add(-v1replayMaxAge)
+	var incomplete bool
+	err = sess.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM logs WHERE id > $1 AND created_at <= $2)`, cursor, since).Scan(&incomplete)
+	if err != nil {
+		sess.log.WithError(err).Error("error checking for expired events")
+		sess.unsubscribeFailed(req.ID, sub)
+		return
+	}
+	resp["cursor"] = req.Cursor
+	if incomplete {
+		resp["incomplete"] = true
+	}
+	sess.reply(req.ID, http.StatusOK, resp)
+	sess.replay(sub, cursor, since)
+}
+
+func (sess *v1session) unsubscribeFailed(id json.RawMessage, sub *v1subscription) {
+	sess.mtx.Lock()
+	delete(sess.subscriptions, sub.id)
+	sess.mtx.Unlock()
+	sess.reply(id, http.StatusInternalServerError, map[string]interface{}{"error": "server error"})
+}
+
+// replay sends the events after the given cursor that match sub's
+// filters, followed by any new events that matched while replaying,
+// and then marks sub as live.
+func (sess *v1session) replay(sub *v1subscription, cursor uint64, since time.Time) {
+	// sent is the set of log IDs already sent, so events that
+	// are loaded from the database and also arrive via Filter
+	// are only sent once.
+	sent := map[uint64]bool{}
+	send := func(events []*event) bool {
+		for _, e := range events {
+			if sent[e.LogID] {
+				continue
+			}
+			if !sess.queueReplay(sub, e) {
+				return false
+			}
+			sent[e.LogID] = true
+		}
+		return true
+	}
+	loadFromDB := true
+	for {
+		for loadFromDB {
+			old, last, full := sess.loadReplayBatch(sub, cursor, since)
+			if !send(old) {
+				return
+			}
+			cursor = last
+			loadFromDB = full
+		}
+		sess.mtx.Lock()
+		if sub.overflow {
+			// Some events were discarded from pending,
+			// so we need to load them from the database.
+			sub.overflow = false
+			sub.pending = nil
+			sess.mtx.Unlock()
+			loadFromDB = true
+			continue
+		}
+		if len(sub.pending) == 0 {
+			sub.live = true
+			sess.mtx.Unlock()
+			return
+		}
+		var pending []*event
+		for _, e := range sub.pending {
+			pending = append(pending, &event{
+				LogID:    e.LogID,
+				Received: e.Received,
+				Ready:    e.Ready,
+				Serial:   e.Serial,
+				db:       e.db,
+				logger:   e.logger,
+				logRow:   e.Detail(),
+			})
+		}
+		sub.pending = nil
+		sess.mtx.Unlock()
+		if !send(pending) {
+			return
+		}
+	}
+}
+
+// loadReplayBatch loads up to v1replayBatchSize log rows after the
+// given cursor, and returns the events that match sub's filters, the
+// ID of the last row loaded (or cursor, if none), and whether there
+// may be more rows to load.
+func (sess *v1session) loadReplayBatch(sub *v1subscription, cursor uint64, since time.Time) ([]*event, uint64, bool) {
+	ctx := sess.ws.Request().Context()
+	rows, err := sess.db.QueryContext(ctx, `SELECT `+logRowColumns+` FROM logs WHERE id > $1 AND created_at > $2 ORDER BY id LIMIT $3`, cursor, since, v1replayBatchSize)
+	if err != nil {
+		sess.log.WithError(err).Error("replay db.Query failed")
+		return nil, cursor, false
+	}
+	defer rows.Close()
+	var old []*event
+	nrows := 0
+	now := time.Now()
+	for rows.Next() {
+		nrows++
+		detail, err := scanLogRow(rows)
+		if err != nil {
+			sess.log.WithError(err).Error("replay row scan failed")
+			continue
+		}
+		cursor = detail.ID
+		if !sub.match(sess.eventAttrs(detail)) {
+			continue
+		}
+		old = append(old, &event{
+			LogID:    detail.ID,
+			Received: now,
+			Ready:    now,
+			db:       sess.db,
+			logger:   sess.log,
+			logRow:   detail,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		sess.log.WithError(err).Error("replay db.Query failed")
+		return old, cursor, false
+	}
+	return old, cursor, nrows == v1replayBatchSize
+}
+
+// queueReplay queues an event for sending to sub only. It returns
+// false if the session or subscription has ended.
+func (sess *v1session) queueReplay(sub *v1subscription, e *event) bool {
+	ctx := sess.ws.Request().Context()
+	for len(sess.sendq)*2 > cap(sess.sendq) {
+		// Leave room in the queue for new events -- see
+		// (*v0subscribe)sendOldEvents.
+		time.Sleep(100 * time.Millisecond)
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+	sess.mtx.Lock()
+	if sess.subscriptions[sub.id] != sub {
+		sess.mtx.Unlock()
+		return false
+	}
+	sess.replayed[e] = sub.id
+	sess.mtx.Unlock()
+	select {
+	case sess.sendq <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// eventAttrs returns the event attributes that are sent to the
+// client and used for filtering.
+func (sess *v1session) eventAttrs(detail *arvados.Log) map[string]interface{} {
+	kind, _ := sess.ac.KindForUUID(detail.ObjectUUID)
+	attrs := map[string]interface{}{
+		"id":                float64(detail.ID),
+		"uuid":              detail.UUID,
+		"object_uuid":       detail.ObjectUUID,
+		"object_owner_uuid": detail.ObjectOwnerUUID,
+		"object_kind":       kind,
+		"event_type":        detail.EventType,
+		"event_at":          nil,
+		"created_at":        nil,
+		"properties":        sendProperties(detail),
+	}
+	if detail.EventAt != nil {
+		attrs["event_at"] = *detail.EventAt
+	}
+	if detail.CreatedAt != nil {
+		attrs["created_at"] = *detail.CreatedAt
+	}
+	return attrs
+}
+
+func (sess *v1session) Filter(e *event) bool {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+	if len(sess.subscriptions) == 0 {
+		return false
+	}
+	detail := e.Detail()
+	if detail == nil {
+		return false
+	}
+	attrs := sess.eventAttrs(detail)
+	send := false
+	for _, sub := range sess.subscriptions {
+		if !sub.match(attrs) {
+			continue
+		} else if sub.live {
+			send = true
+		} else if sub.overflow {
+			// replay will load this event from the
+			// database.
+		} else if len(sub.pending) >= cap(sess.sendq) {
+			sub.pending = nil
+			sub.overflow = true
+		} else {
+			sub.pending = append(sub.pending, e)
+		}
+	}
+	return send
+}
+
+func (sess *v1session) EventMessage(e *event) ([]byte, error) {
+	detail := e.Detail()
+	if detail == nil {
+		return nil, nil
+	}
+	attrs := sess.eventAttrs(detail)
+
+	var subs []string
+	sess.mtx.Lock()
+	if id, ok := sess.replayed[e]; ok {
+		delete(sess.replayed, e)
+		if sess.subscriptions[id] != nil {
+			subs = append(subs, id)
+		}
+	} else {
+		for id, sub := range sess.subscriptions {
+			if sub.live && sub.match(attrs) {
+				subs = append(subs, id)
+			}
+		}
+	}
+	sess.mtx.Unlock()
+	if len(subs) == 0 {
+		// Unsubscribed since the event was queued.
+		return nil, nil
+	}
+	sort.Strings(subs)
+
+	ok, err := sess.permChecker.Check(sess.ws.Request().Context(), permTarget(detail))
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"subscriptions": subs,
+		"cursor":        strconv.FormatUint(detail.ID, 10),
+		"event":         attrs,
+	})
 }
@@ -0,0 +1,402 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// v1eventAttrs lists the attributes of an event message that can be
+// used in v1 filters, and whether each one is a timestamp.
+var v1eventAttrs = map[string]bool{
+	"id":                false,
+	"uuid":              false,
+	"object_uuid":       false,
+	"object_owner_uuid": false,
+	"object_kind":       false,
+	"event_type":        false,
+	"event_at":          true,
+	"created_at":        true,
+	"properties":        false,
+}
+
+// v1uuidAttrs lists the attributes that can be used with the "is_a"
+// operator.
+var v1uuidAttrs = map[string]bool{
+	"uuid":              true,
+	"object_uuid":       true,
+	"object_owner_uuid": true,
+}
+
+// v1filter is a compiled [attribute, operator, operand] filter
+// condition, with the same semantics as a filter in a REST API list
+// request.
+type v1filter struct {
+	attr  string
+	path  []string // subproperty keys, if attr is "properties.x.y"
+	match func(val interface{}, present bool) bool
+}
+
+// check returns true if the given event message attributes satisfy
+// the filter condition.
+func (f *v1filter) check(attrs map[string]interface{}) bool {
+	val, present := attrs[f.attr]
+	for _, key := range f.path {
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			val, present = nil, false
+			break
+		}
+		val, present = obj[key]
+	}
+	return f.match(val, present)
+}
+
+// compileV1Filters checks the given filters and returns a slice of
+// compiled filters. kindForUUID is used to implement the "is_a"
+// operator.
+func compileV1Filters(filters []interface{}, kindForUUID func(string) (string, error)) ([]v1filter, error) {
+	var compiled []v1filter
+	for _, raw := range filters {
+		f, ok := raw.([]interface{})
+		if !ok || len(f) != 3 {
+			return nil, fmt.Errorf("invalid filter %v: must be an array [attribute, operator, operand]", raw)
+		}
+		attr, ok := f[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %v: attribute must be a string", raw)
+		}
+		op, ok := f[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %v: operator must be a string", raw)
+		}
+		cf, err := compileV1Filter(attr, strings.ToLower(op), f[2], kindForUUID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %v: %w", raw, err)
+		}
+		compiled = append(compiled, cf)
+	}
+	return compiled, nil
+}
+
+func compileV1Filter(attr, op string, operand interface{}, kindForUUID func(string) (string, error)) (v1filter, error) {
+	cf := v1filter{attr: attr}
+	if strings.HasPrefix(attr, "properties.") {
+		cf.attr = "properties"
+		cf.path = strings.Split(attr[len("properties."):], ".")
+	} else if _, ok := v1eventAttrs[attr]; !ok {
+		return cf, fmt.Errorf("unsupported attribute %q", attr)
+	}
+	isTime := v1eventAttrs[cf.attr] && cf.path == nil
+
+	switch op {
+	case "=", "!=", "<>":
+		eq, err := v1equalFunc(operand, isTime)
+		if err != nil {
+			return cf, err
+		}
+		if op == "=" {
+			cf.match = func(val interface{}, present bool) bool { return present && eq(val) }
+		} else {
+			cf.match = func(val interface{}, present bool) bool { return !present || !eq(val) }
+		}
+	case "<", "<=", ">", ">=":
+		cmp, err := v1compareFunc(operand, isTime)
+		if err != nil {
+			return cf, err
+		}
+		cf.match = func(val interface{}, present bool) bool {
+			c, ok := cmp(val)
+			if !present || !ok {
+				return false
+			}
+			switch op {
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			default:
+				return c >= 0
+			}
+		}
+	case "like", "ilike":
+		pattern, ok := operand.(string)
+		if !ok {
+			return cf, fmt.Errorf("operand for %q must be a string", op)
+		}
+		re, err := v1likeRegexp(pattern, op == "ilike")
+		if err != nil {
+			return cf, err
+		}
+		cf.match = func(val interface{}, present bool) bool {
+			s, ok := val.(string)
+			return present && ok && re.MatchString(s)
+		}
+	case "in", "not in":
+		arr, ok := operand.([]interface{})
+		if !ok {
+			return cf, fmt.Errorf("operand for %q must be an array", op)
+		}
+		var eqs []func(interface{}) bool
+		for _, elem := range arr {
+			eq, err := v1equalFunc(elem, isTime)
+			if err != nil {
+				return cf, err
+			}
+			eqs = append(eqs, eq)
+		}
+		in := func(val interface{}) bool {
+			for _, eq := range eqs {
+				if eq(val) {
+					return true
+				}
+			}
+			return false
+		}
+		if op == "in" {
+			cf.match = func(val interface{}, present bool) bool { return present && in(val) }
+		} else {
+			cf.match = func(val interface{}, present bool) bool { return !present || !in(val) }
+		}
+	case "is_a":
+		if !v1uuidAttrs[attr] {
+			return cf, fmt.Errorf("operator %q is only supported for UUID attributes", op)
+		}
+		kinds, err := v1stringList(operand)
+		if err != nil {
+			return cf, err
+		}
+		cf.match = func(val interface{}, present bool) bool {
+			uuid, ok := val.(string)
+			if !present || !ok {
+				return false
+			}
+			kind, err := kindForUUID(uuid)
+			if err != nil {
+				return false
+			}
+			for _, k := range kinds {
+				if k == kind {
+					return true
+				}
+			}
+			return false
+		}
+	case "exists":
+		if cf.attr != "properties" {
+			return cf, fmt.Errorf("operator %q is only supported for properties", op)
+		}
+		if cf.path == nil {
+			key, ok := operand.(string)
+			if !ok {
+				return cf, fmt.Errorf("operand for %q must be a string", op)
+			}
+			cf.path = []string{key}
+			cf.match = func(val interface{}, present bool) bool { return present }
+		} else {
+			want, ok := operand.(bool)
+			if !ok {
+				return cf, fmt.Errorf("operand for %q on a subproperty must be a boolean", op)
+			}
+			cf.match = func(val interface{}, present bool) bool { return present == want }
+		}
+	case "contains":
+		want, err := v1stringList(operand)
+		if err != nil {
+			return cf, err
+		}
+		cf.match = func(val interface{}, present bool) bool {
+			switch val := val.(type) {
+			case string:
+				return len(want) == 1 && val == want[0]
+			case []interface{}:
+				for _, w := range want {
+					found := false
+					for _, elem := range val {
+						if elem == w {
+							found = true
+							break
+						}
+					}
+					if !found {
+						return false
+					}
+				}
+				return true
+			case map[string]interface{}:
+				for _, w := range want {
+					if _, ok := val[w]; !ok {
+						return false
+					}
+				}
+				return true
+			default:
+				return false
+			}
+		}
+	default:
+		return cf, fmt.Errorf("unsupported operator %q", op)
+	}
+	return cf, nil
+}
+
+// v1equalFunc returns a func that reports whether an attribute value
+// is equal to the given operand.
+func v1equalFunc(operand interface{}, isTime bool) (func(interface{}) bool, error) {
+	if isTime && operand != nil {
+		t, err := v1parseTime(operand)
+		if err != nil {
+			return nil, err
+		}
+		return func(val interface{}) bool {
+			vt, ok := val.(time.Time)
+			return ok && vt.Equal(t)
+		}, nil
+	}
+	switch operand := operand.(type) {
+	case nil:
+		return func(val interface{}) bool {
+			if t, ok := val.(time.Time); ok {
+				return t.IsZero()
+			}
+			return val == nil
+		}, nil
+	case string:
+		return func(val interface{}) bool {
+			switch val := val.(type) {
+			case string:
+				return val == operand
+			case []interface{}, map[string]interface{}:
+				// As in the REST API, an array or
+				// object attribute can be compared
+				// with a JSON-encoded operand.
+				var decoded interface{}
+				return json.Unmarshal([]byte(operand), &decoded) == nil && reflect.DeepEqual(val, decoded)
+			default:
+				return false
+			}
+		}, nil
+	case float64, bool:
+		return func(val interface{}) bool { return val == operand }, nil
+	default:
+		return nil, fmt.Errorf("unsupported operand type %T", operand)
+	}
+}
+
+// v1compareFunc returns a func that compares an attribute value with
+// the given operand, returning -1, 0, or 1 (and true), or false if
+// the value is not comparable with the operand.
+func v1compareFunc(operand interface{}, isTime bool) (func(interface{}) (int, bool), error) {
+	if isTime {
+		t, err := v1parseTime(operand)
+		if err != nil {
+			return nil, err
+		}
+		return func(val interface{}) (int, bool) {
+			vt, ok := val.(time.Time)
+			if !ok || vt.IsZero() {
+				return 0, false
+			} else if vt.Before(t) {
+				return -1, true
+			} else if vt.After(t) {
+				return 1, true
+			}
+			return 0, true
+		}, nil
+	}
+	switch operand := operand.(type) {
+	case string:
+		return func(val interface{}) (int, bool) {
+			s, ok := val.(string)
+			return strings.Compare(s, operand), ok
+		}, nil
+	case float64:
+		return func(val interface{}) (int, bool) {
+			f, ok := val.(float64)
+			if !ok {
+				return 0, false
+			} else if f < operand {
+				return -1, true
+			} else if f > operand {
+				return 1, true
+			}
+			return 0, true
+		}, nil
+	default:
+		return nil, fmt.Errorf("operand must be a string or number, not %T", operand)
+	}
+}
+
+func v1parseTime(operand interface{}) (time.Time, error) {
+	s, ok := operand.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("operand must be a timestamp string, not %T", operand)
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	return t, nil
+}
+
+// v1stringList returns the given operand (a string or an array of
+// strings) as a slice of strings.
+func v1stringList(operand interface{}) ([]string, error) {
+	switch operand := operand.(type) {
+	case string:
+		return []string{operand}, nil
+	case []interface{}:
+		var strs []string
+		for _, elem := range operand {
+			s, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("operand must be a string or an array of strings")
+			}
+			strs = append(strs, s)
+		}
+		return strs, nil
+	default:
+		return nil, fmt.Errorf("operand must be a string or an array of strings")
+	}
+}
+
+// v1likeRegexp converts an SQL LIKE pattern to a regular expression.
+func v1likeRegexp(pattern string, caseInsensitive bool) (*regexp.Regexp, error) {
+	var re strings.Builder
+	if caseInsensitive {
+		re.WriteString("(?is)")
+	} else {
+		re.WriteString("(?s)")
+	}
+	re.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			re.WriteString(".*")
+		case r == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("LIKE pattern must not end with escape character")
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
@@ -0,0 +1,159 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&v1FilterSuite{})
+
+type v1FilterSuite struct{}
+
+func (s *v1FilterSuite) kindForUUID(uuid string) (string, error) {
+	switch {
+	case len(uuid) != 27:
+		return "", errors.New("bad uuid")
+	case uuid[6:11] == "7fd4e":
+		return "arvados#workflow", nil
+	case uuid[6:11] == "xvhdp":
+		return "arvados#containerRequest", nil
+	default:
+		return "", errors.New("unknown type")
+	}
+}
+
+func (s *v1FilterSuite) TestFilters(c *check.C) {
+	t0 := time.Date(2021, 4, 5, 6, 7, 8, 9000, time.UTC)
+	attrs := map[string]interface{}{
+		"id":                float64(1234),
+		"uuid":              "zzzzz-57u5n-abcdefghijklmno",
+		"object_uuid":       "zzzzz-xvhdp-abcdefghijklmno",
+		"object_owner_uuid": "zzzzz-j7d0g-abcdefghijklmno",
+		"object_kind":       "arvados#containerRequest",
+		"event_type":        "update",
+		"event_at":          t0,
+		"created_at":        t0,
+		"properties": map[string]interface{}{
+			"new_attributes": map[string]interface{}{
+				"state": "Final",
+				"name":  "Foo Bar",
+			},
+			"old_attributes": map[string]interface{}{
+				"state": "Committed",
+			},
+		},
+	}
+	for _, trial := range []struct {
+		filters string
+		match   bool
+	}{
+		{`[]`, true},
+		{`[["event_type","=","update"]]`, true},
+		{`[["event_type","=","create"]]`, false},
+		{`[["event_type","!=","create"]]`, true},
+		{`[["event_type","<>","update"]]`, false},
+		{`[["event_type","in",["create","update"]]]`, true},
+		{`[["event_type","not in",["create","update"]]]`, false},
+		{`[["event_type","in",[]]]`, false},
+		{`[["id",">",1000],["id","<=",1234]]`, true},
+		{`[["id",">=",1235]]`, false},
+		{`[["id","=",1234]]`, true},
+		{`[["created_at",">","2021-04-05T06:07:08Z"]]`, true},
+		{`[["created_at",">","2021-04-05T06:07:08.000009Z"]]`, false},
+		{`[["created_at","=","2021-04-05T06:07:08.000009Z"]]`, true},
+		{`[["created_at",">=","2021-04-05T07:07:08.000009+01:00"]]`, true},
+		{`[["event_at","<","2021-04-06T00:00:00Z"]]`, true},
+		{`[["object_uuid","like","zzzzz-xvhdp-%"]]`, true},
+		{`[["object_uuid","like","ZZZZZ-xvhdp-%"]]`, false},
+		{`[["object_uuid","ilike","ZZZZZ-xvhdp-%"]]`, true},
+		{`[["object_uuid","like","zzzzz-xvhdp-_bcdefghijklmno"]]`, true},
+		{`[["object_uuid","like","zzzzz-xvhdp-_"]]`, false},
+		{`[["object_uuid","is_a","arvados#containerRequest"]]`, true},
+		{`[["object_uuid","is_a",["arvados#workflow","arvados#containerRequest"]]]`, true},
+		{`[["object_uuid","is_a","arvados#workflow"]]`, false},
+		{`[["object_kind","=","arvados#containerRequest"]]`, true},
+		{`[["properties.new_attributes.state","=","Final"]]`, true},
+		{`[["properties.new_attributes.state","in",["Committed","Final"]]]`, true},
+		{`[["properties.old_attributes.state","=","Final"]]`, false},
+		{`[["properties.new_attributes.name","ilike","%bar"]]`, true},
+		{`[["properties.new_attributes.missing","=","x"]]`, false},
+		{`[["properties.new_attributes.missing","!=","x"]]`, true},
+		{`[["properties.new_attributes.state","exists",true]]`, true},
+		{`[["properties.old_attributes.name","exists",true]]`, false},
+		{`[["properties.old_attributes.name","exists",false]]`, true},
+		{`[["properties","exists","new_attributes"]]`, true},
+		{`[["properties","exists","text"]]`, false},
+		{`[["properties.new_attributes","contains","state"]]`, true},
+		{`[["properties.new_attributes","contains",["state","name"]]]`, true},
+		{`[["properties.old_attributes","contains",["state","name"]]]`, false},
+		{`[["event_type","=","update"],["properties.new_attributes.state","=","Committed"]]`, false},
+	} {
+		var filters []interface{}
+		c.Assert(json.Unmarshal([]byte(trial.filters), &filters), check.IsNil)
+		compiled, err := compileV1Filters(filters, s.kindForUUID)
+		if !c.Check(err, check.IsNil, check.Commentf("%s", trial.filters)) {
+			continue
+		}
+		sub := v1subscription{filters: compiled}
+		c.Check(sub.match(attrs), check.Equals, trial.match, check.Commentf("%s", trial.filters))
+	}
+}
+
+func (s *v1FilterSuite) TestInvalidFilters(c *check.C) {
+	for _, trial := range []string{
+		`["event_type","=","update"]`,
+		`[["event_type","="]]`,
+		`[["event_type","=","update","extra"]]`,
+		`["event_type = 'update'"]`,
+		`[[1,"=","update"]]`,
+		`[["event_type",1,"update"]]`,
+		`[["no_such_attr","=","update"]]`,
+		`[["event_type","frobnicate","update"]]`,
+		`[["event_type","in","update"]]`,
+		`[["event_type","like",1]]`,
+		`[["event_type","like","abc\\"]]`,
+		`[["event_type","is_a","arvados#workflow"]]`,
+		`[["event_type","exists",true]]`,
+		`[["properties.foo","exists","bar"]]`,
+		`[["created_at",">","yesterday"]]`,
+		`[["id",">",{}]]`,
+		`[["event_type","=",{}]]`,
+	} {
+		var filters []interface{}
+		c.Assert(json.Unmarshal([]byte(trial), &filters), check.IsNil)
+		_, err := compileV1Filters(filters, s.kindForUUID)
+		c.Check(err, check.NotNil, check.Commentf("%s", trial))
+	}
+}
+
+func (s *v1FilterSuite) TestPendingOverflow(c *check.C) {
+	sendq := make(chan interface{}, 2)
+	sub := &v1subscription{id: "1"}
+	sess := &v1session{
+		ac:            &arvados.Client{},
+		sendq:         sendq,
+		subscriptions: map[string]*v1subscription{"1": sub},
+	}
+	for id := uint64(1); id <= 4; id++ {
+		e := &event{LogID: id, logRow: &arvados.Log{ID: id}}
+		c.Check(sess.Filter(e), check.Equals, false)
+		switch {
+		case id <= 2:
+			c.Check(sub.pending, check.HasLen, int(id))
+			c.Check(sub.overflow, check.Equals, false)
+		default:
+			// Events are discarded, to be reloaded
+			// from the database by replay.
+			c.Check(sub.pending, check.HasLen, 0)
+			c.Check(sub.overflow, check.Equals, true)
+		}
+	}
+}
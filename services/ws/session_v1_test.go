@@ -0,0 +1,250 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"golang.org/x/net/websocket"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&v1Suite{})
+
+// v1Suite uses the v0Suite setup and helpers to test the v1
+// protocol.
+type v1Suite struct {
+	v0 v0Suite
+}
+
+type v1message struct {
+	ID            json.RawMessage
+	Status        int
+	Error         string
+	Subscription  string
+	Subscriptions []string
+	Cursor        string
+	Incomplete    bool
+	Event         *arvados.Log
+}
+
+func (s *v1Suite) SetUpTest(c *check.C) {
+	s.v0.SetUpTest(c)
+}
+
+func (s *v1Suite) TearDownTest(c *check.C) {
+	s.v0.TearDownTest(c)
+}
+
+func (s *v1Suite) TearDownSuite(c *check.C) {
+	s.v0.TearDownSuite(c)
+}
+
+func (s *v1Suite) testClient() (*websocket.Conn, *json.Decoder, *json.Encoder) {
+	srv := s.v0.serviceSuite.srv
+	cfg, err := websocket.NewConfig(strings.Replace(srv.URL, "http", "ws", 1)+"/arvados/v1/events.ws", srv.URL)
+	if err != nil {
+		panic(err)
+	}
+	cfg.Header = http.Header{"Authorization": {"Bearer " + s.v0.token}}
+	conn, err := websocket.DialConfig(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return conn, json.NewDecoder(conn), json.NewEncoder(conn)
+}
+
+// expectResponse returns the next response to a client request,
+// skipping any event messages.
+func (s *v1Suite) expectResponse(c *check.C, r *json.Decoder, status int) v1message {
+	for {
+		msg := s.expectMessage(c, r)
+		if msg.Status != 0 {
+			c.Check(msg.Status, check.Equals, status, check.Commentf("%+v", msg))
+			return msg
+		}
+	}
+}
+
+// expectEvent returns the next event message for an event that
+// happened after s.v0.ignoreLogID, skipping any other messages.
+func (s *v1Suite) expectEvent(c *check.C, r *json.Decoder) v1message {
+	for {
+		msg := s.expectMessage(c, r)
+		if msg.Event != nil && msg.Event.ID > s.v0.ignoreLogID {
+			return msg
+		}
+	}
+}
+
+func (s *v1Suite) expectMessage(c *check.C, r *json.Decoder) v1message {
+	var msg v1message
+	ok := make(chan struct{})
+	go func() {
+		c.Check(r.Decode(&msg), check.IsNil)
+		close(ok)
+	}()
+	select {
+	case <-time.After(10 * time.Second):
+		panic("timed out")
+	case <-ok:
+		return msg
+	}
+}
+
+func (s *v1Suite) TestSubscribe(c *check.C) {
+	conn, r, w := s.testClient()
+	defer conn.Close()
+
+	c.Check(w.Encode(map[string]interface{}{"method": "subscribe", "id": "a"}), check.IsNil)
+	msg := s.expectResponse(c, r, 200)
+	c.Check(string(msg.ID), check.Equals, `"a"`)
+	c.Check(msg.Subscription, check.Not(check.Equals), "")
+	c.Check(msg.Cursor, check.Equals, fmt.Sprintf("%d", s.v0.lastLogID(c)))
+	all := msg.Subscription
+
+	c.Check(w.Encode(map[string]interface{}{
+		"method":  "subscribe",
+		"id":      2,
+		"filters": [][]interface{}{{"event_type", "in", []string{"blip"}}, {"properties.beep", "=", "boop"}},
+	}), check.IsNil)
+	msg = s.expectResponse(c, r, 200)
+	c.Check(string(msg.ID), check.Equals, `2`)
+	blips := msg.Subscription
+	c.Check(blips, check.Not(check.Equals), all)
+
+	uuidChan := make(chan string, 1)
+	go s.v0.emitEvents(uuidChan)
+	uuid := <-uuidChan
+
+	for _, etype := range []string{"create", "blip", "update"} {
+		msg := s.expectEvent(c, r)
+		for msg.Event.ObjectUUID != uuid {
+			msg = s.expectEvent(c, r)
+		}
+		c.Check(msg.Event.EventType, check.Equals, etype)
+		c.Check(msg.Cursor, check.Equals, fmt.Sprintf("%d", msg.Event.ID))
+		if etype == "blip" {
+			c.Check(msg.Subscriptions, check.DeepEquals, []string{all, blips})
+		} else {
+			c.Check(msg.Subscriptions, check.DeepEquals, []string{all})
+		}
+	}
+
+	c.Check(w.Encode(map[string]interface{}{"method": "unsubscribe", "id": 3, "subscription": all}), check.IsNil)
+	s.expectResponse(c, r, 200)
+	c.Check(w.Encode(map[string]interface{}{"method": "unsubscribe", "id": 4, "subscription": all}), check.IsNil)
+	s.expectResponse(c, r, 404)
+
+	go s.v0.emitEvents(uuidChan)
+	uuid = <-uuidChan
+	msg = s.expectEvent(c, r)
+	for msg.Event.ObjectUUID != uuid {
+		msg = s.expectEvent(c, r)
+	}
+	c.Check(msg.Event.EventType, check.Equals, "blip")
+	c.Check(msg.Subscriptions, check.DeepEquals, []string{blips})
+}
+
+func (s *v1Suite) TestBadRequests(c *check.C) {
+	conn, r, w := s.testClient()
+	defer conn.Close()
+
+	_, err := fmt.Fprint(conn, "^]beep\n")
+	c.Check(err, check.IsNil)
+	s.expectResponse(c, r, 400)
+
+	for _, req := range []map[string]interface{}{
+		{"method": "frobnicate"},
+		{"method": "subscribe", "filters": "event_type = 'update'"},
+		{"method": "subscribe", "filters": [][]interface{}{{"event_type", "frobnicate", "update"}}},
+		{"method": "subscribe", "filters": [][]interface{}{{"no_such_attr", "=", "update"}}},
+		{"method": "subscribe", "cursor": "abc"},
+	} {
+		c.Check(w.Encode(req), check.IsNil)
+		msg := s.expectResponse(c, r, 400)
+		c.Check(msg.Error, check.Not(check.Equals), "", check.Commentf("%v", req))
+	}
+
+	c.Check(w.Encode(map[string]interface{}{"method": "subscribe"}), check.IsNil)
+	s.expectResponse(c, r, 200)
+}
+
+func (s *v1Suite) TestCursor(c *check.C) {
+	conn, r, w := s.testClient()
+	c.Check(w.Encode(map[string]interface{}{"method": "subscribe"}), check.IsNil)
+	cursor := s.expectResponse(c, r, 200).Cursor
+	conn.Close()
+
+	// Emit events while disconnected.
+	uuidChan := make(chan string, 1)
+	s.v0.emitEvents(uuidChan)
+	uuid := <-uuidChan
+
+	conn, r, w = s.testClient()
+	defer conn.Close()
+	c.Check(w.Encode(map[string]interface{}{
+		"method":  "subscribe",
+		"filters": [][]interface{}{{"object_uuid", "=", uuid}},
+		"cursor":  cursor,
+	}), check.IsNil)
+	msg := s.expectResponse(c, r, 200)
+	c.Check(msg.Cursor, check.Equals, cursor)
+	c.Check(msg.Incomplete, check.Equals, false)
+
+	for _, etype := range []string{"create", "blip", "update"} {
+		msg := s.expectEvent(c, r)
+		c.Check(msg.Event.ObjectUUID, check.Equals, uuid)
+		c.Check(msg.Event.EventType, check.Equals, etype)
+		cursor = msg.Cursor
+	}
+
+	// Subscribing again with the last cursor replays nothing.
+	c.Check(w.Encode(map[string]interface{}{
+		"method":  "subscribe",
+		"filters": [][]interface{}{{"object_uuid", "=", uuid}},
+		"cursor":  cursor,
+	}), check.IsNil)
+	s.expectResponse(c, r, 200)
+
+	// Subscribing with a very old cursor reports that some
+	// events have expired.
+	c.Check(w.Encode(map[string]interface{}{
+		"method":  "subscribe",
+		"filters": [][]interface{}{{"event_type", "=", "no_such_event_type"}},
+		"cursor":  "0",
+	}), check.IsNil)
+	c.Check(s.expectResponse(c, r, 200).Incomplete, check.Equals, true)
+}
+
+func (s *v1Suite) TestPermission(c *check.C) {
+	conn, r, w := s.testClient()
+	defer conn.Close()
+
+	c.Check(w.Encode(map[string]interface{}{"method": "subscribe"}), check.IsNil)
+	s.expectResponse(c, r, 200)
+
+	uuidChan := make(chan string, 2)
+	go func() {
+		s.v0.token = arvadostest.AdminToken
+		s.v0.emitEvents(uuidChan)
+		s.v0.token = arvadostest.ActiveToken
+		s.v0.emitEvents(uuidChan)
+	}()
+
+	wrongUUID := <-uuidChan
+	rightUUID := <-uuidChan
+	msg := s.expectEvent(c, r)
+	for msg.Event.ObjectUUID != rightUUID {
+		c.Check(msg.Event.ObjectUUID, check.Not(check.Equals), wrongUUID)
+		msg = s.expectEvent(c, r)
+	}
+}